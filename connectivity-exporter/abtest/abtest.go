@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package abtest compares the connections seen by the eBPF program with
+// the ones seen by the pcap backend on the same interface. A connection
+// seen by one backend is matched with a connection with the same
+// client, destination and SNI seen by the other one within the
+// tolerance, otherwise it counts as a divergence of the backend which
+// saw it. A regression of the SNI parsing of either backend shows up as
+// divergences of both, one for the right and one for the wrong SNI.
+package abtest
+
+import (
+	"sync"
+	"time"
+
+	"m/metrics"
+	"m/packet"
+)
+
+// Backends are the values of the backend label of the divergences.
+const (
+	EBPF = "ebpf"
+	Pcap = "pcap"
+)
+
+// expireInterval is the minimum time between two checks for
+// connections without a match.
+const expireInterval = time.Second
+
+type key struct {
+	sourceIP, destIP, sni string
+}
+
+// Comparator matches the connections of the backends.
+type Comparator struct {
+	tolerance time.Duration
+
+	mutex      sync.Mutex
+	lastExpire time.Time
+	// pending are the times of the unmatched connections per backend
+	// and key, oldest first.
+	pending map[string]map[key][]time.Time
+}
+
+// NewComparator creates a comparator matching the connections seen by
+// the backends within the tolerance, which has to cover the delay of
+// the accounting of the eBPF program.
+func NewComparator(tolerance time.Duration) *Comparator {
+	return &Comparator{
+		tolerance: tolerance,
+		pending:   map[string]map[key][]time.Time{EBPF: {}, Pcap: {}},
+	}
+}
+
+// ObserveEBPF adds the new connections of an increment of the eBPF
+// program.
+func (c *Comparator) ObserveEBPF(inc *metrics.Inc) {
+	n := int(inc.SuccessfulConnections + inc.RejectedConnections + inc.RejectedConnectionsByClient + inc.RejectedConnectionsByMiddlebox + inc.RejectedConnectionsByNetwork)
+	c.observe(EBPF, key{inc.SourceIP, inc.DestIP, inc.SNI}, n, inc.Time)
+}
+
+// ObservePcap adds a connection of the pcap backend.
+func (c *Comparator) ObservePcap(conn *packet.PcapConnection) {
+	c.observe(Pcap, key{conn.SourceIP, conn.DestIP, conn.SNI}, 1, conn.Time)
+}
+
+func (c *Comparator) observe(backend string, k key, n int, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if n > 0 {
+		other := c.pending[Pcap]
+		if backend == Pcap {
+			other = c.pending[EBPF]
+		}
+		matched := n
+		if len(other[k]) < matched {
+			matched = len(other[k])
+		}
+		if matched > 0 {
+			metrics.AddBackendMatches(k.sni, matched)
+			other[k] = other[k][matched:]
+			if len(other[k]) == 0 {
+				delete(other, k)
+			}
+		}
+		for i := matched; i < n; i++ {
+			c.pending[backend][k] = append(c.pending[backend][k], now)
+		}
+	}
+	if now.Sub(c.lastExpire) >= expireInterval {
+		c.expire(now)
+		c.lastExpire = now
+	}
+}
+
+// expire counts the connections without a match within the tolerance
+// as divergences.
+func (c *Comparator) expire(now time.Time) {
+	for backend, pending := range c.pending {
+		for k, times := range pending {
+			expired := 0
+			for expired < len(times) && now.Sub(times[expired]) > c.tolerance {
+				expired++
+			}
+			if expired == 0 {
+				continue
+			}
+			metrics.AddBackendDivergences(backend, k.sni, expired)
+			if expired == len(times) {
+				delete(pending, k)
+			} else {
+				pending[k] = times[expired:]
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package abtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+	"m/packet"
+)
+
+func TestComparator(t *testing.T) {
+	c := NewComparator(10 * time.Second)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	pcap := func(second int, sourceIP, sni string) {
+		c.ObservePcap(&packet.PcapConnection{SourceIP: sourceIP, DestIP: "192.168.0.1", SNI: sni, Time: start.Add(time.Duration(second) * time.Second)})
+	}
+	ebpf := func(second int, sourceIP, sni string, successful, rejected float64) {
+		c.ObserveEBPF(&metrics.Inc{
+			SNI:                   sni,
+			SourceIP:              sourceIP,
+			DestIP:                "192.168.0.1",
+			SuccessfulConnections: successful,
+			RejectedConnections:   rejected,
+			Time:                  start.Add(time.Duration(second) * time.Second),
+		})
+	}
+	// The eBPF program accounts the connections seen by the pcap
+	// backend later.
+	pcap(0, "10.0.0.1", "ab.example.com")
+	pcap(0, "10.0.0.1", "ab.example.com")
+	pcap(1, "10.0.0.2", "ab.example.com")
+	ebpf(3, "10.0.0.1", "ab.example.com", 1, 1)
+	// A regression of the SNI parsing of the eBPF program.
+	ebpf(4, "10.0.0.2", packet.UnknownSNI, 0, 1)
+	// Expires all unmatched connections.
+	ebpf(20, "10.0.0.3", "other.example.com", 0, 0)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_backend_divergences_total Total number of connections seen only by the backend.
+		# TYPE connectivity_exporter_backend_divergences_total counter
+		connectivity_exporter_backend_divergences_total{backend="ebpf",sni="unknown"} 1
+		connectivity_exporter_backend_divergences_total{backend="pcap",sni="ab.example.com"} 1
+		# HELP connectivity_exporter_backend_matches_total Total number of connections seen by both the eBPF and the pcap backend.
+		# TYPE connectivity_exporter_backend_matches_total counter
+		connectivity_exporter_backend_matches_total{sni="ab.example.com"} 2
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_backend_divergences_total",
+		"connectivity_exporter_backend_matches_total",
+	); err != nil {
+		t.Error(err)
+	}
+	if len(c.pending[EBPF])+len(c.pending[Pcap]) != 0 {
+		t.Errorf("Unexpected pending connections: %v", c.pending)
+	}
+}
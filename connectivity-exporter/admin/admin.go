@@ -0,0 +1,513 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+
+	"m/config"
+	"m/discovery"
+	"m/events"
+	"m/metrics"
+	"m/packet"
+	"m/rollup"
+	"m/testwindow"
+)
+
+// DataSource is the source of the connections that can be reloaded
+// with another capture filter.
+type DataSource interface {
+	Filter() (networkInterface string, cidrs, ports []string)
+	PlanReload(networkInterface string, cidrs, ports map[string]struct{}) (*packet.ReloadPlan, error)
+	Reload(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}) error
+	StartCanary(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}, candidate *config.Config) error
+	StopCanary(ctx context.Context) error
+	Canary() *packet.CanaryStatus
+}
+
+// Register adds the admin API handlers to the mux. The timeline of the
+// seconds, the connection events and the discovered destinations are
+// only served if they are not nil. The self-test runs after a reload of
+// the data source, a failure rolls the reload back. It is skipped if it
+// is nil.
+func Register(mux *http.ServeMux, store *config.Store, testWindows *testwindow.Registry, rollups *rollup.Tracker, timeline *metrics.Timeline, connections *events.Buffer, discovered *discovery.Tracker, dataSource DataSource, selfTest func(context.Context) error) {
+	mux.HandleFunc("/admin/config", configHandler(store))
+	mux.HandleFunc("/admin/maintenance", maintenanceHandler(store))
+	mux.HandleFunc("/admin/drain", drainHandler(store))
+	mux.HandleFunc(testWindowsPath, testWindowsHandler(testWindows))
+	mux.HandleFunc("/admin/rollups", rollupsHandler(rollups))
+	mux.HandleFunc("/admin/datasource", dataSourceHandler(dataSource, selfTest))
+	mux.HandleFunc("/admin/canary", canaryHandler(dataSource))
+	if timeline != nil {
+		mux.HandleFunc("/admin/seconds", timelineHandler(timeline))
+	}
+	if connections != nil {
+		mux.HandleFunc("/admin/connections", connectionsHandler(connections))
+	}
+	if discovered != nil {
+		mux.HandleFunc("/admin/discovery", discoveryHandler(discovered))
+	}
+}
+
+// configHandler returns the current configuration on GET and
+// replaces it on PUT. With the query parameter dryRun=true, the
+// configuration is only validated.
+func configHandler(store *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, store.Get())
+		case http.MethodPut:
+			cfg := &config.Config{}
+			if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+				http.Error(w, fmt.Sprintf("decoding config: %v", err), http.StatusBadRequest)
+				return
+			}
+			if dryRun(r) {
+				if err := cfg.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				writeJSON(w, cfg)
+				return
+			}
+			if err := store.Set(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			klog.Infof("Configuration replaced via admin API")
+			writeJSON(w, cfg)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// maintenanceRequest declares a maintenance window for an SNI pattern.
+type maintenanceRequest struct {
+	SNI string `json:"sni"`
+	config.Window
+}
+
+// maintenanceHandler lists the maintenance windows on GET, adds a
+// window on POST and removes all windows of an SNI pattern on DELETE.
+func maintenanceHandler(store *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			windows := map[string][]config.Window{}
+			for _, rule := range store.Get().Rules {
+				if len(rule.MaintenanceWindows) > 0 {
+					windows[rule.SNI] = rule.MaintenanceWindows
+				}
+			}
+			writeJSON(w, windows)
+		case http.MethodPost:
+			req := maintenanceRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("decoding maintenance window: %v", err), http.StatusBadRequest)
+				return
+			}
+			err := store.Update(func(cfg *config.Config) error {
+				rule := findRule(cfg, req.SNI)
+				rule.MaintenanceWindows = append(rule.MaintenanceWindows, req.Window)
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			klog.Infof("Maintenance window for %q added: %s - %s", req.SNI, req.Start, req.End)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			sni := r.URL.Query().Get("sni")
+			err := store.Update(func(cfg *config.Config) error {
+				for i := range cfg.Rules {
+					if cfg.Rules[i].SNI == sni {
+						cfg.Rules[i].MaintenanceWindows = nil
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			klog.Infof("Maintenance windows for %q removed", sni)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// drainHandler returns whether the node is draining on GET, marks it
+// as draining on PUT and clears the mark on DELETE.
+func drainHandler(store *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var draining bool
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, map[string]bool{"draining": store.Get().Draining})
+			return
+		case http.MethodPut:
+			draining = true
+		case http.MethodDelete:
+			draining = false
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := store.Update(func(cfg *config.Config) error {
+			cfg.Draining = draining
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		klog.Infof("Node draining set to %t via admin API", draining)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// filter selects the captured connections.
+type filter struct {
+	Interface string   `json:"interface"`
+	CIDRs     []string `json:"cidrs"`
+	Ports     []string `json:"ports"`
+}
+
+// reloadResult is the response of a reload of the data source.
+type reloadResult struct {
+	Filter filter             `json:"filter"`
+	Plan   *packet.ReloadPlan `json:"plan"`
+	// Error is the failure of the self-test, after which the previous
+	// filter was restored.
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolledBack,omitempty"`
+}
+
+// dataSourceHandler returns the capture filter on GET and reloads the
+// data source with a new filter on PUT. With the query parameter
+// dryRun=true, the filter is only validated and the changes of the
+// eBPF maps a reload would apply are returned. Otherwise the self-test
+// runs after the reload and the previous filter is restored if it
+// fails.
+func dataSourceHandler(dataSource DataSource, selfTest func(context.Context) error) http.HandlerFunc {
+	// Reloads are serialized, so a rollback restores the filter of
+	// its own reload.
+	var reloads sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			f := filter{}
+			f.Interface, f.CIDRs, f.Ports = dataSource.Filter()
+			writeJSON(w, f)
+		case http.MethodPut:
+			f := filter{}
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				http.Error(w, fmt.Sprintf("decoding filter: %v", err), http.StatusBadRequest)
+				return
+			}
+			reloads.Lock()
+			defer reloads.Unlock()
+			plan, err := dataSource.PlanReload(f.Interface, asSet(f.CIDRs), asSet(f.Ports))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			result := reloadResult{Filter: f, Plan: plan}
+			if dryRun(r) {
+				writeJSON(w, result)
+				return
+			}
+			previous := filter{}
+			previous.Interface, previous.CIDRs, previous.Ports = dataSource.Filter()
+			if err := dataSource.Reload(r.Context(), f.Interface, asSet(f.CIDRs), asSet(f.Ports)); err != nil {
+				http.Error(w, fmt.Sprintf("reloading data source: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if selfTest != nil {
+				if err := selfTest(r.Context()); err != nil {
+					klog.Errorf("The self-test failed after the reload, restoring the previous filter: %v", err)
+					result.Error = err.Error()
+					if err := dataSource.Reload(r.Context(), previous.Interface, asSet(previous.CIDRs), asSet(previous.Ports)); err != nil {
+						klog.Errorf("Failed to restore the previous filter: %v", err)
+						result.Error += fmt.Sprintf("; restoring the previous filter: %v", err)
+					} else {
+						result.RolledBack = true
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(result)
+					return
+				}
+			}
+			writeJSON(w, result)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// canaryRequest is the candidate filter and, optionally, the candidate
+// configuration of a canary.
+type canaryRequest struct {
+	filter
+	Config *config.Config `json:"config,omitempty"`
+}
+
+// canaryHandler returns the running canary on GET, starts a canary on
+// PUT and stops it on DELETE.
+func canaryHandler(dataSource DataSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, dataSource.Canary())
+		case http.MethodPut:
+			req := canaryRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("decoding canary: %v", err), http.StatusBadRequest)
+				return
+			}
+			if _, err := dataSource.PlanReload(req.Interface, asSet(req.CIDRs), asSet(req.Ports)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Config != nil {
+				if err := req.Config.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := dataSource.StartCanary(r.Context(), req.Interface, asSet(req.CIDRs), asSet(req.Ports), req.Config); err != nil {
+				http.Error(w, fmt.Sprintf("starting canary: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, dataSource.Canary())
+		case http.MethodDelete:
+			if err := dataSource.StopCanary(r.Context()); err != nil {
+				http.Error(w, fmt.Sprintf("stopping canary: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func dryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return dryRun
+}
+
+func asSet(list []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+const testWindowsPath = "/admin/test-windows/"
+
+// testWindowsHandler registers a test window on POST to the
+// collection, and returns or removes the report of a window on GET or
+// DELETE of the window.
+func testWindowsHandler(registry *testwindow.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, testWindowsPath)
+		if id == "" {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			spec := testwindow.Spec{}
+			if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+				http.Error(w, fmt.Sprintf("decoding test window: %v", err), http.StatusBadRequest)
+				return
+			}
+			id, err := registry.Add(spec)
+			if errors.Is(err, testwindow.ErrTooManyWindows) {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			klog.Infof("Test window %s for %q added: %s - %s", id, spec.SNI, spec.Start, spec.End)
+			w.Header().Set("Location", testWindowsPath+id)
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, map[string]string{"id": id})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			report, ok := registry.Report(id, time.Now())
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, report)
+		case http.MethodDelete:
+			if !registry.Delete(id) {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// rollupsHandler returns the rollups of a period on GET. The query
+// parameters are the SNI pattern, all SNIs by default, and the period,
+// by default the month.
+func rollupsHandler(rollups *rollup.Tracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sni := r.URL.Query().Get("sni")
+		if sni == "" {
+			sni = "*"
+		}
+		period := rollup.Period(r.URL.Query().Get("period"))
+		if period == "" {
+			period = rollup.Month
+		}
+		out, err := rollups.Query(sni, period)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, out)
+	}
+}
+
+// timelineHandler returns the timestamped values of the seconds
+// counters on GET. The since query parameter is a Unix time in
+// seconds, the complete buckets ending after it are returned.
+func timelineHandler(timeline *metrics.Timeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var since time.Time
+		if s := r.URL.Query().Get("since"); s != "" {
+			unix, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid since %q: %v", s, err), http.StatusBadRequest)
+				return
+			}
+			since = time.Unix(unix, 0)
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		if err := timeline.WriteSince(w, since); err != nil {
+			klog.Errorf("Failed to write response: %v", err)
+		}
+	}
+}
+
+// connectionsHandler returns the buffered connection events on GET.
+// The query parameters sni, a pattern, source and outcome filter the
+// events, since and until are Unix times in seconds.
+func connectionsHandler(connections *events.Buffer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		f := events.Filter{SNI: query.Get("sni"), SourceIP: query.Get("source"), Outcome: query.Get("outcome")}
+		for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+			s := query.Get(name)
+			if s == "" {
+				continue
+			}
+			unix, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q: %v", name, s, err), http.StatusBadRequest)
+				return
+			}
+			*t = time.Unix(unix, 0)
+		}
+		out, err := connections.Query(f, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, out)
+	}
+}
+
+// discoveryHandler returns the destinations the primary filter does not
+// monitor on GET, the ones with the most connections first. The limit
+// query parameter caps their number, all of them by default.
+func discoveryHandler(discovered *discovery.Tracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var limit int
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, discovered.Ranked(limit, time.Now()))
+	}
+}
+
+// findRule returns the rule with exactly the given SNI pattern. If
+// there is none, a copy of the rule matching the pattern so far is
+// prepended, so it takes precedence over broader patterns without
+// dropping their settings.
+func findRule(cfg *config.Config, sni string) *config.Rule {
+	for i := range cfg.Rules {
+		if cfg.Rules[i].SNI == sni {
+			return &cfg.Rules[i]
+		}
+	}
+	rule := config.Rule{SNI: sni}
+	if match := cfg.RuleFor(sni); match != nil {
+		rule = *match
+		rule.SNI = sni
+		// The windows are appended to, so they must not share the
+		// backing array of the broader rule.
+		rule.MaintenanceWindows = append([]config.Window(nil), match.MaintenanceWindows...)
+	}
+	cfg.Rules = append([]config.Rule{rule}, cfg.Rules...)
+	return &cfg.Rules[0]
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Failed to write response: %v", err)
+	}
+}
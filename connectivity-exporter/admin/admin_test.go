@@ -0,0 +1,246 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"m/config"
+	"m/packet"
+)
+
+// fakeDataSource records the reloads and canaries instead of loading
+// the eBPF program.
+type fakeDataSource struct {
+	networkInterface string
+	cidrs, ports     []string
+	reloads          int
+	canary           *packet.CanaryStatus
+}
+
+func (f *fakeDataSource) Filter() (string, []string, []string) {
+	return f.networkInterface, f.cidrs, f.ports
+}
+
+func (f *fakeDataSource) PlanReload(networkInterface string, cidrs, ports map[string]struct{}) (*packet.ReloadPlan, error) {
+	if networkInterface == "" {
+		return nil, errors.New("no network interface")
+	}
+	return &packet.ReloadPlan{}, nil
+}
+
+func (f *fakeDataSource) Reload(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}) error {
+	f.reloads++
+	f.networkInterface, f.cidrs, f.ports = networkInterface, keys(cidrs), keys(ports)
+	return nil
+}
+
+func (f *fakeDataSource) StartCanary(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}, candidate *config.Config) error {
+	f.canary = &packet.CanaryStatus{Interface: networkInterface, CIDRs: keys(cidrs), Ports: keys(ports), Config: candidate}
+	return nil
+}
+
+func (f *fakeDataSource) StopCanary(ctx context.Context) error {
+	f.canary = nil
+	return nil
+}
+
+func (f *fakeDataSource) Canary() *packet.CanaryStatus {
+	return f.canary
+}
+
+func keys(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for k := range set {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func assert(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func serve(t *testing.T, handler http.HandlerFunc, method, target, body string, wantStatus int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if w.Code != wantStatus {
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, target, w.Code, wantStatus, w.Body.String())
+	}
+	return w
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	slo := &config.SLO{Target: 0.999}
+	store := config.NewStore(&config.Config{Rules: []config.Rule{
+		{SNI: "*.example.com", SLO: slo, DetectHandshakeOnly: true, MinFailedConnections: 3},
+	}})
+	handler := maintenanceHandler(store)
+
+	serve(t, handler, http.MethodPost, "/admin/maintenance", `{"sni": "db.example.com", "start": "2022-05-01T10:00:00Z", "end": "2022-05-01T11:00:00Z"}`, http.StatusCreated)
+	window := config.Window{Start: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC), End: time.Date(2022, 5, 1, 11, 0, 0, 0, time.UTC)}
+
+	// The new exact rule keeps the settings of the wildcard rule that
+	// applied before.
+	cfg := store.Get()
+	rule := cfg.RuleFor("db.example.com")
+	want := config.Rule{SNI: "db.example.com", MaintenanceWindows: []config.Window{window}, SLO: slo, DetectHandshakeOnly: true, MinFailedConnections: 3}
+	if !reflect.DeepEqual(*rule, want) {
+		t.Errorf("Got rule %+v, want %+v", *rule, want)
+	}
+	if got := cfg.RuleFor("api.example.com"); got.SNI != "*.example.com" || len(got.MaintenanceWindows) != 0 {
+		t.Errorf("Got rule %+v for another SNI, want the wildcard rule without windows", *got)
+	}
+	if !cfg.InMaintenance("db.example.com", window.Start) || cfg.InMaintenance("api.example.com", window.Start) {
+		t.Errorf("Got the maintenance window applied to the wrong SNIs")
+	}
+
+	w := serve(t, handler, http.MethodGet, "/admin/maintenance", "", http.StatusOK)
+	windows := map[string][]config.Window{}
+	if err := json.NewDecoder(w.Body).Decode(&windows); err != nil {
+		t.Fatalf("Decoding windows: %v", err)
+	}
+	if want := map[string][]config.Window{"db.example.com": {window}}; !reflect.DeepEqual(windows, want) {
+		t.Errorf("Got windows %+v, want %+v", windows, want)
+	}
+
+	serve(t, handler, http.MethodDelete, "/admin/maintenance?sni=db.example.com", "", http.StatusNoContent)
+	if store.Get().InMaintenance("db.example.com", window.Start) {
+		t.Errorf("Got the SNI still in maintenance after deleting its windows")
+	}
+	serve(t, handler, http.MethodPatch, "/admin/maintenance", "", http.StatusMethodNotAllowed)
+}
+
+func TestDrainHandler(t *testing.T) {
+	store := config.NewStore(nil)
+	handler := drainHandler(store)
+	draining := func() bool {
+		w := serve(t, handler, http.MethodGet, "/admin/drain", "", http.StatusOK)
+		got := map[string]bool{}
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("Decoding drain status: %v", err)
+		}
+		return got["draining"]
+	}
+
+	serve(t, handler, http.MethodPut, "/admin/drain", "", http.StatusNoContent)
+	if !draining() || !store.Get().InMaintenance("db.example.com", time.Now()) {
+		t.Errorf("Got the node not draining after PUT")
+	}
+	serve(t, handler, http.MethodDelete, "/admin/drain", "", http.StatusNoContent)
+	if draining() {
+		t.Errorf("Got the node draining after DELETE")
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	store := config.NewStore(nil)
+	handler := configHandler(store)
+
+	// A dry run validates without replacing the configuration.
+	serve(t, handler, http.MethodPut, "/admin/config?dryRun=true", `{"carryOver": "sni"}`, http.StatusOK)
+	serve(t, handler, http.MethodPut, "/admin/config?dryRun=true", `{"carryOver": "invalid"}`, http.StatusBadRequest)
+	if got := store.Get().CarryOver; got != "" {
+		t.Errorf("Got carry-over %q after a dry run, want none", got)
+	}
+
+	serve(t, handler, http.MethodPut, "/admin/config", `{"carryOver": "sni"}`, http.StatusOK)
+	serve(t, handler, http.MethodPut, "/admin/config", `{"carryOver": "invalid"}`, http.StatusBadRequest)
+	if got := store.Get().CarryOver; got != config.CarryOverSNI {
+		t.Errorf("Got carry-over %q, want %q", got, config.CarryOverSNI)
+	}
+}
+
+func TestDataSourceHandler(t *testing.T) {
+	dataSource := &fakeDataSource{networkInterface: "eth0", cidrs: []string{"10.0.0.0/8"}, ports: []string{"443"}}
+	var selfTestErr error
+	selfTests := 0
+	handler := dataSourceHandler(dataSource, func(context.Context) error {
+		selfTests++
+		return selfTestErr
+	})
+	filterOf := func(w *httptest.ResponseRecorder) (reloadResult, filter) {
+		result := reloadResult{}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Decoding reload result: %v", err)
+		}
+		current := filter{}
+		current.Interface, current.CIDRs, current.Ports = dataSource.Filter()
+		return result, current
+	}
+	previous := filter{Interface: "eth0", CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"443"}}
+	next := filter{Interface: "eth1", CIDRs: []string{"192.168.0.0/16"}, Ports: []string{"8443"}}
+	body := `{"interface": "eth1", "cidrs": ["192.168.0.0/16"], "ports": ["8443"]}`
+
+	// A dry run only plans the reload.
+	result, current := filterOf(serve(t, handler, http.MethodPut, "/admin/datasource?dryRun=true", body, http.StatusOK))
+	if result.Plan == nil || !reflect.DeepEqual(result.Filter, next) {
+		t.Errorf("Got dry run result %+v, want the plan of %+v", result, next)
+	}
+	assert(t, current, previous)
+	serve(t, handler, http.MethodPut, "/admin/datasource", `{"cidrs": ["192.168.0.0/16"]}`, http.StatusBadRequest)
+	assert(t, [2]int{dataSource.reloads, selfTests}, [2]int{0, 0})
+
+	// A failed self-test restores the previous filter.
+	selfTestErr = errors.New("no connections accounted")
+	result, current = filterOf(serve(t, handler, http.MethodPut, "/admin/datasource", body, http.StatusInternalServerError))
+	if !result.RolledBack || result.Error != "no connections accounted" {
+		t.Errorf("Got result %+v, want the rollback after the self-test error", result)
+	}
+	assert(t, current, previous)
+	assert(t, [2]int{dataSource.reloads, selfTests}, [2]int{2, 1})
+
+	selfTestErr = nil
+	result, current = filterOf(serve(t, handler, http.MethodPut, "/admin/datasource", body, http.StatusOK))
+	if result.RolledBack || result.Error != "" {
+		t.Errorf("Got result %+v, want a reload without errors", result)
+	}
+	assert(t, current, next)
+	assert(t, [2]int{dataSource.reloads, selfTests}, [2]int{3, 2})
+}
+
+func TestCanaryHandler(t *testing.T) {
+	dataSource := &fakeDataSource{networkInterface: "eth0"}
+	handler := canaryHandler(dataSource)
+
+	// Invalid filters and configurations do not start a canary.
+	serve(t, handler, http.MethodPut, "/admin/canary", `{"cidrs": ["10.0.0.0/8"]}`, http.StatusBadRequest)
+	serve(t, handler, http.MethodPut, "/admin/canary", `{"interface": "eth1", "config": {"carryOver": "invalid"}}`, http.StatusBadRequest)
+	if dataSource.canary != nil {
+		t.Fatalf("Got canary %+v started with an invalid request", dataSource.canary)
+	}
+
+	w := serve(t, handler, http.MethodPut, "/admin/canary", `{"interface": "eth1", "cidrs": ["10.0.0.0/8"], "ports": ["443"], "config": {"carryOver": "sni"}}`, http.StatusOK)
+	got := &packet.CanaryStatus{}
+	if err := json.NewDecoder(w.Body).Decode(got); err != nil {
+		t.Fatalf("Decoding canary: %v", err)
+	}
+	want := &packet.CanaryStatus{Interface: "eth1", CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"443"}, Config: &config.Config{CarryOver: config.CarryOverSNI}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got canary %+v, want %+v", got, want)
+	}
+	if dataSource.reloads != 0 {
+		t.Errorf("Got %d reloads of the running data source by the canary", dataSource.reloads)
+	}
+
+	serve(t, handler, http.MethodDelete, "/admin/canary", "", http.StatusNoContent)
+	if dataSource.canary != nil {
+		t.Errorf("Got canary %+v after DELETE", dataSource.canary)
+	}
+}
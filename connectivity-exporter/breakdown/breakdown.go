@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package breakdown accounts the seconds per destination and per
+// client, and the views per SNI only and per CIDR group only. The
+// increments are accounted per connection key, which mixes
+// the client and the destination, so summing them up counts a second
+// once for every client connecting in it. A breakdown counts a second
+// of a destination once, active if it was active for any of its
+// clients and failed if it failed for any of them, and likewise for a
+// client, an SNI or a CIDR group.
+package breakdown
+
+import (
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Dimension is the label the seconds of an SNI are broken down by.
+// The seconds of SNI are aggregated over the clients and destinations
+// of an SNI, those of CIDRGroup over the SNIs and clients of the
+// destinations in a CIDR group.
+type Dimension string
+
+const (
+	Destination Dimension = "dest_ip"
+	Client      Dimension = "source_ip"
+	SNI         Dimension = "sni"
+	CIDRGroup   Dimension = "cidr_group"
+)
+
+// Other is the value of the dimension the increments are accounted
+// for once the series limit is reached.
+const Other = "other"
+
+// roundGap is the minimum time between the increments of two
+// accounting rounds. The increments of one round arrive together, the
+// rounds are a second apart.
+const roundGap = time.Second / 2
+
+type key struct {
+	sni, value string
+}
+
+// Tracker aggregates the increments of an accounting round per SNI and
+// value of the dimension.
+type Tracker struct {
+	dimension Dimension
+	limit     int
+	latencies bool
+	// groupOf returns the CIDR group of a destination IP, or an empty
+	// string if there is none.
+	groupOf func(destIP string) string
+
+	mutex sync.Mutex
+	// round is the time of the first increment of the current round.
+	round   time.Time
+	pending map[key]*metrics.Inc
+	// series are the keys with series and the time of their last
+	// update.
+	series map[key]time.Time
+}
+
+// NewTracker creates a tracker exporting at most limit series per kind.
+// The increments of further values are accounted for Other.
+func NewTracker(dimension Dimension, limit int) *Tracker {
+	return &Tracker{
+		dimension: dimension,
+		limit:     limit,
+		pending:   make(map[key]*metrics.Inc),
+		series:    make(map[key]time.Time),
+	}
+}
+
+// NewCIDRGroupTracker creates a tracker of the CIDR groups of the
+// destinations, as returned by groupOf. The increments of destinations
+// without a CIDR group are not accounted.
+func NewCIDRGroupTracker(groupOf func(destIP string) string, limit int) *Tracker {
+	t := NewTracker(CIDRGroup, limit)
+	t.groupOf = groupOf
+	return t
+}
+
+// EnableLatencyHistograms exports a histogram of the connect latencies
+// per destination, within the same series limit. It has no effect on
+// the clients.
+func (t *Tracker) EnableLatencyHistograms() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.latencies = t.dimension == Destination
+}
+
+// Observe adds the increment to the current round. The previous round
+// is exported when the first increment of the next round arrives.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.round.IsZero() || inc.Time.Sub(t.round) >= roundGap {
+		t.flush()
+		t.expire(inc.Time)
+		t.round = inc.Time
+	}
+	k, ok := t.keyOf(inc)
+	if !ok {
+		return
+	}
+	if t.latencies && len(inc.ConnectLatencies) > 0 {
+		metrics.ObserveDestinationConnectLatencies(k.sni, k.value, inc.ConnectLatencies)
+	}
+	p, ok := t.pending[k]
+	if !ok {
+		p = &metrics.Inc{SNI: k.sni, Time: t.round}
+		t.pending[k] = p
+	}
+	// A second is active or failed if it is for any connection key.
+	p.ActiveSeconds = maxFloat(p.ActiveSeconds, inc.ActiveSeconds)
+	p.FailedSeconds = maxFloat(p.FailedSeconds, inc.FailedSeconds)
+	p.ActiveFailedSeconds = maxFloat(p.ActiveFailedSeconds, inc.ActiveFailedSeconds)
+	p.SuccessfulConnections += inc.SuccessfulConnections
+	p.RejectedConnections += inc.RejectedConnections + inc.RejectedConnectionsByClient + inc.RejectedConnectionsByMiddlebox + inc.RejectedConnectionsByNetwork
+}
+
+// keyOf returns the key of the increment, which is false for the
+// increments not accounted by the tracker.
+func (t *Tracker) keyOf(inc *metrics.Inc) (key, bool) {
+	var k key
+	switch t.dimension {
+	case Client:
+		k = key{sni: inc.SNI, value: inc.SourceIP}
+	case SNI:
+		k = key{sni: inc.SNI}
+	case CIDRGroup:
+		k = key{value: t.groupOf(inc.DestIP)}
+		if k.value == "" {
+			return k, false
+		}
+	default:
+		k = key{sni: inc.SNI, value: inc.DestIP}
+	}
+	if _, ok := t.series[k]; ok {
+		return k, true
+	}
+	if len(t.series) >= t.limit {
+		if t.dimension == SNI {
+			k.sni = Other
+		} else {
+			k.value = Other
+		}
+	}
+	t.series[k] = t.round
+	return k, true
+}
+
+// flush exports the aggregated increments of the current round.
+func (t *Tracker) flush() {
+	for k, p := range t.pending {
+		metrics.AddBreakdown(string(t.dimension), k.sni, k.value, p)
+		t.series[k] = t.round
+		delete(t.pending, k)
+	}
+}
+
+// expire deletes the series without updates for longer than the
+// expiration of the metrics, which frees their slots for other values.
+func (t *Tracker) expire(now time.Time) {
+	for k, lastUpdate := range t.series {
+		if lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteBreakdown(string(t.dimension), k.sni, k.value)
+			delete(t.series, k)
+		}
+	}
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,176 @@
+package breakdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+)
+
+func TestTracker(t *testing.T) {
+	destinations := NewTracker(Destination, 2)
+	clients := NewTracker(Client, 10)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(second int, sourceIP, destIP string, active, failed float64) {
+		inc := &metrics.Inc{
+			SNI:                   "api.example.com",
+			SourceIP:              sourceIP,
+			DestIP:                destIP,
+			ActiveSeconds:         active,
+			ActiveFailedSeconds:   failed,
+			SuccessfulConnections: active - failed,
+			RejectedConnections:   failed,
+			// The increments of a round are not accounted at the same
+			// time.
+			Time: start.Add(time.Duration(second)*time.Second + time.Duration(len(sourceIP))*time.Microsecond),
+		}
+		destinations.Observe(inc)
+		clients.Observe(inc)
+	}
+	// Two clients of a destination count one second, which failed for
+	// one of them.
+	observe(0, "10.0.0.1", "192.168.0.1", 1, 0)
+	observe(0, "10.0.0.20", "192.168.0.1", 1, 1)
+	observe(0, "10.0.0.1", "192.168.0.2", 1, 0)
+	// Exceeds the limit of the destinations.
+	observe(0, "10.0.0.1", "192.168.0.3", 1, 0)
+	observe(1, "10.0.0.1", "192.168.0.1", 1, 0)
+	// Closes the second round.
+	observe(2, "10.0.0.1", "192.168.0.1", 0, 0)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_client_seconds_total Total number of seconds per client, a second counts once for all the destinations.
+		# TYPE connectivity_exporter_client_seconds_total counter
+		connectivity_exporter_client_seconds_total{kind="active",sni="api.example.com",source_ip="10.0.0.1"} 2
+		connectivity_exporter_client_seconds_total{kind="active",sni="api.example.com",source_ip="10.0.0.20"} 1
+		connectivity_exporter_client_seconds_total{kind="active_failed",sni="api.example.com",source_ip="10.0.0.1"} 0
+		connectivity_exporter_client_seconds_total{kind="active_failed",sni="api.example.com",source_ip="10.0.0.20"} 1
+		connectivity_exporter_client_seconds_total{kind="failed",sni="api.example.com",source_ip="10.0.0.1"} 0
+		connectivity_exporter_client_seconds_total{kind="failed",sni="api.example.com",source_ip="10.0.0.20"} 0
+		# HELP connectivity_exporter_destination_connections_total Total number of new connections per destination.
+		# TYPE connectivity_exporter_destination_connections_total counter
+		connectivity_exporter_destination_connections_total{dest_ip="192.168.0.1",kind="rejected",sni="api.example.com"} 1
+		connectivity_exporter_destination_connections_total{dest_ip="192.168.0.1",kind="successful",sni="api.example.com"} 2
+		connectivity_exporter_destination_connections_total{dest_ip="192.168.0.2",kind="rejected",sni="api.example.com"} 0
+		connectivity_exporter_destination_connections_total{dest_ip="192.168.0.2",kind="successful",sni="api.example.com"} 1
+		connectivity_exporter_destination_connections_total{dest_ip="other",kind="rejected",sni="api.example.com"} 0
+		connectivity_exporter_destination_connections_total{dest_ip="other",kind="successful",sni="api.example.com"} 1
+		# HELP connectivity_exporter_destination_seconds_total Total number of seconds per destination, a second counts once for all the clients.
+		# TYPE connectivity_exporter_destination_seconds_total counter
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.1",kind="active",sni="api.example.com"} 2
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.1",kind="active_failed",sni="api.example.com"} 1
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.1",kind="failed",sni="api.example.com"} 0
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.2",kind="active",sni="api.example.com"} 1
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.2",kind="active_failed",sni="api.example.com"} 0
+		connectivity_exporter_destination_seconds_total{dest_ip="192.168.0.2",kind="failed",sni="api.example.com"} 0
+		connectivity_exporter_destination_seconds_total{dest_ip="other",kind="active",sni="api.example.com"} 1
+		connectivity_exporter_destination_seconds_total{dest_ip="other",kind="active_failed",sni="api.example.com"} 0
+		connectivity_exporter_destination_seconds_total{dest_ip="other",kind="failed",sni="api.example.com"} 0
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_client_seconds_total",
+		"connectivity_exporter_destination_connections_total",
+		"connectivity_exporter_destination_seconds_total",
+	); err != nil {
+		t.Error(err)
+	}
+
+	// The series expire without updates.
+	observe(2+int(metrics.Expiration/time.Second)+1, "10.0.0.1", "192.168.0.2", 1, 0)
+	if _, ok := destinations.series[key{"api.example.com", "192.168.0.1"}]; ok {
+		t.Errorf("The series of 192.168.0.1 should be expired")
+	}
+}
+
+func TestViews(t *testing.T) {
+	snis := NewTracker(SNI, 1)
+	groups := NewCIDRGroupTracker(func(destIP string) string {
+		if strings.HasPrefix(destIP, "192.168.") {
+			return "datacenter"
+		}
+		return ""
+	}, 10)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(second int, sni, destIP string, active, failed float64) {
+		inc := &metrics.Inc{
+			SNI:                   sni,
+			SourceIP:              "10.0.0.1",
+			DestIP:                destIP,
+			ActiveSeconds:         active,
+			ActiveFailedSeconds:   failed,
+			SuccessfulConnections: active - failed,
+			RejectedConnections:   failed,
+			Time:                  start.Add(time.Duration(second) * time.Second),
+		}
+		snis.Observe(inc)
+		groups.Observe(inc)
+	}
+	// Two destinations of an SNI and of a CIDR group count one second.
+	observe(0, "api.example.com", "192.168.0.1", 1, 0)
+	observe(0, "api.example.com", "192.168.0.2", 1, 1)
+	// Exceeds the limit of the SNIs, and is not in a CIDR group.
+	observe(0, "www.example.com", "172.16.0.1", 1, 0)
+	// Closes the round.
+	observe(1, "api.example.com", "192.168.0.1", 0, 0)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_cidr_group_connections_total Total number of new connections per CIDR group of the destinations.
+		# TYPE connectivity_exporter_cidr_group_connections_total counter
+		connectivity_exporter_cidr_group_connections_total{cidr_group="datacenter",kind="rejected"} 1
+		connectivity_exporter_cidr_group_connections_total{cidr_group="datacenter",kind="successful"} 1
+		# HELP connectivity_exporter_sni_seconds_total Total number of seconds per SNI, a second counts once for all the clients and destinations.
+		# TYPE connectivity_exporter_sni_seconds_total counter
+		connectivity_exporter_sni_seconds_total{kind="active",sni="api.example.com"} 1
+		connectivity_exporter_sni_seconds_total{kind="active",sni="other"} 1
+		connectivity_exporter_sni_seconds_total{kind="active_failed",sni="api.example.com"} 1
+		connectivity_exporter_sni_seconds_total{kind="active_failed",sni="other"} 0
+		connectivity_exporter_sni_seconds_total{kind="failed",sni="api.example.com"} 0
+		connectivity_exporter_sni_seconds_total{kind="failed",sni="other"} 0
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_cidr_group_connections_total",
+		"connectivity_exporter_sni_seconds_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	tracker := NewTracker(Destination, 1)
+	tracker.EnableLatencyHistograms()
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	tracker.Observe(&metrics.Inc{SNI: "slow.example.com", DestIP: "192.168.1.1", Time: now, ConnectLatencies: []time.Duration{time.Millisecond}})
+	// Beyond the limit.
+	tracker.Observe(&metrics.Inc{SNI: "slow.example.com", DestIP: "192.168.1.2", Time: now, ConnectLatencies: []time.Duration{time.Second, 2 * time.Second}})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, f := range families {
+		if f.GetName() != "connectivity_exporter_destination_connect_latency_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "dest_ip" {
+					counts[l.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	if counts["192.168.1.1"] != 1 || counts[Other] != 2 {
+		t.Errorf("Wrong sample counts of the histograms: %v", counts)
+	}
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package change compares the failure rate of the SNIs in consecutive
+// windows with their average of the previous windows. The ratio is a
+// simple signal of a change of an SNI, which does not need a model of
+// its usual failures like an anomaly detection.
+package change
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Tracker keeps the connections of the current window and the failure
+// rates of the previous windows per SNI.
+type Tracker struct {
+	window  time.Duration
+	history int
+
+	mutex sync.Mutex
+	// start is the start of the current window, zero before the first
+	// increment.
+	start time.Time
+	snis  map[string]*rates
+}
+
+type rates struct {
+	successful, failed float64
+	// previous are the failure rates of the last windows with
+	// connections, the latest last.
+	previous []float64
+	// idle is the number of windows without connections in a row.
+	idle int
+}
+
+// NewTracker creates a tracker comparing windows of the duration with
+// the average of up to history previous windows.
+func NewTracker(window time.Duration, history int) *Tracker {
+	return &Tracker{window: window, history: history, snis: make(map[string]*rates)}
+}
+
+// Observe adds the connections of an increment to the current window.
+// The windows are closed by the time of the increments.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	start := inc.Time.Truncate(t.window)
+	if t.start.IsZero() {
+		t.start = start
+	}
+	if start.After(t.start) {
+		t.close()
+		t.start = start
+	}
+	// The resets of the client do not fail the connection.
+	failed := inc.RejectedConnections + inc.RejectedConnectionsByMiddlebox + inc.RejectedConnectionsByNetwork
+	if inc.SuccessfulConnections == 0 && failed == 0 {
+		return
+	}
+	r, ok := t.snis[inc.SNI]
+	if !ok {
+		r = &rates{}
+		t.snis[inc.SNI] = r
+	}
+	r.successful += inc.SuccessfulConnections
+	r.failed += failed
+}
+
+// close exports the ratios of the current window and starts the next
+// window. An SNI needs a previous window with connections to have a
+// ratio, and is forgotten after history windows without connections.
+func (t *Tracker) close() {
+	for sni, r := range t.snis {
+		total := r.successful + r.failed
+		if total == 0 {
+			metrics.DeleteFailureRateChange(sni)
+			r.idle++
+			if r.idle >= t.history {
+				delete(t.snis, sni)
+			}
+			continue
+		}
+		rate := r.failed / total
+		if len(r.previous) > 0 {
+			metrics.SetFailureRateChange(sni, ratio(rate, r.previous))
+		}
+		r.previous = append(r.previous, rate)
+		if len(r.previous) > t.history {
+			r.previous = r.previous[len(r.previous)-t.history:]
+		}
+		r.successful, r.failed, r.idle = 0, 0, 0
+	}
+}
+
+// ratio returns the ratio of the rate to the average of the previous
+// rates. Failures after windows without any are an infinite change,
+// no failures after windows without any no change.
+func ratio(rate float64, previous []float64) float64 {
+	var sum float64
+	for _, p := range previous {
+		sum += p
+	}
+	average := sum / float64(len(previous))
+	switch {
+	case average > 0:
+		return rate / average
+	case rate > 0:
+		return math.Inf(1)
+	default:
+		return 1
+	}
+}
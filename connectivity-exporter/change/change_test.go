@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package change
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(time.Minute, 2)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(window int, sni string, successful, failed float64) {
+		tracker.Observe(&metrics.Inc{SNI: sni, SuccessfulConnections: successful, RejectedConnections: failed, Time: start.Add(time.Duration(window) * time.Minute)})
+	}
+	// Failure rates of 10% and 30%, then 40%: twice the average. Only
+	// the last two windows are compared with: 60% is 1.71 times the
+	// average of 30% and 40%.
+	observe(0, "api.example.com", 9, 1)
+	observe(1, "api.example.com", 7, 3)
+	observe(2, "api.example.com", 6, 4)
+	observe(2, "new.example.com", 10, 0)
+	observe(2, "healthy.example.com", 10, 0)
+	observe(3, "api.example.com", 4, 6)
+	// Failures after a window without any.
+	observe(3, "new.example.com", 9, 1)
+	// No failures after a window without any.
+	observe(3, "healthy.example.com", 10, 0)
+	// The first window has nothing to compare with.
+	observe(3, "first.example.com", 1, 1)
+	// Closes the fourth window.
+	observe(4, "api.example.com", 1, 0)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_failure_rate_change_ratio Ratio of the connection failure rate of the SNI in the last complete change window to its average in the previous windows.
+		# TYPE connectivity_exporter_failure_rate_change_ratio gauge
+		connectivity_exporter_failure_rate_change_ratio{sni="api.example.com"} 1.7142857142857144
+		connectivity_exporter_failure_rate_change_ratio{sni="healthy.example.com"} 1
+		connectivity_exporter_failure_rate_change_ratio{sni="new.example.com"} +Inf
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "connectivity_exporter_failure_rate_change_ratio"); err != nil {
+		t.Error(err)
+	}
+
+	// Windows without connections remove the ratio and forget the SNI.
+	observe(5, "api.example.com", 1, 0)
+	observe(6, "api.example.com", 1, 0)
+	expected = `
+		# HELP connectivity_exporter_failure_rate_change_ratio Ratio of the connection failure rate of the SNI in the last complete change window to its average in the previous windows.
+		# TYPE connectivity_exporter_failure_rate_change_ratio gauge
+		connectivity_exporter_failure_rate_change_ratio{sni="api.example.com"} 0
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "connectivity_exporter_failure_rate_change_ratio"); err != nil {
+		t.Error(err)
+	}
+	assert := func(sni string, tracked bool) {
+		if _, ok := tracker.snis[sni]; ok != tracked {
+			t.Errorf("%s tracked: %t, want %t", sni, ok, tracked)
+		}
+	}
+	assert("api.example.com", true)
+	assert("new.example.com", false)
+}
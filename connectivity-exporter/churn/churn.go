@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package churn tracks the destination IPs of the SNIs in consecutive
+// windows and exports which of them appeared and disappeared. A
+// failover or a DNS change shows up as churn, which often explains a
+// dip of the availability.
+package churn
+
+import (
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Tracker keeps the destination IPs with traffic per SNI in the
+// current and the previous window.
+type Tracker struct {
+	window time.Duration
+
+	mutex sync.Mutex
+	// start is the start of the current window, zero before the first
+	// increment.
+	start time.Time
+	// first is set during the first window, which has no previous
+	// window to compare with.
+	first bool
+	snis  map[string]*destinations
+}
+
+type destinations struct {
+	previous, current map[string]struct{}
+}
+
+// NewTracker creates a tracker with windows of the duration.
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{window: window, snis: make(map[string]*destinations)}
+}
+
+// Observe records the destination IP of an increment with traffic.
+// The windows are closed by the time of the increments.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	start := inc.Time.Truncate(t.window)
+	if t.start.IsZero() {
+		t.start = start
+		t.first = true
+	}
+	if start.After(t.start) {
+		t.close()
+		t.start = start
+		t.first = false
+	}
+	if inc.ActiveSeconds == 0 || inc.DestIP == "" {
+		return
+	}
+	d, ok := t.snis[inc.SNI]
+	if !ok {
+		d = &destinations{previous: map[string]struct{}{}, current: map[string]struct{}{}}
+		t.snis[inc.SNI] = d
+	}
+	d.current[inc.DestIP] = struct{}{}
+}
+
+// close exports the churn of the current window and starts the next
+// window. An SNI which appears after the first window counts all its
+// destinations as added.
+func (t *Tracker) close() {
+	for sni, d := range t.snis {
+		if len(d.current) == 0 {
+			// The SNI had no traffic in the window, its destinations
+			// are gone.
+			metrics.SetDestinationIPs(sni, 0, 0, len(d.previous))
+			metrics.DeleteDestinationIPs(sni)
+			delete(t.snis, sni)
+			continue
+		}
+		var added, removed int
+		for ip := range d.current {
+			if _, ok := d.previous[ip]; !ok {
+				added++
+			}
+		}
+		for ip := range d.previous {
+			if _, ok := d.current[ip]; !ok {
+				removed++
+			}
+		}
+		if t.first {
+			added = 0
+		}
+		metrics.SetDestinationIPs(sni, len(d.current), added, removed)
+		d.previous, d.current = d.current, map[string]struct{}{}
+	}
+}
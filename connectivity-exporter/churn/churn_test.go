@@ -0,0 +1,54 @@
+package churn
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(time.Minute)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(window int, sni, destIP string, active float64) {
+		tracker.Observe(&metrics.Inc{SNI: sni, DestIP: destIP, ActiveSeconds: active, Time: start.Add(time.Duration(window) * time.Minute)})
+	}
+	// The destinations of the first window are not counted as added.
+	observe(0, "churn.example.com", "10.0.0.1", 1)
+	observe(0, "churn.example.com", "10.0.0.2", 1)
+	observe(0, "gone.example.com", "10.0.1.1", 1)
+	// A failover to another destination, inactive keys do not count.
+	observe(1, "churn.example.com", "10.0.0.1", 1)
+	observe(1, "churn.example.com", "10.0.0.2", 0)
+	observe(1, "churn.example.com", "10.0.0.3", 1)
+	observe(1, "new.example.com", "10.0.2.1", 1)
+	// Closes the second window.
+	observe(2, "churn.example.com", "10.0.0.1", 1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_destination_ip_changes_total Total number of destination IPs of the SNI which appeared or disappeared between two churn windows.
+		# TYPE connectivity_exporter_destination_ip_changes_total counter
+		connectivity_exporter_destination_ip_changes_total{kind="added",sni="churn.example.com"} 1
+		connectivity_exporter_destination_ip_changes_total{kind="added",sni="gone.example.com"} 0
+		connectivity_exporter_destination_ip_changes_total{kind="added",sni="new.example.com"} 1
+		connectivity_exporter_destination_ip_changes_total{kind="removed",sni="churn.example.com"} 1
+		connectivity_exporter_destination_ip_changes_total{kind="removed",sni="gone.example.com"} 1
+		connectivity_exporter_destination_ip_changes_total{kind="removed",sni="new.example.com"} 0
+		# HELP connectivity_exporter_destination_ips Number of destination IPs of the SNI with traffic in the last complete churn window.
+		# TYPE connectivity_exporter_destination_ips gauge
+		connectivity_exporter_destination_ips{sni="churn.example.com"} 2
+		connectivity_exporter_destination_ips{sni="new.example.com"} 1
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_destination_ip_changes_total",
+		"connectivity_exporter_destination_ips",
+	); err != nil {
+		t.Error(err)
+	}
+}
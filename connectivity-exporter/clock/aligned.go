@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package clock
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alignedTicker is a TickSource ticking at the multiples of the
+// interval of a clock instead of every interval after its start.
+type alignedTicker struct {
+	clock    Clock
+	interval time.Duration
+	offset   time.Duration
+	ticks    chan time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewAlignedTicker returns a TickSource ticking offset after every
+// multiple of the interval of the clock, e.g. at every second boundary
+// of the wall clock. The ticks carry the time of the wall clock rounded
+// to the interval, so the windows of nodes with synchronized clocks
+// start at the same times and carry the same timestamps. The offset
+// gives the packets at the end of a window time to be accounted before
+// the tick. Like with a time.Ticker, ticks are dropped for slow
+// receivers. The next tick is computed from the clock after every tick,
+// so steps and slews of the clock are followed.
+func NewAlignedTicker(clock Clock, interval, offset time.Duration) TickSource {
+	t := &alignedTicker{
+		clock:    clock,
+		interval: interval,
+		offset:   offset,
+		ticks:    make(chan time.Time, 1),
+		stop:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *alignedTicker) run() {
+	timer := time.NewTimer(t.untilNext())
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-timer.C:
+		}
+		select {
+		case t.ticks <- time.Now().Add(-t.offset).Round(t.interval):
+		default:
+		}
+		timer.Reset(t.untilNext())
+	}
+}
+
+// untilNext returns the time until the next multiple of the interval
+// plus the offset.
+func (t *alignedTicker) untilNext() time.Duration {
+	now := t.clock.Now()
+	d := now.Truncate(t.interval).Add(t.offset).Sub(now)
+	for d <= 0 {
+		d += t.interval
+	}
+	return d
+}
+
+func (t *alignedTicker) C() <-chan time.Time {
+	return t.ticks
+}
+
+func (t *alignedTicker) Stop() {
+	t.once.Do(func() { close(t.stop) })
+}
+
+// NewTickSource returns the TickSource of the spec:
+//
+//	ticker         every interval after the start, with a time.Ticker
+//	wall-clock     aligned to the multiples of the interval of the wall clock
+//	phc:<device>   aligned to the multiples of the interval of a PTP
+//	               hardware clock, e.g. phc:/dev/ptp0
+//
+// The offset only applies to the aligned tick sources.
+func NewTickSource(spec string, interval, offset time.Duration) (TickSource, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid tick interval %v", interval)
+	}
+	if offset < 0 || offset >= interval {
+		return nil, fmt.Errorf("tick offset %v has to be within the interval %v", offset, interval)
+	}
+	switch {
+	case spec == "ticker":
+		return NewTicker(interval), nil
+	case spec == "wall-clock":
+		return NewAlignedTicker(Real, interval, offset), nil
+	case strings.HasPrefix(spec, "phc:"):
+		phc, err := OpenPHC(strings.TrimPrefix(spec, "phc:"))
+		if err != nil {
+			return nil, err
+		}
+		return &phcTicker{TickSource: NewAlignedTicker(phc, interval, offset), phc: phc}, nil
+	}
+	return nil, fmt.Errorf("unknown tick source %q, expecting ticker, wall-clock or phc:<device>", spec)
+}
+
+// phcTicker closes the PTP hardware clock when it is stopped.
+type phcTicker struct {
+	TickSource
+	phc *PHC
+}
+
+func (t *phcTicker) Stop() {
+	t.TickSource.Stop()
+	t.phc.Close()
+}
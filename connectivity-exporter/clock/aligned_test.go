@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlignedTicker(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	ticks := NewAlignedTicker(Real, interval, 10*time.Millisecond)
+	defer ticks.Stop()
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		tick := <-ticks.C()
+		if !tick.Equal(tick.Truncate(interval)) {
+			t.Errorf("Tick %v is not aligned to %v", tick, interval)
+		}
+		if !last.IsZero() && !tick.After(last) {
+			t.Errorf("Tick %v is not after %v", tick, last)
+		}
+		// The tick is delivered after the offset.
+		if d := time.Since(tick); d < 10*time.Millisecond {
+			t.Errorf("Tick %v delivered %v after the boundary", tick, d)
+		}
+		last = tick
+	}
+}
+
+func TestNewTickSource(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		offset time.Duration
+		valid  bool
+	}{
+		{"ticker", 0, true},
+		{"wall-clock", 100 * time.Millisecond, true},
+		{"wall-clock", time.Second, false},
+		{"phc:/dev/does-not-exist", 0, false},
+		{"ntp", 0, false},
+	} {
+		ticks, err := NewTickSource(tc.spec, time.Second, tc.offset)
+		if (err == nil) != tc.valid {
+			t.Errorf("NewTickSource(%q, %v) = %v, want valid %v", tc.spec, tc.offset, err, tc.valid)
+		}
+		if ticks != nil {
+			ticks.Stop()
+		}
+	}
+}
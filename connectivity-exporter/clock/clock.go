@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package clock abstracts the time of the accounting loop, so tests
+// and replays can drive it with virtual time.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// TickSource delivers the ticks which start the accounting of a
+// window.
+type TickSource interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// ticker is a TickSource backed by a time.Ticker.
+type ticker struct {
+	t *time.Ticker
+}
+
+// NewTicker returns a TickSource ticking every interval.
+func NewTicker(interval time.Duration) TickSource {
+	return ticker{t: time.NewTicker(interval)}
+}
+
+func (t ticker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t ticker) Stop() {
+	t.t.Stop()
+}
+
+// Fake is a virtual clock which is also a TickSource. The time only
+// changes when it is set or advanced.
+type Fake struct {
+	mutex sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+// NewFake returns a fake clock set to the time now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, ticks: make(chan time.Time)}
+}
+
+// Now returns the current virtual time.
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Set sets the virtual time.
+func (f *Fake) Set(now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = now
+}
+
+// Advance moves the virtual time forward by d.
+func (f *Fake) Advance(d time.Duration) time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	return f.now
+}
+
+// Tick advances the virtual time by d and delivers a tick. It blocks
+// until the tick is received.
+func (f *Fake) Tick(d time.Duration) {
+	f.ticks <- f.Advance(d)
+}
+
+// C returns the channel the ticks are delivered on.
+func (f *Fake) C() <-chan time.Time {
+	return f.ticks
+}
+
+// Stop does nothing, the ticks are only delivered by Tick.
+func (f *Fake) Stop() {}
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package clock
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PHC is the Clock of a PTP hardware clock, read with clock_gettime on
+// the dynamic clock ID of its character device. PTP clocks usually
+// run on TAI, which is ahead of UTC by whole seconds, so their second
+// boundaries match the ones of UTC.
+type PHC struct {
+	file *os.File
+	id   int32
+}
+
+// OpenPHC opens the PTP hardware clock of the device, e.g. /dev/ptp0.
+func OpenPHC(device string) (*PHC, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("opening PTP hardware clock: %w", err)
+	}
+	// FD_TO_CLOCKID of the kernel, see clock_getres(2).
+	p := &PHC{file: file, id: int32((^file.Fd())<<3 | 3)}
+	var ts unix.Timespec
+	if err := unix.ClockGettime(p.id, &ts); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading PTP hardware clock %s: %w", device, err)
+	}
+	return p, nil
+}
+
+// Now returns the time of the hardware clock, or of the wall clock if
+// it cannot be read.
+func (p *PHC) Now() time.Time {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(p.id, &ts); err != nil {
+		return time.Now()
+	}
+	return time.Unix(ts.Unix())
+}
+
+// Close closes the device of the clock.
+func (p *PHC) Close() error {
+	return p.file.Close()
+}
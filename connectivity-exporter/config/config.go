@@ -0,0 +1,653 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the part of the exporter configuration that can be
+// changed at runtime without reloading the eBPF program.
+type Config struct {
+	// Rules configure the accounting per SNI pattern. The first
+	// rule with a matching pattern applies to an SNI.
+	Rules []Rule `json:"rules,omitempty"`
+	// CarryOver is the granularity of the failed-second carry-over,
+	// either CarryOverSNI (default) or CarryOverSNIAndDest.
+	CarryOver string `json:"carryOver,omitempty"`
+	// CarryOverRetention is how long the carry-over state of an
+	// inactive SNI is kept. Afterwards its failure is no longer
+	// carried over. Defaults to DefaultCarryOverRetention.
+	CarryOverRetention Duration `json:"carryOverRetention,omitempty"`
+	// CIDRGroups name the destinations. A connection without an SNI
+	// is accounted for the name of the first group containing its
+	// destination IP.
+	CIDRGroups []CIDRGroup `json:"cidrGroups,omitempty"`
+	// SNIGroups are accounted as SNIs of their own besides their
+	// members, e.g. the hostnames served by one VIP.
+	SNIGroups []SNIGroup `json:"sniGroups,omitempty"`
+	// AnnotationLabels are the keys of the annotations of the CIDR
+	// groups which are exported as labels of the info metric of the
+	// groups.
+	AnnotationLabels []string `json:"annotationLabels,omitempty"`
+	// SNICacheTTL is how long the SNI of a client, destination IP and
+	// port is applied to the following connections of the same triple
+	// without an SNI, e.g. resumed sessions. 0 disables the cache.
+	SNICacheTTL Duration `json:"sniCacheTTL,omitempty"`
+	// Draining is set while the node is drained. The connections are
+	// still measured, but all SNIs are in maintenance, so the expected
+	// churn of the drain neither burns error budgets nor emits failure
+	// events.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// CIDRGroup is a named group of destination networks.
+type CIDRGroup struct {
+	Name  string   `json:"name"`
+	CIDRs []string `json:"cidrs"`
+	// Annotations describe the destinations, e.g. the owning team,
+	// and are added to the failure events of the group.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Contains checks whether the IP is in one of the networks of the
+// group. The group is expected to be valid.
+func (g CIDRGroup) Contains(ip net.IP) bool {
+	for _, cidr := range g.CIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CIDRGroupName returns the name of the first CIDR group containing
+// the IP, or an empty string if there is none.
+func (c *Config) CIDRGroupName(ip net.IP) string {
+	for _, g := range c.CIDRGroups {
+		if g.Contains(ip) {
+			return g.Name
+		}
+	}
+	return ""
+}
+
+// CIDRGroupAnnotations returns a copy of the annotations of the first
+// CIDR group containing the IP, or nil if there is none.
+func (c *Config) CIDRGroupAnnotations(ip net.IP) map[string]string {
+	for _, g := range c.CIDRGroups {
+		if !g.Contains(ip) {
+			continue
+		}
+		if len(g.Annotations) == 0 {
+			return nil
+		}
+		annotations := make(map[string]string, len(g.Annotations))
+		for k, v := range g.Annotations {
+			annotations[k] = v
+		}
+		return annotations
+	}
+	return nil
+}
+
+// AnnotationLabelValues returns the values of the annotation labels
+// of the group, empty for the annotations it does not have.
+func (c *Config) AnnotationLabelValues(g CIDRGroup) []string {
+	values := make([]string, len(c.AnnotationLabels))
+	for i, l := range c.AnnotationLabels {
+		values[i] = g.Annotations[l]
+	}
+	return values
+}
+
+// SNIGroup is a named group of SNIs, e.g. the hostnames of a wildcard
+// certificate. The connections of its members are accounted for the
+// name of the group as well.
+type SNIGroup struct {
+	Name string `json:"name"`
+	// SNIs are patterns as accepted by path.Match, for example
+	// "*.example.com".
+	SNIs []string `json:"snis"`
+}
+
+// Contains checks whether the SNI matches one of the patterns of the
+// group. The group is expected to be valid.
+func (g SNIGroup) Contains(sni string) bool {
+	for _, pattern := range g.SNIs {
+		if ok, _ := path.Match(pattern, sni); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SNIGroupNames returns the names of all the SNI groups containing the
+// SNI, in the order of the configuration.
+func (c *Config) SNIGroupNames(sni string) []string {
+	var names []string
+	for _, g := range c.SNIGroups {
+		if g.Contains(sni) {
+			names = append(names, g.Name)
+		}
+	}
+	return names
+}
+
+// DefaultCarryOverRetention matches the expiration of the metrics.
+const DefaultCarryOverRetention = 15 * time.Minute
+
+// Duration is a time.Duration represented as a string like "90s" in
+// JSON.
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// CarryOverRetentionOrDefault returns the configured carry-over
+// retention or the default.
+func (c *Config) CarryOverRetentionOrDefault() time.Duration {
+	if c.CarryOverRetention <= 0 {
+		return DefaultCarryOverRetention
+	}
+	return time.Duration(c.CarryOverRetention)
+}
+
+const (
+	// CarryOverSNI carries over failed seconds per SNI regardless
+	// of the client and the destination IP.
+	CarryOverSNI = "sni"
+	// CarryOverSNIAndDest carries over failed seconds per SNI and
+	// destination IP.
+	CarryOverSNIAndDest = "sni+dest"
+)
+
+// Rule configures the accounting of the SNIs matching a pattern.
+type Rule struct {
+	// SNI is a pattern as accepted by path.Match, for example
+	// "*.example.com".
+	SNI string `json:"sni"`
+	// MaintenanceWindows are the planned maintenances of the
+	// matching SNIs. Failed seconds within a window are recorded
+	// as silenced seconds instead.
+	MaintenanceWindows []Window `json:"maintenanceWindows,omitempty"`
+	// Schedule declares when traffic to the matching SNIs is
+	// expected. Inactive seconds outside of the schedule are
+	// recorded as expected idle seconds and do not carry over
+	// failures. An empty schedule means traffic is always
+	// expected.
+	Schedule []ScheduleWindow `json:"schedule,omitempty"`
+	// SLO is the availability objective of each matching SNI.
+	SLO *SLO `json:"slo,omitempty"`
+	// SecondsPolicy decides which seconds of the matching SNIs are
+	// accounted, one of the Seconds* policies. Defaults to
+	// SecondsActiveWithCarry.
+	SecondsPolicy string `json:"secondsPolicy,omitempty"`
+	// DetectHandshakeOnly counts the connections of the matching
+	// SNIs whose TLS handshake succeeded, but whose client sent no
+	// application data afterwards, e.g. for HTTP/2 endpoints.
+	DetectHandshakeOnly bool `json:"detectHandshakeOnly,omitempty"`
+	// MinFailedConnections is the number of failed connections of a
+	// matching SNI, source and destination within a window which
+	// fails it, to ignore e.g. a single stray reset. Defaults to 1.
+	MinFailedConnections uint64 `json:"minFailedConnections,omitempty"`
+	// AttributeFailures accounts the active seconds of the matching
+	// SNIs with failed connections by their cause as well: the
+	// server, the client or the network. The failures of the client
+	// do not fail the seconds otherwise.
+	AttributeFailures bool `json:"attributeFailures,omitempty"`
+	// MinThroughput is the minimum expected throughput in bytes per
+	// second of a matching SNI, source and destination, e.g. for
+	// backup targets. The windows with traffic below it are degraded
+	// seconds. 0 disables the check.
+	MinThroughput uint64 `json:"minThroughput,omitempty"`
+}
+
+const (
+	// SecondsActiveWithCarry accounts the active seconds and the
+	// inactive seconds following a failed second, which are failed.
+	SecondsActiveWithCarry = "active-with-carry"
+	// SecondsActiveOnly accounts the active seconds only, a failure
+	// is not carried over.
+	SecondsActiveOnly = "active-only"
+	// SecondsWallClockWithCarry accounts every second. An inactive
+	// second is failed if the preceding second was failed, unknown
+	// otherwise.
+	SecondsWallClockWithCarry = "wall-clock-with-carry"
+	// SecondsWallClockStrict accounts every second. An inactive
+	// second is failed.
+	SecondsWallClockStrict = "wall-clock-strict"
+)
+
+// SLO is an availability objective. The error budget is the share of
+// the window which may be failed seconds.
+type SLO struct {
+	// Target is the objective as a fraction, e.g. 0.999.
+	Target float64 `json:"target"`
+	// Window is the rolling window of the objective. Defaults to
+	// DefaultSLOWindow.
+	Window Duration `json:"window,omitempty"`
+}
+
+// DefaultSLOWindow is the rolling window of an SLO without a window.
+const DefaultSLOWindow = 30 * 24 * time.Hour
+
+// WindowOrDefault returns the configured window or the default.
+func (s *SLO) WindowOrDefault() time.Duration {
+	if s.Window <= 0 {
+		return DefaultSLOWindow
+	}
+	return time.Duration(s.Window)
+}
+
+// BudgetSeconds returns the error budget of a window. It is rounded
+// to milliseconds, so a target like 0.99 yields a whole number.
+func (s *SLO) BudgetSeconds() float64 {
+	return math.Round((1-s.Target)*s.WindowOrDefault().Seconds()*1000) / 1000
+}
+
+// ScheduleWindow is a recurring daily time interval in UTC. If the
+// end is before the start, the window spans midnight and the days
+// refer to the day the window starts.
+type ScheduleWindow struct {
+	// Days are the abbreviated weekday names, e.g. "Mon". No days
+	// means every day.
+	Days []string `json:"days,omitempty"`
+	// Start is the inclusive start time formatted as "15:04".
+	Start string `json:"start"`
+	// End is the exclusive end time formatted as "15:04", "24:00"
+	// denotes the end of the day.
+	End string `json:"end"`
+}
+
+// Contains checks whether the time t is within the schedule window.
+// The window is expected to be valid.
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	t = t.UTC()
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if start <= end {
+		return w.onDay(t.Weekday()) && start <= sinceMidnight && sinceMidnight < end
+	}
+	// The window spans midnight.
+	if sinceMidnight >= start {
+		return w.onDay(t.Weekday())
+	}
+	return sinceMidnight < end && w.onDay((t.Weekday()+6)%7)
+}
+
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if strings.EqualFold(d, day.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w ScheduleWindow) validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if _, err := time.Parse("Mon", d); err != nil {
+			return fmt.Errorf("invalid weekday %q", d)
+		}
+	}
+	return nil
+}
+
+// parseClock parses the time of the day formatted as "15:04" and
+// returns the duration since midnight.
+func parseClock(clock string) (time.Duration, error) {
+	if clock == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", clock, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Window is a time interval, the start is inclusive and the end is
+// exclusive.
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Contains checks whether the time t is within the window.
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Load reads the configuration from a JSON file. An empty path
+// yields an empty configuration.
+func Load(filename string) (*Config, error) {
+	cfg := &Config{}
+	if filename == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", filename, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validating config %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// labelName matches the valid names of Prometheus labels.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate checks the configuration for errors.
+func (c *Config) Validate() error {
+	switch c.CarryOver {
+	case "", CarryOverSNI, CarryOverSNIAndDest:
+	default:
+		return fmt.Errorf("invalid carry-over granularity %q", c.CarryOver)
+	}
+	if c.CarryOverRetention < 0 {
+		return fmt.Errorf("negative carry-over retention %s", time.Duration(c.CarryOverRetention))
+	}
+	if c.SNICacheTTL < 0 {
+		return fmt.Errorf("negative SNI cache TTL %s", time.Duration(c.SNICacheTTL))
+	}
+	for i, g := range c.CIDRGroups {
+		if g.Name == "" {
+			return fmt.Errorf("CIDR group %d: empty name", i)
+		}
+		for _, cidr := range g.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("CIDR group %q: %w", g.Name, err)
+			}
+		}
+		for k := range g.Annotations {
+			if k == "" {
+				return fmt.Errorf("CIDR group %q: empty annotation key", g.Name)
+			}
+		}
+	}
+	sniGroups := make(map[string]bool, len(c.SNIGroups))
+	for i, g := range c.SNIGroups {
+		if g.Name == "" {
+			return fmt.Errorf("SNI group %d: empty name", i)
+		}
+		if sniGroups[g.Name] {
+			return fmt.Errorf("SNI group %q: duplicate name", g.Name)
+		}
+		sniGroups[g.Name] = true
+		if len(g.SNIs) == 0 {
+			return fmt.Errorf("SNI group %q: no SNIs", g.Name)
+		}
+		for _, pattern := range g.SNIs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("SNI group %q: invalid SNI pattern %q: %w", g.Name, pattern, err)
+			}
+		}
+		// The group would be accounted for its own connections
+		// twice.
+		if g.Contains(g.Name) {
+			return fmt.Errorf("SNI group %q: the name matches its own SNIs", g.Name)
+		}
+	}
+	for _, l := range c.AnnotationLabels {
+		if !labelName.MatchString(l) || l == "sni" {
+			return fmt.Errorf("invalid annotation label %q", l)
+		}
+	}
+	for i, r := range c.Rules {
+		if _, err := path.Match(r.SNI, ""); err != nil {
+			return fmt.Errorf("rule %d: invalid SNI pattern %q: %w", i, r.SNI, err)
+		}
+		for _, w := range r.MaintenanceWindows {
+			if !w.End.After(w.Start) {
+				return fmt.Errorf("rule %d: maintenance window ends before it starts: %s - %s", i, w.Start, w.End)
+			}
+		}
+		for _, w := range r.Schedule {
+			if err := w.validate(); err != nil {
+				return fmt.Errorf("rule %d: schedule: %w", i, err)
+			}
+		}
+		switch r.SecondsPolicy {
+		case "", SecondsActiveWithCarry, SecondsActiveOnly, SecondsWallClockWithCarry, SecondsWallClockStrict:
+		default:
+			return fmt.Errorf("rule %d: invalid seconds policy %q", i, r.SecondsPolicy)
+		}
+		if r.SLO != nil {
+			if r.SLO.Target <= 0 || r.SLO.Target >= 1 {
+				return fmt.Errorf("rule %d: SLO target %v is not between 0 and 1", i, r.SLO.Target)
+			}
+			if r.SLO.Window < 0 {
+				return fmt.Errorf("rule %d: negative SLO window %s", i, time.Duration(r.SLO.Window))
+			}
+		}
+	}
+	return nil
+}
+
+// RuleFor returns the first rule matching the SNI, or nil if there
+// is none.
+func (c *Config) RuleFor(sni string) *Rule {
+	for i := range c.Rules {
+		// The patterns are validated, so the error can be ignored.
+		if ok, _ := path.Match(c.Rules[i].SNI, sni); ok {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// InMaintenance checks whether the SNI is in a maintenance window
+// at the time t or the node is draining.
+func (c *Config) InMaintenance(sni string, t time.Time) bool {
+	if c.Draining {
+		return true
+	}
+	r := c.RuleFor(sni)
+	if r == nil {
+		return false
+	}
+	for _, w := range r.MaintenanceWindows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSchedule checks whether the traffic to the SNI follows a
+// schedule.
+func (c *Config) HasSchedule(sni string) bool {
+	r := c.RuleFor(sni)
+	return r != nil && len(r.Schedule) > 0
+}
+
+// SecondsPolicyFor returns the seconds policy of the SNI.
+func (c *Config) SecondsPolicyFor(sni string) string {
+	r := c.RuleFor(sni)
+	if r == nil || r.SecondsPolicy == "" {
+		return SecondsActiveWithCarry
+	}
+	return r.SecondsPolicy
+}
+
+// DetectsHandshakeOnly checks whether the connections of the SNI
+// without application data are counted.
+func (c *Config) DetectsHandshakeOnly(sni string) bool {
+	r := c.RuleFor(sni)
+	return r != nil && r.DetectHandshakeOnly
+}
+
+// DetectsAnyHandshakeOnly checks whether any rule counts the
+// connections without application data.
+func (c *Config) DetectsAnyHandshakeOnly() bool {
+	for _, r := range c.Rules {
+		if r.DetectHandshakeOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// MinFailedConnectionsFor returns the number of failed connections
+// within a window which fails it for the SNI.
+func (c *Config) MinFailedConnectionsFor(sni string) uint64 {
+	r := c.RuleFor(sni)
+	if r == nil || r.MinFailedConnections == 0 {
+		return 1
+	}
+	return r.MinFailedConnections
+}
+
+// AttributesFailures checks whether the failed seconds of the SNI are
+// accounted by cause.
+func (c *Config) AttributesFailures(sni string) bool {
+	r := c.RuleFor(sni)
+	return r != nil && r.AttributeFailures
+}
+
+// MinThroughputFor returns the minimum expected throughput of the SNI
+// in bytes per second, 0 if none is expected.
+func (c *Config) MinThroughputFor(sni string) uint64 {
+	r := c.RuleFor(sni)
+	if r == nil {
+		return 0
+	}
+	return r.MinThroughput
+}
+
+// HasMinThroughput checks whether any rule expects a minimum
+// throughput, so the payload bytes have to be counted.
+func (c *Config) HasMinThroughput() bool {
+	for _, r := range c.Rules {
+		if r.MinThroughput > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWallClock checks whether the seconds policy accounts every second.
+func IsWallClock(policy string) bool {
+	return policy == SecondsWallClockWithCarry || policy == SecondsWallClockStrict
+}
+
+// ExpectsTraffic checks whether traffic to the SNI is expected at
+// the time t according to its schedule.
+func (c *Config) ExpectsTraffic(sni string, t time.Time) bool {
+	r := c.RuleFor(sni)
+	if r == nil || len(r.Schedule) == 0 {
+		return true
+	}
+	for _, w := range r.Schedule {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a deep copy of the configuration. The copy is made
+// by a JSON round trip, so it covers all the serializable fields.
+func (c *Config) Clone() *Config {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(fmt.Sprintf("bug: config is not serializable: %v", err))
+	}
+	out := &Config{}
+	if err := json.Unmarshal(data, out); err != nil {
+		panic(fmt.Sprintf("bug: config is not deserializable: %v", err))
+	}
+	return out
+}
+
+// Store holds the current configuration and allows to replace it
+// while it is being used by other goroutines. The configuration
+// returned by Get must not be modified.
+type Store struct {
+	mutex sync.RWMutex
+	cfg   *Config
+}
+
+// NewStore creates a store holding the given configuration.
+func NewStore(cfg *Config) *Store {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	return &Store{cfg: cfg}
+}
+
+// Get returns the current configuration.
+func (s *Store) Get() *Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cfg
+}
+
+// Set validates and replaces the current configuration.
+func (s *Store) Set(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cfg = cfg
+	return nil
+}
+
+// Update applies the function to a copy of the current
+// configuration and stores the result if it is valid.
+func (s *Store) Update(f func(*Config) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cfg := s.cfg.Clone()
+	if err := f(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.cfg = cfg
+	return nil
+}
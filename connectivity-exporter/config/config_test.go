@@ -0,0 +1,271 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleFor(t *testing.T) {
+	cfg := &Config{Rules: []Rule{
+		{SNI: "api.example.com"},
+		{SNI: "*.example.com"},
+	}}
+	tests := []struct {
+		sni  string
+		want string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"example.org", ""},
+	}
+	for _, tc := range tests {
+		got := ""
+		if r := cfg.RuleFor(tc.sni); r != nil {
+			got = r.SNI
+		}
+		if got != tc.want {
+			t.Errorf("RuleFor(%q): got %q, want %q", tc.sni, got, tc.want)
+		}
+	}
+}
+
+func TestInMaintenance(t *testing.T) {
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	cfg := &Config{Rules: []Rule{{
+		SNI:                "*.example.com",
+		MaintenanceWindows: []Window{{Start: start, End: start.Add(time.Hour)}},
+	}}}
+	tests := []struct {
+		sni  string
+		t    time.Time
+		want bool
+	}{
+		{"api.example.com", start.Add(-time.Second), false},
+		{"api.example.com", start, true},
+		{"api.example.com", start.Add(time.Hour - time.Second), true},
+		{"api.example.com", start.Add(time.Hour), false},
+		{"example.org", start, false},
+	}
+	for _, tc := range tests {
+		if got := cfg.InMaintenance(tc.sni, tc.t); got != tc.want {
+			t.Errorf("InMaintenance(%q, %s): got %t, want %t", tc.sni, tc.t, got, tc.want)
+		}
+	}
+
+	// A draining node is in maintenance for all SNIs.
+	cfg.Draining = true
+	if !cfg.InMaintenance("example.org", start.Add(-time.Hour)) {
+		t.Errorf("A draining node should be in maintenance")
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	store := NewStore(&Config{Rules: []Rule{{SNI: "*.example.com"}}})
+	original := store.Get()
+
+	now := time.Now()
+	err := store.Update(func(cfg *Config) error {
+		cfg.Rules[0].MaintenanceWindows = append(cfg.Rules[0].MaintenanceWindows, Window{Start: now, End: now.Add(-time.Hour)})
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Update with an invalid window should fail")
+	}
+	if store.Get() != original {
+		t.Fatalf("Failed update should keep the original config")
+	}
+
+	err = store.Update(func(cfg *Config) error {
+		cfg.Rules[0].MaintenanceWindows = append(cfg.Rules[0].MaintenanceWindows, Window{Start: now, End: now.Add(time.Hour)})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if len(original.Rules[0].MaintenanceWindows) != 0 {
+		t.Fatalf("Update modified the original config")
+	}
+	if !store.Get().InMaintenance("api.example.com", now) {
+		t.Fatalf("Updated config should be in maintenance")
+	}
+}
+
+func TestScheduleWindowContains(t *testing.T) {
+	// 2022-05-02 is a Monday.
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2022, 5, 2, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		desc   string
+		window ScheduleWindow
+		t      time.Time
+		want   bool
+	}{
+		{"daily, inside", ScheduleWindow{Start: "08:00", End: "18:00"}, monday(12, 0), true},
+		{"daily, at start", ScheduleWindow{Start: "08:00", End: "18:00"}, monday(8, 0), true},
+		{"daily, at end", ScheduleWindow{Start: "08:00", End: "18:00"}, monday(18, 0), false},
+		{"whole day", ScheduleWindow{Start: "00:00", End: "24:00"}, monday(23, 59), true},
+		{"other day", ScheduleWindow{Days: []string{"Tue"}, Start: "08:00", End: "18:00"}, monday(12, 0), false},
+		{"overnight, before midnight", ScheduleWindow{Days: []string{"Mon"}, Start: "22:00", End: "04:00"}, monday(23, 0), true},
+		{"overnight, after midnight", ScheduleWindow{Days: []string{"Sun"}, Start: "22:00", End: "04:00"}, monday(3, 0), true},
+		{"overnight, after midnight, wrong day", ScheduleWindow{Days: []string{"Mon"}, Start: "22:00", End: "04:00"}, monday(3, 0), false},
+		{"overnight, outside", ScheduleWindow{Start: "22:00", End: "04:00"}, monday(12, 0), false},
+	}
+	for _, tc := range tests {
+		if err := tc.window.validate(); err != nil {
+			t.Fatalf("%s: invalid window: %v", tc.desc, err)
+		}
+		if got := tc.window.Contains(tc.t); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, w := range []ScheduleWindow{
+		{Start: "8", End: "18:00"},
+		{Start: "08:00", End: "25:00"},
+		{Days: []string{"Monday"}, Start: "08:00", End: "18:00"},
+	} {
+		cfg := &Config{Rules: []Rule{{SNI: "*", Schedule: []ScheduleWindow{w}}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", w)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	cfg := &Config{}
+	if err := json.Unmarshal([]byte(`{"carryOverRetention": "90s"}`), cfg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got := cfg.CarryOverRetentionOrDefault(); got != 90*time.Second {
+		t.Fatalf("Wrong retention: got %s", got)
+	}
+	if got := cfg.Clone().CarryOverRetentionOrDefault(); got != 90*time.Second {
+		t.Fatalf("Wrong retention after clone: got %s", got)
+	}
+	if err := json.Unmarshal([]byte(`{"carryOverRetention": 90}`), cfg); err == nil {
+		t.Fatalf("Unmarshal of a number should fail")
+	}
+	if got := (&Config{}).CarryOverRetentionOrDefault(); got != DefaultCarryOverRetention {
+		t.Fatalf("Wrong default retention: got %s", got)
+	}
+}
+
+func TestValidateSLO(t *testing.T) {
+	for _, slo := range []SLO{
+		{Target: 0},
+		{Target: 1},
+		{Target: 99.9},
+		{Target: 0.999, Window: Duration(-time.Hour)},
+	} {
+		slo := slo
+		cfg := &Config{Rules: []Rule{{SNI: "*", SLO: &slo}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", slo)
+		}
+	}
+	slo := &SLO{Target: 0.999}
+	if got, want := slo.BudgetSeconds(), 0.001*DefaultSLOWindow.Seconds(); got < want-1e-6 || got > want+1e-6 {
+		t.Errorf("BudgetSeconds() = %v, want %v", got, want)
+	}
+}
+
+func TestCIDRGroupName(t *testing.T) {
+	cfg := &Config{CIDRGroups: []CIDRGroup{
+		{Name: "database", CIDRs: []string{"10.0.1.0/24"}},
+		{Name: "internal", CIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	for ip, want := range map[string]string{
+		"10.0.1.5":    "database",
+		"10.0.2.5":    "internal",
+		"192.168.0.1": "internal",
+		"172.16.0.1":  "",
+	} {
+		if got := cfg.CIDRGroupName(net.ParseIP(ip)); got != want {
+			t.Errorf("CIDRGroupName(%s) = %q, want %q", ip, got, want)
+		}
+	}
+
+	for _, g := range []CIDRGroup{{CIDRs: []string{"10.0.0.0/8"}}, {Name: "invalid", CIDRs: []string{"10.0.0.0"}}} {
+		if err := (&Config{CIDRGroups: []CIDRGroup{g}}).Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", g)
+		}
+	}
+}
+
+func TestSNIGroupNames(t *testing.T) {
+	cfg := &Config{SNIGroups: []SNIGroup{
+		{Name: "vip-1", SNIs: []string{"*.apps.example.com", "api.example.com"}},
+		{Name: "apis", SNIs: []string{"api.*"}},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	for sni, want := range map[string][]string{
+		"shop.apps.example.com": {"vip-1"},
+		"api.example.com":       {"vip-1", "apis"},
+		"www.example.com":       nil,
+	} {
+		if got := cfg.SNIGroupNames(sni); !reflect.DeepEqual(got, want) {
+			t.Errorf("SNIGroupNames(%s) = %q, want %q", sni, got, want)
+		}
+	}
+
+	for _, groups := range [][]SNIGroup{
+		{{SNIs: []string{"*.example.com"}}},
+		{{Name: "empty"}},
+		{{Name: "invalid", SNIs: []string{"["}}},
+		{{Name: "twice", SNIs: []string{"a.example.com"}}, {Name: "twice", SNIs: []string{"b.example.com"}}},
+		{{Name: "all.example.com", SNIs: []string{"*.example.com"}}},
+	} {
+		if err := (&Config{SNIGroups: groups}).Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", groups)
+		}
+	}
+}
+
+func TestCIDRGroupAnnotations(t *testing.T) {
+	cfg := &Config{
+		CIDRGroups: []CIDRGroup{
+			{Name: "database", CIDRs: []string{"10.0.1.0/24"}, Annotations: map[string]string{"team": "storage", "tier": "1"}},
+			{Name: "internal", CIDRs: []string{"10.0.0.0/8"}},
+		},
+		AnnotationLabels: []string{"team", "criticality"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	annotations := cfg.CIDRGroupAnnotations(net.ParseIP("10.0.1.5"))
+	if annotations["team"] != "storage" || annotations["tier"] != "1" {
+		t.Errorf("CIDRGroupAnnotations() = %v", annotations)
+	}
+	// The annotations are a copy.
+	annotations["team"] = "changed"
+	if cfg.CIDRGroups[0].Annotations["team"] != "storage" {
+		t.Errorf("CIDRGroupAnnotations() returned the annotations of the group")
+	}
+	if annotations := cfg.CIDRGroupAnnotations(net.ParseIP("10.0.2.5")); annotations != nil {
+		t.Errorf("CIDRGroupAnnotations() of a group without annotations = %v", annotations)
+	}
+	if values := cfg.AnnotationLabelValues(cfg.CIDRGroups[0]); !reflect.DeepEqual(values, []string{"storage", ""}) {
+		t.Errorf("AnnotationLabelValues() = %q", values)
+	}
+
+	for _, labels := range [][]string{{"sni"}, {"owner-team"}} {
+		if err := (&Config{AnnotationLabels: labels}).Validate(); err == nil {
+			t.Errorf("Validate() with annotation labels %q should fail", labels)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package conntrack resolves the connections to the virtual IPs of
+// Kubernetes Services to the backends kube-proxy chose for them. The
+// iptables mode of kube-proxy translates the destination with netfilter,
+// the IPVS mode with IPVS, so the connection tracking tables of both are
+// read from procfs.
+package conntrack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	netfilterTable = "/proc/net/nf_conntrack"
+	ipvsTable      = "/proc/net/ip_vs_conn"
+)
+
+// Tuple identifies a TCP connection by the addresses the client sent
+// its packets to, before the translation.
+type Tuple struct {
+	SourceIP, DestIP     string
+	SourcePort, DestPort uint16
+}
+
+// Table maps the tuples of the translated connections to the IPs of
+// their backends.
+type Table map[Tuple]string
+
+// Resolver reads the backends of the connections to the Services.
+type Resolver struct {
+	services []*net.IPNet
+	// tables are the paths of the netfilter and the IPVS table.
+	tables []string
+}
+
+// NewResolver creates a resolver of the connections to the IPs of the
+// CIDRs, e.g. the ClusterIP range of the cluster.
+func NewResolver(serviceCIDRs string) (*Resolver, error) {
+	r := &Resolver{tables: []string{netfilterTable, ipvsTable}}
+	for _, c := range strings.Split(serviceCIDRs, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Service CIDR %q: %w", c, err)
+		}
+		r.services = append(r.services, network)
+	}
+	if len(r.services) == 0 {
+		return nil, errors.New("no Service CIDR")
+	}
+	return r, nil
+}
+
+// IsService returns whether the IP is in the Service CIDRs.
+func (r *Resolver) IsService(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range r.services {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads the translated connections to the Services. A missing
+// table is skipped, e.g. of IPVS with kube-proxy in iptables mode, but
+// one of them has to exist.
+func (r *Resolver) Read() (Table, error) {
+	table := make(Table)
+	found := false
+	for i, path := range r.tables {
+		file, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		parse := parseNetfilter
+		if i == 1 {
+			parse = parseIPVS
+		}
+		err = parse(file, r, table)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("none of the connection tracking tables %s exists", strings.Join(r.tables, ", "))
+	}
+	return table, nil
+}
+
+// parseNetfilter adds the TCP connections to the Services of the
+// netfilter table, whose lines have the original tuple followed by the
+// tuple of the replies, e.g.
+//
+//	ipv4 2 tcp 6 117 SYN_SENT src=10.0.0.1 dst=10.96.0.10 sport=40000 dport=443 [UNREPLIED] src=10.244.1.5 dst=10.0.0.1 sport=8443 dport=40000 mark=0 use=1
+//
+// The source of the replies is the backend.
+func parseNetfilter(r io.Reader, resolver *Resolver, table Table) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !hasField(fields, "tcp") {
+			continue
+		}
+		// The original and the reply tuple.
+		var tuples [2]map[string]string
+		n := 0
+		for _, f := range fields {
+			name, value, ok := strings.Cut(f, "=")
+			if !ok {
+				continue
+			}
+			if name == "src" {
+				n++
+			}
+			if n == 0 || n > 2 {
+				continue
+			}
+			if tuples[n-1] == nil {
+				tuples[n-1] = make(map[string]string)
+			}
+			tuples[n-1][name] = value
+		}
+		if n < 2 || !resolver.IsService(tuples[0]["dst"]) || tuples[1]["src"] == tuples[0]["dst"] {
+			continue
+		}
+		sport, err := strconv.ParseUint(tuples[0]["sport"], 10, 16)
+		if err != nil {
+			return err
+		}
+		dport, err := strconv.ParseUint(tuples[0]["dport"], 10, 16)
+		if err != nil {
+			return err
+		}
+		table[Tuple{SourceIP: tuples[0]["src"], DestIP: tuples[0]["dst"], SourcePort: uint16(sport), DestPort: uint16(dport)}] = tuples[1]["src"]
+	}
+	return scanner.Err()
+}
+
+// parseIPVS adds the TCP connections to the Services of the IPVS
+// table, whose lines have the client, the virtual and the real server
+// with hexadecimal IPv4 addresses and ports, e.g.
+//
+//	TCP 0A000001 9C40 0A60000A 01BB 0AF40105 20FB SYN_RECV 57
+func parseIPVS(r io.Reader, resolver *Resolver, table Table) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The header and the IPv6 connections are skipped.
+		if len(fields) < 7 || fields[0] != "TCP" || len(fields[1]) != 8 {
+			continue
+		}
+		var values [6]uint64
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i+1], 16, 32)
+			if err != nil {
+				return fmt.Errorf("invalid field %q: %w", fields[i+1], err)
+			}
+			values[i] = v
+		}
+		destIP := hexIP(values[2])
+		if !resolver.IsService(destIP) {
+			continue
+		}
+		table[Tuple{SourceIP: hexIP(values[0]), DestIP: destIP, SourcePort: uint16(values[1]), DestPort: uint16(values[3])}] = hexIP(values[4])
+	}
+	return scanner.Err()
+}
+
+func hasField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hexIP(v uint64) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(v))
+	return ip.String()
+}
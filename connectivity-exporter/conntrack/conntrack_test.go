@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package conntrack
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const netfilter = `ipv4     2 tcp      6 117 SYN_SENT src=10.0.0.1 dst=10.96.0.10 sport=40000 dport=443 [UNREPLIED] src=10.244.1.5 dst=10.0.0.1 sport=8443 dport=40000 mark=0 zone=0 use=2
+ipv4     2 tcp      6 86398 ESTABLISHED src=10.0.0.2 dst=10.96.0.10 sport=40001 dport=443 src=10.244.2.7 dst=10.0.0.2 sport=8443 dport=40001 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 86398 ESTABLISHED src=10.0.0.2 dst=192.168.0.1 sport=40002 dport=443 src=192.168.0.1 dst=10.0.0.2 sport=443 dport=40002 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 29 src=10.0.0.1 dst=10.96.0.53 sport=53000 dport=53 src=10.244.1.9 dst=10.0.0.1 sport=53 dport=53000 mark=0 zone=0 use=2
+ipv4     2 tcp      6 10 CLOSE src=10.0.0.3 dst=10.96.0.11 sport=40003 dport=443 src=10.96.0.11 dst=10.0.0.3 sport=443 dport=40003 mark=0 zone=0 use=2
+`
+
+const ipvs = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000004 9C44 0A60000C 01BB 0AF40308 20FB SYN_RECV         57
+TCP 0A000004 9C45 C0A80001 01BB C0A80001 01BB ESTABLISHED     900
+UDP 0A000004 CF08 0A600035 0035 0AF40109 0035 UDP              290
+`
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewResolver("10.96.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.tables = []string{filepath.Join(dir, "nf_conntrack"), filepath.Join(dir, "ip_vs_conn")}
+	if _, err := r.Read(); err == nil {
+		t.Error("Expected an error without any table")
+	}
+	if err := os.WriteFile(r.tables[0], []byte(netfilter), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r.tables[1], []byte(ipvs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connections outside of the Service CIDRs, of UDP and the
+	// ones which were not translated are skipped.
+	want := Table{
+		{SourceIP: "10.0.0.1", DestIP: "10.96.0.10", SourcePort: 40000, DestPort: 443}: "10.244.1.5",
+		{SourceIP: "10.0.0.2", DestIP: "10.96.0.10", SourcePort: 40001, DestPort: 443}: "10.244.2.7",
+		{SourceIP: "10.0.0.4", DestIP: "10.96.0.12", SourcePort: 40004, DestPort: 443}: "10.244.3.8",
+	}
+	if !reflect.DeepEqual(table, want) {
+		t.Errorf("got %v, want %v", table, want)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	if _, err := NewResolver(" , "); err == nil {
+		t.Error("Expected an error without a CIDR")
+	}
+	if _, err := NewResolver("10.96.0.0"); err == nil {
+		t.Error("Expected an error for an invalid CIDR")
+	}
+	r, err := NewResolver("10.96.0.0/12, fd00:10:96::/112")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"10.96.0.10": true, "10.112.0.1": false, "fd00:10:96::a": true, "invalid": false} {
+		if got := r.IsService(ip); got != want {
+			t.Errorf("IsService(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
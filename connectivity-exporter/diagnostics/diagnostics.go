@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package diagnostics writes the diagnostics bundle of a fatal failure:
+// a tar.gz archive of the eBPF maps and the internal state of the
+// exporter when it exits, so a rare crash can be analysed without
+// reproducing it.
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// bundleLayout is the layout of the time of the failure in the name of
+// a bundle.
+const bundleLayout = "20060102T150405Z"
+
+// File is a file of a bundle.
+type File struct {
+	Name  string
+	Write func(w io.Writer) error
+}
+
+// JSON returns the file with the value returned by get as indented
+// JSON.
+func JSON(name string, get func() (interface{}, error)) File {
+	return File{Name: name, Write: func(w io.Writer) error {
+		v, err := get()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}}
+}
+
+// Goroutines returns the file with the stacks of all goroutines.
+func Goroutines() File {
+	return File{Name: "goroutines.txt", Write: func(w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 2)
+	}}
+}
+
+// Metrics returns the file with the metrics of the gatherer in the text
+// format.
+func Metrics(gatherer prometheus.Gatherer) File {
+	return File{Name: "metrics.txt", Write: func(w io.Writer) error {
+		families, err := gatherer.Gather()
+		enc := expfmt.NewEncoder(w, expfmt.FmtText)
+		for _, f := range families {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return err
+	}}
+}
+
+// WriteBundle writes the files to a new bundle in the directory and
+// returns its name. The files are in a directory named like the bundle
+// without the suffix .tar.gz. A file which cannot be written is
+// replaced with the file of its name with the suffix .error holding
+// the error, so a failing file does not lose the others.
+func WriteBundle(dir string, now time.Time, files []File) (string, error) {
+	base := "diagnostics-" + now.UTC().Format(bundleLayout)
+	filename := filepath.Join(dir, base+".tar.gz")
+	// The bundle appears complete or not at all.
+	tmp, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeArchive(tmp, base, now, files); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+func writeArchive(w io.Writer, base string, now time.Time, files []File) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		name := f.Name
+		// A tar header needs the size before the content.
+		var buf bytes.Buffer
+		if err := f.Write(&buf); err != nil {
+			name += ".error"
+			buf.Reset()
+			fmt.Fprintln(&buf, err)
+		}
+		header := &tar.Header{
+			Name:    base + "/" + strings.TrimPrefix(name, "/"),
+			Mode:    0o644,
+			Size:    int64(buf.Len()),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package diagnostics
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	files := []File{
+		JSON("error.json", func() (interface{}, error) { return map[string]string{"error": "failed"}, nil }),
+		JSON("maps.json", func() (interface{}, error) { return nil, errors.New("no eBPF program loaded") }),
+	}
+	filename, err := WriteBundle(dir, now, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "diagnostics-20220501T100000Z.tar.gz"); filename != want {
+		t.Errorf("got bundle %s, want %s", filename, want)
+	}
+
+	// A failing file is replaced with its error.
+	want := map[string]string{
+		"diagnostics-20220501T100000Z/error.json":      "{\n  \"error\": \"failed\"\n}\n",
+		"diagnostics-20220501T100000Z/maps.json.error": "no eBPF program loaded\n",
+	}
+	if got := readBundle(t, filename); !reflect.DeepEqual(got, want) {
+		t.Errorf("got bundle %q, want %q", got, want)
+	}
+	// The temporary file is gone.
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("got directory %v, %v, want the bundle only", entries, err)
+	}
+}
+
+func readBundle(t *testing.T, filename string) map[string]string {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = string(b)
+	}
+}
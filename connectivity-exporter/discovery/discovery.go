@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package discovery ranks the destinations seen by a broad secondary
+// filter which the primary filter does not monitor, so the operators
+// can find the dependencies of a node they should add to the SLOs.
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Expiration is the time a destination is kept without sampled
+// connections.
+const Expiration = 24 * time.Hour
+
+// Destination is an unmonitored destination of an SNI.
+type Destination struct {
+	SNI    string `json:"sni"`
+	DestIP string `json:"destIP"`
+	// Connections and FailedConnections are estimated from the sampled
+	// increments, scaled by the sample rate.
+	Connections       float64   `json:"connections"`
+	FailedConnections float64   `json:"failedConnections"`
+	FirstSeen         time.Time `json:"firstSeen"`
+	LastSeen          time.Time `json:"lastSeen"`
+}
+
+// Tracker samples the increments of the unmonitored SNIs and keeps up
+// to a maximum number of destinations. When it is full, the destination
+// with the fewest connections makes room for a new one.
+type Tracker struct {
+	rate            float64
+	maxDestinations int
+	// random returns the samples in [0, 1).
+	random func() float64
+
+	mutex        sync.Mutex
+	snis         map[string]map[string]*Destination
+	destinations int
+}
+
+// NewTracker creates a tracker sampling the share rate of the
+// increments, in (0, 1], and keeping up to maxDestinations.
+func NewTracker(rate float64, maxDestinations int) (*Tracker, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid sample rate %v, it has to be in (0, 1]", rate)
+	}
+	if maxDestinations <= 0 {
+		return nil, fmt.Errorf("invalid maximum number of destinations %d", maxDestinations)
+	}
+	return &Tracker{
+		rate:            rate,
+		maxDestinations: maxDestinations,
+		random:          rand.Float64,
+		snis:            make(map[string]map[string]*Destination),
+	}, nil
+}
+
+// Observe samples an increment of an unmonitored SNI. Increments
+// without connections are ignored.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	connections := inc.SuccessfulConnections + inc.RejectedConnections
+	if connections == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.random() >= t.rate {
+		return
+	}
+	t.expire(inc.Time)
+	d, ok := t.snis[inc.SNI][inc.DestIP]
+	if !ok {
+		if t.destinations >= t.maxDestinations {
+			t.evict()
+		}
+		dests, ok := t.snis[inc.SNI]
+		if !ok {
+			dests = make(map[string]*Destination)
+			t.snis[inc.SNI] = dests
+		}
+		d = &Destination{SNI: inc.SNI, DestIP: inc.DestIP, FirstSeen: inc.Time}
+		dests[inc.DestIP] = d
+		t.destinations++
+	}
+	d.Connections += connections / t.rate
+	d.FailedConnections += inc.RejectedConnections / t.rate
+	if inc.Time.After(d.LastSeen) {
+		d.LastSeen = inc.Time
+	}
+}
+
+// Forget removes the destinations of an SNI which became monitored.
+func (t *Tracker) Forget(sni string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.destinations -= len(t.snis[sni])
+	delete(t.snis, sni)
+}
+
+// Ranked returns up to limit destinations seen since the expiration,
+// the ones with the most connections first. A limit of 0 returns all of
+// them.
+func (t *Tracker) Ranked(limit int, now time.Time) []Destination {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.expire(now)
+	ranked := make([]Destination, 0, t.destinations)
+	for _, dests := range t.snis {
+		for _, d := range dests {
+			ranked = append(ranked, *d)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Connections != ranked[j].Connections {
+			return ranked[i].Connections > ranked[j].Connections
+		}
+		if ranked[i].SNI != ranked[j].SNI {
+			return ranked[i].SNI < ranked[j].SNI
+		}
+		return ranked[i].DestIP < ranked[j].DestIP
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// expire removes the destinations without sampled connections since
+// the expiration.
+func (t *Tracker) expire(now time.Time) {
+	for sni, dests := range t.snis {
+		for ip, d := range dests {
+			if d.LastSeen.Add(Expiration).Before(now) {
+				delete(dests, ip)
+				t.destinations--
+			}
+		}
+		if len(dests) == 0 {
+			delete(t.snis, sni)
+		}
+	}
+}
+
+// evict removes the destination with the fewest connections, the least
+// recently seen one of those.
+func (t *Tracker) evict() {
+	var victim *Destination
+	for _, dests := range t.snis {
+		for _, d := range dests {
+			if victim == nil || d.Connections < victim.Connections ||
+				d.Connections == victim.Connections && d.LastSeen.Before(victim.LastSeen) {
+				victim = d
+			}
+		}
+	}
+	if victim == nil {
+		return
+	}
+	delete(t.snis[victim.SNI], victim.DestIP)
+	t.destinations--
+	if len(t.snis[victim.SNI]) == 0 {
+		delete(t.snis, victim.SNI)
+	}
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discovery
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"m/metrics"
+)
+
+func TestTracker(t *testing.T) {
+	tracker, err := NewTracker(0.5, 3)
+	if err != nil {
+		t.Fatalf("Creating tracker: %v", err)
+	}
+	// Every other increment is sampled.
+	var samples int
+	tracker.random = func() float64 {
+		samples++
+		if samples%2 == 1 {
+			return 0
+		}
+		return 0.9
+	}
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(minute int, sni, destIP string, successful, rejected float64) {
+		tracker.Observe(&metrics.Inc{SNI: sni, DestIP: destIP, SuccessfulConnections: successful, RejectedConnections: rejected, Time: start.Add(time.Duration(minute) * time.Minute)})
+	}
+	observe(0, "db.example.com", "10.0.0.1", 3, 1)
+	observe(0, "db.example.com", "10.0.0.1", 100, 0) // not sampled
+	// Increments without connections are not sampled.
+	observe(0, "idle.example.com", "10.0.0.9", 0, 0)
+	observe(1, "api.example.com", "10.0.1.1", 10, 0)
+	observe(1, "api.example.com", "10.0.1.1", 100, 0) // not sampled
+	observe(2, "cache.example.com", "10.0.2.1", 1, 0)
+	observe(2, "cache.example.com", "10.0.2.1", 100, 0) // not sampled
+	// The tracker is full, the destination with the fewest connections
+	// makes room.
+	observe(3, "queue.example.com", "10.0.3.1", 5, 0)
+
+	want := []Destination{
+		{SNI: "api.example.com", DestIP: "10.0.1.1", Connections: 20, FirstSeen: start.Add(time.Minute), LastSeen: start.Add(time.Minute)},
+		{SNI: "queue.example.com", DestIP: "10.0.3.1", Connections: 10, FirstSeen: start.Add(3 * time.Minute), LastSeen: start.Add(3 * time.Minute)},
+		{SNI: "db.example.com", DestIP: "10.0.0.1", Connections: 8, FailedConnections: 2, FirstSeen: start, LastSeen: start},
+	}
+	if got := tracker.Ranked(0, start.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got ranked destinations %+v, want %+v", got, want)
+	}
+	if got := tracker.Ranked(1, start.Add(time.Hour)); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Got top destination %+v, want %+v", got, want[:1])
+	}
+
+	// A monitored SNI is forgotten, the others expire.
+	tracker.Forget("api.example.com")
+	if got := tracker.Ranked(0, start.Add(time.Hour)); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("Got destinations %+v after forgetting, want %+v", got, want[1:])
+	}
+	if got := tracker.Ranked(0, start.Add(2*time.Minute+Expiration)); !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("Got destinations %+v after the expiration, want %+v", got, want[1:2])
+	}
+}
+
+func TestNewTracker(t *testing.T) {
+	for _, tc := range []struct {
+		rate            float64
+		maxDestinations int
+		wantErr         bool
+	}{
+		{rate: 1, maxDestinations: 1},
+		{rate: 0.01, maxDestinations: 1000},
+		{rate: 0, maxDestinations: 1000, wantErr: true},
+		{rate: 1.5, maxDestinations: 1000, wantErr: true},
+		{rate: 0.1, maxDestinations: 0, wantErr: true},
+	} {
+		if _, err := NewTracker(tc.rate, tc.maxDestinations); (err != nil) != tc.wantErr {
+			t.Errorf("NewTracker(%v, %d): got error %v, want error %v", tc.rate, tc.maxDestinations, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dns tracks the DNS queries of the clients and their
+// responses, so failures of the name resolution stand out next to the
+// failures of the connections to the SNIs. The eBPF program passes the
+// DNS messages over UDP and TCP on, the queries are correlated with
+// their responses here.
+package dns
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"m/metrics"
+)
+
+const (
+	// Other is the queried name of the queries beyond the limit of the
+	// names.
+	Other = "other"
+	// QueryTimeout is the time after which a query without a response
+	// is accounted as timed out.
+	QueryTimeout = 5 * time.Second
+	// maxPendingQueries bounds the queries waiting for their response.
+	maxPendingQueries = 10000
+)
+
+// rcodes are the names of the common response codes, the others are
+// exported as their numbers.
+var rcodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "noerror",
+	layers.DNSResponseCodeFormErr:  "formerr",
+	layers.DNSResponseCodeServFail: "servfail",
+	layers.DNSResponseCodeNXDomain: "nxdomain",
+	layers.DNSResponseCodeNotImp:   "notimp",
+	layers.DNSResponseCodeRefused:  "refused",
+}
+
+// queryKey identifies a query by its client, server and ID. The
+// response is sent back from the server to the client.
+type queryKey struct {
+	client, server         [4]byte
+	clientPort, serverPort uint16
+	id                     uint16
+}
+
+type query struct {
+	qname string
+	sent  time.Time
+}
+
+// series are the label values a queried name was exported with.
+type series struct {
+	lastUpdate time.Time
+	qtypes     map[string]struct{}
+	rcodes     map[string]struct{}
+}
+
+// Tracker correlates the DNS queries with their responses. It is not
+// safe for concurrent use, the messages are handled by the goroutine
+// capturing them.
+type Tracker struct {
+	maxQNames int
+	pending   map[queryKey]query
+	series    map[string]*series
+
+	eth     layers.Ethernet
+	vlan    layers.Dot1Q
+	ip      layers.IPv4
+	udp     layers.UDP
+	tcp     layers.TCP
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	msg     layers.DNS
+}
+
+// NewTracker creates a tracker exporting the metrics of up to
+// maxQNames queried names, the queries of further names are accounted
+// as Other.
+func NewTracker(maxQNames int) *Tracker {
+	t := &Tracker{
+		maxQNames: maxQNames,
+		pending:   make(map[queryKey]query),
+		series:    make(map[string]*series),
+		decoded:   make([]gopacket.LayerType, 0, 4),
+	}
+	t.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &t.eth, &t.vlan, &t.ip, &t.udp, &t.tcp)
+	t.parser.IgnoreUnsupported = true
+	return t
+}
+
+// Handle accounts the DNS message of a frame. Over TCP, only the first
+// message of a segment is accounted.
+func (t *Tracker) Handle(data []byte, now time.Time) {
+	// The error of the DNS layer, which is not decoded by the parser,
+	// is ignored, the decoded layers are checked instead.
+	_ = t.parser.DecodeLayers(data, &t.decoded)
+	var payload []byte
+	var key queryKey
+	for _, l := range t.decoded {
+		switch l {
+		case layers.LayerTypeUDP:
+			payload = t.udp.Payload
+			key.clientPort, key.serverPort = uint16(t.udp.SrcPort), uint16(t.udp.DstPort)
+		case layers.LayerTypeTCP:
+			if len(t.tcp.Payload) < 2 {
+				return
+			}
+			length := int(binary.BigEndian.Uint16(t.tcp.Payload))
+			payload = t.tcp.Payload[2:]
+			if length < len(payload) {
+				payload = payload[:length]
+			}
+			key.clientPort, key.serverPort = uint16(t.tcp.SrcPort), uint16(t.tcp.DstPort)
+		}
+	}
+	if payload == nil || t.ip.SrcIP.To4() == nil || t.ip.DstIP.To4() == nil {
+		return
+	}
+	copy(key.client[:], t.ip.SrcIP.To4())
+	copy(key.server[:], t.ip.DstIP.To4())
+	if err := t.msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	if t.msg.OpCode != layers.DNSOpCodeQuery || len(t.msg.Questions) != 1 {
+		return
+	}
+	key.id = t.msg.ID
+
+	if !t.msg.QR {
+		qname := t.qname(string(t.msg.Questions[0].Name), now)
+		qtype := t.msg.Questions[0].Type.String()
+		if qtype == "Unknown" {
+			qtype = strconv.Itoa(int(t.msg.Questions[0].Type))
+		}
+		t.series[qname].qtypes[qtype] = struct{}{}
+		metrics.IncDNSQueries(qname, qtype)
+		// A retransmitted query keeps the time of the first one.
+		if _, ok := t.pending[key]; !ok && len(t.pending) < maxPendingQueries {
+			t.pending[key] = query{qname: qname, sent: now}
+		}
+		return
+	}
+
+	// The response is sent in the opposite direction of its query.
+	key.client, key.server = key.server, key.client
+	key.clientPort, key.serverPort = key.serverPort, key.clientPort
+	q, ok := t.pending[key]
+	if !ok {
+		// The responses to the queries not seen are not accounted,
+		// e.g. to those sent before the start.
+		return
+	}
+	delete(t.pending, key)
+	rcode, ok := rcodes[t.msg.ResponseCode]
+	if !ok {
+		rcode = strconv.Itoa(int(t.msg.ResponseCode))
+	}
+	// The series of a pending query does not expire, the query times
+	// out first.
+	s := t.series[q.qname]
+	s.rcodes[rcode] = struct{}{}
+	s.lastUpdate = now
+	metrics.IncDNSResponses(q.qname, rcode)
+	metrics.ObserveDNSResponseLatency(q.qname, now.Sub(q.sent))
+}
+
+// qname returns the name the queries of the name are accounted to and
+// marks its series as updated. The names are case-insensitive.
+func (t *Tracker) qname(name string, now time.Time) string {
+	name = strings.ToLower(name)
+	if name == "" {
+		name = "."
+	}
+	s, ok := t.series[name]
+	if !ok {
+		if len(t.series) >= t.maxQNames {
+			name = Other
+			s, ok = t.series[name]
+		}
+		if !ok {
+			s = &series{qtypes: make(map[string]struct{}), rcodes: make(map[string]struct{})}
+			t.series[name] = s
+		}
+	}
+	s.lastUpdate = now
+	return name
+}
+
+// Expire accounts the queries without a response in time as timed out
+// and deletes the metrics of the names without queries for longer than
+// the expiration of the metrics.
+func (t *Tracker) Expire(now time.Time) {
+	for key, q := range t.pending {
+		if now.Sub(q.sent) > QueryTimeout {
+			delete(t.pending, key)
+			metrics.IncDNSTimeouts(q.qname)
+			t.series[q.qname].lastUpdate = now
+		}
+	}
+	for qname, s := range t.series {
+		if s.lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteDNSMetrics(qname, keys(s.qtypes), keys(s.rcodes))
+			delete(t.series, qname)
+		}
+	}
+}
+
+func keys(m map[string]struct{}) []string {
+	l := make([]string, 0, len(m))
+	for k := range m {
+		l = append(l, k)
+	}
+	return l
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+)
+
+var (
+	client = net.IPv4(10, 0, 0, 1)
+	server = net.IPv4(10, 0, 0, 53)
+)
+
+// frame returns the frame of a DNS message from the source to the
+// destination, over TCP with its length if tcp is set.
+func frame(t *testing.T, msg *layers.DNS, src, dst net.IP, srcPort, dstPort uint16, tcp bool) []byte {
+	t.Helper()
+	dnsBuf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(dnsBuf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	payload := dnsBuf.Bytes()
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+	var transport gopacket.SerializableLayer
+	if tcp {
+		ip.Protocol = layers.IPProtocolTCP
+		l := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), PSH: true, ACK: true, Window: 1024}
+		if err := l.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		transport = l
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(payload)))
+		payload = append(length, payload...)
+	} else {
+		ip.Protocol = layers.IPProtocolUDP
+		l := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		if err := l.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		transport = l
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func message(id uint16, qname string, response bool, rcode layers.DNSResponseCode) *layers.DNS {
+	return &layers.DNS{
+		ID:           id,
+		QR:           response,
+		OpCode:       layers.DNSOpCodeQuery,
+		ResponseCode: rcode,
+		Questions:    []layers.DNSQuestion{{Name: []byte(qname), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(2)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	exchange := func(id uint16, qname string, rcode layers.DNSResponseCode, latency time.Duration, tcp bool) {
+		tracker.Handle(frame(t, message(id, qname, false, 0), client, server, 40000, 53, tcp), start)
+		if latency > 0 {
+			tracker.Handle(frame(t, message(id, qname, true, rcode), server, client, 53, 40000, tcp), start.Add(latency))
+		}
+	}
+	exchange(1, "api.example.com", layers.DNSResponseCodeNoErr, 10*time.Millisecond, false)
+	// The names are case-insensitive.
+	exchange(2, "API.example.com", layers.DNSResponseCodeNoErr, 10*time.Millisecond, true)
+	exchange(3, "missing.example.com", layers.DNSResponseCodeNXDomain, 10*time.Millisecond, false)
+	// Beyond the limit of the names.
+	exchange(4, "broken.example.com", layers.DNSResponseCodeServFail, 10*time.Millisecond, false)
+	// Without a response.
+	exchange(5, "api.example.com", 0, 0, false)
+	// A response to a query not seen.
+	tracker.Handle(frame(t, message(6, "api.example.com", true, 0), server, client, 53, 40000, false), start)
+	tracker.Expire(start.Add(QueryTimeout + time.Second))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_dns_queries_total Total number of DNS queries per queried name and type.
+		# TYPE connectivity_exporter_dns_queries_total counter
+		connectivity_exporter_dns_queries_total{qname="api.example.com",qtype="A"} 3
+		connectivity_exporter_dns_queries_total{qname="missing.example.com",qtype="A"} 1
+		connectivity_exporter_dns_queries_total{qname="other",qtype="A"} 1
+		# HELP connectivity_exporter_dns_responses_total Total number of DNS responses per queried name and response code.
+		# TYPE connectivity_exporter_dns_responses_total counter
+		connectivity_exporter_dns_responses_total{qname="api.example.com",rcode="noerror"} 2
+		connectivity_exporter_dns_responses_total{qname="missing.example.com",rcode="nxdomain"} 1
+		connectivity_exporter_dns_responses_total{qname="other",rcode="servfail"} 1
+		# HELP connectivity_exporter_dns_timeouts_total Total number of DNS queries without a response per queried name.
+		# TYPE connectivity_exporter_dns_timeouts_total counter
+		connectivity_exporter_dns_timeouts_total{qname="api.example.com"} 1
+	`
+	names := []string{"connectivity_exporter_dns_queries_total", "connectivity_exporter_dns_responses_total", "connectivity_exporter_dns_timeouts_total"}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(metrics.NewCollector(), "connectivity_exporter_dns_response_latency_seconds"); n != 3 {
+		t.Errorf("got %d latency histograms, want 3", n)
+	}
+
+	// The names without queries expire.
+	tracker.Expire(start.Add(metrics.Expiration + time.Minute))
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(""), names...); err != nil {
+		t.Error(err)
+	}
+	if len(tracker.series) != 0 || len(tracker.pending) != 0 {
+		t.Errorf("got %d series and %d pending queries after the expiration, want none", len(tracker.series), len(tracker.pending))
+	}
+}
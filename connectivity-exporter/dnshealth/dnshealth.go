@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dnshealth probes the node-local DNS cache, so failures of an
+// SNI can be correlated with failures of the name resolution.
+package dnshealth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+const (
+	// CorrelationWindow is the time before and after a failure of an
+	// SNI in which a failed probe makes DNS the suspected cause.
+	CorrelationWindow = 30 * time.Second
+	// retention is the time the failed probes are kept.
+	retention = 10 * time.Minute
+)
+
+// Prober resolves a name with the DNS server on every tick and keeps
+// the times of the failed probes.
+type Prober struct {
+	name     string
+	timeout  time.Duration
+	resolver *net.Resolver
+
+	mutex    sync.Mutex
+	failures []time.Time
+}
+
+// NewProber creates a prober resolving the name with the DNS server at
+// the address, e.g. the node-local DNS cache at 169.254.20.10:53.
+func NewProber(server, name string, timeout time.Duration) *Prober {
+	dialer := &net.Dialer{}
+	return &Prober{
+		name:    name,
+		timeout: timeout,
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, server)
+			},
+		},
+	}
+}
+
+// Run probes the DNS server on every tick.
+func (p *Prober) Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time) {
+	defer wg.Done()
+	done := ctx.Done()
+	for {
+		select {
+		case now := <-ticks:
+			p.probe(ctx, now)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *Prober) probe(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if _, err := p.resolver.LookupHost(ctx, p.name); err != nil {
+		klog.V(2).Infof("DNS probe of %s failed: %v", p.name, err)
+		metrics.IncDNSProbes("failed")
+		p.record(now)
+		return
+	}
+	metrics.IncDNSProbes("succeeded")
+}
+
+func (p *Prober) record(failure time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.failures = append(p.failures, failure)
+	oldest := failure.Add(-retention)
+	expired := 0
+	for expired < len(p.failures) && p.failures[expired].Before(oldest) {
+		expired++
+	}
+	p.failures = p.failures[expired:]
+}
+
+// FailedAround reports whether a probe failed within the correlation
+// window around the time t.
+func (p *Prober) FailedAround(t time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, f := range p.failures {
+		if !f.Before(t.Add(-CorrelationWindow)) && !f.After(t.Add(CorrelationWindow)) {
+			return true
+		}
+	}
+	return false
+}
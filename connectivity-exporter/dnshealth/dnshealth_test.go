@@ -0,0 +1,43 @@
+package dnshealth
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFailedAround(t *testing.T) {
+	// Nothing listens on the port of the closed socket.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	prober := NewProber(addr, "kubernetes.default.svc.cluster.local.", time.Second)
+	failure := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	prober.probe(context.Background(), failure)
+
+	for _, tc := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{failure, true},
+		{failure.Add(-CorrelationWindow), true},
+		{failure.Add(CorrelationWindow), true},
+		{failure.Add(CorrelationWindow + time.Second), false},
+		{failure.Add(-CorrelationWindow - time.Second), false},
+	} {
+		if got := prober.FailedAround(tc.t); got != tc.want {
+			t.Errorf("FailedAround(%s) = %v, want %v", tc.t, got, tc.want)
+		}
+	}
+
+	// The failures older than the retention are removed.
+	prober.record(failure.Add(retention + time.Minute))
+	if prober.FailedAround(failure) {
+		t.Errorf("The first failure should be expired")
+	}
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Connection are the connections of an SNI from a source to a
+// destination with the same outcome, accounted in one second.
+type Connection struct {
+	Time     time.Time `json:"time"`
+	SNI      string    `json:"sni"`
+	SourceIP string    `json:"sourceIP"`
+	DestIP   string    `json:"destIP"`
+	// Outcome is the kind of the connections_total metric.
+	Outcome string  `json:"outcome"`
+	Count   float64 `json:"count"`
+}
+
+// Filter selects connection events. Empty fields match all events.
+type Filter struct {
+	// SNI is a pattern as in path.Match.
+	SNI      string
+	SourceIP string
+	Outcome  string
+	// Since and Until bound the time of the events, both inclusive.
+	Since, Until time.Time
+}
+
+func (f Filter) matches(c *Connection) bool {
+	if f.SNI != "" {
+		if ok, _ := path.Match(f.SNI, c.SNI); !ok {
+			return false
+		}
+	}
+	if f.SourceIP != "" && f.SourceIP != c.SourceIP {
+		return false
+	}
+	if f.Outcome != "" && f.Outcome != c.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && c.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && c.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Buffer keeps the connection events of the last retention in a ring
+// buffer, so they can be queried without an external sink. If more
+// events arrive within the retention, the oldest ones are dropped.
+type Buffer struct {
+	retention time.Duration
+
+	mutex sync.Mutex
+	// events is a ring of the events in the order of their time,
+	// the oldest at start.
+	events       []Connection
+	start, count int
+}
+
+// NewBuffer creates a buffer with space for size events.
+func NewBuffer(retention time.Duration, size int) *Buffer {
+	return &Buffer{retention: retention, events: make([]Connection, size)}
+}
+
+// Observe adds an event for every outcome of the connections of the
+// increment.
+func (b *Buffer) Observe(inc *metrics.Inc) {
+	outcomes := []struct {
+		name  string
+		count float64
+	}{
+		{"successful", inc.SuccessfulConnections},
+		{"rejected", inc.RejectedConnections},
+		{"rejected_by_client", inc.RejectedConnectionsByClient},
+		{"rejected_by_middlebox", inc.RejectedConnectionsByMiddlebox},
+		{"rejected_by_network", inc.RejectedConnectionsByNetwork},
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(inc.Time)
+	for _, o := range outcomes {
+		if o.count == 0 || len(b.events) == 0 {
+			continue
+		}
+		c := Connection{Time: inc.Time, SNI: inc.SNI, SourceIP: inc.SourceIP, DestIP: inc.DestIP, Outcome: o.name, Count: o.count}
+		if b.count == len(b.events) {
+			b.events[b.start] = c
+			b.start = (b.start + 1) % len(b.events)
+			continue
+		}
+		b.events[(b.start+b.count)%len(b.events)] = c
+		b.count++
+	}
+}
+
+// Query returns the events matching the filter, the oldest first.
+// The events older than the retention at the time now are dropped.
+func (b *Buffer) Query(f Filter, now time.Time) ([]Connection, error) {
+	if _, err := path.Match(f.SNI, ""); err != nil {
+		return nil, fmt.Errorf("invalid SNI pattern %q: %w", f.SNI, err)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(now)
+	out := []Connection{}
+	for i := 0; i < b.count; i++ {
+		c := &b.events[(b.start+i)%len(b.events)]
+		if f.matches(c) {
+			out = append(out, *c)
+		}
+	}
+	return out, nil
+}
+
+func (b *Buffer) expire(now time.Time) {
+	oldest := now.Add(-b.retention)
+	for b.count > 0 && b.events[b.start].Time.Before(oldest) {
+		b.events[b.start] = Connection{}
+		b.start = (b.start + 1) % len(b.events)
+		b.count--
+	}
+}
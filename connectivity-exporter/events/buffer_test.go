@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	"m/metrics"
+)
+
+func TestBuffer(t *testing.T) {
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	b := NewBuffer(time.Minute, 4)
+	b.Observe(&metrics.Inc{SNI: "a.example.com", SourceIP: "10.0.0.1", SuccessfulConnections: 2, RejectedConnections: 1, Time: start})
+	b.Observe(&metrics.Inc{SNI: "b.example.com", SourceIP: "10.0.0.2", SuccessfulConnections: 1, Time: start.Add(time.Second)})
+	// No connections, no events.
+	b.Observe(&metrics.Inc{SNI: "b.example.com", SourceIP: "10.0.0.2", Time: start.Add(2 * time.Second)})
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"all", Filter{}, 3},
+		{"sni", Filter{SNI: "a.*"}, 2},
+		{"source", Filter{SourceIP: "10.0.0.2"}, 1},
+		{"outcome", Filter{Outcome: "rejected"}, 1},
+		{"since", Filter{Since: start.Add(time.Second)}, 1},
+		{"until", Filter{Until: start}, 2},
+	} {
+		got, err := b.Query(tc.filter, start)
+		if err != nil {
+			t.Fatalf("%s: Query() = %v", tc.name, err)
+		}
+		if len(got) != tc.want {
+			t.Errorf("%s: got %d events, want %d: %+v", tc.name, len(got), tc.want, got)
+		}
+	}
+
+	// The oldest event is dropped when the buffer is full.
+	b.Observe(&metrics.Inc{SNI: "c.example.com", SuccessfulConnections: 1, RejectedConnectionsByClient: 1, Time: start.Add(3 * time.Second)})
+	got, _ := b.Query(Filter{}, start)
+	if len(got) != 4 || got[0].SNI != "a.example.com" || got[0].Outcome != "rejected" || got[3].Outcome != "rejected_by_client" {
+		t.Errorf("Wrong events after the buffer was full: %+v", got)
+	}
+
+	// The events older than the retention are dropped.
+	got, _ = b.Query(Filter{}, start.Add(time.Minute+2*time.Second))
+	if len(got) != 2 || got[0].SNI != "c.example.com" {
+		t.Errorf("Wrong events after the retention: %+v", got)
+	}
+
+	if _, err := b.Query(Filter{SNI: "["}, start); err == nil {
+		t.Errorf("Query() with an invalid pattern should fail")
+	}
+}
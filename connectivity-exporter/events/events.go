@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package events writes the failure events of the exporter as JSON
+// lines and keeps the recent connection events in memory.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+	"m/sink"
+	"m/traceroute"
+)
+
+// SchemaVersion is the version of the schema of the events in
+// failure.schema.json. It is only increased by incompatible changes,
+// fields may be added to any version.
+const SchemaVersion = 1
+
+// Failure is emitted when the seconds of an SNI start failing.
+type Failure struct {
+	// Version is the SchemaVersion of the event, set when it is written.
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`
+	SNI      string    `json:"sni"`
+	SourceIP string    `json:"sourceIP"`
+	DestIP   string    `json:"destIP"`
+	// Path is the traceroute to the destination at the time of the
+	// failure, if enabled.
+	Path []traceroute.Hop `json:"path,omitempty"`
+	// PathError is set if the traceroute failed.
+	PathError string `json:"pathError,omitempty"`
+	// Annotations hint at the cause of the failure, e.g.
+	// suspected_cause=dns, and hold the annotations of the CIDR group
+	// of the destination.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// DNSHealth tells whether the name resolution failed around a time.
+type DNSHealth interface {
+	FailedAround(t time.Time) bool
+}
+
+// Tracer discovers the path to a destination.
+type Tracer interface {
+	// Allow checks whether a traceroute to the destination may start
+	// at the time now. Done is called after each allowed traceroute.
+	Allow(destIP string, now time.Time) bool
+	Done()
+	Trace(ctx context.Context, destIP string) ([]traceroute.Hop, error)
+}
+
+// Process queues the failures received over the channel for the sink
+// out, see Writer. If tracer is not nil, the path to the destination
+// is traced asynchronously before the failure is queued. If dns is not
+// nil, the failures with a concurrent failure of the name resolution
+// are annotated with suspected_cause=dns. The failures still buffered
+// in the channel when the context is done are queued without a path.
+func Process(ctx context.Context, wg *sync.WaitGroup, failures <-chan *Failure, tracer Tracer, dns DNSHealth, out *sink.Queue) {
+	defer wg.Done()
+	defer klog.Infoln("Bye.")
+	done := ctx.Done()
+	traces := &sync.WaitGroup{}
+	defer traces.Wait()
+
+	for {
+		select {
+		case <-done:
+			for {
+				select {
+				case f := <-failures:
+					if dns != nil && dns.FailedAround(f.Time) {
+						f.annotate("suspected_cause", "dns")
+					}
+					out.Offer(f)
+				default:
+					return
+				}
+			}
+		case f := <-failures:
+			if dns != nil && dns.FailedAround(f.Time) {
+				f.annotate("suspected_cause", "dns")
+			}
+			if tracer == nil {
+				out.Offer(f)
+				continue
+			}
+			if !tracer.Allow(f.DestIP, f.Time) {
+				metrics.IncTraceroutes("rate_limited")
+				out.Offer(f)
+				continue
+			}
+			traces.Add(1)
+			go func() {
+				defer traces.Done()
+				defer tracer.Done()
+				path, err := tracer.Trace(ctx, f.DestIP)
+				f.Path = path
+				if err != nil {
+					metrics.IncTraceroutes("failed")
+					f.PathError = err.Error()
+				} else {
+					metrics.IncTraceroutes("completed")
+				}
+				out.Offer(f)
+			}()
+		}
+	}
+}
+
+func (f *Failure) annotate(key, value string) {
+	if f.Annotations == nil {
+		f.Annotations = make(map[string]string)
+	}
+	f.Annotations[key] = value
+}
+
+// Writer returns the delivery of the failures to w as JSON lines, for
+// the queue of the sink. The queue delivers from a single goroutine.
+func Writer(w io.Writer) func(item interface{}) error {
+	encoder := json.NewEncoder(w)
+	return func(item interface{}) error {
+		f := item.(*Failure)
+		f.Version = SchemaVersion
+		return encoder.Encode(f)
+	}
+}
@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"m/sink"
+	"m/traceroute"
+)
+
+type fakeTracer struct {
+	allowed map[string]bool
+	paths   map[string][]traceroute.Hop
+}
+
+func (t *fakeTracer) Allow(destIP string, now time.Time) bool { return t.allowed[destIP] }
+func (t *fakeTracer) Done()                                   {}
+func (t *fakeTracer) Trace(ctx context.Context, destIP string) ([]traceroute.Hop, error) {
+	path, ok := t.paths[destIP]
+	if !ok {
+		return nil, errors.New("no route")
+	}
+	return path, nil
+}
+
+// newQueue returns the queue writing the failures to out and a function
+// delivering the queued failures.
+func newQueue(out io.Writer) (*sink.Queue, func()) {
+	queue := sink.NewQueue("failure_events", sink.DefaultOptions, Writer(out))
+	return queue, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		queue.Run(ctx, wg)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	path := []traceroute.Hop{{TTL: 1, IP: "192.168.0.1", RTT: time.Millisecond}, {TTL: 2}}
+	tracer := &fakeTracer{
+		allowed: map[string]bool{"10.0.0.1": true, "10.0.0.2": true},
+		paths:   map[string][]traceroute.Hop{"10.0.0.1": path},
+	}
+	failures := make(chan *Failure)
+	out := &bytes.Buffer{}
+	queue, deliver := newQueue(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go Process(ctx, wg, failures, tracer, nil, queue)
+
+	failures <- &Failure{SNI: "traced.example.com", DestIP: "10.0.0.1"}
+	failures <- &Failure{SNI: "failed.example.com", DestIP: "10.0.0.2"}
+	failures <- &Failure{SNI: "rate-limited.example.com", DestIP: "10.0.0.3"}
+	cancel()
+	wg.Wait()
+	deliver()
+
+	got := map[string]Failure{}
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		f := Failure{}
+		if err := decoder.Decode(&f); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		got[f.SNI] = f
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %v", got)
+	}
+	if !reflect.DeepEqual(got["traced.example.com"].Path, path) {
+		t.Errorf("wrong path: %v", got["traced.example.com"].Path)
+	}
+	if got["failed.example.com"].PathError != "no route" {
+		t.Errorf("wrong path error: %q", got["failed.example.com"].PathError)
+	}
+	if f := got["rate-limited.example.com"]; f.Path != nil || f.PathError != "" {
+		t.Errorf("rate limited failure should not be traced: %+v", f)
+	}
+}
+
+func TestProcessDrainsFailures(t *testing.T) {
+	failures := make(chan *Failure, 10)
+	failures <- &Failure{SNI: "buffered.example.com"}
+	out := &bytes.Buffer{}
+	queue, deliver := newQueue(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	// The data source stopped before, its failures are still written.
+	cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	Process(ctx, wg, failures, nil, nil, queue)
+	deliver()
+	f := Failure{}
+	if err := json.NewDecoder(out).Decode(&f); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if f.SNI != "buffered.example.com" {
+		t.Errorf("Wrong failure: %+v", f)
+	}
+}
+
+type fakeDNSHealth struct {
+	failure time.Time
+}
+
+func (d *fakeDNSHealth) FailedAround(t time.Time) bool { return t.Equal(d.failure) }
+
+func TestProcessDNSAnnotation(t *testing.T) {
+	failure := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	failures := make(chan *Failure)
+	out := &bytes.Buffer{}
+	queue, deliver := newQueue(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go Process(ctx, wg, failures, nil, &fakeDNSHealth{failure: failure}, queue)
+
+	failures <- &Failure{SNI: "dns.example.com", Time: failure}
+	failures <- &Failure{SNI: "other.example.com", Time: failure.Add(time.Hour)}
+	cancel()
+	wg.Wait()
+	deliver()
+
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		f := Failure{}
+		if err := decoder.Decode(&f); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		want := map[string]string(nil)
+		if f.SNI == "dns.example.com" {
+			want = map[string]string{"suspected_cause": "dns"}
+		}
+		if !reflect.DeepEqual(f.Annotations, want) {
+			t.Errorf("%s: got annotations %v, want %v", f.SNI, f.Annotations, want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"k8s.io/klog/v2"
+)
+
+// rotatedSuffixLayout is the layout of the time of the rotation appended
+// to the name of a rotated file, sorting like the time.
+const rotatedSuffixLayout = "20060102T150405.000000000Z"
+
+// FileOptions configure the rotation of a File.
+type FileOptions struct {
+	// MaxSize is the size in bytes after which the file is rotated, 0
+	// disables it.
+	MaxSize int64
+	// MaxAge is the time after which a file with content is rotated, 0
+	// disables it.
+	MaxAge time.Duration
+	// Compress compresses the rotated files with zstd, adding the
+	// suffix .zst.
+	Compress bool
+	// Retention is the time after its rotation a rotated file is
+	// removed, 0 keeps the files.
+	Retention time.Duration
+	// MaxFiles is the number of rotated files kept, 0 keeps all.
+	MaxFiles int
+}
+
+// File is a file the events are appended to which is rotated by size
+// and age. The rotated files get the time of the rotation as suffix,
+// e.g. failures.jsonl.20220501T100000.000000000Z.zst, and are removed
+// by Run after the retention.
+type File struct {
+	filename string
+	opts     FileOptions
+	// now is replaced in tests.
+	now func() time.Time
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	// started is the time of the first write to the file.
+	started time.Time
+}
+
+// OpenFile opens the file for appending and sweeps the rotated files
+// outside of the retention.
+func OpenFile(filename string, opts FileOptions) (*File, error) {
+	f := &File{filename: filename, opts: opts, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.sweep(f.now())
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", f.filename, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening %s: %w", f.filename, err)
+	}
+	f.file, f.size, f.started = file, info.Size(), time.Time{}
+	if f.size > 0 {
+		// The age of the content written before a restart is not
+		// known, the modification time is the best guess.
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating it before if p would exceed
+// its size or the file is older than its maximum age. Every write of
+// the events is a complete line, so a line is never split over files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	now := f.now()
+	if f.size > 0 && f.due(int64(len(p)), now) {
+		if err := f.rotate(now); err != nil {
+			klog.Errorf("Failed to rotate %s: %v", f.filename, err)
+		}
+		if f.file == nil {
+			// Reopening failed, the rotated file is not appended to.
+			return 0, os.ErrClosed
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if f.started.IsZero() {
+		f.started = now
+	}
+	return n, err
+}
+
+func (f *File) due(n int64, now time.Time) bool {
+	if f.opts.MaxSize > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && now.Sub(f.started) >= f.opts.MaxAge
+}
+
+// rotate renames the file, compresses it if configured and opens a new
+// file. The compression blocks the writes, the events are written
+// rarely enough.
+func (f *File) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		klog.Errorf("Failed to close %s: %v", f.filename, err)
+	}
+	f.file = nil
+	rotated := f.filename + "." + now.UTC().Format(rotatedSuffixLayout)
+	if err := os.Rename(f.filename, rotated); err != nil {
+		return f.open()
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.opts.Compress {
+		if err := compress(rotated); err != nil {
+			return fmt.Errorf("compressing %s: %w", rotated, err)
+		}
+	}
+	f.sweep(now)
+	return nil
+}
+
+// compress replaces the file with its zstd compressed copy with the
+// suffix .zst.
+func compress(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filename+".zst", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := compressTo(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(filename)
+}
+
+func compressTo(w io.Writer, r io.Reader) error {
+	encoder, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, r); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// rotatedFiles returns the rotated files with the time of their
+// rotation, oldest first.
+func (f *File) rotatedFiles() ([]string, []time.Time, error) {
+	matches, err := filepath.Glob(f.filename + ".*")
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []string
+	var times []time.Time
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, f.filename+"."), ".zst")
+		t, err := time.Parse(rotatedSuffixLayout, suffix)
+		if err != nil {
+			// Not a file rotated by us.
+			continue
+		}
+		files, times = append(files, m), append(times, t)
+	}
+	sort.Sort(byRotation{files, times})
+	return files, times, nil
+}
+
+type byRotation struct {
+	files []string
+	times []time.Time
+}
+
+func (b byRotation) Len() int           { return len(b.files) }
+func (b byRotation) Less(i, j int) bool { return b.times[i].Before(b.times[j]) }
+func (b byRotation) Swap(i, j int) {
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+}
+
+// sweep removes the rotated files outside of the retention and beyond
+// the number of kept files.
+func (f *File) sweep(now time.Time) {
+	files, times, err := f.rotatedFiles()
+	if err != nil {
+		klog.Errorf("Failed to list the rotated files of %s: %v", f.filename, err)
+		return
+	}
+	for i, name := range files {
+		expired := f.opts.Retention > 0 && now.Sub(times[i]) > f.opts.Retention
+		excess := f.opts.MaxFiles > 0 && len(files)-i > f.opts.MaxFiles
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("Failed to remove %s: %v", name, err)
+		}
+	}
+}
+
+// Run rotates the file once it reached its maximum age, even without
+// writes, and removes the rotated files outside of the retention on
+// every tick.
+func (f *File) Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time) {
+	defer wg.Done()
+	done := ctx.Done()
+	for {
+		select {
+		case now := <-ticks:
+			f.tick(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (f *File) tick(now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil && f.size > 0 && f.due(0, now) {
+		if err := f.rotate(now); err != nil {
+			klog.Errorf("Failed to rotate %s: %v", f.filename, err)
+		}
+		return
+	}
+	f.sweep(now)
+}
+
+// Close closes the file, it is not rotated.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
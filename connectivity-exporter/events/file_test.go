@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "failures.jsonl")
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	f, err := OpenFile(filename, FileOptions{MaxSize: 14, MaxAge: time.Hour, Compress: true, Retention: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	write := func(line string) {
+		t.Helper()
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first\n")
+	write("second\n")
+	now = now.Add(time.Minute)
+	// Exceeds the size, the lines are not split.
+	write("third\n")
+	// The age of the file is checked on the ticks as well.
+	now = now.Add(time.Hour)
+	f.tick(now)
+
+	files, _, err := f.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, name := range files {
+		contents = append(contents, decompress(t, name))
+	}
+	if want := []string{"first\nsecond\n", "third\n"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("got rotated files %q, want %q", contents, want)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+		t.Errorf("got file %v, %v, want an empty file", info, err)
+	}
+
+	// The retention counts from the rotation.
+	f.sweep(now.Add(2*time.Hour - time.Minute + time.Second))
+	if files, _, _ := f.rotatedFiles(); len(files) != 1 {
+		t.Errorf("got rotated files %q, want the last one", files)
+	}
+}
+
+func TestFileMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "failures.jsonl")
+	f, err := OpenFile(filename, FileOptions{MaxSize: 1, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	files, _, err := f.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, name := range files {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	if want := []string{"2\n", "3\n"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("got rotated files %q, want %q", contents, want)
+	}
+}
+
+func decompress(t *testing.T, filename string) string {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	b, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
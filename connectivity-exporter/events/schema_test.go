@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"m/traceroute"
+)
+
+// TestGolden ensures the events of a version stay compatible: fields
+// may be added to the golden file, but existing ones must not change.
+func TestGolden(t *testing.T) {
+	f := &Failure{
+		Time:        time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC),
+		SNI:         "api.example.com",
+		SourceIP:    "10.0.0.1",
+		DestIP:      "192.168.0.1",
+		Path:        []traceroute.Hop{{TTL: 1, IP: "10.0.0.254", RTT: time.Millisecond}, {TTL: 2}},
+		PathError:   "no route",
+		Annotations: map[string]string{"suspected_cause": "dns"},
+	}
+	out := &bytes.Buffer{}
+	if err := Writer(out)(f); err != nil {
+		t.Fatalf("Writer() = %v", err)
+	}
+
+	want, err := os.ReadFile("testdata/failure.v1.json")
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("The event differs from the golden file:\ngot  %swant %s", out.Bytes(), want)
+	}
+}
+
+type schema struct {
+	Required   []string           `json:"required"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+}
+
+// TestSchema ensures that the fields of the events are documented in
+// the schema.
+func TestSchema(t *testing.T) {
+	data, err := os.ReadFile("failure.schema.json")
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	s := &schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	compareFields(t, "Failure", reflect.TypeOf(Failure{}), s)
+	compareFields(t, "Hop", reflect.TypeOf(traceroute.Hop{}), s.Properties["path"].Items)
+}
+
+func compareFields(t *testing.T, name string, typ reflect.Type, s *schema) {
+	var properties, required []string
+	for i := 0; i < typ.NumField(); i++ {
+		tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")
+		properties = append(properties, tag[0])
+		if len(tag) == 1 {
+			required = append(required, tag[0])
+		}
+	}
+	var documented []string
+	for p := range s.Properties {
+		documented = append(documented, p)
+	}
+	sort.Strings(properties)
+	sort.Strings(documented)
+	sort.Strings(required)
+	sort.Strings(s.Required)
+	if !reflect.DeepEqual(properties, documented) {
+		t.Errorf("%s: the schema has the properties %v, want %v", name, documented, properties)
+	}
+	if !reflect.DeepEqual(required, s.Required) {
+		t.Errorf("%s: the schema requires %v, want %v", name, s.Required, required)
+	}
+}
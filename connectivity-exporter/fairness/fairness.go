@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fairness accounts the connections to the SNIs per namespace
+// of the clients, so the tenant responsible for a spike of failures to
+// a shared upstream stands out. Besides the counters, the shares of
+// the namespaces in the successful and failed connections to an SNI
+// are exported over a sliding window.
+package fairness
+
+import (
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Unknown is the namespace of the clients which are not resolved to a
+// pod, e.g. of the host network.
+const Unknown = "unknown"
+
+// Resolver resolves the IPs of the clients to their namespaces.
+type Resolver interface {
+	Namespace(ip string) (string, bool)
+}
+
+// The kinds of the connections.
+const (
+	successful = "successful"
+	failed     = "failed"
+)
+
+type key struct {
+	sni, namespace string
+}
+
+type shareKey struct {
+	kind string
+	key
+}
+
+type counts struct {
+	successful, failed float64
+}
+
+// bucket are the connections of an accounting round.
+type bucket struct {
+	time        time.Time
+	connections map[key]counts
+}
+
+// Tracker aggregates the connections per SNI and namespace.
+type Tracker struct {
+	resolver Resolver
+	window   time.Duration
+
+	mutex sync.Mutex
+	// buckets are the rounds of the window, the last one is the
+	// current round.
+	buckets []*bucket
+	// series are the keys with counters and the time of their last
+	// update, shares the keys with a share.
+	series map[key]time.Time
+	shares map[shareKey]struct{}
+}
+
+// NewTracker creates a tracker exporting the shares of the namespaces
+// over the window.
+func NewTracker(resolver Resolver, window time.Duration) *Tracker {
+	return &Tracker{
+		resolver: resolver,
+		window:   window,
+		series:   make(map[key]time.Time),
+		shares:   make(map[shareKey]struct{}),
+	}
+}
+
+// Observe adds the connections of an increment to the namespace of its
+// client. The shares are updated when the first increment of the next
+// round arrives.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	c := counts{
+		successful: inc.SuccessfulConnections,
+		// The resets of the client do not fail the connection.
+		failed: inc.RejectedConnections + inc.RejectedConnectionsByMiddlebox + inc.RejectedConnectionsByNetwork,
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	round := inc.Time.Truncate(time.Second)
+	if n := len(t.buckets); n == 0 || round.After(t.buckets[n-1].time) {
+		t.exportShares(round)
+		t.expire(inc.Time)
+		t.buckets = append(t.buckets, &bucket{time: round, connections: make(map[key]counts)})
+	}
+	if c == (counts{}) {
+		return
+	}
+	namespace, ok := t.resolver.Namespace(inc.SourceIP)
+	if !ok {
+		namespace = Unknown
+	}
+	k := key{sni: inc.SNI, namespace: namespace}
+	metrics.AddNamespaceConnections(k.sni, k.namespace, c.successful, c.failed)
+	t.series[k] = inc.Time
+
+	b := t.buckets[len(t.buckets)-1]
+	sum := b.connections[k]
+	sum.successful += c.successful
+	sum.failed += c.failed
+	b.connections[k] = sum
+}
+
+// exportShares drops the rounds before the window ending with the
+// round and exports the shares of the remaining ones.
+func (t *Tracker) exportShares(round time.Time) {
+	start := round.Add(-t.window)
+	i := 0
+	for i < len(t.buckets) && !t.buckets[i].time.After(start) {
+		i++
+	}
+	t.buckets = t.buckets[i:]
+
+	sums := make(map[key]counts)
+	totals := make(map[string]counts)
+	for _, b := range t.buckets {
+		for k, c := range b.connections {
+			sum := sums[k]
+			sum.successful += c.successful
+			sum.failed += c.failed
+			sums[k] = sum
+			total := totals[k.sni]
+			total.successful += c.successful
+			total.failed += c.failed
+			totals[k.sni] = total
+		}
+	}
+
+	shares := make(map[shareKey]struct{}, len(t.shares))
+	for k, sum := range sums {
+		total := totals[k.sni]
+		for _, s := range []struct {
+			kind     string
+			n, outOf float64
+		}{
+			{successful, sum.successful, total.successful},
+			{failed, sum.failed, total.failed},
+		} {
+			if s.outOf == 0 {
+				continue
+			}
+			metrics.SetNamespaceShare(s.kind, k.sni, k.namespace, s.n/s.outOf)
+			shares[shareKey{kind: s.kind, key: k}] = struct{}{}
+		}
+	}
+	for sk := range t.shares {
+		if _, ok := shares[sk]; !ok {
+			metrics.DeleteNamespaceShare(sk.kind, sk.sni, sk.namespace)
+		}
+	}
+	t.shares = shares
+}
+
+// expire deletes the counters without updates for longer than the
+// expiration of the metrics.
+func (t *Tracker) expire(now time.Time) {
+	for k, lastUpdate := range t.series {
+		if lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteNamespaceConnections(k.sni, k.namespace)
+			delete(t.series, k)
+		}
+	}
+}
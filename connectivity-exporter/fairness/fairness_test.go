@@ -0,0 +1,67 @@
+package fairness
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/metrics"
+)
+
+type resolver map[string]string
+
+func (r resolver) Namespace(ip string) (string, bool) {
+	namespace, ok := r[ip]
+	return namespace, ok
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(resolver{"10.1.0.1": "tenant-a", "10.1.0.2": "tenant-b"}, time.Minute)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(second int, sourceIP string, successful, rejected float64) {
+		tracker.Observe(&metrics.Inc{
+			SNI:                   "shared.example.com",
+			SourceIP:              sourceIP,
+			SuccessfulConnections: successful,
+			RejectedConnections:   rejected,
+			Time:                  start.Add(time.Duration(second) * time.Second),
+		})
+	}
+	// Falls out of the window before the shares are exported.
+	observe(0, "10.1.0.2", 0, 4)
+	observe(30, "10.1.0.1", 3, 3)
+	observe(31, "10.1.0.2", 1, 0)
+	observe(31, "10.0.0.1", 0, 1)
+	// Closes the last round.
+	observe(61, "10.1.0.1", 0, 0)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_namespace_connection_share Share of the namespace of the clients in the successful or failed connections to the SNI in the last share window.
+		# TYPE connectivity_exporter_namespace_connection_share gauge
+		connectivity_exporter_namespace_connection_share{kind="failed",namespace="tenant-a",sni="shared.example.com"} 0.75
+		connectivity_exporter_namespace_connection_share{kind="failed",namespace="tenant-b",sni="shared.example.com"} 0
+		connectivity_exporter_namespace_connection_share{kind="failed",namespace="unknown",sni="shared.example.com"} 0.25
+		connectivity_exporter_namespace_connection_share{kind="successful",namespace="tenant-a",sni="shared.example.com"} 0.75
+		connectivity_exporter_namespace_connection_share{kind="successful",namespace="tenant-b",sni="shared.example.com"} 0.25
+		connectivity_exporter_namespace_connection_share{kind="successful",namespace="unknown",sni="shared.example.com"} 0
+		# HELP connectivity_exporter_namespace_connections_total Total number of successful and failed connections to the SNI per namespace of the clients.
+		# TYPE connectivity_exporter_namespace_connections_total counter
+		connectivity_exporter_namespace_connections_total{kind="failed",namespace="tenant-a",sni="shared.example.com"} 3
+		connectivity_exporter_namespace_connections_total{kind="failed",namespace="tenant-b",sni="shared.example.com"} 4
+		connectivity_exporter_namespace_connections_total{kind="failed",namespace="unknown",sni="shared.example.com"} 1
+		connectivity_exporter_namespace_connections_total{kind="successful",namespace="tenant-a",sni="shared.example.com"} 3
+		connectivity_exporter_namespace_connections_total{kind="successful",namespace="tenant-b",sni="shared.example.com"} 1
+		connectivity_exporter_namespace_connections_total{kind="successful",namespace="unknown",sni="shared.example.com"} 0
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_namespace_connection_share",
+		"connectivity_exporter_namespace_connections_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fatal classifies the errors which end the exporter, so the
+// orchestration can tell a bad configuration, which a restart does not
+// fix, from a transient failure by the exit code and the last log line.
+package fatal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Category is the category of an error which ends the exporter.
+type Category int
+
+const (
+	// Runtime is a failure while running, e.g. of a listener or of
+	// reading an eBPF map. A restart may fix it.
+	Runtime Category = iota
+	// Config is an invalid flag, configuration file or interface.
+	Config
+	// Capability means the exporter is not privileged enough.
+	Capability
+	// Kernel means the kernel cannot run the eBPF program.
+	Kernel
+)
+
+func (c Category) String() string {
+	switch c {
+	case Config:
+		return "config"
+	case Capability:
+		return "capability"
+	case Kernel:
+		return "kernel"
+	default:
+		return "runtime"
+	}
+}
+
+// ExitCode returns the exit code of the category. Errors can refine
+// it, see Classified.
+func (c Category) ExitCode() int {
+	switch c {
+	case Config:
+		return 2
+	case Capability:
+		return 3
+	case Kernel:
+		return 6
+	default:
+		return 1
+	}
+}
+
+// Classified is implemented by the errors which know their category,
+// like packet.SetupError. The reason refines the category and the exit
+// code, which has to be unique to the category.
+type Classified interface {
+	error
+	Category() Category
+	Reason() string
+	ExitCode() int
+}
+
+// Error is an error with its category.
+type Error struct {
+	category Category
+	reason   string
+	code     int
+	err      error
+}
+
+// Classify returns the category of the error, which is the one of the
+// first Classified error in its chain, or the fallback.
+func Classify(err error, fallback Category) *Error {
+	var c Classified
+	if errors.As(err, &c) {
+		return &Error{category: c.Category(), reason: c.Reason(), code: c.ExitCode(), err: err}
+	}
+	return &Error{category: fallback, code: fallback.ExitCode(), err: err}
+}
+
+func (e *Error) Error() string {
+	if e.err == nil {
+		return e.category.String()
+	}
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func (e *Error) Category() Category {
+	return e.category
+}
+
+func (e *Error) Reason() string {
+	return e.reason
+}
+
+func (e *Error) ExitCode() int {
+	return e.code
+}
+
+// exit is replaced in tests.
+var exit = os.Exit
+
+// hookTimeout limits the time the hooks run before the exporter exits
+// anyway, e.g. if a hook waits for a lock held by the failing
+// goroutine.
+var hookTimeout = 30 * time.Second
+
+var (
+	hooksMutex sync.Mutex
+	hooks      []func(msg string, e *Error)
+)
+
+// BeforeExit registers a hook which Exit runs with the message and the
+// classified error before exiting, e.g. to write a diagnostics bundle.
+func BeforeExit(hook func(msg string, e *Error)) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks = append(hooks, hook)
+}
+
+// runHooks runs the hooks registered with BeforeExit in order, all of
+// them within hookTimeout.
+func runHooks(msg string, e *Error) {
+	hooksMutex.Lock()
+	registered := hooks
+	hooksMutex.Unlock()
+	if len(registered) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, hook := range registered {
+			hook(msg, e)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(hookTimeout):
+		klog.Errorf("The hooks before exiting did not finish within %v", hookTimeout)
+	}
+}
+
+// Exit runs the hooks registered with BeforeExit, logs the error with
+// its category, reason and exit code as the last line and exits with
+// the exit code. The category of an error which is not Classified is
+// the fallback.
+func Exit(fallback Category, msg string, err error) {
+	e := Classify(err, fallback)
+	runHooks(msg, e)
+	keysAndValues := []interface{}{"category", e.category.String()}
+	if e.reason != "" {
+		keysAndValues = append(keysAndValues, "reason", e.reason)
+	}
+	keysAndValues = append(keysAndValues, "exitCode", e.code)
+	klog.ErrorS(err, msg, keysAndValues...)
+	klog.Flush()
+	exit(e.code)
+}
+
+// Exitf is Exit without an error.
+func Exitf(category Category, format string, args ...interface{}) {
+	Exit(category, fmt.Sprintf(format, args...), nil)
+}
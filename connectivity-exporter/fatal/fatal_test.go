@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fatal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// interfaceError classifies itself like packet.SetupError.
+type interfaceError struct{}
+
+func (interfaceError) Error() string      { return "no such network interface" }
+func (interfaceError) Category() Category { return Config }
+func (interfaceError) Reason() string     { return "interface_not_found" }
+func (interfaceError) ExitCode() int      { return 5 }
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		desc       string
+		fallback   Category
+		err        error
+		wantCode   int
+		wantReason string
+	}{
+		{desc: "runtime", fallback: Runtime, err: errors.New("connection refused"), wantCode: 1},
+		{desc: "config", fallback: Config, err: errors.New("invalid port x"), wantCode: 2},
+		{desc: "capability", fallback: Capability, wantCode: 3},
+		{desc: "kernel", fallback: Kernel, wantCode: 6},
+		{
+			desc:       "classified",
+			fallback:   Runtime,
+			err:        fmt.Errorf("creating the data source: %w", interfaceError{}),
+			wantCode:   5,
+			wantReason: "interface_not_found",
+		},
+	}
+	defer func(e func(int)) { exit = e }(exit)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			code := -1
+			exit = func(c int) { code = c }
+			Exit(tc.fallback, "Failed", tc.err)
+			if code != tc.wantCode {
+				t.Errorf("got exit code %d, want %d", code, tc.wantCode)
+			}
+			if reason := Classify(tc.err, tc.fallback).Reason(); reason != tc.wantReason {
+				t.Errorf("got reason %q, want %q", reason, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestBeforeExit(t *testing.T) {
+	defer func(e func(int), h []func(string, *Error), d time.Duration) { exit, hooks, hookTimeout = e, h, d }(exit, hooks, hookTimeout)
+	exit = func(int) {}
+	var got []string
+	BeforeExit(func(msg string, e *Error) { got = append(got, fmt.Sprintf("%s: %s", msg, e.Category())) })
+	Exit(Kernel, "Failed", errors.New("no BTF"))
+	if want := []string{"Failed: kernel"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got hook calls %q, want %q", got, want)
+	}
+
+	// A blocked hook does not keep the exporter from exiting.
+	hookTimeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	BeforeExit(func(string, *Error) { <-block })
+	code := -1
+	exit = func(c int) { code = c }
+	Exit(Runtime, "Failed", nil)
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+}
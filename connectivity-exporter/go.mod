@@ -5,8 +5,10 @@ go 1.18
 require (
 	github.com/cilium/ebpf v0.8.1
 	github.com/google/gopacket v1.1.19
+	github.com/klauspost/compress v1.15.15
 	github.com/prometheus/client_golang v1.12.1
 	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.32.1
 	go.uber.org/automaxprocs v1.5.1
 	golang.org/x/sys v0.0.0-20220502124256-b6088ccd6cba
 	k8s.io/klog/v2 v2.60.1
@@ -18,7 +20,7 @@ require (
 	github.com/go-logr/logr v1.2.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
-	github.com/prometheus/common v0.32.1 // indirect
 	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
 	google.golang.org/protobuf v1.26.0 // indirect
 )
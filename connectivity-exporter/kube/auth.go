@@ -0,0 +1,180 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCachedDecisions bounds the memory of the decision cache. Once
+// reached, the expired decisions are removed, and all of them if none
+// expired.
+const maxCachedDecisions = 1024
+
+type decisionKey struct {
+	token      [sha256.Size]byte
+	verb, path string
+}
+
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+// Authorizer authorizes the requests to the exporter with the RBAC of
+// the cluster, like the API server authorizes its own /metrics: a
+// TokenReview authenticates the bearer token of the client and a
+// SubjectAccessReview checks whether its user may access the path of
+// the request as non-resource URL with the verb of the method.
+type Authorizer struct {
+	client *Client
+	ttl    time.Duration
+
+	mutex     sync.Mutex
+	decisions map[decisionKey]decision
+}
+
+// NewAuthorizer creates an authorizer caching its decisions for the
+// ttl, so a scrape every few seconds does not review the token every
+// time.
+func NewAuthorizer(client *Client, ttl time.Duration) *Authorizer {
+	return &Authorizer{client: client, ttl: ttl, decisions: make(map[decisionKey]decision)}
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated,omitempty"`
+	User          userInfo `json:"user"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type userInfo struct {
+	Username string              `json:"username,omitempty"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+type subjectAccessReview struct {
+	APIVersion string                    `json:"apiVersion"`
+	Kind       string                    `json:"kind"`
+	Spec       subjectAccessReviewSpec   `json:"spec"`
+	Status     subjectAccessReviewStatus `json:"status"`
+}
+
+type subjectAccessReviewSpec struct {
+	NonResourceAttributes nonResourceAttributes `json:"nonResourceAttributes"`
+	User                  string                `json:"user"`
+	UID                   string                `json:"uid,omitempty"`
+	Groups                []string              `json:"groups,omitempty"`
+	Extra                 map[string][]string   `json:"extra,omitempty"`
+}
+
+type nonResourceAttributes struct {
+	Path string `json:"path"`
+	Verb string `json:"verb"`
+}
+
+type subjectAccessReviewStatus struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// verbs map the methods to the verbs of the Kubernetes API.
+var verbs = map[string]string{
+	http.MethodGet:    "get",
+	http.MethodHead:   "get",
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "patch",
+	http.MethodDelete: "delete",
+}
+
+// Authorize checks whether the client with the token may send the
+// request. A token which is not authenticated is not allowed.
+func (a *Authorizer) Authorize(ctx context.Context, token string, r *http.Request) (bool, error) {
+	verb, ok := verbs[r.Method]
+	if !ok {
+		return false, nil
+	}
+	key := decisionKey{token: sha256.Sum256([]byte(token)), verb: verb, path: r.URL.Path}
+	now := time.Now()
+	a.mutex.Lock()
+	d, ok := a.decisions[key]
+	a.mutex.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.allowed, nil
+	}
+
+	allowed, err := a.review(ctx, token, verb, r.URL.Path)
+	if err != nil {
+		return false, err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.decisions) >= maxCachedDecisions {
+		a.expire(now)
+	}
+	a.decisions[key] = decision{allowed: allowed, expires: now.Add(a.ttl)}
+	return allowed, nil
+}
+
+func (a *Authorizer) review(ctx context.Context, token, verb, path string) (bool, error) {
+	tr := &tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	}
+	if err := a.client.Create(ctx, "/apis/authentication.k8s.io/v1/tokenreviews", tr, tr); err != nil {
+		return false, fmt.Errorf("reviewing the token: %w", err)
+	}
+	if !tr.Status.Authenticated {
+		return false, nil
+	}
+	user := tr.Status.User
+	sar := &subjectAccessReview{
+		APIVersion: "authorization.k8s.io/v1",
+		Kind:       "SubjectAccessReview",
+		Spec: subjectAccessReviewSpec{
+			NonResourceAttributes: nonResourceAttributes{Path: path, Verb: verb},
+			User:                  user.Username,
+			UID:                   user.UID,
+			Groups:                user.Groups,
+			Extra:                 user.Extra,
+		},
+	}
+	if err := a.client.Create(ctx, "/apis/authorization.k8s.io/v1/subjectaccessreviews", sar, sar); err != nil {
+		return false, fmt.Errorf("reviewing the access of %s: %w", user.Username, err)
+	}
+	return sar.Status.Allowed, nil
+}
+
+// expire removes the expired decisions, or all decisions if none
+// expired.
+func (a *Authorizer) expire(now time.Time) {
+	for k, d := range a.decisions {
+		if !now.Before(d.expires) {
+			delete(a.decisions, k)
+		}
+	}
+	if len(a.decisions) >= maxCachedDecisions {
+		a.decisions = make(map[decisionKey]decision)
+	}
+}
@@ -0,0 +1,64 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizer(t *testing.T) {
+	reviews := 0
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer exporter" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reviews++
+		switch r.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			tr := &tokenReview{}
+			json.NewDecoder(r.Body).Decode(tr)
+			if tr.Spec.Token == "prometheus" {
+				tr.Status = tokenReviewStatus{Authenticated: true, User: userInfo{Username: "system:serviceaccount:monitoring:prometheus"}}
+			}
+			json.NewEncoder(w).Encode(tr)
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			sar := &subjectAccessReview{}
+			json.NewDecoder(r.Body).Decode(sar)
+			attrs := sar.Spec.NonResourceAttributes
+			sar.Status.Allowed = sar.Spec.User == "system:serviceaccount:monitoring:prometheus" && attrs.Path == "/metrics" && attrs.Verb == "get"
+			json.NewEncoder(w).Encode(sar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	a := NewAuthorizer(NewClient(api.URL, "exporter", api.Client()), time.Minute)
+
+	for _, tc := range []struct {
+		token, method, path string
+		want                bool
+	}{
+		{"prometheus", http.MethodGet, "/metrics", true},
+		{"prometheus", http.MethodPut, "/admin/drain", false},
+		{"unknown", http.MethodGet, "/metrics", false},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		allowed, err := a.Authorize(context.Background(), tc.token, r)
+		if err != nil {
+			t.Fatalf("Authorize() = %v", err)
+		}
+		if allowed != tc.want {
+			t.Errorf("%s %s with token %q: got allowed %t, want %t", tc.method, tc.path, tc.token, allowed, tc.want)
+		}
+	}
+
+	// The decisions are cached.
+	before := reviews
+	if allowed, _ := a.Authorize(context.Background(), "prometheus", httptest.NewRequest(http.MethodGet, "/metrics", nil)); !allowed || reviews != before {
+		t.Errorf("The cached decision should be used, got allowed %t after %d reviews", allowed, reviews-before)
+	}
+}
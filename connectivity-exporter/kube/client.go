@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package kube is a minimal client of the Kubernetes API for the few
+// calls of the exporter, which do not justify the dependencies of
+// client-go.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client is a minimal client of the Kubernetes API.
+type Client struct {
+	host       string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient creates a client of the API server at host, which
+// authenticates with the bearer token.
+func NewClient(host, token string, httpClient *http.Client) *Client {
+	return &Client{host: host, token: token, httpClient: httpClient}
+}
+
+// NewInClusterClient creates a client with the service account of the
+// pod and returns the namespace of the pod.
+func NewInClusterClient() (*Client, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", errors.New("not running in a cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, "", fmt.Errorf("reading the service account token: %w", err)
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, "", fmt.Errorf("reading the namespace: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, "", fmt.Errorf("reading the cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", errors.New("no certificate in the cluster CA")
+	}
+	return &Client{
+		host:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, strings.TrimSpace(string(namespace)), nil
+}
+
+// Do sends the body to the path and decodes the response into out,
+// unless out is nil.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Create posts the object to the path of its resource and decodes the
+// created object into out.
+func (c *Client) Create(ctx context.Context, path string, object, out interface{}) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return c.Do(ctx, http.MethodPost, path, "application/json", body, out)
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kube
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+type podList struct {
+	Items []podItem `json:"items"`
+}
+
+type podItem struct {
+	Metadata struct {
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		HostNetwork bool `json:"hostNetwork,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase,omitempty"`
+		PodIP  string `json:"podIP,omitempty"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs,omitempty"`
+	} `json:"status"`
+}
+
+// PodResolver resolves the IPs of the pods to their namespaces. It
+// lists the pods of a node, or of the whole cluster, periodically.
+// The pods of the host network share the IP of the node, so they are
+// not resolved.
+type PodResolver struct {
+	client *Client
+	node   string
+
+	mutex      sync.RWMutex
+	namespaces map[string]string
+}
+
+// NewPodResolver creates a resolver of the pods of the node, of all
+// pods if it is empty.
+func NewPodResolver(client *Client, node string) *PodResolver {
+	return &PodResolver{client: client, node: node, namespaces: make(map[string]string)}
+}
+
+// Namespace returns the namespace of the pod with the IP.
+func (r *PodResolver) Namespace(ip string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	namespace, ok := r.namespaces[ip]
+	return namespace, ok
+}
+
+// Refresh lists the pods and replaces the resolved IPs.
+func (r *PodResolver) Refresh(ctx context.Context) error {
+	path := "/api/v1/pods"
+	if r.node != "" {
+		path += "?fieldSelector=" + url.QueryEscape("spec.nodeName="+r.node)
+	}
+	list := &podList{}
+	if err := r.client.Do(ctx, http.MethodGet, path, "", nil, list); err != nil {
+		return err
+	}
+	namespaces := make(map[string]string, len(list.Items))
+	for _, p := range list.Items {
+		// The IPs of terminated pods are reused by new pods.
+		if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+			continue
+		}
+		if p.Status.PodIP != "" {
+			namespaces[p.Status.PodIP] = p.Metadata.Namespace
+		}
+		for _, ip := range p.Status.PodIPs {
+			namespaces[ip.IP] = p.Metadata.Namespace
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.namespaces = namespaces
+	return nil
+}
+
+// Run refreshes the pods on every tick until the context is done. A
+// failed refresh keeps the previous pods.
+func (r *PodResolver) Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time) {
+	defer wg.Done()
+	for {
+		select {
+		case <-ticks:
+			if err := r.Refresh(ctx); err != nil {
+				klog.Warningf("Failed to list the pods: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
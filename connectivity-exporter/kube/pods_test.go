@@ -0,0 +1,44 @@
+package kube
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPodResolver(t *testing.T) {
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"items": [
+			{"metadata": {"namespace": "tenant-a"}, "status": {"phase": "Running", "podIP": "10.1.0.1", "podIPs": [{"ip": "10.1.0.1"}, {"ip": "fd00::1"}]}},
+			{"metadata": {"namespace": "kube-system"}, "spec": {"hostNetwork": true}, "status": {"phase": "Running", "podIP": "10.0.0.1"}},
+			{"metadata": {"namespace": "tenant-b"}, "status": {"phase": "Succeeded", "podIP": "10.1.0.2"}}
+		]}`))
+	}))
+	defer api.Close()
+	r := NewPodResolver(NewClient(api.URL, "exporter", api.Client()), "node-1")
+	if err := r.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+
+	for _, tc := range []struct {
+		ip, namespace string
+		ok            bool
+	}{
+		{"10.1.0.1", "tenant-a", true},
+		{"fd00::1", "tenant-a", true},
+		// The pods of the host network and terminated pods are not
+		// resolved.
+		{"10.0.0.1", "", false},
+		{"10.1.0.2", "", false},
+	} {
+		namespace, ok := r.Namespace(tc.ip)
+		if namespace != tc.namespace || ok != tc.ok {
+			t.Errorf("Namespace(%q) = %q, %t, want %q, %t", tc.ip, namespace, ok, tc.namespace, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package latency computes quantiles of the connect and the handshake
+// latencies of the SNIs within a sliding window, for dashboards which
+// cannot afford histograms per SNI.
+package latency
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"m/metrics"
+)
+
+// Quantiles are the quantiles computed for every SNI.
+var Quantiles = []float64{0.5, 0.95, 0.99}
+
+// maxSamples bounds the memory per SNI and kind of latency. Once
+// reached, the oldest samples are dropped before they leave the
+// window.
+const maxSamples = 1024
+
+const (
+	kindConnect   = "connect"
+	kindHandshake = "handshake"
+)
+
+type key struct {
+	sni, kind string
+}
+
+type sample struct {
+	time    time.Time
+	latency time.Duration
+}
+
+// Tracker keeps the latencies of the SNIs within the window.
+type Tracker struct {
+	window time.Duration
+
+	mutex   sync.Mutex
+	samples map[key][]sample
+}
+
+// NewTracker creates a tracker computing the quantiles over the
+// window.
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{window: window, samples: make(map[key][]sample)}
+}
+
+// Observe records the latencies of the increment.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	if len(inc.ConnectLatencies) == 0 && len(inc.HandshakeLatencies) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.add(key{inc.SNI, kindConnect}, inc.Time, inc.ConnectLatencies)
+	t.add(key{inc.SNI, kindHandshake}, inc.Time, inc.HandshakeLatencies)
+}
+
+func (t *Tracker) add(k key, now time.Time, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	samples := t.samples[k]
+	for _, l := range latencies {
+		samples = append(samples, sample{time: now, latency: l})
+	}
+	if len(samples) > maxSamples {
+		samples = append(samples[:0], samples[len(samples)-maxSamples:]...)
+	}
+	t.samples[k] = samples
+}
+
+// Summaries returns the quantiles of the latencies within the window
+// at the time now, sorted by SNI and kind. The SNIs without latencies
+// within the window are dropped.
+func (t *Tracker) Summaries(now time.Time) []metrics.LatencySummary {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var out []metrics.LatencySummary
+	oldest := now.Add(-t.window)
+	for k, samples := range t.samples {
+		// The samples are appended in the order of the accounted
+		// seconds, so the expired samples are at the start.
+		expired := sort.Search(len(samples), func(i int) bool { return !samples[i].time.Before(oldest) })
+		samples = samples[expired:]
+		if len(samples) == 0 {
+			delete(t.samples, k)
+			continue
+		}
+		t.samples[k] = samples
+		out = append(out, summarize(k, samples))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SNI != out[j].SNI {
+			return out[i].SNI < out[j].SNI
+		}
+		return out[i].Kind < out[j].Kind
+	})
+	return out
+}
+
+func summarize(k key, samples []sample) metrics.LatencySummary {
+	sorted := make([]float64, len(samples))
+	var sum float64
+	for i, s := range samples {
+		sorted[i] = s.latency.Seconds()
+		sum += sorted[i]
+	}
+	sort.Float64s(sorted)
+	quantiles := make(map[float64]float64, len(Quantiles))
+	for _, q := range Quantiles {
+		// The nearest rank, so a quantile is always a measured
+		// latency.
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		quantiles[q] = sorted[rank]
+	}
+	return metrics.LatencySummary{
+		SNI:       k.sni,
+		Kind:      k.kind,
+		Count:     uint64(len(sorted)),
+		Sum:       sum,
+		Quantiles: quantiles,
+	}
+}
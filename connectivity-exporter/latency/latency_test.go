@@ -0,0 +1,59 @@
+package latency
+
+import (
+	"testing"
+	"time"
+
+	"m/metrics"
+)
+
+func TestSummaries(t *testing.T) {
+	tracker := NewTracker(time.Minute)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var connect []time.Duration
+	for i := 1; i <= 100; i++ {
+		connect = append(connect, time.Duration(i)*time.Millisecond)
+	}
+	tracker.Observe(&metrics.Inc{SNI: "b.example.com", ConnectLatencies: connect, Time: start})
+	tracker.Observe(&metrics.Inc{SNI: "a.example.com", HandshakeLatencies: []time.Duration{time.Second}, Time: start.Add(30 * time.Second)})
+
+	summaries := tracker.Summaries(start.Add(time.Minute))
+	if len(summaries) != 2 {
+		t.Fatalf("Summaries() returned %d summaries, want 2: %+v", len(summaries), summaries)
+	}
+	if s := summaries[0]; s.SNI != "a.example.com" || s.Kind != kindHandshake || s.Count != 1 || s.Quantiles[0.5] != 1 || s.Quantiles[0.99] != 1 {
+		t.Errorf("Wrong summary of a.example.com: %+v", s)
+	}
+	s := summaries[1]
+	if s.SNI != "b.example.com" || s.Kind != kindConnect || s.Count != 100 {
+		t.Errorf("Wrong summary of b.example.com: %+v", s)
+	}
+	for q, want := range map[float64]float64{0.5: 0.05, 0.95: 0.095, 0.99: 0.099} {
+		if s.Quantiles[q] != want {
+			t.Errorf("Quantile %v of b.example.com = %v, want %v", q, s.Quantiles[q], want)
+		}
+	}
+
+	// The latencies of b.example.com leave the window.
+	summaries = tracker.Summaries(start.Add(time.Minute + time.Second))
+	if len(summaries) != 1 || summaries[0].SNI != "a.example.com" {
+		t.Errorf("Only a.example.com should be left: %+v", summaries)
+	}
+}
+
+func TestMaxSamples(t *testing.T) {
+	tracker := NewTracker(time.Minute)
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*maxSamples; i++ {
+		tracker.Observe(&metrics.Inc{SNI: "a.example.com", ConnectLatencies: []time.Duration{time.Duration(i) * time.Microsecond}, Time: now})
+	}
+	summaries := tracker.Summaries(now)
+	if len(summaries) != 1 || summaries[0].Count != maxSamples {
+		t.Fatalf("Want %d samples: %+v", maxSamples, summaries)
+	}
+	// The oldest samples were dropped.
+	if got, want := summaries[0].Quantiles[0.5], (time.Duration(maxSamples+maxSamples/2-1) * time.Microsecond).Seconds(); got != want {
+		t.Errorf("Median = %v, want %v", got, want)
+	}
+}
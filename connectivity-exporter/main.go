@@ -6,72 +6,672 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"m/abtest"
+	"m/admin"
+	"m/breakdown"
+	"m/change"
+	"m/churn"
+	"m/clock"
+	"m/config"
+	"m/conntrack"
+	"m/diagnostics"
+	"m/discovery"
+	"m/dns"
+	"m/dnshealth"
+	"m/events"
+	"m/fairness"
+	"m/fatal"
+	"m/kube"
+	"m/latency"
 	"m/metrics"
+	"m/normalization"
 	"m/packet"
+	"m/pipeline"
+	"m/podmonitor"
 	"m/promextra"
+	"m/rollup"
+	"m/selftest"
+	"m/server"
+	"m/sflow"
+	"m/sink"
+	"m/slo"
+	"m/testwindow"
+	"m/top"
+	"m/traceroute"
 
-	"golang.org/x/sys/unix"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog/v2"
 
-	_ "net/http/pprof"
-
 	_ "go.uber.org/automaxprocs"
 )
 
 var (
 	networkInterface = flag.String("i", "", "Network interface to listen on")
 	cidrs            = flag.String("r", "", "Network CIDRs, comma separated")
-	ports            = flag.String("p", "", "Ports, comma separated")
-	addr             = flag.String("metrics-addr", ":19100", "Bind and listen address for the metrics")
+	ports            = flag.String("p", "", "Ports, comma separated, with the suffix "+packet.PortSuffixHTTP+" for plaintext HTTP whose Host header is used as the SNI, with the suffix "+packet.PortSuffixUDP+" for UDP whose flows are tracked, with the suffix "+packet.PortSuffixSCTP+" for SCTP whose associations are tracked")
+	secondaryCIDRs   = flag.String("secondary-r", "", "Network CIDRs of the secondary filter, comma separated, e.g. for discovering the endpoints next to the strict filter of -r and -p, empty to attach the program only once")
+	secondaryPorts   = flag.String("secondary-p", "", "Ports of the secondary filter, comma separated, with the suffixes of -p")
+	secondaryNS      = flag.String("secondary-namespace", "connectivity_exporter_discovery", "Namespace of the metrics of the secondary filter")
+	discoveryRate    = flag.Float64("discovery-sample-rate", 0, "Share of the increments of the secondary filter sampled to rank the destinations the primary filter does not monitor on /admin/discovery, in (0, 1], 0 to disable the discovery")
+	discoveryMax     = flag.Int("discovery-max-destinations", 1000, "Maximum number of unmonitored destinations kept for /admin/discovery")
+	configFile       = flag.String("config", "", "Path to the JSON configuration file")
+	failureEvents    = flag.String("failure-events", "", "Path to the file the failure events are appended to as JSON lines, '-' for stdout")
+	eventsMaxSize    = flag.Int64("failure-events-max-size", 100<<20, "Size in bytes after which the failure events file is rotated, 0 disables it")
+	eventsMaxAge     = flag.Duration("failure-events-max-age", 24*time.Hour, "Time after which the failure events file is rotated, 0 disables it")
+	eventsCompress   = flag.Bool("failure-events-compress", true, "Compress the rotated failure events files with zstd")
+	eventsFileRetain = flag.Duration("failure-events-retention", 7*24*time.Hour, "Time after which the rotated failure events files are removed, 0 keeps them")
+	eventsMaxFiles   = flag.Int("failure-events-max-files", 0, "Number of rotated failure events files kept, 0 keeps all within the retention")
+	eventsRate       = flag.Float64("failure-events-rate", 100, "Number of failure events written per second, 0 for no limit")
+	traceOnFailure   = flag.Bool("traceroute-on-failure", false, "Trace the path to the destination when an SNI starts failing and add it to the failure event")
+	traceInterval    = flag.Duration("traceroute-interval", 10*time.Minute, "Minimum time between two traceroutes to the same destination")
+	recordSnapshots  = flag.String("record-map-snapshots", "", "Path to the file the eBPF map snapshots are appended to for debugging")
+	recordMaxSize    = flag.Int64("record-map-snapshots-max-size", 100<<20, "Size in bytes after which the recording of the eBPF map snapshots stops")
+	journalFile      = flag.String("accounting-journal", "", "Path to the file the inputs and outputs of the accounting of every window are written to for debugging")
+	journalRetention = flag.Duration("accounting-journal-retention", 10*time.Minute, "Time after which the accounting journal is rotated, the journal and its previous file with the suffix .1 cover at least this time")
+	quarantineDir    = flag.String("quarantine-dir", "", "Directory the eBPF map snapshots of the windows whose accounting panicked are dumped to, the temporary directory if empty")
+	diagnosticsDir   = flag.String("diagnostics-dir", "", "Directory a diagnostics bundle of the eBPF maps and the internal state is written to before the exporter exits on a fatal error, empty to disable it")
+	replaySnapshots  = flag.String("replay-map-snapshots", "", "Path to recorded eBPF map snapshots to replay instead of capturing packets")
+	replayInterval   = flag.Duration("replay-interval", time.Second, "Time between two replayed eBPF map snapshots")
+	captureUnparsed  = flag.String("capture-unparsed-packets", "", "Path to the pcap file the packets are written to whose SNI cannot be parsed by the eBPF program")
+	reassembleHellos = flag.Bool("reassemble-client-hellos", false, "Reassemble the ClientHellos split over several segments in userspace to parse their SNIs, exclusive with -capture-unparsed-packets")
+	captureSnapLen   = flag.Uint("capture-snap-length", 0, "Number of bytes captured per packet, 0 for up to the end of the TLS record header")
+	rollupsFile      = flag.String("rollups-file", "", "Path to the file the daily, weekly and monthly availability rollups are persisted to, empty to keep them in memory")
+	secondsBuckets   = flag.Duration("seconds-timeline-bucket", 0, "Width of the buckets the values of the seconds counters are kept in with timestamps for /admin/seconds, 0 to disable them")
+	podMonitor       = flag.Bool("register-pod-monitor", false, "Create or update the PodMonitor scraping the metrics listener of the pod, requires running in a cluster")
+	podMonitorName   = flag.String("pod-monitor-name", "connectivity-exporter", "Name of the registered PodMonitor")
+	podMonitorLabels = flag.String("pod-monitor-labels", "", "Labels of the registered PodMonitor, comma separated name=value pairs")
+	podMonitorScrape = flag.String("pod-monitor-interval", "", "Scrape interval of the registered PodMonitor, empty for the default of Prometheus")
+	podName          = flag.String("pod-name", os.Getenv("POD_NAME"), "Name of the pod of the exporter, for the registered PodMonitor")
+	dnsHealthServer  = flag.String("dns-health-server", "", "Address of the node-local DNS cache probed to annotate failure events, e.g. 169.254.20.10:53, empty to disable the probes")
+	dnsHealthName    = flag.String("dns-health-name", "kubernetes.default.svc.cluster.local.", "Name resolved by the probes of the DNS cache")
+	dnsHealthProbes  = flag.Duration("dns-health-interval", 5*time.Second, "Time between two probes of the DNS cache")
+	udpTimeout       = flag.Duration("udp-response-timeout", packet.DefaultUDPResponseTimeout, "Time after which a UDP flow to a port with the suffix "+packet.PortSuffixUDP+" without a response is unanswered")
+	dnsTracking      = flag.Bool("dns-tracking", false, "Track the DNS queries over UDP and TCP port 53 and export their responses and response latencies per queried name")
+	dnsMaxQNames     = flag.Int("dns-max-qnames", 1000, "Maximum number of queried names with DNS metrics, the queries of further names are accounted as \""+dns.Other+"\"")
+	churnWindow      = flag.Duration("destination-churn-window", 5*time.Minute, "Window the destination IPs of the SNIs are compared in to export their churn, 0 to disable it")
+	changeWindow     = flag.Duration("failure-rate-change-window", 5*time.Minute, "Window the failure rates of the SNIs are compared with their average of the previous windows in, 0 to disable it")
+	changeHistory    = flag.Int("failure-rate-change-history", 6, "Number of previous windows the failure rate of an SNI is compared with")
+	latencyWindow    = flag.Duration("latency-window", 5*time.Minute, "Sliding window of the latency quantiles per SNI, 0 to disable them")
+	maxSNILength     = flag.Int("max-sni-length", packet.MaxSNILength, "Maximum length of the SNIs, longer SNIs are truncated and marked with the suffix "+packet.TruncatedSNISuffix)
+	eventsRetention  = flag.Duration("connection-events-retention", 15*time.Minute, "Time the connection events are kept in memory for the admin API, 0 to disable them")
+	eventsBufferSize = flag.Int("connection-events-buffer-size", 100000, "Maximum number of connection events kept in memory, the oldest are dropped first")
+	destinationLimit = flag.Int("destination-breakdown-max-series", 10000, "Maximum number of SNI and destination IP pairs with seconds per destination, further destinations are accounted as \""+breakdown.Other+"\", 0 to disable them")
+	latencyHeatmaps  = flag.Bool("destination-latency-histograms", false, "Export a histogram of the connect latencies per destination, within the series limit of the destinations, requires the program built with LATENCY=1")
+	testWindowHosts  = flag.String("test-window-callback-hosts", "", "Hosts the reports of the test windows may be sent to with a callback, comma separated, empty to reject the test windows with a callback")
+	selfTestReload   = flag.Bool("self-test-after-reload", false, "Probe the reloaded program with the traffic of the self-test after a reload of the data source via the admin API and restore the previous filter if it fails")
+	authCacheTTL     = flag.Duration("kubernetes-auth-cache-ttl", time.Minute, "Time the decisions of the Kubernetes authorization are cached per token and path")
+	clientLimit      = flag.Int("client-breakdown-max-series", 0, "Maximum number of SNI and source IP pairs with seconds per client, further clients are accounted as \""+breakdown.Other+"\", 0 to disable them")
+	sniViewLimit     = flag.Int("sni-view-max-series", 10000, "Maximum number of SNIs with seconds aggregated per SNI only, further SNIs are accounted as \""+breakdown.Other+"\", 0 to disable them")
+	groupViewLimit   = flag.Int("cidr-group-view-max-series", 1000, "Maximum number of CIDR groups with seconds aggregated per CIDR group of the destinations only, 0 to disable them")
+	keySeries        = flag.Bool("per-key-series", true, "Export the seconds and connections per SNI, source IP and destination IP, disable it to only keep the aggregated views")
+	resumedLabel     = flag.Bool("tls-resumed-label", false, "Set the resumed label of the TLS handshake metrics to true for the resumed TLS 1.3 sessions and to false for the full handshakes")
+	compareBackends  = flag.Duration("compare-pcap-backend", 0, "Parse the connections in userspace as well and export the divergences from the eBPF program, matching the connections of both within the given tolerance, 0 to disable it")
+	tickSource       = flag.String("tick-source", "ticker", "Source of the ticks accounting the windows: ticker for every window after the start, wall-clock for the window boundaries of the wall clock, phc:<device> for the window boundaries of a PTP hardware clock")
+	tickOffset       = flag.Duration("tick-offset", 0, "Time after the window boundaries the aligned tick sources tick at")
+	vxlanPort        = flag.Int("vxlan-port", 0, "UDP port of the VXLAN tunnels whose inner packets are tracked instead of the outer ones, e.g. 4789, 0 to track the outer ones")
+	genevePort       = flag.Int("geneve-port", 0, "UDP port of the Geneve tunnels whose inner packets are tracked instead of the outer ones, e.g. 6081, 0 to track the outer ones")
+	gtpuPort         = flag.Int("gtpu-port", 0, "UDP port of the GTP-U tunnels whose inner packets are tracked instead of the outer ones, e.g. 2152 on the N3 interface of a mobile network, 0 to track the outer ones")
+	proxySourceIP    = flag.Bool("proxy-protocol-source-ip", false, "Report the original client of the PROXY protocol header of a connection from a load balancer as its source IP instead of the load balancer")
+	noSNIPrefix      = flag.String("no-sni-prefix", "", "Prefix of the pseudo SNI the connections without an SNI are accounted for, followed by the port of the server, e.g. __no_sni__: for __no_sni__:5432, empty to account them for the CIDR group of their destination or unknown")
+	observePartial   = flag.Bool("observe-partial-matches", false, "Report the servers of the connection attempts matching only the CIDRs or only the ports in partial_matches_total, to find the endpoints missing in the filter")
+	span             = flag.Bool("span", false, "Capture mirrored traffic (SPAN) on the dedicated capture interface given with -i, which is put into promiscuous mode")
+	sflowCollector   = flag.String("sflow-collector", "", "Address of the sFlow collector the sampled packet headers and the flow records are sent to, host:port, empty to disable the export")
+	sflowSampling    = flag.Int("sflow-sampling-rate", 1000, "One in how many frames of the network interface are sampled for sFlow, 0 to only send the flow records")
+	sflowRecordRate  = flag.Float64("sflow-flow-record-rate", 10000, "Number of increments per second turned into sFlow flow records, 0 for no limit")
+	sinkQueueSize    = flag.Int("sink-queue-size", sink.DefaultOptions.QueueSize, "Number of items queued per push sink, further items are dropped")
+	sinkMaxAttempts  = flag.Int("sink-max-attempts", sink.DefaultOptions.MaxAttempts, "Number of times the delivery of an item to a push sink is attempted")
+	sinkMaxBackoff   = flag.Duration("sink-max-backoff", sink.DefaultOptions.MaxBackoff, "Maximum time waited after failed deliveries to a push sink")
+	sflowHeaderBytes = flag.Int("sflow-header-bytes", 128, "Number of bytes of the sampled frames sent to the sFlow collector")
+	podEnrichment    = flag.Bool("pod-enrichment", false, "Resolve the source IPs to the namespaces of their pods and export the connections and their shares per namespace, requires running in a cluster")
+	podEnrichNode    = flag.String("pod-enrichment-node", os.Getenv("NODE_NAME"), "Name of the node whose pods are resolved, empty for the pods of all nodes")
+	podEnrichRefresh = flag.Duration("pod-enrichment-interval", 30*time.Second, "Time between two lists of the pods")
+	shareWindow      = flag.Duration("namespace-share-window", 5*time.Minute, "Sliding window of the shares of the namespaces in the connections to the SNIs")
+	serviceCIDRs     = flag.String("service-cidrs", "", "Service CIDRs, comma separated, whose failed connections are attributed to the backends kube-proxy translated them to, empty to disable")
+	rttCgroup        = flag.String("sample-rtt-cgroup", "", "Path of the cgroup v2 whose sockets the smoothed RTT is sampled of with a sock_ops program, e.g. /sys/fs/cgroup, empty to disable it")
+	sniAggregation   = flag.String("sni-aggregation-rules", "", "Path to the JSON file of the rules normalizing the SNIs before they are accounted, empty to account the SNIs as they are")
+	topURL           = flag.String("top-url", "http://localhost:19100/metrics", "URL of the metrics of the exporter shown by the top command")
+	topInterval      = flag.Duration("top-interval", 2*time.Second, "Time between two refreshes of the top command")
+	resolution       = flag.Duration("resolution", packet.DefaultResolution, "Width of the accounting windows, from "+packet.MinResolution.String()+" to "+packet.MaxResolution.String()+", a fraction or a multiple of a second")
 
 	incs      = make(chan *metrics.Inc)
+	failures  = make(chan *events.Failure, 100)
 	snapshots = make(chan promextra.Snapshot)
 
+	metricsListener = &server.Listener{Name: "metrics", Addr: ":19100"}
+	adminListener   = &server.Listener{Name: "admin"}
+	debugListener   = &server.Listener{Name: "debug"}
+
 	signals = make(chan os.Signal, 1)
 	wg      = &sync.WaitGroup{}
 )
 
+// maxConcurrentTraceroutes limits the traceroutes running at the same
+// time when many destinations start failing at once.
+const maxConcurrentTraceroutes = 4
+
 func main() {
 	klog.InitFlags(nil)
+	metricsListener.RegisterFlags(flag.CommandLine, "Bind and listen address for the metrics")
+	adminListener.RegisterFlags(flag.CommandLine, "Bind and listen address for the admin API, empty to serve it on the metrics address")
+	debugListener.RegisterFlags(flag.CommandLine, "Bind and listen address for the debug handlers, empty to serve them on the metrics address")
 	flag.Parse()
+	if flag.NArg() == 1 && flag.Arg(0) == "selftest" {
+		if err := packet.RemoveMemlockLimit(); err != nil {
+			exitOnError(fatal.Config, "Failed to set rlimit", err)
+		}
+		if err := selftest.Run(); err != nil {
+			exitOnError(fatal.Kernel, "Self-test failed", err)
+		}
+		klog.Info("Self-test passed")
+		return
+	}
+	if flag.NArg() == 1 && flag.Arg(0) == "top" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		info, err := os.Stdout.Stat()
+		color := err == nil && info.Mode()&os.ModeCharDevice != 0
+		if err := top.Run(ctx, *topURL, *topInterval, os.Stdout, color); err != nil {
+			exitOnError(fatal.Runtime, "Failed to run the dashboard", err)
+		}
+		return
+	}
 	if len(flag.Args()) != 0 {
-		klog.Fatalf("Expecting only flag / value pairs, got additional arguments: '%s'. Please check the quoting of the command line arguments.", flag.Args())
+		fatal.Exitf(fatal.Config, "Expecting only flag / value pairs, got additional arguments: '%s'. Please check the quoting of the command line arguments.", flag.Args())
 	}
 
-	// Using eBPF maps requires locking memory, which in turn requires setting
-	// the rlimit for the process.
-	err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{
-		Cur: unix.RLIM_INFINITY,
-		Max: unix.RLIM_INFINITY,
-	})
+	cfg, err := config.Load(*configFile)
 	if err != nil {
-		klog.Fatalf("Failed to set rlimit: %v", err)
+		exitOnError(fatal.Config, "Failed to load the configuration", err)
 	}
+	store := config.NewStore(cfg)
 
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 
-	dataSource, err := packet.NewNetworkDataSource(*networkInterface, packet.AsSet(*cidrs), packet.AsSet(*ports))
-	if err != nil {
-		klog.Fatalf("Failed to create an eBPF setup: %v", err)
+	// sources and sinks are the first and the last stage of the
+	// pipeline, around the accounting.
+	var sources, sinks []pipeline.Goroutine
+	// queues deliver the items of the push sinks and stop after the
+	// sinks, transports hold the connections of the push sinks and
+	// stop last.
+	var queues, transports []pipeline.Goroutine
+	var dataSource *packet.NetworkDataSource
+	if *diagnosticsDir != "" {
+		fatal.BeforeExit(diagnosticsHook(*diagnosticsDir, store, func() *packet.NetworkDataSource { return dataSource }))
+	}
+	var connectionTicks clock.TickSource
+	var discovered *discovery.Tracker
+	if *replaySnapshots != "" {
+		dataSource, err = packet.NewReplayDataSource(*replaySnapshots, store)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to replay the eBPF map snapshots", err)
+		}
+		if err := dataSource.SetResolution(*resolution); err != nil {
+			exitOnError(fatal.Config, "Failed to set the resolution", err)
+		}
+		connectionTicks = clock.NewTicker(*replayInterval)
+	} else {
+		if err := packet.RemoveMemlockLimit(); err != nil {
+			exitOnError(fatal.Config, "Failed to set rlimit", err)
+		}
+		newDataSource := packet.NewNetworkDataSource
+		if *span {
+			newDataSource = packet.NewSpanDataSource
+		}
+		dataSource, err = newDataSource(*networkInterface, packet.AsSet(*cidrs), packet.AsSet(*ports), store)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create an eBPF setup", err)
+		}
+		if err := dataSource.SetMaxSNILength(*maxSNILength); err != nil {
+			exitOnError(fatal.Config, "Failed to set the maximum SNI length", err)
+		}
+		if err := dataSource.SetNoSNIPrefix(*noSNIPrefix); err != nil {
+			exitOnError(fatal.Config, "Failed to set the prefix of the connections without an SNI", err)
+		}
+		if err := dataSource.SetResolution(*resolution); err != nil {
+			exitOnError(fatal.Config, "Failed to set the resolution", err)
+		}
+		if err := dataSource.SetUDPResponseTimeout(*udpTimeout); err != nil {
+			exitOnError(fatal.Config, "Failed to set the UDP response timeout", err)
+		}
+		if err := dataSource.SetTunnelPorts(*vxlanPort, *genevePort, *gtpuPort); err != nil {
+			exitOnError(fatal.Config, "Failed to set the tunnel ports", err)
+		}
+		if err := dataSource.SetProxySourceIP(*proxySourceIP); err != nil {
+			exitOnError(fatal.Config, "Failed to set the PROXY protocol source IP", err)
+		}
+		if err := dataSource.SetObservePartialMatches(*observePartial); err != nil {
+			exitOnError(fatal.Config, "Failed to observe the partial matches", err)
+		}
+		if *secondaryCIDRs != "" || *secondaryPorts != "" {
+			if *secondaryCIDRs == "" || *secondaryPorts == "" {
+				fatal.Exitf(fatal.Config, "-secondary-r and -secondary-p have to be given together")
+			}
+			if *secondaryNS == "" || *secondaryNS == "connectivity_exporter" {
+				fatal.Exitf(fatal.Config, "-secondary-namespace has to differ from the namespace of the primary filter")
+			}
+			secondary := metrics.NewSecondary(*secondaryNS)
+			if err := dataSource.AttachSecondary(packet.AsSet(*secondaryCIDRs), packet.AsSet(*secondaryPorts), secondary); err != nil {
+				exitOnError(fatal.Config, "Failed to attach the secondary filter", err)
+			}
+			prometheus.MustRegister(secondary)
+		}
+		if *discoveryRate != 0 {
+			discovered, err = discovery.NewTracker(*discoveryRate, *discoveryMax)
+			if err != nil {
+				exitOnError(fatal.Config, "Failed to create the discovery tracker", err)
+			}
+			if err := dataSource.DiscoverUnmonitored(discovered); err != nil {
+				exitOnError(fatal.Config, "Failed to discover the unmonitored destinations", err)
+			}
+		}
+		if *recordSnapshots != "" {
+			if err := dataSource.RecordSnapshots(*recordSnapshots, *recordMaxSize); err != nil {
+				exitOnError(fatal.Config, "Failed to record the eBPF map snapshots", err)
+			}
+		}
+		if *captureUnparsed != "" {
+			if err := dataSource.CaptureUnparsedPackets(ctx, wg, *captureUnparsed, uint32(*captureSnapLen)); err != nil {
+				exitOnError(fatal.Config, "Failed to capture the unparsed packets", err)
+			}
+		}
+		if *reassembleHellos {
+			if *captureUnparsed != "" {
+				fatal.Exitf(fatal.Config, "-reassemble-client-hellos and -capture-unparsed-packets are exclusive")
+			}
+			if err := dataSource.ReassembleClientHellos(ctx, wg); err != nil {
+				exitOnError(fatal.Config, "Failed to reassemble the ClientHellos", err)
+			}
+		}
+		if *dnsTracking {
+			if err := dataSource.CaptureDNS(ctx, wg, dns.NewTracker(*dnsMaxQNames)); err != nil {
+				exitOnError(fatal.Config, "Failed to track DNS", err)
+			}
+		}
+		if *serviceCIDRs != "" {
+			backends, err := conntrack.NewResolver(*serviceCIDRs)
+			if err != nil {
+				exitOnError(fatal.Config, "Failed to resolve the Service backends", err)
+			}
+			dataSource.ResolveServiceBackends(backends)
+		}
+		if *rttCgroup != "" {
+			if err := dataSource.SampleRTT(*rttCgroup); err != nil {
+				exitOnError(fatal.Config, "Failed to sample the RTT", err)
+			}
+		}
+		connectionTicks, err = clock.NewTickSource(*tickSource, *resolution, *tickOffset)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create the tick source", err)
+		}
+		executionTicks := time.NewTicker(time.Second).C
+		sources = append(sources, func(ctx context.Context, wg *sync.WaitGroup) {
+			dataSource.TrackExecutionTime(ctx, wg, executionTicks, snapshots)
+		})
 	}
 	defer dataSource.Close()
-	wg.Add(4)
-	go dataSource.TrackExecutionTime(ctx, wg, time.NewTicker(time.Second).C, snapshots)
-	go dataSource.TrackConnections(ctx, wg, time.NewTicker(time.Second).C, incs)
-	go metrics.Apply(ctx, wg, incs, snapshots)
-	go metrics.ListenAndServe(ctx, *addr, wg)
-
-	sig := <-signals
-	klog.Infof("Received signal '%s'. Initiating a graceful shutdown.\n", sig)
-	cancel()
+	dataSource.SetQuarantineDir(*quarantineDir)
+	if *sniAggregation != "" {
+		normalizer, err := normalization.Load(*sniAggregation)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to load the SNI aggregation rules", err)
+		}
+		dataSource.NormalizeSNIs(normalizer)
+	}
+	// The accounting of replayed snapshots is journaled too.
+	if *journalFile != "" {
+		if err := dataSource.JournalAccounting(*journalFile, *journalRetention); err != nil {
+			exitOnError(fatal.Config, "Failed to write the accounting journal", err)
+		}
+	}
+	testWindows := testwindow.NewRegistry(dataSource.AccountingDelay(), packet.AsSet(*testWindowHosts))
+	rollups, err := rollup.NewTracker(*rollupsFile)
+	if err != nil {
+		exitOnError(fatal.Config, "Failed to load the rollups", err)
+	}
+	var timeline *metrics.Timeline
+	if *secondsBuckets > 0 {
+		timeline = metrics.NewTimeline(*secondsBuckets)
+	}
+	var connectionEvents *events.Buffer
+	if *eventsRetention > 0 && *eventsBufferSize > 0 {
+		connectionEvents = events.NewBuffer(*eventsRetention, *eventsBufferSize)
+	}
+	adminMux := http.NewServeMux()
+	var reloadSelfTest func(context.Context) error
+	if *selfTestReload {
+		reloadSelfTest = func(ctx context.Context) error { return selftest.Probe(ctx, dataSource) }
+	}
+	admin.Register(adminMux, store, testWindows, rollups, timeline, connectionEvents, discovered, dataSource, reloadSelfTest)
+	metrics.Default.SetOpenConnections(dataSource.OpenConnections)
+	metrics.Default.SetDraining(func() bool { return store.Get().Draining })
+	metrics.Default.SetTestWindows(func() (int, int) { return testWindows.Count(time.Now()) })
+	sloTracker := slo.NewTracker(store)
+	metrics.Default.SetErrorBudgets(func() []metrics.ErrorBudget { return sloTracker.Budgets(time.Now()) })
+	metrics.Default.SetRollups(func() []metrics.Rollup { return rollups.Current(time.Now()) })
+	metrics.Default.SetCIDRGroups(func() ([]string, []metrics.CIDRGroupInfo) {
+		cfg := store.Get()
+		if len(cfg.AnnotationLabels) == 0 {
+			return nil, nil
+		}
+		var groups []metrics.CIDRGroupInfo
+		seen := make(map[string]bool)
+		for _, g := range cfg.CIDRGroups {
+			// Only the first group of a name is ever accounted.
+			if !seen[g.Name] {
+				seen[g.Name] = true
+				groups = append(groups, metrics.CIDRGroupInfo{Name: g.Name, Values: cfg.AnnotationLabelValues(g)})
+			}
+		}
+		return cfg.AnnotationLabels, groups
+	})
+	observers := []func(*metrics.Inc){testWindows.Observe, sloTracker.Observe, rollups.Observe}
+	if timeline != nil {
+		observers = append(observers, timeline.Observe)
+	}
+	if connectionEvents != nil {
+		observers = append(observers, connectionEvents.Observe)
+	}
+	if *churnWindow > 0 {
+		observers = append(observers, churn.NewTracker(*churnWindow).Observe)
+	}
+	if *changeWindow > 0 {
+		if *changeHistory <= 0 {
+			fatal.Exitf(fatal.Config, "-failure-rate-change-history must be positive")
+		}
+		observers = append(observers, change.NewTracker(*changeWindow, *changeHistory).Observe)
+	}
+	if *destinationLimit > 0 {
+		destinations := breakdown.NewTracker(breakdown.Destination, *destinationLimit)
+		if *latencyHeatmaps {
+			destinations.EnableLatencyHistograms()
+		}
+		observers = append(observers, destinations.Observe)
+	}
+	if *clientLimit > 0 {
+		observers = append(observers, breakdown.NewTracker(breakdown.Client, *clientLimit).Observe)
+	}
+	if *sniViewLimit > 0 {
+		observers = append(observers, breakdown.NewTracker(breakdown.SNI, *sniViewLimit).Observe)
+	}
+	if *groupViewLimit > 0 {
+		groupOf := func(destIP string) string { return store.Get().CIDRGroupName(net.ParseIP(destIP)) }
+		observers = append(observers, breakdown.NewCIDRGroupTracker(groupOf, *groupViewLimit).Observe)
+	}
+	if !*keySeries {
+		metrics.DisableKeySeries()
+	}
+	if *resumedLabel {
+		metrics.EnableResumedLabel()
+	}
+	if *latencyWindow > 0 {
+		latencies := latency.NewTracker(*latencyWindow)
+		metrics.Default.SetLatencies(func() []metrics.LatencySummary { return latencies.Summaries(time.Now()) })
+		observers = append(observers, latencies.Observe)
+	}
+	if *compareBackends > 0 {
+		if *replaySnapshots != "" {
+			fatal.Exitf(fatal.Config, "Comparing the pcap backend is not supported when replaying map snapshots")
+		}
+		backend, err := packet.NewPcapBackend(*networkInterface, packet.AsSet(*cidrs), packet.AsSet(*ports), *maxSNILength, store)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create the pcap backend", err)
+		}
+		backend.SetNoSNIPrefix(*noSNIPrefix)
+		comparator := abtest.NewComparator(*compareBackends)
+		if err := backend.Run(ctx, wg, comparator.ObservePcap); err != nil {
+			exitOnError(fatal.Config, "Failed to start the pcap backend", err)
+		}
+		observers = append(observers, comparator.ObserveEBPF)
+	}
+	if *sflowCollector != "" {
+		agent, err := sflow.NewAgent(*sflowCollector, *networkInterface, *sflowSampling, *sflowHeaderBytes)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create the sFlow agent", err)
+		}
+		queue := sink.NewQueue("sflow", sinkOptions(*sflowRecordRate), func(item interface{}) error {
+			agent.Observe(item.(*metrics.Inc))
+			return nil
+		})
+		observers = append(observers, func(inc *metrics.Inc) { queue.Offer(inc) })
+		queues = append(queues, queue.Run)
+		transports = append(transports, agent.Run)
+	}
+	if *podEnrichment {
+		if *shareWindow <= 0 {
+			fatal.Exitf(fatal.Config, "-namespace-share-window must be positive")
+		}
+		client, _, err := kube.NewInClusterClient()
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create the pod resolver", err)
+		}
+		pods := kube.NewPodResolver(client, *podEnrichNode)
+		if err := pods.Refresh(ctx); err != nil {
+			klog.Warningf("Failed to list the pods: %v", err)
+		}
+		observers = append(observers, fairness.NewTracker(pods, *shareWindow).Observe)
+		podTicks := time.NewTicker(*podEnrichRefresh).C
+		sources = append(sources, func(ctx context.Context, wg *sync.WaitGroup) { pods.Run(ctx, wg, podTicks) })
+	}
+	prometheus.MustRegister(metrics.Default)
+
+	var dnsHealth events.DNSHealth
+	if *dnsHealthServer != "" {
+		prober := dnshealth.NewProber(*dnsHealthServer, *dnsHealthName, *dnsHealthProbes)
+		dnsHealth = prober
+		probes := time.NewTicker(*dnsHealthProbes).C
+		sources = append(sources, func(ctx context.Context, wg *sync.WaitGroup) { prober.Run(ctx, wg, probes) })
+	}
+
+	var failureSink chan<- *events.Failure
+	if *failureEvents != "" {
+		var w io.Writer = os.Stdout
+		if *failureEvents != "-" {
+			file, err := events.OpenFile(*failureEvents, events.FileOptions{
+				MaxSize:   *eventsMaxSize,
+				MaxAge:    *eventsMaxAge,
+				Compress:  *eventsCompress,
+				Retention: *eventsFileRetain,
+				MaxFiles:  *eventsMaxFiles,
+			})
+			if err != nil {
+				exitOnError(fatal.Config, "Failed to open the failure events file", err)
+			}
+			defer file.Close()
+			w = file
+			sweepTicks := time.NewTicker(time.Minute).C
+			sinks = append(sinks, func(ctx context.Context, wg *sync.WaitGroup) { file.Run(ctx, wg, sweepTicks) })
+		}
+		var tracer events.Tracer
+		if *traceOnFailure {
+			tracer = traceroute.NewTracer(*traceInterval, maxConcurrentTraceroutes)
+		}
+		failureSink = failures
+		queue := sink.NewQueue("failure_events", sinkOptions(*eventsRate), events.Writer(w))
+		sinks = append(sinks, func(ctx context.Context, wg *sync.WaitGroup) {
+			events.Process(ctx, wg, failures, tracer, dnsHealth, queue)
+		})
+		queues = append(queues, queue.Run)
+	} else if *traceOnFailure {
+		fatal.Exitf(fatal.Config, "-traceroute-on-failure requires -failure-events")
+	}
+
+	if metricsListener.KubernetesAuth || adminListener.KubernetesAuth || debugListener.KubernetesAuth {
+		client, _, err := kube.NewInClusterClient()
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to create the Kubernetes authorizer", err)
+		}
+		authorizer := kube.NewAuthorizer(client, *authCacheTTL)
+		for _, l := range []*server.Listener{metricsListener, adminListener, debugListener} {
+			l.Authorizer = authorizer
+		}
+	}
+
+	servers, err := server.Group(
+		server.Surface{Listener: metricsListener, Prefix: "/metrics", Handler: metrics.Handler()},
+		server.Surface{Listener: adminListener, Prefix: "/admin/", Handler: adminMux},
+		server.Surface{Listener: debugListener, Prefix: "/debug/", Handler: debugMux(dataSource)},
+	)
+	if err != nil {
+		exitOnError(fatal.Config, "Failed to configure the listeners", err)
+	}
+
+	sources = append(sources, func(ctx context.Context, wg *sync.WaitGroup) {
+		dataSource.TrackConnections(ctx, wg, connectionTicks, incs, failureSink)
+	})
+	testWindowTicks, rollupTicks := time.NewTicker(time.Second).C, time.NewTicker(time.Minute).C
+	sinks = append(sinks,
+		func(ctx context.Context, wg *sync.WaitGroup) { testWindows.Run(ctx, wg, testWindowTicks) },
+		func(ctx context.Context, wg *sync.WaitGroup) { rollups.Run(ctx, wg, rollupTicks) },
+	)
+	for _, s := range servers {
+		sinks = append(sinks, s.ListenAndServe)
+	}
+	if *podMonitor {
+		labels, err := podmonitor.ParseLabels(*podMonitorLabels)
+		if err != nil {
+			exitOnError(fatal.Config, "Failed to parse the PodMonitor labels", err)
+		}
+		opts := podmonitor.Options{Name: *podMonitorName, PodName: *podName, Labels: labels, Interval: *podMonitorScrape}
+		registrations := time.NewTicker(10 * time.Minute).C
+		sinks = append(sinks, func(ctx context.Context, wg *sync.WaitGroup) {
+			podmonitor.Run(ctx, wg, registrations, opts, metricsListener)
+		})
+	}
+
+	// The sources stop first and the sinks last, so no stage sends to
+	// a stage which stopped receiving.
+	p := &pipeline.Pipeline{}
+	p.Add(sources...)
+	p.Add(func(ctx context.Context, wg *sync.WaitGroup) { metrics.Apply(ctx, wg, incs, snapshots, observers...) })
+	p.Add(sinks...)
+	p.Add(queues...)
+	p.Add(transports...)
+	go func() {
+		sig := <-signals
+		klog.Infof("Received signal '%s'. Initiating a graceful shutdown.\n", sig)
+		cancel()
+	}()
+	p.Run(ctx)
 	wg.Wait()
 	klog.Infoln("See you next time!")
 }
+
+// sinkOptions returns the options of the queue of a push sink with the
+// rate, which allows bursts of a second.
+func sinkOptions(rate float64) sink.Options {
+	opts := sink.DefaultOptions
+	opts.QueueSize = *sinkQueueSize
+	opts.Rate = rate
+	opts.Burst = int(math.Ceil(rate))
+	opts.MaxAttempts = *sinkMaxAttempts
+	opts.MaxBackoff = *sinkMaxBackoff
+	return opts
+}
+
+// debugMux returns the mux of the debug handlers.
+func debugMux(dataSource *packet.NetworkDataSource) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/ebpf", ebpfHandler(dataSource))
+	return mux
+}
+
+// ebpfHandler returns the loaded eBPF programs and maps, with the query
+// parameter verifierLog=true also the logs of the verifier.
+func ebpfHandler(dataSource *packet.NetworkDataSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		verifierLog, _ := strconv.ParseBool(r.URL.Query().Get("verifierLog"))
+		info, err := dataSource.EBPFInfo(verifierLog)
+		if errors.Is(err, packet.ErrNoEBPF) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			klog.Errorf("Failed to write response: %v", err)
+		}
+	}
+}
+
+// diagnosticsHook returns the hook writing a diagnostics bundle to the
+// directory before the exporter exits on a fatal error. An invalid
+// configuration is fully described by its error, so it gets no bundle.
+func diagnosticsHook(dir string, store *config.Store, dataSource func() *packet.NetworkDataSource) func(string, *fatal.Error) {
+	return func(msg string, e *fatal.Error) {
+		if e.Category() == fatal.Config {
+			return
+		}
+		now := time.Now()
+		files := []diagnostics.File{
+			diagnostics.JSON("error.json", func() (interface{}, error) {
+				return struct {
+					Time     time.Time `json:"time"`
+					Message  string    `json:"message"`
+					Error    string    `json:"error"`
+					Category string    `json:"category"`
+					Reason   string    `json:"reason,omitempty"`
+					ExitCode int       `json:"exitCode"`
+				}{now, msg, e.Error(), e.Category().String(), e.Reason(), e.ExitCode()}, nil
+			}),
+			diagnostics.Goroutines(),
+			diagnostics.Metrics(prometheus.DefaultGatherer),
+			diagnostics.JSON("config.json", func() (interface{}, error) { return store.Get(), nil }),
+		}
+		if ds := dataSource(); ds != nil {
+			files = append(files,
+				diagnostics.JSON("ebpf.json", func() (interface{}, error) { return ds.EBPFInfo(false) }),
+				diagnostics.JSON("maps.json", func() (interface{}, error) { return ds.DumpMaps() }),
+			)
+		}
+		filename, err := diagnostics.WriteBundle(dir, now, files)
+		if err != nil {
+			klog.Errorf("Failed to write the diagnostics bundle: %v", err)
+			return
+		}
+		klog.Errorf("Wrote the diagnostics bundle to %s", filename)
+	}
+}
+
+// exitOnError logs the error, with the remediation hint of a failure to
+// set up the eBPF program, and exits with the exit code of its category.
+// The category of an error which does not know it is the fallback.
+func exitOnError(fallback fatal.Category, msg string, err error) {
+	var setupErr *packet.SetupError
+	if errors.As(err, &setupErr) {
+		if setupErr.VerifierLog != "" {
+			klog.Errorf("End of the verifier log:\n%s", setupErr.VerifierLog)
+		}
+		if hint := setupErr.Hint(); hint != "" {
+			klog.Errorf("Hint: %s", hint)
+		}
+	}
+	fatal.Exit(fallback, msg, err)
+}
@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Collector is the prometheus.Collector of the exporter. The counters
+// are pushed by Apply and the setters of this package, the gauges of
+// the current state are computed at scrape time from the sources set
+// on the collector. It can be registered in several registries.
+type Collector struct {
+	mutex           sync.RWMutex
+	openConnections func() (map[string]int, error)
+	testWindows     func() (pending, complete int)
+	errorBudgets    func() []ErrorBudget
+	rollups         func() []Rollup
+	latencies       func() []LatencySummary
+	draining        func() bool
+	cidrGroups      func() ([]string, []CIDRGroupInfo)
+}
+
+// Default is the collector main registers in the default registry.
+var Default = NewCollector()
+
+// NewCollector returns a collector without sources. The pushed
+// metrics are shared by all collectors.
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// SetOpenConnections sets the source of the number of open
+// connections by state.
+func (c *Collector) SetOpenConnections(f func() (map[string]int, error)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.openConnections = f
+}
+
+// SetTestWindows sets the source of the number of test windows.
+func (c *Collector) SetTestWindows(f func() (pending, complete int)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.testWindows = f
+}
+
+// SetErrorBudgets sets the source of the error budgets of the SLOs.
+func (c *Collector) SetErrorBudgets(f func() []ErrorBudget) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.errorBudgets = f
+}
+
+// SetRollups sets the source of the rollups of the current calendar
+// periods.
+func (c *Collector) SetRollups(f func() []Rollup) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rollups = f
+}
+
+// SetLatencies sets the source of the latency quantiles.
+func (c *Collector) SetLatencies(f func() []LatencySummary) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.latencies = f
+}
+
+// SetDraining sets the source of the draining state of the node.
+func (c *Collector) SetDraining(f func() bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.draining = f
+}
+
+// SetCIDRGroups sets the source of the annotation labels and the CIDR
+// groups. The labels are configured at runtime, so the info metric of
+// the groups is not described.
+func (c *Collector) SetCIDRGroups(f func() ([]string, []CIDRGroupInfo)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cidrGroups = f
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range pushed {
+		m.Describe(ch)
+	}
+	ch <- openConnectionsDesc
+	ch <- testWindowsDesc
+	ch <- errorBudgetDesc
+	ch <- errorBudgetRemainingDesc
+	ch <- errorBudgetExhaustedDesc
+	ch <- rollupSecondsDesc
+	ch <- rollupAvailabilityDesc
+	ch <- latencyDesc
+	ch <- drainingDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range pushed {
+		m.Collect(ch)
+	}
+
+	c.mutex.RLock()
+	openConnections, testWindows, errorBudgets, rollups, latencies, draining, cidrGroups := c.openConnections, c.testWindows, c.errorBudgets, c.rollups, c.latencies, c.draining, c.cidrGroups
+	c.mutex.RUnlock()
+	if openConnections != nil {
+		counts, err := openConnections()
+		if err != nil {
+			klog.Errorf("Failed to count the open connections: %v", err)
+		}
+		for state, n := range counts {
+			ch <- prometheus.MustNewConstMetric(openConnectionsDesc, prometheus.GaugeValue, float64(n), state)
+		}
+	}
+	if testWindows != nil {
+		pending, complete := testWindows()
+		ch <- prometheus.MustNewConstMetric(testWindowsDesc, prometheus.GaugeValue, float64(pending), strconv.FormatBool(false))
+		ch <- prometheus.MustNewConstMetric(testWindowsDesc, prometheus.GaugeValue, float64(complete), strconv.FormatBool(true))
+	}
+	if errorBudgets != nil {
+		for _, b := range errorBudgets() {
+			ch <- prometheus.MustNewConstMetric(errorBudgetDesc, prometheus.GaugeValue, b.Budget, b.SNI)
+			ch <- prometheus.MustNewConstMetric(errorBudgetRemainingDesc, prometheus.GaugeValue, b.Remaining, b.SNI)
+			if !b.Exhausted.IsZero() {
+				ch <- prometheus.MustNewConstMetric(errorBudgetExhaustedDesc, prometheus.GaugeValue, float64(b.Exhausted.Unix()), b.SNI)
+			}
+		}
+	}
+	if rollups != nil {
+		for _, r := range rollups() {
+			ch <- prometheus.MustNewConstMetric(rollupSecondsDesc, prometheus.GaugeValue, r.ActiveSeconds, "active", r.SNI, r.Period)
+			ch <- prometheus.MustNewConstMetric(rollupSecondsDesc, prometheus.GaugeValue, r.ActiveFailedSeconds, "active_failed", r.SNI, r.Period)
+			if r.ActiveSeconds > 0 {
+				ch <- prometheus.MustNewConstMetric(rollupAvailabilityDesc, prometheus.GaugeValue, 1-r.ActiveFailedSeconds/r.ActiveSeconds, r.SNI, r.Period)
+			}
+		}
+	}
+	if latencies != nil {
+		for _, l := range latencies() {
+			ch <- prometheus.MustNewConstSummary(latencyDesc, l.Count, l.Sum, l.Quantiles, l.Kind, l.SNI)
+		}
+	}
+	if draining != nil {
+		value := 0.0
+		if draining() {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(drainingDesc, prometheus.GaugeValue, value)
+	}
+	if cidrGroups != nil {
+		labels, groups := cidrGroups()
+		// The groups are accounted like SNIs, so the info metric
+		// joins the other metrics on the SNI.
+		desc := prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cidr_group_info"),
+			"Annotations of the CIDR group, whose name is used as SNI.",
+			append([]string{"sni"}, labels...), nil,
+		)
+		for _, g := range groups {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, append([]string{g.Name}, g.Values...)...)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	defer resetMetrics()
+	c := NewCollector()
+	c.SetOpenConnections(func() (map[string]int, error) {
+		return map[string]int{"syn_received": 2, "sni_received": 1}, nil
+	})
+	c.SetTestWindows(func() (int, int) { return 3, 1 })
+	(&Inc{SuccessfulConnections: 1, SNI: "test.sni", SourceIP: "10.0.0.1", DestIP: "10.0.0.2"}).apply()
+
+	// The collector can be registered in several registries.
+	for _, registry := range []*prometheus.Registry{prometheus.NewRegistry(), prometheus.NewRegistry()} {
+		if err := registry.Register(c); err != nil {
+			t.Fatalf("Register() = %v", err)
+		}
+		expected := `
+			# HELP connectivity_exporter_connections_total Total number of new connections.
+			# TYPE connectivity_exporter_connections_total counter
+			connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected",sni="test.sni",source_ip="10.0.0.1"} 0
+			connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_client",sni="test.sni",source_ip="10.0.0.1"} 0
+			connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_middlebox",sni="test.sni",source_ip="10.0.0.1"} 0
+			connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_network",sni="test.sni",source_ip="10.0.0.1"} 0
+			connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="successful",sni="test.sni",source_ip="10.0.0.1"} 1
+			# HELP connectivity_exporter_open_connections Number of connections tracked by the eBPF program which are not accounted yet.
+			# TYPE connectivity_exporter_open_connections gauge
+			connectivity_exporter_open_connections{state="sni_received"} 1
+			connectivity_exporter_open_connections{state="syn_received"} 2
+			# HELP connectivity_exporter_test_windows Number of registered test windows.
+			# TYPE connectivity_exporter_test_windows gauge
+			connectivity_exporter_test_windows{complete="false"} 3
+			connectivity_exporter_test_windows{complete="true"} 1
+		`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+			"connectivity_exporter_connections_total",
+			"connectivity_exporter_open_connections",
+			"connectivity_exporter_test_windows",
+		); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCIDRGroupInfo(t *testing.T) {
+	c := NewCollector()
+	c.SetCIDRGroups(func() ([]string, []CIDRGroupInfo) {
+		return []string{"team", "tier"}, []CIDRGroupInfo{{Name: "database", Values: []string{"storage", "1"}}}
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	expected := `
+		# HELP connectivity_exporter_cidr_group_info Annotations of the CIDR group, whose name is used as SNI.
+		# TYPE connectivity_exporter_cidr_group_info gauge
+		connectivity_exporter_cidr_group_info{sni="database",team="storage",tier="1"} 1
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "connectivity_exporter_cidr_group_info"); err != nil {
+		t.Error(err)
+	}
+}
@@ -6,39 +6,78 @@ package metrics
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"k8s.io/klog/v2"
 
 	"m/promextra"
 )
 
-// ListenAndServe starts the http server to expose the prometheus metrics
-func ListenAndServe(ctx context.Context, addr string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer klog.Infoln("Bye.")
-
-	http.Handle("/metrics", promhttp.Handler())
-	klog.Info("Starting connectivity-exporter")
-	server := &http.Server{Addr: addr, Handler: nil}
+// Handler returns the http handler exposing the prometheus metrics of
+// the default registry. The parameters collect[] of a scrape select the
+// metric families, see handlerFor.
+func Handler() http.Handler {
+	return handlerFor(promhttp.Handler(), prometheus.DefaultGatherer)
+}
 
-	go func() {
-		<-ctx.Done()
-		// ignoring the error, we are shutting down anyway
-		_ = server.Shutdown(context.TODO())
-	}()
+// handlerFor serves all metric families with the handler, or only the
+// families of the gatherer matching one of the collect[] parameters, so
+// the scrape jobs with different intervals can split the metrics. A
+// parameter is a pattern as accepted by path.Match of the name of the
+// family, with or without the prefix "connectivity_exporter_".
+func handlerFor(all http.Handler, gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		patterns := r.URL.Query()["collect[]"]
+		if len(patterns) == 0 {
+			all.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				http.Error(w, fmt.Sprintf("invalid collect[] pattern %q: %v", p, err), http.StatusBadRequest)
+				return
+			}
+		}
+		filtered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			families, err := gatherer.Gather()
+			selected := families[:0]
+			for _, f := range families {
+				if matchesFamily(patterns, f.GetName()) {
+					selected = append(selected, f)
+				}
+			}
+			return selected, err
+		})
+		promhttp.HandlerFor(filtered, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
 
-	err := server.ListenAndServe()
-	if err != http.ErrServerClosed {
-		klog.Fatal("unexpected error", err)
+func matchesFamily(patterns []string, name string) bool {
+	short := strings.TrimPrefix(name, namespace+"_")
+	for _, p := range patterns {
+		// The patterns are validated, so the error can be ignored.
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, short); ok {
+			return true
+		}
 	}
-	klog.Info(err)
+	return false
 }
 
-// Apply the increments to the prometheus metrics
-func Apply(ctx context.Context, wg *sync.WaitGroup, incs <-chan *Inc, snapshots <-chan promextra.Snapshot) {
+// Apply the increments to the prometheus metrics and pass them on to
+// the observers.
+func Apply(ctx context.Context, wg *sync.WaitGroup, incs <-chan *Inc, snapshots <-chan promextra.Snapshot, observers ...func(*Inc)) {
 	defer wg.Done()
 	defer klog.Infoln("Bye.")
 	done := ctx.Done()
@@ -49,33 +88,672 @@ func Apply(ctx context.Context, wg *sync.WaitGroup, incs <-chan *Inc, snapshots
 			return
 		case inc := <-incs:
 			inc.apply()
+			for _, observe := range observers {
+				observe(inc)
+			}
 		case snapshot := <-snapshots:
 			applySnapshot(snapshot)
 		}
 	}
 }
 
+// keySeries is unset to leave out the seconds and connections per
+// connection key, see DisableKeySeries.
+var keySeries = true
+
+// DisableKeySeries stops exporting the seconds and connections per SNI,
+// source IP and destination IP, for the deployments only using the
+// aggregated views. It must be called before Apply.
+func DisableKeySeries() {
+	keySeries = false
+}
+
 func (inc *Inc) apply() {
 	klog.InfoS("apply", "source", inc.SourceIP, "dest", inc.DestIP, "sni", inc.SNI)
+	endpoints.add(inc.SNI, inc.SourceIP, inc.DestIP)
+	if keySeries {
+		inc.applyKeySeries()
+	}
+	handshakesAbandoned.WithLabelValues(inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.HandshakesAbandoned)
+	connectionFailures.WithLabelValues("tls_handshake", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.HandshakesFailed)
+	connectionFailures.WithLabelValues("established", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.EstablishedResets)
+	if inc.CertificateRequests > 0 {
+		certificateRequests.WithLabelValues(inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.CertificateRequests)
+		certificateRequestFailures.WithLabelValues(inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.CertificateRequestFailures)
+	}
+	if inc.InferredSNIConnections > 0 {
+		sniAttributions.WithLabelValues("inferred", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.InferredSNIConnections)
+	}
+	if inc.FallbackSNIConnections > 0 {
+		sniAttributions.WithLabelValues("fallback", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.FallbackSNIConnections)
+	}
+	for transition, n := range inc.Transitions {
+		stateTransitions.WithLabelValues(transition, inc.SNI).Add(n)
+	}
+	for code, n := range inc.ICMPCodes {
+		networkRejections.WithLabelValues(code, inc.SNI, inc.SourceIP, inc.DestIP).Add(n)
+	}
+	for origin, n := range inc.RSTOrigins {
+		resets.WithLabelValues(origin, inc.SNI, inc.SourceIP, inc.DestIP).Add(n)
+	}
+	for class, n := range inc.Classes {
+		classifiedConnections.WithLabelValues(class.Classifier, class.Name, inc.SNI, inc.SourceIP, inc.DestIP).Add(n)
+	}
+	if inc.AttributeFailures {
+		failedSecondsByCause.WithLabelValues("server", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ServerFailedSeconds)
+		failedSecondsByCause.WithLabelValues("client", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ClientFailedSeconds)
+		failedSecondsByCause.WithLabelValues("network", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.NetworkFailedSeconds)
+	}
+	if inc.DetectHandshakeOnly {
+		handshakeOnlyConnections.WithLabelValues(inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.HandshakeOnlyConnections)
+	}
+	ecnNegotiations.WithLabelValues("requested", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ECNRequested)
+	ecnNegotiations.WithLabelValues("accepted", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ECNAccepted)
+	congestionSignals.WithLabelValues("ce", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.CongestionExperiencedPackets)
+	congestionSignals.WithLabelValues("ece", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ECEPackets)
+	congestionSignals.WithLabelValues("cwr", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.CWRPackets)
+	if len(inc.HandshakeDurations) > 0 {
+		h := handshakeDuration.WithLabelValues(inc.SNI)
+		for _, d := range inc.HandshakeDurations {
+			h.Observe(d.Seconds())
+		}
+	}
+}
+
+func (inc *Inc) applyKeySeries() {
 	seconds.WithLabelValues("active", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ActiveSeconds)
 	seconds.WithLabelValues("failed", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.FailedSeconds)
 	seconds.WithLabelValues("active_failed", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ActiveFailedSeconds)
+	seconds.WithLabelValues("silenced", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.SilencedSeconds)
+	seconds.WithLabelValues("expected_idle", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.ExpectedIdleSeconds)
+	if inc.WallClockSeconds > 0 {
+		seconds.WithLabelValues("wall_clock", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.WallClockSeconds)
+		seconds.WithLabelValues("unknown", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.UnknownSeconds)
+	}
 	connections.WithLabelValues("successful", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.SuccessfulConnections)
 	connections.WithLabelValues("rejected", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.RejectedConnections)
 	connections.WithLabelValues("rejected_by_client", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.RejectedConnectionsByClient)
+	connections.WithLabelValues("rejected_by_middlebox", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.RejectedConnectionsByMiddlebox)
+	connections.WithLabelValues("rejected_by_network", inc.SNI, inc.SourceIP, inc.DestIP).Add(inc.RejectedConnectionsByNetwork)
 }
 
+// RTTSnapshot is the name of the snapshots of the RTT histograms, whose
+// label value is the SNI.
+const RTTSnapshot = "rtt"
+
 func applySnapshot(snapshot promextra.Snapshot) {
-	if err := execution.ApplySnapshot(snapshot); err != nil {
+	var err error
+	switch snapshot.Name {
+	case RTTSnapshot:
+		err = rtt.ApplySnapshot(snapshot)
+	default:
+		err = execution.ApplySnapshot(snapshot)
+	}
+	if err != nil {
 		klog.Error("failed to apply snapshot", err)
 	}
 }
 
+// endpointSet holds the source and destination IPs of the series per
+// SNI. DeleteLabelValues only deletes a series given all its label
+// values, so they are needed to delete the series of an SNI.
+type endpointSet struct {
+	mutex sync.Mutex
+	bySNI map[string]map[endpoint]struct{}
+}
+
+type endpoint struct {
+	sourceIP, destIP string
+}
+
+var endpoints = &endpointSet{bySNI: map[string]map[endpoint]struct{}{}}
+
+func (s *endpointSet) add(sni, sourceIP, destIP string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set, ok := s.bySNI[sni]
+	if !ok {
+		set = map[endpoint]struct{}{}
+		s.bySNI[sni] = set
+	}
+	set[endpoint{sourceIP: sourceIP, destIP: destIP}] = struct{}{}
+}
+
+// remove forgets the endpoints of the SNI and returns them.
+func (s *endpointSet) remove(sni string) map[endpoint]struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set := s.bySNI[sni]
+	delete(s.bySNI, sni)
+	return set
+}
+
+// DeleteMetrics removes the series of the SNI.
 func DeleteMetrics(sni string) {
-	seconds.DeleteLabelValues("active", sni)
-	seconds.DeleteLabelValues("failed", sni)
-	seconds.DeleteLabelValues("active_failed", sni)
-	connections.DeleteLabelValues("successful", sni)
-	connections.DeleteLabelValues("rejected", sni)
-	connections.DeleteLabelValues("rejected_by_client", sni)
+	for e := range endpoints.remove(sni) {
+		deleteEndpointMetrics(sni, e.sourceIP, e.destIP)
+	}
+	for _, transition := range []string{"syn", "synack", "sni", "rst_client", "rst_server", "fin", "expired"} {
+		stateTransitions.DeleteLabelValues(transition, sni)
+	}
+	suspectedInterceptions.DeleteLabelValues(sni, "split_handshake")
+	suspectedInterceptions.DeleteLabelValues(sni, "client_hello_after_rst")
+	destinationIPChanges.DeleteLabelValues("added", sni)
+	destinationIPChanges.DeleteLabelValues("removed", sni)
+	for _, protocol := range ALPNProtocols {
+		alpnOffered.DeleteLabelValues(sni, protocol)
+		alpnSelected.DeleteLabelValues(sni, protocol)
+	}
+	handshakeDuration.DeleteLabelValues(sni)
+}
+
+// deleteEndpointMetrics removes the series of the SNI, source IP and
+// destination IP.
+func deleteEndpointMetrics(sni, sourceIP, destIP string) {
+	for _, kind := range []string{"active", "failed", "active_failed", "silenced", "expected_idle", "wall_clock", "unknown"} {
+		seconds.DeleteLabelValues(kind, sni, sourceIP, destIP)
+	}
+	for _, kind := range []string{"successful", "rejected", "rejected_by_client", "rejected_by_middlebox", "rejected_by_network"} {
+		connections.DeleteLabelValues(kind, sni, sourceIP, destIP)
+	}
+	for _, code := range ICMPUnreachableCodes {
+		networkRejections.DeleteLabelValues(code, sni, sourceIP, destIP)
+	}
+	for _, origin := range RSTOrigins {
+		resets.DeleteLabelValues(origin, sni, sourceIP, destIP)
+	}
+	handshakesAbandoned.DeleteLabelValues(sni, sourceIP, destIP)
+	connectionFailures.DeleteLabelValues("tls_handshake", sni, sourceIP, destIP)
+	connectionFailures.DeleteLabelValues("established", sni, sourceIP, destIP)
+	sniAttributions.DeleteLabelValues("inferred", sni, sourceIP, destIP)
+	sniAttributions.DeleteLabelValues("fallback", sni, sourceIP, destIP)
+	handshakeOnlyConnections.DeleteLabelValues(sni, sourceIP, destIP)
+	certificateRequests.DeleteLabelValues(sni, sourceIP, destIP)
+	certificateRequestFailures.DeleteLabelValues(sni, sourceIP, destIP)
+	for _, cause := range []string{"server", "client", "network"} {
+		failedSecondsByCause.DeleteLabelValues(cause, sni, sourceIP, destIP)
+	}
+	for _, kind := range []string{"requested", "accepted"} {
+		ecnNegotiations.DeleteLabelValues(kind, sni, sourceIP, destIP)
+	}
+	for _, signal := range []string{"ce", "ece", "cwr"} {
+		congestionSignals.DeleteLabelValues(signal, sni, sourceIP, destIP)
+	}
+}
+
+// AddBreakdown adds the seconds and connections of an SNI aggregated
+// per destination or per client, or of the views per SNI or per CIDR
+// group. The label is "dest_ip", "source_ip", "sni" or "cidr_group".
+// The views only use the SNI or the value respectively.
+func AddBreakdown(label, sni, value string, inc *Inc) {
+	secondsVec, connectionsVec := breakdownVecs(label)
+	secondsVec.WithLabelValues(breakdownLabelValues(label, "active", sni, value)...).Add(inc.ActiveSeconds)
+	secondsVec.WithLabelValues(breakdownLabelValues(label, "failed", sni, value)...).Add(inc.FailedSeconds)
+	secondsVec.WithLabelValues(breakdownLabelValues(label, "active_failed", sni, value)...).Add(inc.ActiveFailedSeconds)
+	connectionsVec.WithLabelValues(breakdownLabelValues(label, "successful", sni, value)...).Add(inc.SuccessfulConnections)
+	connectionsVec.WithLabelValues(breakdownLabelValues(label, "rejected", sni, value)...).Add(inc.RejectedConnections)
+}
+
+// DeleteBreakdown removes the series of an SNI and a destination or a
+// client, or of a view, without updates.
+func DeleteBreakdown(label, sni, value string) {
+	secondsVec, connectionsVec := breakdownVecs(label)
+	for _, kind := range []string{"active", "failed", "active_failed"} {
+		secondsVec.DeleteLabelValues(breakdownLabelValues(label, kind, sni, value)...)
+	}
+	for _, kind := range []string{"successful", "rejected"} {
+		connectionsVec.DeleteLabelValues(breakdownLabelValues(label, kind, sni, value)...)
+	}
+	if label == "dest_ip" {
+		destinationConnectLatency.DeleteLabelValues(sni, value)
+	}
+}
+
+// AddCanary adds the increments of a window of the current or, if
+// candidate is set, the candidate configuration of the canary.
+func AddCanary(candidate bool, incs []*Inc) {
+	side, sign := "current", -1.0
+	if candidate {
+		side, sign = "candidate", 1.0
+	}
+	for _, inc := range incs {
+		for kind, v := range map[string]float64{
+			"active":        inc.ActiveSeconds,
+			"failed":        inc.FailedSeconds,
+			"active_failed": inc.ActiveFailedSeconds,
+		} {
+			canarySeconds.WithLabelValues(side, kind, inc.SNI).Add(v)
+			canarySecondsDelta.WithLabelValues(kind, inc.SNI).Add(sign * v)
+		}
+		for kind, v := range map[string]float64{
+			"successful": inc.SuccessfulConnections,
+			"rejected":   inc.RejectedConnections,
+		} {
+			canaryConnections.WithLabelValues(side, kind, inc.SNI).Add(v)
+			canaryConnectionsDelta.WithLabelValues(kind, inc.SNI).Add(sign * v)
+		}
+	}
+}
+
+// ResetCanary removes the series of the previous canary.
+func ResetCanary() {
+	canarySeconds.Reset()
+	canaryConnections.Reset()
+	canarySecondsDelta.Reset()
+	canaryConnectionsDelta.Reset()
+}
+
+// AddBackendMatches adds the connections of an SNI seen by both the
+// eBPF and the pcap backend.
+func AddBackendMatches(sni string, n int) {
+	backendMatches.WithLabelValues(sni).Add(float64(n))
+}
+
+// AddBackendDivergences adds the connections of an SNI seen only by the
+// backend.
+func AddBackendDivergences(backend, sni string, n int) {
+	backendDivergences.WithLabelValues(backend, sni).Add(float64(n))
+}
+
+// ObserveDestinationConnectLatencies adds the connect latencies of a
+// destination of an SNI to its histogram.
+func ObserveDestinationConnectLatencies(sni, destIP string, latencies []time.Duration) {
+	h := destinationConnectLatency.WithLabelValues(sni, destIP)
+	for _, l := range latencies {
+		h.Observe(l.Seconds())
+	}
+}
+
+func breakdownVecs(label string) (*prometheus.CounterVec, *prometheus.CounterVec) {
+	switch label {
+	case "source_ip":
+		return clientSeconds, clientConnections
+	case "sni":
+		return sniSeconds, sniConnections
+	case "cidr_group":
+		return cidrGroupSeconds, cidrGroupConnections
+	}
+	return destinationSeconds, destinationConnections
+}
+
+func breakdownLabelValues(label, kind, sni, value string) []string {
+	switch label {
+	case "sni":
+		return []string{kind, sni}
+	case "cidr_group":
+		return []string{kind, value}
+	}
+	return []string{kind, sni, value}
+}
+
+// SetDestinationIPs sets the number of destination IPs of the SNI and
+// adds the destination IPs which appeared and disappeared since the
+// previous churn window.
+func SetDestinationIPs(sni string, n, added, removed int) {
+	destinationIPs.WithLabelValues(sni).Set(float64(n))
+	destinationIPChanges.WithLabelValues("added", sni).Add(float64(added))
+	destinationIPChanges.WithLabelValues("removed", sni).Add(float64(removed))
+}
+
+// DeleteDestinationIPs removes the number of destination IPs of an SNI
+// without traffic.
+func DeleteDestinationIPs(sni string) {
+	destinationIPs.DeleteLabelValues(sni)
+}
+
+// SetFailureRateChange sets the ratio of the failure rate of the SNI
+// in the last window to its average in the previous windows.
+func SetFailureRateChange(sni string, ratio float64) {
+	failureRateChanges.WithLabelValues(sni).Set(ratio)
+}
+
+// DeleteFailureRateChange removes the ratio of an SNI without
+// connections in the last window.
+func DeleteFailureRateChange(sni string) {
+	failureRateChanges.DeleteLabelValues(sni)
+}
+
+// IncDNSProbes counts a probe of the DNS cache. The result is either
+// "succeeded" or "failed".
+func IncDNSProbes(result string) {
+	dnsProbes.WithLabelValues(result).Inc()
+}
+
+// AddUDPFlows adds UDP flows to a destination. The outcome is either
+// "answered" or "unanswered".
+func AddUDPFlows(outcome, destIP, destPort string, n float64) {
+	udpFlows.WithLabelValues(outcome, destIP, destPort).Add(n)
+}
+
+// DeleteUDPFlows removes the UDP flows of a destination without flows.
+func DeleteUDPFlows(destIP, destPort string) {
+	udpFlows.DeleteLabelValues("answered", destIP, destPort)
+	udpFlows.DeleteLabelValues("unanswered", destIP, destPort)
+}
+
+// IncDNSQueries counts a DNS query of the name and type.
+func IncDNSQueries(qname, qtype string) {
+	dnsQueries.WithLabelValues(qname, qtype).Inc()
+}
+
+// IncDNSResponses counts a DNS response to a query of the name.
+func IncDNSResponses(qname, rcode string) {
+	dnsResponses.WithLabelValues(qname, rcode).Inc()
+}
+
+// IncDNSTimeouts counts a DNS query of the name without a response.
+func IncDNSTimeouts(qname string) {
+	dnsTimeouts.WithLabelValues(qname).Inc()
+}
+
+// ObserveDNSResponseLatency adds the latency of a DNS response to the
+// histogram of the queried name.
+func ObserveDNSResponseLatency(qname string, latency time.Duration) {
+	dnsResponseLatency.WithLabelValues(qname).Observe(latency.Seconds())
+}
+
+// DeleteDNSMetrics removes the DNS metrics of a queried name, with the
+// types and response codes it was counted with.
+func DeleteDNSMetrics(qname string, qtypes, rcodes []string) {
+	for _, qtype := range qtypes {
+		dnsQueries.DeleteLabelValues(qname, qtype)
+	}
+	for _, rcode := range rcodes {
+		dnsResponses.DeleteLabelValues(qname, rcode)
+	}
+	dnsTimeouts.DeleteLabelValues(qname)
+	dnsResponseLatency.DeleteLabelValues(qname)
+}
+
+// IncQuarantinedStats counts a stats entry which was not accounted.
+// The reason is one of "overflow", "implausible", "inconsistent" or
+// "malformed".
+func IncQuarantinedStats(reason string) {
+	quarantinedStats.WithLabelValues(reason).Inc()
+}
+
+// SetCarryOverEntries sets the size of the failed-second carry-over
+// state.
+func SetCarryOverEntries(n int) {
+	carryOverEntries.Set(float64(n))
+}
+
+// IncTraceroutes counts a traceroute triggered by a failure. The
+// result is one of "completed", "failed" or "rate_limited".
+func IncTraceroutes(result string) {
+	traceroutes.WithLabelValues(result).Inc()
+}
+
+// SetDestinationTTLs replaces the typical TTLs of the destinations.
+func SetDestinationTTLs(ttls map[string]uint8) {
+	destinationTTL.Reset()
+	for destIP, ttl := range ttls {
+		destinationTTL.WithLabelValues(destIP).Set(float64(ttl))
+	}
+}
+
+// AddInterfacePackets increases the number of packets seen on the
+// network interface. The result is "seen" for all packets or
+// "matched" for those matching the CIDRs and ports.
+func AddInterfacePackets(iface, result string, n float64) {
+	interfacePackets.WithLabelValues(iface, result).Add(n)
+}
+
+// AddInterfaceBytes increases the number of bytes seen on the network
+// interface.
+func AddInterfaceBytes(iface string, n float64) {
+	interfaceBytes.WithLabelValues(iface).Add(n)
+}
+
+// AddTTLAnomalies increases the number of packets from the
+// destination with an unexpected TTL.
+func AddTTLAnomalies(destIP string, n float64) {
+	ttlAnomalies.WithLabelValues(destIP).Add(n)
+}
+
+// AddSuspectedInterceptions increases the number of connections of the
+// SNI with a signature of interception. The signature is either
+// "split_handshake" or "client_hello_after_rst".
+func AddSuspectedInterceptions(sni, signature string, n float64) {
+	suspectedInterceptions.WithLabelValues(sni, signature).Add(n)
+}
+
+// resumedLabel is set to tell the resumed TLS handshakes apart by the
+// resumed label, see EnableResumedLabel.
+var resumedLabel = false
+
+// EnableResumedLabel sets the resumed label of the TLS handshakes to
+// "true" for the resumed TLS 1.3 sessions and to "false" for the full
+// handshakes. Without it, the label is empty, which Prometheus drops,
+// so the series stay the same. It must be called before Apply.
+func EnableResumedLabel() {
+	resumedLabel = true
+}
+
+func resumedLabelValue(resumed bool) string {
+	if !resumedLabel {
+		return ""
+	}
+	return strconv.FormatBool(resumed)
+}
+
+// AddTLSHandshakes increases the number of TLS handshakes of the SNI
+// with the negotiated version and cipher suite, e.g. "TLS 1.2" and
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func AddTLSHandshakes(sni, version, cipherSuite string, resumed bool, n float64) {
+	tlsVersions.WithLabelValues(sni, version, resumedLabelValue(resumed)).Add(n)
+	tlsCipherSuites.WithLabelValues(sni, cipherSuite, resumedLabelValue(resumed)).Add(n)
+}
+
+// AddTLSEarlyData increases the number of TLS handshakes of the SNI
+// whose ClientHello offered 0-RTT early data.
+func AddTLSEarlyData(sni string, resumed bool, n float64) {
+	tlsEarlyData.WithLabelValues(sni, resumedLabelValue(resumed)).Add(n)
+}
+
+// AddMPTCPSubflows increases the number of subflows joining the MPTCP
+// connections of the SNI. The result is "joined" for the subflows
+// accepted by the server or "failed" for those of them closed by the
+// server or the network.
+func AddMPTCPSubflows(sni, result string, n float64) {
+	mptcpSubflows.WithLabelValues(sni, result).Add(n)
+}
+
+// AddPartialMatches increases the number of connection attempts which
+// matched only one filter dimension, "cidr" or "port". The IP and the
+// port of the server are empty unless the partial matches are observed.
+func AddPartialMatches(match, ip, port string, n float64) {
+	partialMatches.WithLabelValues(match, ip, port).Add(n)
+}
+
+// AddTLSAlerts increases the number of fatal TLS alerts of the SNI
+// sent during the handshake, e.g. "unknown_ca", by the sender, either
+// "client" or "server".
+func AddTLSAlerts(sni, alert, sender string, n float64) {
+	tlsAlerts.WithLabelValues(sni, alert, sender).Add(n)
+}
+
+// DeleteRTT removes the RTT histogram of an SNI without samples.
+func DeleteRTT(sni string) {
+	rtt.Delete(sni)
+}
+
+// AddDegradedSeconds increases the seconds of the SNI, source and
+// destination with a throughput below the expected minimum.
+func AddDegradedSeconds(sni, sourceIP, destIP string, seconds float64) {
+	degradedSeconds.WithLabelValues(sni, sourceIP, destIP).Add(seconds)
+}
+
+// DeleteDegradedSeconds deletes the degraded seconds of the SNI,
+// source and destination.
+func DeleteDegradedSeconds(sni, sourceIP, destIP string) {
+	degradedSeconds.DeleteLabelValues(sni, sourceIP, destIP)
+}
+
+// IncServiceBackendFailures increases the failed connections of the
+// SNI to the Service IP which were translated to the backend IP.
+func IncServiceBackendFailures(sni, serviceIP, backendIP string) {
+	serviceBackendFailures.WithLabelValues(sni, serviceIP, backendIP).Inc()
+}
+
+// DeleteServiceBackendFailures deletes the failed connections of the
+// SNI to the backend of the Service IP.
+func DeleteServiceBackendFailures(sni, serviceIP, backendIP string) {
+	serviceBackendFailures.DeleteLabelValues(sni, serviceIP, backendIP)
+}
+
+// RSTOrigins are the values of the rst_origin label, the origins of a
+// reset by their number in the kernel.
+var RSTOrigins = []string{
+	"server",
+	"client",
+	"middlebox",
+}
+
+// ICMPUnreachableCodes are the values of the icmp_code label, the names
+// of the codes of an ICMP destination unreachable by their number.
+var ICMPUnreachableCodes = []string{
+	"net_unreachable",
+	"host_unreachable",
+	"protocol_unreachable",
+	"port_unreachable",
+	"fragmentation_needed",
+	"source_route_failed",
+	"net_unknown",
+	"host_unknown",
+	"host_isolated",
+	"net_prohibited",
+	"host_prohibited",
+	"net_unreachable_for_tos",
+	"host_unreachable_for_tos",
+	"admin_prohibited",
+	"host_precedence_violation",
+	"precedence_cutoff",
+}
+
+// ALPNProtocols are the values of the protocol label of the ALPN
+// metrics. A protocol is "none" without an ALPN extension, and the
+// selection of TLS 1.3 is "encrypted".
+var ALPNProtocols = []string{"h2", "http/1.1", "h3", "other", "none", "encrypted"}
+
+// AddALPN increases the number of ClientHellos of the SNI offering the
+// protocol if selected is not set, else of ServerHellos selecting it.
+func AddALPN(sni, protocol string, selected bool, n float64) {
+	if selected {
+		alpnSelected.WithLabelValues(sni, protocol).Add(n)
+		return
+	}
+	alpnOffered.WithLabelValues(sni, protocol).Add(n)
+}
+
+// AddNamespaceConnections increases the number of successful and
+// failed connections to the SNI from the clients of the namespace.
+func AddNamespaceConnections(sni, ns string, successful, failed float64) {
+	namespaceConnections.WithLabelValues("successful", sni, ns).Add(successful)
+	namespaceConnections.WithLabelValues("failed", sni, ns).Add(failed)
+}
+
+// DeleteNamespaceConnections deletes the connections to the SNI from
+// the clients of the namespace.
+func DeleteNamespaceConnections(sni, ns string) {
+	namespaceConnections.DeleteLabelValues("successful", sni, ns)
+	namespaceConnections.DeleteLabelValues("failed", sni, ns)
+}
+
+// SetNamespaceShare sets the share of the namespace in the connections
+// to the SNI. The kind is either "successful" or "failed".
+func SetNamespaceShare(kind, sni, ns string, share float64) {
+	namespaceShare.WithLabelValues(kind, sni, ns).Set(share)
+}
+
+// DeleteNamespaceShare deletes the share of the namespace in the
+// connections to the SNI.
+func DeleteNamespaceShare(kind, sni, ns string) {
+	namespaceShare.DeleteLabelValues(kind, sni, ns)
+}
+
+// AddMapReadDuplicates increases the number of entries of the map seen
+// twice while reading it.
+func AddMapReadDuplicates(name string, n float64) {
+	mapReadDuplicates.WithLabelValues(name).Add(n)
+}
+
+// AddLateStatsWrites increases the number of writes to sealed slots
+// of the stats map.
+func AddLateStatsWrites(n float64) {
+	lateStatsWrites.Add(n)
+}
+
+// IncClientHelloReassemblies counts a ClientHello split over several
+// segments. The result is one of "reassembled", "no_sni",
+// "out_of_order", "expired" or "dropped".
+func IncClientHelloReassemblies(result string) {
+	clientHelloReassemblies.WithLabelValues(result).Inc()
+}
+
+// AddMergedIncs increases the number of increments merged into an
+// increment with the same labels.
+func AddMergedIncs(n float64) {
+	mergedIncs.Add(n)
+}
+
+// AddSNITruncations increases the number of SNIs truncated by the eBPF
+// program.
+func AddSNITruncations(n float64) {
+	sniTruncations.Add(n)
+}
+
+// IncUnknownSNIConnections counts a connection whose SNI could not be
+// extracted.
+func IncUnknownSNIConnections(destIP, destPort, state string) {
+	unknownSNIConnections.WithLabelValues(destIP, destPort, state).Inc()
+}
+
+// SetBPFProgramInstructions sets the number of instructions of a
+// loaded eBPF program.
+func SetBPFProgramInstructions(program string, n int) {
+	bpfProgramInstructions.WithLabelValues(program).Set(float64(n))
+}
+
+// SetResolution sets the width of the accounting windows and the
+// number of slots of the stats map.
+func SetResolution(window time.Duration, slots int) {
+	resolution.Set(window.Seconds())
+	statsSlots.Set(float64(slots))
+}
+
+// IncSFlowDatagrams counts a datagram sent to the sFlow collector. The
+// result is either "sent" or "failed".
+func IncSFlowDatagrams(result string) {
+	sflowDatagrams.WithLabelValues(result).Inc()
+}
+
+// IncSinkItems counts an item of a push sink. The result is
+// "delivered", "failed" or "dropped".
+func IncSinkItems(sink, result string) {
+	sinkItems.WithLabelValues(sink, result).Inc()
+}
+
+// SetSinkQueueLength exports the number of items queued for a push
+// sink.
+func SetSinkQueueLength(sink string, n int) {
+	sinkQueueLength.WithLabelValues(sink).Set(float64(n))
+}
+
+// SetBPFSetupError exports the kind of the last failure to load or
+// attach the eBPF program.
+func SetBPFSetupError(kind, program string) {
+	bpfSetupError.Reset()
+	bpfSetupError.WithLabelValues(kind, program).Set(1)
+}
+
+// ClearBPFSetupError clears the failure after the eBPF program was
+// loaded and attached.
+func ClearBPFSetupError() {
+	bpfSetupError.Reset()
+}
+
+// IncQuarantinedWindows counts a window whose accounting panicked.
+func IncQuarantinedWindows() {
+	quarantinedWindows.Inc()
 }
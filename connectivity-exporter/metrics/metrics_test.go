@@ -1,23 +1,39 @@
 package metrics
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/promextra"
 )
 
 func TestSNI(t *testing.T) {
 	defer resetMetrics()
 	sni := "test.sni"
 	inc := &Inc{
-		ActiveSeconds:               1,
-		FailedSeconds:               1,
-		ActiveFailedSeconds:         1,
-		SuccessfulConnections:       2,
-		RejectedConnections:         5,
-		RejectedConnectionsByClient: 1,
-		SNI:                         sni,
+		ActiveSeconds:                  1,
+		FailedSeconds:                  1,
+		ActiveFailedSeconds:            1,
+		SilencedSeconds:                3,
+		ExpectedIdleSeconds:            4,
+		SuccessfulConnections:          2,
+		RejectedConnections:            5,
+		RejectedConnectionsByClient:    1,
+		RejectedConnectionsByMiddlebox: 6,
+		ECNRequested:                   7,
+		ECNAccepted:                    8,
+		CongestionExperiencedPackets:   9,
+		ECEPackets:                     10,
+		CWRPackets:                     11,
+		SNI:                            sni,
+		SourceIP:                       "10.0.0.1",
+		DestIP:                         "10.0.0.2",
 	}
 
 	inc.apply()
@@ -28,9 +44,11 @@ func TestSNI(t *testing.T) {
 	`
 
 	secondsExpected := `
-		connectivity_exporter_seconds_total{kind="active",sni="test.sni"} 1
-		connectivity_exporter_seconds_total{kind="active_failed",sni="test.sni"} 1
-		connectivity_exporter_seconds_total{kind="failed",sni="test.sni"} 1
+		connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="active",sni="test.sni",source_ip="10.0.0.1"} 1
+		connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="active_failed",sni="test.sni",source_ip="10.0.0.1"} 1
+		connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="expected_idle",sni="test.sni",source_ip="10.0.0.1"} 4
+		connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="failed",sni="test.sni",source_ip="10.0.0.1"} 1
+		connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="silenced",sni="test.sni",source_ip="10.0.0.1"} 3
 	`
 
 	if err := testutil.CollectAndCompare(seconds, strings.NewReader(secondsMetadata+secondsExpected)); err != nil {
@@ -43,17 +61,321 @@ func TestSNI(t *testing.T) {
 	`
 
 	connectionsExpected := `
-		connectivity_exporter_connections_total{kind="rejected",sni="test.sni"} 5
-		connectivity_exporter_connections_total{kind="rejected_by_client",sni="test.sni"} 1
-		connectivity_exporter_connections_total{kind="successful",sni="test.sni"} 2
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected",sni="test.sni",source_ip="10.0.0.1"} 5
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_client",sni="test.sni",source_ip="10.0.0.1"} 1
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_middlebox",sni="test.sni",source_ip="10.0.0.1"} 6
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_network",sni="test.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="successful",sni="test.sni",source_ip="10.0.0.1"} 2
 	`
 
 	if err := testutil.CollectAndCompare(connections, strings.NewReader(connectionsMetadata+connectionsExpected)); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
+
+	const congestionSignalsMetadata = `
+		# HELP connectivity_exporter_congestion_signals_total Total number of packets with congestion signals.
+		# TYPE connectivity_exporter_congestion_signals_total counter
+	`
+
+	congestionSignalsExpected := `
+		connectivity_exporter_congestion_signals_total{dest_ip="10.0.0.2",kind="ce",sni="test.sni",source_ip="10.0.0.1"} 9
+		connectivity_exporter_congestion_signals_total{dest_ip="10.0.0.2",kind="cwr",sni="test.sni",source_ip="10.0.0.1"} 11
+		connectivity_exporter_congestion_signals_total{dest_ip="10.0.0.2",kind="ece",sni="test.sni",source_ip="10.0.0.1"} 10
+	`
+
+	if err := testutil.CollectAndCompare(congestionSignals, strings.NewReader(congestionSignalsMetadata+congestionSignalsExpected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+
+	const ecnNegotiationsMetadata = `
+		# HELP connectivity_exporter_ecn_negotiations_total Total number of connections requesting and accepting ECN.
+		# TYPE connectivity_exporter_ecn_negotiations_total counter
+	`
+
+	ecnNegotiationsExpected := `
+		connectivity_exporter_ecn_negotiations_total{dest_ip="10.0.0.2",kind="accepted",sni="test.sni",source_ip="10.0.0.1"} 8
+		connectivity_exporter_ecn_negotiations_total{dest_ip="10.0.0.2",kind="requested",sni="test.sni",source_ip="10.0.0.1"} 7
+	`
+
+	if err := testutil.CollectAndCompare(ecnNegotiations, strings.NewReader(ecnNegotiationsMetadata+ecnNegotiationsExpected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestHandshakeDuration(t *testing.T) {
+	defer resetMetrics()
+	(&Inc{SNI: "test.sni", HandshakeDurations: []time.Duration{3 * time.Millisecond, 20 * time.Millisecond}}).apply()
+	(&Inc{SNI: "test.sni", SourceIP: "10.0.0.2", HandshakeDurations: []time.Duration{time.Second}}).apply()
+
+	expected := `
+		# HELP connectivity_exporter_handshake_duration_seconds Duration of the TLS handshakes per SNI, from the SYN to the ServerHello.
+		# TYPE connectivity_exporter_handshake_duration_seconds histogram
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.001"} 0
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.002"} 0
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.004"} 1
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.008"} 1
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.016"} 1
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.032"} 2
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.064"} 2
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.128"} 2
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.256"} 2
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="0.512"} 2
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="1.024"} 3
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="2.048"} 3
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="4.096"} 3
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="8.192"} 3
+		connectivity_exporter_handshake_duration_seconds_bucket{sni="test.sni",le="+Inf"} 3
+		connectivity_exporter_handshake_duration_seconds_sum{sni="test.sni"} 1.023
+		connectivity_exporter_handshake_duration_seconds_count{sni="test.sni"} 3
+	`
+	if err := testutil.CollectAndCompare(handshakeDuration, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	DeleteMetrics("test.sni")
+	if n := testutil.CollectAndCount(handshakeDuration); n != 0 {
+		t.Errorf("The histogram of the SNI should be deleted, got %d series", n)
+	}
+}
+
+func TestDeleteMetrics(t *testing.T) {
+	defer resetMetrics()
+	for _, sourceIP := range []string{"10.0.0.1", "10.0.0.2"} {
+		inc := &Inc{SNI: "test.sni", SourceIP: sourceIP, DestIP: "10.0.1.1", SuccessfulConnections: 1, ECNRequested: 1}
+		inc.AddRSTOrigin("server", 1)
+		inc.apply()
+	}
+	(&Inc{SNI: "other.sni", SourceIP: "10.0.0.1", DestIP: "10.0.1.2", SuccessfulConnections: 1}).apply()
+
+	// The series of all the sources and destinations of the SNI are
+	// deleted, not only those without them.
+	DeleteMetrics("test.sni")
+	if n := testutil.CollectAndCount(resets); n != 0 {
+		t.Errorf("The resets of the SNI should be deleted, got %d series", n)
+	}
+	// Only the series of the other SNI are left.
+	if n := testutil.CollectAndCount(seconds); n != 5 {
+		t.Errorf("Got %d series of seconds, want 5", n)
+	}
+	if n := testutil.CollectAndCount(ecnNegotiations); n != 2 {
+		t.Errorf("Got %d series of ECN negotiations, want 2", n)
+	}
+	expected := `
+		# HELP connectivity_exporter_connections_total Total number of new connections.
+		# TYPE connectivity_exporter_connections_total counter
+		connectivity_exporter_connections_total{dest_ip="10.0.1.2",kind="rejected",sni="other.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.1.2",kind="rejected_by_client",sni="other.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.1.2",kind="rejected_by_middlebox",sni="other.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.1.2",kind="rejected_by_network",sni="other.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.1.2",kind="successful",sni="other.sni",source_ip="10.0.0.1"} 1
+	`
+	if err := testutil.CollectAndCompare(connections, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestNetworkRejections(t *testing.T) {
+	defer resetMetrics()
+	inc := &Inc{SNI: "test.sni", SourceIP: "10.0.0.1", DestIP: "10.0.0.2"}
+	inc.AddICMPCode("admin_prohibited", 1)
+	other := &Inc{}
+	other.AddICMPCode("admin_prohibited", 2)
+	other.AddICMPCode("host_unreachable", 1)
+	inc.Merge(other)
+	inc.apply()
+
+	expected := `
+		# HELP connectivity_exporter_network_rejections_total Total number of connections whose SYN got an ICMP destination unreachable back, by the ICMP code.
+		# TYPE connectivity_exporter_network_rejections_total counter
+		connectivity_exporter_network_rejections_total{dest_ip="10.0.0.2",icmp_code="admin_prohibited",sni="test.sni",source_ip="10.0.0.1"} 3
+		connectivity_exporter_network_rejections_total{dest_ip="10.0.0.2",icmp_code="host_unreachable",sni="test.sni",source_ip="10.0.0.1"} 1
+	`
+	if err := testutil.CollectAndCompare(networkRejections, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	connectionsExpected := `
+		# HELP connectivity_exporter_connections_total Total number of new connections.
+		# TYPE connectivity_exporter_connections_total counter
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected",sni="test.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_client",sni="test.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_middlebox",sni="test.sni",source_ip="10.0.0.1"} 0
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="rejected_by_network",sni="test.sni",source_ip="10.0.0.1"} 4
+		connectivity_exporter_connections_total{dest_ip="10.0.0.2",kind="successful",sni="test.sni",source_ip="10.0.0.1"} 0
+	`
+	if err := testutil.CollectAndCompare(connections, strings.NewReader(connectionsExpected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestResets(t *testing.T) {
+	defer resetMetrics()
+	inc := &Inc{SNI: "test.sni", SourceIP: "10.0.0.1", DestIP: "10.0.0.2", RejectedConnectionsByMiddlebox: 1}
+	inc.AddRSTOrigin("middlebox", 1)
+	other := &Inc{}
+	other.AddRSTOrigin("server", 2)
+	inc.Merge(other)
+	inc.apply()
+
+	expected := `
+		# HELP connectivity_exporter_resets_total Total number of connections closed by a reset, by the origin of the reset.
+		# TYPE connectivity_exporter_resets_total counter
+		connectivity_exporter_resets_total{dest_ip="10.0.0.2",rst_origin="middlebox",sni="test.sni",source_ip="10.0.0.1"} 1
+		connectivity_exporter_resets_total{dest_ip="10.0.0.2",rst_origin="server",sni="test.sni",source_ip="10.0.0.1"} 2
+	`
+	if err := testutil.CollectAndCompare(resets, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestDisableKeySeries(t *testing.T) {
+	defer resetMetrics()
+	DisableKeySeries()
+	defer func() { keySeries = true }()
+	(&Inc{SNI: "test.sni", ActiveSeconds: 1, SuccessfulConnections: 1, HandshakeDurations: []time.Duration{time.Millisecond}}).apply()
+	if n := testutil.CollectAndCount(seconds) + testutil.CollectAndCount(connections); n != 0 {
+		t.Errorf("The seconds and connections per key should not be exported, got %d series", n)
+	}
+	if n := testutil.CollectAndCount(handshakeDuration); n != 1 {
+		t.Errorf("The other metrics should still be exported, got %d series", n)
+	}
+}
+
+func TestEnableResumedLabel(t *testing.T) {
+	defer tlsVersions.Reset()
+	AddTLSHandshakes("test.sni", "TLS 1.3", "TLS_AES_128_GCM_SHA256", true, 1)
+	EnableResumedLabel()
+	defer func() { resumedLabel = false }()
+	AddTLSHandshakes("test.sni", "TLS 1.3", "TLS_AES_128_GCM_SHA256", true, 2)
+	AddTLSHandshakes("test.sni", "TLS 1.3", "TLS_AES_128_GCM_SHA256", false, 3)
+
+	// The empty label of the handshakes before is dropped by Prometheus.
+	expected := `
+		# HELP connectivity_exporter_tls_version_total Total number of TLS handshakes by the version negotiated with the ServerHello.
+		# TYPE connectivity_exporter_tls_version_total counter
+		connectivity_exporter_tls_version_total{resumed="",sni="test.sni",version="TLS 1.3"} 1
+		connectivity_exporter_tls_version_total{resumed="false",sni="test.sni",version="TLS 1.3"} 3
+		connectivity_exporter_tls_version_total{resumed="true",sni="test.sni",version="TLS 1.3"} 2
+	`
+	if err := testutil.CollectAndCompare(tlsVersions, strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRTTSnapshots(t *testing.T) {
+	defer rtt.Delete("test.sni")
+	snapshot := promextra.NewSnapshot(32)
+	snapshot.Name, snapshot.LabelValues = RTTSnapshot, []string{"test.sni"}
+	snapshot.Total = 3000000
+	// A millisecond is in the bucket up to 2^20 nanoseconds.
+	snapshot.Buckets[19] = 3
+	applySnapshot(snapshot)
+	// The execution time is not affected.
+	applySnapshot(promextra.NewSnapshot(32))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(rtt)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("got %v, want one histogram", families)
+	}
+	h := families[0].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 3 || h.GetSampleSum() != 0.003 {
+		t.Errorf("got %d samples with a sum of %v, want 3 with 0.003", h.GetSampleCount(), h.GetSampleSum())
+	}
+	if le := h.GetBucket()[19]; le.GetCumulativeCount() != 3 || le.GetUpperBound() != 0.001048576 {
+		t.Errorf("got %v, want the samples below 0.001048576", le)
+	}
+	DeleteRTT("test.sni")
+	if n := testutil.CollectAndCount(rtt); n != 0 {
+		t.Errorf("The histogram of the SNI should be deleted, got %d series", n)
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	s := NewSecondary("test_discovery")
+	s.Add([]*Inc{{SNI: "test.sni", ActiveSeconds: 1, FailedSeconds: 1, SuccessfulConnections: 2}})
+	s.Add([]*Inc{{SNI: "test.sni", ActiveSeconds: 1, RejectedConnections: 1}})
+	if got := testutil.ToFloat64(s.seconds.WithLabelValues("active", "test.sni")); got != 2 {
+		t.Errorf("got %v active seconds, want 2", got)
+	}
+	if got := testutil.ToFloat64(s.connections.WithLabelValues("rejected", "test.sni")); got != 1 {
+		t.Errorf("got %v rejected connections, want 1", got)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(s)
+	// The primary metrics are not affected.
+	registry.MustRegister(seconds)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	if want := "test_discovery_connections_total test_discovery_seconds_total"; strings.Join(names, " ") != want {
+		t.Errorf("got the families %v, want %s", names, want)
+	}
+	s.Delete("test.sni")
+	if n := testutil.CollectAndCount(s); n != 0 {
+		t.Errorf("The series of the SNI should be deleted, got %d series", n)
+	}
+}
+
+func TestHandlerCollect(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	for _, name := range []string{"seconds_total", "connections_total", "handshake_duration_seconds"} {
+		c := prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: name})
+		c.Inc()
+		registry.MustRegister(c)
+	}
+	handler := handlerFor(http.NotFoundHandler(), registry)
+	scrape := func(query string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics"+query, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  []string
+	}{
+		{"", http.StatusNotFound, nil},
+		{"?collect[]=seconds_total", http.StatusOK, []string{"connectivity_exporter_seconds_total"}},
+		{"?collect[]=connectivity_exporter_seconds_total&collect[]=handshake_*", http.StatusOK, []string{"connectivity_exporter_handshake_duration_seconds", "connectivity_exporter_seconds_total"}},
+		{"?collect[]=*_total", http.StatusOK, []string{"connectivity_exporter_connections_total", "connectivity_exporter_seconds_total"}},
+		{"?collect[]=unknown", http.StatusOK, nil},
+		{"?collect[]=[", http.StatusBadRequest, nil},
+	} {
+		code, body := scrape(tc.query)
+		if code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.query, code, tc.code)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		var got []string
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, "# TYPE ") {
+				got = append(got, strings.Fields(line)[2])
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got families %v, want %v", tc.query, got, tc.want)
+		}
+	}
 }
 
 func resetMetrics() {
 	seconds.Reset()
 	connections.Reset()
+	ecnNegotiations.Reset()
+	congestionSignals.Reset()
+	handshakeDuration.Reset()
+	resets.Reset()
+	endpoints = &endpointSet{bySNI: map[string]map[endpoint]struct{}{}}
 }
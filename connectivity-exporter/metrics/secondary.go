@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Secondary are the metrics of a secondary attachment, the program
+// attached a second time with a filter of its own, e.g. a broad
+// discovery filter next to the strict filter of the SLOs. They are
+// exported in a namespace of their own and only per SNI, so the
+// connections of the secondary filter add neither series nor seconds
+// to the metrics of the primary one.
+type Secondary struct {
+	seconds     *prometheus.CounterVec
+	connections *prometheus.CounterVec
+}
+
+// NewSecondary returns the metrics of a secondary attachment in the
+// namespace, e.g. "connectivity_exporter_discovery".
+func NewSecondary(namespace string) *Secondary {
+	return &Secondary{
+		seconds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "seconds_total",
+				Help:      "Total number of seconds of the secondary filter.",
+			}, []string{"kind", "sni"},
+		),
+		connections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "connections_total",
+				Help:      "Total number of new connections of the secondary filter.",
+			}, []string{"kind", "sni"},
+		),
+	}
+}
+
+// Add adds the increments of a window of the secondary attachment.
+func (s *Secondary) Add(incs []*Inc) {
+	for _, inc := range incs {
+		s.seconds.WithLabelValues("active", inc.SNI).Add(inc.ActiveSeconds)
+		s.seconds.WithLabelValues("failed", inc.SNI).Add(inc.FailedSeconds)
+		s.seconds.WithLabelValues("active_failed", inc.SNI).Add(inc.ActiveFailedSeconds)
+		s.connections.WithLabelValues("successful", inc.SNI).Add(inc.SuccessfulConnections)
+		s.connections.WithLabelValues("rejected", inc.SNI).Add(inc.RejectedConnections)
+	}
+}
+
+// Delete removes the series of an SNI which expired.
+func (s *Secondary) Delete(sni string) {
+	for _, kind := range []string{"active", "failed", "active_failed"} {
+		s.seconds.DeleteLabelValues(kind, sni)
+	}
+	for _, kind := range []string{"successful", "rejected"} {
+		s.connections.DeleteLabelValues(kind, sni)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *Secondary) Describe(ch chan<- *prometheus.Desc) {
+	s.seconds.Describe(ch)
+	s.connections.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Secondary) Collect(ch chan<- prometheus.Metric) {
+	s.seconds.Collect(ch)
+	s.connections.Collect(ch)
+}
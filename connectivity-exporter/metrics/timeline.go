@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// TimelineRetention is the time the buckets of a timeline are kept.
+const TimelineRetention = time.Hour
+
+// Timeline keeps the values of the seconds counters at the end of
+// sub-buckets of the accounted seconds. A scrape only sees the
+// increments accumulated since the previous scrape, so after a missed
+// scrape they appear as one jump. The timestamped values let a
+// consumer fill the gap with the increments at the time they were
+// accounted.
+type Timeline struct {
+	width time.Duration
+
+	mutex   sync.Mutex
+	buckets []*timelineBucket
+}
+
+type timelineBucket struct {
+	start time.Time
+	// values are the values of the counters updated in the bucket at
+	// the end of the bucket.
+	values map[timelineSeries]float64
+}
+
+type timelineSeries struct {
+	kind, sni, sourceIP, destIP string
+}
+
+// NewTimeline creates a timeline with buckets of the width.
+func NewTimeline(width time.Duration) *Timeline {
+	return &Timeline{width: width}
+}
+
+// Observe records the values of the seconds counters updated by the
+// increment. It has to observe the increments after they are applied.
+func (t *Timeline) Observe(inc *Inc) {
+	kinds := []string{"active", "failed", "active_failed", "silenced", "expected_idle"}
+	if inc.WallClockSeconds > 0 {
+		kinds = append(kinds, "wall_clock", "unknown")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	start := inc.Time.Truncate(t.width)
+	// The increments arrive in the order of the accounted seconds, a
+	// late one is recorded in the current bucket.
+	if n := len(t.buckets); n == 0 || start.After(t.buckets[n-1].start) {
+		t.buckets = append(t.buckets, &timelineBucket{start: start, values: make(map[timelineSeries]float64)})
+	}
+	current := t.buckets[len(t.buckets)-1]
+	for _, kind := range kinds {
+		m := &dto.Metric{}
+		if err := seconds.WithLabelValues(kind, inc.SNI, inc.SourceIP, inc.DestIP).Write(m); err != nil {
+			continue
+		}
+		current.values[timelineSeries{kind, inc.SNI, inc.SourceIP, inc.DestIP}] = m.GetCounter().GetValue()
+	}
+
+	oldest := start.Add(-TimelineRetention)
+	expired := 0
+	for expired < len(t.buckets) && t.buckets[expired].start.Before(oldest) {
+		expired++
+	}
+	t.buckets = t.buckets[expired:]
+}
+
+// WriteSince writes the values at the end of the complete buckets
+// ending after since in the text format, with the end of the bucket
+// as timestamp. The bucket of the latest increment is not complete
+// yet.
+func (t *Timeline) WriteSince(w io.Writer, since time.Time) error {
+	name, help := namespace+"_seconds_total", "Total number of seconds."
+	family := &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_COUNTER.Enum()}
+
+	t.mutex.Lock()
+	for i := 0; i < len(t.buckets)-1; i++ {
+		b := t.buckets[i]
+		end := b.start.Add(t.width)
+		if !end.After(since) {
+			continue
+		}
+		series := make([]timelineSeries, 0, len(b.values))
+		for s := range b.values {
+			series = append(series, s)
+		}
+		sort.Slice(series, func(i, j int) bool {
+			a, b := series[i], series[j]
+			if a.sni != b.sni {
+				return a.sni < b.sni
+			}
+			if a.sourceIP != b.sourceIP {
+				return a.sourceIP < b.sourceIP
+			}
+			if a.destIP != b.destIP {
+				return a.destIP < b.destIP
+			}
+			return a.kind < b.kind
+		})
+		timestamp := end.UnixNano() / int64(time.Millisecond)
+		for _, s := range series {
+			value := b.values[s]
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label:       timelineLabels(s),
+				Counter:     &dto.Counter{Value: &value},
+				TimestampMs: &timestamp,
+			})
+		}
+	}
+	t.mutex.Unlock()
+
+	if len(family.Metric) == 0 {
+		return nil
+	}
+	if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+		return fmt.Errorf("writing timeline: %w", err)
+	}
+	return nil
+}
+
+func timelineLabels(s timelineSeries) []*dto.LabelPair {
+	names := []string{"dest_ip", "kind", "sni", "source_ip"}
+	values := []string{s.destIP, s.kind, s.sni, s.sourceIP}
+	labels := make([]*dto.LabelPair, len(names))
+	for i := range names {
+		labels[i] = &dto.LabelPair{Name: &names[i], Value: &values[i]}
+	}
+	return labels
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	defer resetMetrics()
+	timeline := NewTimeline(10 * time.Second)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	observe := func(offset time.Duration, active float64) {
+		inc := &Inc{ActiveSeconds: active, SNI: "test.sni", SourceIP: "10.0.0.1", DestIP: "10.0.0.2", Time: start.Add(offset)}
+		inc.apply()
+		timeline.Observe(inc)
+	}
+	// The increments of a missed scrape are spread over the buckets.
+	observe(0, 1)
+	observe(5*time.Second, 1)
+	observe(10*time.Second, 1)
+	observe(20*time.Second, 1)
+
+	var out bytes.Buffer
+	if err := timeline.WriteSince(&out, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="active",sni="test.sni",source_ip="10.0.0.1"} 2 1651399210000`,
+		`connectivity_exporter_seconds_total{dest_ip="10.0.0.2",kind="active",sni="test.sni",source_ip="10.0.0.1"} 3 1651399220000`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Missing %s in:\n%s", want, out.String())
+		}
+	}
+	// The last bucket is not complete yet.
+	if strings.Contains(out.String(), "} 4 ") {
+		t.Errorf("The incomplete bucket should be left out:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := timeline.WriteSince(&out, start.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "} 2 ") || !strings.Contains(out.String(), "} 3 ") {
+		t.Errorf("Only the bucket ending after since should be written:\n%s", out.String())
+	}
+
+	// The buckets older than the retention are removed.
+	observe(TimelineRetention+time.Minute, 1)
+	out.Reset()
+	if err := timeline.WriteSince(&out, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("The expired buckets should be removed:\n%s", out.String())
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"m/promextra"
 )
@@ -18,12 +17,169 @@ type Inc struct {
 	ActiveSeconds,
 	FailedSeconds,
 	ActiveFailedSeconds,
+	SilencedSeconds,
+	ExpectedIdleSeconds,
+	// WallClockSeconds and UnknownSeconds are only accounted for
+	// the SNIs with a wall-clock seconds policy.
+	WallClockSeconds,
+	UnknownSeconds,
+	// ServerFailedSeconds, ClientFailedSeconds and
+	// NetworkFailedSeconds are the active seconds with failures by
+	// their cause, only accounted for the SNIs with AttributeFailures.
+	ServerFailedSeconds,
+	ClientFailedSeconds,
+	NetworkFailedSeconds,
 	SuccessfulConnections,
 	RejectedConnections,
-	RejectedConnectionsByClient float64
-	SNI string
+	RejectedConnectionsByClient,
+	RejectedConnectionsByMiddlebox,
+	// RejectedConnectionsByNetwork are the connections whose SYN got
+	// an ICMP destination unreachable back.
+	RejectedConnectionsByNetwork,
+	HandshakesAbandoned,
+	HandshakesFailed,
+	EstablishedResets,
+	// HandshakeOnlyConnections are only accounted for the SNIs with
+	// DetectHandshakeOnly.
+	HandshakeOnlyConnections,
+	// CertificateRequests are the connections whose server requested
+	// a client certificate, CertificateRequestFailures those of them
+	// closed before the handshake finished.
+	CertificateRequests,
+	CertificateRequestFailures,
+	ECNRequested,
+	ECNAccepted,
+	CongestionExperiencedPackets,
+	ECEPackets,
+	CWRPackets,
+	// InferredSNIConnections are the connections without an SNI
+	// accounted for the cached SNI of their client and destination,
+	// FallbackSNIConnections the ones accounted for a CIDR group or
+	// the unknown SNI.
+	InferredSNIConnections,
+	FallbackSNIConnections float64
+	SNI      string
 	SourceIP string
-	DestIP string
+	DestIP   string
+	// Time is the approximate start of the accounted second.
+	Time time.Time
+	// DetectHandshakeOnly is set for the SNIs with DetectHandshakeOnly.
+	DetectHandshakeOnly bool
+	// AttributeFailures is set for the SNIs with AttributeFailures.
+	AttributeFailures bool
+	// ConnectLatencies and HandshakeLatencies are the latencies
+	// measured for the accounted connections, HandshakeDurations the
+	// durations of their handshakes from the SYN to the ServerHello.
+	ConnectLatencies, HandshakeLatencies []time.Duration
+	HandshakeDurations                   []time.Duration
+	// Classes are the connections per class of the registered
+	// classifiers.
+	Classes map[Class]float64
+	// Transitions are the connections per observed state transition.
+	Transitions map[string]float64
+	// ICMPCodes are the RejectedConnectionsByNetwork per ICMP code,
+	// see ICMPUnreachableCodes.
+	ICMPCodes map[string]float64
+	// RSTOrigins are the connections closed by a reset per origin of
+	// the reset, see RSTOrigins.
+	RSTOrigins map[string]float64
+}
+
+// Class is a class of connections of a classifier.
+type Class struct {
+	Classifier, Name string
+}
+
+// Merge adds the increment of another key with the same labels in the
+// same window. The seconds are of the same window, so they are not
+// added but the merged increment is e.g. active if either one is.
+func (inc *Inc) Merge(other *Inc) {
+	for _, s := range []struct{ dst, src *float64 }{
+		{&inc.ActiveSeconds, &other.ActiveSeconds},
+		{&inc.FailedSeconds, &other.FailedSeconds},
+		{&inc.ActiveFailedSeconds, &other.ActiveFailedSeconds},
+		{&inc.SilencedSeconds, &other.SilencedSeconds},
+		{&inc.ExpectedIdleSeconds, &other.ExpectedIdleSeconds},
+		{&inc.WallClockSeconds, &other.WallClockSeconds},
+		{&inc.UnknownSeconds, &other.UnknownSeconds},
+		{&inc.ServerFailedSeconds, &other.ServerFailedSeconds},
+		{&inc.ClientFailedSeconds, &other.ClientFailedSeconds},
+		{&inc.NetworkFailedSeconds, &other.NetworkFailedSeconds},
+	} {
+		if *s.src > *s.dst {
+			*s.dst = *s.src
+		}
+	}
+	inc.SuccessfulConnections += other.SuccessfulConnections
+	inc.RejectedConnections += other.RejectedConnections
+	inc.RejectedConnectionsByClient += other.RejectedConnectionsByClient
+	inc.RejectedConnectionsByMiddlebox += other.RejectedConnectionsByMiddlebox
+	inc.RejectedConnectionsByNetwork += other.RejectedConnectionsByNetwork
+	inc.HandshakesAbandoned += other.HandshakesAbandoned
+	inc.HandshakesFailed += other.HandshakesFailed
+	inc.EstablishedResets += other.EstablishedResets
+	inc.HandshakeOnlyConnections += other.HandshakeOnlyConnections
+	inc.CertificateRequests += other.CertificateRequests
+	inc.CertificateRequestFailures += other.CertificateRequestFailures
+	inc.ECNRequested += other.ECNRequested
+	inc.ECNAccepted += other.ECNAccepted
+	inc.CongestionExperiencedPackets += other.CongestionExperiencedPackets
+	inc.ECEPackets += other.ECEPackets
+	inc.CWRPackets += other.CWRPackets
+	inc.InferredSNIConnections += other.InferredSNIConnections
+	inc.FallbackSNIConnections += other.FallbackSNIConnections
+	inc.DetectHandshakeOnly = inc.DetectHandshakeOnly || other.DetectHandshakeOnly
+	inc.AttributeFailures = inc.AttributeFailures || other.AttributeFailures
+	inc.ConnectLatencies = append(inc.ConnectLatencies, other.ConnectLatencies...)
+	inc.HandshakeLatencies = append(inc.HandshakeLatencies, other.HandshakeLatencies...)
+	inc.HandshakeDurations = append(inc.HandshakeDurations, other.HandshakeDurations...)
+	for class, n := range other.Classes {
+		if inc.Classes == nil {
+			inc.Classes = make(map[Class]float64)
+		}
+		inc.Classes[class] += n
+	}
+	for transition, n := range other.Transitions {
+		inc.AddTransitions(transition, n)
+	}
+	for code, n := range other.ICMPCodes {
+		if inc.ICMPCodes == nil {
+			inc.ICMPCodes = make(map[string]float64)
+		}
+		inc.ICMPCodes[code] += n
+	}
+	for origin, n := range other.RSTOrigins {
+		inc.AddRSTOrigin(origin, n)
+	}
+}
+
+// AddICMPCode adds connections rejected by the network with the ICMP
+// code, one of ICMPUnreachableCodes.
+func (inc *Inc) AddICMPCode(code string, n float64) {
+	if inc.ICMPCodes == nil {
+		inc.ICMPCodes = make(map[string]float64)
+	}
+	inc.ICMPCodes[code] += n
+	inc.RejectedConnectionsByNetwork += n
+}
+
+// AddRSTOrigin adds connections closed by a reset from the origin, one
+// of RSTOrigins.
+func (inc *Inc) AddRSTOrigin(origin string, n float64) {
+	if inc.RSTOrigins == nil {
+		inc.RSTOrigins = make(map[string]float64)
+	}
+	inc.RSTOrigins[origin] += n
+}
+
+// AddTransitions adds connections with the state transition, one of
+// "syn", "synack", "sni", "rst_client", "rst_server", "fin" or
+// "expired".
+func (inc *Inc) AddTransitions(transition string, n float64) {
+	if inc.Transitions == nil {
+		inc.Transitions = make(map[string]float64)
+	}
+	inc.Transitions[transition] += n
 }
 
 const (
@@ -32,7 +188,7 @@ const (
 )
 
 var (
-	seconds = promauto.NewCounterVec(
+	seconds = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "seconds_total",
@@ -40,7 +196,7 @@ var (
 		}, []string{"kind", "sni", "source_ip", "dest_ip"},
 	)
 
-	connections = promauto.NewCounterVec(
+	connections = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "connections_total",
@@ -48,7 +204,588 @@ var (
 		}, []string{"kind", "sni", "source_ip", "dest_ip"},
 	)
 
-	// Use promextra.NewPrecomputedHistogramAuto to register the metric
+	handshakesAbandoned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handshake_abandoned_total",
+			Help:      "Total number of connections with a ClientHello which never received a ServerHello.",
+		}, []string{"sni", "source_ip", "dest_ip"},
+	)
+
+	connectionFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connection_failures_total",
+			Help:      "Total number of connections which failed after the ServerHello, by the phase of the connection.",
+		}, []string{"phase", "sni", "source_ip", "dest_ip"},
+	)
+
+	networkRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "network_rejections_total",
+			Help:      "Total number of connections whose SYN got an ICMP destination unreachable back, by the ICMP code.",
+		}, []string{"icmp_code", "sni", "source_ip", "dest_ip"},
+	)
+
+	resets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "resets_total",
+			Help:      "Total number of connections closed by a reset, by the origin of the reset.",
+		}, []string{"rst_origin", "sni", "source_ip", "dest_ip"},
+	)
+
+	degradedSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "degraded_seconds_total",
+			Help:      "Total number of seconds with a throughput below the minimum expected for the SNI.",
+		}, []string{"sni", "source_ip", "dest_ip"},
+	)
+
+	serviceBackendFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "service_backend_failures_total",
+			Help:      "Total number of failed connections to a Service IP per backend chosen by kube-proxy.",
+		}, []string{"sni", "service_ip", "backend_ip"},
+	)
+
+	certificateRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificate_requests_total",
+			Help:      "Total number of TLS 1.2 connections whose server requested a client certificate.",
+		}, []string{"sni", "source_ip", "dest_ip"},
+	)
+
+	certificateRequestFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificate_request_failures_total",
+			Help:      "Total number of TLS 1.2 connections closed in the handshake after the server requested a client certificate.",
+		}, []string{"sni", "source_ip", "dest_ip"},
+	)
+
+	sniAttributions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sni_attribution_connections_total",
+			Help:      "Total number of connections without an SNI, by how they were attributed: inferred from the SNI cache, or a fallback.",
+		}, []string{"attribution", "sni", "source_ip", "dest_ip"},
+	)
+
+	classifiedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_classified_total",
+			Help:      "Total number of connections per class of the registered classifiers.",
+		}, []string{"classifier", "class", "sni", "source_ip", "dest_ip"},
+	)
+
+	failedSecondsByCause = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failed_seconds_by_cause_total",
+			Help:      "Total number of active seconds with failed connections by the cause of the failures.",
+		}, []string{"cause", "sni", "source_ip", "dest_ip"},
+	)
+
+	stateTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "state_transitions_total",
+			Help:      "Total number of connections per observed state transition, for custom availability definitions.",
+		}, []string{"transition", "sni"},
+	)
+
+	handshakeOnlyConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handshake_only_connections_total",
+			Help:      "Total number of connections with a successful TLS handshake, but without application data from the client.",
+		}, []string{"sni", "source_ip", "dest_ip"},
+	)
+
+	ecnNegotiations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ecn_negotiations_total",
+			Help:      "Total number of connections requesting and accepting ECN.",
+		}, []string{"kind", "sni", "source_ip", "dest_ip"},
+	)
+
+	congestionSignals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "congestion_signals_total",
+			Help:      "Total number of packets with congestion signals.",
+		}, []string{"kind", "sni", "source_ip", "dest_ip"},
+	)
+
+	destinationSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "destination_seconds_total",
+			Help:      "Total number of seconds per destination, a second counts once for all the clients.",
+		}, []string{"kind", "sni", "dest_ip"},
+	)
+
+	destinationConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "destination_connections_total",
+			Help:      "Total number of new connections per destination.",
+		}, []string{"kind", "sni", "dest_ip"},
+	)
+
+	// destinationConnectLatency has exponential buckets, so the
+	// histograms of the destinations can be shown as a heatmap. The
+	// vendored client_golang does not support native histograms yet.
+	destinationConnectLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "destination_connect_latency_seconds",
+			Help:      "Connect latency per destination, from the SYN to the SYN-ACK.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"sni", "dest_ip"},
+	)
+
+	handshakeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of the TLS handshakes per SNI, from the SYN to the ServerHello.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"sni"},
+	)
+
+	clientSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_seconds_total",
+			Help:      "Total number of seconds per client, a second counts once for all the destinations.",
+		}, []string{"kind", "sni", "source_ip"},
+	)
+
+	clientConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_connections_total",
+			Help:      "Total number of new connections per client.",
+		}, []string{"kind", "sni", "source_ip"},
+	)
+
+	sniSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sni_seconds_total",
+			Help:      "Total number of seconds per SNI, a second counts once for all the clients and destinations.",
+		}, []string{"kind", "sni"},
+	)
+
+	sniConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sni_connections_total",
+			Help:      "Total number of new connections per SNI.",
+		}, []string{"kind", "sni"},
+	)
+
+	cidrGroupSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cidr_group_seconds_total",
+			Help:      "Total number of seconds per CIDR group of the destinations, a second counts once for all the SNIs and clients.",
+		}, []string{"kind", "cidr_group"},
+	)
+
+	cidrGroupConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cidr_group_connections_total",
+			Help:      "Total number of new connections per CIDR group of the destinations.",
+		}, []string{"kind", "cidr_group"},
+	)
+
+	canarySeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "canary_seconds_total",
+			Help:      "Total number of seconds of the current and the candidate configuration since the start of the canary.",
+		}, []string{"config", "kind", "sni"},
+	)
+
+	canaryConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "canary_connections_total",
+			Help:      "Total number of new connections of the current and the candidate configuration since the start of the canary.",
+		}, []string{"config", "kind", "sni"},
+	)
+
+	canarySecondsDelta = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "canary_seconds_delta",
+			Help:      "Seconds of the candidate minus the seconds of the current configuration since the start of the canary.",
+		}, []string{"kind", "sni"},
+	)
+
+	canaryConnectionsDelta = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "canary_connections_delta",
+			Help:      "New connections of the candidate minus the ones of the current configuration since the start of the canary.",
+		}, []string{"kind", "sni"},
+	)
+
+	backendMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_matches_total",
+			Help:      "Total number of connections seen by both the eBPF and the pcap backend.",
+		}, []string{"sni"},
+	)
+
+	backendDivergences = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_divergences_total",
+			Help:      "Total number of connections seen only by the backend.",
+		}, []string{"backend", "sni"},
+	)
+
+	destinationTTL = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "destination_ttl",
+			Help:      "Typical TTL of the packets from the destination.",
+		}, []string{"dest_ip"},
+	)
+
+	interfacePackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "interface_packets_total",
+			Help:      "Total number of packets seen on the network interface by the eBPF program, and of those matching the CIDRs and ports.",
+		}, []string{"interface", "result"},
+	)
+
+	interfaceBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "interface_bytes_total",
+			Help:      "Total number of bytes of the packets seen on the network interface by the eBPF program.",
+		}, []string{"interface"},
+	)
+
+	ttlAnomalies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ttl_anomalies_total",
+			Help:      "Total number of packets from the destination with an unexpected TTL.",
+		}, []string{"dest_ip"},
+	)
+
+	destinationIPs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "destination_ips",
+			Help:      "Number of destination IPs of the SNI with traffic in the last complete churn window.",
+		}, []string{"sni"},
+	)
+
+	failureRateChanges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "failure_rate_change_ratio",
+			Help:      "Ratio of the connection failure rate of the SNI in the last complete change window to its average in the previous windows.",
+		}, []string{"sni"},
+	)
+
+	suspectedInterceptions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "suspected_interception_total",
+			Help:      "Total number of connections with a signature of an SNI proxy or TLS interception, by signature.",
+		}, []string{"sni", "signature"},
+	)
+
+	tlsVersions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_version_total",
+			Help:      "Total number of TLS handshakes by the version negotiated with the ServerHello.",
+		}, []string{"sni", "version", "resumed"},
+	)
+
+	tlsCipherSuites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_cipher_suite_total",
+			Help:      "Total number of TLS handshakes by the cipher suite negotiated with the ServerHello.",
+		}, []string{"sni", "cipher_suite", "resumed"},
+	)
+
+	tlsEarlyData = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_early_data_total",
+			Help:      "Total number of TLS handshakes whose ClientHello offered 0-RTT early data.",
+		}, []string{"sni", "resumed"},
+	)
+
+	mptcpSubflows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mptcp_subflows_total",
+			Help:      "Total number of additional subflows joining the MPTCP connections, which are not accounted as connections of their own.",
+		}, []string{"sni", "result"},
+	)
+
+	partialMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "partial_matches_total",
+			Help:      "Total number of connection attempts matching only the configured CIDRs or only the configured ports, which are not tracked.",
+		}, []string{"match", "ip", "port"},
+	)
+
+	tlsAlerts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_alerts_total",
+			Help:      "Total number of fatal TLS alerts sent during the handshake, by the alert and its sender.",
+		}, []string{"sni", "alert", "sender"},
+	)
+
+	alpnOffered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "alpn_offered_total",
+			Help:      "Total number of ClientHellos offering the application protocol with the ALPN.",
+		}, []string{"sni", "protocol"},
+	)
+
+	alpnSelected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "alpn_selected_total",
+			Help:      "Total number of ServerHellos selecting the application protocol with the ALPN.",
+		}, []string{"sni", "protocol"},
+	)
+
+	namespaceConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "namespace_connections_total",
+			Help:      "Total number of successful and failed connections to the SNI per namespace of the clients.",
+		}, []string{"kind", "sni", "namespace"},
+	)
+
+	namespaceShare = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "namespace_connection_share",
+			Help:      "Share of the namespace of the clients in the successful or failed connections to the SNI in the last share window.",
+		}, []string{"kind", "sni", "namespace"},
+	)
+
+	destinationIPChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "destination_ip_changes_total",
+			Help:      "Total number of destination IPs of the SNI which appeared or disappeared between two churn windows.",
+		}, []string{"kind", "sni"},
+	)
+
+	traceroutes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "traceroutes_total",
+			Help:      "Total number of traceroutes triggered by failures.",
+		}, []string{"result"},
+	)
+
+	dnsProbes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_probes_total",
+			Help:      "Total number of probes of the node-local DNS cache.",
+		}, []string{"result"},
+	)
+
+	udpFlows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "udp_flows_total",
+			Help:      "Total number of UDP flows per destination, answered by the server or unanswered within the response timeout.",
+		}, []string{"outcome", "dest_ip", "dest_port"},
+	)
+
+	dnsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_queries_total",
+			Help:      "Total number of DNS queries per queried name and type.",
+		}, []string{"qname", "qtype"},
+	)
+
+	dnsResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_responses_total",
+			Help:      "Total number of DNS responses per queried name and response code.",
+		}, []string{"qname", "rcode"},
+	)
+
+	dnsTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_timeouts_total",
+			Help:      "Total number of DNS queries without a response per queried name.",
+		}, []string{"qname"},
+	)
+
+	dnsResponseLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dns_response_latency_seconds",
+			Help:      "Latency of the DNS responses per queried name, from the query to its response.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"qname"},
+	)
+
+	sniTruncations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sni_truncations_total",
+			Help:      "Total number of SNIs longer than the maximum SNI length, which were truncated.",
+		},
+	)
+
+	mapReadDuplicates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "map_read_duplicates_total",
+			Help:      "Total number of entries seen twice while reading an eBPF map without batch operations.",
+		}, []string{"map"},
+	)
+
+	lateStatsWrites = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stats_late_writes_total",
+			Help:      "Total number of connections closed while the slot of the stats map was read, accounted as old connections instead.",
+		},
+	)
+
+	clientHelloReassemblies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_hello_reassemblies_total",
+			Help:      "Total number of ClientHellos split over several segments which were reassembled in userspace, by result.",
+		}, []string{"result"},
+	)
+
+	mergedIncs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "merged_increments_total",
+			Help:      "Total number of increments merged into an increment with the same labels before they were applied.",
+		},
+	)
+
+	quarantinedStats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quarantined_stats_total",
+			Help:      "Total number of implausible stats entries read from the eBPF program, which were not accounted.",
+		}, []string{"reason"},
+	)
+
+	carryOverEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "carry_over_entries",
+			Help:      "Number of entries in the failed-second carry-over state.",
+		},
+	)
+
+	unknownSNIConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unknown_sni_connections_total",
+			Help:      "Total number of connections whose SNI could not be extracted, accounted for the unknown SNI.",
+		}, []string{"dest_ip", "dest_port", "state"},
+	)
+
+	bpfProgramInstructions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bpf_program_instructions",
+			Help:      "Number of instructions of the loaded eBPF programs.",
+		}, []string{"program"},
+	)
+
+	resolution = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "window_resolution_seconds",
+			Help:      "Width of the accounting windows, the granularity of the seconds counters.",
+		},
+	)
+
+	statsSlots = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stats_slots",
+			Help:      "Number of windows the stats map of the eBPF program holds before they are accounted.",
+		},
+	)
+
+	sflowDatagrams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sflow_datagrams_total",
+			Help:      "Total number of sFlow datagrams sent to the collector.",
+		}, []string{"result"},
+	)
+
+	sinkItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sink_items_total",
+			Help:      "Total number of items of the push sinks by result: delivered, failed after all attempts or dropped by the full queue.",
+		}, []string{"sink", "result"},
+	)
+
+	sinkQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sink_queue_length",
+			Help:      "Number of items queued for a push sink.",
+		}, []string{"sink"},
+	)
+
+	bpfSetupError = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bpf_setup_error_info",
+			Help:      "The kind of the last failure to load or attach the eBPF program, unset after a success.",
+		}, []string{"kind", "program"},
+	)
+
+	quarantinedWindows = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quarantined_windows_total",
+			Help:      "Total number of windows whose accounting panicked and whose map snapshot was quarantined.",
+		},
+	)
+
 	execution = promextra.NewPrecomputedHistogram(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -63,4 +800,184 @@ var (
 			),
 		},
 	)
+
+	rtt = promextra.NewPrecomputedHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rtt_seconds",
+			Help:      "Smoothed RTT of the connections per SNI, sampled by the sock_ops program.",
+			// The same buckets as the execution time, the
+			// histograms of the eBPF program share their layout.
+			Buckets: prometheus.ExponentialBuckets(2, 2, 31),
+		}, []string{"sni"},
+	)
+
+	// pushed are the metrics updated by Apply and the setters.
+	pushed = []prometheus.Collector{
+		seconds,
+		connections,
+		handshakesAbandoned,
+		connectionFailures,
+		networkRejections,
+		resets,
+		certificateRequests,
+		certificateRequestFailures,
+		degradedSeconds,
+		serviceBackendFailures,
+		sniAttributions,
+		classifiedConnections,
+		failedSecondsByCause,
+		stateTransitions,
+		handshakeOnlyConnections,
+		ecnNegotiations,
+		congestionSignals,
+		destinationSeconds,
+		destinationConnections,
+		destinationConnectLatency,
+		handshakeDuration,
+		clientSeconds,
+		clientConnections,
+		sniSeconds,
+		sniConnections,
+		cidrGroupSeconds,
+		cidrGroupConnections,
+		canarySeconds,
+		canaryConnections,
+		canarySecondsDelta,
+		canaryConnectionsDelta,
+		backendMatches,
+		backendDivergences,
+		destinationTTL,
+		ttlAnomalies,
+		interfacePackets,
+		interfaceBytes,
+		suspectedInterceptions,
+		tlsVersions,
+		tlsCipherSuites,
+		tlsEarlyData,
+		mptcpSubflows,
+		partialMatches,
+		tlsAlerts,
+		alpnOffered,
+		alpnSelected,
+		namespaceConnections,
+		namespaceShare,
+		destinationIPs,
+		destinationIPChanges,
+		failureRateChanges,
+		traceroutes,
+		dnsProbes,
+		udpFlows,
+		dnsQueries,
+		dnsResponses,
+		dnsTimeouts,
+		dnsResponseLatency,
+		quarantinedStats,
+		mapReadDuplicates,
+		lateStatsWrites,
+		mergedIncs,
+		sniTruncations,
+		clientHelloReassemblies,
+		carryOverEntries,
+		unknownSNIConnections,
+		bpfProgramInstructions,
+		resolution,
+		statsSlots,
+		sflowDatagrams,
+		sinkItems,
+		sinkQueueLength,
+		bpfSetupError,
+		quarantinedWindows,
+		execution,
+		rtt,
+	}
+
+	openConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "open_connections"),
+		"Number of connections tracked by the eBPF program which are not accounted yet.",
+		[]string{"state"}, nil,
+	)
+
+	testWindowsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "test_windows"),
+		"Number of registered test windows.",
+		[]string{"complete"}, nil,
+	)
+
+	errorBudgetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "slo", "error_budget_seconds"),
+		"Error budget of the SLO of the SNI over its window.",
+		[]string{"sni"}, nil,
+	)
+
+	errorBudgetRemainingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "slo", "error_budget_remaining_seconds"),
+		"Error budget of the SLO of the SNI not burnt by failed seconds within its window, negative when overspent.",
+		[]string{"sni"}, nil,
+	)
+
+	errorBudgetExhaustedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "slo", "error_budget_exhausted_timestamp_seconds"),
+		"Time the error budget of the SLO of the SNI was exhausted, unset while budget remains.",
+		[]string{"sni"}, nil,
+	)
+
+	rollupSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "rollup", "seconds"),
+		"Number of seconds of the SNI accounted in the current calendar period.",
+		[]string{"kind", "sni", "period"}, nil,
+	)
+
+	rollupAvailabilityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "rollup", "availability_ratio"),
+		"Share of the active seconds of the SNI which did not fail in the current calendar period.",
+		[]string{"sni", "period"}, nil,
+	)
+
+	latencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "latency_seconds"),
+		"Quantiles of the connect and the handshake latency of the SNI within the latency window.",
+		[]string{"kind", "sni"}, nil,
+	)
+
+	drainingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "draining"),
+		"Whether the node is draining, its failures are silenced meanwhile.",
+		nil, nil,
+	)
 )
+
+// LatencySummary are the quantiles of a kind of latency of an SNI.
+type LatencySummary struct {
+	SNI string
+	// Kind is "connect" or "handshake".
+	Kind      string
+	Count     uint64
+	Sum       float64
+	Quantiles map[float64]float64
+}
+
+// Rollup are the seconds of an SNI in the current calendar period.
+type Rollup struct {
+	SNI    string
+	Period string
+	ActiveSeconds,
+	ActiveFailedSeconds float64
+}
+
+// ErrorBudget is the state of the SLO of an SNI.
+type ErrorBudget struct {
+	SNI       string
+	Budget    float64
+	Remaining float64
+	// Exhausted is the time the budget was exhausted, zero while
+	// budget remains.
+	Exhausted time.Time
+}
+
+// CIDRGroupInfo are the values of the annotation labels of a CIDR
+// group, in the order of the labels.
+type CIDRGroupInfo struct {
+	Name   string
+	Values []string
+}
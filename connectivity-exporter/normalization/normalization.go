@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package normalization maps the SNIs to the names they are accounted
+// for, so the thousands of generated SNIs of e.g. the ingresses of the
+// clusters of a landscape share a single series instead of blowing up
+// the cardinality of the metrics.
+package normalization
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxCachedSNIs bounds the normalized SNIs kept, the cache is cleared
+// once it is full.
+const maxCachedSNIs = 100000
+
+// Rule normalizes the matching SNIs. Exactly one of Suffix, Regex and
+// Wildcard is set.
+type Rule struct {
+	// Suffix collapses the SNIs ending with the suffix after a dot to
+	// "*." followed by the suffix, e.g. "a.ingress.example.com" to
+	// "*.ingress.example.com" for the suffix "ingress.example.com".
+	Suffix string `json:"suffix,omitempty"`
+	// Regex replaces the SNIs matching the regular expression with
+	// Replacement, which can refer to the capture groups, e.g. $1.
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	// Wildcard folds the SNIs matching the pattern, as accepted by
+	// path.Match, into the pattern itself.
+	Wildcard string `json:"wildcard,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Rules are the normalization rules, the first matching rule applies.
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Normalizer normalizes the SNIs with the rules. It is not safe for
+// concurrent use, the SNIs are normalized by the accounting.
+type Normalizer struct {
+	rules []Rule
+	cache map[string]string
+}
+
+// Load reads the rules of the file.
+func Load(filename string) (*Normalizer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading SNI aggregation rules: %w", err)
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing SNI aggregation rules %s: %w", filename, err)
+	}
+	n, err := New(rules.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("validating SNI aggregation rules %s: %w", filename, err)
+	}
+	return n, nil
+}
+
+// New creates a normalizer of the rules.
+func New(rules []Rule) (*Normalizer, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	n := &Normalizer{rules: make([]Rule, len(rules)), cache: make(map[string]string)}
+	for i, r := range rules {
+		kinds := 0
+		for _, s := range []string{r.Suffix, r.Regex, r.Wildcard} {
+			if s != "" {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("rule %d: expected exactly one of suffix, regex and wildcard", i)
+		}
+		if (r.Replacement != "") != (r.Regex != "") {
+			return nil, fmt.Errorf("rule %d: expected a replacement with a regex", i)
+		}
+		if r.Suffix != "" {
+			r.Suffix = strings.TrimPrefix(r.Suffix, ".")
+			if r.Suffix == "" {
+				return nil, fmt.Errorf("rule %d: empty suffix", i)
+			}
+		}
+		if r.Wildcard != "" {
+			if _, err := path.Match(r.Wildcard, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid wildcard %q: %w", i, r.Wildcard, err)
+			}
+		}
+		if r.Regex != "" {
+			regex, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			r.regex = regex
+		}
+		n.rules[i] = r
+	}
+	return n, nil
+}
+
+// Normalize returns the name the SNI is accounted for, the SNI itself
+// if no rule matches.
+func (n *Normalizer) Normalize(sni string) string {
+	if normalized, ok := n.cache[sni]; ok {
+		return normalized
+	}
+	normalized := n.normalize(sni)
+	if len(n.cache) >= maxCachedSNIs {
+		n.cache = make(map[string]string)
+	}
+	n.cache[sni] = normalized
+	return normalized
+}
+
+func (n *Normalizer) normalize(sni string) string {
+	for _, r := range n.rules {
+		switch {
+		case r.Suffix != "":
+			if strings.HasSuffix(sni, "."+r.Suffix) {
+				return "*." + r.Suffix
+			}
+		case r.regex != nil:
+			if match := r.regex.FindStringSubmatchIndex(sni); match != nil {
+				return string(r.regex.ExpandString(nil, r.Replacement, sni, match))
+			}
+		default:
+			if ok, _ := path.Match(r.Wildcard, sni); ok {
+				return r.Wildcard
+			}
+		}
+	}
+	return sni
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package normalization
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	n, err := New([]Rule{
+		{Regex: `^shoot--([^-]+)--[^.]+\.(.+)$`, Replacement: "shoot--$1--*.$2"},
+		{Suffix: ".ingress.cluster.example.com"},
+		{Wildcard: "api-*.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sni, want := range map[string]string{
+		"shoot--garden--a1b2.example.com":                 "shoot--garden--*.example.com",
+		"x.y.ingress.cluster.example.com":                 "*.ingress.cluster.example.com",
+		"ingress.cluster.example.com":                     "ingress.cluster.example.com",
+		"api-eu1.example.com":                             "api-*.example.com",
+		"api.example.com":                                 "api.example.com",
+		"shoot--garden--a1b2.ingress.cluster.example.com": "shoot--garden--*.ingress.cluster.example.com",
+	} {
+		// The second call is served from the cache.
+		for i := 0; i < 2; i++ {
+			if got := n.Normalize(sni); got != want {
+				t.Errorf("Normalize(%q) = %q, want %q", sni, got, want)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for desc, rules := range map[string][]Rule{
+		"no rules":                  nil,
+		"no kind":                   {{}},
+		"two kinds":                 {{Suffix: "example.com", Wildcard: "*.example.com"}},
+		"replacement without regex": {{Suffix: "example.com", Replacement: "x"}},
+		"regex without replacement": {{Regex: "x"}},
+		"invalid regex":             {{Regex: "(", Replacement: "x"}},
+		"invalid wildcard":          {{Wildcard: "["}},
+		"empty suffix":              {{Suffix: "."}},
+	} {
+		if _, err := New(rules); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(filename, []byte(`{"rules": [{"suffix": "ingress.example.com"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Normalize("a.ingress.example.com"); got != "*.ingress.example.com" {
+		t.Errorf("got %q", got)
+	}
+	if err := os.WriteFile(filename, []byte(`{"rules": [{}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil {
+		t.Error("Expected an error for an invalid rule")
+	}
+}
@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"m/metrics"
+)
+
+// labelSet are the labels of the metrics of an increment.
+type labelSet struct {
+	sni, sourceIP, destIP string
+}
+
+// aggregateIncs merges the increments of a window with the same
+// labels, so the keys mapped to the same labels are sent to the
+// metrics as one increment. The order of the first increment of each
+// label set is kept.
+func aggregateIncs(incs []*metrics.Inc) []*metrics.Inc {
+	aggregated := incs[:0]
+	seen := make(map[labelSet]*metrics.Inc, len(incs))
+	for _, inc := range incs {
+		labels := labelSet{sni: inc.SNI, sourceIP: inc.SourceIP, destIP: inc.DestIP}
+		if first, ok := seen[labels]; ok {
+			first.Merge(inc)
+			continue
+		}
+		seen[labels] = inc
+		aggregated = append(aggregated, inc)
+	}
+	if merged := len(incs) - len(aggregated); merged > 0 {
+		metrics.AddMergedIncs(float64(merged))
+	}
+	return aggregated
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// alpnKey mirrors struct alpn_t.
+type alpnKey struct {
+	SNI      [C.TLS_MAX_SERVER_NAME_LEN]byte
+	Side     uint8
+	Protocol uint8
+}
+
+// alpn is a protocol offered by the ClientHellos or selected by the
+// ServerHellos for an SNI.
+type alpn struct {
+	sni      string
+	selected bool
+	protocol uint8
+}
+
+// alpnProtocolNames are the names of the ALPN_* protocols, the protocol
+// label.
+var alpnProtocolNames = map[uint8]string{
+	C.ALPN_H2:        "h2",
+	C.ALPN_HTTP_1_1:  "http/1.1",
+	C.ALPN_H3:        "h3",
+	C.ALPN_OTHER:     "other",
+	C.ALPN_NONE:      "none",
+	C.ALPN_ENCRYPTED: "encrypted",
+}
+
+// readALPN exports the protocols offered and selected per SNI since the
+// last read. The kernel counters are cumulative, last holds their
+// previous values.
+func (s *NetworkDataSource) readALPN(last map[alpn]uint64) error {
+	var key alpnKey
+	var count uint64
+	current := make(map[alpn]uint64)
+	entries := s.ebpfConfig.alpnMap.Iterate()
+	for entries.Next(&key, &count) {
+		a := alpn{sni: sniFromC(key.SNI[:]), selected: key.Side == C.ALPN_SELECTED, protocol: key.Protocol}
+		current[a] = count
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for a, delta := range alpnDeltas(last, current) {
+		name, ok := alpnProtocolNames[a.protocol]
+		if !ok {
+			continue
+		}
+		metrics.AddALPN(normalizeSNI(s.normalizer, a.sni), name, a.selected, float64(delta))
+	}
+	return nil
+}
+
+// alpnDeltas returns the increase of the counters and replaces the last
+// counters with the current ones, like tlsParameterDeltas.
+func alpnDeltas(last, current map[alpn]uint64) map[alpn]uint64 {
+	deltas := make(map[alpn]uint64)
+	for a, count := range current {
+		if delta := counterDelta(last[a], count); delta > 0 {
+			deltas[a] = delta
+		}
+	}
+	for a := range last {
+		if _, ok := current[a]; !ok {
+			delete(last, a)
+		}
+	}
+	for a, count := range current {
+		last[a] = count
+	}
+	return deltas
+}
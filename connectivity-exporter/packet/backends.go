@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/conntrack"
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// UnknownBackend is the backend of the connections to a Service whose
+// translation is no longer in the connection tracking table.
+const UnknownBackend = "unknown"
+
+// ServiceBackends resolves the connections to the virtual IPs of the
+// Services to the backends kube-proxy translated them to.
+type ServiceBackends interface {
+	IsService(ip string) bool
+	Read() (conntrack.Table, error)
+}
+
+// backendKey identifies the failures of the connections to a backend
+// of a Service.
+type backendKey struct {
+	sni, serviceIP, backendIP string
+}
+
+// ResolveServiceBackends attributes the failed connections to the
+// Services to their backends.
+func (s *NetworkDataSource) ResolveServiceBackends(backends ServiceBackends) {
+	s.backends = backends
+}
+
+// failsConnection returns whether the state of a stale connection
+// fails it, as in accountForConnections.
+func failsConnection(state connState) bool {
+	switch state {
+	case SYN_RECEIVED, SYNACK_RECEIVED, RST_SENT_BY_SERVER, RST_SENT_BY_MIDDLEBOX, ICMP_UNREACHABLE:
+		return true
+	}
+	return false
+}
+
+// attributeBackends counts the failed stale connections to the
+// Services per backend. The connection tracking table is only read if
+// one of them failed. The connections closed within their window are
+// counted in the stats map without their ports, so they cannot be
+// attributed.
+func (s *State) attributeBackends(keys []C.struct_tuple_key_t, connections []*tupleData) {
+	if s.backends == nil || s.quiet {
+		return
+	}
+	var table conntrack.Table
+	now := s.clock.Now()
+	for i, key := range keys {
+		data := connections[i]
+		if !failsConnection(data.state) {
+			continue
+		}
+		ck := connKeyFromC(key, data.sni)
+		if !s.backends.IsService(ck.destIP) {
+			continue
+		}
+		if table == nil {
+			var err error
+			if table, err = s.backends.Read(); err != nil {
+				klog.Errorf("Failed to read the backends of the Services: %v", err)
+				return
+			}
+		}
+		tuple := conntrack.Tuple{
+			SourceIP:   ck.sourceIP,
+			DestIP:     ck.destIP,
+			SourcePort: ntohs(uint16(key.source_port)),
+			DestPort:   ntohs(uint16(key.dest_port)),
+		}
+		backend, ok := table[tuple]
+		if !ok {
+			backend = UnknownBackend
+		}
+		k := backendKey{sni: ck.sni, serviceIP: ck.destIP, backendIP: backend}
+		metrics.IncServiceBackendFailures(k.sni, k.serviceIP, k.backendIP)
+		s.backendSeries[k] = now
+	}
+}
+
+// deleteExpiredBackends deletes the failures of the backends which did
+// not fail for the metric expiration.
+func (s *State) deleteExpiredBackends(now time.Time) {
+	for k, lastUpdate := range s.backendSeries {
+		if lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteServiceBackendFailures(k.sni, k.serviceIP, k.backendIP)
+			delete(s.backendSeries, k)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/clock"
+	"m/conntrack"
+	"m/metrics"
+)
+
+type fakeBackends struct {
+	table conntrack.Table
+	reads int
+}
+
+func (f *fakeBackends) IsService(ip string) bool {
+	return strings.HasPrefix(ip, "10.96.")
+}
+
+func (f *fakeBackends) Read() (conntrack.Table, error) {
+	f.reads++
+	return f.table, nil
+}
+
+func TestAttributeBackends(t *testing.T) {
+	backends := &fakeBackends{table: conntrack.Table{
+		{SourceIP: "10.0.0.1", DestIP: "10.96.0.10", SourcePort: 40000, DestPort: 443}: "10.244.1.5",
+		{SourceIP: "10.0.0.1", DestIP: "10.96.0.10", SourcePort: 40001, DestPort: 443}: "10.244.2.7",
+	}}
+	clk := clock.NewFake(time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC))
+	state := newState(nil, clk)
+	state.backends = backends
+
+	var keys []udpFlowKey
+	var connections []*tupleData
+	add := func(destIP string, srcPort uint16, data *tupleData) {
+		e, err := encodeConnection(&tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP(destIP), srcPort: srcPort, dstPort: 443}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _, err := decodeConnection(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, connections = append(keys, key), append(connections, data)
+	}
+	add("10.96.0.10", 40000, &tupleData{state: SYN_RECEIVED, sni: "api.example.com"})
+	add("10.96.0.10", 40001, &tupleData{state: SNI_RECEIVED, sni: "api.example.com"})
+	// The translation is gone.
+	add("10.96.0.10", 40002, &tupleData{state: RST_SENT_BY_SERVER, sni: "api.example.com"})
+	// Not a Service.
+	add("192.168.0.1", 40003, &tupleData{state: SYN_RECEIVED, sni: "api.example.com"})
+	state.attributeBackends(keys, connections)
+	assert(t, backends.reads, 1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_service_backend_failures_total Total number of failed connections to a Service IP per backend chosen by kube-proxy.
+		# TYPE connectivity_exporter_service_backend_failures_total counter
+		connectivity_exporter_service_backend_failures_total{backend_ip="10.244.1.5",service_ip="10.96.0.10",sni="api.example.com"} 1
+		connectivity_exporter_service_backend_failures_total{backend_ip="unknown",service_ip="10.96.0.10",sni="api.example.com"} 1
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "connectivity_exporter_service_backend_failures_total"); err != nil {
+		t.Error(err)
+	}
+
+	// Without failures, the table is not read.
+	state.attributeBackends(keys[1:2], connections[1:2])
+	assert(t, backends.reads, 1)
+
+	clk.Advance(metrics.Expiration + time.Second)
+	state.deleteExpiredBackends(clk.Now())
+	if n := testutil.CollectAndCount(metrics.NewCollector(), "connectivity_exporter_service_backend_failures_total"); n != 0 {
+		t.Errorf("The backend series should be removed, got %d", n)
+	}
+}
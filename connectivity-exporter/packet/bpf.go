@@ -14,12 +14,16 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 
 	"m/constants"
+	"m/metrics"
 	"m/promextra"
 )
 
@@ -27,22 +31,56 @@ import (
 import "C"
 
 const (
-	SO_ATTACH_BPF           = 50
-	BPF_PROGRAM_NAME        = "capture_packets"
-	BPF_CIDR_MAP_NAME       = "config_cidrs"
-	BPF_PORT_MAP_NAME       = "config_ports"
-	BPF_CONNECTION_MAP_NAME = "connections"
-	BPF_HISTOGRAM_MAP_NAME  = "histogram"
-
-	BPF_TEST_HOOK_MAP_NAME    = "test_hook"
-	BPF_TICKER_CLOCK_MAP_NAME = "ticker_clock"
-	BPF_STATS_MAP_NAME        = "stats"
-	BPF_SNI_STATS_MAP_NAME    = "sni_stats"
-
-	BPF_WRITE_START_MAP_NAME = "write_start"
+	SO_ATTACH_BPF             = 50
+	BPF_PROGRAM_NAME          = "capture_packets"
+	BPF_DNS_PROGRAM_NAME      = "capture_dns"
+	BPF_SOCKOPS_PROGRAM_NAME  = "sample_rtt"
+	BPF_CIDR_MAP_NAME         = "config_cidrs"
+	BPF_PORT_MAP_NAME         = "config_ports"
+	BPF_FORWARD_MAP_NAME      = "config_forward"
+	BPF_CAPTURE_MAP_NAME      = "config_capture"
+	BPF_SNI_CONFIG_MAP_NAME   = "config_sni"
+	BPF_STATS_CONFIG_MAP_NAME = "config_stats"
+	BPF_CONNECTION_MAP_NAME   = "connections"
+	BPF_HISTOGRAM_MAP_NAME    = "histogram"
+
+	BPF_TEST_HOOK_MAP_NAME         = "test_hook"
+	BPF_TICKER_CLOCK_MAP_NAME      = "ticker_clock"
+	BPF_STATS_MAP_NAME             = "stats"
+	BPF_SNI_STATS_MAP_NAME         = "sni_stats"
+	BPF_DEST_TTL_MAP_NAME          = "dest_ttl"
+	BPF_TTL_ANOMALY_MAP_NAME       = "ttl_anomalies"
+	BPF_INTERCEPTIONS_MAP_NAME     = "interceptions"
+	BPF_REASSEMBLED_SNIS_MAP_NAME  = "reassembled_snis"
+	BPF_TLS_PARAMETERS_MAP_NAME    = "tls_parameters"
+	BPF_TLS_ALERTS_MAP_NAME        = "tls_alerts"
+	BPF_MPTCP_CONNECTIONS_MAP_NAME = "mptcp_connections"
+	BPF_MPTCP_SUBFLOWS_MAP_NAME    = "mptcp_subflows"
+	BPF_PARTIAL_MATCHES_MAP_NAME   = "partial_matches"
+	BPF_UDP_FLOWS_MAP_NAME         = "udp_flows"
+	BPF_ALPN_MAP_NAME              = "alpn"
+	BPF_DATA_BYTES_MAP_NAME        = "data_bytes"
+	BPF_RTT_MAP_NAME               = "rtt"
+	BPF_INTERFACE_PACKETS_MAP_NAME = "interface_packets"
+
+	BPF_STATS_GENERATIONS_MAP_NAME = "stats_generations"
+	BPF_LATE_WRITES_MAP_NAME       = "late_writes"
+	BPF_SNI_TRUNCATIONS_MAP_NAME   = "sni_truncations"
+
+	BPF_WRITE_START_MAP_NAME  = "write_start"
 	BPF_WRITE_EVENTS_MAP_NAME = "write_events"
+
+	BPF_PROGRAMS_MAP_NAME = "programs"
 )
 
+// tailCalls maps the indices of the programs map to the tail-called
+// sub-programs of BPF_PROGRAM_NAME.
+var tailCalls = map[uint32]string{
+	C.PROG_L4_STATE:   "l4_state",
+	C.PROG_TLS_PARSE:  "tls_parse",
+	C.PROG_HTTP_PARSE: "http_parse",
+}
+
 func init() {
 	verifyConstants()
 }
@@ -54,12 +92,67 @@ type ebpfConfig struct {
 	coll           *ebpf.Collection
 	cidrMap        *ebpf.Map
 	portMap        *ebpf.Map
+	forwardMap     *ebpf.Map
+	captureMap     *ebpf.Map
+	sniConfigMap   *ebpf.Map
+	statsConfigMap *ebpf.Map
 	connectionMap  *ebpf.Map
 	histogramMap   *ebpf.Map
 	testHookMap    *ebpf.Map
 	tickerClockMap *ebpf.Map
 	statsMap       *ebpf.Map
-	prog           *ebpf.Program
+	destTTLMap     *ebpf.Map
+	ttlAnomalyMap  *ebpf.Map
+	// interceptionsMap counts the signatures of interception per SNI.
+	interceptionsMap *ebpf.Map
+	// reassembledSNIsMap hands the SNIs of the ClientHellos
+	// reassembled in userspace over to the eBPF program.
+	reassembledSNIsMap *ebpf.Map
+	// tlsParametersMap counts the handshakes per SNI, TLS version and
+	// cipher suite.
+	tlsParametersMap *ebpf.Map
+	// tlsAlertsMap counts the fatal alerts of the handshakes per SNI,
+	// alert and sender.
+	tlsAlertsMap *ebpf.Map
+	// mptcpConnectionsMap maps the keys of the servers of the MPTCP
+	// connections to their stats keys, mptcpSubflowsMap counts the
+	// subflows joining them per token.
+	mptcpConnectionsMap *ebpf.Map
+	mptcpSubflowsMap    *ebpf.Map
+	// partialMatchesMap counts the SYNs matching only the CIDRs or
+	// only the ports.
+	partialMatchesMap *ebpf.Map
+	// udpFlowsMap tracks the flows to the ports of UDP.
+	udpFlowsMap *ebpf.Map
+	// alpnMap counts the protocols offered and selected with the ALPN
+	// per SNI.
+	alpnMap *ebpf.Map
+	// dataBytesMap counts the payload bytes per source, destination and
+	// SNI while countDataBytes is set.
+	dataBytesMap   *ebpf.Map
+	countDataBytes bool
+	// interfacePacketsMap counts the packets and bytes seen per
+	// network interface.
+	interfacePacketsMap *ebpf.Map
+	// generationsMap holds the ticker clock each slot of the stats
+	// map is open for.
+	generationsMap *ebpf.Map
+	lateWritesMap  *ebpf.Map
+	truncationsMap *ebpf.Map
+	// spareStatsMap is the empty inner map swapped in for the next
+	// read slot of the stats map.
+	spareStatsMap *ebpf.Map
+	// slots is the number of slots of the stats map in use.
+	slots       uint64
+	programsMap *ebpf.Map
+	prog        *ebpf.Program
+	// sockOpsSpec is the sock_ops program sampling the RTT, which is
+	// only loaded by attachSockOps. It and rttMap are nil for a
+	// program built before them.
+	sockOpsSpec *ebpf.ProgramSpec
+	rttMap      *ebpf.Map
+	// loadedAt is the time the programs were loaded.
+	loadedAt time.Time
 }
 
 // newEBPFConfig loads the connection tracking program into the
@@ -82,6 +175,13 @@ func newEBPFConfig() (*ebpfConfig, error) {
 	// Configure inner map
 	config.spec.Maps[BPF_STATS_MAP_NAME].InnerMap = config.spec.Maps[BPF_SNI_STATS_MAP_NAME]
 
+	// The sock_ops program needs a cgroup and a newer kernel than the
+	// socket filter, so it is only loaded on request.
+	config.sockOpsSpec = config.spec.Programs[BPF_SOCKOPS_PROGRAM_NAME]
+	delete(config.spec.Programs, BPF_SOCKOPS_PROGRAM_NAME)
+
+	// The error names the sub-program rejected by the verifier, followed
+	// by the verifier log.
 	config.coll, err = ebpf.NewCollection(config.spec)
 	if err != nil {
 		return nil, fmt.Errorf("creating eBPF collection: %w", err)
@@ -94,12 +194,55 @@ func newEBPFConfig() (*ebpfConfig, error) {
 	var ok bool
 	config.prog, ok = config.coll.Programs[BPF_PROGRAM_NAME]
 	if !ok {
-		return nil, fmt.Errorf("bpf program %q not found", BPF_PROGRAM_NAME)
+		err = fmt.Errorf("bpf program %q not found", BPF_PROGRAM_NAME)
+		return nil, err
+	}
+
+	if err = setupTailCalls(config); err != nil {
+		return nil, err
 	}
+	reportPrograms(config.coll.Programs)
+	config.loadedAt = time.Now()
 
 	return config, nil
 }
 
+// setupTailCalls installs the sub-programs in the programs map, so the
+// entry program can tail-call them.
+func setupTailCalls(config *ebpfConfig) error {
+	for index, name := range tailCalls {
+		prog, ok := config.coll.Programs[name]
+		if !ok {
+			return fmt.Errorf("bpf program %q not found", name)
+		}
+		if err := config.programsMap.Put(index, prog); err != nil {
+			return fmt.Errorf("installing bpf program %q for tail calls: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// reportPrograms logs and exports the size of the loaded programs
+// after the kernel translated them. Each sub-program is verified on
+// its own, so the size shows how close it is to the limits of the
+// verifier.
+func reportPrograms(programs map[string]*ebpf.Program) {
+	for name, prog := range programs {
+		info, err := prog.Info()
+		if err != nil {
+			klog.Warningf("Failed to get info of bpf program %q: %v", name, err)
+			continue
+		}
+		insns, err := info.Instructions()
+		if err != nil {
+			klog.Warningf("Failed to get instructions of bpf program %q: %v", name, err)
+			continue
+		}
+		klog.Infof("Loaded bpf program %q with %d instructions", name, len(insns))
+		metrics.SetBPFProgramInstructions(name, len(insns))
+	}
+}
+
 // Close drops a reference to the loaded program. Whether the loaded
 // program will actually be unloaded from the kernel depends on
 // whether this was a last reference to the program.
@@ -108,6 +251,10 @@ func (config *ebpfConfig) Close() {
 		config.coll.Close()
 		config.coll = nil
 	}
+	if config.spareStatsMap != nil {
+		config.spareStatsMap.Close()
+		config.spareStatsMap = nil
+	}
 }
 
 // setupMaps initializes the map fields of ebpfConfig, so accessing
@@ -122,6 +269,22 @@ func setupMaps(config *ebpfConfig) error {
 	if !ok {
 		return fmt.Errorf("no map named %q found", BPF_PORT_MAP_NAME)
 	}
+	config.forwardMap, ok = config.coll.Maps[BPF_FORWARD_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_FORWARD_MAP_NAME)
+	}
+	config.captureMap, ok = config.coll.Maps[BPF_CAPTURE_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_CAPTURE_MAP_NAME)
+	}
+	config.sniConfigMap, ok = config.coll.Maps[BPF_SNI_CONFIG_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_SNI_CONFIG_MAP_NAME)
+	}
+	config.statsConfigMap, ok = config.coll.Maps[BPF_STATS_CONFIG_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_STATS_CONFIG_MAP_NAME)
+	}
 	config.connectionMap, ok = config.coll.Maps[BPF_CONNECTION_MAP_NAME]
 	if !ok {
 		return fmt.Errorf("no map named %q found", BPF_CONNECTION_MAP_NAME)
@@ -142,6 +305,76 @@ func setupMaps(config *ebpfConfig) error {
 	if !ok {
 		return fmt.Errorf("no map named %q found", BPF_STATS_MAP_NAME)
 	}
+	config.destTTLMap, ok = config.coll.Maps[BPF_DEST_TTL_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_DEST_TTL_MAP_NAME)
+	}
+	config.ttlAnomalyMap, ok = config.coll.Maps[BPF_TTL_ANOMALY_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_TTL_ANOMALY_MAP_NAME)
+	}
+	config.interceptionsMap, ok = config.coll.Maps[BPF_INTERCEPTIONS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_INTERCEPTIONS_MAP_NAME)
+	}
+	config.reassembledSNIsMap, ok = config.coll.Maps[BPF_REASSEMBLED_SNIS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_REASSEMBLED_SNIS_MAP_NAME)
+	}
+	config.tlsParametersMap, ok = config.coll.Maps[BPF_TLS_PARAMETERS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_TLS_PARAMETERS_MAP_NAME)
+	}
+	config.tlsAlertsMap, ok = config.coll.Maps[BPF_TLS_ALERTS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_TLS_ALERTS_MAP_NAME)
+	}
+	config.mptcpConnectionsMap, ok = config.coll.Maps[BPF_MPTCP_CONNECTIONS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_MPTCP_CONNECTIONS_MAP_NAME)
+	}
+	config.mptcpSubflowsMap, ok = config.coll.Maps[BPF_MPTCP_SUBFLOWS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_MPTCP_SUBFLOWS_MAP_NAME)
+	}
+	config.partialMatchesMap, ok = config.coll.Maps[BPF_PARTIAL_MATCHES_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_PARTIAL_MATCHES_MAP_NAME)
+	}
+	config.udpFlowsMap, ok = config.coll.Maps[BPF_UDP_FLOWS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_UDP_FLOWS_MAP_NAME)
+	}
+	config.alpnMap, ok = config.coll.Maps[BPF_ALPN_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_ALPN_MAP_NAME)
+	}
+	config.dataBytesMap, ok = config.coll.Maps[BPF_DATA_BYTES_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_DATA_BYTES_MAP_NAME)
+	}
+	config.interfacePacketsMap, ok = config.coll.Maps[BPF_INTERFACE_PACKETS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_INTERFACE_PACKETS_MAP_NAME)
+	}
+	config.generationsMap, ok = config.coll.Maps[BPF_STATS_GENERATIONS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_STATS_GENERATIONS_MAP_NAME)
+	}
+	config.lateWritesMap, ok = config.coll.Maps[BPF_LATE_WRITES_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_LATE_WRITES_MAP_NAME)
+	}
+	config.truncationsMap, ok = config.coll.Maps[BPF_SNI_TRUNCATIONS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_SNI_TRUNCATIONS_MAP_NAME)
+	}
+	config.programsMap, ok = config.coll.Maps[BPF_PROGRAMS_MAP_NAME]
+	if !ok {
+		return fmt.Errorf("no map named %q found", BPF_PROGRAMS_MAP_NAME)
+	}
+	// Only needed by the sock_ops program, see attachSockOps.
+	config.rttMap = config.coll.Maps[BPF_RTT_MAP_NAME]
 
 	return nil
 }
@@ -155,15 +388,26 @@ func setupMaps(config *ebpfConfig) error {
 // decrease the reference count on the program.
 type ebpfAttachment struct {
 	socketFD [32]int
+	// sockOps is the link of the sock_ops program to its cgroup, if
+	// it is attached.
+	sockOps link.Link
 }
 
-// attachProgramToNetworkInterface returns an ebpfAttachment object
-func attachProgramToNetworkInterface(prog *ebpf.Program, networkInterface string) (*ebpfAttachment, error) {
+// attachProgramToNetworkInterface returns an ebpfAttachment object. For
+// mirrored traffic, the program is only attached to the capture
+// interface, which is put into promiscuous mode.
+func attachProgramToNetworkInterface(prog *ebpf.Program, networkInterface string, span bool) (*ebpfAttachment, error) {
+	if span {
+		return attachPromiscuous(prog, networkInterface)
+	}
 	attachment := &ebpfAttachment{}
+	var attached int
+	var lastErr error
 	for ifaceIndex := 0; ifaceIndex < len(attachment.socketFD); ifaceIndex++ {
 		fd, err := openRawSock(ifaceIndex)
 		if err != nil {
 			klog.Errorf("Failed to open socket for interface %d: %w\n", ifaceIndex, err)
+			lastErr = err
 			continue
 		}
 		attachment.socketFD[ifaceIndex] = fd
@@ -171,15 +415,55 @@ func attachProgramToNetworkInterface(prog *ebpf.Program, networkInterface string
 		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, SO_ATTACH_BPF, prog.FD())
 		if err != nil {
 			klog.Errorf("Failed to set socket option for interface %d: %w\n", ifaceIndex, err)
+			lastErr = err
 			continue
 		}
 
 		klog.Infof("Listening on interface %d\n", ifaceIndex)
+		attached++
+	}
+	if attached == 0 {
+		attachment.Close()
+		return nil, fmt.Errorf("attaching the program to any interface: %w", lastErr)
 	}
 	return attachment, nil
 }
 
-// Close closes the underlying socket.
+// attachPromiscuous attaches the program to a socket of the capture
+// interface only, which receives the frames of any destination MAC
+// address. The interface leaves promiscuous mode when the socket is
+// closed.
+func attachPromiscuous(prog *ebpf.Program, networkInterface string) (*ebpfAttachment, error) {
+	if networkInterface == "" {
+		return nil, errors.New("capturing mirrored traffic requires a network interface")
+	}
+	iface, err := net.InterfaceByName(networkInterface)
+	if err != nil {
+		return nil, &SetupError{Kind: InterfaceNotFound, Err: err}
+	}
+	fd, err := openRawSock(iface.Index)
+	if err != nil {
+		return nil, fmt.Errorf("opening socket for interface %s: %w", networkInterface, err)
+	}
+	// The socket of all interfaces is not used, so it holds the only
+	// socket.
+	attachment := &ebpfAttachment{}
+	attachment.socketFD[0] = fd
+	mreq := unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		attachment.Close()
+		return nil, fmt.Errorf("enabling promiscuous mode of %s: %w", networkInterface, err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, SO_ATTACH_BPF, prog.FD()); err != nil {
+		attachment.Close()
+		return nil, fmt.Errorf("attaching the program to %s: %w", networkInterface, err)
+	}
+	klog.Infof("Listening on interface %s in promiscuous mode", networkInterface)
+	return attachment, nil
+}
+
+// Close closes the underlying socket and detaches the sock_ops
+// program.
 func (a *ebpfAttachment) Close() {
 	for ifaceIndex := 0; ifaceIndex < len(a.socketFD); ifaceIndex++ {
 		if a.socketFD[ifaceIndex] > 0 {
@@ -187,6 +471,49 @@ func (a *ebpfAttachment) Close() {
 			a.socketFD[ifaceIndex] = -1
 		}
 	}
+	if a.sockOps != nil {
+		a.sockOps.Close()
+		a.sockOps = nil
+	}
+}
+
+// attachSockOps loads the sock_ops program sampling the RTT with the
+// connections and RTT maps of the config and attaches it to the
+// cgroup, which has to be a cgroup v2 directory.
+func (a *ebpfAttachment) attachSockOps(config *ebpfConfig, cgroupPath string) error {
+	if config.sockOpsSpec == nil || config.rttMap == nil {
+		return fmt.Errorf("bpf program %q not found, rebuild the program with make bpf", BPF_SOCKOPS_PROGRAM_NAME)
+	}
+	spec := &ebpf.CollectionSpec{
+		Maps:     map[string]*ebpf.MapSpec{},
+		Programs: map[string]*ebpf.ProgramSpec{BPF_SOCKOPS_PROGRAM_NAME: config.sockOpsSpec.Copy()},
+	}
+	if err := spec.RewriteMaps(map[string]*ebpf.Map{
+		BPF_CONNECTION_MAP_NAME: config.connectionMap,
+		BPF_RTT_MAP_NAME:        config.rttMap,
+	}); err != nil {
+		return fmt.Errorf("sharing the maps with bpf program %q: %w", BPF_SOCKOPS_PROGRAM_NAME, err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return fmt.Errorf("loading bpf program %q: %w", BPF_SOCKOPS_PROGRAM_NAME, err)
+	}
+	// The link holds its own reference to the program.
+	defer coll.Close()
+	l, err := link.AttachCgroup(link.CgroupOptions{
+		Path:    cgroupPath,
+		Attach:  ebpf.AttachCGroupSockOps,
+		Program: coll.Programs[BPF_SOCKOPS_PROGRAM_NAME],
+	})
+	if err != nil {
+		return fmt.Errorf("attaching bpf program %q to cgroup %s: %w", BPF_SOCKOPS_PROGRAM_NAME, cgroupPath, err)
+	}
+	if a.sockOps != nil {
+		a.sockOps.Close()
+	}
+	a.sockOps = l
+	klog.Infof("Sampling the RTT of the sockets in cgroup %s", cgroupPath)
+	return nil
 }
 
 func readSnapshotFromMap(histogramMap *ebpf.Map) (promextra.Snapshot, error) {
@@ -195,6 +522,11 @@ func readSnapshotFromMap(histogramMap *ebpf.Map) (promextra.Snapshot, error) {
 	if err := histogramMap.Lookup(unsafe.Pointer(&index), &values); err != nil {
 		return promextra.Snapshot{}, fmt.Errorf("failed to get values from map: %w", err)
 	}
+	return snapshotFromHistograms(values), nil
+}
+
+// snapshotFromHistograms sums up the per-CPU values of a histogram.
+func snapshotFromHistograms(values []C.struct_execution_histogram) promextra.Snapshot {
 	snapshot := promextra.NewSnapshot(len(values[0].Buckets))
 	for _, value := range values {
 		snapshot.Total += (uint64)(value.Total)
@@ -202,7 +534,7 @@ func readSnapshotFromMap(histogramMap *ebpf.Map) (promextra.Snapshot, error) {
 			snapshot.Buckets[idx] += (uint64)(bucketValue)
 		}
 	}
-	return snapshot, nil
+	return snapshot
 }
 
 func verifyConstants() {
@@ -267,14 +599,11 @@ func initCIDRMap(m *ebpf.Map, cidrs map[string]struct{}) error {
 
 func initPortMap(m *ebpf.Map, ports map[string]struct{}) error {
 	for p := range ports {
-		parsed, err := strconv.ParseUint(p, 10, 16)
+		port, protocol, err := parsePort(p)
 		if err != nil {
-			return fmt.Errorf("invalid port %s", p)
+			return err
 		}
-		port := uint16(parsed)
-
-		v := byte(1)
-		if err := m.Put(unsafe.Pointer(&port), unsafe.Pointer(&v)); err != nil {
+		if err := m.Put(unsafe.Pointer(&port), unsafe.Pointer(&protocol)); err != nil {
 			return err
 		}
 	}
@@ -282,6 +611,95 @@ func initPortMap(m *ebpf.Map, ports map[string]struct{}) error {
 	return nil
 }
 
+// PortSuffixHTTP marks a port of plaintext HTTP, e.g. "80/http". The
+// Host header of the first request of a connection is used as its SNI.
+const PortSuffixHTTP = "/http"
+
+// PortSuffixUDP marks a port of UDP, e.g. "51820/udp". The flows to it
+// are tracked instead of the connections of TCP.
+const PortSuffixUDP = "/udp"
+
+// PortSuffixSCTP marks a port of SCTP, e.g. "3868/sctp". Its
+// associations are tracked like the connections of TCP and accounted
+// to the pseudo SNI of the port, e.g. "__sctp__:3868".
+const PortSuffixSCTP = "/sctp"
+
+// parsePort parses a port with an optional protocol suffix and returns
+// the port and its protocol, PORT_PROTOCOL_TLS without a suffix.
+func parsePort(p string) (uint16, byte, error) {
+	protocol := byte(C.PORT_PROTOCOL_TLS)
+	switch {
+	case strings.HasSuffix(p, PortSuffixHTTP):
+		p = strings.TrimSuffix(p, PortSuffixHTTP)
+		protocol = C.PORT_PROTOCOL_HTTP
+	case strings.HasSuffix(p, PortSuffixUDP):
+		p = strings.TrimSuffix(p, PortSuffixUDP)
+		protocol = C.PORT_PROTOCOL_UDP
+	case strings.HasSuffix(p, PortSuffixSCTP):
+		p = strings.TrimSuffix(p, PortSuffixSCTP)
+		protocol = C.PORT_PROTOCOL_SCTP
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s", p)
+	}
+	return uint16(port), protocol, nil
+}
+
+// forwardConfig configures the packets the eBPF program passes on to
+// the attached sockets. It mirrors the forward_config_t C struct.
+type forwardConfig struct {
+	enabled bool
+	// snapLength is the number of bytes passed on, 0 means up to
+	// the end of the TLS record header.
+	snapLength uint32
+}
+
+// captureConfig configures the capture of the eBPF program. It mirrors
+// the capture_config_t C struct.
+type captureConfig struct {
+	// span captures mirrored traffic.
+	span bool
+	// tunnels are decapsulated.
+	tunnels tunnelPorts
+	// proxySourceIP accounts the connections with a PROXY protocol
+	// header for the original client of the header.
+	proxySourceIP bool
+	// observePartialMatches counts the partial matches per server.
+	observePartialMatches bool
+	// deferHandshakeOnly counts open TLS connections as succeeded
+	// only once the client sent application data.
+	deferHandshakeOnly bool
+}
+
+// capture returns the capture configuration of the options.
+func (o setupOptions) capture() captureConfig {
+	return captureConfig{span: o.span, tunnels: o.tunnels, proxySourceIP: o.proxySourceIP, observePartialMatches: o.observePartialMatches, deferHandshakeOnly: o.deferHandshakeOnly}
+}
+
+func initCaptureMap(m *ebpf.Map, capture captureConfig) error {
+	var zero uint32
+	value := C.struct_capture_config_t{
+		span:                    C.__u32(boolToUint64(capture.span)),
+		vxlan_port:              C.__u16(capture.tunnels.vxlan),
+		geneve_port:             C.__u16(capture.tunnels.geneve),
+		gtpu_port:               C.__u16(capture.tunnels.gtpu),
+		proxy_source_ip:         C.__u32(boolToUint64(capture.proxySourceIP)),
+		observe_partial_matches: C.__u32(boolToUint64(capture.observePartialMatches)),
+		defer_handshake_only:    C.__u32(boolToUint64(capture.deferHandshakeOnly)),
+	}
+	return m.Put(unsafe.Pointer(&zero), unsafe.Pointer(&value))
+}
+
+func initForwardMap(m *ebpf.Map, forward forwardConfig) error {
+	var zero uint32
+	value := C.struct_forward_config_t{
+		enabled: C.__u32(boolToUint64(forward.enabled)),
+		snaplen: C.__u32(forward.snapLength),
+	}
+	return m.Put(unsafe.Pointer(&zero), unsafe.Pointer(&value))
+}
+
 func initTestHookMap(m *ebpf.Map, i uint64) error {
 	var zero uint32 = 0
 	if err := m.Put(unsafe.Pointer(&zero), unsafe.Pointer(&i)); err != nil {
@@ -290,25 +708,78 @@ func initTestHookMap(m *ebpf.Map, i uint64) error {
 	return nil
 }
 
-func initStatsMap(m *ebpf.Map) error {
-	var clock uint32
-	for clock = 0; clock < C.STATS_SECONDS_COUNT; clock++ {
-		innerMap, err := ebpf.NewMap(&ebpf.MapSpec{
-			Name:       "sni_stats",
-			Type:       ebpf.Hash,
-			KeySize:    C.TLS_MAX_SERVER_NAME_LEN+8,
-			ValueSize:  16,
-			MaxEntries: C.MAX_SERVER_COUNT,
-		})
+// newInnerStatsMap creates an inner map of the stats map. The entries
+// of hash maps are pre-allocated, so the kernel does not allocate
+// memory when a packet adds an entry.
+func newInnerStatsMap() (*ebpf.Map, error) {
+	return ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "sni_stats",
+		Type:       ebpf.Hash,
+		KeySize:    C.sizeof_struct_stats_key_t,
+		ValueSize:  C.sizeof_struct_sni_stats_t,
+		MaxEntries: C.MAX_SERVER_COUNT,
+	})
+}
+
+// initStatsMap sets the number of slots of the stats map in use, 0 for
+// C.STATS_SECONDS_COUNT. It fills the slots without an inner map and
+// allocates the spare inner map of the config, so it can be called
+// again with more slots.
+func initStatsMap(config *ebpfConfig, slots uint64) error {
+	if slots == 0 {
+		slots = C.STATS_SECONDS_COUNT
+	}
+	if slots < 2 || slots > C.STATS_MAX_SLOTS {
+		return fmt.Errorf("invalid number of stats slots %d, expected 2 to %d", slots, C.STATS_MAX_SLOTS)
+	}
+	var slot uint32
+	for slot = 0; slot < uint32(slots); slot++ {
+		var innerMap *ebpf.Map
+		if err := config.statsMap.Lookup(slot, &innerMap); err == nil {
+			innerMap.Close()
+			continue
+		}
+		innerMap, err := newInnerStatsMap()
 		if err != nil {
 			return err
 		}
-		innerMapFdUint32 := uint32(innerMap.FD())
-
-		if err := m.Put(unsafe.Pointer(&clock), innerMapFdUint32); err != nil {
+		// The stats map holds a reference to the inner map.
+		err = config.statsMap.Put(slot, innerMap)
+		innerMap.Close()
+		if err != nil {
 			return err
 		}
 	}
+	if err := writeStatsConfig(config, slots, config.countDataBytes); err != nil {
+		return err
+	}
+	config.slots = slots
+	if config.spareStatsMap == nil {
+		spare, err := newInnerStatsMap()
+		if err != nil {
+			return err
+		}
+		config.spareStatsMap = spare
+	}
+	return nil
+}
+
+func writeStatsConfig(config *ebpfConfig, slots uint64, countDataBytes bool) error {
+	var zero uint32
+	value := C.struct_stats_config_t{slots: C.__u32(slots), count_data_bytes: C.__u32(boolToUint64(countDataBytes))}
+	return config.statsConfigMap.Put(unsafe.Pointer(&zero), unsafe.Pointer(&value))
+}
+
+// setDataBytesCounting enables or disables the counting of the payload
+// bytes in the data bytes map.
+func setDataBytesCounting(config *ebpfConfig, enabled bool) error {
+	if enabled == config.countDataBytes {
+		return nil
+	}
+	if err := writeStatsConfig(config, config.slots, enabled); err != nil {
+		return err
+	}
+	config.countDataBytes = enabled
 	return nil
 }
 
@@ -344,6 +815,11 @@ func htons(i uint16) uint16 {
 	return *(*uint16)(unsafe.Pointer(&b[0]))
 }
 
+// ntohs converts the unsigned short integer netshort from network byte order to host byte order.
+func ntohs(i uint16) uint16 {
+	return htons(i)
+}
+
 type tuple struct {
 	srcIP, dstIP     net.IP
 	srcPort, dstPort uint16
@@ -374,15 +850,115 @@ const (
 	RST_SENT_BY_CLIENT
 	RST_SENT_BY_SERVER
 	FIN_RECEIVED
+	RST_SENT_BY_MIDDLEBOX
+	ICMP_UNREACHABLE
 )
 
+func (s connState) String() string {
+	switch s {
+	case SYN_RECEIVED:
+		return "syn_received"
+	case SYNACK_RECEIVED:
+		return "synack_received"
+	case SNI_RECEIVED:
+		return "sni_received"
+	case RST_SENT_BY_CLIENT:
+		return "rst_sent_by_client"
+	case RST_SENT_BY_SERVER:
+		return "rst_sent_by_server"
+	case FIN_RECEIVED:
+		return "fin_received"
+	case RST_SENT_BY_MIDDLEBOX:
+		return "rst_sent_by_middlebox"
+	case ICMP_UNREACHABLE:
+		return "icmp_unreachable"
+	default:
+		return "unknown"
+	}
+}
+
 // Mirrors the tuple_data_t C struct.
 type tupleData struct {
 	state                  connState
-	sourceIP net.IP
-	destIP net.IP
+	sourceIP               net.IP
+	destIP                 net.IP
 	sni                    string
 	tickerClockFirstPacket uint64
+	// The TTL of the last non-RST packets from both peers.
+	clientTTL, serverTTL uint8
+	// icmpCode is the code of the ICMP destination unreachable in
+	// state ICMP_UNREACHABLE.
+	icmpCode   uint8
+	congestion congestionSignals
+	// serverHelloSeen is set once the server answered the ClientHello,
+	// handshakeFinished once the client sent its Finished.
+	serverHelloSeen, handshakeFinished bool
+	// httpHost is set if the SNI is the Host header of a plaintext
+	// HTTP request.
+	httpHost bool
+	// sctp is set if the connection is an SCTP association, whose SNI
+	// is the pseudo SNI of its port.
+	sctp bool
+	// noSNI is set if the connection had no SNI and is accounted for
+	// the pseudo SNI of its port, see SetNoSNIPrefix.
+	noSNI bool
+	// proxied is set if the stream of the client started with a PROXY
+	// protocol header. sourceIP is then the original client of the
+	// header if SetProxySourceIP enabled it.
+	proxied bool
+	// certificateRequested is set if the server requested a client
+	// certificate with TLS 1.2.
+	certificateRequested bool
+	// mptcpSubflow is set if the connection is an additional subflow
+	// of an MPTCP connection, which is not accounted on its own.
+	mptcpSubflow bool
+	// latency is zero until measured.
+	latency latencySample
+	// tls13 is set if the ServerHello negotiated TLS 1.3.
+	tls13 bool
+	// clientAppDataRecords is the number of ApplicationData records
+	// from the client, up to the minimum of minAppDataRecords.
+	clientAppDataRecords uint32
+	// transitions has the bits of the observed state transitions set,
+	// see transitionNames.
+	transitions uint32
+}
+
+// handshakeOnly checks whether the TLS handshake succeeded, but the
+// client sent no application data.
+func (td *tupleData) handshakeOnly() bool {
+	return td.serverHelloSeen && td.clientAppDataRecords < td.minAppDataRecords()
+}
+
+// minAppDataRecords returns the number of ApplicationData records of
+// the client the connection needs to carry application data. With TLS
+// 1.3, the Finished of the client is the first one.
+func (td *tupleData) minAppDataRecords() uint32 {
+	if td.tls13 {
+		return C.CONN_MIN_APP_DATA_RECORDS_TLS_1_3
+	}
+	return C.CONN_MIN_APP_DATA_RECORDS
+}
+
+// handshakeFailed checks whether the connection was closed in the
+// second half of the TLS handshake, after the ServerHello.
+func (td *tupleData) handshakeFailed() bool {
+	return td.closed() && td.serverHelloSeen && !td.handshakeFinished
+}
+
+// establishedReset checks whether the server or a middlebox reset the
+// connection after the TLS handshake finished.
+func (td *tupleData) establishedReset() bool {
+	return td.handshakeFinished && (td.state == RST_SENT_BY_SERVER || td.state == RST_SENT_BY_MIDDLEBOX)
+}
+
+func (td *tupleData) closed() bool {
+	switch td.state {
+	case RST_SENT_BY_CLIENT, RST_SENT_BY_SERVER, RST_SENT_BY_MIDDLEBOX, ICMP_UNREACHABLE, FIN_RECEIVED:
+		return true
+	default:
+		return false
+	}
 }
 
 // Creates a tupleData from a C.struct_tuple_data_t and returns a pointer to
@@ -403,42 +979,209 @@ func tupleDataFromC(td C.struct_tuple_data_t) *tupleData {
 	}
 
 	res := tupleData{
-		state: connState(td.state),
-		// Cut the SNI at the first zero byte. This removes any zero bytes we
-		// get from the null-terminated C string and also ensures we don't have
-		// zero bytes in the middle of the SNI.
-		sourceIP: net.IP(sourceIP),
-		destIP: net.IP(destIP),
-		sni:                    string(bytes.SplitN(sni, []byte{0}, 2)[0]),
+		state:                  connState(td.state),
+		sourceIP:               net.IP(sourceIP),
+		destIP:                 net.IP(destIP),
+		sni:                    sniFromC(sni),
 		tickerClockFirstPacket: uint64(td.ticker_clock_first_packet),
+		clientTTL:              uint8(td.client_ttl),
+		serverTTL:              uint8(td.server_ttl),
+		icmpCode:               uint8(td.icmp_code),
+		congestion: congestionSignals{
+			ecnRequested: boolToUint64(td.ecn_flags&C.ECN_REQUESTED != 0),
+			ecnAccepted:  boolToUint64(td.ecn_flags&C.ECN_ACCEPTED != 0),
+			cePackets:    uint64(td.ce_packets),
+			ecePackets:   uint64(td.ece_packets),
+			cwrPackets:   uint64(td.cwr_packets),
+		},
+		serverHelloSeen:      td.tls_flags&C.TLS_SERVER_HELLO_SEEN != 0,
+		handshakeFinished:    td.tls_flags&C.TLS_HANDSHAKE_FINISHED != 0,
+		httpHost:             td.tls_flags&C.HTTP_HOST_PARSED != 0,
+		sctp:                 td.tls_flags&C.SCTP_ASSOCIATION != 0,
+		noSNI:                td.tls_flags&C.NO_SNI_ACCOUNTED != 0,
+		proxied:              td.tls_flags&C.PROXY_HEADER_SKIPPED != 0,
+		certificateRequested: td.tls_flags&C.TLS_CERTIFICATE_REQUESTED != 0,
+		mptcpSubflow:         td.tls_flags&C.MPTCP_SUBFLOW != 0,
+		tls13:                td.tls_flags&C.TLS_1_3_NEGOTIATED != 0,
+		latency:              latencySampleFromC(td.connect_latency_us, td.handshake_latency_us, td.handshake_duration_us),
+		clientAppDataRecords: uint32(td.client_app_data_records),
+		transitions:          uint32(td.transitions),
 	}
 
 	return &res
 }
 
+// Mirrors the sni_stats_t C struct.
+type sniStats struct {
+	succeededConnections uint64
+	failedConnections    uint64
+	middleboxResets      uint64
+	// icmpUnreachable are the connections rejected by the network
+	// with an ICMP destination unreachable, per ICMP code.
+	icmpUnreachable     [C.ICMP_UNREACHABLE_CODE_COUNT]uint64
+	handshakesAbandoned uint64
+	handshakesOnly      uint64
+	handshakesFailed    uint64
+	establishedResets   uint64
+	// certificateRequests are the connections whose server requested a
+	// client certificate, certificateRequestFailures those of them
+	// closed in the handshake.
+	certificateRequests        uint64
+	certificateRequestFailures uint64
+	congestion                 congestionSignals
+	// transitions are the closed connections per state transition,
+	// indexed like transitionNames.
+	transitions [C.TRANSITION_COUNT]uint64
+	// resets are the connections closed by a reset, indexed like
+	// metrics.RSTOrigins.
+	resets [C.RST_ORIGIN_COUNT]uint64
+	// latencies are the latencies of the first closed connections.
+	latencies []latencySample
+}
+
+// latencySample is the connect and the handshake latency of a
+// connection and the duration of its handshake from the SYN to the
+// ServerHello, a latency is zero if it was not measured.
+type latencySample struct {
+	connect, handshake, handshakeDuration time.Duration
+}
+
+// addTo adds the measured latencies to the increment.
+func (l latencySample) addTo(inc *metrics.Inc) {
+	if l.connect > 0 {
+		inc.ConnectLatencies = append(inc.ConnectLatencies, l.connect)
+	}
+	if l.handshake > 0 {
+		inc.HandshakeLatencies = append(inc.HandshakeLatencies, l.handshake)
+	}
+	if l.handshakeDuration > 0 {
+		inc.HandshakeDurations = append(inc.HandshakeDurations, l.handshakeDuration)
+	}
+}
+
+func latencySampleFromC(connectUS, handshakeUS, durationUS C.__u32) latencySample {
+	return latencySample{
+		connect:           time.Duration(connectUS) * time.Microsecond,
+		handshake:         time.Duration(handshakeUS) * time.Microsecond,
+		handshakeDuration: time.Duration(durationUS) * time.Microsecond,
+	}
+}
+
+// congestionSignals are the ECN negotiations and the congestion
+// signals of one or more connections.
+type congestionSignals struct {
+	ecnRequested, ecnAccepted         uint64
+	cePackets, ecePackets, cwrPackets uint64
+}
+
+func (c *congestionSignals) add(other congestionSignals) {
+	c.ecnRequested += other.ecnRequested
+	c.ecnAccepted += other.ecnAccepted
+	c.cePackets += other.cePackets
+	c.ecePackets += other.ecePackets
+	c.cwrPackets += other.cwrPackets
+}
+
+func sniStatsFromC(s C.struct_sni_stats_t) sniStats {
+	stats := sniStats{
+		succeededConnections:       uint64(s.succeeded_connections),
+		failedConnections:          uint64(s.failed_connections),
+		middleboxResets:            uint64(s.middlebox_resets),
+		handshakesAbandoned:        uint64(s.handshakes_abandoned),
+		handshakesOnly:             uint64(s.handshakes_only),
+		handshakesFailed:           uint64(s.handshakes_failed),
+		establishedResets:          uint64(s.established_resets),
+		certificateRequests:        uint64(s.certificate_requests),
+		certificateRequestFailures: uint64(s.certificate_request_failures),
+		congestion: congestionSignals{
+			ecnRequested: uint64(s.ecn_requested),
+			ecnAccepted:  uint64(s.ecn_accepted),
+			cePackets:    uint64(s.ce_packets),
+			ecePackets:   uint64(s.ece_packets),
+			cwrPackets:   uint64(s.cwr_packets),
+		},
+	}
+	for i, n := range s.icmp_unreachable {
+		stats.icmpUnreachable[i] = uint64(n)
+	}
+	for i, n := range s.transitions {
+		stats.transitions[i] = uint64(n)
+	}
+	for i, n := range s.resets {
+		stats.resets[i] = uint64(n)
+	}
+	for i := 0; i < int(s.latency_samples) && i < C.LATENCY_SAMPLE_COUNT; i++ {
+		stats.latencies = append(stats.latencies, latencySampleFromC(s.connect_latency_us[i], s.handshake_latency_us[i], s.handshake_duration_us[i]))
+	}
+	return stats
+}
+
+func (s *sniStats) add(other sniStats) {
+	s.succeededConnections += other.succeededConnections
+	s.failedConnections += other.failedConnections
+	s.middleboxResets += other.middleboxResets
+	s.handshakesAbandoned += other.handshakesAbandoned
+	s.handshakesOnly += other.handshakesOnly
+	s.handshakesFailed += other.handshakesFailed
+	s.establishedResets += other.establishedResets
+	s.certificateRequests += other.certificateRequests
+	s.certificateRequestFailures += other.certificateRequestFailures
+	s.congestion.add(other.congestion)
+	for i, n := range other.icmpUnreachable {
+		s.icmpUnreachable[i] += n
+	}
+	for i, n := range other.transitions {
+		s.transitions[i] += n
+	}
+	for i, n := range other.resets {
+		s.resets[i] += n
+	}
+	s.latencies = append(s.latencies, other.latencies...)
+}
+
+func boolToUint64(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// empty checks whether no connection was completed.
+func (s sniStats) empty() bool {
+	return s.succeededConnections == 0 && s.failedConnections == 0 && s.middleboxResets == 0 && s.networkRejections() == 0
+}
+
+// networkRejections returns the connections rejected by the network
+// with any ICMP code.
+func (s sniStats) networkRejections() uint64 {
+	var n uint64
+	for _, c := range s.icmpUnreachable {
+		n += c
+	}
+	return n
+}
+
 // Query the BPF stats map.
-func getStats(outerMap *ebpf.Map) (out []map[string][2]uint64, err error) {
+func getStats(outerMap *ebpf.Map) (out []map[string]sniStats, err error) {
 	var outerKey uint32
 	var innerMap *ebpf.Map
 
-	out = make([]map[string][2]uint64, C.STATS_SECONDS_COUNT)
+	out = make([]map[string]sniStats, C.STATS_MAX_SLOTS)
 	outerEntries := outerMap.Iterate()
 	for outerEntries.Next(&outerKey, &innerMap) {
 		if outerKey >= uint32(len(out)) {
-			return nil, errors.New("More than 20 entries in the stats map")
+			return nil, fmt.Errorf("More than %d entries in the stats map", C.STATS_MAX_SLOTS)
 		}
-		out[outerKey] = make(map[string][2]uint64)
+		out[outerKey] = make(map[string]sniStats)
 
-		var innerKey string
-		var innerValue [2]uint64
+		var innerKey C.struct_stats_key_t
+		var innerValue C.struct_sni_stats_t
 		innerEntries := innerMap.Iterate()
-		for innerEntries.Next(&innerKey, &innerValue) {
-			sniString := strings.SplitN(innerKey[8:], "\000", 2)[0]
+		for innerEntries.Next(unsafe.Pointer(&innerKey), unsafe.Pointer(&innerValue)) {
+			sniString := statsKeyFromC(innerKey).sni
 			klog.InfoS("getStats", "sni", sniString)
 
-			// succeeded_connections := innerValue[0]
-			// failed_connections := innerValue[1]
-			out[outerKey][sniString] = innerValue
+			out[outerKey][sniString] = sniStatsFromC(innerValue)
 		}
 		if err := innerEntries.Err(); err != nil {
 			return nil, err
@@ -470,29 +1213,86 @@ func getConnection(m *ebpf.Map, t *tuple) (*tupleData, error) {
 func setConnection(m *ebpf.Map, t *tuple, td *tupleData) error {
 	key := t.toBytes()
 
-	if len(td.sni) > C.TLS_MAX_SERVER_NAME_LEN {
-		return fmt.Errorf("SNI field is too long: got %d, allowed %d",
-			len(td.sni), C.TLS_MAX_SERVER_NAME_LEN)
+	v, err := tupleDataToC(td)
+	if err != nil {
+		return err
+	}
+
+	return m.Put(unsafe.Pointer(&key), unsafe.Pointer(&v))
+}
+
+// Creates a C.struct_tuple_data_t from a tupleData.
+func tupleDataToC(td *tupleData) (C.struct_tuple_data_t, error) {
+	sniBytes := sniToC(td.sni)
+	if len(sniBytes) > C.TLS_MAX_SERVER_NAME_LEN {
+		return C.struct_tuple_data_t{}, fmt.Errorf("SNI field is too long: got %d, allowed %d",
+			len(sniBytes), C.TLS_MAX_SERVER_NAME_LEN)
 	}
 
 	// TODO: Maybe we can avoid copying here.
-	var sni [C.TLS_MAX_SERVER_NAME_LEN+8]byte
+	var sni [C.sizeof_struct_stats_key_t]byte
 	for i, v := range td.sourceIP {
 		sni[i] = v
 	}
 	for i, v := range td.destIP {
 		sni[i+4] = v
 	}
-	for i, v := range td.sni {
-		sni[i+8] = byte(v)
-	}
+	copy(sni[8:], sniBytes)
 
-	v := C.struct_tuple_data_t{
-		state: uint32(td.state),
-		i:   sni,
+	var ecnFlags C.__u32
+	if td.congestion.ecnRequested > 0 {
+		ecnFlags |= C.ECN_REQUESTED
+	}
+	if td.congestion.ecnAccepted > 0 {
+		ecnFlags |= C.ECN_ACCEPTED
+	}
+	var tlsFlags C.__u32
+	if td.serverHelloSeen {
+		tlsFlags |= C.TLS_SERVER_HELLO_SEEN
+	}
+	if td.handshakeFinished {
+		tlsFlags |= C.TLS_HANDSHAKE_FINISHED
+	}
+	if td.httpHost {
+		tlsFlags |= C.HTTP_HOST_PARSED
+	}
+	if td.sctp {
+		tlsFlags |= C.SCTP_ASSOCIATION
+	}
+	if td.noSNI {
+		tlsFlags |= C.NO_SNI_ACCOUNTED
+	}
+	if td.proxied {
+		tlsFlags |= C.PROXY_HEADER_SKIPPED
+	}
+	if td.certificateRequested {
+		tlsFlags |= C.TLS_CERTIFICATE_REQUESTED
+	}
+	if td.mptcpSubflow {
+		tlsFlags |= C.MPTCP_SUBFLOW
+	}
+	if td.tls13 {
+		tlsFlags |= C.TLS_1_3_NEGOTIATED
 	}
 
-	return m.Put(unsafe.Pointer(&key), unsafe.Pointer(&v))
+	return C.struct_tuple_data_t{
+		state:                     uint32(td.state),
+		i:                         sni,
+		ticker_clock_first_packet: C.__u64(td.tickerClockFirstPacket),
+		client_ttl:                C.__u8(td.clientTTL),
+		server_ttl:                C.__u8(td.serverTTL),
+		icmp_code:                 C.__u8(td.icmpCode),
+		ecn_flags:                 ecnFlags,
+		ce_packets:                C.__u32(td.congestion.cePackets),
+		ece_packets:               C.__u32(td.congestion.ecePackets),
+		cwr_packets:               C.__u32(td.congestion.cwrPackets),
+		tls_flags:                 tlsFlags,
+		connect_latency_us:        C.__u32(td.latency.connect / time.Microsecond),
+		handshake_latency_us:      C.__u32(td.latency.handshake / time.Microsecond),
+		handshake_duration_us:     C.__u32(td.latency.handshakeDuration / time.Microsecond),
+		client_app_data_records:   C.__u32(td.clientAppDataRecords),
+		transitions:               C.__u32(td.transitions),
+	}, nil
 }
 
 type tcpFlag struct {
@@ -520,3 +1320,18 @@ func flagsString(flags byte) string {
 	}
 	return fmt.Sprintf("[%s]", strings.Join(r, ""))
 }
+
+// icmpCodeName returns the name of the code of an ICMP destination
+// unreachable, the icmp_code label.
+func icmpCodeName(code uint8) string {
+	if int(code) < len(metrics.ICMPUnreachableCodes) {
+		return metrics.ICMPUnreachableCodes[code]
+	}
+	return strconv.Itoa(int(code))
+}
+
+// rstOriginName returns the name of the origin of a reset, one of
+// the RST_ORIGIN_* constants, the rst_origin label.
+func rstOriginName(origin int) string {
+	return metrics.RSTOrigins[origin]
+}
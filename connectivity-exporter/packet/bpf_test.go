@@ -43,6 +43,9 @@ func TestConnectionTracking(t *testing.T) {
 		// packets (e.g. SYN/ACK).
 		serverToClient          bool
 		FIN, SYN, RST, PSH, ACK bool
+		TTL                     uint8
+		// Captures mirrored traffic.
+		span bool
 		// When true, we don't expect to find a connection for that test case.
 		shouldFail bool
 		wantState  connState
@@ -92,6 +95,80 @@ func TestConnectionTracking(t *testing.T) {
 			ACK:            true,
 			shouldFail:     true,
 		},
+		{
+			desc:  "RST packet from server",
+			cidrs: "127.0.0.1/32",
+			ports: "443",
+			initialState: map[*tuple]*tupleData{
+				{
+					srcIP:   net.ParseIP("127.0.0.2"),
+					dstIP:   net.ParseIP("127.0.0.1"),
+					srcPort: 10000,
+					dstPort: 443,
+				}: {state: SYNACK_RECEIVED, serverTTL: 60},
+			},
+			srcAddr:        net.ParseIP("127.0.0.1"),
+			destAddr:       net.ParseIP("127.0.0.2"),
+			srcPort:        443,
+			destPort:       10000,
+			serverToClient: true,
+			RST:            true,
+			TTL:            59,
+			wantState:      RST_SENT_BY_SERVER,
+		},
+		{
+			desc:  "RST packet injected by middlebox",
+			cidrs: "127.0.0.1/32",
+			ports: "443",
+			initialState: map[*tuple]*tupleData{
+				{
+					srcIP:   net.ParseIP("127.0.0.2"),
+					dstIP:   net.ParseIP("127.0.0.1"),
+					srcPort: 10000,
+					dstPort: 443,
+				}: {state: SYNACK_RECEIVED, serverTTL: 60},
+			},
+			srcAddr:        net.ParseIP("127.0.0.1"),
+			destAddr:       net.ParseIP("127.0.0.2"),
+			srcPort:        443,
+			destPort:       10000,
+			serverToClient: true,
+			RST:            true,
+			TTL:            250,
+			wantState:      RST_SENT_BY_MIDDLEBOX,
+		},
+		{
+			desc:      "SYN packet between configured ports, mirrored",
+			cidrs:     "127.0.0.1/32",
+			ports:     "443",
+			srcAddr:   net.ParseIP("127.0.0.2"),
+			destAddr:  net.ParseIP("127.0.0.1"),
+			srcPort:   443,
+			destPort:  443,
+			SYN:       true,
+			span:      true,
+			wantState: SYN_RECEIVED,
+		},
+		{
+			desc:  "RST packet between configured ports from client, mirrored",
+			cidrs: "127.0.0.1/32",
+			ports: "443",
+			initialState: map[*tuple]*tupleData{
+				{
+					srcIP:   net.ParseIP("127.0.0.2"),
+					dstIP:   net.ParseIP("127.0.0.1"),
+					srcPort: 443,
+					dstPort: 443,
+				}: {state: SYNACK_RECEIVED},
+			},
+			srcAddr:   net.ParseIP("127.0.0.2"),
+			destAddr:  net.ParseIP("127.0.0.1"),
+			srcPort:   443,
+			destPort:  443,
+			RST:       true,
+			span:      true,
+			wantState: RST_SENT_BY_CLIENT,
+		},
 	}
 
 	for _, tc := range tests {
@@ -108,6 +185,9 @@ func TestConnectionTracking(t *testing.T) {
 			if err := initPortMap(ec.portMap, AsSet(tc.ports)); err != nil {
 				t.Fatalf("Initializing port map: %v", err)
 			}
+			if err := initCaptureMap(ec.captureMap, captureConfig{span: tc.span}); err != nil {
+				t.Fatalf("Initializing capture map: %v", err)
+			}
 
 			// Initialize connection map to match test scenario.
 			for k, v := range tc.initialState {
@@ -130,6 +210,7 @@ func TestConnectionTracking(t *testing.T) {
 				&layers.IPv4{
 					SrcIP:    tc.srcAddr,
 					DstIP:    tc.destAddr,
+					TTL:      tc.TTL,
 					Protocol: layers.IPProtocolTCP,
 				},
 				&layers.TCP{
@@ -193,8 +274,205 @@ func TestConnectionTracking(t *testing.T) {
 	}
 }
 
+// TestVLANTags checks that the IP header is found behind the VLAN tags
+// of the frames of VLAN sub-interfaces and QinQ, up to two tags.
+func TestVLANTags(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		// tags are the EtherTypes of the VLAN tags, outermost first.
+		tags        []layers.EthernetType
+		wantTracked bool
+	}{
+		{desc: "untagged", wantTracked: true},
+		{desc: "802.1Q", tags: []layers.EthernetType{layers.EthernetTypeDot1Q}, wantTracked: true},
+		{desc: "QinQ with 802.1ad", tags: []layers.EthernetType{layers.EthernetTypeQinQ, layers.EthernetTypeDot1Q}, wantTracked: true},
+		{desc: "QinQ with 802.1Q", tags: []layers.EthernetType{layers.EthernetTypeDot1Q, layers.EthernetTypeDot1Q}, wantTracked: true},
+		{desc: "three tags", tags: []layers.EthernetType{layers.EthernetTypeQinQ, layers.EthernetTypeDot1Q, layers.EthernetTypeDot1Q}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ec, err := newEBPFConfig()
+			if err != nil {
+				t.Fatalf("Creating eBPF config: %v", err)
+			}
+			defer ec.Close()
+			if err := initCIDRMap(ec.cidrMap, AsSet("127.0.0.1/32")); err != nil {
+				t.Fatalf("Initializing CIDR map: %v", err)
+			}
+			if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+				t.Fatalf("Initializing port map: %v", err)
+			}
+
+			// Every header carries the EtherType of the next one.
+			types := append(append([]layers.EthernetType{}, tc.tags...), layers.EthernetTypeIPv4)
+			headers := []gopacket.SerializableLayer{&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{1, 1, 1, 1, 1, 1},
+				DstMAC:       net.HardwareAddr{2, 2, 2, 2, 2, 2},
+				EthernetType: types[0],
+			}}
+			for i := range tc.tags {
+				headers = append(headers, &layers.Dot1Q{VLANIdentifier: uint16(100 + i), Type: types[i+1]})
+			}
+			headers = append(headers,
+				&layers.IPv4{SrcIP: net.ParseIP("127.0.0.2"), DstIP: net.ParseIP("127.0.0.1"), Protocol: layers.IPProtocolTCP},
+				&layers.TCP{SYN: true, SrcPort: 10000, DstPort: 443},
+			)
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, headers...); err != nil {
+				t.Fatalf("Serializing layers: %v", err)
+			}
+			packet := append(make([]byte, 14), buf.Bytes()...)
+			if _, _, err := ec.prog.Benchmark(packet, 1, nil); err != nil {
+				t.Fatalf("Executing program: %v", err)
+			}
+
+			_, err = getConnection(ec.connectionMap, &tuple{
+				srcIP:   net.ParseIP("127.0.0.2"),
+				dstIP:   net.ParseIP("127.0.0.1"),
+				srcPort: 10000,
+				dstPort: 443,
+			})
+			if tracked := err == nil; tracked != tc.wantTracked {
+				t.Errorf("Got tracked %v, want %v", tracked, tc.wantTracked)
+			}
+		})
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	serialize := func(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+		t.Helper()
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+			t.Fatalf("Serializing layers: %v", err)
+		}
+		return buf.Bytes()
+	}
+	ethernet := func(t layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 1, 1, 1, 1, 1}, DstMAC: net.HardwareAddr{2, 2, 2, 2, 2, 2}, EthernetType: t}
+	}
+	syn := func(t *testing.T) []byte {
+		return serialize(t,
+			&layers.IPv4{SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("10.0.0.1"), Protocol: layers.IPProtocolTCP},
+			&layers.TCP{SYN: true, SrcPort: 10000, DstPort: 443},
+		)
+	}
+	innerFrame := func(t *testing.T) []byte {
+		return append(serialize(t, ethernet(layers.EthernetTypeIPv4)), syn(t)...)
+	}
+	vxlan := []byte{0x08, 0, 0, 0, 0, 0, 42, 0}
+	// A Geneve header with one option of 4 bytes and the option.
+	geneve := func(protocol layers.EthernetType) []byte {
+		return []byte{0x01, 0, byte(protocol >> 8), byte(protocol), 0, 0, 42, 0, 0, 0, 0, 0}
+	}
+	// A GTP-U G-PDU header without optional fields.
+	gtpu := []byte{0x30, 0xff, 0, 0, 0, 0, 0, 42}
+	// A GTP-U G-PDU header with the optional fields and the PDU session
+	// container extension header of N3.
+	gtpuPDUSession := []byte{0x34, 0xff, 0, 0, 0, 0, 0, 42, 0, 0, 0, 0x85, 0x01, 0x10, 0x01, 0x00}
+	// A GTP-U echo request.
+	gtpuEcho := []byte{0x32, 0x01, 0, 4, 0, 0, 0, 0, 0, 1, 0, 0}
+
+	for _, tc := range []struct {
+		desc        string
+		tunnels     tunnelPorts
+		dstPort     uint16
+		tunnel      func(t *testing.T) []byte
+		wantTracked bool
+	}{
+		{
+			desc:        "VXLAN",
+			tunnels:     tunnelPorts{vxlan: 4789},
+			dstPort:     4789,
+			tunnel:      func(t *testing.T) []byte { return append(vxlan, innerFrame(t)...) },
+			wantTracked: true,
+		},
+		{
+			desc:    "VXLAN without decapsulation",
+			dstPort: 4789,
+			tunnel:  func(t *testing.T) []byte { return append(vxlan, innerFrame(t)...) },
+		},
+		{
+			desc:    "VXLAN to another port",
+			tunnels: tunnelPorts{vxlan: 8472},
+			dstPort: 4789,
+			tunnel:  func(t *testing.T) []byte { return append(vxlan, innerFrame(t)...) },
+		},
+		{
+			desc:        "Geneve with an Ethernet frame",
+			tunnels:     tunnelPorts{geneve: 6081},
+			dstPort:     6081,
+			tunnel:      func(t *testing.T) []byte { return append(geneve(0x6558), innerFrame(t)...) },
+			wantTracked: true,
+		},
+		{
+			desc:        "Geneve with an IP packet",
+			tunnels:     tunnelPorts{geneve: 6081},
+			dstPort:     6081,
+			tunnel:      func(t *testing.T) []byte { return append(geneve(layers.EthernetTypeIPv4), syn(t)...) },
+			wantTracked: true,
+		},
+		{
+			desc:        "GTP-U",
+			tunnels:     tunnelPorts{gtpu: 2152},
+			dstPort:     2152,
+			tunnel:      func(t *testing.T) []byte { return append(gtpu, syn(t)...) },
+			wantTracked: true,
+		},
+		{
+			desc:        "GTP-U with a PDU session container",
+			tunnels:     tunnelPorts{gtpu: 2152},
+			dstPort:     2152,
+			tunnel:      func(t *testing.T) []byte { return append(gtpuPDUSession, syn(t)...) },
+			wantTracked: true,
+		},
+		{
+			desc:    "GTP-U echo request",
+			tunnels: tunnelPorts{gtpu: 2152},
+			dstPort: 2152,
+			tunnel:  func(t *testing.T) []byte { return append(gtpuEcho, syn(t)...) },
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ec, err := newEBPFConfig()
+			if err != nil {
+				t.Fatalf("Creating eBPF config: %v", err)
+			}
+			defer ec.Close()
+			if err := initCIDRMap(ec.cidrMap, AsSet("10.0.0.1/32")); err != nil {
+				t.Fatalf("Initializing CIDR map: %v", err)
+			}
+			if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+				t.Fatalf("Initializing port map: %v", err)
+			}
+			if err := initCaptureMap(ec.captureMap, captureConfig{tunnels: tc.tunnels}); err != nil {
+				t.Fatalf("Initializing capture map: %v", err)
+			}
+
+			packet := serialize(t,
+				ethernet(layers.EthernetTypeIPv4),
+				&layers.IPv4{SrcIP: net.ParseIP("192.168.0.2"), DstIP: net.ParseIP("192.168.0.1"), Protocol: layers.IPProtocolUDP},
+				&layers.UDP{SrcPort: 50000, DstPort: layers.UDPPort(tc.dstPort)},
+				gopacket.Payload(tc.tunnel(t)),
+			)
+			if _, _, err := ec.prog.Benchmark(append(make([]byte, 14), packet...), 1, nil); err != nil {
+				t.Fatalf("Executing program: %v", err)
+			}
+
+			_, err = getConnection(ec.connectionMap, &tuple{
+				srcIP:   net.ParseIP("10.0.0.2"),
+				dstIP:   net.ParseIP("10.0.0.1"),
+				srcPort: 10000,
+				dstPort: 443,
+			})
+			if tracked := err == nil; tracked != tc.wantTracked {
+				t.Errorf("Got tracked %v, want %v", tracked, tc.wantTracked)
+			}
+		})
+	}
+}
+
 func TestSNI(t *testing.T) {
-	tests := []struct {
+	type sniTest struct {
 		desc string
 		// The state of the connection map before the test packet is processed.
 		// Use this field when testing scenarios which assume a certain state
@@ -207,7 +485,16 @@ func TestSNI(t *testing.T) {
 		destPort     uint16
 		wantState    connState
 		wantSNI      string
-	}{
+		// payload is the TLS payload of the test packet, the client
+		// hello below if nil.
+		payload []byte
+		// proxyHeader is sent before the payload, as by a load balancer.
+		proxyHeader  []byte
+		capture      captureConfig
+		wantProxied  bool
+		wantSourceIP net.IP
+	}
+	tests := []sniTest{
 		{
 			desc: "Basic SNI parsing",
 			initialState: map[*tuple]*tupleData{
@@ -292,8 +579,77 @@ func TestSNI(t *testing.T) {
 		0x00,
 	}
 
+	// The ClientHello behind the PROXY protocol headers of a load
+	// balancer, for the original client 203.0.113.7:56324.
+	proxyV1 := []byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 443\r\n")
+	proxyV2 := []byte{
+		0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a,
+		0x21, 0x11, 0x00, 0x0c,
+		203, 0, 113, 7, 127, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb,
+	}
+	for _, tc := range []struct {
+		desc        string
+		proxyHeader []byte
+		capture     captureConfig
+		wantSource  string
+	}{
+		{"PROXY v1", proxyV1, captureConfig{}, "127.0.0.2"},
+		{"PROXY v1 with the original client", proxyV1, captureConfig{proxySourceIP: true}, "203.0.113.7"},
+		{"PROXY v2", proxyV2, captureConfig{}, "127.0.0.2"},
+		{"PROXY v2 with the original client", proxyV2, captureConfig{proxySourceIP: true}, "203.0.113.7"},
+	} {
+		tests = append(tests, sniTest{
+			desc: tc.desc,
+			initialState: map[*tuple]*tupleData{
+				{
+					srcIP:   net.ParseIP("127.0.0.2"),
+					dstIP:   net.ParseIP("127.0.0.1"),
+					srcPort: 10000,
+					dstPort: 443,
+				}: {state: SYNACK_RECEIVED},
+			},
+			srcAddr:      net.ParseIP("127.0.0.2"),
+			destAddr:     net.ParseIP("127.0.0.1"),
+			srcPort:      10000,
+			destPort:     443,
+			wantState:    SNI_RECEIVED,
+			wantSNI:      "google.com",
+			proxyHeader:  tc.proxyHeader,
+			capture:      tc.capture,
+			wantProxied:  true,
+			wantSourceIP: net.ParseIP(tc.wantSource),
+		})
+	}
+
+	// The ClientHellos of the real TLS stacks in the corpus.
+	for _, e := range loadClientHelloCorpus(t) {
+		tests = append(tests, sniTest{
+			desc: "Corpus " + e.Stack,
+			initialState: map[*tuple]*tupleData{
+				{
+					srcIP:   net.ParseIP("127.0.0.2"),
+					dstIP:   net.ParseIP("127.0.0.1"),
+					srcPort: 10000,
+					dstPort: 443,
+				}: {state: SYNACK_RECEIVED},
+			},
+			srcAddr:   net.ParseIP("127.0.0.2"),
+			destAddr:  net.ParseIP("127.0.0.1"),
+			srcPort:   10000,
+			destPort:  443,
+			wantState: SNI_RECEIVED,
+			wantSNI:   e.SNI,
+			payload:   e.payload,
+		})
+	}
+
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
+			payload := tc.payload
+			if payload == nil {
+				payload = clientHello
+			}
+			payload = append(append([]byte{}, tc.proxyHeader...), payload...)
 			ec, err := newEBPFConfig()
 			if err != nil {
 				t.Fatalf("Creating eBPF config: %v", err)
@@ -306,6 +662,9 @@ func TestSNI(t *testing.T) {
 			if err := initPortMap(ec.portMap, AsSet(fmt.Sprint(tc.destPort))); err != nil {
 				t.Fatalf("Initializing port map: %v", err)
 			}
+			if err := initCaptureMap(ec.captureMap, tc.capture); err != nil {
+				t.Fatalf("Initializing capture map: %v", err)
+			}
 
 			// Initialize connection map to match test scenario.
 			for k, v := range tc.initialState {
@@ -336,7 +695,7 @@ func TestSNI(t *testing.T) {
 					SrcPort: layers.TCPPort(tc.srcPort),
 					DstPort: layers.TCPPort(tc.destPort),
 				},
-				gopacket.Payload(clientHello),
+				gopacket.Payload(payload),
 			)
 			if err != nil {
 				t.Fatalf("Serializing layers: %v", err)
@@ -369,6 +728,12 @@ func TestSNI(t *testing.T) {
 			if td.sni != tc.wantSNI {
 				t.Fatalf("Wrong SNI: got %q, want %q", td.sni, tc.wantSNI)
 			}
+			if td.proxied != tc.wantProxied {
+				t.Fatalf("Wrong PROXY header: got %t, want %t", td.proxied, tc.wantProxied)
+			}
+			if tc.wantSourceIP != nil && !td.sourceIP.Equal(tc.wantSourceIP) {
+				t.Fatalf("Wrong source IP: got %s, want %s", td.sourceIP, tc.wantSourceIP)
+			}
 		})
 	}
 }
@@ -510,7 +875,7 @@ func TestStatMaps(t *testing.T) {
 	if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
 		t.Fatalf("Initializing port map: %v", err)
 	}
-	if err := initStatsMap(ec.statsMap); err != nil {
+	if err := initStatsMap(ec, 0); err != nil {
 		t.Fatalf("Initializing stats map: %v", err)
 	}
 	if err := initTestHookMap(ec.testHookMap, 1); err != nil {
@@ -570,8 +935,8 @@ func TestStatMaps(t *testing.T) {
 		t.Fatalf("Stats: wrong amount of items: %+v", stats)
 	}
 	if s, ok := stats[0]["my-sni-server"]; ok {
-		succeededSeconds := s[0]
-		failedSeconds := s[1]
+		succeededSeconds := s.succeededConnections
+		failedSeconds := s.failedConnections
 
 		if succeededSeconds != 42 {
 			t.Fatalf("Stats: wrong succeededSeconds value for my-sni-server: %v", succeededSeconds)
@@ -584,6 +949,426 @@ func TestStatMaps(t *testing.T) {
 	}
 }
 
+func TestTTLAnomalies(t *testing.T) {
+	ec, err := newEBPFConfig()
+	if err != nil {
+		t.Fatalf("Creating eBPF config: %v", err)
+	}
+	defer ec.Close()
+
+	if err := initCIDRMap(ec.cidrMap, AsSet("127.0.0.1/32")); err != nil {
+		t.Fatalf("Initializing CIDR map: %v", err)
+	}
+	if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+		t.Fatalf("Initializing port map: %v", err)
+	}
+
+	// Packets from the server, the third one took another path.
+	for _, ttl := range []uint8{60, 61, 50} {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true}
+		err = gopacket.SerializeLayers(
+			buf,
+			opts,
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{1, 1, 1, 1, 1, 1},
+				DstMAC:       net.HardwareAddr{2, 2, 2, 2, 2, 2},
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			&layers.IPv4{
+				SrcIP:    net.ParseIP("127.0.0.1"),
+				DstIP:    net.ParseIP("127.0.0.2"),
+				TTL:      ttl,
+				Protocol: layers.IPProtocolTCP,
+			},
+			&layers.TCP{
+				ACK:     true,
+				SrcPort: layers.TCPPort(443),
+				DstPort: layers.TCPPort(10000),
+			},
+		)
+		if err != nil {
+			t.Fatalf("Serializing layers: %v", err)
+		}
+
+		// TODO: The first 14 bytes are ignored by the kernel (why?).
+		packet := append(make([]byte, 14), buf.Bytes()...)
+
+		if _, _, err := ec.prog.Benchmark(packet, 1, nil); err != nil {
+			t.Fatalf("Executing program: %v", err)
+		}
+	}
+
+	s := &NetworkDataSource{ebpfConfig: ec}
+	last := map[string]uint64{}
+	if err := s.readTTLAnomalies(last); err != nil {
+		t.Fatalf("Reading TTL anomalies: %v", err)
+	}
+	if last["127.0.0.1"] != 1 {
+		t.Fatalf("Wrong TTL anomaly count: %+v", last)
+	}
+}
+
+func TestTLSAlerts(t *testing.T) {
+	// An alert record with the level and the description.
+	alert := func(level, description byte) []byte {
+		return []byte{0x15, 0x03, 0x03, 0x00, 0x02, level, description}
+	}
+	for _, tc := range []struct {
+		desc         string
+		initialState *tupleData
+		fromServer   bool
+		payload      []byte
+		wantAlerts   map[tlsAlert]uint64
+	}{
+		{
+			desc:         "Server rejects the ClientHello",
+			initialState: &tupleData{state: SNI_RECEIVED, sni: "google.com"},
+			fromServer:   true,
+			payload:      alert(2, 112),
+			wantAlerts:   map[tlsAlert]uint64{{sni: "google.com", description: 112, fromServer: true}: 1},
+		},
+		{
+			desc:         "Client rejects the certificate",
+			initialState: &tupleData{state: SNI_RECEIVED, sni: "google.com", serverHelloSeen: true},
+			payload:      alert(2, 48),
+			wantAlerts:   map[tlsAlert]uint64{{sni: "google.com", description: 48}: 1},
+		},
+		{
+			desc:         "Warning",
+			initialState: &tupleData{state: SNI_RECEIVED, sni: "google.com"},
+			fromServer:   true,
+			payload:      alert(1, 0),
+			wantAlerts:   map[tlsAlert]uint64{},
+		},
+		{
+			desc:         "After the handshake",
+			initialState: &tupleData{state: SNI_RECEIVED, sni: "google.com", serverHelloSeen: true, handshakeFinished: true},
+			payload:      alert(2, 40),
+			wantAlerts:   map[tlsAlert]uint64{},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ec, err := newEBPFConfig()
+			if err != nil {
+				t.Fatalf("Creating eBPF config: %v", err)
+			}
+			defer ec.Close()
+			if err := initCIDRMap(ec.cidrMap, AsSet("127.0.0.1/32")); err != nil {
+				t.Fatalf("Initializing CIDR map: %v", err)
+			}
+			if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+				t.Fatalf("Initializing port map: %v", err)
+			}
+			client, server := net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")
+			conn := &tuple{srcIP: client, dstIP: server, srcPort: 10000, dstPort: 443}
+			if err := setConnection(ec.connectionMap, conn, tc.initialState); err != nil {
+				t.Fatalf("Setting connection: %v", err)
+			}
+
+			ip := &layers.IPv4{SrcIP: client, DstIP: server, Protocol: layers.IPProtocolTCP}
+			tcp := &layers.TCP{PSH: true, ACK: true, SrcPort: 10000, DstPort: 443}
+			if tc.fromServer {
+				ip.SrcIP, ip.DstIP = server, client
+				tcp.SrcPort, tcp.DstPort = 443, 10000
+			}
+			buf := gopacket.NewSerializeBuffer()
+			err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+				&layers.Ethernet{
+					SrcMAC:       net.HardwareAddr{1, 1, 1, 1, 1, 1},
+					DstMAC:       net.HardwareAddr{2, 2, 2, 2, 2, 2},
+					EthernetType: layers.EthernetTypeIPv4,
+				},
+				ip, tcp, gopacket.Payload(tc.payload),
+			)
+			if err != nil {
+				t.Fatalf("Serializing layers: %v", err)
+			}
+			// TODO: The first 14 bytes are ignored by the kernel (why?).
+			if _, _, err := ec.prog.Benchmark(append(make([]byte, 14), buf.Bytes()...), 1, nil); err != nil {
+				t.Fatalf("Executing program: %v", err)
+			}
+
+			s := &NetworkDataSource{ebpfConfig: ec}
+			last := map[tlsAlert]uint64{}
+			if err := s.readTLSAlerts(last); err != nil {
+				t.Fatalf("Reading TLS alerts: %v", err)
+			}
+			assert(t, last, tc.wantAlerts)
+		})
+	}
+}
+
+// TestHandshakeOnlyConnections replays the TLS 1.2 and 1.3 handshakes
+// from the ServerHello on. The server flight alone exceeds
+// CONN_MIN_DATA_BYTES, so while the handshake-only connections are
+// detected, a connection must not be counted before the client sent
+// application data.
+func TestHandshakeOnlyConnections(t *testing.T) {
+	record := func(contentType byte, length int) []byte {
+		return append([]byte{contentType, 0x03, 0x03, byte(length >> 8), byte(length)}, make([]byte, length)...)
+	}
+	serverHello := func(cipherSuite uint16) []byte {
+		body := []byte{0x02, 0x00, 0x00, 0x48, 0x03, 0x03}
+		body = append(body, make([]byte, 32)...)
+		body = append(body, 32)
+		body = append(body, make([]byte, 32)...)
+		body = append(body, byte(cipherSuite>>8), byte(cipherSuite), 0x00, 0x00, 0x00)
+		return append([]byte{0x16, 0x03, 0x03, 0x00, byte(len(body))}, body...)
+	}
+	concat := func(records ...[]byte) []byte {
+		return bytes.Join(records, nil)
+	}
+	type segment struct {
+		fromServer bool
+		payload    []byte
+	}
+	// The ServerHello, the ChangeCipherSpec and the encrypted flight of a
+	// TLS 1.3 server, and the ChangeCipherSpec and Finished of the client
+	// in middlebox compatibility mode.
+	tls13Server := segment{fromServer: true, payload: concat(serverHello(0x1301), record(0x14, 1), record(0x17, 1200))}
+	tls13Finished := segment{payload: concat(record(0x14, 1), record(0x17, 53))}
+	// The ServerHello, Certificate and ServerHelloDone of a TLS 1.2
+	// server, the ClientKeyExchange, ChangeCipherSpec and Finished of the
+	// client and the ChangeCipherSpec and Finished of the server.
+	tls12Server := segment{fromServer: true, payload: concat(serverHello(0xc02f), record(0x16, 1200), record(0x16, 4))}
+	tls12Finished := segment{payload: concat(record(0x16, 37), record(0x14, 1), record(0x16, 40))}
+	tls12ServerFinished := segment{fromServer: true, payload: concat(record(0x14, 1), record(0x16, 40))}
+	request := segment{payload: record(0x17, 100)}
+
+	for _, tc := range []struct {
+		desc     string
+		segments []segment
+		// withoutDetection leaves the success of the open
+		// connections as without the detection of the handshake-only
+		// connections.
+		withoutDetection bool
+		// wantOpen is set if the connection is not accounted yet.
+		wantOpen bool
+		// wantHandshakesOnly is the number of handshake-only
+		// connections of an accounted connection.
+		wantHandshakesOnly uint64
+	}{
+		{
+			desc:     "TLS 1.3",
+			segments: []segment{tls13Server, tls13Finished, request},
+		},
+		{
+			desc:     "TLS 1.3 with the request in the segment of the Finished",
+			segments: []segment{tls13Server, {payload: concat(tls13Finished.payload, request.payload)}},
+		},
+		{
+			desc:     "TLS 1.3 without application data",
+			segments: []segment{tls13Server, tls13Finished},
+			wantOpen: true,
+		},
+		{
+			desc:     "TLS 1.2",
+			segments: []segment{tls12Server, tls12Finished, tls12ServerFinished, request},
+		},
+		{
+			desc:     "TLS 1.2 without application data",
+			segments: []segment{tls12Server, tls12Finished, tls12ServerFinished},
+			wantOpen: true,
+		},
+		{
+			desc:               "TLS 1.3 without application data and without the detection",
+			segments:           []segment{tls13Server, tls13Finished},
+			withoutDetection:   true,
+			wantHandshakesOnly: 1,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ec, err := newEBPFConfig()
+			if err != nil {
+				t.Fatalf("Creating eBPF config: %v", err)
+			}
+			defer ec.Close()
+			if err := initCIDRMap(ec.cidrMap, AsSet("127.0.0.1/32")); err != nil {
+				t.Fatalf("Initializing CIDR map: %v", err)
+			}
+			if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+				t.Fatalf("Initializing port map: %v", err)
+			}
+			if err := initStatsMap(ec, 0); err != nil {
+				t.Fatalf("Initializing stats map: %v", err)
+			}
+			if err := initCaptureMap(ec.captureMap, captureConfig{deferHandshakeOnly: !tc.withoutDetection}); err != nil {
+				t.Fatalf("Initializing capture map: %v", err)
+			}
+			client, server := net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")
+			conn := &tuple{srcIP: client, dstIP: server, srcPort: 10000, dstPort: 443}
+			if err := setConnection(ec.connectionMap, conn, &tupleData{state: SNI_RECEIVED, sni: "google.com"}); err != nil {
+				t.Fatalf("Setting connection: %v", err)
+			}
+
+			for _, s := range tc.segments {
+				ip := &layers.IPv4{SrcIP: client, DstIP: server, Protocol: layers.IPProtocolTCP}
+				tcp := &layers.TCP{PSH: true, ACK: true, SrcPort: 10000, DstPort: 443}
+				if s.fromServer {
+					ip.SrcIP, ip.DstIP = server, client
+					tcp.SrcPort, tcp.DstPort = 443, 10000
+				}
+				buf := gopacket.NewSerializeBuffer()
+				err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+					&layers.Ethernet{
+						SrcMAC:       net.HardwareAddr{1, 1, 1, 1, 1, 1},
+						DstMAC:       net.HardwareAddr{2, 2, 2, 2, 2, 2},
+						EthernetType: layers.EthernetTypeIPv4,
+					},
+					ip, tcp, gopacket.Payload(s.payload),
+				)
+				if err != nil {
+					t.Fatalf("Serializing layers: %v", err)
+				}
+				// TODO: The first 14 bytes are ignored by the kernel (why?).
+				if _, _, err := ec.prog.Benchmark(append(make([]byte, 14), buf.Bytes()...), 1, nil); err != nil {
+					t.Fatalf("Executing program: %v", err)
+				}
+			}
+
+			td, err := getConnection(ec.connectionMap, conn)
+			if open := err == nil; open != tc.wantOpen {
+				t.Fatalf("Got open %v, want %v", open, tc.wantOpen)
+			}
+			if tc.wantOpen {
+				// Accounted when it is closed or by its age.
+				if !td.handshakeOnly() {
+					t.Errorf("Got an open connection with application data: %+v", td)
+				}
+				return
+			}
+			stats, err := getStats(ec.statsMap)
+			if err != nil {
+				t.Fatalf("Getting stats: %v", err)
+			}
+			s := stats[0]["google.com"]
+			assert(t, [2]uint64{s.succeededConnections, s.handshakesOnly}, [2]uint64{1, tc.wantHandshakesOnly})
+		})
+	}
+}
+
+// TestResetOrigins checks that a reset is attributed to a middlebox only
+// by its TTL, the IP ID of a genuine reset of the peer may be random, zero
+// or lower than the one of its prior packets.
+func TestResetOrigins(t *testing.T) {
+	type packet struct {
+		fromServer, rst bool
+		ttl             uint8
+		ipid            uint16
+	}
+	for _, tc := range []struct {
+		desc    string
+		packets []packet
+		// wantResets are indexed like metrics.RSTOrigins.
+		wantState  connState
+		wantResets [3]uint64
+	}{
+		{
+			desc:       "server RST",
+			packets:    []packet{{fromServer: true, ttl: 60, ipid: 5000}, {fromServer: true, rst: true, ttl: 60, ipid: 5001}},
+			wantState:  RST_SENT_BY_SERVER,
+			wantResets: [3]uint64{1, 0, 0},
+		},
+		{
+			desc:       "server RST with a random IP ID",
+			packets:    []packet{{fromServer: true, ttl: 60, ipid: 5000}, {fromServer: true, rst: true, ttl: 59, ipid: 48213}},
+			wantState:  RST_SENT_BY_SERVER,
+			wantResets: [3]uint64{1, 0, 0},
+		},
+		{
+			desc:       "server RST with an IP ID below the last one",
+			packets:    []packet{{fromServer: true, ttl: 60, ipid: 5000}, {fromServer: true, rst: true, ttl: 60, ipid: 17}},
+			wantState:  RST_SENT_BY_SERVER,
+			wantResets: [3]uint64{1, 0, 0},
+		},
+		{
+			desc:       "server RST with a zero IP ID",
+			packets:    []packet{{fromServer: true, ttl: 60, ipid: 5000}, {fromServer: true, rst: true, ttl: 60}},
+			wantState:  RST_SENT_BY_SERVER,
+			wantResets: [3]uint64{1, 0, 0},
+		},
+		{
+			desc:       "client RST",
+			packets:    []packet{{ttl: 64, ipid: 100}, {rst: true, ttl: 64, ipid: 30000}},
+			wantState:  RST_SENT_BY_CLIENT,
+			wantResets: [3]uint64{0, 1, 0},
+		},
+		{
+			desc:       "RST injected by a middlebox",
+			packets:    []packet{{fromServer: true, ttl: 60, ipid: 5000}, {fromServer: true, rst: true, ttl: 250, ipid: 5001}},
+			wantState:  RST_SENT_BY_MIDDLEBOX,
+			wantResets: [3]uint64{0, 0, 1},
+		},
+		{
+			desc:       "RST injected by a middlebox towards the server",
+			packets:    []packet{{ttl: 64, ipid: 100}, {rst: true, ttl: 50, ipid: 101}},
+			wantState:  RST_SENT_BY_MIDDLEBOX,
+			wantResets: [3]uint64{0, 0, 1},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ec, err := newEBPFConfig()
+			if err != nil {
+				t.Fatalf("Creating eBPF config: %v", err)
+			}
+			defer ec.Close()
+			if err := initCIDRMap(ec.cidrMap, AsSet("127.0.0.1/32")); err != nil {
+				t.Fatalf("Initializing CIDR map: %v", err)
+			}
+			if err := initPortMap(ec.portMap, AsSet("443")); err != nil {
+				t.Fatalf("Initializing port map: %v", err)
+			}
+			if err := initStatsMap(ec, 0); err != nil {
+				t.Fatalf("Initializing stats map: %v", err)
+			}
+			client, server := net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")
+			conn := &tuple{srcIP: client, dstIP: server, srcPort: 10000, dstPort: 443}
+			if err := setConnection(ec.connectionMap, conn, &tupleData{state: SNI_RECEIVED, sni: "google.com"}); err != nil {
+				t.Fatalf("Setting connection: %v", err)
+			}
+
+			for _, p := range tc.packets {
+				ip := &layers.IPv4{SrcIP: client, DstIP: server, TTL: p.ttl, Id: p.ipid, Protocol: layers.IPProtocolTCP}
+				tcp := &layers.TCP{RST: p.rst, ACK: !p.rst, SrcPort: 10000, DstPort: 443}
+				if p.fromServer {
+					ip.SrcIP, ip.DstIP = server, client
+					tcp.SrcPort, tcp.DstPort = 443, 10000
+				}
+				buf := gopacket.NewSerializeBuffer()
+				err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+					&layers.Ethernet{
+						SrcMAC:       net.HardwareAddr{1, 1, 1, 1, 1, 1},
+						DstMAC:       net.HardwareAddr{2, 2, 2, 2, 2, 2},
+						EthernetType: layers.EthernetTypeIPv4,
+					},
+					ip, tcp,
+				)
+				if err != nil {
+					t.Fatalf("Serializing layers: %v", err)
+				}
+				// TODO: The first 14 bytes are ignored by the kernel (why?).
+				if _, _, err := ec.prog.Benchmark(append(make([]byte, 14), buf.Bytes()...), 1, nil); err != nil {
+					t.Fatalf("Executing program: %v", err)
+				}
+			}
+
+			td, err := getConnection(ec.connectionMap, conn)
+			if err != nil {
+				t.Fatalf("Getting connection from map: %v", err)
+			}
+			if td.state != tc.wantState {
+				t.Errorf("Wrong state: got %d, want %d", td.state, tc.wantState)
+			}
+			stats, err := getStats(ec.statsMap)
+			if err != nil {
+				t.Fatalf("Getting stats: %v", err)
+			}
+			assert(t, stats[0]["google.com"].resets, tc.wantResets)
+		})
+	}
+}
+
 func BenchmarkBPF(b *testing.B) {
 	ec, err := newEBPFConfig()
 	if err != nil {
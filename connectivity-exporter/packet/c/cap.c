@@ -38,7 +38,7 @@ struct bpf_map_def SEC("maps") config_cidrs = {
 struct bpf_map_def SEC("maps") config_ports = {
   .type = BPF_MAP_TYPE_HASH,
   .key_size = sizeof(__u16), // 0-65535 (native endian)
-  .value_size = 1, // not used
+  .value_size = 1, // PORT_PROTOCOL_TLS or PORT_PROTOCOL_HTTP
   .max_entries = 32,
 };
 
@@ -58,6 +58,87 @@ struct bpf_map_def SEC("maps") histogram = {
   .max_entries = 1,
 };
 
+// Used to pass the configuration of the packets passed on to userspace.
+struct bpf_map_def SEC("maps") config_forward = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct forward_config_t),
+  .max_entries = 1,
+};
+
+// Used to pass the configuration of the capture.
+struct bpf_map_def SEC("maps") config_capture = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct capture_config_t),
+  .max_entries = 1,
+};
+
+// Used to pass the configuration of the SNI parsing.
+struct bpf_map_def SEC("maps") config_sni = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct sni_config_t),
+  .max_entries = 1,
+};
+
+// Used to pass the configuration of the stats map.
+struct bpf_map_def SEC("maps") config_stats = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct stats_config_t),
+  .max_entries = 1,
+};
+
+// Counts the SNIs which were truncated.
+struct bpf_map_def SEC("maps") sni_truncations = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(__u64),
+  .max_entries = 1,
+};
+
+// The tail-called sub-programs, populated from userspace.
+struct bpf_map_def SEC("maps") programs = {
+  .type = BPF_MAP_TYPE_PROG_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(__u32),
+  .max_entries = PROG_MAX,
+};
+
+// The headers parsed by the entry program. Tail calls only pass the skb to
+// the next program, but all the programs run on the same CPU for a packet.
+struct packet_ctx_t {
+  struct tuple_key_t key;
+  struct iphdr iph;
+  struct tcphdr tcph;
+  // The offsets of the IP and the TCP header in the frame.
+  int ip_off;
+  int tcp_off;
+  // The length of the PROXY protocol header skipped at the start of the
+  // payload, see skip_proxy_header.
+  int proxy_len;
+  bool server_to_client;
+  // The PORT_PROTOCOL_* of the port of the server.
+  __u8 protocol;
+};
+
+struct bpf_map_def SEC("maps") packet_ctx = {
+  .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct packet_ctx_t),
+  .max_entries = 1,
+};
+
+// The start of a plaintext HTTP request searched for the Host header, too
+// large for the stack.
+struct bpf_map_def SEC("maps") http_buffer = {
+  .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = HTTP_MAX_HEADER_LEN,
+  .max_entries = 1,
+};
+
 // Use to keep a variable whose value alters the program behaviour
 // - 0: program works as normal
 // - 1: skip normal processing and add some data in the stats map
@@ -79,16 +160,207 @@ struct bpf_map_def SEC("maps") ticker_clock = {
 struct bpf_map_def SEC("maps") stats = {
   .type = BPF_MAP_TYPE_ARRAY_OF_MAPS,
   .key_size = sizeof(__u32),
-  .max_entries = STATS_SECONDS_COUNT,
+  .max_entries = STATS_MAX_SLOTS,
+};
+
+// The ticker clock each slot of the stats map is open for. Userspace seals a
+// slot before reading it and opens it for the next ticker clock before
+// advancing the clock, so no write reaches a slot while it is read.
+struct bpf_map_def SEC("maps") stats_generations = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(__u64),
+  .max_entries = STATS_MAX_SLOTS,
+};
+
+// Counts the writes to a slot of the stats map which was not open for the
+// ticker clock of the write.
+struct bpf_map_def SEC("maps") late_writes = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(__u64),
+  .max_entries = 1,
 };
 
 struct bpf_map_def SEC("maps") sni_stats = {
   .type = BPF_MAP_TYPE_HASH,
-  .key_size = sizeof(char[TLS_MAX_SERVER_NAME_LEN])+8,
+  .key_size = sizeof(struct stats_key_t),
   .value_size = sizeof(struct sni_stats_t),
   .max_entries = MAX_SERVER_COUNT,
 };
 
+// Counts the payload bytes of the connections with an SNI per source,
+// destination and SNI while config_stats enables it, for the throughput.
+struct bpf_map_def SEC("maps") data_bytes = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct stats_key_t),
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_DATA_BYTES_KEY_COUNT,
+};
+
+// Used for learning the typical TTL of the packets from each destination.
+struct bpf_map_def SEC("maps") dest_ttl = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(__u32), // destination IP (network byte order)
+  .value_size = sizeof(struct dest_ttl_t),
+  .max_entries = MAX_DESTINATION_COUNT,
+};
+
+// Counts the packets from each destination with an unexpected TTL.
+struct bpf_map_def SEC("maps") ttl_anomalies = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(__u32), // destination IP (network byte order)
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_DESTINATION_COUNT,
+};
+
+// Counts the packets and bytes seen per network interface, so a missing
+// attachment or mirror shows even without traffic to the configured CIDRs.
+struct bpf_map_def SEC("maps") interface_packets = {
+  .type = BPF_MAP_TYPE_PERCPU_HASH,
+  .key_size = sizeof(__u32), // ifindex
+  .value_size = sizeof(struct interface_counters_t),
+  .max_entries = MAX_INTERFACE_COUNT,
+};
+
+// Counts the SYNs of the clients matching only one of the configured CIDRs and
+// ports, see partial_match_t.
+struct bpf_map_def SEC("maps") partial_matches = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct partial_match_t),
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_PARTIAL_MATCH_COUNT,
+};
+
+// Counts the signatures of SNI proxies and TLS interception per SNI.
+struct bpf_map_def SEC("maps") interceptions = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = TLS_MAX_SERVER_NAME_LEN, // SNI
+  .value_size = sizeof(struct interception_t),
+  .max_entries = MAX_INTERCEPTION_SNI_COUNT,
+};
+
+// Keeps the SNIs of the connections reset before the ServerHello, to recognize
+// a ClientHello retransmitted after the reset.
+struct bpf_map_def SEC("maps") reset_handshakes = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct tuple_key_t),
+  .value_size = TLS_MAX_SERVER_NAME_LEN, // SNI
+  .max_entries = MAX_RESET_HANDSHAKE_COUNT,
+};
+
+// Counts the handshakes per SNI, negotiated TLS version and cipher suite.
+struct bpf_map_def SEC("maps") tls_parameters = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct tls_parameters_t),
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_TLS_PARAMETERS_COUNT,
+};
+
+// Maps the key of the server of an MPTCP connection with an SNI to the stats key
+// of the connection, so userspace can attribute the subflows joining it by the
+// token, which is derived from the key with SHA-256.
+struct bpf_map_def SEC("maps") mptcp_connections = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(__u64),
+  .value_size = sizeof(struct stats_key_t),
+  .max_entries = MAX_MPTCP_CONNECTION_COUNT,
+};
+
+// Counts the subflows joining MPTCP connections per token.
+struct bpf_map_def SEC("maps") mptcp_subflows = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(__u32),
+  .value_size = sizeof(struct mptcp_subflows_t),
+  .max_entries = MAX_MPTCP_CONNECTION_COUNT,
+};
+
+// Counts the fatal alerts of the handshakes per SNI, alert and sender.
+struct bpf_map_def SEC("maps") tls_alerts = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct tls_alert_t),
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_TLS_ALERT_COUNT,
+};
+
+// Counts the protocols offered by the ClientHellos and selected by the
+// ServerHellos per SNI.
+struct bpf_map_def SEC("maps") alpn = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct alpn_t),
+  .value_size = sizeof(__u64),
+  .max_entries = MAX_ALPN_COUNT,
+};
+
+// Holds the SNIs of ClientHellos split over several segments, reassembled in
+// userspace from the forwarded segments, until the next packet of their
+// connection applies them.
+struct bpf_map_def SEC("maps") reassembled_snis = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct tuple_key_t),
+  .value_size = TLS_MAX_SERVER_NAME_LEN, // SNI
+  .max_entries = MAX_REASSEMBLED_SNI_COUNT,
+};
+
+// Tracks the flows of UDP to the ports configured for UDP, until they are
+// accounted and deleted in userspace.
+struct bpf_map_def SEC("maps") udp_flows = {
+  .type = BPF_MAP_TYPE_LRU_HASH,
+  .key_size = sizeof(struct tuple_key_t),
+  .value_size = sizeof(struct udp_flow_t),
+  .max_entries = MAX_UDP_FLOW_COUNT,
+};
+
+// The histograms of the smoothed RTT per SNI, sampled by the sock_ops program
+// sample_rtt. The SNIs without samples are evicted first.
+struct bpf_map_def SEC("maps") rtt = {
+  .type = BPF_MAP_TYPE_LRU_PERCPU_HASH,
+  .key_size = TLS_MAX_SERVER_NAME_LEN, // SNI
+  .value_size = sizeof(struct execution_histogram),
+  .max_entries = MAX_RTT_SNI_COUNT,
+};
+
+// Returns the signatures of interception of an SNI, inserting zeroes first.
+static inline struct interception_t *interception(char *sni)
+{
+  struct interception_t *i = bpf_map_lookup_elem(&interceptions, sni);
+  if (i)
+    return i;
+  // Another CPU might insert the entry at the same time, so insert zeroes
+  // only and add the values atomically.
+  struct interception_t new_interception = {};
+  bpf_map_update_elem(&interceptions, sni, &new_interception, BPF_NOEXIST);
+  return bpf_map_lookup_elem(&interceptions, sni);
+}
+
+// Counts a handshake whose ServerHello comes from another hop distance than the
+// prior packets from the server, e.g. the SYN-ACK. An SNI proxy answers the TCP
+// handshake itself and splices the connection to the server after reading the
+// SNI.
+static inline void check_split_handshake(struct tuple_data_t *conn, __u8 previous_ttl, __u8 ttl)
+{
+  // Nothing seen from the server before, so there is nothing to compare with.
+  if (previous_ttl == 0)
+    return;
+  __u8 ttl_diff = ttl > previous_ttl ? ttl - previous_ttl : previous_ttl - ttl;
+  if (ttl_diff <= HANDSHAKE_TTL_TOLERANCE)
+    return;
+  struct interception_t *i = interception(conn->i.id.sni);
+  if (i)
+    __sync_fetch_and_add(&i->split_handshakes, 1);
+}
+
+// Returns the slot of the stats map which is open for the ticker clock.
+static inline __u64 stats_slot(__u64 clock)
+{
+  __u32 zero = 0;
+  __u64 slots = STATS_SECONDS_COUNT;
+  struct stats_config_t *config = bpf_map_lookup_elem(&config_stats, &zero);
+  if (config && config->slots > 0 && config->slots <= STATS_MAX_SLOTS)
+    slots = config->slots;
+  return clock % slots;
+}
+
 static inline void run_test_hook(__u64 i)
 {
   // ok, we add some data in the stats map
@@ -96,7 +368,7 @@ static inline void run_test_hook(__u64 i)
   __u32 zero = 0;
   __u64 *clock_key_ptr = bpf_map_lookup_elem(&ticker_clock, &zero);
   if (clock_key_ptr)
-    clock_key = *clock_key_ptr % STATS_SECONDS_COUNT;
+    clock_key = stats_slot(*clock_key_ptr);
 
   void *inner_map = bpf_map_lookup_elem(&stats, &clock_key);
   if (inner_map) {
@@ -114,41 +386,298 @@ static inline void run_test_hook(__u64 i)
   }
 }
 
-static inline void add_connection_to_stats(struct tuple_key_t *key, char *sni_string, bool successful_connection)
+// The latencies need bpf_ktime_get_ns, which requires a GPL compatible license
+// before Linux 5.8, so they are only measured if enabled explicitly.
+#ifndef LATENCY_ENABLED
+#define LATENCY_ENABLED 0
+#endif
+
+// Returns the current time in nanoseconds, or 0 if the latencies are not
+// measured.
+static inline __u64 latency_clock_ns(void)
+{
+  if (LATENCY_ENABLED)
+    return bpf_ktime_get_ns();
+  return 0;
+}
+
+// Returns the microseconds since the start, or 0 if the start is unknown.
+static inline __u32 latency_since_us(__u64 start_ns)
+{
+  if (start_ns == 0)
+    return 0;
+  __u64 latency_us = (latency_clock_ns() - start_ns) / 1000;
+  // 0 means not measured.
+  return latency_us > 0 ? latency_us : 1;
+}
+
+// Counts a subflow joining the MPTCP connection of the token, or its failure.
+static inline void count_mptcp_subflow(__u32 token, bool failed)
+{
+  struct mptcp_subflows_t *subflows = bpf_map_lookup_elem(&mptcp_subflows, &token);
+  if (!subflows) {
+    // Another CPU might insert the entry at the same time.
+    struct mptcp_subflows_t zero = {};
+    bpf_map_update_elem(&mptcp_subflows, &token, &zero, BPF_NOEXIST);
+    subflows = bpf_map_lookup_elem(&mptcp_subflows, &token);
+    if (!subflows)
+      return;
+  }
+  if (failed)
+    __sync_fetch_and_add(&subflows->failed, 1);
+  else
+    __sync_fetch_and_add(&subflows->joined, 1);
+}
+
+// Remembers the stats key of an MPTCP connection once its SNI is known, see
+// mptcp_connections.
+static inline void remember_mptcp_connection(struct tuple_data_t *conn)
+{
+  if (!(conn->tls_flags & MPTCP_CAPABLE) || conn->mptcp_key == 0)
+    return;
+  bpf_map_update_elem(&mptcp_connections, &conn->mptcp_key, &conn->i.id, BPF_ANY);
+}
+
+// Writes the port in decimal to the SNI buffer at the offset.
+static inline void write_port(char *sni, __u32 off, __u16 port)
+{
+  int len = port >= 10000 ? 5 : port >= 1000 ? 4 : port >= 100 ? 3 : port >= 10 ? 2 : 1;
+  for (int i = 0; i < 5; i++) {
+    if (i >= len)
+      break;
+    sni[(off + len - 1 - i) & (TLS_MAX_SERVER_NAME_LEN - 1)] = '0' + port % 10;
+    port /= 10;
+  }
+}
+
+// Writes the pseudo SNI of a connection without an SNI to the port of the
+// server, the prefix of sni_config_t followed by the port in decimal. Returns
+// false if sni_config_t has no prefix.
+static inline bool no_sni(char *sni, __u16 port)
+{
+  __u32 zero = 0;
+  struct sni_config_t *config = bpf_map_lookup_elem(&config_sni, &zero);
+  if (!config || config->no_sni_prefix_len == 0)
+    return false;
+  __u32 len = config->no_sni_prefix_len;
+  if (len > NO_SNI_PREFIX_MAX_LEN)
+    len = NO_SNI_PREFIX_MAX_LEN;
+  for (int i = 0; i < NO_SNI_PREFIX_MAX_LEN; i++) {
+    if (i >= len)
+      break;
+    sni[i] = config->no_sni_prefix[i];
+  }
+  write_port(sni, len, port);
+  return true;
+}
+
+// Returns the number of ApplicationData records of the client a connection
+// needs to carry application data.
+static inline __u32 min_app_data_records(struct tuple_data_t *conn)
+{
+  if (conn->tls_flags & TLS_1_3_NEGOTIATED)
+    return CONN_MIN_APP_DATA_RECORDS_TLS_1_3;
+  return CONN_MIN_APP_DATA_RECORDS;
+}
+
+// Checks whether the TLS handshake succeeded, but the client sent no
+// application data (yet).
+static inline bool handshake_only(struct tuple_data_t *conn)
+{
+  return (conn->tls_flags & TLS_SERVER_HELLO_SEEN)
+    && conn->client_app_data_records < min_app_data_records(conn);
+}
+
+// Checks whether an open connection is not counted as succeeded yet although it
+// exceeds the thresholds. The server flight alone exceeds CONN_MIN_DATA_BYTES,
+// so while handshake-only connections are detected, an open TLS connection is
+// only counted as succeeded once the client sent application data. Without,
+// it is accounted when it is closed or by its age.
+static inline bool success_deferred(struct tuple_data_t *conn)
 {
+  __u32 zero = 0;
+  struct capture_config_t *capture = bpf_map_lookup_elem(&config_capture, &zero);
+  return capture && capture->defer_handshake_only && handshake_only(conn);
+}
+
+static inline void add_connection_to_stats(struct tuple_key_t *key, struct tuple_data_t *conn, enum conn_outcome outcome)
+{
+  // An additional subflow of an MPTCP connection is no connection of its own,
+  // the MPTCP connection is accounted with its first subflow.
+  if (conn->tls_flags & MPTCP_SUBFLOW) {
+    if (outcome != CONN_SUCCEEDED)
+      count_mptcp_subflow(conn->mptcp_token, true);
+    bpf_map_delete_elem(&connections, key);
+    return;
+  }
+
   __u64 clock_key = 0;
   __u32 zero = 0;
   __u64 *clock_key_ptr = bpf_map_lookup_elem(&ticker_clock, &zero);
   if (clock_key_ptr)
-    clock_key = *clock_key_ptr % STATS_SECONDS_COUNT;
+    clock_key = stats_slot(*clock_key_ptr);
+
+  // A connection closed while its slot is sealed stays in the connections
+  // map, it is accounted as an old connection instead.
+  __u32 slot = clock_key;
+  __u64 *generation = bpf_map_lookup_elem(&stats_generations, &slot);
+  if (generation && clock_key_ptr && *generation != *clock_key_ptr) {
+    __u64 *late = bpf_map_lookup_elem(&late_writes, &zero);
+    if (late)
+      __sync_fetch_and_add(late, 1);
+    return;
+  }
 
   void *inner_map = bpf_map_lookup_elem(&stats, &clock_key);
   if (!inner_map)
     return;
 
+  // A connection without an SNI, e.g. a health check or of another protocol
+  // than TLS, is accounted for the pseudo SNI of its port if it is enabled.
+  if (conn->i.id.sni[0] == '\0' && no_sni(conn->i.id.sni, bpf_ntohs(key->dest_port)))
+    conn->tls_flags |= NO_SNI_ACCOUNTED;
+
   struct sni_stats_t *s;
-  s = bpf_map_lookup_elem(inner_map, sni_string);
-  if (s) {
-    if (successful_connection)
-      __sync_fetch_and_add(&s->succeeded_connections, 1); // TODO: Use core specific datastructures to avoid synchronization
-    else
-      __sync_fetch_and_add(&s->failed_connections, 1);
-  } else {
-    struct sni_stats_t new_stats = {
-      successful_connection ? 1 : 0,
-      successful_connection ? 0 : 1
-    };
-    bpf_map_update_elem(inner_map, sni_string, &new_stats, BPF_ANY);
+  s = bpf_map_lookup_elem(inner_map, conn->i.key);
+  if (!s) {
+    // Another CPU might insert the entry at the same time, so insert zeroes
+    // only and add the values atomically below.
+    struct sni_stats_t new_stats = {};
+    bpf_map_update_elem(inner_map, conn->i.key, &new_stats, BPF_NOEXIST);
+    s = bpf_map_lookup_elem(inner_map, conn->i.key);
+    if (!s)
+      return;
+  }
+
+  // TODO: Use core specific datastructures to avoid synchronization
+  if (outcome == CONN_SUCCEEDED)
+    __sync_fetch_and_add(&s->succeeded_connections, 1);
+  else if (outcome == CONN_FAILED)
+    __sync_fetch_and_add(&s->failed_connections, 1);
+  else if (outcome == CONN_ICMP_UNREACHABLE) {
+    __u8 code = conn->icmp_code;
+    if (code < ICMP_UNREACHABLE_CODE_COUNT)
+      __sync_fetch_and_add(&s->icmp_unreachable[code], 1);
+  } else
+    __sync_fetch_and_add(&s->middlebox_resets, 1);
+
+  if (conn->ecn_flags & ECN_REQUESTED)
+    __sync_fetch_and_add(&s->ecn_requested, 1);
+  if (conn->ecn_flags & ECN_ACCEPTED)
+    __sync_fetch_and_add(&s->ecn_accepted, 1);
+  __sync_fetch_and_add(&s->ce_packets, conn->ce_packets);
+  __sync_fetch_and_add(&s->ece_packets, conn->ece_packets);
+  __sync_fetch_and_add(&s->cwr_packets, conn->cwr_packets);
+  if (conn->i.id.sni[0] != '\0' && !(conn->tls_flags & (TLS_SERVER_HELLO_SEEN | HTTP_HOST_PARSED | SCTP_ASSOCIATION | NO_SNI_ACCOUNTED)))
+    __sync_fetch_and_add(&s->handshakes_abandoned, 1);
+  if (handshake_only(conn))
+    __sync_fetch_and_add(&s->handshakes_only, 1);
+  // Connections counted as succeeded while still open are not closed.
+  if (conn->state != SNI_RECEIVED && (conn->tls_flags & TLS_SERVER_HELLO_SEEN)) {
+    if (!(conn->tls_flags & TLS_HANDSHAKE_FINISHED))
+      __sync_fetch_and_add(&s->handshakes_failed, 1);
+    else if (outcome != CONN_SUCCEEDED)
+      __sync_fetch_and_add(&s->established_resets, 1);
+  }
+  if (conn->tls_flags & TLS_CERTIFICATE_REQUESTED) {
+    __sync_fetch_and_add(&s->certificate_requests, 1);
+    if (conn->state != SNI_RECEIVED && !(conn->tls_flags & TLS_HANDSHAKE_FINISHED))
+      __sync_fetch_and_add(&s->certificate_request_failures, 1);
+  }
+  for (int i = 0; i < TRANSITION_COUNT; i++) {
+    if (conn->transitions & (1 << i))
+      __sync_fetch_and_add(&s->transitions[i], 1);
+  }
+  if (conn->state == RST_SENT_BY_SERVER)
+    __sync_fetch_and_add(&s->resets[RST_ORIGIN_SERVER], 1);
+  else if (conn->state == RST_SENT_BY_CLIENT)
+    __sync_fetch_and_add(&s->resets[RST_ORIGIN_CLIENT], 1);
+  else if (conn->state == RST_SENT_BY_MIDDLEBOX)
+    __sync_fetch_and_add(&s->resets[RST_ORIGIN_MIDDLEBOX], 1);
+  if (conn->connect_latency_us != 0 || conn->handshake_latency_us != 0 || conn->handshake_duration_us != 0) {
+    __u32 i = __sync_fetch_and_add(&s->latency_samples, 1);
+    if (i < LATENCY_SAMPLE_COUNT) {
+      s->connect_latency_us[i] = conn->connect_latency_us;
+      s->handshake_latency_us[i] = conn->handshake_latency_us;
+      s->handshake_duration_us[i] = conn->handshake_duration_us;
+    }
   }
 
   // Always delete the connection after it has been counted.
   bpf_map_delete_elem(&connections, key);
 }
 
+// Compares the TTL of a packet from a destination with the typical TTL of the
+// destination and counts the deviations. A changing TTL is a strong signal for
+// routing changes or interception.
+static inline void check_ttl(__u32 dest_ip, __u8 ttl)
+{
+  struct dest_ttl_t *typical = bpf_map_lookup_elem(&dest_ttl, &dest_ip);
+  if (!typical) {
+    struct dest_ttl_t new_ttl = { .ttl = ttl };
+    bpf_map_update_elem(&dest_ttl, &dest_ip, &new_ttl, BPF_NOEXIST);
+    return;
+  }
+
+  __u8 ttl_diff = ttl > typical->ttl ? ttl - typical->ttl : typical->ttl - ttl;
+  if (ttl_diff <= TTL_ANOMALY_TOLERANCE) {
+    typical->deviations = 0;
+    return;
+  }
+
+  __u64 *count = bpf_map_lookup_elem(&ttl_anomalies, &dest_ip);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+  } else {
+    __u64 one = 1;
+    bpf_map_update_elem(&ttl_anomalies, &dest_ip, &one, BPF_NOEXIST);
+  }
+
+  // The deviation persists, so the path has probably changed.
+  typical->deviations++;
+  if (typical->deviations >= TTL_RELEARN_COUNT) {
+    typical->ttl = ttl;
+    typical->deviations = 0;
+  }
+}
+
+// Checks whether the TTL of a RST packet deviates from the prior packets of the
+// peer it claims to come from. Middleboxes injecting resets are usually a
+// different number of hops away. The IP ID is not compared: many stacks use
+// random, per-destination or zero IDs, so a jump does not tell a reset of the
+// peer from an injected one.
+static inline bool is_injected_rst(struct tuple_data_t *conn, struct iphdr *iph, bool server_to_client)
+{
+  __u8 peer_ttl = server_to_client ? conn->server_ttl : conn->client_ttl;
+
+  // Nothing seen from the peer yet, so there is nothing to compare with.
+  if (peer_ttl == 0)
+    return false;
+
+  __u8 ttl_diff = iph->ttl > peer_ttl ? iph->ttl - peer_ttl : peer_ttl - iph->ttl;
+  return ttl_diff > RST_TTL_TOLERANCE;
+}
+
+// Returns the configured maximum length of an SNI.
+static inline __u32 sni_max_len(void)
+{
+  __u32 zero = 0;
+  struct sni_config_t *config = bpf_map_lookup_elem(&config_sni, &zero);
+  if (!config || config->max_len == 0 || config->max_len > TLS_MAX_SERVER_NAME_LEN)
+    return TLS_MAX_SERVER_NAME_LEN;
+  return config->max_len;
+}
+
 // Parses the provided SKB at the given offset for SNI information. If parsing
 // succeeds, the SNI information is written to the out array. Returns the
-// number of characters in the SNI field or 0 if SNI couldn't be parsed.
-static inline int parse_sni(struct __sk_buff *skb, int data_offset, char *out)
+// number of characters in the SNI field or 0 if SNI couldn't be parsed. An SNI
+// longer than the maximum length is truncated, its last character is replaced
+// with SNI_TRUNCATED_MARKER. The SNI of a ClientHello with the encrypted client
+// hello extension is prefixed with ECH_SNI_PREFIX. The offset of the ALPN
+// extension is written to alpn_ext_off if it is set, 0 without one. The
+// TLS_PSK_OFFERED and TLS_EARLY_DATA_OFFERED flags of a resumption are set in
+// tls_flags if it is set.
+static inline int parse_sni(struct __sk_buff *skb, int data_offset, char *out, int *alpn_ext_off, __u32 *tls_flags)
 {
   // Verify TLS content type.
   __u8 content_type;
@@ -182,19 +711,34 @@ static inline int parse_sni(struct __sk_buff *skb, int data_offset, char *out)
       compression_methods_len_off + TLS_COMPRESSION_METHODS_LENGTH_LEN +
         compression_methods_len;
 
+  __u16 extensions_len_be;
+  bpf_skb_load_bytes(skb, extensions_len_off, &extensions_len_be, 2);
+  __u16 extensions_len = bpf_ntohs(extensions_len_be);
+
   int extensions_off = extensions_len_off + TLS_EXTENSIONS_LENGTH_LEN;
 
-  // TODO: Ensure the cursor doesn't surpass the extensions length value?
   __u16 cur = 0;
   __u16 server_name_ext_off = 0;
+  bool ech = false;
+  // The encrypted client hello extension may follow the server name extension,
+  // so all extensions are looked at.
   for (int i = 0; i < TLS_MAX_EXTENSION_COUNT; i++) {
+    if (cur >= extensions_len)
+      break;
     __u16 curr_ext_type_be;
-    bpf_skb_load_bytes(skb, extensions_off + cur, &curr_ext_type_be, 2);
-    if (bpf_ntohs(curr_ext_type_be) == TLS_EXTENSION_SERVER_NAME)
-    {
-      server_name_ext_off = extensions_off + cur;
+    if (bpf_skb_load_bytes(skb, extensions_off + cur, &curr_ext_type_be, 2))
       break;
-    }
+    __u16 curr_ext_type = bpf_ntohs(curr_ext_type_be);
+    if (curr_ext_type == TLS_EXTENSION_SERVER_NAME && server_name_ext_off == 0)
+      server_name_ext_off = extensions_off + cur;
+    else if (curr_ext_type == TLS_EXTENSION_ENCRYPTED_CLIENT_HELLO)
+      ech = true;
+    else if (curr_ext_type == TLS_EXTENSION_ALPN && alpn_ext_off)
+      *alpn_ext_off = extensions_off + cur;
+    else if (curr_ext_type == TLS_EXTENSION_PRE_SHARED_KEY && tls_flags)
+      *tls_flags |= TLS_PSK_OFFERED;
+    else if (curr_ext_type == TLS_EXTENSION_EARLY_DATA && tls_flags)
+      *tls_flags |= TLS_EARLY_DATA_OFFERED;
     // Skip the extension type field to get to the extension length field.
     cur += TLS_EXTENSION_TYPE_LEN;
 
@@ -212,15 +756,27 @@ static inline int parse_sni(struct __sk_buff *skb, int data_offset, char *out)
   bpf_skb_load_bytes(skb, server_name_ext_off + TLS_SERVER_NAME_LENGTH_OFF,
       &server_name_len_be, 2);
   __u16 server_name_len = bpf_ntohs(server_name_len_be);
-  if (server_name_len == 0 || server_name_len > TLS_MAX_SERVER_NAME_LEN)
+  if (server_name_len == 0)
     return 0;
+  __u32 max_len = sni_max_len();
+  // The server name follows the prefix of an encrypted client hello.
+  int name_off = 0;
+  if (ech && max_len > ECH_SNI_PREFIX_LEN) {
+    name_off = ECH_SNI_PREFIX_LEN;
+    max_len -= ECH_SNI_PREFIX_LEN;
+    if (out)
+      __builtin_memcpy(out, ECH_SNI_PREFIX, ECH_SNI_PREFIX_LEN);
+  }
+  bool truncated = server_name_len > max_len;
+  if (truncated)
+    server_name_len = max_len;
 
   // The server name field under the server name extension.
   __u16 server_name_off = server_name_ext_off + TLS_SERVER_NAME_OFF;
 
   // Read the server name field.
-  int counter = 0;
-  for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
+  int counter = name_off;
+  for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN - ECH_SNI_PREFIX_LEN; i++) {
     if (!out)
       break;
     if (i >= server_name_len)
@@ -229,9 +785,19 @@ static inline int parse_sni(struct __sk_buff *skb, int data_offset, char *out)
     bpf_skb_load_bytes(skb, server_name_off + i, &b, 1);
     if (b == '\0')
       break;
-    out[i] = b;
+    out[(name_off + i) & (TLS_MAX_SERVER_NAME_LEN - 1)] = b;
     counter++;
   }
+  // The prefix alone is no SNI.
+  if (counter == name_off)
+    return 0;
+  if (truncated && out && counter > 0) {
+    out[(counter - 1) & (TLS_MAX_SERVER_NAME_LEN - 1)] = SNI_TRUNCATED_MARKER;
+    __u32 zero = 0;
+    __u64 *truncations = bpf_map_lookup_elem(&sni_truncations, &zero);
+    if (truncations)
+      __sync_fetch_and_add(truncations, 1);
+  }
   return counter;
 }
 
@@ -242,63 +808,532 @@ void* get_from_array(struct bpf_map_def* map, __u32 index)
 }
 
 static
-int capture_packets_internal(struct __sk_buff *skb)
+// Checks whether the traffic is mirrored, see capture_config_t.
+static inline bool capture_span(void)
 {
-  // Skip frames with non-IP Ethernet protocol.
-  struct ethhdr ethh;
-  if (bpf_skb_load_bytes(skb, 0, &ethh, sizeof ethh)) {
-    return 0;
-  }
-  if (bpf_ntohs(ethh.h_proto) != ETH_P_IP) {
-    return 0;
-  }
-
-  int ip_off = ETH_HLEN;
+  __u32 zero = 0;
+  struct capture_config_t *capture = bpf_map_lookup_elem(&config_capture, &zero);
+  return capture && capture->span;
+}
 
-  // Read the IP header.
-  struct iphdr iph;
-  if (bpf_skb_load_bytes(skb, ip_off, &iph, sizeof iph)) {
-    return 0;
-  }
+// Infers the direction of a packet whose ports are both configured from its
+// connection: the peer which sent the SYN is the client. A packet of an
+// unknown connection is from the server, like with the source port.
+static inline bool is_server_to_client(struct iphdr *iph, struct tcphdr *tcph)
+{
+  if (tcph->syn)
+    return tcph->ack;
+  struct tuple_key_t key = {};
+  key.source_ip = iph->saddr;
+  key.dest_ip = iph->daddr;
+  key.source_port = tcph->source;
+  key.dest_port = tcph->dest;
+  return !bpf_map_lookup_elem(&connections, &key);
+}
 
-  // Skip packets with IP protocol other than TCP.
-  if (iph.protocol != IPPROTO_TCP) {
-    return 0;
+// Counts a packet seen on the interface of the sk_buff.
+static inline void count_packet(struct __sk_buff *skb)
+{
+  __u32 ifindex = skb->ifindex;
+  struct interface_counters_t *counters = bpf_map_lookup_elem(&interface_packets, &ifindex);
+  if (!counters) {
+    struct interface_counters_t zero = {};
+    bpf_map_update_elem(&interface_packets, &ifindex, &zero, BPF_NOEXIST);
+    counters = bpf_map_lookup_elem(&interface_packets, &ifindex);
+    if (!counters)
+      return;
   }
+  // The map is per CPU, so the counters are not shared.
+  counters->packets++;
+  counters->bytes += skb->len;
+}
 
-  struct cidr_key lpm_key;
-  lpm_key.prefixlen = 32;
+// Counts a packet matching the configured CIDRs and ports, after count_packet.
+static inline void count_matched(struct __sk_buff *skb)
+{
+  __u32 ifindex = skb->ifindex;
+  struct interface_counters_t *counters = bpf_map_lookup_elem(&interface_packets, &ifindex);
+  if (counters)
+    counters->matched++;
+}
 
-  // We can't check the two boolean expressions using '&&' or '||' as doing so
-  // causes clang to optimize to a '|=' bitwise operator on a pointer, which
-  // gets rejected by the verifier.
-  lpm_key.ip = iph.saddr;
-  void* src_addr_found = bpf_map_lookup_elem(&config_cidrs, &lpm_key);
-  if (!src_addr_found) {
-    lpm_key.ip = iph.daddr;
-    void* dst_addr_found = bpf_map_lookup_elem(&config_cidrs, &lpm_key);
-    if (!dst_addr_found)
-      return 0;
+// Counts the SYN of a client to a server matching only one of the configured
+// CIDRs and ports, so the servers missing in the configuration can be found.
+// Other packets are not counted, a connection attempt is counted once.
+static inline void count_partial_match(struct iphdr *iph, struct tcphdr *tcph, __u8 match)
+{
+  if (!tcph->syn || tcph->ack)
+    return;
+  struct partial_match_t key = {};
+  key.match = match;
+  __u32 zero = 0;
+  struct capture_config_t *capture = bpf_map_lookup_elem(&config_capture, &zero);
+  if (capture && capture->observe_partial_matches) {
+    key.ip = iph->daddr;
+    key.port = tcph->dest;
+  }
+  __u64 *count = bpf_map_lookup_elem(&partial_matches, &key);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+    return;
   }
+  // Another CPU might insert the entry at the same time.
+  __u64 initial = 0;
+  bpf_map_update_elem(&partial_matches, &key, &initial, BPF_NOEXIST);
+  count = bpf_map_lookup_elem(&partial_matches, &key);
+  if (count)
+    __sync_fetch_and_add(count, 1);
+}
 
-  // An IPv4 header doesn't have a fixed size. The IHL field of a packet
-  // represents the size of the IP header in 32-bit words, so we need to
-  // multiply this value by 4 to get the header size in bytes.
-  __u8 ip_header_len = iph.ihl * 4;
-  int tcp_off = ip_off + ip_header_len;
+// Counts the SYN of a client outside of the configured CIDRs to a port
+// configured for TCP as a partial match.
+static inline void count_port_match(struct __sk_buff *skb, struct packet_ctx_t *ctx, int tcp_off)
+{
+  struct tcphdr *tcph = &ctx->tcph;
+  if (bpf_skb_load_bytes(skb, tcp_off, tcph, sizeof *tcph))
+    return;
+  if (!tcph->syn || tcph->ack)
+    return;
+  __u16 dst_port = bpf_ntohs(tcph->dest);
+  __u8 *protocol = bpf_map_lookup_elem(&config_ports, &dst_port);
+  if (!protocol || *protocol == PORT_PROTOCOL_UDP || *protocol == PORT_PROTOCOL_SCTP)
+    return;
+  count_partial_match(&ctx->iph, tcph, PARTIAL_MATCH_PORT);
+}
 
-  // Read the TCP header.
-  struct tcphdr tcph;
-  if (bpf_skb_load_bytes(skb, tcp_off, &tcph, sizeof tcph)) {
-    return 0;
+// Counts a datagram of a UDP flow. A datagram to a port configured for UDP
+// starts or continues the flow of its client, a datagram from the port answers
+// it. The datagrams of the server without a flow, e.g. of flows started before
+// the program was attached, are not tracked.
+static inline void track_udp_flow(struct __sk_buff *skb, struct iphdr *iph, int udp_off)
+{
+  __u16 ports[2];
+  if (bpf_skb_load_bytes(skb, udp_off, ports, sizeof ports))
+    return;
+  __u32 zero = 0;
+  __u64 *clock_ptr = bpf_map_lookup_elem(&ticker_clock, &zero);
+  if (!clock_ptr)
+    return;
+
+  __u16 dst_port = bpf_ntohs(ports[1]);
+  __u8 *protocol = bpf_map_lookup_elem(&config_ports, &dst_port);
+  struct tuple_key_t key = {};
+  struct udp_flow_t *flow;
+  if (protocol && *protocol == PORT_PROTOCOL_UDP) {
+    count_matched(skb);
+    key.source_ip = iph->saddr;
+    key.dest_ip = iph->daddr;
+    key.source_port = ports[0];
+    key.dest_port = ports[1];
+    flow = bpf_map_lookup_elem(&udp_flows, &key);
+    if (!flow) {
+      // Another CPU might insert the flow at the same time.
+      struct udp_flow_t new_flow = {.first_tick = *clock_ptr};
+      bpf_map_update_elem(&udp_flows, &key, &new_flow, BPF_NOEXIST);
+      flow = bpf_map_lookup_elem(&udp_flows, &key);
+      if (!flow)
+        return;
+    }
+    flow->last_tick = *clock_ptr;
+    __sync_fetch_and_add(&flow->client_packets, 1);
+    return;
   }
 
-  // Should be enabled from command-line explicitly for testing purposes.
-  #ifndef TEST_ENABLED
-  #define TEST_ENABLED 0
-  #endif
+  __u16 src_port = bpf_ntohs(ports[0]);
+  protocol = bpf_map_lookup_elem(&config_ports, &src_port);
+  if (!protocol || *protocol != PORT_PROTOCOL_UDP)
+    return;
+  count_matched(skb);
+  key.source_ip = iph->daddr;
+  key.dest_ip = iph->saddr;
+  key.source_port = ports[1];
+  key.dest_port = ports[0];
+  flow = bpf_map_lookup_elem(&udp_flows, &key);
+  if (!flow)
+    return;
+  flow->last_tick = *clock_ptr;
+  __sync_fetch_and_add(&flow->server_packets, 1);
+}
+
+// Writes the pseudo SNI of the SCTP associations to the port of the server,
+// SCTP_SNI_PREFIX followed by the port in decimal.
+static inline void sctp_sni(char *sni, __u16 port)
+{
+  __builtin_memcpy(sni, SCTP_SNI_PREFIX, SCTP_SNI_PREFIX_LEN);
+  write_port(sni, SCTP_SNI_PREFIX_LEN, port);
+}
+
+// Follows an SCTP association through the chunk of a packet, mapped onto the
+// states of the TCP connections: the INIT starts the association like a SYN,
+// the INIT-ACK answers it like a SYN-ACK and the COOKIE-ACK establishes it,
+// which is SNI_RECEIVED. An ABORT is a reset of the peer sending it, a SHUTDOWN
+// closes the association like a FIN. The connect latency is the time from the
+// INIT to the INIT-ACK, the handshake latency the time from the COOKIE-ECHO to
+// the COOKIE-ACK. Returns false if the following chunks are not of interest.
+static inline bool track_sctp_chunk(struct tuple_key_t *key, __u8 type, bool server_to_client, __u64 clock)
+{
+  if (type == SCTP_CHUNK_INIT && !server_to_client) {
+    struct tuple_data_t value = {
+      .state = SYN_RECEIVED,
+      .ticker_clock_first_packet = clock,
+      .syn_ns = latency_clock_ns(),
+      .transitions = 1 << TRANSITION_SYN,
+      .tls_flags = SCTP_ASSOCIATION,
+    };
+    value.i.id.source_ip = key->source_ip;
+    value.i.id.dest_ip = key->dest_ip;
+    sctp_sni(value.i.id.sni, bpf_ntohs(key->dest_port));
+    bpf_map_update_elem(&connections, key, &value, BPF_ANY);
+    // An INIT is not bundled with other chunks.
+    return false;
+  }
+
+  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, key);
+  if (!conn || !(conn->tls_flags & SCTP_ASSOCIATION))
+    return false;
+  switch (type) {
+  case SCTP_CHUNK_INIT_ACK:
+    if (server_to_client && conn->state == SYN_RECEIVED) {
+      conn->connect_latency_us = latency_since_us(conn->syn_ns);
+      conn->state = SYNACK_RECEIVED;
+      conn->transitions |= 1 << TRANSITION_SYNACK;
+    }
+    return false;
+  case SCTP_CHUNK_COOKIE_ECHO:
+    // The COOKIE-ECHO can be bundled with the first DATA chunks.
+    if (!server_to_client && conn->state == SYNACK_RECEIVED)
+      conn->client_hello_ns = latency_clock_ns();
+    return false;
+  case SCTP_CHUNK_COOKIE_ACK:
+    if (server_to_client && conn->state == SYNACK_RECEIVED) {
+      conn->handshake_latency_us = latency_since_us(conn->client_hello_ns);
+      conn->handshake_duration_us = latency_since_us(conn->syn_ns);
+      conn->state = SNI_RECEIVED;
+      conn->transitions |= 1 << TRANSITION_SNI;
+    }
+    // An ABORT can follow.
+    return true;
+  case SCTP_CHUNK_ABORT:
+    conn->transitions |= 1 << (server_to_client ? TRANSITION_RST_SERVER : TRANSITION_RST_CLIENT);
+    if (server_to_client) {
+      // The server rejected the association, e.g. without a listener.
+      conn->state = RST_SENT_BY_SERVER;
+      add_connection_to_stats(key, conn, CONN_FAILED);
+    } else {
+      conn->state = RST_SENT_BY_CLIENT;
+      add_connection_to_stats(key, conn, CONN_SUCCEEDED);
+    }
+    return false;
+  case SCTP_CHUNK_SHUTDOWN:
+    conn->transitions |= 1 << TRANSITION_FIN;
+    conn->state = FIN_RECEIVED;
+    add_connection_to_stats(key, conn, CONN_SUCCEEDED);
+    return false;
+  }
+  // Other control chunks, e.g. a SACK, can be bundled before an ABORT.
+  return true;
+}
+
+// Tracks the SCTP associations to the ports configured for SCTP in the
+// connections map, keyed by the tuple from the client, see track_sctp_chunk.
+// The associations have no SNI, they are accounted to the pseudo SNI of the
+// port, see sctp_sni.
+static inline void track_sctp_association(struct __sk_buff *skb, struct iphdr *iph, int sctp_off)
+{
+  __u16 ports[2];
+  if (bpf_skb_load_bytes(skb, sctp_off, ports, sizeof ports))
+    return;
+  __u32 zero = 0;
+  __u64 *clock_ptr = bpf_map_lookup_elem(&ticker_clock, &zero);
+  if (!clock_ptr)
+    return;
+
+  __u16 dst_port = bpf_ntohs(ports[1]);
+  __u16 src_port = bpf_ntohs(ports[0]);
+  __u8 *protocol = bpf_map_lookup_elem(&config_ports, &dst_port);
+  bool server_to_client = false;
+  struct tuple_key_t key = {};
+  if (protocol && *protocol == PORT_PROTOCOL_SCTP) {
+    key.source_ip = iph->saddr;
+    key.dest_ip = iph->daddr;
+    key.source_port = ports[0];
+    key.dest_port = ports[1];
+  } else {
+    protocol = bpf_map_lookup_elem(&config_ports, &src_port);
+    if (!protocol || *protocol != PORT_PROTOCOL_SCTP)
+      return;
+    server_to_client = true;
+    key.source_ip = iph->daddr;
+    key.dest_ip = iph->saddr;
+    key.source_port = ports[1];
+    key.dest_port = ports[0];
+  }
+  count_matched(skb);
+
+  int off = sctp_off + SCTP_COMMON_HEADER_LEN;
+  for (int i = 0; i < SCTP_MAX_CHUNKS; i++) {
+    // The type, the flags and the length of the chunk.
+    __u8 chunk[4];
+    if (bpf_skb_load_bytes(skb, off, chunk, sizeof chunk))
+      return;
+    if (!track_sctp_chunk(&key, chunk[0], server_to_client, *clock_ptr))
+      return;
+    __u16 len = (chunk[2] << 8) | chunk[3];
+    if (len < sizeof chunk)
+      return;
+    // The chunks are padded to a multiple of 4 bytes.
+    off += (len + 3) & ~3;
+  }
+}
+
+// Correlates an ICMP destination unreachable, e.g. administratively prohibited
+// by a firewall, with the connection of the TCP header it quotes. A connection
+// still waiting for the SYN-ACK is closed as rejected by the network instead of
+// timing out later. The quoted addresses are those of the SYN, so the outer
+// addresses of the router sending the ICMP message need not be configured.
+static inline void correlate_icmp(struct __sk_buff *skb, int icmp_off)
+{
+  __u8 icmp[2];
+  if (bpf_skb_load_bytes(skb, icmp_off, icmp, sizeof icmp))
+    return;
+  if (icmp[0] != ICMP_DEST_UNREACHABLE || icmp[1] >= ICMP_UNREACHABLE_CODE_COUNT)
+    return;
+  // The quoted IP header follows the 8 bytes of the ICMP header.
+  int inner_off = icmp_off + 8;
+  struct iphdr inner;
+  if (bpf_skb_load_bytes(skb, inner_off, &inner, sizeof inner))
+    return;
+  if (inner.protocol != IPPROTO_TCP)
+    return;
+  struct cidr_key lpm_key = {.prefixlen = 32, .ip = inner.saddr};
+  if (!bpf_map_lookup_elem(&config_cidrs, &lpm_key)) {
+    lpm_key.ip = inner.daddr;
+    if (!bpf_map_lookup_elem(&config_cidrs, &lpm_key))
+      return;
+  }
+  // At least the ports of the quoted TCP header are included.
+  __u16 ports[2];
+  if (bpf_skb_load_bytes(skb, inner_off + inner.ihl * 4, ports, sizeof ports))
+    return;
+  struct tuple_key_t key = {
+    .source_ip = inner.saddr,
+    .dest_ip = inner.daddr,
+    .source_port = ports[0],
+    .dest_port = ports[1],
+  };
+  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &key);
+  if (!conn || conn->state != SYN_RECEIVED)
+    return;
+  conn->state = ICMP_UNREACHABLE;
+  conn->icmp_code = icmp[1];
+  add_connection_to_stats(&key, conn, CONN_ICMP_UNREACHABLE);
+}
+
+// Returns the offset of the IPv4 header of the frame, after the Ethernet header
+// and up to MAX_VLAN_TAGS 802.1Q or 802.1ad VLAN tags, or 0 if the frame does
+// not carry IPv4. The tags stripped by the network interface are not part of
+// the frame.
+static inline int ip_offset(struct __sk_buff *skb)
+{
+  struct ethhdr ethh;
+  if (bpf_skb_load_bytes(skb, 0, &ethh, sizeof ethh))
+    return 0;
+  __be16 proto = ethh.h_proto;
+  int off = ETH_HLEN;
+  for (int i = 0; i < MAX_VLAN_TAGS; i++) {
+    if (proto != bpf_htons(ETH_P_8021Q) && proto != bpf_htons(ETH_P_8021AD))
+      break;
+    // The tag control information is followed by the EtherType of the
+    // encapsulated frame.
+    if (bpf_skb_load_bytes(skb, off + 2, &proto, sizeof proto))
+      return 0;
+    off += VLAN_HLEN;
+  }
+  if (proto != bpf_htons(ETH_P_IP))
+    return 0;
+  return off;
+}
+
+// Returns the offset of the IP packet of a GTP-U G-PDU after the header at off,
+// or 0 if the packet is not a G-PDU or has more than GTPU_MAX_EXTENSIONS
+// extension headers. The signalling messages, e.g. echo requests and end
+// markers, carry no IP packet.
+static inline int gtpu_payload_offset(struct __sk_buff *skb, int off)
+{
+  struct gtpu_header_t hdr;
+  if (bpf_skb_load_bytes(skb, off, &hdr, sizeof hdr))
+    return 0;
+  if ((hdr.flags & GTPU_VERSION_PT_MASK) != GTPU_VERSION_PT || hdr.type != GTPU_TYPE_GPDU)
+    return 0;
+  off += GTPU_HLEN;
+  if (!(hdr.flags & GTPU_FLAGS_OPT))
+    return off;
+  __u8 next = 0;
+  if (hdr.flags & GTPU_FLAG_E) {
+    if (bpf_skb_load_bytes(skb, off + GTPU_OPT_LEN - 1, &next, sizeof next))
+      return 0;
+  }
+  off += GTPU_OPT_LEN;
+  for (int i = 0; i < GTPU_MAX_EXTENSIONS; i++) {
+    if (!next)
+      return off;
+    // The length of an extension header is in 4-byte multiples, its last
+    // byte is the type of the next one.
+    __u8 len;
+    if (bpf_skb_load_bytes(skb, off, &len, sizeof len))
+      return 0;
+    if (!len)
+      return 0;
+    off += len * 4;
+    if (bpf_skb_load_bytes(skb, off - 1, &next, sizeof next))
+      return 0;
+  }
+  if (next)
+    return 0;
+  return off;
+}
+
+// Returns the offset of the inner IPv4 header of a VXLAN, Geneve or GTP-U
+// packet to a port of capture_config_t, the offset of the IPv4 header of other
+// packets, or 0 if the inner packet is not IPv4. The inner packet of VXLAN is an
+// Ethernet frame, the one of Geneve an Ethernet frame or an IP packet, the one
+// of GTP-U an IP packet.
+static inline int decapsulate(struct __sk_buff *skb, int ip_off)
+{
+  __u32 zero = 0;
+  struct capture_config_t *capture = bpf_map_lookup_elem(&config_capture, &zero);
+  if (!capture || (!capture->vxlan_port && !capture->geneve_port && !capture->gtpu_port))
+    return ip_off;
+  struct iphdr iph;
+  if (bpf_skb_load_bytes(skb, ip_off, &iph, sizeof iph))
+    return ip_off;
+  if (iph.protocol != IPPROTO_UDP || (iph.frag_off & bpf_htons(IP_FRAGMENT_OFFSET_MASK)))
+    return ip_off;
+  int udp_off = ip_off + iph.ihl * 4;
+  __u16 ports[2];
+  if (bpf_skb_load_bytes(skb, udp_off, ports, sizeof ports))
+    return ip_off;
+  __u16 dst_port = bpf_ntohs(ports[1]);
+  int tunnel_off = udp_off + UDP_HLEN;
+  int inner_off;
+  if (dst_port == capture->vxlan_port) {
+    __u8 flags;
+    if (bpf_skb_load_bytes(skb, tunnel_off, &flags, sizeof flags))
+      return ip_off;
+    if (!(flags & VXLAN_FLAG_VNI))
+      return ip_off;
+    inner_off = tunnel_off + VXLAN_HLEN;
+  } else if (dst_port == capture->geneve_port) {
+    struct geneve_header_t hdr;
+    if (bpf_skb_load_bytes(skb, tunnel_off, &hdr, sizeof hdr))
+      return ip_off;
+    if (hdr.ver_opt_len >> 6)
+      return ip_off;
+    inner_off = tunnel_off + GENEVE_HLEN + (hdr.ver_opt_len & 0x3f) * 4;
+    if (hdr.protocol == bpf_htons(ETH_P_IP))
+      return inner_off;
+    if (hdr.protocol != bpf_htons(ETH_P_TEB))
+      return 0;
+  } else if (dst_port == capture->gtpu_port) {
+    inner_off = gtpu_payload_offset(skb, tunnel_off);
+    if (!inner_off)
+      return 0;
+    __u8 version;
+    if (bpf_skb_load_bytes(skb, inner_off, &version, sizeof version))
+      return 0;
+    if (version >> 4 != 4)
+      return 0;
+    return inner_off;
+  } else {
+    return ip_off;
+  }
+  struct ethhdr ethh;
+  if (bpf_skb_load_bytes(skb, inner_off, &ethh, sizeof ethh))
+    return 0;
+  if (ethh.h_proto != bpf_htons(ETH_P_IP))
+    return 0;
+  return inner_off + ETH_HLEN;
+}
+
+int capture_packets_internal(struct __sk_buff *skb)
+{
+  // Skip frames with non-IP Ethernet protocol.
+  int ip_off = ip_offset(skb);
+  if (!ip_off) {
+    return 0;
+  }
+  ip_off = decapsulate(skb, ip_off);
+  if (!ip_off) {
+    return 0;
+  }
+
+  __u32 zero = 0;
+  struct packet_ctx_t *ctx = bpf_map_lookup_elem(&packet_ctx, &zero);
+  if (!ctx) {
+    return 0;
+  }
+
+  // Read the IP header.
+  struct iphdr *iph = &ctx->iph;
+  if (bpf_skb_load_bytes(skb, ip_off, iph, sizeof *iph)) {
+    return 0;
+  }
+
+  if (iph->protocol == IPPROTO_ICMP) {
+    correlate_icmp(skb, ip_off + iph->ihl * 4);
+    return 0;
+  }
+
+  // Skip packets with IP protocol other than TCP, UDP and SCTP.
+  if (iph->protocol != IPPROTO_TCP && iph->protocol != IPPROTO_UDP
+      && iph->protocol != IPPROTO_SCTP) {
+    return 0;
+  }
+
+  struct cidr_key lpm_key;
+  lpm_key.prefixlen = 32;
+
+  // We can't check the two boolean expressions using '&&' or '||' as doing so
+  // causes clang to optimize to a '|=' bitwise operator on a pointer, which
+  // gets rejected by the verifier.
+  lpm_key.ip = iph->saddr;
+  void* src_addr_found = bpf_map_lookup_elem(&config_cidrs, &lpm_key);
+  if (!src_addr_found) {
+    lpm_key.ip = iph->daddr;
+    void* dst_addr_found = bpf_map_lookup_elem(&config_cidrs, &lpm_key);
+    if (!dst_addr_found) {
+      if (iph->protocol == IPPROTO_TCP)
+        count_port_match(skb, ctx, ip_off + iph->ihl * 4);
+      return 0;
+    }
+  }
+
+  // An IPv4 header doesn't have a fixed size. The IHL field of a packet
+  // represents the size of the IP header in 32-bit words, so we need to
+  // multiply this value by 4 to get the header size in bytes.
+  __u8 ip_header_len = iph->ihl * 4;
+  int tcp_off = ip_off + ip_header_len;
+
+  if (iph->protocol == IPPROTO_UDP) {
+    track_udp_flow(skb, iph, tcp_off);
+    return 0;
+  }
+  if (iph->protocol == IPPROTO_SCTP) {
+    track_sctp_association(skb, iph, tcp_off);
+    return 0;
+  }
+
+  // Read the TCP header.
+  struct tcphdr *tcph = &ctx->tcph;
+  if (bpf_skb_load_bytes(skb, tcp_off, tcph, sizeof *tcph)) {
+    return 0;
+  }
+
+  // Should be enabled from command-line explicitly for testing purposes.
+  #ifndef TEST_ENABLED
+  #define TEST_ENABLED 0
+  #endif
   if (TEST_ENABLED) {
-    __u32 zero = 0;
     __u64 *test_value = bpf_map_lookup_elem(&test_hook, &zero);
     if (test_value && *test_value != 0) {
       run_test_hook(*test_value);
@@ -306,13 +1341,16 @@ int capture_packets_internal(struct __sk_buff *skb)
     }
   }
 
-  __u16 src_port = bpf_ntohs(tcph.source);
-  __u16 dst_port = bpf_ntohs(tcph.dest);
-  void *src_port_found = bpf_map_lookup_elem(&config_ports, &src_port);
+  __u16 src_port = bpf_ntohs(tcph->source);
+  __u16 dst_port = bpf_ntohs(tcph->dest);
+  __u8 *src_port_found = bpf_map_lookup_elem(&config_ports, &src_port);
+  __u8 *dst_port_found = NULL;
   if (!src_port_found) {
-    void *dst_port_found = bpf_map_lookup_elem(&config_ports, &dst_port);
-    if (!dst_port_found)
+    dst_port_found = bpf_map_lookup_elem(&config_ports, &dst_port);
+    if (!dst_port_found) {
+      count_partial_match(iph, tcph, PARTIAL_MATCH_CIDR);
       return 0;
+    }
   }
 
   // We need to be able to determine whether the packet is from the client to
@@ -320,103 +1358,1015 @@ int capture_packets_internal(struct __sk_buff *skb)
   // server->client packets the source/dest IP and port need to be reversed so
   // that we can identify the right connection in the connections map.
   bool server_to_client = src_port_found;
+  // Mirrored traffic carries the connections between any peers, which can both
+  // use configured ports.
+  if (src_port_found && capture_span()) {
+    dst_port_found = bpf_map_lookup_elem(&config_ports, &dst_port);
+    if (dst_port_found)
+      server_to_client = is_server_to_client(iph, tcph);
+  }
+  __u8 *protocol = server_to_client ? src_port_found : dst_port_found;
+  // The ports configured for UDP or SCTP are not tracked for TCP.
+  if (protocol && (*protocol == PORT_PROTOCOL_UDP || *protocol == PORT_PROTOCOL_SCTP))
+    return 0;
 
-  struct tuple_key_t key;
+  struct tuple_key_t *key = &ctx->key;
   if (server_to_client) {
-    key.source_ip = iph.daddr;
-    key.dest_ip = iph.saddr;
-    key.source_port = tcph.dest;
-    key.dest_port = tcph.source;
+    key->source_ip = iph->daddr;
+    key->dest_ip = iph->saddr;
+    key->source_port = tcph->dest;
+    key->dest_port = tcph->source;
   } else {
-    key.source_ip = iph.saddr;
-    key.dest_ip = iph.daddr;
-    key.source_port = tcph.source;
-    key.dest_port = tcph.dest;
+    key->source_ip = iph->saddr;
+    key->dest_ip = iph->daddr;
+    key->source_port = tcph->source;
+    key->dest_port = tcph->dest;
   }
+  ctx->ip_off = ip_off;
+  ctx->tcp_off = tcp_off;
+  ctx->proxy_len = 0;
+  ctx->server_to_client = server_to_client;
+  ctx->protocol = protocol ? *protocol : PORT_PROTOCOL_TLS;
+
+  if (server_to_client)
+    check_ttl(iph->saddr, iph->ttl);
+
+  count_matched(skb);
+  bpf_tail_call(skb, &programs, PROG_L4_STATE);
+  // The tail call only returns if the sub-program is missing.
+  return 0;
+}
 
-  __u64 clock_key = 0;
+// Returns the length of the TCP payload. It ends with the IP packet rather than
+// the frame: short frames are padded to the minimum Ethernet frame size, and
+// mirrored frames can carry the frame check sequence. A total length of 0 is
+// left by segmentation offloads, the payload then ends with the frame.
+static inline __u32 payload_length(struct __sk_buff *skb, struct packet_ctx_t *ctx, int payload_off)
+{
+  __u32 end = ctx->ip_off + bpf_ntohs(ctx->iph.tot_len);
+  if (ctx->iph.tot_len == 0 || end > skb->len)
+    end = skb->len;
+  return end > payload_off ? end - payload_off : 0;
+}
+
+// Counts the payload bytes of a connection with an SNI in the data_bytes map if
+// config_stats enables it.
+static inline void count_data_bytes(struct tuple_data_t *conn, __u32 len)
+{
+  __u32 zero = 0;
+  struct stats_config_t *config = bpf_map_lookup_elem(&config_stats, &zero);
+  if (!config || !config->count_data_bytes || len == 0 || conn->state != SNI_RECEIVED)
+    return;
+  __u64 *count = bpf_map_lookup_elem(&data_bytes, conn->i.key);
+  if (count) {
+    __sync_fetch_and_add(count, len);
+    return;
+  }
+  // Another CPU might insert the entry at the same time.
+  __u64 initial = 0;
+  bpf_map_update_elem(&data_bytes, conn->i.key, &initial, BPF_NOEXIST);
+  count = bpf_map_lookup_elem(&data_bytes, conn->i.key);
+  if (count)
+    __sync_fetch_and_add(count, len);
+}
+
+// Finishes the processing of a packet of a known connection after the SNI
+// was handled: counts the payload and accounts for closed connections.
+static inline void finish_packet(struct __sk_buff *skb, struct packet_ctx_t *ctx, struct tuple_data_t *conn, int payload_off)
+{
+  struct tcphdr *tcph = &ctx->tcph;
+
+  count_data_bytes(conn, payload_length(skb, ctx, payload_off));
+  if (tcph->psh) {
+    __u16 data_bytes = payload_length(skb, ctx, payload_off);
+    __sync_fetch_and_add(&conn->num_packets, 1);
+    __sync_fetch_and_add(&conn->total_data_bytes, data_bytes);
+  }
+
+  if (tcph->rst) {
+    conn->transitions |= 1 << (ctx->server_to_client ? TRANSITION_RST_SERVER : TRANSITION_RST_CLIENT);
+    // Remember the SNI of a handshake reset before the ServerHello, a
+    // retransmitted ClientHello reveals a reset the client did not accept.
+    if (ctx->server_to_client && conn->state == SNI_RECEIVED
+        && !(conn->tls_flags & TLS_SERVER_HELLO_SEEN))
+      bpf_map_update_elem(&reset_handshakes, &ctx->key, conn->i.id.sni, BPF_ANY);
+    if (is_injected_rst(conn, &ctx->iph, ctx->server_to_client)) { // Middlebox RST
+      conn->state = RST_SENT_BY_MIDDLEBOX;
+      // Neither of the peers reset the connection, but the path is broken.
+      add_connection_to_stats(&ctx->key, conn, CONN_RESET_BY_MIDDLEBOX);
+    } else if (ctx->server_to_client) { // Server RST
+      conn->state = RST_SENT_BY_SERVER;
+      // Server RST could indicate server unavailability. Therefore, treat
+      // the connection as failed.
+      add_connection_to_stats(&ctx->key, conn, CONN_FAILED);
+    } else { // Client RST
+      conn->state = RST_SENT_BY_CLIENT;
+      // Client RST does not indicate server unavailability. Therefore, treat
+      // the connection as successful.
+      add_connection_to_stats(&ctx->key, conn, CONN_SUCCEEDED);
+    }
+  }
+
+  if (tcph->fin) {
+    conn->transitions |= 1 << TRANSITION_FIN;
+    conn->state = FIN_RECEIVED;
+    add_connection_to_stats(&ctx->key, conn, CONN_SUCCEEDED);
+  }
+}
+
+// Returns the number of bytes of the packet passed on to the userspace
+// socket. The return value of a socket filter is the snap length of the
+// packet, so payloads are only copied as far as needed.
+static inline int forward_length(int payload_off)
+{
+  __u32 zero = 0;
+  struct forward_config_t *forward = bpf_map_lookup_elem(&config_forward, &zero);
+  if (!forward || !forward->enabled)
+    return 0;
+  if (forward->snaplen > 0)
+    return forward->snaplen;
+  return payload_off + TLS_RECORD_HEADER_LEN;
+}
+
+// The TLS payload starts after the TCP header, whose data offset field is
+// specified in 32-bit words, and after a PROXY protocol header.
+static inline int payload_offset(struct packet_ctx_t *ctx)
+{
+  return ctx->tcp_off + ctx->tcph.doff * 4 + ctx->proxy_len;
+}
+
+// Returns the length of the PROXY protocol header of version 1 at the offset,
+// which starts with "PROXY ", or 0 if it does not end within PROXY_V1_MAX_LEN.
+// The source address of "PROXY TCP4" is stored in source_ip, in network byte
+// order.
+static inline int proxy_v1_length(struct __sk_buff *skb, int off, __u32 *source_ip)
+{
+  int len = 0;
+  for (int i = 0; i < PROXY_V1_MAX_LEN / PROXY_V1_CHUNK_LEN + 1 && !len; i++) {
+    char chunk[PROXY_V1_CHUNK_LEN] = {};
+    int chunk_off = i * PROXY_V1_CHUNK_LEN;
+    // The last chunk of a payload ending within the header overlaps the
+    // previous one, so it ends with the payload.
+    bool last = off + chunk_off + PROXY_V1_CHUNK_LEN > skb->len;
+    if (last)
+      chunk_off = (int)skb->len - off - PROXY_V1_CHUNK_LEN;
+    if (chunk_off < 0 || bpf_skb_load_bytes(skb, off + chunk_off, chunk, sizeof chunk))
+      return 0;
+    for (int j = 0; j < PROXY_V1_CHUNK_LEN; j++) {
+      if (chunk[j] == '\n') {
+        len = chunk_off + j + 1;
+        break;
+      }
+    }
+    if (last && !len)
+      return 0;
+  }
+  if (!len || len > PROXY_V1_MAX_LEN)
+    return 0;
+
+  char prefix[PROXY_V1_TCP4_PREFIX_LEN];
+  if (bpf_skb_load_bytes(skb, off, prefix, sizeof prefix))
+    return len;
+  if (prefix[6] != 'T' || prefix[7] != 'C' || prefix[8] != 'P' || prefix[9] != '4' || prefix[10] != ' ')
+    return len;
+  char addr[PROXY_V1_MAX_ADDR_LEN];
+  if (bpf_skb_load_bytes(skb, off + PROXY_V1_TCP4_PREFIX_LEN, addr, sizeof addr))
+    return len;
+  __u32 ip = 0, octet = 0, dots = 0;
+  for (int i = 0; i < PROXY_V1_MAX_ADDR_LEN; i++) {
+    char c = addr[i];
+    if (c >= '0' && c <= '9') {
+      octet = octet * 10 + (c - '0');
+      if (octet > 255)
+        return len;
+    } else if (c == '.' && dots < 3) {
+      ip = ip << 8 | octet;
+      octet = 0;
+      dots++;
+    } else if (c == ' ' && dots == 3) {
+      *source_ip = bpf_htonl(ip << 8 | octet);
+      return len;
+    } else {
+      return len;
+    }
+  }
+  return len;
+}
+
+// Returns the length of the PROXY protocol header at the start of the payload,
+// or 0 if it does not start with one. The source address of a header of a TCP
+// connection over IPv4 is stored in source_ip, in network byte order, headers
+// without one, e.g. of the health checks of the load balancer, leave it.
+static inline int proxy_header_length(struct __sk_buff *skb, int payload_off, __u32 *source_ip)
+{
+  __u8 hdr[PROXY_V2_HEADER_LEN];
+  if (bpf_skb_load_bytes(skb, payload_off, hdr, PROXY_V1_PREFIX_LEN))
+    return 0;
+  if (hdr[0] == 'P' && hdr[1] == 'R' && hdr[2] == 'O' && hdr[3] == 'X' && hdr[4] == 'Y' && hdr[5] == ' ')
+    return proxy_v1_length(skb, payload_off, source_ip);
+
+  if (bpf_skb_load_bytes(skb, payload_off, hdr, sizeof hdr))
+    return 0;
+  // The signature is "\r\n\r\n\0\r\nQUIT\n".
+  if (hdr[0] != '\r' || hdr[1] != '\n' || hdr[2] != '\r' || hdr[3] != '\n'
+      || hdr[4] != '\0' || hdr[5] != '\r' || hdr[6] != '\n' || hdr[7] != 'Q'
+      || hdr[8] != 'U' || hdr[9] != 'I' || hdr[10] != 'T' || hdr[11] != '\n')
+    return 0;
+  if (hdr[12] >> 4 != PROXY_V2_VERSION)
+    return 0;
+  __u16 addr_len = (__u16)hdr[14] << 8 | hdr[15];
+  if ((hdr[12] & 0xf) == PROXY_V2_CMD_PROXY && hdr[13] >> 4 == PROXY_V2_FAMILY_INET
+      && addr_len >= 4)
+    bpf_skb_load_bytes(skb, payload_off + PROXY_V2_HEADER_LEN, source_ip, sizeof *source_ip);
+  return PROXY_V2_HEADER_LEN + addr_len;
+}
+
+// Skips the PROXY protocol header a load balancer put in front of the stream
+// of the client, so the ClientHello is parsed after it. The original client of
+// the header becomes the source IP of the stats key if configured.
+static inline void skip_proxy_header(struct __sk_buff *skb, struct packet_ctx_t *ctx, struct tuple_data_t *conn)
+{
+  __u32 source_ip = 0;
+  int len = proxy_header_length(skb, payload_offset(ctx), &source_ip);
+  if (!len)
+    return;
+  ctx->proxy_len = len;
+  conn->tls_flags |= PROXY_HEADER_SKIPPED;
+  if (!source_ip)
+    return;
   __u32 zero = 0;
+  struct capture_config_t *capture = bpf_map_lookup_elem(&config_capture, &zero);
+  if (capture && capture->proxy_source_ip)
+    conn->i.id.source_ip = source_ip;
+}
+
+// Checks whether the payload starts with a handshake record holding a
+// ServerHello.
+static inline bool is_server_hello(struct __sk_buff *skb, int payload_off)
+{
+  __u8 header[TLS_HANDSHAKE_TYPE_OFF + 1];
+  if (bpf_skb_load_bytes(skb, payload_off, header, sizeof header))
+    return false;
+  return header[0] == TLS_CONTENT_TYPE_HANDSHAKE
+    && header[TLS_HANDSHAKE_TYPE_OFF] == TLS_HANDSHAKE_TYPE_SERVER_HELLO;
+}
+
+// Follows the records and handshake messages of the server flight of TLS 1.2
+// through the packet by their TCP sequence numbers, from the ServerHello to the
+// ServerHelloDone, and sets TLS_CERTIFICATE_REQUESTED on a CertificateRequest.
+// The Certificate usually spans several segments, so the headers cannot be
+// found by looking at the start of the payload. The tracking stops at the end
+// of the flight, at a record other than a handshake record, e.g. the
+// ChangeCipherSpec or the encrypted records of TLS 1.3, and at the end of the
+// handshake. A header split over two segments is not seen, nor a packet lost
+// on the way to the program, so the following headers are missed.
+static inline void scan_server_flight(struct __sk_buff *skb, struct packet_ctx_t *ctx, struct tuple_data_t *conn, int payload_off)
+{
+  __u32 seq = bpf_ntohl(ctx->tcph.seq);
+  __u32 len = payload_length(skb, ctx, payload_off);
+  for (int i = 0; i < TLS_MAX_FLIGHT_HEADERS; i++) {
+    // A message header is in the current record before its end, otherwise
+    // the next record header comes first.
+    if ((__s32)(conn->server_message_seq - conn->server_record_seq) < 0) {
+      __u32 off = conn->server_message_seq - seq;
+      if (off >= len)
+        return;
+      __u8 header[TLS_HANDSHAKE_HEADER_LEN];
+      if (bpf_skb_load_bytes(skb, payload_off + off, header, sizeof header))
+        return;
+      if (header[0] == TLS_HANDSHAKE_TYPE_CERTIFICATE_REQUEST)
+        conn->tls_flags |= TLS_CERTIFICATE_REQUESTED;
+      if (header[0] == TLS_HANDSHAKE_TYPE_CERTIFICATE_REQUEST
+          || header[0] == TLS_HANDSHAKE_TYPE_SERVER_HELLO_DONE) {
+        conn->tls_flags &= ~TLS_SERVER_FLIGHT_TRACKED;
+        return;
+      }
+      __u32 message_len = (header[1] << 16) | (header[2] << 8) | header[3];
+      conn->server_message_seq += TLS_HANDSHAKE_HEADER_LEN + message_len;
+      continue;
+    }
+    __u32 off = conn->server_record_seq - seq;
+    if (off >= len)
+      return;
+    __u8 header[TLS_RECORD_HEADER_LEN];
+    if (bpf_skb_load_bytes(skb, payload_off + off, header, sizeof header))
+      return;
+    if (header[0] != TLS_CONTENT_TYPE_HANDSHAKE) {
+      conn->tls_flags &= ~TLS_SERVER_FLIGHT_TRACKED;
+      return;
+    }
+    // The next message header, or the rest of a message fragmented over
+    // several records, follows the record header.
+    conn->server_message_seq += TLS_RECORD_HEADER_LEN;
+    conn->server_record_seq += TLS_RECORD_HEADER_LEN + ((header[3] << 8) | header[4]);
+  }
+}
+
+// Checks whether the payload starts with a handshake record holding a
+// ClientHello.
+static inline bool is_client_hello(struct __sk_buff *skb, int payload_off)
+{
+  __u8 header[TLS_HANDSHAKE_TYPE_OFF + 1];
+  if (bpf_skb_load_bytes(skb, payload_off, header, sizeof header))
+    return false;
+  return header[0] == TLS_CONTENT_TYPE_HANDSHAKE
+    && header[TLS_HANDSHAKE_TYPE_OFF] == TLS_HANDSHAKE_TYPE_CLIENT_HELLO;
+}
+
+// Counts a ClientHello of a connection which was reset before the ServerHello.
+// The client only retransmits it if it did not accept the reset, so the reset
+// was probably injected by a middlebox filtering the SNI.
+static inline void check_client_hello_after_rst(struct __sk_buff *skb, struct packet_ctx_t *ctx)
+{
+  char *sni = bpf_map_lookup_elem(&reset_handshakes, &ctx->key);
+  if (!sni || !is_client_hello(skb, payload_offset(ctx)))
+    return;
+  struct interception_t *i = interception(sni);
+  if (i)
+    __sync_fetch_and_add(&i->client_hellos_after_rst, 1);
+  bpf_map_delete_elem(&reset_handshakes, &ctx->key);
+}
+
+// Returns the ALPN_* protocol of the protocol name of the given length at the
+// offset.
+static inline __u8 alpn_protocol(struct __sk_buff *skb, int off, __u8 len)
+{
+  char name[ALPN_HTTP_1_1_NAME_LEN];
+  if (len == 2) {
+    if (bpf_skb_load_bytes(skb, off, name, 2) || name[0] != 'h')
+      return ALPN_OTHER;
+    if (name[1] == '2')
+      return ALPN_H2;
+    if (name[1] == '3')
+      return ALPN_H3;
+  } else if (len == ALPN_HTTP_1_1_NAME_LEN) {
+    if (bpf_skb_load_bytes(skb, off, name, ALPN_HTTP_1_1_NAME_LEN))
+      return ALPN_OTHER;
+    char http_1_1[ALPN_HTTP_1_1_NAME_LEN];
+    __builtin_memcpy(http_1_1, ALPN_HTTP_1_1_NAME, ALPN_HTTP_1_1_NAME_LEN);
+    for (int i = 0; i < ALPN_HTTP_1_1_NAME_LEN; i++) {
+      if (name[i] != http_1_1[i])
+        return ALPN_OTHER;
+    }
+    return ALPN_HTTP_1_1;
+  }
+  return ALPN_OTHER;
+}
+
+static inline void count_alpn(char *sni, __u8 side, __u8 protocol)
+{
+  struct alpn_t key = {};
+  __builtin_memcpy(key.sni, sni, TLS_MAX_SERVER_NAME_LEN);
+  key.side = side;
+  key.protocol = protocol;
+
+  __u64 *count = bpf_map_lookup_elem(&alpn, &key);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+    return;
+  }
+  // Another CPU might insert the entry at the same time.
+  __u64 zero = 0;
+  bpf_map_update_elem(&alpn, &key, &zero, BPF_NOEXIST);
+  count = bpf_map_lookup_elem(&alpn, &key);
+  if (count)
+    __sync_fetch_and_add(count, 1);
+}
+
+// Counts the protocols offered by the ALPN extension of a ClientHello at the
+// offset, ALPN_NONE without one. Only the first MAX_ALPN_PROTOCOL_COUNT
+// protocols are looked at.
+static inline void count_alpn_offered(struct __sk_buff *skb, int alpn_ext_off, struct tuple_data_t *conn)
+{
+  if (alpn_ext_off == 0) {
+    count_alpn(conn->i.id.sni, ALPN_OFFERED, ALPN_NONE);
+    return;
+  }
+  __u16 list_len_be;
+  if (bpf_skb_load_bytes(skb, alpn_ext_off + TLS_ALPN_LIST_LENGTH_OFF, &list_len_be, 2))
+    return;
+  __u16 list_len = bpf_ntohs(list_len_be);
+  int list_off = alpn_ext_off + TLS_ALPN_LIST_OFF;
+  __u8 offered = 0;
+  __u16 cur = 0;
+  for (int i = 0; i < MAX_ALPN_PROTOCOL_COUNT; i++) {
+    if (cur >= list_len)
+      break;
+    __u8 len;
+    if (bpf_skb_load_bytes(skb, list_off + cur, &len, 1))
+      break;
+    offered |= 1 << alpn_protocol(skb, list_off + cur + 1, len);
+    cur += 1 + len;
+  }
+  // A protocol offered twice is counted once.
+  for (__u8 protocol = ALPN_H2; protocol <= ALPN_OTHER; protocol++) {
+    if (offered & (1 << protocol))
+      count_alpn(conn->i.id.sni, ALPN_OFFERED, protocol);
+  }
+}
+
+// Counts the protocol selected by the ServerHello at the offset. The session ID
+// length has been checked by the caller. TLS 1.3 sends the ALPN extension in
+// the encrypted EncryptedExtensions, so it is counted as ALPN_ENCRYPTED.
+static inline void count_alpn_selected(struct __sk_buff *skb, int payload_off, __u8 session_id_len, bool tls13, struct tuple_data_t *conn)
+{
+  if (tls13) {
+    count_alpn(conn->i.id.sni, ALPN_SELECTED, ALPN_ENCRYPTED);
+    return;
+  }
+  int extensions_len_off = payload_off + TLS_SESSION_ID_LENGTH_OFF + TLS_SESSION_ID_LENGTH_LEN
+      + session_id_len + TLS_CIPHER_SUITE_LEN + TLS_COMPRESSION_METHOD_LEN;
+  __u16 extensions_len_be;
+  // A ServerHello without extensions.
+  if (bpf_skb_load_bytes(skb, extensions_len_off, &extensions_len_be, 2)) {
+    count_alpn(conn->i.id.sni, ALPN_SELECTED, ALPN_NONE);
+    return;
+  }
+  __u16 extensions_len = bpf_ntohs(extensions_len_be);
+  int extensions_off = extensions_len_off + TLS_EXTENSIONS_LENGTH_LEN;
+
+  __u8 selected = ALPN_NONE;
+  __u16 cur = 0;
+  for (int i = 0; i < TLS_MAX_EXTENSION_COUNT; i++) {
+    if (cur >= extensions_len)
+      break;
+    __u16 ext_type_be, len_be;
+    if (bpf_skb_load_bytes(skb, extensions_off + cur, &ext_type_be, 2)
+        || bpf_skb_load_bytes(skb, extensions_off + cur + TLS_EXTENSION_TYPE_LEN, &len_be, 2))
+      break;
+    if (bpf_ntohs(ext_type_be) == TLS_EXTENSION_ALPN) {
+      // The list holds the single selected protocol.
+      __u8 len;
+      selected = ALPN_OTHER;
+      if (!bpf_skb_load_bytes(skb, extensions_off + cur + TLS_ALPN_LIST_OFF, &len, 1))
+        selected = alpn_protocol(skb, extensions_off + cur + TLS_ALPN_LIST_OFF + 1, len);
+      break;
+    }
+    cur += TLS_EXTENSION_TYPE_LEN + TLS_EXTENSION_LENGTH_LEN + bpf_ntohs(len_be);
+  }
+  count_alpn(conn->i.id.sni, ALPN_SELECTED, selected);
+}
+
+// Checks whether the TLS 1.3 ServerHello at the offset selects one of the
+// pre-shared keys offered by the ClientHello, i.e. resumes a session. The
+// session ID length has been checked by the caller.
+static inline bool server_hello_selects_psk(struct __sk_buff *skb, int payload_off, __u8 session_id_len)
+{
+  int extensions_len_off = payload_off + TLS_SESSION_ID_LENGTH_OFF + TLS_SESSION_ID_LENGTH_LEN
+      + session_id_len + TLS_CIPHER_SUITE_LEN + TLS_COMPRESSION_METHOD_LEN;
+  __u16 extensions_len_be;
+  if (bpf_skb_load_bytes(skb, extensions_len_off, &extensions_len_be, 2))
+    return false;
+  __u16 extensions_len = bpf_ntohs(extensions_len_be);
+  int extensions_off = extensions_len_off + TLS_EXTENSIONS_LENGTH_LEN;
+
+  __u16 cur = 0;
+  for (int i = 0; i < TLS_MAX_EXTENSION_COUNT; i++) {
+    if (cur >= extensions_len)
+      break;
+    __u16 ext_type_be, len_be;
+    if (bpf_skb_load_bytes(skb, extensions_off + cur, &ext_type_be, 2)
+        || bpf_skb_load_bytes(skb, extensions_off + cur + TLS_EXTENSION_TYPE_LEN, &len_be, 2))
+      break;
+    if (bpf_ntohs(ext_type_be) == TLS_EXTENSION_PRE_SHARED_KEY)
+      return true;
+    cur += TLS_EXTENSION_TYPE_LEN + TLS_EXTENSION_LENGTH_LEN + bpf_ntohs(len_be);
+  }
+  return false;
+}
+
+// Counts the TLS version and cipher suite negotiated by a ServerHello and the
+// selected protocol. The cipher suite follows the session ID, whose length
+// varies. A TLS 1.3 ServerHello accepting the pre_shared_key of the
+// ClientHello resumes the session, see TLS_SESSION_RESUMED.
+static inline void count_tls_parameters(struct __sk_buff *skb, int payload_off, struct tuple_data_t *conn)
+{
+  __u8 hello[TLS_SESSION_ID_LENGTH_OFF + 1];
+  if (bpf_skb_load_bytes(skb, payload_off, hello, sizeof hello))
+    return;
+  __u8 session_id_len = hello[TLS_SESSION_ID_LENGTH_OFF];
+  if (session_id_len > 32)
+    return;
+  __u8 cipher_suite[2];
+  if (bpf_skb_load_bytes(skb, payload_off + TLS_SESSION_ID_LENGTH_OFF + 1 + session_id_len, cipher_suite, sizeof cipher_suite))
+    return;
+
+  struct tls_parameters_t key = {};
+  __builtin_memcpy(key.sni, conn->i.id.sni, TLS_MAX_SERVER_NAME_LEN);
+  key.version = (hello[TLS_SERVER_HELLO_VERSION_OFF] << 8) | hello[TLS_SERVER_HELLO_VERSION_OFF + 1];
+  key.cipher_suite = (cipher_suite[0] << 8) | cipher_suite[1];
+  if (cipher_suite[0] == TLS_1_3_CIPHER_SUITE_PREFIX)
+    key.version = TLS_VERSION_1_3;
+  if (key.version == TLS_VERSION_1_3)
+    conn->tls_flags |= TLS_1_3_NEGOTIATED;
+  if (key.version == TLS_VERSION_1_3 && (conn->tls_flags & TLS_PSK_OFFERED)
+      && server_hello_selects_psk(skb, payload_off, session_id_len))
+    conn->tls_flags |= TLS_SESSION_RESUMED;
+  key.resumed = (conn->tls_flags & TLS_SESSION_RESUMED) != 0;
+  key.early_data = (conn->tls_flags & TLS_EARLY_DATA_OFFERED) != 0;
+
+  __u64 *count = bpf_map_lookup_elem(&tls_parameters, &key);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+    return;
+  }
+  // Another CPU might insert the entry at the same time.
+  __u64 zero = 0;
+  bpf_map_update_elem(&tls_parameters, &key, &zero, BPF_NOEXIST);
+  count = bpf_map_lookup_elem(&tls_parameters, &key);
+  if (count)
+    __sync_fetch_and_add(count, 1);
+
+  count_alpn_selected(skb, payload_off, session_id_len, key.version == TLS_VERSION_1_3, conn);
+}
+
+// Applies the SNI reassembled in userspace to the connection. The connection is
+// only updated by the packets, so the update does not race with them. The time
+// of the ClientHello is unknown, so the handshake latency is not measured.
+static inline void apply_reassembled_sni(struct packet_ctx_t *ctx, struct tuple_data_t *conn)
+{
+  char *sni = bpf_map_lookup_elem(&reassembled_snis, &ctx->key);
+  if (!sni)
+    return;
+  for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
+    if (sni[i] == '\0')
+      break;
+    conn->i.id.sni[i] = sni[i];
+  }
+  conn->state = SNI_RECEIVED;
+  conn->transitions |= 1 << TRANSITION_SNI;
+  remember_mptcp_connection(conn);
+  bpf_map_delete_elem(&reassembled_snis, &ctx->key);
+}
+
+// Checks whether the payload of a packet from the client after the ServerHello
+// holds the Finished of the client. The records are not decrypted, so the
+// Finished is recognized by the record before it: the ChangeCipherSpec with
+// TLS 1.2 and with the middlebox compatibility mode of TLS 1.3. Otherwise, the
+// first encrypted record of the client with TLS 1.3 is the Finished, unless it
+// is short enough to be an alert.
+static inline bool is_client_finished(struct __sk_buff *skb, int payload_off)
+{
+  __u8 header[TLS_RECORD_HEADER_LEN];
+  if (bpf_skb_load_bytes(skb, payload_off, header, sizeof header))
+    return false;
+  if (header[0] == TLS_CONTENT_TYPE_CHANGE_CIPHER_SPEC)
+    return true;
+  __u16 record_len = ((__u16)header[3] << 8) | header[4];
+  return header[0] == TLS_CONTENT_TYPE_APPLICATION_DATA
+    && record_len > TLS_ENCRYPTED_ALERT_MAX_LEN;
+}
+
+// Counts a fatal alert at the start of the payload, e.g. the handshake_failure
+// of a server rejecting the ClientHello or the unknown_ca of a client rejecting
+// the certificate. Only the plaintext alerts are recognized: with TLS 1.3, the
+// alerts after the ServerHello are encrypted.
+static inline void count_tls_alert(struct __sk_buff *skb, int payload_off, struct tuple_data_t *conn, bool from_server)
+{
+  __u8 record[TLS_RECORD_HEADER_LEN + 2];
+  if (bpf_skb_load_bytes(skb, payload_off, record, sizeof record))
+    return;
+  if (record[0] != TLS_CONTENT_TYPE_ALERT || record[TLS_RECORD_HEADER_LEN] != TLS_ALERT_LEVEL_FATAL)
+    return;
+  conn->tls_flags |= TLS_ALERT_COUNTED;
+
+  struct tls_alert_t key = {};
+  __builtin_memcpy(key.sni, conn->i.id.sni, TLS_MAX_SERVER_NAME_LEN);
+  key.description = record[TLS_RECORD_HEADER_LEN + 1];
+  key.from_server = from_server;
+  __u64 *count = bpf_map_lookup_elem(&tls_alerts, &key);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+    return;
+  }
+  // Another CPU might insert the entry at the same time.
+  __u64 zero = 0;
+  bpf_map_update_elem(&tls_alerts, &key, &zero, BPF_NOEXIST);
+  count = bpf_map_lookup_elem(&tls_alerts, &key);
+  if (count)
+    __sync_fetch_and_add(count, 1);
+}
+
+// Counts the ApplicationData records of the segment, up to
+// TLS_MAX_SEGMENT_RECORDS records from the start of the payload. The records are
+// only found if the payload starts with a record header, not in the middle of a
+// record spanning several segments.
+static inline __u32 count_application_data_records(struct __sk_buff *skb, int payload_off)
+{
+  __u32 count = 0;
+  int off = payload_off;
+  for (int i = 0; i < TLS_MAX_SEGMENT_RECORDS; i++) {
+    __u8 header[TLS_RECORD_HEADER_LEN];
+    if (bpf_skb_load_bytes(skb, off, header, sizeof header))
+      break;
+    if (header[0] < TLS_CONTENT_TYPE_CHANGE_CIPHER_SPEC || header[0] > TLS_CONTENT_TYPE_APPLICATION_DATA)
+      break;
+    if (header[0] == TLS_CONTENT_TYPE_APPLICATION_DATA)
+      count++;
+    off += TLS_RECORD_HEADER_LEN + (((__u16)header[3] << 8) | header[4]);
+  }
+  return count;
+}
+
+// Reads the MPTCP option of a SYN or a SYN-ACK: the MP_CAPABLE or MP_JOIN of the
+// SYN of the client, and the key of the server from the MP_CAPABLE of the
+// SYN-ACK of an MPTCP connection. The first SYN-ACK of a subflow counts it as
+// joined.
+static inline void parse_mptcp_option(struct __sk_buff *skb, struct packet_ctx_t *ctx, struct tuple_data_t *conn)
+{
+  int off = ctx->tcp_off + sizeof(struct tcphdr);
+  int end = ctx->tcp_off + ctx->tcph.doff * 4;
+  bool found = false;
+  for (int i = 0; i < TCP_MAX_OPTION_COUNT; i++) {
+    __u8 option[2];
+    if (off >= end || bpf_skb_load_bytes(skb, off, option, 1) || option[0] == TCP_OPTION_END)
+      return;
+    if (option[0] == TCP_OPTION_NOP) {
+      off++;
+      continue;
+    }
+    if (bpf_skb_load_bytes(skb, off, option, sizeof option) || option[1] < 2)
+      return;
+    if (option[0] == TCP_OPTION_MPTCP) {
+      found = true;
+      break;
+    }
+    off += option[1];
+  }
+  if (!found)
+    return;
+  __u8 subtype;
+  if (bpf_skb_load_bytes(skb, off + MPTCP_SUBTYPE_OFF, &subtype, 1))
+    return;
+  subtype >>= 4;
+  if (!ctx->tcph.ack) {
+    if (subtype == MPTCP_SUB_CAPABLE) {
+      conn->tls_flags |= MPTCP_CAPABLE;
+    } else if (subtype == MPTCP_SUB_JOIN) {
+      conn->tls_flags |= MPTCP_SUBFLOW;
+      bpf_skb_load_bytes(skb, off + MPTCP_JOIN_TOKEN_OFF, &conn->mptcp_token, sizeof conn->mptcp_token);
+    }
+  } else if (subtype == MPTCP_SUB_CAPABLE && (conn->tls_flags & MPTCP_CAPABLE)) {
+    bpf_skb_load_bytes(skb, off + MPTCP_CAPABLE_KEY_OFF, &conn->mptcp_key, sizeof conn->mptcp_key);
+  } else if (subtype == MPTCP_SUB_JOIN && (conn->tls_flags & MPTCP_SUBFLOW) && conn->state == SYN_RECEIVED) {
+    count_mptcp_subflow(conn->mptcp_token, false);
+  }
+}
+
+// Tracks the TCP state of the connection of the packet. Payloads before the
+// SNI is known are handed over to the TLS parse program.
+SEC("socket/l4_state")
+int l4_state(struct __sk_buff *skb)
+{
+  __u32 zero = 0;
+  struct packet_ctx_t *ctx = bpf_map_lookup_elem(&packet_ctx, &zero);
+  if (!ctx)
+    return 0;
+  struct iphdr *iph = &ctx->iph;
+  struct tcphdr *tcph = &ctx->tcph;
+
   __u64 *clock_key_ptr = bpf_map_lookup_elem(&ticker_clock, &zero);
   if (!clock_key_ptr) {
     return 0;
   }
 
-  if (tcph.syn && !tcph.ack) { // New connection
+  if (tcph->syn && !tcph->ack) { // New connection
     struct tuple_data_t value = {
       .state = SYN_RECEIVED,
       .ticker_clock_first_packet = *clock_key_ptr,
+      // An ECN-setup SYN has both the ECE and the CWR flags set (RFC 3168).
+      .ecn_flags = tcph->ece && tcph->cwr ? ECN_REQUESTED : 0,
+      .syn_ns = latency_clock_ns(),
+      .transitions = 1 << TRANSITION_SYN,
       // TODO: Add more fields.
     };
-    value.i.id.source_ip = key.source_ip;
-    value.i.id.dest_ip = key.dest_ip;
-    bpf_map_update_elem(&connections, &key, &value, BPF_ANY);
+    value.i.id.source_ip = ctx->key.source_ip;
+    value.i.id.dest_ip = ctx->key.dest_ip;
+    bpf_map_update_elem(&connections, &ctx->key, &value, BPF_ANY);
     // TODO: We aren't returning here because we still want to push the packet
     // to the queue as long as we don't have complete business logic in eBPF.
   }
 
   // Existing connection - look it up in the connections map.
-  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &key);
-  if (!conn)
+  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &ctx->key);
+  if (!conn) {
+    // The connection was closed, but the client might still send payloads.
+    if (!ctx->server_to_client && tcph->psh)
+      check_client_hello_after_rst(skb, ctx);
     return 0;
+  }
 
-  if (tcph.syn && tcph.ack)
+  // The MPTCP options are only looked for in the SYN and the SYN-ACK.
+  if (tcph->syn)
+    parse_mptcp_option(skb, ctx, conn);
+
+  if (tcph->syn && tcph->ack) {
+    // Retransmitted SYN-ACKs do not change the connect latency.
+    if (conn->state == SYN_RECEIVED)
+      conn->connect_latency_us = latency_since_us(conn->syn_ns);
     conn->state = SYNACK_RECEIVED; // TODO: Is this operation safe?
+    conn->transitions |= 1 << TRANSITION_SYNACK;
+  }
 
-  if (tcph.psh) {
-    // The data offset field in the header is specified in 32-bit words. We
-    // have to multiply this value by 4 to get the TCP header length in bytes.
-    __u8 tcp_header_len = tcph.doff * 4;
-    // TLS data starts at this offset.
-    int payload_off = tcp_off + tcp_header_len;
-
-    if (conn->state == SNI_RECEIVED) {
-      if (conn->num_packets > CONN_MIN_NUM_OF_PACKETS
-          || conn->total_data_bytes > CONN_MIN_DATA_BYTES) {
-        add_connection_to_stats(&key, conn->i.key, true);
-      }
-    } else {
-      // Parse SNI.
-      char sni[TLS_MAX_SERVER_NAME_LEN] = {};
-      int read = parse_sni(skb, payload_off, sni);
-      // Update SNI in connection data.
-      if (read > 0) {
-        for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
-          if (sni[i] == '\0')
-            break;
-          conn->i.id.sni[i] = sni[i];
-        }
-        conn->state = SNI_RECEIVED;
-      }
+  // The server accepts ECN with an ECN-setup SYN-ACK which has only the ECE
+  // flag set. Afterwards, the ECE and CWR flags signal congestion.
+  if (tcph->syn && tcph->ack && tcph->ece && !tcph->cwr && (conn->ecn_flags & ECN_REQUESTED))
+    conn->ecn_flags |= ECN_ACCEPTED;
+  if ((iph->tos & IP_ECN_MASK) == IP_ECN_CE)
+    __sync_fetch_and_add(&conn->ce_packets, 1);
+  if (!tcph->syn && tcph->ece)
+    __sync_fetch_and_add(&conn->ece_packets, 1);
+  if (!tcph->syn && tcph->cwr)
+    __sync_fetch_and_add(&conn->cwr_packets, 1);
+
+  // Remember the TTL of the peers to be able to attribute resets.
+  __u8 previous_server_ttl = conn->server_ttl;
+  if (!tcph->rst) {
+    if (ctx->server_to_client)
+      conn->server_ttl = iph->ttl;
+    else
+      conn->client_ttl = iph->ttl;
+  }
+
+  if (conn->state != SNI_RECEIVED)
+    apply_reassembled_sni(ctx, conn);
+  // The header comes first in the stream of the client, before any record.
+  if (!ctx->server_to_client && conn->state != SNI_RECEIVED
+      && !(conn->tls_flags & PROXY_HEADER_SKIPPED))
+    skip_proxy_header(skb, ctx, conn);
+
+  int payload_off = payload_offset(ctx);
+  // Only the last segment of a ClientHello split over several segments is
+  // usually pushed, so all the payloads of the client are parsed until the SNI
+  // is known.
+  if (conn->state != SNI_RECEIVED
+      && (tcph->psh || (!ctx->server_to_client && payload_length(skb, ctx, payload_off) > 0))) {
+    if (ctx->protocol == PORT_PROTOCOL_HTTP)
+      bpf_tail_call(skb, &programs, PROG_HTTP_PARSE);
+    else
+      bpf_tail_call(skb, &programs, PROG_TLS_PARSE);
+    // Without the parser, the connection is still tracked below.
+  }
+  // The segments of the server flight without PSH hold headers too.
+  if (ctx->server_to_client && (conn->tls_flags & TLS_SERVER_FLIGHT_TRACKED)) {
+    if (conn->tls_flags & TLS_HANDSHAKE_FINISHED)
+      conn->tls_flags &= ~TLS_SERVER_FLIGHT_TRACKED;
+    else
+      scan_server_flight(skb, ctx, conn, payload_off);
+  }
+  if (tcph->psh) {
+    // Remember the ServerHello, a ClientHello without one is an abandoned
+    // handshake.
+    if (conn->state == SNI_RECEIVED && ctx->server_to_client
+        && !(conn->tls_flags & TLS_SERVER_HELLO_SEEN)
+        && is_server_hello(skb, payload_off)) {
+      conn->tls_flags |= TLS_SERVER_HELLO_SEEN;
+      conn->handshake_latency_us = latency_since_us(conn->client_hello_ns);
+      conn->handshake_duration_us = latency_since_us(conn->syn_ns);
+      check_split_handshake(conn, previous_server_ttl, iph->ttl);
+      count_tls_parameters(skb, payload_off, conn);
+      conn->tls_flags |= TLS_SERVER_FLIGHT_TRACKED;
+      conn->server_record_seq = bpf_ntohl(tcph->seq);
+      conn->server_message_seq = conn->server_record_seq;
+      scan_server_flight(skb, ctx, conn, payload_off);
+    }
+    // A fatal alert during the handshake tells why a peer rejected it, the
+    // connection is usually closed right after.
+    if (conn->state == SNI_RECEIVED
+        && !(conn->tls_flags & (TLS_HANDSHAKE_FINISHED | TLS_ALERT_COUNTED | HTTP_HOST_PARSED | SCTP_ASSOCIATION)))
+      count_tls_alert(skb, payload_off, conn, ctx->server_to_client);
+    // The second half of the handshake ends with the Finished of the client.
+    // A connection closed before is a failed handshake.
+    if (conn->state == SNI_RECEIVED && !ctx->server_to_client
+        && (conn->tls_flags & TLS_SERVER_HELLO_SEEN)
+        && !(conn->tls_flags & TLS_HANDSHAKE_FINISHED)
+        && is_client_finished(skb, payload_off))
+      conn->tls_flags |= TLS_HANDSHAKE_FINISHED;
+    // Count the application data of the client, a connection without any is
+    // a handshake-only connection. The 0-RTT early data of a resumption is
+    // sent before the ServerHello.
+    if (conn->state == SNI_RECEIVED && !ctx->server_to_client
+        && (conn->tls_flags & (TLS_SERVER_HELLO_SEEN | TLS_EARLY_DATA_OFFERED))
+        && conn->client_app_data_records < min_app_data_records(conn))
+      conn->client_app_data_records += count_application_data_records(skb, payload_off);
+    if (conn->state == SNI_RECEIVED && (conn->num_packets > CONN_MIN_NUM_OF_PACKETS
+        || conn->total_data_bytes > CONN_MIN_DATA_BYTES)
+        && !success_deferred(conn)) {
+      add_connection_to_stats(&ctx->key, conn, CONN_SUCCEEDED);
     }
-    __u16 data_bytes = skb->len - payload_off;
-    __sync_fetch_and_add(&conn->num_packets, 1);
-    __sync_fetch_and_add(&conn->total_data_bytes, data_bytes);
   }
 
-  if (tcph.rst) {
-    if (server_to_client) { // Server RST
-      conn->state = RST_SENT_BY_SERVER;
-      // Server RST could indicate server unavailability. Therefore, treat
-      // the connection as failed.
-      add_connection_to_stats(&key, conn->i.key, false);
-    } else { // Client RST
-      conn->state = RST_SENT_BY_CLIENT;
-      // Client RST does not indicate server unavailability. Therefore, treat
-      // the connection as successful.
-      add_connection_to_stats(&key, conn->i.key, true);
+  finish_packet(skb, ctx, conn, payload_off);
+  return 0;
+}
+
+// Reads the SNI from the TLS ClientHello in the payload of the packet.
+SEC("socket/tls_parse")
+int tls_parse(struct __sk_buff *skb)
+{
+  __u32 zero = 0;
+  struct packet_ctx_t *ctx = bpf_map_lookup_elem(&packet_ctx, &zero);
+  if (!ctx)
+    return 0;
+
+  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &ctx->key);
+  if (!conn)
+    return 0;
+
+  int payload_off = payload_offset(ctx);
+  // Parse SNI.
+  char sni[TLS_MAX_SERVER_NAME_LEN] = {};
+  int alpn_ext_off = 0;
+  __u32 hello_flags = 0;
+  int read = parse_sni(skb, payload_off, sni, &alpn_ext_off, &hello_flags);
+  // Update SNI in connection data. A resumed session is accounted for the SNI
+  // of its ClientHello like a full handshake.
+  if (read > 0) {
+    for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
+      if (sni[i] == '\0')
+        break;
+      conn->i.id.sni[i] = sni[i];
+    }
+    conn->state = SNI_RECEIVED;
+    conn->transitions |= 1 << TRANSITION_SNI;
+    conn->client_hello_ns = latency_clock_ns();
+    conn->tls_flags |= hello_flags;
+    remember_mptcp_connection(conn);
+    count_alpn_offered(skb, alpn_ext_off, conn);
+  }
+
+  finish_packet(skb, ctx, conn, payload_off);
+  // Pass the payloads the SNI could not be parsed from on to userspace.
+  return read > 0 ? 0 : forward_length(payload_off);
+}
+
+static inline char to_lower(char c)
+{
+  return c >= 'A' && c <= 'Z' ? c + ('a' - 'A') : c;
+}
+
+// Parses the host of the Host header of a plaintext HTTP request at the given
+// offset, without the port, into the out array. Returns the length of the host
+// or 0 if it couldn't be parsed. Only the first HTTP_MAX_HEADER_LEN bytes of
+// the request are searched. The host is lowercased and truncated like an SNI.
+static inline int parse_http_host(struct __sk_buff *skb, struct packet_ctx_t *ctx, int payload_off, char *out)
+{
+  __u32 zero = 0;
+  char *buf = bpf_map_lookup_elem(&http_buffer, &zero);
+  if (!buf)
+    return 0;
+  __u32 len = payload_length(skb, ctx, payload_off);
+  if (len > HTTP_MAX_HEADER_LEN)
+    len = HTTP_MAX_HEADER_LEN;
+  if (len < HTTP_HOST_HEADER_LEN || bpf_skb_load_bytes(skb, payload_off, buf, len))
+    return 0;
+  // A request starts with the method.
+  if (buf[0] < 'A' || buf[0] > 'Z')
+    return 0;
+
+  int host_off = 0;
+  for (int i = 0; i < HTTP_MAX_HEADER_LEN - HTTP_HOST_HEADER_LEN; i++) {
+    if (i + HTTP_HOST_HEADER_LEN > len)
+      break;
+    if (buf[i] != '\n')
+      continue;
+    // The empty line ends the headers.
+    if (buf[i + 1] == '\r' || buf[i + 1] == '\n')
+      break;
+    if (to_lower(buf[i + 1]) == 'h' && to_lower(buf[i + 2]) == 'o'
+        && to_lower(buf[i + 3]) == 's' && to_lower(buf[i + 4]) == 't'
+        && buf[i + 5] == ':') {
+      host_off = i + HTTP_HOST_HEADER_LEN;
+      break;
     }
   }
+  if (host_off == 0)
+    return 0;
+
+  __u32 max_len = sni_max_len();
+  int counter = 0;
+  bool truncated = false;
+  for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
+    int off = host_off + i;
+    if (off >= len)
+      break;
+    char c = buf[off & (HTTP_MAX_HEADER_LEN - 1)];
+    // The whitespace before the host.
+    if ((c == ' ' || c == '\t') && counter == 0)
+      continue;
+    if (c == ':' || c == ' ' || c == '\t' || c == '\r' || c == '\n')
+      break;
+    if (counter >= max_len) {
+      truncated = true;
+      break;
+    }
+    out[counter & (TLS_MAX_SERVER_NAME_LEN - 1)] = to_lower(c);
+    counter++;
+  }
+  if (truncated && counter > 0) {
+    out[(counter - 1) & (TLS_MAX_SERVER_NAME_LEN - 1)] = SNI_TRUNCATED_MARKER;
+    __u64 *truncations = bpf_map_lookup_elem(&sni_truncations, &zero);
+    if (truncations)
+      __sync_fetch_and_add(truncations, 1);
+  }
+  return counter;
+}
+
+// Reads the host from the Host header of a plaintext HTTP request of the client
+// and uses it as the SNI of the connection.
+SEC("socket/http_parse")
+int http_parse(struct __sk_buff *skb)
+{
+  __u32 zero = 0;
+  struct packet_ctx_t *ctx = bpf_map_lookup_elem(&packet_ctx, &zero);
+  if (!ctx)
+    return 0;
 
-  if (tcph.fin) {
-    if (conn) {
-      conn->state = FIN_RECEIVED;
-      add_connection_to_stats(&key, conn->i.key, true);
+  struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &ctx->key);
+  if (!conn)
+    return 0;
+
+  int payload_off = payload_offset(ctx);
+  char host[TLS_MAX_SERVER_NAME_LEN] = {};
+  if (!ctx->server_to_client && parse_http_host(skb, ctx, payload_off, host) > 0) {
+    for (int i = 0; i < TLS_MAX_SERVER_NAME_LEN; i++) {
+      if (host[i] == '\0')
+        break;
+      conn->i.id.sni[i] = host[i];
     }
+    conn->state = SNI_RECEIVED;
+    conn->transitions |= 1 << TRANSITION_SNI;
+    conn->tls_flags |= HTTP_HOST_PARSED;
+    conn->client_hello_ns = latency_clock_ns();
+    remember_mptcp_connection(conn);
   }
 
+  finish_packet(skb, ctx, conn, payload_off);
   return 0;
 }
 
+// Passes the DNS messages on to the socket it is attached to, independent of the
+// configured CIDRs and ports. The queries are correlated with their responses
+// by the DNS tracker in userspace: the names are compressed and of variable
+// length, which is expensive to parse under the verifier.
+SEC("socket/dns")
+int capture_dns(struct __sk_buff *skb)
+{
+  int ip_off = ip_offset(skb);
+  if (!ip_off) {
+    return 0;
+  }
+  ip_off = decapsulate(skb, ip_off);
+  if (!ip_off) {
+    return 0;
+  }
+
+  struct iphdr iph;
+  if (bpf_skb_load_bytes(skb, ip_off, &iph, sizeof iph)) {
+    return 0;
+  }
+  if (iph.frag_off & bpf_htons(IP_FRAGMENT_OFFSET_MASK)) {
+    return 0;
+  }
+
+  int l4_off = ip_off + iph.ihl * 4;
+  int dns_off;
+  __u16 source_port, dest_port;
+  if (iph.protocol == IPPROTO_UDP) {
+    __u16 ports[2];
+    if (bpf_skb_load_bytes(skb, l4_off, ports, sizeof ports)) {
+      return 0;
+    }
+    source_port = ports[0];
+    dest_port = ports[1];
+    dns_off = l4_off + DNS_UDP_HEADER_LEN;
+  } else if (iph.protocol == IPPROTO_TCP) {
+    struct tcphdr tcph;
+    if (bpf_skb_load_bytes(skb, l4_off, &tcph, sizeof tcph)) {
+      return 0;
+    }
+    source_port = tcph.source;
+    dest_port = tcph.dest;
+    dns_off = l4_off + tcph.doff * 4 + DNS_TCP_LENGTH_LEN;
+  } else {
+    return 0;
+  }
+  if (bpf_ntohs(source_port) != DNS_PORT && bpf_ntohs(dest_port) != DNS_PORT) {
+    return 0;
+  }
+
+  // The segments of TCP without a message, e.g. the handshake, fail to load
+  // the header.
+  struct dns_header_t dnsh;
+  if (bpf_skb_load_bytes(skb, dns_off, &dnsh, sizeof dnsh)) {
+    return 0;
+  }
+  if ((dnsh.flags & bpf_htons(DNS_OPCODE_MASK)) || bpf_ntohs(dnsh.qdcount) != 1) {
+    return 0;
+  }
+  return skb->len;
+}
+
 // https://github.com/iovisor/bcc/blob/722cf83941879c52ebea5e5a1692b2976de6ad62/src/cc/export/helpers.h#L977-L989
 // SPDX-FileCopyrightText: 2021 SAP SE or an SAP affiliate company and Gardener contributors
 // SPDX-FileCopyrightText: Copyright (c) 2015 PLUMgrid, Inc.
@@ -469,10 +2419,72 @@ int capture_packets(struct __sk_buff *skb)
   // before Linux Kernel version 5.8. So we can activate this feature after the OS has been updated to 5.8+.
   // https://github.com/torvalds/linux/commit/082b57e3eb09810d357083cca5ee2df02c16aec9
   // __u64 start = bpf_ktime_get_ns();
+  count_packet(skb);
   int ret_val = capture_packets_internal(skb);
   // __u64 end = bpf_ktime_get_ns();
   // update_histogram(end - start);
   return ret_val;
 }
 
+// Adds a sample of the smoothed RTT of a connection to the histogram of its SNI.
+// The buckets are the same as those of the execution time, in nanoseconds.
+static inline void add_rtt_sample(char *sni, __u32 srtt_us)
+{
+  struct execution_histogram *hist = bpf_map_lookup_elem(&rtt, sni);
+  if (!hist) {
+    struct execution_histogram zero = {};
+    bpf_map_update_elem(&rtt, sni, &zero, BPF_NOEXIST);
+    hist = bpf_map_lookup_elem(&rtt, sni);
+    if (!hist) {
+      return;
+    }
+  }
+  // The smoothed RTT is kept in 1/8 microseconds.
+  __u64 rtt_ns = (__u64)(srtt_us >> 3) * 1000;
+  hist->Total += rtt_ns;
+  __u64 bucket_index = BUCKET_COUNT - 1;
+  if (rtt_ns <= 0xFFFFFFFF) {
+    bucket_index = bpf_log2(rtt_ns);
+  }
+  if (bucket_index >= BUCKET_COUNT) {
+    bucket_index = BUCKET_COUNT - 1;
+  }
+  hist->Buckets[bucket_index]++;
+}
+
+// Samples the smoothed RTT of the connections opened by the sockets of the
+// cgroup it is attached to. Only loaded and attached by userspace on request,
+// the RTT callbacks need Linux 5.3 or later. The SNI is taken from the
+// connection tracked by the socket filter, so the connections which are not
+// tracked, e.g. because they are translated before the captured interface, are
+// not sampled.
+SEC("sockops")
+int sample_rtt(struct bpf_sock_ops *skops)
+{
+  if (skops->family != 2 /* AF_INET */) {
+    return 1;
+  }
+  switch (skops->op) {
+  case BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB:
+    // The sockets are the clients of the connections they opened.
+    bpf_sock_ops_cb_flags_set(skops, BPF_SOCK_OPS_RTT_CB_FLAG);
+    break;
+  case BPF_SOCK_OPS_RTT_CB: {
+    // The same byte order as the headers seen by the socket filter.
+    struct tuple_key_t key = {
+      .source_ip = skops->local_ip4,
+      .dest_ip = skops->remote_ip4,
+      .source_port = bpf_htonl(skops->local_port) >> 16,
+      .dest_port = skops->remote_port >> 16,
+    };
+    struct tuple_data_t *conn = bpf_map_lookup_elem(&connections, &key);
+    if (conn && conn->i.id.sni[0] != '\0') {
+      add_rtt_sample(conn->i.id.sni, skops->srtt_us);
+    }
+    break;
+  }
+  }
+  return 1;
+}
+
 char _license[] SEC("license") = "Apache-2.0";
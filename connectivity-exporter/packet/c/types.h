@@ -8,16 +8,53 @@
 
 #define TLS_CONTENT_TYPE_HANDSHAKE 0x16
 #define TLS_HANDSHAKE_TYPE_CLIENT_HELLO 0x1
+#define TLS_HANDSHAKE_TYPE_SERVER_HELLO 0x2
+#define TLS_HANDSHAKE_TYPE_CERTIFICATE_REQUEST 0xd
+#define TLS_HANDSHAKE_TYPE_SERVER_HELLO_DONE 0xe
+#define TLS_CONTENT_TYPE_APPLICATION_DATA 0x17
+#define TLS_CONTENT_TYPE_CHANGE_CIPHER_SPEC 0x14
+#define TLS_CONTENT_TYPE_ALERT 0x15
+#define TLS_ALERT_LEVEL_FATAL 0x2
 #define TLS_EXTENSION_SERVER_NAME 0x0
+#define TLS_EXTENSION_ENCRYPTED_CLIENT_HELLO 0xfe0d
+#define TLS_EXTENSION_ALPN 0x10
+// The extensions of a TLS 1.3 resumption: the pre_shared_key extension of the
+// ClientHello offers the session tickets, the one of the ServerHello selects
+// one of them. It is the last extension of the ClientHello.
+#define TLS_EXTENSION_PRE_SHARED_KEY 0x29
+#define TLS_EXTENSION_EARLY_DATA 0x2a
 // TODO: Figure out real max number according to RFC.
 #define TLS_MAX_EXTENSION_COUNT 20
-// TODO: figure out the right value.
+// The size of the SNI buffers. Longer SNIs are truncated, see sni_config_t.
+// It has to be a power of two.
 #define TLS_MAX_SERVER_NAME_LEN 128
+// Replaces the last byte of a truncated SNI, so it does not collide with an
+// SNI of the truncated length. It is not valid in host names.
+#define SNI_TRUNCATED_MARKER 0x1
+// Prefixes the outer SNI of a ClientHello with the encrypted client hello
+// extension. The outer SNI is the public name of the client-facing server, the
+// real SNI is encrypted, so the connections are not accounted to the outer SNI.
+#define ECH_SNI_PREFIX "__ech__:"
+#define ECH_SNI_PREFIX_LEN 8
+// Prefixes the port of the server in the pseudo SNI of the SCTP associations,
+// which have no SNI, e.g. __sctp__:3868.
+#define SCTP_SNI_PREFIX "__sctp__:"
+#define SCTP_SNI_PREFIX_LEN 9
+// The maximum length of the configurable prefix of the pseudo SNI of the
+// connections without an SNI, see sni_config_t.
+#define NO_SNI_PREFIX_MAX_LEN 32
 
 // The stats eBPF map can hold statistics for as many different SNI
 #define MAX_SERVER_COUNT 100
-// The stats eBPF map can hold up to 20 seconds of data
+// The stats eBPF map holds 20 windows of data by default, 20 seconds at the
+// default resolution of a second.
 #define STATS_SECONDS_COUNT 20
+// The maximum number of slots of the stats eBPF map, 20 seconds of data at the
+// finest resolution of 100ms. The slots in use are set in config_stats.
+#define STATS_MAX_SLOTS 200
+// The generation of a slot of the stats map while userspace reads it. No
+// ticker clock has this value.
+#define STATS_SLOT_SEALED ((__u64)-1)
 
 // The length of the session ID length field.
 #define TLS_SESSION_ID_LENGTH_LEN 1
@@ -39,10 +76,28 @@
 // extension.
 #define TLS_SERVER_NAME_OFF 9
 
+// The offset of the protocol name list length field from the start of the
+// application_layer_protocol_negotiation TLS extension.
+#define TLS_ALPN_LIST_LENGTH_OFF 4
+// The offset of the protocol name list from the start of the
+// application_layer_protocol_negotiation TLS extension.
+#define TLS_ALPN_LIST_OFF 6
+// The length of the cipher suite field of a ServerHello.
+#define TLS_CIPHER_SUITE_LEN 2
+// The length of the compression method field of a ServerHello.
+#define TLS_COMPRESSION_METHOD_LEN 1
+
 // The offset of the handshake type field from the start of the TLS payload.
 #define TLS_HANDSHAKE_TYPE_OFF 5
 // The offset of the session ID length field from the start of the TLS payload.
 #define TLS_SESSION_ID_LENGTH_OFF 43
+// The offset of the legacy version field of a ServerHello from the start of the
+// TLS payload.
+#define TLS_SERVER_HELLO_VERSION_OFF 9
+// TLS 1.3 negotiates its version in an extension and keeps TLS 1.2 as the
+// legacy version, but its cipher suites are not used by earlier versions.
+#define TLS_VERSION_1_3 0x0304
+#define TLS_1_3_CIPHER_SUITE_PREFIX 0x13
 
 // The minimum number of packets that should be sent/received for a connection
 // in order to treat the connection as successful.
@@ -51,6 +106,375 @@
 // connection in order to treat the connection as successful.
 #define CONN_MIN_DATA_BYTES 1024
 
+// The minimum number of ApplicationData records from the client for a
+// connection to carry application data. With TLS 1.3, the Finished of the
+// client is the first one. An open connection is not counted as succeeded
+// before, so a connection without application data is counted as
+// handshake-only when it is closed or accounted by its age.
+#define CONN_MIN_APP_DATA_RECORDS 1
+#define CONN_MIN_APP_DATA_RECORDS_TLS_1_3 2
+// The maximum number of records looked at in a segment of the client, e.g. the
+// ChangeCipherSpec, the Finished and the first request of a TLS 1.3 client in
+// middlebox compatibility mode.
+#define TLS_MAX_SEGMENT_RECORDS 4
+
+// The maximum difference between the TTL of a RST packet and the TTL of the
+// prior packets from the same peer. A larger difference suggests that the RST
+// was injected by a middlebox on the path.
+#define RST_TTL_TOLERANCE 2
+
+// The origin of a reset of a connection: the server, the client or a middlebox
+// injecting it on the path, see is_injected_rst.
+#define RST_ORIGIN_SERVER 0
+#define RST_ORIGIN_CLIENT 1
+#define RST_ORIGIN_MIDDLEBOX 2
+#define RST_ORIGIN_COUNT 3
+
+// The maximum difference between the TTL of a packet from a destination and
+// the typical TTL of the destination which is not counted as an anomaly.
+#define TTL_ANOMALY_TOLERANCE 1
+// The number of consecutive packets with a deviating TTL after which the
+// deviating TTL becomes the typical TTL of the destination, e.g. after a
+// routing change.
+#define TTL_RELEARN_COUNT 16
+// The maximum difference between the TTL of the ServerHello and the TTL of the
+// prior packets from the server, e.g. the SYN-ACK. A larger difference suggests
+// that a proxy answered the TCP handshake.
+#define HANDSHAKE_TTL_TOLERANCE 2
+// The number of SNIs whose signatures of interception are counted.
+#define MAX_INTERCEPTION_SNI_COUNT 1024
+// The number of connections reset before the ServerHello which are kept to
+// recognize a ClientHello retransmitted after the reset.
+#define MAX_RESET_HANDSHAKE_COUNT 1024
+// The number of network interfaces whose packets are counted.
+#define MAX_INTERFACE_COUNT 256
+// The number of combinations of SNI, TLS version and cipher suite counted.
+#define MAX_TLS_PARAMETERS_COUNT 4096
+// The number of combinations of SNI, alert and sender of the TLS alerts counted.
+#define MAX_TLS_ALERT_COUNT 4096
+// The number of combinations of SNI, side and protocol of the ALPN counted.
+#define MAX_ALPN_COUNT 4096
+// The number of protocol names of a ClientHello looked at.
+#define MAX_ALPN_PROTOCOL_COUNT 8
+// The protocols of the ALPN, the protocol of alpn_t. The offered protocols of a
+// ClientHello are collected as bits of these.
+#define ALPN_H2 1
+#define ALPN_HTTP_1_1 2
+#define ALPN_H3 3
+#define ALPN_OTHER 4
+// No ALPN extension.
+#define ALPN_NONE 5
+// TLS 1.3 sends the selected protocol in the encrypted EncryptedExtensions.
+#define ALPN_ENCRYPTED 6
+#define ALPN_HTTP_1_1_NAME "http/1.1"
+#define ALPN_HTTP_1_1_NAME_LEN 8
+// The side of alpn_t.
+#define ALPN_OFFERED 0
+#define ALPN_SELECTED 1
+// The number of sources, destinations and SNIs whose payload bytes are counted.
+#define MAX_DATA_BYTES_KEY_COUNT 4096
+// The number of SNIs of ClientHellos split over several segments which were
+// reassembled in userspace and not yet applied to their connections.
+#define MAX_REASSEMBLED_SNI_COUNT 1024
+// The ECN negotiation flags of a connection.
+#define ECN_REQUESTED (1 << 0)
+#define ECN_ACCEPTED (1 << 1)
+
+// The state transitions observed on a connection, the indices of its bits in
+// tuple_data_t.transitions and of the counters in sni_stats_t.transitions. The
+// resets are attributed by the direction of the packet only, and the expired
+// connections are counted in userspace.
+#define TRANSITION_SYN 0
+#define TRANSITION_SYNACK 1
+#define TRANSITION_SNI 2
+#define TRANSITION_RST_CLIENT 3
+#define TRANSITION_RST_SERVER 4
+#define TRANSITION_FIN 5
+#define TRANSITION_COUNT 6
+
+// The ICMP type destination unreachable and the number of its codes counted
+// per SNI, from net unreachable (0) to precedence cutoff (15).
+#define ICMP_DEST_UNREACHABLE 3
+#define ICMP_UNREACHABLE_CODE_COUNT 16
+
+// Flags of the TLS handshake of a connection. The handshake is finished once
+// the client sent its Finished, see is_client_finished.
+#define TLS_SERVER_HELLO_SEEN (1 << 0)
+#define TLS_HANDSHAKE_FINISHED (1 << 1)
+// The SNI of the connection is the Host header of a plaintext HTTP request, so
+// the connection has no TLS handshake.
+#define HTTP_HOST_PARSED (1 << 2)
+// The server requested a client certificate, mutual TLS.
+#define TLS_CERTIFICATE_REQUESTED (1 << 3)
+// The handshake messages of the server after the ServerHello are followed by
+// their TCP sequence numbers, see scan_server_flight.
+#define TLS_SERVER_FLIGHT_TRACKED (1 << 4)
+// The connection is an SCTP association, so it has no TLS handshake. The state
+// SNI_RECEIVED stands for the established association.
+#define SCTP_ASSOCIATION (1 << 5)
+// The stream of the client started with a PROXY protocol header of a load
+// balancer, which was skipped. The source IP of the stats key is the original
+// client of the header if capture_config_t enables it.
+#define PROXY_HEADER_SKIPPED (1 << 6)
+// A fatal alert of the handshake was counted, see count_tls_alert. Only the
+// first alert of a connection is counted.
+#define TLS_ALERT_COUNTED (1 << 7)
+// The ClientHello offered to resume a TLS 1.3 session with a pre_shared_key
+// extension, and to send 0-RTT early data with an early_data extension.
+#define TLS_PSK_OFFERED (1 << 8)
+#define TLS_EARLY_DATA_OFFERED (1 << 9)
+// The ServerHello accepted the pre_shared_key, the session was resumed without
+// a certificate.
+#define TLS_SESSION_RESUMED (1 << 10)
+// The SYN of the client carried an MP_CAPABLE option: the connection is the
+// first subflow of an MPTCP connection, which is accounted like a TCP
+// connection.
+#define MPTCP_CAPABLE (1 << 11)
+// The SYN of the client carried an MP_JOIN option: the connection is an
+// additional subflow of an MPTCP connection. It has no ClientHello of its own
+// and is counted for the MPTCP connection instead of being accounted, see
+// count_mptcp_subflow.
+#define MPTCP_SUBFLOW (1 << 12)
+// The connection had no SNI when it was accounted and is accounted for the
+// pseudo SNI of its port instead, see no_sni.
+#define NO_SNI_ACCOUNTED (1 << 13)
+// The ServerHello negotiated TLS 1.3, whose Finished of the client is an
+// ApplicationData record.
+#define TLS_1_3_NEGOTIATED (1 << 14)
+// The TCP options looked at for MPTCP: the kind of the end of the options,
+// of a no-operation and of MPTCP (RFC 8684). The MPTCP subtype is in the upper 4
+// bits of the third byte of the option.
+#define TCP_OPTION_END 0
+#define TCP_OPTION_NOP 1
+#define TCP_OPTION_MPTCP 30
+#define TCP_MAX_OPTION_COUNT 12
+#define MPTCP_SUBTYPE_OFF 2
+#define MPTCP_SUB_CAPABLE 0x0
+#define MPTCP_SUB_JOIN 0x1
+// The offset of the key of the sender from the start of the MP_CAPABLE option
+// of a SYN-ACK, and of the token of the receiver from the start of the MP_JOIN
+// option of a SYN.
+#define MPTCP_CAPABLE_KEY_OFF 4
+#define MPTCP_JOIN_TOKEN_OFF 4
+#define MAX_MPTCP_CONNECTION_COUNT 4096
+
+// The maximum number of record and handshake message headers of the server
+// flight looked at per packet.
+#define TLS_MAX_FLIGHT_HEADERS 12
+// The length of the handshake message header: type and length.
+#define TLS_HANDSHAKE_HEADER_LEN 4
+// The maximum length of an encrypted TLS 1.3 alert record: the alert, the
+// inner content type and an AEAD tag of 16 bytes. The encrypted Finished of the
+// client is longer.
+#define TLS_ENCRYPTED_ALERT_MAX_LEN 19
+// The ECN field in the IP header and its congestion experienced codepoint.
+#define IP_ECN_MASK 0x3
+#define IP_ECN_CE 0x3
+
+// The number of connect and handshake latencies kept per entry of the stats
+// map. The latencies of further connections in the same second are dropped.
+#define LATENCY_SAMPLE_COUNT 8
+
+// The number of destinations whose TTL is tracked.
+#define MAX_DESTINATION_COUNT 1024
+
+// The protocols of the ports, the values of the config_ports map. The SNI of
+// the connections to an HTTP port is the Host header of the first request.
+#define PORT_PROTOCOL_TLS 1
+#define PORT_PROTOCOL_HTTP 2
+// The flows of UDP to a port are tracked in the udp_flows map instead of the
+// connections of TCP.
+#define PORT_PROTOCOL_UDP 3
+// The number of tracked UDP flows.
+#define MAX_UDP_FLOW_COUNT 8192
+// The associations of SCTP to a port are tracked in the connections map like
+// the connections of TCP, see track_sctp_association.
+#define PORT_PROTOCOL_SCTP 4
+
+// The length of the SCTP common header and the chunk types of the setup and
+// the teardown of an association (RFC 9260).
+#define SCTP_COMMON_HEADER_LEN 12
+#define SCTP_CHUNK_INIT 1
+#define SCTP_CHUNK_INIT_ACK 2
+#define SCTP_CHUNK_ABORT 6
+#define SCTP_CHUNK_SHUTDOWN 7
+#define SCTP_CHUNK_COOKIE_ECHO 10
+#define SCTP_CHUNK_COOKIE_ACK 11
+// The maximum number of chunks of a packet looked at. Control chunks like the
+// ABORT can be bundled after others.
+#define SCTP_MAX_CHUNKS 4
+// The number of SNIs with histograms of the RTT.
+#define MAX_RTT_SNI_COUNT 1024
+
+// The filter dimension matched by the SYN of a partial match, see
+// partial_match_t, and the number of servers observed with them.
+#define PARTIAL_MATCH_CIDR 1
+#define PARTIAL_MATCH_PORT 2
+#define MAX_PARTIAL_MATCH_COUNT 1024
+
+// The number of bytes at the start of a plaintext HTTP request searched for the
+// Host header. It has to be a power of two.
+#define HTTP_MAX_HEADER_LEN 512
+// The length of the start of the Host header: a newline and "host:".
+#define HTTP_HOST_HEADER_LEN 6
+
+// The DNS messages passed on to the DNS tracker in userspace: those over UDP and
+// TCP with the port on either side, a standard query or its response with a
+// single question. Over TCP, the message follows its length.
+#define DNS_PORT 53
+#define DNS_TCP_LENGTH_LEN 2
+#define DNS_UDP_HEADER_LEN 8
+#define DNS_OPCODE_MASK 0x7800
+// The fragment offset of the IPv4 header, only the first fragment has the
+// header of the transport protocol.
+#define IP_FRAGMENT_OFFSET_MASK 0x1fff
+
+// The length of an 802.1Q or 802.1ad VLAN tag and the number of tags skipped
+// in front of the IP header, two for QinQ.
+#define VLAN_HLEN 4
+#define MAX_VLAN_TAGS 2
+
+// The lengths of the UDP header and of the fixed VXLAN and Geneve headers. The
+// Geneve header is followed by its options.
+#define UDP_HLEN 8
+#define VXLAN_HLEN 8
+#define GENEVE_HLEN 8
+// The I flag of a VXLAN header with a valid VNI.
+#define VXLAN_FLAG_VNI 0x08
+
+// The GTP-U header of the user plane of mobile networks, e.g. on the N3
+// interface between the RAN and the UPF: version 1 and the protocol type GTP in
+// the upper 3 and the next bit of the flags, the G-PDU message type of the
+// tunneled IP packets. If any of the E, S and PN flags is set, the fixed header
+// is followed by the sequence number, the N-PDU number and the type of the next
+// extension header, each extension header by the next type in its last byte.
+// Up to GTPU_MAX_EXTENSIONS extension headers are skipped, e.g. the PDU session
+// container of N3.
+#define GTPU_HLEN 8
+#define GTPU_OPT_LEN 4
+#define GTPU_VERSION_PT_MASK 0xf0
+#define GTPU_VERSION_PT 0x30
+#define GTPU_FLAG_E 0x04
+#define GTPU_FLAGS_OPT 0x07
+#define GTPU_TYPE_GPDU 0xff
+#define GTPU_MAX_EXTENSIONS 4
+
+// The PROXY protocol of load balancers: the human-readable header of version 1
+// starts with "PROXY " and ends with CRLF within 107 bytes, the binary header of
+// version 2 starts with a 12-byte signature and is 16 bytes plus the length of
+// the addresses. The source address of "PROXY TCP4 " is up to 15 characters.
+#define PROXY_V1_PREFIX_LEN 6
+#define PROXY_V1_TCP4_PREFIX_LEN 11
+#define PROXY_V1_MAX_LEN 107
+#define PROXY_V1_MAX_ADDR_LEN 16
+#define PROXY_V1_CHUNK_LEN 8
+#define PROXY_V2_HEADER_LEN 16
+#define PROXY_V2_VERSION 0x2
+#define PROXY_V2_CMD_PROXY 0x1
+#define PROXY_V2_FAMILY_INET 0x1
+
+// The fixed part of a GTP-U header.
+struct gtpu_header_t {
+  __u8 flags;
+  __u8 type;
+  // The length of the payload after the fixed header, including the optional
+  // fields and the extension headers.
+  __be16 length;
+  __be32 teid;
+};
+
+// The fixed part of a Geneve header.
+struct geneve_header_t {
+  // The version in the upper 2 bits, the length of the options in 4-byte
+  // multiples in the lower 6 bits.
+  __u8 ver_opt_len;
+  __u8 flags;
+  // The EtherType of the inner packet.
+  __be16 protocol;
+  __u8 vni[3];
+  __u8 reserved;
+};
+
+struct dns_header_t {
+  __u16 id;
+  __u16 flags;
+  __u16 qdcount;
+  __u16 ancount;
+  __u16 nscount;
+  __u16 arcount;
+};
+
+// The length of the TLS record header: content type, version and length.
+#define TLS_RECORD_HEADER_LEN 5
+
+// Configures the packets passed on to the userspace socket. Nothing is passed
+// on unless enabled.
+struct forward_config_t {
+  __u32 enabled;
+  // The number of bytes passed on, the snap length. 0 means up to the end of
+  // the TLS record header of the packet.
+  __u32 snaplen;
+};
+
+// Configures the capture.
+struct capture_config_t {
+  // Non-zero for mirrored traffic (SPAN) on a dedicated capture interface. The
+  // peers of the connections are not local, so the direction of a packet whose
+  // ports are both configured follows its connection instead of the source
+  // port.
+  __u32 span;
+  // The UDP destination ports of the VXLAN and Geneve tunnels whose inner
+  // packets are tracked instead of the outer ones, 0 to track the outer ones.
+  __u16 vxlan_port;
+  __u16 geneve_port;
+  // The UDP destination port of the GTP-U tunnels whose inner packets are
+  // tracked instead of the outer ones, 0 to track the outer ones.
+  __u16 gtpu_port;
+  __u16 pad;
+  // Non-zero to account the connections with a PROXY protocol header for the
+  // original client of the header instead of the load balancer.
+  __u32 proxy_source_ip;
+  // Non-zero to observe the servers of the partial matches, see
+  // partial_match_t.
+  __u32 observe_partial_matches;
+  // Non-zero to count an open TLS connection as succeeded only once the client
+  // sent application data, so the handshake-only connections are not counted
+  // as succeeded before. Set while a rule detects them.
+  __u32 defer_handshake_only;
+};
+
+// Configures the parsing of the SNI.
+struct sni_config_t {
+  // The maximum length of an SNI, including the truncation marker. 0 means
+  // TLS_MAX_SERVER_NAME_LEN, larger values are capped.
+  __u32 max_len;
+  // The prefix of the pseudo SNI the connections without an SNI are accounted
+  // for, followed by the port of the server, e.g. __no_sni__:5432. 0 leaves
+  // them without an SNI.
+  __u32 no_sni_prefix_len;
+  char no_sni_prefix[NO_SNI_PREFIX_MAX_LEN];
+};
+
+// Configures the stats map.
+struct stats_config_t {
+  // The number of slots of the stats map in use, one per window of the
+  // accounting. 0 means STATS_SECONDS_COUNT, larger values than
+  // STATS_MAX_SLOTS are ignored as well.
+  __u32 slots;
+  // The payload bytes of the connections with an SNI are counted in the
+  // data_bytes map if set, only while a rule has a minimum throughput.
+  __u32 count_data_bytes;
+};
+
+// The indices of the tail-called sub-programs in the programs map. The entry
+// program parses the L2/L3 headers, the L4 state program tracks the TCP
+// connection and the TLS parse program reads the SNI. New protocol parsers
+// get their own index, so every sub-program is verified on its own.
+#define PROG_L4_STATE 0
+#define PROG_TLS_PARSE 1
+#define PROG_HTTP_PARSE 2
+#define PROG_MAX 8
+
 #define ALL_TCP_FLAGS(func) \
   func(fin, (1 << 0))       \
   func(syn, (1 << 1))       \
@@ -88,6 +512,13 @@ struct tuple_key_t {
   __u16 dest_port;
 };
 
+// The identity of a connection, the key of the inner stats map.
+struct stats_key_t {
+  __u32 source_ip;
+  __u32 dest_ip;
+  char sni[TLS_MAX_SERVER_NAME_LEN];
+};
+
 struct tuple_data_t {
   enum {
     SYN_RECEIVED,
@@ -96,24 +527,191 @@ struct tuple_data_t {
     RST_SENT_BY_CLIENT,
     RST_SENT_BY_SERVER,
     FIN_RECEIVED,
+    RST_SENT_BY_MIDDLEBOX,
+    // The SYN got an ICMP destination unreachable back, see icmp_code.
+    ICMP_UNREACHABLE,
   } state;
     union {
-        struct {
-            __u32 source_ip;
-            __u32 dest_ip;
-            char sni[TLS_MAX_SERVER_NAME_LEN];
-        } id;
-        char key[4+TLS_MAX_SERVER_NAME_LEN];
+        struct stats_key_t id;
+        char key[sizeof(struct stats_key_t)];
     } i;
   // The following two fields cause clang to crash when set to __u16.
   __u64 num_packets;
   __u64 total_data_bytes;
   __u64 ticker_clock_first_packet;
+  // The TTL of the last non-RST packets from both peers, used to detect
+  // resets injected by middleboxes. A zero TTL means no packet was seen yet.
+  __u8 client_ttl;
+  __u8 server_ttl;
+  // The code of the ICMP destination unreachable in state ICMP_UNREACHABLE.
+  __u8 icmp_code;
+  __u32 ecn_flags;
+  // The number of packets with congestion signals.
+  __u32 ce_packets;
+  __u32 ece_packets;
+  __u32 cwr_packets;
+  __u32 tls_flags;
+  // The latencies from the SYN to the SYN-ACK and from the ClientHello to the
+  // ServerHello, and the duration of the handshake from the SYN to the
+  // ServerHello, in microseconds, 0 until measured. They are only measured if
+  // the program is built with LATENCY_ENABLED.
+  __u32 connect_latency_us;
+  __u32 handshake_latency_us;
+  __u32 handshake_duration_us;
+  // The number of ApplicationData records from the client, up to the
+  // minimum of min_app_data_records.
+  __u32 client_app_data_records;
+  __u64 syn_ns;
+  __u64 client_hello_ns;
+  // The bits of the observed transitions, see TRANSITION_SYN.
+  __u32 transitions;
+  // The TCP sequence numbers of the next record header and of the next
+  // handshake message header from the server while TLS_SERVER_FLIGHT_TRACKED
+  // is set.
+  __u32 server_record_seq;
+  __u32 server_message_seq;
+  // The key of the server of an MPTCP connection from the MP_CAPABLE option of
+  // its SYN-ACK, and the token of the MPTCP connection an MP_JOIN subflow
+  // joins, both as on the wire.
+  __u64 mptcp_key;
+  __u32 mptcp_token;
+};
+
+// The subflows joining an MPTCP connection, the value of the mptcp_subflows map
+// keyed by the token of the connection. Joined are the subflows accepted with
+// a SYN-ACK, failed those of them closed by the server or the network.
+struct mptcp_subflows_t {
+  __u64 joined;
+  __u64 failed;
+};
+
+// A SYN of a client matching only one of the configured CIDRs and ports, the key
+// of the partial_matches map: the server is in a configured CIDR but not its
+// port, or the other way around. The connection is not tracked. The server is
+// only observed if capture_config_t enables it, zero otherwise, so the map holds
+// a counter per matched dimension.
+struct partial_match_t {
+  __u32 ip;   // server IP (network byte order)
+  __u16 port; // server port (network byte order)
+  __u8 match; // PARTIAL_MATCH_CIDR or PARTIAL_MATCH_PORT
+  __u8 pad;
+};
+
+// A UDP flow from a client to a server, keyed by its tuple_key_t from the
+// client. The ticks are the ticker clock of its first and last datagram.
+struct udp_flow_t {
+  __u64 first_tick;
+  __u64 last_tick;
+  __u32 client_packets;
+  // The datagrams from the server, a flow with any is answered.
+  __u32 server_packets;
+};
+
+// The typical TTL of the packets from a destination.
+struct dest_ttl_t {
+  __u8 ttl;
+  // The number of consecutive packets with a deviating TTL.
+  __u8 deviations;
+};
+
+// The packets seen on a network interface, the value of the interface_packets
+// map. Matched are the packets to or from the configured CIDRs and ports.
+struct interface_counters_t {
+  __u64 packets;
+  __u64 matched;
+  __u64 bytes;
+};
+
+// The signatures of SNI proxies and TLS interception of an SNI.
+struct interception_t {
+  // The handshakes whose ServerHello came from another hop distance than the
+  // prior packets from the server: a proxy answered the TCP handshake and
+  // spliced the connection to the server after reading the SNI.
+  __u64 split_handshakes;
+  // The ClientHellos retransmitted after the connection was reset before the
+  // ServerHello: the client did not accept the reset, so it was probably
+  // injected by a middlebox filtering the SNI.
+  __u64 client_hellos_after_rst;
+};
+
+// The TLS version and cipher suite negotiated with the ServerHello for an SNI,
+// the key of the tls_parameters map.
+struct tls_parameters_t {
+  char sni[TLS_MAX_SERVER_NAME_LEN];
+  // The version and the cipher suite in host byte order.
+  __u16 version;
+  __u16 cipher_suite;
+  // Whether the ServerHello resumed a session, see TLS_SESSION_RESUMED.
+  __u8 resumed;
+  // Whether the ClientHello offered early data, see TLS_EARLY_DATA_OFFERED.
+  __u8 early_data;
+};
+
+// A fatal alert sent during the handshake of an SNI, the key of the tls_alerts
+// map.
+struct tls_alert_t {
+  char sni[TLS_MAX_SERVER_NAME_LEN];
+  // The AlertDescription, e.g. 40 for handshake_failure.
+  __u8 description;
+  // Whether the server sent the alert, or the client.
+  __u8 from_server;
+};
+
+// The protocols offered by the ClientHellos and selected by the ServerHellos
+// for an SNI, the key of the alpn map.
+struct alpn_t {
+  char sni[TLS_MAX_SERVER_NAME_LEN];
+  // ALPN_OFFERED or ALPN_SELECTED.
+  __u8 side;
+  // One of the ALPN_* protocols.
+  __u8 protocol;
+};
+
+// The outcome of a connection as recorded in the stats map.
+enum conn_outcome {
+  CONN_SUCCEEDED,
+  CONN_FAILED,
+  CONN_RESET_BY_MIDDLEBOX,
+  CONN_ICMP_UNREACHABLE,
 };
 
 struct sni_stats_t {
     __u64 succeeded_connections;
     __u64 failed_connections;
+    __u64 middlebox_resets;
+    // The connections whose SYN got an ICMP destination unreachable back, per
+    // ICMP code.
+    __u64 icmp_unreachable[ICMP_UNREACHABLE_CODE_COUNT];
+    __u64 ecn_requested;
+    __u64 ecn_accepted;
+    __u64 ce_packets;
+    __u64 ece_packets;
+    __u64 cwr_packets;
+    // The connections with a ClientHello which never received a ServerHello.
+    __u64 handshakes_abandoned;
+    // The connections with a ServerHello, but without application data from
+    // the client.
+    __u64 handshakes_only;
+    // The connections closed after the ServerHello, but before the Finished of
+    // the client, e.g. because the client rejected the certificate.
+    __u64 handshakes_failed;
+    // The connections reset by the server or a middlebox after the handshake
+    // finished.
+    __u64 established_resets;
+    // The connections whose server requested a client certificate, and those
+    // of them closed before the Finished of the client.
+    __u64 certificate_requests;
+    __u64 certificate_request_failures;
+    // The number of closed connections with each transition.
+    __u64 transitions[TRANSITION_COUNT];
+    // The connections closed by a reset, per RST_ORIGIN_SERVER, ...
+    __u64 resets[RST_ORIGIN_COUNT];
+    // The number of closed connections with a latency, the latencies of the
+    // first LATENCY_SAMPLE_COUNT of them are kept.
+    __u32 latency_samples;
+    __u32 connect_latency_us[LATENCY_SAMPLE_COUNT];
+    __u32 handshake_latency_us[LATENCY_SAMPLE_COUNT];
+    __u32 handshake_duration_us[LATENCY_SAMPLE_COUNT];
 };
 
 // A number of linear buckets in histogram.
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/clock"
+	"m/config"
+	"m/metrics"
+)
+
+// canary is a candidate filter and configuration accounted side by side
+// with the current ones. Its program has its own maps and is attached
+// with its own socket, and every socket filter of the interface sees
+// the same packets, so both state machines are fed by the same
+// traffic.
+type canary struct {
+	source  snapshotSource
+	state   *State
+	clock   *clock.Fake
+	release func()
+	status  CanaryStatus
+}
+
+// CanaryStatus describes the running canary.
+type CanaryStatus struct {
+	Interface string    `json:"interface"`
+	CIDRs     []string  `json:"cidrs"`
+	Ports     []string  `json:"ports"`
+	Since     time.Time `json:"since"`
+	// Config is the candidate configuration, nil if the canary
+	// follows the current one.
+	Config *config.Config `json:"config,omitempty"`
+}
+
+type canaryRequest struct {
+	// canary is nil to stop the running canary.
+	canary *canary
+	done   chan error
+}
+
+// StartCanary loads the program with the candidate filter next to the
+// running one and accounts its connections with the candidate
+// configuration, or the current one if it is nil. The increments of
+// both are exported per SNI, together with their delta, instead of
+// being pushed to the regular metrics. A running canary is replaced.
+func (s *NetworkDataSource) StartCanary(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}, candidate *config.Config) error {
+	s.mutex.RLock()
+	capturing, opts, resolution := s.ebpfConfig != nil, s.setupOptions(), s.resolution
+	s.mutex.RUnlock()
+	if !capturing {
+		return errors.New("canaries are only supported when capturing packets")
+	}
+	store := s.config
+	if candidate != nil {
+		if err := candidate.Validate(); err != nil {
+			return err
+		}
+		store = config.NewStore(candidate)
+	}
+	opts.deferHandshakeOnly = store.Get().DetectsAnyHandshakeOnly()
+	ec, attachment, err := newEBPFSetup(networkInterface, cidrs, ports, opts)
+	if err != nil {
+		return err
+	}
+	windowClock := clock.NewFake(time.Time{})
+	state := newState(store, windowClock)
+	state.setResolution(resolution)
+	state.quiet = true
+	state.normalizer = s.normalizer
+	state.noSNIPrefix = s.noSNIPrefix
+	c := &canary{
+		source: &ebpfSource{config: ec},
+		state:  state,
+		clock:  windowClock,
+		release: func() {
+			attachment.Close()
+			ec.Close()
+		},
+		status: CanaryStatus{
+			Interface: networkInterface,
+			CIDRs:     setToSortedList(cidrs),
+			Ports:     setToSortedList(ports),
+			Since:     time.Now(),
+			Config:    candidate,
+		},
+	}
+	if err := s.sendCanary(ctx, c); err != nil {
+		c.release()
+		return err
+	}
+	klog.Infof("Started a canary on %s", networkInterface)
+	return nil
+}
+
+// StopCanary unloads the program of the canary and removes its series.
+// It is a no-op without a canary.
+func (s *NetworkDataSource) StopCanary(ctx context.Context) error {
+	return s.sendCanary(ctx, nil)
+}
+
+// Canary returns the status of the running canary, or nil.
+func (s *NetworkDataSource) Canary() *CanaryStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.canary == nil {
+		return nil
+	}
+	status := s.canary.status
+	return &status
+}
+
+func (s *NetworkDataSource) sendCanary(ctx context.Context, c *canary) error {
+	req := &canaryRequest{canary: c, done: make(chan error, 1)}
+	select {
+	case s.canaries <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.done
+}
+
+// swapCanary replaces the running canary. It is called by
+// TrackConnections between two windows, so both sides of the
+// comparison start with the same window.
+func (s *NetworkDataSource) swapCanary(c *canary, tickerClock uint64) error {
+	if c != nil {
+		if err := c.source.setTickerClock(tickerClock); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	previous := s.canary
+	s.canary = c
+	s.mutex.Unlock()
+	if previous != nil {
+		previous.release()
+	}
+	metrics.ResetCanary()
+	return nil
+}
+
+// accountCanary accounts the window of the canary and exports it
+// together with the increments of the current window. Neither side is
+// exported if the canary cannot be accounted, which would skew the
+// delta.
+func (s *NetworkDataSource) accountCanary(current []*metrics.Inc, tickerClock uint64, now time.Time) {
+	c := s.canary
+	snapshot, err := c.source.read(tickerClock, now)
+	if err != nil {
+		klog.Errorf("reading canary map snapshot: %v", err)
+		return
+	}
+	c.clock.Set(snapshot.Time)
+	incs, _, oldKeys, err := c.state.accountSnapshot(snapshot)
+	if err != nil {
+		klog.Errorf("accounting canary map snapshot: %v", err)
+		return
+	}
+	c.source.deleteConnections(oldKeys)
+	c.state.deleteExpiredSNIs(snapshot.Time)
+	metrics.AddCanary(false, current)
+	metrics.AddCanary(true, incs)
+}
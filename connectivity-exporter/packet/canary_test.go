@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"m/clock"
+	"m/metrics"
+)
+
+func TestCanary(t *testing.T) {
+	const sni = "canary.example.com"
+	stats := func(srcIP string, s sniStats) rawEntry {
+		return statsEntry(t, ConnKey{sourceIP: srcIP, destIP: "192.168.0.1", sni: sni}, s)
+	}
+	current := &scriptedSource{stats: map[uint64][]rawEntry{
+		1: {stats("10.0.0.1", sniStats{succeededConnections: 1})},
+	}}
+	// The candidate filter captures another client, whose connection
+	// is rejected.
+	candidate := &scriptedSource{stats: map[uint64][]rawEntry{
+		1: {stats("10.0.0.1", sniStats{succeededConnections: 1}), stats("10.0.0.2", sniStats{failedConnections: 1})},
+	}}
+	dataSource := &NetworkDataSource{source: current, canaries: make(chan *canaryRequest)}
+
+	clk := clock.NewFake(time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC))
+	incs := make(chan *metrics.Inc, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, clk, incs, nil)
+
+	clk.Tick(time.Second)
+	released := 0
+	state := newState(nil, nil)
+	state.quiet = true
+	c := &canary{source: candidate, state: state, clock: clock.NewFake(time.Time{}), release: func() { released++ }}
+	if err := dataSource.sendCanary(ctx, c); err != nil {
+		t.Fatalf("starting canary: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		clk.Tick(time.Second)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.NewCollector())
+	expected := `
+		# HELP connectivity_exporter_canary_connections_delta New connections of the candidate minus the ones of the current configuration since the start of the canary.
+		# TYPE connectivity_exporter_canary_connections_delta gauge
+		connectivity_exporter_canary_connections_delta{kind="rejected",sni="canary.example.com"} 1
+		connectivity_exporter_canary_connections_delta{kind="successful",sni="canary.example.com"} 0
+		# HELP connectivity_exporter_canary_connections_total Total number of new connections of the current and the candidate configuration since the start of the canary.
+		# TYPE connectivity_exporter_canary_connections_total counter
+		connectivity_exporter_canary_connections_total{config="candidate",kind="rejected",sni="canary.example.com"} 1
+		connectivity_exporter_canary_connections_total{config="candidate",kind="successful",sni="canary.example.com"} 1
+		connectivity_exporter_canary_connections_total{config="current",kind="rejected",sni="canary.example.com"} 0
+		connectivity_exporter_canary_connections_total{config="current",kind="successful",sni="canary.example.com"} 1
+	`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"connectivity_exporter_canary_connections_delta",
+		"connectivity_exporter_canary_connections_total",
+	); err != nil {
+		t.Error(err)
+	}
+
+	if err := dataSource.StopCanary(ctx); err != nil {
+		t.Fatalf("stopping canary: %v", err)
+	}
+	cancel()
+	wg.Wait()
+	close(incs)
+	assert(t, released, 1)
+	assert(t, dataSource.Canary() == nil, true)
+	// The increments of the candidate are not pushed.
+	for inc := range incs {
+		if inc.SourceIP != "10.0.0.1" {
+			t.Errorf("Unexpected increment of %s", inc.SourceIP)
+		}
+	}
+	if n := testutil.CollectAndCount(metrics.NewCollector(), "connectivity_exporter_canary_connections_total"); n != 0 {
+		t.Errorf("The canary series should be removed, got %d", n)
+	}
+}
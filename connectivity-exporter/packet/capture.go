@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// capturePollTimeout bounds the time a reload waits for the capture,
+// which holds the attachment while polling its sockets.
+const capturePollTimeout = 100 * time.Millisecond
+
+// CaptureUnparsedPackets makes the eBPF program pass the packets whose
+// SNI it cannot parse on to userspace and writes them to a pcap file,
+// e.g. to debug ClientHellos split over several packets. Only the
+// first snapLength bytes of a packet are passed on, 0 means up to the
+// end of its TLS record header.
+func (s *NetworkDataSource) CaptureUnparsedPackets(ctx context.Context, wg *sync.WaitGroup, filename string, snapLength uint32) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening capture file: %w", err)
+	}
+	headerSnapLength := snapLength
+	if headerSnapLength == 0 {
+		headerSnapLength = 0xffff
+	}
+	w := pcapgo.NewWriter(file)
+	if err := w.WriteFileHeader(headerSnapLength, layers.LinkTypeEthernet); err != nil {
+		file.Close()
+		return fmt.Errorf("writing capture file header: %w", err)
+	}
+
+	if err := s.enableForward(forwardConfig{enabled: true, snapLength: snapLength}); err != nil {
+		file.Close()
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer file.Close()
+		buf := make([]byte, 0xffff)
+		for ctx.Err() == nil {
+			err := s.capturePackets(buf, func(data []byte, now time.Time) error {
+				info := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)}
+				return w.WritePacket(info, data)
+			})
+			if err != nil {
+				klog.Errorf("Failed to capture unparsed packets: %v", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// enableForward makes the eBPF program pass the packets whose SNI it
+// cannot parse on to the sockets of the attachment. The packets are
+// only read by one consumer.
+func (s *NetworkDataSource) enableForward(forward forwardConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return errors.New("passing on unparsed packets is only supported when capturing packets")
+	}
+	if s.forward.enabled {
+		return errors.New("the unparsed packets are already passed on")
+	}
+	if err := initForwardMap(s.ebpfConfig.forwardMap, forward); err != nil {
+		return fmt.Errorf("initializing forward map: %w", err)
+	}
+	s.forward = forward
+	return nil
+}
+
+// capturePackets waits for packets on the sockets of the attachment
+// and hands them over. The attachment is held, so its sockets are not
+// closed by a reload in the meantime.
+func (s *NetworkDataSource) capturePackets(buf []byte, handle func(data []byte, now time.Time) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.attachment == nil {
+		return errors.New("data source is closed")
+	}
+	return pollSockets(s.attachment, buf, handle)
+}
+
+// pollSockets waits for packets on the sockets of the attachment for
+// up to capturePollTimeout and hands them over.
+func pollSockets(attachment *ebpfAttachment, buf []byte, handle func(data []byte, now time.Time) error) error {
+	var fds []unix.PollFd
+	for _, fd := range attachment.socketFD {
+		if fd > 0 {
+			fds = append(fds, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+		}
+	}
+	if _, err := unix.Poll(fds, int(capturePollTimeout/time.Millisecond)); err != nil && !errors.Is(err, unix.EINTR) {
+		return err
+	}
+	for _, fd := range fds {
+		if fd.Revents&unix.POLLIN == 0 {
+			continue
+		}
+		n, _, err := unix.Recvfrom(int(fd.Fd), buf, unix.MSG_DONTWAIT)
+		if err != nil {
+			continue
+		}
+		if err := handle(buf[:n], time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
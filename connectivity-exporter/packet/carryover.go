@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"time"
+
+	"m/config"
+	"m/events"
+	"m/metrics"
+)
+
+// carryOverKey identifies the connections sharing the failed-second
+// carry-over. Depending on the configured granularity, the
+// destination IP is left empty.
+type carryOverKey struct {
+	sni    string
+	destIP string
+}
+
+func carryOverKeyFor(granularity string, connKey ConnKey) carryOverKey {
+	// The connections without an SNI share the unknown SNI, an
+	// unreachable destination must not fail the others.
+	if granularity == config.CarryOverSNIAndDest || connKey.sni == UnknownSNI {
+		return carryOverKey{sni: connKey.sni, destIP: connKey.destIP}
+	}
+	return carryOverKey{sni: connKey.sni}
+}
+
+// carriedFailure is the outcome of the last accounted second of a
+// carry-over key.
+type carriedFailure struct {
+	failed bool
+	// connKey is the connection key the carried over failed seconds
+	// are reported for. It is the last key with a failure, so the
+	// failing client stays visible.
+	connKey ConnKey
+	// lastActive is the time the carry-over key was last seen in a
+	// window.
+	lastActive time.Time
+}
+
+// accountWindow accounts for the connections of one window. Besides
+// the connection keys seen in the window, the inactive carry-over
+// keys are accounted too if they carry over a failure or follow a
+// schedule. A failure event is returned for each carry-over key that
+// starts failing outside of a maintenance window.
+func (s *State) accountWindow(connKeys map[ConnKey]struct{}, staleConnections map[ConnKey][]*tupleData, stats map[ConnKey]sniStats) ([]*metrics.Inc, []*events.Failure) {
+	cfg := s.config.Get()
+	now := s.clock.Now()
+	// The accounted second, the maintenance windows apply to.
+	accounted := now.Add(-accountingDelay(s.window))
+	incs := make([]*metrics.Inc, 0, len(connKeys))
+	// All the connection keys of a carry-over key see the outcome of
+	// the previous window, so the outcomes of this window are
+	// collected separately.
+	current := make(map[carryOverKey]*carriedFailure)
+
+	for connKey := range connKeys {
+		key := carryOverKeyFor(cfg.CarryOver, connKey)
+		previous := s.carryOver[key]
+		previousFailed := previous != nil && previous.failed
+		inc, failedSecond := s.accountForConnections(connKey, previousFailed, staleConnections[connKey], stats[connKey])
+		incs = append(incs, inc)
+		if s.journal != nil {
+			s.journal.add(newJournalRecord(connKey, previousFailed, false, staleConnections[connKey], stats[connKey], inc, failedSecond))
+		}
+
+		if c, ok := current[key]; !ok {
+			current[key] = &carriedFailure{failed: failedSecond, connKey: connKey, lastActive: now}
+		} else if failedSecond && !c.failed {
+			c.failed = true
+			c.connKey = connKey
+		}
+	}
+
+	for key, previous := range s.carryOver {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		// An inactive key is accounted if it carries over a failure,
+		// follows a schedule, or every second is accounted.
+		policy := cfg.SecondsPolicyFor(key.sni)
+		if policy == config.SecondsActiveOnly {
+			continue
+		}
+		if !previous.failed && !cfg.HasSchedule(key.sni) && !config.IsWallClock(policy) {
+			continue
+		}
+		inc, failedSecond := s.accountForConnections(previous.connKey, previous.failed, nil, sniStats{})
+		incs = append(incs, inc)
+		if s.journal != nil {
+			s.journal.add(newJournalRecord(previous.connKey, previous.failed, true, nil, sniStats{}, inc, failedSecond))
+		}
+		current[key] = &carriedFailure{failed: failedSecond, connKey: previous.connKey, lastActive: previous.lastActive}
+	}
+
+	var failures []*events.Failure
+	for key, c := range current {
+		previous := s.carryOver[key]
+		if c.failed && (previous == nil || !previous.failed) && !cfg.InMaintenance(key.sni, accounted) {
+			failures = append(failures, &events.Failure{
+				Time:     now,
+				SNI:      c.connKey.sni,
+				SourceIP: c.connKey.sourceIP,
+				DestIP:   c.connKey.destIP,
+				// The annotations of the destination's CIDR group
+				// route the event to the owners.
+				Annotations: cfg.CIDRGroupAnnotations(net.ParseIP(c.connKey.destIP)),
+			})
+		}
+		s.carryOver[key] = c
+	}
+	return incs, failures
+}
+
+// deleteExpiredCarryOvers removes the carry-over state of the keys
+// that have been inactive for longer than the retention.
+func (s *State) deleteExpiredCarryOvers(now time.Time) {
+	retention := s.config.Get().CarryOverRetentionOrDefault()
+	for key, c := range s.carryOver {
+		if c.lastActive.Add(retention).Before(now) {
+			delete(s.carryOver, key)
+		}
+	}
+	if !s.quiet {
+		metrics.SetCarryOverEntries(len(s.carryOver))
+	}
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+	"time"
+
+	"m/clock"
+	"m/config"
+	"m/metrics"
+)
+
+// window is the input of a single accounting window.
+type window map[ConnKey][]*tupleData
+
+func (w window) account(state *State) []*metrics.Inc {
+	connKeys := map[ConnKey]struct{}{}
+	for k := range w {
+		connKeys[k] = struct{}{}
+	}
+	incs, _ := state.accountWindow(connKeys, w, nil)
+	return incs
+}
+
+// failedSeconds sums up the failed seconds per connection key.
+func failedSeconds(incs []*metrics.Inc) map[ConnKey]float64 {
+	out := map[ConnKey]float64{}
+	for _, inc := range incs {
+		if inc.FailedSeconds > 0 {
+			out[ConnKey{sourceIP: inc.SourceIP, destIP: inc.DestIP, sni: inc.SNI}] += inc.FailedSeconds
+		}
+	}
+	return out
+}
+
+func TestCarryOver(t *testing.T) {
+	const sni = "api.example.com"
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: sni}
+	clientB := ConnKey{sourceIP: "10.0.0.2", destIP: "192.168.0.1", sni: sni}
+	clientAOtherDest := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.2", sni: sni}
+	failed := []*tupleData{{state: RST_SENT_BY_SERVER}}
+	succeeded := []*tupleData{{state: SNI_RECEIVED}}
+
+	tests := []struct {
+		desc        string
+		granularity string
+		windows     []window
+		// The failed seconds per connection key in each window.
+		want []map[ConnKey]float64
+	}{
+		{
+			desc:    "failure is carried over during inactivity",
+			windows: []window{{clientA: failed}, {}, {}},
+			want:    []map[ConnKey]float64{{clientA: 1}, {clientA: 1}, {clientA: 1}},
+		},
+		{
+			desc:    "success ends the carry-over",
+			windows: []window{{clientA: failed}, {clientA: succeeded}, {}},
+			want:    []map[ConnKey]float64{{clientA: 1}, {}, {}},
+		},
+		{
+			desc:    "success of another client ends the carry-over",
+			windows: []window{{clientA: failed}, {}, {clientB: succeeded}, {}},
+			want:    []map[ConnKey]float64{{clientA: 1}, {clientA: 1}, {}, {}},
+		},
+		{
+			desc:    "failure is carried over for the failing client",
+			windows: []window{{clientA: failed, clientB: succeeded}, {}},
+			want:    []map[ConnKey]float64{{clientA: 1}, {clientA: 1}},
+		},
+		{
+			desc:        "success to another destination ends the carry-over per SNI",
+			granularity: config.CarryOverSNI,
+			windows:     []window{{clientA: failed}, {clientAOtherDest: succeeded}, {}},
+			want:        []map[ConnKey]float64{{clientA: 1}, {}, {}},
+		},
+		{
+			desc:        "success to another destination keeps the carry-over per SNI and destination",
+			granularity: config.CarryOverSNIAndDest,
+			windows:     []window{{clientA: failed}, {clientAOtherDest: succeeded}, {}},
+			want:        []map[ConnKey]float64{{clientA: 1}, {clientA: 1}, {clientA: 1}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := newState(config.NewStore(&config.Config{CarryOver: tc.granularity}), nil)
+			for i, w := range tc.windows {
+				got := failedSeconds(w.account(state))
+				assert(t, got, tc.want[i])
+			}
+		})
+	}
+}
+
+func TestCarryOverExpiry(t *testing.T) {
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	clk := clock.NewFake(time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC))
+	state := newState(config.NewStore(&config.Config{CarryOverRetention: config.Duration(time.Minute)}), clk)
+
+	window{clientA: {{state: RST_SENT_BY_SERVER}}}.account(state)
+	state.deleteExpiredCarryOvers(clk.Advance(30 * time.Second))
+	assert(t, failedSeconds(window{}.account(state)), map[ConnKey]float64{clientA: 1})
+
+	// Carrying over the failure does not make the key active.
+	state.deleteExpiredCarryOvers(clk.Advance(31 * time.Second))
+	assert(t, len(state.carryOver), 0)
+	assert(t, failedSeconds(window{}.account(state)), map[ConnKey]float64{})
+}
+
+func TestWallClockSeconds(t *testing.T) {
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	succeeded := []*tupleData{{state: SNI_RECEIVED}}
+	wallClockSeconds := func(incs []*metrics.Inc) (wallClock, unknown float64) {
+		for _, inc := range incs {
+			wallClock += inc.WallClockSeconds
+			unknown += inc.UnknownSeconds
+		}
+		return wallClock, unknown
+	}
+
+	for policy, want := range map[string][2]float64{
+		config.SecondsActiveWithCarry:    {0, 0},
+		config.SecondsWallClockWithCarry: {1, 1},
+	} {
+		state := newState(config.NewStore(&config.Config{Rules: []config.Rule{{SNI: "*", SecondsPolicy: policy}}}), nil)
+		window{clientA: succeeded}.account(state)
+		// The inactive key is only accounted with a wall-clock policy.
+		wallClock, unknown := wallClockSeconds(window{}.account(state))
+		assert(t, [2]float64{wallClock, unknown}, want)
+	}
+}
+
+func TestFailureEvents(t *testing.T) {
+	const sni = "api.example.com"
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: sni}
+	failed := []*tupleData{{state: RST_SENT_BY_SERVER}}
+	succeeded := []*tupleData{{state: SNI_RECEIVED}}
+	state := newState(nil, nil)
+
+	failureCount := func(w window) int {
+		connKeys := map[ConnKey]struct{}{}
+		for k := range w {
+			connKeys[k] = struct{}{}
+		}
+		_, failures := state.accountWindow(connKeys, w, nil)
+		for _, f := range failures {
+			assert(t, [3]string{f.SNI, f.SourceIP, f.DestIP}, [3]string{sni, clientA.sourceIP, clientA.destIP})
+		}
+		return len(failures)
+	}
+
+	// Only the start of a failure is reported, not the carried over
+	// or repeated failed seconds.
+	assert(t, failureCount(window{clientA: failed}), 1)
+	assert(t, failureCount(window{}), 0)
+	assert(t, failureCount(window{clientA: failed}), 0)
+	assert(t, failureCount(window{clientA: succeeded}), 0)
+	assert(t, failureCount(window{clientA: failed}), 1)
+}
+
+func TestFailureEventsAfterMaintenance(t *testing.T) {
+	start := time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{
+		SNI:                "api.example.com",
+		MaintenanceWindows: []config.Window{{Start: start, End: end}},
+	}}})
+	clk := clock.NewFake(end.Add(accountingDelay(0) / 2))
+	state := newState(store, clk)
+	connKey := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	failed := window{connKey: {{state: RST_SENT_BY_SERVER}}}
+	succeeded := window{connKey: {{state: SNI_RECEIVED}}}
+
+	// The snapshot is taken after the window, but the second is still
+	// within it.
+	_, failures := state.accountWindow(map[ConnKey]struct{}{connKey: {}}, failed, nil)
+	assert(t, len(failures), 0)
+
+	state.accountWindow(map[ConnKey]struct{}{connKey: {}}, succeeded, nil)
+	clk.Set(end.Add(accountingDelay(0) + time.Second))
+	_, failures = state.accountWindow(map[ConnKey]struct{}{connKey: {}}, failed, nil)
+	assert(t, len(failures), 1)
+}
+
+func TestFailureEventAnnotations(t *testing.T) {
+	store := config.NewStore(&config.Config{CIDRGroups: []config.CIDRGroup{
+		{Name: "database", CIDRs: []string{"192.168.0.0/24"}, Annotations: map[string]string{"team": "storage"}},
+	}})
+	state := newState(store, nil)
+	connKey := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "db.example.com"}
+	_, failures := state.accountWindow(map[ConnKey]struct{}{connKey: {}}, window{connKey: {{state: RST_SENT_BY_SERVER}}}, nil)
+	assert(t, len(failures), 1)
+	assert(t, failures[0].Annotations, map[string]string{"team": "storage"})
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"m/metrics"
+)
+
+// ClassifiedConnection is the view of a connection from the connections map
+// given to the classifiers.
+type ClassifiedConnection struct {
+	// State is the state of the eBPF program, e.g. "rst_sent_by_server".
+	State                        string
+	SNI                          string
+	SourceIP, DestIP             string
+	ClientTTL, ServerTTL         uint8
+	ServerHelloSeen              bool
+	HandshakeFinished            bool
+	ClientApplicationDataRecords uint32
+}
+
+// Classification is the contribution of a classifier to the accounting
+// of a connection.
+type Classification struct {
+	// Class is counted in connections_classified_total, empty if the
+	// classifier does not claim the connection.
+	Class string
+	// Failed fails the second of the connection.
+	Failed bool
+}
+
+// Classifier is a second pass over the connections after the states of
+// the eBPF program are accounted, e.g. to count states of a fork
+// without changing the accounting of the core states.
+//
+// The classifiers run in ascending Order, classifiers of the same order
+// in the order of their registration. The first classifier returning a
+// class claims the connection, the later classifiers do not see it. A
+// classifier can fail a second, but it cannot clear a failure of the
+// core states. The closed connections accounted in the stats map are
+// aggregated by the eBPF program, so they are not classified.
+type Classifier struct {
+	// Name is the value of the classifier label.
+	Name     string
+	Order    int
+	Classify func(*ClassifiedConnection) Classification
+}
+
+var (
+	classifiersMutex sync.Mutex
+	classifiers      []Classifier
+)
+
+// RegisterClassifier adds a classifier to the data sources created
+// afterwards, so it is typically called in an init function.
+func RegisterClassifier(c Classifier) error {
+	if c.Name == "" || c.Classify == nil {
+		return fmt.Errorf("classifier without a name or function")
+	}
+	classifiersMutex.Lock()
+	defer classifiersMutex.Unlock()
+	for _, registered := range classifiers {
+		if registered.Name == c.Name {
+			return fmt.Errorf("classifier %q is already registered", c.Name)
+		}
+	}
+	classifiers = append(classifiers, c)
+	sort.SliceStable(classifiers, func(i, j int) bool { return classifiers[i].Order < classifiers[j].Order })
+	return nil
+}
+
+// registeredClassifiers returns the classifiers in the order they run.
+func registeredClassifiers() []Classifier {
+	classifiersMutex.Lock()
+	defer classifiersMutex.Unlock()
+	return append([]Classifier(nil), classifiers...)
+}
+
+// classify runs the classifiers on a connection, adds the class of the
+// claiming classifier to the increment and returns whether it failed
+// the second.
+func (s *State) classify(td *tupleData, inc *metrics.Inc) bool {
+	if len(s.classifiers) == 0 {
+		return false
+	}
+	c := &ClassifiedConnection{
+		State:                        td.state.String(),
+		SNI:                          td.sni,
+		SourceIP:                     td.sourceIP.String(),
+		DestIP:                       td.destIP.String(),
+		ClientTTL:                    td.clientTTL,
+		ServerTTL:                    td.serverTTL,
+		ServerHelloSeen:              td.serverHelloSeen,
+		HandshakeFinished:            td.handshakeFinished,
+		ClientApplicationDataRecords: td.clientAppDataRecords,
+	}
+	failed := false
+	for _, classifier := range s.classifiers {
+		result := classifier.Classify(c)
+		failed = failed || result.Failed
+		if result.Class == "" {
+			continue
+		}
+		if inc.Classes == nil {
+			inc.Classes = make(map[metrics.Class]float64)
+		}
+		inc.Classes[metrics.Class{Classifier: classifier.Name, Name: result.Class}]++
+		break
+	}
+	return failed
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+
+	"m/metrics"
+)
+
+func TestClassifiers(t *testing.T) {
+	defer func(registered []Classifier) { classifiers = registered }(classifiers)
+	classifiers = nil
+
+	// Claims the connections with a low TTL of the server, the later
+	// classifier does not see them.
+	lowTTL := Classifier{Name: "low_ttl", Order: 10, Classify: func(c *ClassifiedConnection) Classification {
+		if c.ServerTTL < 10 {
+			return Classification{Class: "low"}
+		}
+		return Classification{}
+	}}
+	resets := Classifier{Name: "resets", Order: 20, Classify: func(c *ClassifiedConnection) Classification {
+		if c.State == "rst_sent_by_client" {
+			return Classification{Class: "client_reset", Failed: true}
+		}
+		return Classification{Class: "other"}
+	}}
+	// Registered in reverse order, the order decides.
+	if err := RegisterClassifier(resets); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterClassifier(lowTTL); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterClassifier(resets); err == nil {
+		t.Error("RegisterClassifier() of a duplicate name succeeded")
+	}
+
+	state := newState(nil, nil)
+	stale := []*tupleData{
+		{state: FIN_RECEIVED, serverTTL: 5},
+		{state: RST_SENT_BY_CLIENT, serverTTL: 5},
+		{state: RST_SENT_BY_CLIENT, serverTTL: 64},
+		{state: FIN_RECEIVED, serverTTL: 64},
+	}
+	inc, failed := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, sniStats{})
+	assert(t, inc.Classes, map[metrics.Class]float64{
+		{Classifier: "low_ttl", Name: "low"}:         2,
+		{Classifier: "resets", Name: "client_reset"}: 1,
+		{Classifier: "resets", Name: "other"}:        1,
+	})
+	// The core states are accounted as before.
+	assert(t, inc.RejectedConnectionsByClient, float64(2))
+	assert(t, failed, true)
+}
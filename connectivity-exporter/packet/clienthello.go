@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// The TLS extensions parsed from a ClientHello.
+const (
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+	extensionECH               = 0xfe0d
+)
+
+// echSNIPrefix prefixes the outer SNI of a ClientHello with the
+// encrypted client hello extension, mirroring ECH_SNI_PREFIX. The outer
+// SNI is the public name of the client-facing server, the real SNI is
+// encrypted.
+const echSNIPrefix = "__ech__:"
+
+// clientHello are the fields of a ClientHello parsed in userspace.
+type clientHello struct {
+	// sni is prefixed with echSNIPrefix with an encrypted client hello.
+	sni  string
+	alpn []string
+	// version is the highest supported version, or the legacy
+	// version without the supported versions extension.
+	version uint16
+}
+
+// parseClientHelloSNI returns the server name of a ClientHello at the
+// start of the payload.
+func parseClientHelloSNI(payload []byte) (string, bool) {
+	hello, ok := parseClientHello(payload)
+	if !ok || hello.sni == "" {
+		return "", false
+	}
+	return hello.sni, true
+}
+
+// parseClientHello parses a ClientHello at the start of the payload.
+// Like the eBPF program, it only sees the first record and does not
+// reassemble a ClientHello split over several segments.
+func parseClientHello(payload []byte) (*clientHello, bool) {
+	// The TLS record header and the handshake header.
+	const recordHeaderLen, handshakeHeaderLen = 5, 4
+	if len(payload) < recordHeaderLen+handshakeHeaderLen || payload[0] != 0x16 || payload[recordHeaderLen] != 0x01 {
+		return nil, false
+	}
+	p := payload[recordHeaderLen+handshakeHeaderLen:]
+	// The client version and random.
+	if len(p) < 2+32 {
+		return nil, false
+	}
+	hello := &clientHello{version: binary.BigEndian.Uint16(p)}
+	p = p[2+32:]
+	// The session ID, cipher suites and compression methods.
+	for _, lengthSize := range []int{1, 2, 1} {
+		var ok bool
+		if _, p, ok = readVector(p, lengthSize); !ok {
+			return nil, false
+		}
+	}
+	if len(p) == 0 {
+		// A ClientHello without extensions.
+		return hello, true
+	}
+	if len(p) < 2 {
+		return nil, false
+	}
+	extensions, _, ok := readVector(p, 2)
+	if !ok {
+		// The extensions are cut off by the end of the segment.
+		extensions = p[2:]
+	}
+	ech := false
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		ext, rest, ok := readVector(extensions[2:], 2)
+		if !ok {
+			return nil, false
+		}
+		extensions = rest
+		switch extType {
+		case extensionServerName:
+			// The server name list with the host name first.
+			list, _, ok := readVector(ext, 2)
+			if !ok || len(list) < 1 || list[0] != 0 {
+				return nil, false
+			}
+			name, _, ok := readVector(list[1:], 2)
+			if !ok || len(name) == 0 {
+				return nil, false
+			}
+			hello.sni = string(name)
+		case extensionALPN:
+			list, _, ok := readVector(ext, 2)
+			if !ok {
+				return nil, false
+			}
+			for len(list) > 0 {
+				var protocol []byte
+				if protocol, list, ok = readVector(list, 1); !ok {
+					return nil, false
+				}
+				hello.alpn = append(hello.alpn, string(protocol))
+			}
+		case extensionSupportedVersions:
+			list, _, ok := readVector(ext, 1)
+			if !ok {
+				return nil, false
+			}
+			for ; len(list) >= 2; list = list[2:] {
+				v := binary.BigEndian.Uint16(list)
+				// GREASE values are reserved and never negotiated.
+				if v&0x0f0f != 0x0a0a && v > hello.version {
+					hello.version = v
+				}
+			}
+		case extensionECH:
+			ech = true
+		}
+	}
+	if ech && hello.sni != "" {
+		hello.sni = echSNIPrefix + hello.sni
+	}
+	return hello, true
+}
+
+// readVector returns the content of a vector with a length of
+// lengthSize bytes and the bytes after it.
+func readVector(p []byte, lengthSize int) (content, rest []byte, ok bool) {
+	if len(p) < lengthSize {
+		return nil, nil, false
+	}
+	n := int(p[0])
+	if lengthSize == 2 {
+		n = int(binary.BigEndian.Uint16(p))
+	}
+	if len(p) < lengthSize+n {
+		return nil, nil, false
+	}
+	return p[lengthSize : lengthSize+n], p[lengthSize+n:], true
+}
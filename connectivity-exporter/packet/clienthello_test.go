@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const clientHelloCorpusDir = "testdata/clienthello"
+
+// corpusEntry is a ClientHello of a real TLS stack and the fields it
+// has to be parsed as.
+type corpusEntry struct {
+	File    string   `json:"file"`
+	Stack   string   `json:"stack"`
+	SNI     string   `json:"sni"`
+	ALPN    []string `json:"alpn"`
+	Version string   `json:"version"`
+	// Synthetic is set for the ClientHellos which are built instead of
+	// captured from the stack.
+	Synthetic bool `json:"synthetic"`
+
+	payload []byte
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS 1.0": 0x0301,
+	"TLS 1.1": 0x0302,
+	"TLS 1.2": 0x0303,
+	"TLS 1.3": 0x0304,
+}
+
+func loadClientHelloCorpus(t *testing.T) []corpusEntry {
+	data, err := os.ReadFile(filepath.Join(clientHelloCorpusDir, "corpus.json"))
+	if err != nil {
+		t.Fatalf("reading corpus: %v", err)
+	}
+	var corpus []corpusEntry
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatalf("decoding corpus: %v", err)
+	}
+	for i := range corpus {
+		if corpus[i].payload, err = os.ReadFile(filepath.Join(clientHelloCorpusDir, corpus[i].File)); err != nil {
+			t.Fatalf("reading ClientHello of %s: %v", corpus[i].Stack, err)
+		}
+	}
+	return corpus
+}
+
+func TestClientHelloCorpus(t *testing.T) {
+	for _, e := range loadClientHelloCorpus(t) {
+		t.Run(e.Stack, func(t *testing.T) {
+			hello, ok := parseClientHello(e.payload)
+			if !ok {
+				t.Fatalf("%s is not parsed", e.File)
+			}
+			version, ok := tlsVersions[e.Version]
+			if !ok {
+				t.Fatalf("Unknown version %q", e.Version)
+			}
+			assert(t, hello, &clientHello{sni: e.SNI, alpn: e.ALPN, version: version})
+		})
+	}
+}
@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// ErrNoEBPF is returned by EBPFInfo if the data source did not load an
+// eBPF program, e.g. while replaying snapshots.
+var ErrNoEBPF = errors.New("no eBPF program loaded")
+
+// verifierLogSize is the size of the buffer of the verifier log of a
+// program. The log of the largest sub-program fits.
+const verifierLogSize = 8 << 20
+
+// The attachments of the programs, see ProgramInfo.
+const (
+	attachmentSocket   = "socket"
+	attachmentTailCall = "tail_call"
+	attachmentCgroup   = "cgroup"
+)
+
+// EBPFInfo describes the loaded eBPF programs and maps, so a support
+// request holds them without access to the node.
+type EBPFInfo struct {
+	// LoadedAt is the time the programs were loaded, at startup or by
+	// the last reload.
+	LoadedAt  time.Time     `json:"loadedAt"`
+	Interface string        `json:"interface"`
+	Span      bool          `json:"span"`
+	Programs  []ProgramInfo `json:"programs"`
+	Maps      []MapInfo     `json:"maps"`
+	// VerifierLogs are the logs of the verifier per program, only
+	// returned on request.
+	VerifierLogs map[string]string `json:"verifierLogs,omitempty"`
+}
+
+// ProgramInfo describes a loaded eBPF program.
+type ProgramInfo struct {
+	Name string `json:"name"`
+	// ID is the ID of the program in the kernel, as shown by bpftool.
+	ID   uint32 `json:"id,omitempty"`
+	Type string `json:"type"`
+	Tag  string `json:"tag,omitempty"`
+	// Instructions is the number of instructions after the kernel
+	// translated the program.
+	Instructions int `json:"instructions,omitempty"`
+	// Attachment is how the program is run: "socket" for the entry
+	// program attached to the sockets of the interfaces, "tail_call"
+	// for the sub-programs and "cgroup" for the sock_ops program.
+	Attachment string `json:"attachment"`
+}
+
+// MapInfo describes a map of the loaded eBPF programs.
+type MapInfo struct {
+	Name       string `json:"name"`
+	ID         uint32 `json:"id,omitempty"`
+	Type       string `json:"type"`
+	KeySize    uint32 `json:"keySize"`
+	ValueSize  uint32 `json:"valueSize"`
+	MaxEntries uint32 `json:"maxEntries"`
+	Flags      uint32 `json:"flags,omitempty"`
+}
+
+// EBPFInfo returns the programs and maps of the running eBPF setup.
+// With verifierLogs, the programs are verified again to return the
+// logs of the verifier, see verifierLogs.
+func (s *NetworkDataSource) EBPFInfo(verifierLogs bool) (*EBPFInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ec := s.ebpfConfig
+	if ec == nil || ec.coll == nil {
+		return nil, ErrNoEBPF
+	}
+	info := &EBPFInfo{LoadedAt: ec.loadedAt, Interface: s.networkInterface, Span: s.span}
+	for name, prog := range ec.coll.Programs {
+		attachment := attachmentTailCall
+		if name == BPF_PROGRAM_NAME {
+			attachment = attachmentSocket
+		}
+		info.Programs = append(info.Programs, programInfo(name, prog, attachment))
+	}
+	if s.attachment != nil && s.attachment.sockOps != nil {
+		info.Programs = append(info.Programs, ProgramInfo{Name: BPF_SOCKOPS_PROGRAM_NAME, Type: ebpf.SockOps.String(), Attachment: attachmentCgroup})
+	}
+	sort.Slice(info.Programs, func(i, j int) bool { return info.Programs[i].Name < info.Programs[j].Name })
+	for name, m := range ec.coll.Maps {
+		info.Maps = append(info.Maps, mapInfo(name, m))
+	}
+	sort.Slice(info.Maps, func(i, j int) bool { return info.Maps[i].Name < info.Maps[j].Name })
+	if verifierLogs {
+		logs, err := ec.verifierLogs()
+		if err != nil {
+			return nil, err
+		}
+		info.VerifierLogs = logs
+	}
+	return info, nil
+}
+
+func programInfo(name string, prog *ebpf.Program, attachment string) ProgramInfo {
+	p := ProgramInfo{Name: name, Attachment: attachment}
+	info, err := prog.Info()
+	if err != nil {
+		return p
+	}
+	p.Type = info.Type.String()
+	p.Tag = info.Tag
+	if id, ok := info.ID(); ok {
+		p.ID = uint32(id)
+	}
+	if insns, err := info.Instructions(); err == nil {
+		p.Instructions = len(insns)
+	}
+	return p
+}
+
+func mapInfo(name string, m *ebpf.Map) MapInfo {
+	i := MapInfo{Name: name, Type: m.Type().String(), KeySize: m.KeySize(), ValueSize: m.ValueSize(), MaxEntries: m.MaxEntries(), Flags: m.Flags()}
+	if info, err := m.Info(); err == nil {
+		if id, ok := info.ID(); ok {
+			i.ID = uint32(id)
+		}
+	}
+	return i
+}
+
+// verifierLogs loads the programs of the config again with the log of
+// the verifier enabled and returns the logs per program. The programs
+// are not attached and share the maps of the config, so they are
+// verified like the running ones. Keeping the logs of every load
+// instead would cost their memory for the lifetime of the programs.
+func (config *ebpfConfig) verifierLogs() (map[string]string, error) {
+	spec := config.spec.Copy()
+	if err := spec.RewriteMaps(config.coll.Maps); err != nil {
+		return nil, fmt.Errorf("sharing the maps with the verified programs: %w", err)
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		Programs: ebpf.ProgramOptions{LogLevel: 1, LogSize: verifierLogSize},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verifying the programs: %w", err)
+	}
+	defer coll.Close()
+	logs := make(map[string]string, len(coll.Programs))
+	for name, prog := range coll.Programs {
+		logs[name] = prog.VerifierLog
+	}
+	return logs, nil
+}
+
+// MapDump is the content of a map of the loaded eBPF programs, see
+// DumpMaps.
+type MapDump struct {
+	MapInfo
+	Entries []MapEntry `json:"entries"`
+	// Error tells why the entries could not be read, e.g. of a map
+	// whose values cannot be looked up from userspace.
+	Error string `json:"error,omitempty"`
+}
+
+// MapEntry is an entry of a map as stored in the kernel. The value of
+// a per-CPU map is one per possible CPU.
+type MapEntry struct {
+	Key    []byte   `json:"key"`
+	Value  []byte   `json:"value,omitempty"`
+	PerCPU [][]byte `json:"perCPU,omitempty"`
+}
+
+// DumpMaps returns the raw content of all maps of the running eBPF
+// setup, for the post-mortem analysis of a failure. The maps are read
+// while the programs update them, so the dump is not consistent across
+// maps.
+func (s *NetworkDataSource) DumpMaps() ([]MapDump, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ec := s.ebpfConfig
+	if ec == nil || ec.coll == nil {
+		return nil, ErrNoEBPF
+	}
+	dumps := make([]MapDump, 0, len(ec.coll.Maps))
+	for name, m := range ec.coll.Maps {
+		dump := MapDump{MapInfo: mapInfo(name, m)}
+		entries, err := dumpEntries(m)
+		if err != nil {
+			dump.Error = err.Error()
+		}
+		dump.Entries = entries
+		dumps = append(dumps, dump)
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Name < dumps[j].Name })
+	return dumps, nil
+}
+
+// dumpEntries reads the entries of the map by iterating it. The entries
+// read before an error are returned with it.
+func dumpEntries(m *ebpf.Map) ([]MapEntry, error) {
+	entries := []MapEntry{}
+	var key []byte
+	iter := m.Iterate()
+	switch m.Type() {
+	case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash:
+		var values [][]byte
+		for iter.Next(&key, &values) {
+			perCPU := make([][]byte, len(values))
+			for i, v := range values {
+				perCPU[i] = copyBytes(v)
+			}
+			entries = append(entries, MapEntry{Key: copyBytes(key), PerCPU: perCPU})
+		}
+	default:
+		var value []byte
+		for iter.Next(&key, &value) {
+			entries = append(entries, MapEntry{Key: copyBytes(key), Value: copyBytes(value)})
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return entries, fmt.Errorf("iterating: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// DNSHandler handles the DNS messages passed on by the eBPF program.
+type DNSHandler interface {
+	// Handle handles the frame of a DNS message.
+	Handle(data []byte, now time.Time)
+	// Expire is called about every second, e.g. to time out the
+	// queries without a response.
+	Expire(now time.Time)
+}
+
+// CaptureDNS attaches the DNS program of the eBPF collection to sockets
+// of its own and hands the frames of the DNS messages over to the
+// handler until the context is done. The program has no maps, so its
+// sockets are kept across reloads.
+func (s *NetworkDataSource) CaptureDNS(ctx context.Context, wg *sync.WaitGroup, handler DNSHandler) error {
+	s.mutex.RLock()
+	if s.ebpfConfig == nil {
+		s.mutex.RUnlock()
+		return errors.New("tracking DNS is only supported when capturing packets")
+	}
+	prog, ok := s.ebpfConfig.coll.Programs[BPF_DNS_PROGRAM_NAME]
+	if !ok {
+		s.mutex.RUnlock()
+		return fmt.Errorf("bpf program %q not found", BPF_DNS_PROGRAM_NAME)
+	}
+	attachment, err := attachProgramToNetworkInterface(prog, s.networkInterface, s.span)
+	s.mutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("attaching bpf program %q: %w", BPF_DNS_PROGRAM_NAME, err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer attachment.Close()
+		lastExpiry := time.Now()
+		buf := make([]byte, 0xffff)
+		for ctx.Err() == nil {
+			err := pollSockets(attachment, buf, func(data []byte, now time.Time) error {
+				handler.Handle(data, now)
+				return nil
+			})
+			if err != nil {
+				klog.Errorf("Failed to capture DNS messages: %v", err)
+				return
+			}
+			if now := time.Now(); now.Sub(lastExpiry) > time.Second {
+				handler.Expire(now)
+				lastExpiry = now
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	"m/fatal"
+	"m/metrics"
+)
+
+// SetupErrorKind classifies why the eBPF program cannot be loaded or
+// attached.
+type SetupErrorKind int
+
+const (
+	// SetupFailed is any other failure.
+	SetupFailed SetupErrorKind = iota
+	// MissingCapability means the exporter is not privileged enough.
+	MissingCapability
+	// VerifierRejected means the kernel verifier rejected a program.
+	VerifierRejected
+	// InterfaceNotFound means the network interface does not exist.
+	InterfaceNotFound
+	// KernelUnsupported means the kernel lacks a required eBPF
+	// feature.
+	KernelUnsupported
+)
+
+func (k SetupErrorKind) String() string {
+	switch k {
+	case MissingCapability:
+		return "missing_capability"
+	case VerifierRejected:
+		return "verifier_rejected"
+	case InterfaceNotFound:
+		return "interface_not_found"
+	case KernelUnsupported:
+		return "kernel_unsupported"
+	default:
+		return "setup_failed"
+	}
+}
+
+// SetupError is returned when the eBPF program cannot be loaded or
+// attached. Use errors.As to distinguish the kinds of failures.
+type SetupError struct {
+	Kind SetupErrorKind
+	// Program is the sub-program rejected by the verifier.
+	Program string
+	// VerifierLog is the end of the log of the verifier, which states
+	// why the program was rejected.
+	VerifierLog string
+	Err         error
+}
+
+func (e *SetupError) Error() string {
+	if e.Program != "" {
+		return fmt.Sprintf("%s (program %s): %v", e.Kind, e.Program, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// Category implements fatal.Classified. Any other failure is counted as
+// a configuration error, it is mostly an invalid CIDR or port.
+func (e *SetupError) Category() fatal.Category {
+	switch e.Kind {
+	case MissingCapability:
+		return fatal.Capability
+	case VerifierRejected, KernelUnsupported:
+		return fatal.Kernel
+	default:
+		return fatal.Config
+	}
+}
+
+// Reason implements fatal.Classified.
+func (e *SetupError) Reason() string {
+	return e.Kind.String()
+}
+
+// ExitCode implements fatal.Classified. The exit codes predate the
+// categories and tell the kinds apart.
+func (e *SetupError) ExitCode() int {
+	switch e.Kind {
+	case VerifierRejected:
+		return 4
+	case InterfaceNotFound:
+		return 5
+	default:
+		return e.Category().ExitCode()
+	}
+}
+
+// Hint tells how to remediate the failure.
+func (e *SetupError) Hint() string {
+	switch e.Kind {
+	case MissingCapability:
+		return "run the exporter privileged or with the capabilities CAP_SYS_ADMIN, CAP_NET_RAW and CAP_SYS_RESOURCE"
+	case VerifierRejected:
+		return "the kernel is probably too old for the program, see the verifier log for the rejected instruction"
+	case InterfaceNotFound:
+		return "check the -i flag, the interface has to exist in the network namespace of the exporter, e.g. with hostNetwork"
+	case KernelUnsupported:
+		return "upgrade the kernel of the node, it lacks an eBPF feature the program requires"
+	default:
+		return ""
+	}
+}
+
+// verifierLogLines is the number of lines of the verifier log kept in
+// a SetupError. The reason of the rejection is at the end of the log.
+const verifierLogLines = 5
+
+var programErrorPattern = regexp.MustCompile(`program (\w+): `)
+
+// classifySetupError wraps the error of loading or attaching the eBPF
+// program into a SetupError and exports its kind as a metric.
+func classifySetupError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var setupErr *SetupError
+	if !errors.As(err, &setupErr) {
+		setupErr = &SetupError{Kind: SetupFailed, Err: err}
+		switch {
+		case errors.Is(err, ebpf.ErrNotSupported):
+			setupErr.Kind = KernelUnsupported
+		case errors.Is(err, unix.EPERM):
+			setupErr.Kind = MissingCapability
+		case errors.Is(err, unix.EACCES) || errors.Is(err, unix.EINVAL):
+			// The cilium/ebpf errors of a program carry the log of
+			// the verifier, but their type is internal.
+			if m := programErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+				setupErr.Kind = VerifierRejected
+				setupErr.Program = m[1]
+				setupErr.VerifierLog = lastLines(err.Error(), verifierLogLines)
+			}
+		}
+	}
+	metrics.SetBPFSetupError(setupErr.Kind.String(), setupErr.Program)
+	return setupErr
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RemoveMemlockLimit removes the limit of locked memory of the process.
+// Using eBPF maps requires locking memory.
+func RemoveMemlockLimit() error {
+	err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{
+		Cur: unix.RLIM_INFINITY,
+		Max: unix.RLIM_INFINITY,
+	})
+	return classifySetupError(err)
+}
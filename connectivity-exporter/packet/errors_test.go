@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	"m/fatal"
+)
+
+func TestClassifySetupError(t *testing.T) {
+	verifierLog := "0: (b7) r0 = 0\n1: (61) r2 = *(u32 *)(r1 +0)\n2: (bf) r3 = r2\n3: (07) r3 += 14\n4: (2d) if r3 > r1 goto pc+1\n5: (71) r0 = *(u8 *)(r2 +12)\ninvalid access to packet, off=12 size=1"
+	tests := []struct {
+		desc        string
+		err         error
+		wantKind    SetupErrorKind
+		wantProgram string
+		wantLog     string
+	}{
+		{
+			desc:     "missing capability",
+			err:      fmt.Errorf("creating eBPF collection: map connections: map create: %w", unix.EPERM),
+			wantKind: MissingCapability,
+		},
+		{
+			desc:     "kernel too old",
+			err:      fmt.Errorf("creating eBPF collection: map stats: map create: %w", ebpf.ErrNotSupported),
+			wantKind: KernelUnsupported,
+		},
+		{
+			desc:        "verifier rejected",
+			err:         fmt.Errorf("creating eBPF collection: program l4_state: load program: %w: %s", unix.EACCES, verifierLog),
+			wantKind:    VerifierRejected,
+			wantProgram: "l4_state",
+			wantLog:     "2: (bf) r3 = r2\n3: (07) r3 += 14\n4: (2d) if r3 > r1 goto pc+1\n5: (71) r0 = *(u8 *)(r2 +12)\ninvalid access to packet, off=12 size=1",
+		},
+		{
+			desc:     "already classified",
+			err:      &SetupError{Kind: InterfaceNotFound, Err: errors.New("no such network interface")},
+			wantKind: InterfaceNotFound,
+		},
+		{
+			desc:     "other",
+			err:      errors.New("initializing port map: invalid port x"),
+			wantKind: SetupFailed,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var setupErr *SetupError
+			if !errors.As(classifySetupError(tc.err), &setupErr) {
+				t.Fatalf("not a SetupError: %v", tc.err)
+			}
+			assert(t, setupErr.Kind, tc.wantKind)
+			assert(t, setupErr.Program, tc.wantProgram)
+			assert(t, setupErr.VerifierLog, tc.wantLog)
+			if !errors.Is(setupErr, tc.err) {
+				t.Errorf("the SetupError does not wrap %v", tc.err)
+			}
+		})
+	}
+}
+
+func TestSetupErrorExitCodes(t *testing.T) {
+	// The exit codes are documented and must not change.
+	tests := []struct {
+		kind         SetupErrorKind
+		wantCategory fatal.Category
+		wantCode     int
+	}{
+		{SetupFailed, fatal.Config, 2},
+		{MissingCapability, fatal.Capability, 3},
+		{VerifierRejected, fatal.Kernel, 4},
+		{InterfaceNotFound, fatal.Config, 5},
+		{KernelUnsupported, fatal.Kernel, 6},
+	}
+	for _, tc := range tests {
+		e := fatal.Classify(fmt.Errorf("creating the data source: %w", &SetupError{Kind: tc.kind}), fatal.Runtime)
+		assert(t, e.Category(), tc.wantCategory)
+		assert(t, e.ExitCode(), tc.wantCode)
+		assert(t, e.Reason(), tc.kind.String())
+	}
+}
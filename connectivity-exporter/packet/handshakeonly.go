@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"fmt"
+
+	"m/config"
+)
+
+// syncHandshakeOnly makes the eBPF program count open TLS connections
+// as succeeded only once the client sent application data while a
+// rule of the configuration detects the handshake-only connections.
+// Otherwise an open connection is counted as succeeded as soon as it
+// exceeds the thresholds, as without the detection.
+func (s *NetworkDataSource) syncHandshakeOnly(cfg *config.Config) error {
+	enabled := cfg.DetectsAnyHandshakeOnly()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil || enabled == s.deferHandshakeOnly {
+		return nil
+	}
+	capture := s.setupOptions().capture()
+	capture.deferHandshakeOnly = enabled
+	if err := initCaptureMap(s.ebpfConfig.captureMap, capture); err != nil {
+		return fmt.Errorf("initializing capture map: %w", err)
+	}
+	s.deferHandshakeOnly = enabled
+	return nil
+}
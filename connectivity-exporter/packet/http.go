@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bytes"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// parseHTTPHost returns the host of the Host header of a plaintext
+// HTTP request at the start of the payload, without the port and
+// lowercased. Like the eBPF program, it only searches the first
+// HTTP_MAX_HEADER_LEN bytes of the request.
+func parseHTTPHost(payload []byte) (string, bool) {
+	if len(payload) > C.HTTP_MAX_HEADER_LEN {
+		payload = payload[:C.HTTP_MAX_HEADER_LEN]
+	}
+	// A request starts with the method.
+	if len(payload) == 0 || payload[0] < 'A' || payload[0] > 'Z' {
+		return "", false
+	}
+	for {
+		i := bytes.IndexByte(payload, '\n')
+		if i < 0 {
+			return "", false
+		}
+		payload = payload[i+1:]
+		// The empty line ends the headers.
+		if len(payload) < C.HTTP_HOST_HEADER_LEN-1 || payload[0] == '\r' || payload[0] == '\n' {
+			return "", false
+		}
+		if bytes.EqualFold(payload[:4], []byte("host")) && payload[4] == ':' {
+			break
+		}
+	}
+	value := bytes.TrimLeft(payload[C.HTTP_HOST_HEADER_LEN-1:], " \t")
+	if end := bytes.IndexAny(value, ": \t\r\n"); end >= 0 {
+		value = value[:end]
+	}
+	if len(value) == 0 {
+		return "", false
+	}
+	return string(bytes.ToLower(value)), true
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPHost(t *testing.T) {
+	for _, tc := range []struct {
+		request string
+		host    string
+	}{
+		{"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n", "api.example.com"},
+		{"POST /v1 HTTP/1.1\r\nUser-Agent: curl\r\nhost:API.Example.com:8080\r\n\r\n", "api.example.com"},
+		{"GET / HTTP/1.1\nHOST: \tapi.example.com \n\n", "api.example.com"},
+		// No Host header before the end of the headers.
+		{"GET / HTTP/1.1\r\n\r\nHost: api.example.com\r\n", ""},
+		{"GET / HTTP/1.0\r\nX-Host: api.example.com\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: \r\n\r\n", ""},
+		// Not a request.
+		{"\x16\x03\x01\x00\x05\x01", ""},
+		// Beyond the searched bytes.
+		{"GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 512) + "\r\nHost: api.example.com\r\n\r\n", ""},
+	} {
+		host, ok := parseHTTPHost([]byte(tc.request))
+		if host != tc.host || ok != (tc.host != "") {
+			t.Errorf("parseHTTPHost(%q) = %q, %t, want %q", tc.request, host, ok, tc.host)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"time"
+
+	"m/config"
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// clientDest identifies the connections of a client to a destination
+// IP. The stats map does not key the destination port.
+type clientDest struct {
+	sourceIP, destIP string
+}
+
+// identity is the SNI last seen for a client, destination IP and port.
+type identity struct {
+	sni     string
+	expires time.Time
+}
+
+// identityCache keeps the SNIs of the connections for the SNI cache
+// TTL, so the following connections of the same triple without an
+// SNI, e.g. of clients resuming their sessions, are still accounted
+// for it.
+type identityCache map[clientDest]map[uint16]identity
+
+// learn keeps the SNI of a connection.
+func (c identityCache) learn(cd clientDest, destPort uint16, sni string, expires time.Time) {
+	ports, ok := c[cd]
+	if !ok {
+		ports = make(map[uint16]identity)
+		c[cd] = ports
+	}
+	ports[destPort] = identity{sni: sni, expires: expires}
+}
+
+// lookup returns the SNI of a connection without an SNI.
+func (c identityCache) lookup(cd clientDest, destPort uint16, now time.Time) (string, bool) {
+	id, ok := c[cd][destPort]
+	if !ok || id.expires.Before(now) {
+		return "", false
+	}
+	return id.sni, true
+}
+
+// lookupAnyPort returns the SNI of stats without an SNI, which do not
+// have a destination port. The SNI is only inferred if all the ports of
+// the client and destination IP have the same SNI.
+func (c identityCache) lookupAnyPort(cd clientDest, now time.Time) (string, bool) {
+	var sni string
+	for _, id := range c[cd] {
+		if id.expires.Before(now) {
+			continue
+		}
+		if sni != "" && id.sni != sni {
+			return "", false
+		}
+		sni = id.sni
+	}
+	return sni, sni != ""
+}
+
+// deleteExpired removes the SNIs whose TTL passed.
+func (c identityCache) deleteExpired(now time.Time) {
+	for cd, ports := range c {
+		for port, id := range ports {
+			if id.expires.Before(now) {
+				delete(ports, port)
+			}
+		}
+		if len(ports) == 0 {
+			delete(c, cd)
+		}
+	}
+}
+
+// sniAttributions counts the connections without an SNI per connection
+// key they were accounted for.
+type sniAttributions struct {
+	inferred, fallback map[ConnKey]uint64
+}
+
+func newSNIAttributions() *sniAttributions {
+	return &sniAttributions{inferred: make(map[ConnKey]uint64), fallback: make(map[ConnKey]uint64)}
+}
+
+// addTo adds the counts of the connection keys of the increments.
+func (a *sniAttributions) addTo(incs []*metrics.Inc) {
+	for _, inc := range incs {
+		ck := ConnKey{sourceIP: inc.SourceIP, destIP: inc.DestIP, sni: inc.SNI}
+		inc.InferredSNIConnections = float64(a.inferred[ck])
+		inc.FallbackSNIConnections = float64(a.fallback[ck])
+	}
+}
+
+// learnSNI keeps the SNI of a connection in the cache if it is enabled.
+func (s *State) learnSNI(cfg *config.Config, key C.struct_tuple_key_t, sni string) {
+	if cfg.SNICacheTTL <= 0 || sni == "" {
+		return
+	}
+	ck := connKeyFromC(key, "")
+	s.identities.learn(clientDest{sourceIP: ck.sourceIP, destIP: ck.destIP}, ntohs(uint16(key.dest_port)), sni, s.clock.Now().Add(time.Duration(cfg.SNICacheTTL)))
+}
+
+// connectionSNI returns the SNI a connection without an SNI is
+// accounted for: the cached SNI of its client, destination IP and
+// port, or the fallback SNI.
+func (s *State) connectionSNI(cfg *config.Config, key C.struct_tuple_key_t, attributions *sniAttributions) string {
+	ck := connKeyFromC(key, "")
+	if cfg.SNICacheTTL > 0 {
+		if sni, ok := s.identities.lookup(clientDest{sourceIP: ck.sourceIP, destIP: ck.destIP}, ntohs(uint16(key.dest_port)), s.clock.Now()); ok {
+			ck.sni = sni
+			attributions.inferred[ck]++
+			return sni
+		}
+	}
+	ck.sni = fallbackSNI(cfg, net.ParseIP(ck.destIP))
+	attributions.fallback[ck]++
+	return ck.sni
+}
+
+// statsSNI returns the SNI stats without an SNI are accounted for: the
+// cached SNI of all the ports of their client and destination IP, or
+// the fallback SNI.
+func (s *State) statsSNI(cfg *config.Config, ck ConnKey, stats sniStats, attributions *sniAttributions) string {
+	connections := stats.succeededConnections + stats.failedConnections + stats.middleboxResets + stats.networkRejections()
+	if cfg.SNICacheTTL > 0 {
+		if sni, ok := s.identities.lookupAnyPort(clientDest{sourceIP: ck.sourceIP, destIP: ck.destIP}, s.clock.Now()); ok {
+			ck.sni = sni
+			attributions.inferred[ck] += connections
+			return sni
+		}
+	}
+	ck.sni = fallbackSNI(cfg, net.ParseIP(ck.destIP))
+	attributions.fallback[ck] += connections
+	return ck.sni
+}
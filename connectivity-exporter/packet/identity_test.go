@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"m/clock"
+	"m/config"
+)
+
+func TestSNICache(t *testing.T) {
+	const sni = "api.example.com"
+	connection := func(dstPort uint16, sni string, first uint64) rawEntry {
+		tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000 + dstPort, dstPort: dstPort}
+		e, err := encodeConnection(tp, &tupleData{state: RST_SENT_BY_CLIENT, sourceIP: tp.srcIP.To4(), destIP: tp.dstIP.To4(), sni: sni, tickerClockFirstPacket: first})
+		if err != nil {
+			t.Fatalf("encodeConnection: %v", err)
+		}
+		return e
+	}
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	state := newState(config.NewStore(&config.Config{SNICacheTTL: config.Duration(time.Minute)}), clk)
+	account := func(snapshot *mapSnapshot) map[string][2]float64 {
+		t.Helper()
+		snapshot.TickerClock = 21
+		incs, _, _, err := state.accountSnapshot(snapshot)
+		if err != nil {
+			t.Fatalf("accountSnapshot: %v", err)
+		}
+		attributions := make(map[string][2]float64)
+		for _, inc := range incs {
+			attributions[inc.SNI] = [2]float64{inc.InferredSNIConnections, inc.FallbackSNIConnections}
+		}
+		return attributions
+	}
+
+	// The SNI of a young connection is applied to the old connection
+	// of the same port and to the stats of the client and
+	// destination, but not to another port.
+	attributions := account(&mapSnapshot{
+		Connections: []rawEntry{connection(443, sni, 21), connection(443, "", 0), connection(8443, "", 0)},
+		Stats: []rawEntry{
+			statsEntry(t, ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1"}, sniStats{succeededConnections: 2}),
+		},
+	})
+	assert(t, attributions, map[string][2]float64{sni: {3, 0}, UnknownSNI: {0, 1}})
+
+	// The stats are only attributed while all the ports agree.
+	attributions = account(&mapSnapshot{
+		Connections: []rawEntry{connection(8443, "other.example.com", 21)},
+		Stats: []rawEntry{
+			statsEntry(t, ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1"}, sniStats{succeededConnections: 2}),
+		},
+	})
+	assert(t, attributions, map[string][2]float64{UnknownSNI: {0, 2}})
+
+	// The SNIs expire after the TTL.
+	clk.Advance(2 * time.Minute)
+	state.deleteExpiredSNIs(clk.Now())
+	assert(t, len(state.identities), 0)
+	attributions = account(&mapSnapshot{Connections: []rawEntry{connection(443, "", 0)}})
+	assert(t, attributions, map[string][2]float64{UnknownSNI: {0, 1}})
+
+	// Without a TTL, nothing is cached.
+	state = newState(nil, clk)
+	attributions = account(&mapSnapshot{Connections: []rawEntry{connection(443, sni, 21), connection(443, "", 0)}})
+	assert(t, attributions, map[string][2]float64{UnknownSNI: {0, 1}})
+	assert(t, len(state.identities), 0)
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// interceptionCounts mirrors struct interception_t, the signatures of
+// interception of an SNI.
+type interceptionCounts struct {
+	SplitHandshakes      uint64
+	ClientHellosAfterRST uint64
+}
+
+// readInterceptions exports the connections with a signature of an SNI
+// proxy or TLS interception per SNI since the last read. The kernel
+// counters are cumulative, last holds their previous values per SNI.
+func (s *NetworkDataSource) readInterceptions(last map[string]interceptionCounts) error {
+	var sni [C.TLS_MAX_SERVER_NAME_LEN]byte
+	var counts interceptionCounts
+	current := make(map[string]interceptionCounts)
+	entries := s.ebpfConfig.interceptionsMap.Iterate()
+	for entries.Next(&sni, &counts) {
+		current[sniFromC(sni[:])] = counts
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for sni, delta := range interceptionDeltas(last, current) {
+		sni = normalizeSNI(s.normalizer, sni)
+		if delta.SplitHandshakes > 0 {
+			metrics.AddSuspectedInterceptions(sni, "split_handshake", float64(delta.SplitHandshakes))
+		}
+		if delta.ClientHellosAfterRST > 0 {
+			metrics.AddSuspectedInterceptions(sni, "client_hello_after_rst", float64(delta.ClientHellosAfterRST))
+		}
+	}
+	return nil
+}
+
+// interceptionDeltas returns the increase of the counters per SNI and
+// replaces the last counters with the current ones. Evicted SNIs start
+// from zero again.
+func interceptionDeltas(last, current map[string]interceptionCounts) map[string]interceptionCounts {
+	deltas := make(map[string]interceptionCounts)
+	for sni, counts := range current {
+		previous := last[sni]
+		delta := interceptionCounts{
+			SplitHandshakes:      counterDelta(previous.SplitHandshakes, counts.SplitHandshakes),
+			ClientHellosAfterRST: counterDelta(previous.ClientHellosAfterRST, counts.ClientHellosAfterRST),
+		}
+		if delta != (interceptionCounts{}) {
+			deltas[sni] = delta
+		}
+	}
+	for sni := range last {
+		if _, ok := current[sni]; !ok {
+			delete(last, sni)
+		}
+	}
+	for sni, counts := range current {
+		last[sni] = counts
+	}
+	return deltas
+}
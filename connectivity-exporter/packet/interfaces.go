@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"strconv"
+
+	"m/metrics"
+)
+
+// interfaceCounts mirrors struct interface_counters_t, the packets seen
+// on a network interface.
+type interfaceCounts struct {
+	Packets uint64
+	Matched uint64
+	Bytes   uint64
+}
+
+// readInterfaceCounts exports the packets seen, the packets matched by
+// the CIDRs and ports and the bytes inspected per network interface
+// since the last read. The kernel counters are cumulative and per CPU,
+// last holds their previous sums per interface index.
+func (s *NetworkDataSource) readInterfaceCounts(last map[uint32]interfaceCounts) error {
+	var ifindex uint32
+	var perCPU []interfaceCounts
+	current := make(map[uint32]interfaceCounts)
+	entries := s.ebpfConfig.interfacePacketsMap.Iterate()
+	for entries.Next(&ifindex, &perCPU) {
+		var sum interfaceCounts
+		for _, counts := range perCPU {
+			sum.Packets += counts.Packets
+			sum.Matched += counts.Matched
+			sum.Bytes += counts.Bytes
+		}
+		current[ifindex] = sum
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for ifindex, delta := range interfaceDeltas(last, current) {
+		name := interfaceName(ifindex)
+		// Zero increases are added as well, so the series of an
+		// interface without packets exist.
+		metrics.AddInterfacePackets(name, "seen", float64(delta.Packets))
+		metrics.AddInterfacePackets(name, "matched", float64(delta.Matched))
+		metrics.AddInterfaceBytes(name, float64(delta.Bytes))
+	}
+	return nil
+}
+
+// interfaceDeltas returns the increase of the counters per interface
+// index and replaces the last counters with the current ones. Unlike
+// the deltas of the other counters, unchanged interfaces are returned
+// with a zero delta.
+func interfaceDeltas(last, current map[uint32]interfaceCounts) map[uint32]interfaceCounts {
+	deltas := make(map[uint32]interfaceCounts, len(current))
+	for ifindex, counts := range current {
+		previous := last[ifindex]
+		deltas[ifindex] = interfaceCounts{
+			Packets: counterDelta(previous.Packets, counts.Packets),
+			Matched: counterDelta(previous.Matched, counts.Matched),
+			Bytes:   counterDelta(previous.Bytes, counts.Bytes),
+		}
+	}
+	for ifindex := range last {
+		if _, ok := current[ifindex]; !ok {
+			delete(last, ifindex)
+		}
+	}
+	for ifindex, counts := range current {
+		last[ifindex] = counts
+	}
+	return deltas
+}
+
+// interfaceName returns the name of the interface, or its index if it
+// is gone.
+func interfaceName(ifindex uint32) string {
+	if iface, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+		return iface.Name
+	}
+	return strconv.FormatUint(uint64(ifindex), 10)
+}
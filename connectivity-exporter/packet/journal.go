@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+// journalWindow is a line of the accounting journal: the inputs and the
+// outputs of the accounting of one window.
+type journalWindow struct {
+	Time        time.Time       `json:"time"`
+	TickerClock uint64          `json:"tickerClock"`
+	Keys        []journalRecord `json:"keys"`
+}
+
+// journalRecord is the accounting of a connection key in a window.
+type journalRecord struct {
+	SNI      string `json:"sni"`
+	SourceIP string `json:"sourceIP,omitempty"`
+	DestIP   string `json:"destIP,omitempty"`
+	// PreviousFailed is the failed second carried over from the
+	// previous window, Inactive is set if the key had neither
+	// connections nor stats and was only accounted for the carry-over
+	// or the seconds policy.
+	PreviousFailed bool                `json:"previousFailed,omitempty"`
+	Inactive       bool                `json:"inactive,omitempty"`
+	Connections    []journalConnection `json:"connections,omitempty"`
+	Stats          *journalStats       `json:"stats,omitempty"`
+	FailedSecond   bool                `json:"failedSecond,omitempty"`
+	// Inc holds the non-zero fields of the emitted increment.
+	Inc map[string]interface{} `json:"inc"`
+}
+
+// journalConnection is a stale connection of a key.
+type journalConnection struct {
+	State                  string `json:"state"`
+	TickerClockFirstPacket uint64 `json:"tickerClockFirstPacket"`
+	ServerHelloSeen        bool   `json:"serverHelloSeen,omitempty"`
+	HandshakeFinished      bool   `json:"handshakeFinished,omitempty"`
+	ClientAppDataRecords   uint32 `json:"clientAppDataRecords,omitempty"`
+	Transitions            uint32 `json:"transitions,omitempty"`
+}
+
+// journalStats are the stats of a key in a window.
+type journalStats struct {
+	Succeeded           uint64 `json:"succeeded,omitempty"`
+	Failed              uint64 `json:"failed,omitempty"`
+	MiddleboxResets     uint64 `json:"middleboxResets,omitempty"`
+	NetworkRejections   uint64 `json:"networkRejections,omitempty"`
+	HandshakesAbandoned uint64 `json:"handshakesAbandoned,omitempty"`
+	HandshakesOnly      uint64 `json:"handshakesOnly,omitempty"`
+	HandshakesFailed    uint64 `json:"handshakesFailed,omitempty"`
+	EstablishedResets   uint64 `json:"establishedResets,omitempty"`
+}
+
+func newJournalRecord(connKey ConnKey, previousFailed, inactive bool, stale []*tupleData, stats sniStats, inc *metrics.Inc, failedSecond bool) journalRecord {
+	r := journalRecord{
+		SNI:            connKey.sni,
+		SourceIP:       connKey.sourceIP,
+		DestIP:         connKey.destIP,
+		PreviousFailed: previousFailed,
+		Inactive:       inactive,
+		FailedSecond:   failedSecond,
+		Inc:            nonZeroFields(inc),
+	}
+	for _, td := range stale {
+		r.Connections = append(r.Connections, journalConnection{
+			State:                  td.state.String(),
+			TickerClockFirstPacket: td.tickerClockFirstPacket,
+			ServerHelloSeen:        td.serverHelloSeen,
+			HandshakeFinished:      td.handshakeFinished,
+			ClientAppDataRecords:   td.clientAppDataRecords,
+			Transitions:            td.transitions,
+		})
+	}
+	s := journalStats{
+		Succeeded:           stats.succeededConnections,
+		Failed:              stats.failedConnections,
+		MiddleboxResets:     stats.middleboxResets,
+		NetworkRejections:   stats.networkRejections(),
+		HandshakesAbandoned: stats.handshakesAbandoned,
+		HandshakesOnly:      stats.handshakesOnly,
+		HandshakesFailed:    stats.handshakesFailed,
+		EstablishedResets:   stats.establishedResets,
+	}
+	if s != (journalStats{}) {
+		r.Stats = &s
+	}
+	return r
+}
+
+// nonZeroFields returns the exported fields of the struct the pointer
+// points to which are not zero, keyed by their names.
+func nonZeroFields(v interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" || value.Field(i).IsZero() {
+			continue
+		}
+		fields[field.Name] = value.Field(i).Interface()
+	}
+	return fields
+}
+
+// accountingJournal appends the accounting of every window as JSON
+// lines to a file. The file is rotated once it covers the retention, so
+// the journal and its previous file, with the suffix ".1", cover at
+// least the retention.
+type accountingJournal struct {
+	filename  string
+	retention time.Duration
+	file      *os.File
+	encoder   *json.Encoder
+	// started is the time of the first window in the file.
+	started time.Time
+	// window collects the records of the window being accounted.
+	window []journalRecord
+}
+
+func newAccountingJournal(filename string, retention time.Duration) (*accountingJournal, error) {
+	j := &accountingJournal{filename: filename, retention: retention}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *accountingJournal) open() error {
+	file, err := os.OpenFile(j.filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening accounting journal: %w", err)
+	}
+	j.file = file
+	j.encoder = json.NewEncoder(file)
+	j.started = time.Time{}
+	return nil
+}
+
+// add adds the record to the window being accounted.
+func (j *accountingJournal) add(r journalRecord) {
+	j.window = append(j.window, r)
+}
+
+// flush writes the records of the accounted window.
+func (j *accountingJournal) flush(now time.Time, tickerClock uint64) {
+	keys := j.window
+	j.window = nil
+	if j.file == nil {
+		return
+	}
+	if !j.started.IsZero() && now.Sub(j.started) >= j.retention {
+		if err := j.rotate(); err != nil {
+			klog.Errorf("Failed to rotate the accounting journal: %v", err)
+			return
+		}
+	}
+	if j.started.IsZero() {
+		j.started = now
+	}
+	if err := j.encoder.Encode(journalWindow{Time: now, TickerClock: tickerClock, Keys: keys}); err != nil {
+		klog.Errorf("Failed to write the accounting journal: %v", err)
+	}
+}
+
+func (j *accountingJournal) rotate() error {
+	j.Close()
+	if err := os.Rename(j.filename, j.filename+".1"); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+func (j *accountingJournal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// JournalAccounting writes the inputs and outputs of the accounting of
+// every window to the file, so the accounting of a second can be
+// explained afterwards. The file and its previous file cover at least
+// the retention.
+func (s *NetworkDataSource) JournalAccounting(filename string, retention time.Duration) error {
+	if retention <= 0 {
+		return fmt.Errorf("invalid accounting journal retention %s, expected a positive duration", retention)
+	}
+	journal, err := newAccountingJournal(filename, retention)
+	if err != nil {
+		return err
+	}
+	s.journal = journal
+	return nil
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readJournal(t *testing.T, filename string) []journalWindow {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var windows []journalWindow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var w journalWindow
+		if err := json.Unmarshal(scanner.Bytes(), &w); err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func TestAccountingJournal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "journal")
+	journal, err := newAccountingJournal(filename, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	state := newState(nil, nil)
+	state.journal = journal
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	window{clientA: {{state: RST_SENT_BY_SERVER, tickerClockFirstPacket: 3}}}.account(state)
+	journal.flush(start, 24)
+	// The failure is carried over.
+	window{}.account(state)
+	journal.flush(start.Add(time.Second), 25)
+
+	windows := readJournal(t, filename)
+	if len(windows) != 2 {
+		t.Fatalf("got %d windows, want 2", len(windows))
+	}
+	failed := windows[0].Keys
+	assert(t, len(failed), 1)
+	assert(t, failed[0].SNI, "api.example.com")
+	assert(t, failed[0].Connections, []journalConnection{{State: "rst_sent_by_server", TickerClockFirstPacket: 3}})
+	assert(t, failed[0].FailedSecond, true)
+	assert(t, failed[0].Inc["FailedSeconds"], 1.0)
+	assert(t, failed[0].Inc["RejectedConnections"], 1.0)
+	carried := windows[1].Keys
+	assert(t, len(carried), 1)
+	assert(t, carried[0].Inactive, true)
+	assert(t, carried[0].PreviousFailed, true)
+	assert(t, carried[0].Inc["FailedSeconds"], 1.0)
+
+	// The journal is rotated once it covers the retention.
+	journal.flush(start.Add(time.Minute), 84)
+	assert(t, len(readJournal(t, filename)), 1)
+	assert(t, len(readJournal(t, filename+".1")), 2)
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+
+	"m/metrics"
+)
+
+// readEntries reads all entries of a hash map with the given name, which the eBPF program
+// updates concurrently. Iterating the map key by key restarts from the
+// first key when the previous key is deleted in the meantime, so an
+// iteration can see entries twice or miss entries. A batched lookup of
+// the size of the map instead walks the buckets of the map once in a
+// single syscall, which sees every entry present during the whole
+// read exactly once. Kernels without batch operations (before 5.6)
+// fall back to iterating, and the entries seen twice are dropped and
+// counted.
+func readEntries(name string, m *ebpf.Map) ([]rawEntry, error) {
+	entries, err := batchLookupEntries(m)
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		entries, err = iterateEntries(m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, duplicates := dropDuplicateEntries(entries)
+	if duplicates > 0 {
+		metrics.AddMapReadDuplicates(name, float64(duplicates))
+	}
+	return entries, nil
+}
+
+func batchLookupEntries(m *ebpf.Map) ([]rawEntry, error) {
+	keySize, valueSize, count := int(m.KeySize()), int(m.ValueSize()), int(m.MaxEntries())
+	keys := reflect.MakeSlice(reflect.SliceOf(reflect.ArrayOf(keySize, reflect.TypeOf(byte(0)))), count, count)
+	values := reflect.MakeSlice(reflect.SliceOf(reflect.ArrayOf(valueSize, reflect.TypeOf(byte(0)))), count, count)
+	// The cursor of a hash map is the index of the next bucket, which
+	// the kernel writes into a buffer of the key size.
+	var prev interface{}
+	var entries []rawEntry
+	for {
+		next := make([]byte, keySize)
+		n, err := m.BatchLookup(prev, &next, keys.Interface(), values.Interface(), nil)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			entries = append(entries, rawEntry{
+				Key:   copyBytes(keys.Index(i).Slice(0, keySize).Bytes()),
+				Value: copyBytes(values.Index(i).Slice(0, valueSize).Bytes()),
+			})
+		}
+		if err != nil || n == 0 {
+			return entries, nil
+		}
+		prev = next
+	}
+}
+
+func iterateEntries(m *ebpf.Map) ([]rawEntry, error) {
+	var entries []rawEntry
+	var key, value []byte
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		entries = append(entries, rawEntry{Key: copyBytes(key), Value: copyBytes(value)})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterating: %w", err)
+	}
+	return entries, nil
+}
+
+// dropDuplicateEntries keeps the last value read of every key.
+func dropDuplicateEntries(entries []rawEntry) ([]rawEntry, int) {
+	index := make(map[string]int, len(entries))
+	out := entries[:0]
+	for _, e := range entries {
+		if i, ok := index[string(e.Key)]; ok {
+			out[i] = e
+			continue
+		}
+		index[string(e.Key)] = len(out)
+		out = append(out, e)
+	}
+	return out, len(entries) - len(out)
+}
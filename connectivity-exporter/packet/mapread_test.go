@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestReadEntriesUnderChurn(t *testing.T) {
+	const stable, churning = 256, 512
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 8, ValueSize: 16, MaxEntries: stable + churning})
+	if err != nil {
+		t.Fatalf("creating map: %v", err)
+	}
+	defer m.Close()
+	value := make([]byte, 16)
+	for i := uint64(0); i < stable; i++ {
+		if err := m.Put(i, value); err != nil {
+			t.Fatalf("putting key %d: %v", i, err)
+		}
+	}
+
+	// A traffic generator adds and removes connections, and updates
+	// the stable ones.
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v := make([]byte, 16)
+		for n := uint64(0); ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := stable + n%churning
+			binary.LittleEndian.PutUint64(v, n)
+			_ = m.Put(k, v)
+			_ = m.Put(n%stable, v)
+			_ = m.Delete(stable + (n+churning/2)%churning)
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 200; i++ {
+		entries, err := readEntries("test", m)
+		if err != nil {
+			t.Fatalf("reading entries: %v", err)
+		}
+		seen := make(map[uint64]int)
+		for _, e := range entries {
+			seen[binary.LittleEndian.Uint64(e.Key)]++
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Fatalf("Key %d read %d times", k, n)
+			}
+		}
+		for k := uint64(0); k < stable; k++ {
+			if seen[k] != 1 {
+				t.Fatalf("Read %d: missed stable key %d", i, k)
+			}
+		}
+	}
+}
+
+func TestDropDuplicateEntries(t *testing.T) {
+	entries, duplicates := dropDuplicateEntries([]rawEntry{
+		{Key: []byte{1}, Value: []byte{1}},
+		{Key: []byte{2}, Value: []byte{1}},
+		{Key: []byte{1}, Value: []byte{2}},
+	})
+	assert(t, duplicates, 1)
+	assert(t, entries, []rawEntry{{Key: []byte{1}, Value: []byte{2}}, {Key: []byte{2}, Value: []byte{1}}})
+}
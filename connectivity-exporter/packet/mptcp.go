@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"crypto/sha256"
+
+	"m/metrics"
+)
+
+// mptcpSubflowCounts mirrors struct mptcp_subflows_t.
+type mptcpSubflowCounts struct {
+	Joined uint64
+	Failed uint64
+}
+
+// mptcpToken is the token of an MPTCP connection as on the wire.
+type mptcpToken [4]byte
+
+// mptcpTokenOf returns the token of an MPTCP connection, which the
+// MP_JOIN of its subflows carries: the most significant 32 bits of the
+// SHA-256 of the key of the server as on the wire (RFC 8684).
+func mptcpTokenOf(key [8]byte) mptcpToken {
+	sum := sha256.Sum256(key[:])
+	var token mptcpToken
+	copy(token[:], sum[:4])
+	return token
+}
+
+// readMPTCPSubflows exports the subflows joining the MPTCP connections
+// per SNI since the last read. The subflows are attributed to the SNI
+// of the MPTCP connection of their token, a subflow of an unknown
+// connection, e.g. evicted or without an SNI, to the empty SNI. The
+// kernel counters are cumulative, last holds their previous values.
+func (s *NetworkDataSource) readMPTCPSubflows(last map[mptcpToken]mptcpSubflowCounts) error {
+	var key [8]byte
+	var statsKey []byte
+	snis := make(map[mptcpToken]string)
+	connections := s.ebpfConfig.mptcpConnectionsMap.Iterate()
+	for connections.Next(&key, &statsKey) {
+		ck, err := statsKeyFromBytes(statsKey)
+		if err != nil {
+			return err
+		}
+		snis[mptcpTokenOf(key)] = ck.sni
+	}
+	if err := connections.Err(); err != nil {
+		return err
+	}
+
+	var token mptcpToken
+	var counts mptcpSubflowCounts
+	current := make(map[mptcpToken]mptcpSubflowCounts)
+	subflows := s.ebpfConfig.mptcpSubflowsMap.Iterate()
+	for subflows.Next(&token, &counts) {
+		current[token] = counts
+	}
+	if err := subflows.Err(); err != nil {
+		return err
+	}
+	for token, delta := range mptcpSubflowDeltas(last, current) {
+		sni := normalizeSNI(s.normalizer, snis[token])
+		if delta.Joined > 0 {
+			metrics.AddMPTCPSubflows(sni, "joined", float64(delta.Joined))
+		}
+		if delta.Failed > 0 {
+			metrics.AddMPTCPSubflows(sni, "failed", float64(delta.Failed))
+		}
+	}
+	return nil
+}
+
+// mptcpSubflowDeltas returns the increase of the counters and replaces
+// the last counters with the current ones. Evicted entries start from
+// zero again.
+func mptcpSubflowDeltas(last, current map[mptcpToken]mptcpSubflowCounts) map[mptcpToken]mptcpSubflowCounts {
+	deltas := make(map[mptcpToken]mptcpSubflowCounts)
+	for token, counts := range current {
+		previous := last[token]
+		delta := mptcpSubflowCounts{
+			Joined: counterDelta(previous.Joined, counts.Joined),
+			Failed: counterDelta(previous.Failed, counts.Failed),
+		}
+		if delta.Joined > 0 || delta.Failed > 0 {
+			deltas[token] = delta
+		}
+	}
+	for token := range last {
+		if _, ok := current[token]; !ok {
+			delete(last, token)
+		}
+	}
+	for token, counts := range current {
+		last[token] = counts
+	}
+	return deltas
+}
@@ -0,0 +1,28 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+// SNINormalizer maps the SNIs to the names they are accounted for, see
+// the normalization package.
+type SNINormalizer interface {
+	Normalize(sni string) string
+}
+
+// NormalizeSNIs accounts the connections and the counters of the eBPF
+// maps for the normalized SNIs. The SNIs are normalized before the
+// rules of the configuration are matched, so the rules apply to the
+// normalized names.
+func (s *NetworkDataSource) NormalizeSNIs(normalizer SNINormalizer) {
+	s.normalizer = normalizer
+}
+
+// normalizeSNI returns the normalized SNI. Connections without an SNI
+// stay without one.
+func normalizeSNI(normalizer SNINormalizer, sni string) string {
+	if normalizer == nil || sni == "" {
+		return sni
+	}
+	return normalizer.Normalize(sni)
+}
@@ -7,17 +7,20 @@ package packet
 import (
 	"context"
 	"fmt"
+	"io"
 	"m/metrics"
 	"net"
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
 	"encoding/binary"
-	"github.com/cilium/ebpf"
 	"k8s.io/klog/v2"
 
+	"m/clock"
+	"m/config"
+	"m/events"
+	"m/fatal"
 	"m/promextra"
 )
 
@@ -25,27 +28,232 @@ import (
 import "C"
 
 type NetworkDataSource struct {
-	cidrs      map[string]struct{}
-	ports      map[string]struct{}
+	networkInterface string
+	cidrs            map[string]struct{}
+	ports            map[string]struct{}
+	// mutex guards the eBPF resources, which are swapped by
+	// TrackConnections on a reload.
+	mutex      sync.RWMutex
 	ebpfConfig *ebpfConfig
 	attachment *ebpfAttachment
+	config     *config.Store
+	source     snapshotSource
+	recorder   *snapshotRecorder
+	journal    *accountingJournal
+	backends   ServiceBackends
+	normalizer SNINormalizer
+	// reloads are handled by TrackConnections between two windows.
+	reloads chan *reloadRequest
+	// draining are the sources of the previous programs, which are
+	// read until all their connections are accounted.
+	draining []*drainingSource
+	// canaries start and stop the canary, which is accounted by
+	// TrackConnections next to the current source.
+	canaries chan *canaryRequest
+	canary   *canary
+	// probes run the frames of a probe through the current program,
+	// see Probe. probe is the running one and probeSources are the
+	// source IPs of all probes so far, whose increments are withheld.
+	probes       chan *probeRequest
+	probe        *probeRequest
+	probeSources map[string]struct{}
+	// secondary is the attachment of the secondary filter, see
+	// AttachSecondary.
+	secondary *secondary
+	// forward, maxSNILength, noSNIPrefix, resolution, span, tunnels,
+	// proxySourceIP, observePartialMatches and deferHandshakeOnly are
+	// kept across reloads.
+	forward               forwardConfig
+	maxSNILength          uint32
+	noSNIPrefix           string
+	resolution            time.Duration
+	span                  bool
+	tunnels               tunnelPorts
+	proxySourceIP         bool
+	observePartialMatches bool
+	deferHandshakeOnly    bool
+	// rttCgroup and rtt are set by SampleRTT, the former is kept
+	// across reloads.
+	rttCgroup string
+	rtt       *rttTracker
+	// udpResponseTimeout 0 is DefaultUDPResponseTimeout.
+	udpResponseTimeout time.Duration
+	// quarantineDir is the directory of the map snapshots of the
+	// windows whose accounting panicked.
+	quarantineDir string
+	// quarantined is the number of snapshots dumped so far.
+	quarantined int
+}
+
+// setupOptions configure the eBPF program beyond its filter. They are
+// kept across reloads.
+type setupOptions struct {
+	forward forwardConfig
+	// maxSNILength 0 is the size of the SNI buffers.
+	maxSNILength uint32
+	// noSNIPrefix is the prefix of the pseudo SNI of the connections
+	// without an SNI, empty if they are not accounted for it.
+	noSNIPrefix string
+	// slots 0 are the slots of the default resolution.
+	slots uint64
+	// span captures mirrored traffic.
+	span bool
+	// tunnels are decapsulated.
+	tunnels tunnelPorts
+	// proxySourceIP accounts the connections for the original clients
+	// of their PROXY protocol headers.
+	proxySourceIP bool
+	// observePartialMatches counts the partial matches per server.
+	observePartialMatches bool
+	// deferHandshakeOnly counts open TLS connections as succeeded
+	// only once the client sent application data, see
+	// syncHandshakeOnly.
+	deferHandshakeOnly bool
+	// rttCgroup is the cgroup the sock_ops program sampling the RTT
+	// is attached to, empty if it is not.
+	rttCgroup string
+}
+
+// setupOptions returns the options of the running program. The caller
+// holds the mutex.
+func (s *NetworkDataSource) setupOptions() setupOptions {
+	return setupOptions{forward: s.forward, maxSNILength: s.maxSNILength, noSNIPrefix: s.noSNIPrefix, slots: statsSlots(s.resolution), span: s.span, tunnels: s.tunnels, proxySourceIP: s.proxySourceIP, observePartialMatches: s.observePartialMatches, deferHandshakeOnly: s.deferHandshakeOnly, rttCgroup: s.rttCgroup}
 }
 
 type State struct {
-	snis map[string]time.Time
+	snis   map[string]time.Time
+	config *config.Store
+	clock  clock.Clock
+	// carryOver keeps track of the failed seconds between windows in
+	// order to carry over failed seconds during inactive seconds.
+	carryOver map[carryOverKey]*carriedFailure
+	// unknownSNIs is the number of connections without an SNI, to
+	// sample their log messages.
+	unknownSNIs uint64
+	// identities are the SNIs of the clients and destinations, for
+	// their connections without an SNI.
+	identities identityCache
+	// classifiers are the registered classifiers when the state was
+	// created.
+	classifiers []Classifier
+	// quiet does not export the diagnostics of the accounting, for
+	// the state of a canary, which sees the same packets.
+	quiet bool
+	// window is the width of the windows and slots the number of
+	// windows a connection stays in the connections map before it is
+	// accounted.
+	window time.Duration
+	slots  uint64
+	// journal records the accounting of the windows if it is set.
+	journal *accountingJournal
+	// openKeys are the connection keys with an open connection in the
+	// last snapshot, only collected while a rule has a minimum
+	// throughput.
+	openKeys map[ConnKey]struct{}
+	// backends resolves the connections to the Services if it is set,
+	// backendSeries are the backends with failures and the time of
+	// their last update.
+	backends      ServiceBackends
+	backendSeries map[backendKey]time.Time
+	// normalizer normalizes the SNIs of the connection keys if it is
+	// set.
+	normalizer SNINormalizer
+	// noSNIPrefix is the prefix of the pseudo SNI of the connections
+	// without an SNI, see SetNoSNIPrefix.
+	noSNIPrefix string
 }
 
 type ConnKey struct {
 	sourceIP, destIP string
-	sni string
+	sni              string
 }
 
 // NewNetworkDataSource creates a new network data source based on
 // eBPF that loads the socket filtering program on the given network
 // interface and sets the program according to the given CIDRs and
-// ports.
-func NewNetworkDataSource(networkInterface string, cidrs, ports map[string]struct{}) (*NetworkDataSource, error) {
-	ec, err := newEBPFConfig()
+// ports. The accounting of the connections follows the configuration
+// in the store.
+func NewNetworkDataSource(networkInterface string, cidrs, ports map[string]struct{}, store *config.Store) (*NetworkDataSource, error) {
+	return newNetworkDataSource(networkInterface, cidrs, ports, store, false)
+}
+
+// NewSpanDataSource creates a network data source for mirrored traffic
+// (SPAN) on a dedicated capture interface, e.g. of a central tap box.
+// The interface is put into promiscuous mode and the peers of the
+// connections are not assumed to be local.
+func NewSpanDataSource(networkInterface string, cidrs, ports map[string]struct{}, store *config.Store) (*NetworkDataSource, error) {
+	return newNetworkDataSource(networkInterface, cidrs, ports, store, true)
+}
+
+func newNetworkDataSource(networkInterface string, cidrs, ports map[string]struct{}, store *config.Store, span bool) (*NetworkDataSource, error) {
+	deferHandshakeOnly := store != nil && store.Get().DetectsAnyHandshakeOnly()
+	ec, attachment, err := newEBPFSetup(networkInterface, cidrs, ports, setupOptions{span: span, deferHandshakeOnly: deferHandshakeOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &NetworkDataSource{
+		networkInterface:   networkInterface,
+		cidrs:              cidrs,
+		ports:              ports,
+		ebpfConfig:         ec,
+		attachment:         attachment,
+		config:             store,
+		source:             &ebpfSource{config: ec},
+		reloads:            make(chan *reloadRequest),
+		canaries:           make(chan *canaryRequest),
+		probes:             make(chan *probeRequest),
+		span:               span,
+		deferHandshakeOnly: deferHandshakeOnly,
+	}
+
+	return s, nil
+}
+
+// newEBPFSetup loads the eBPF program, initializes its maps and
+// attaches it to the network interface. The errors are SetupErrors.
+func newEBPFSetup(networkInterface string, cidrs, ports map[string]struct{}, opts setupOptions) (*ebpfConfig, *ebpfAttachment, error) {
+	ec, err := newEBPFProgram(networkInterface, cidrs, ports, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	attachment, err := attachEBPFProgram(ec, networkInterface, opts)
+	if err != nil {
+		ec.Close()
+		return nil, nil, err
+	}
+	return ec, attachment, nil
+}
+
+// newEBPFProgram loads the eBPF program and initializes its maps
+// without attaching it. The errors are SetupErrors.
+func newEBPFProgram(networkInterface string, cidrs, ports map[string]struct{}, opts setupOptions) (*ebpfConfig, error) {
+	ec, err := loadEBPF(networkInterface, cidrs, ports, opts)
+	if err != nil {
+		return nil, classifySetupError(err)
+	}
+	return ec, nil
+}
+
+// attachEBPFProgram attaches the loaded eBPF program to the network
+// interface. The errors are SetupErrors.
+func attachEBPFProgram(ec *ebpfConfig, networkInterface string, opts setupOptions) (*ebpfAttachment, error) {
+	attachment, err := attachEBPF(ec, networkInterface, opts)
+	if err != nil {
+		return nil, classifySetupError(err)
+	}
+	metrics.ClearBPFSetupError()
+	return attachment, nil
+}
+
+func loadEBPF(networkInterface string, cidrs, ports map[string]struct{}, opts setupOptions) (ec *ebpfConfig, err error) {
+	if networkInterface != "" {
+		if _, err := net.InterfaceByName(networkInterface); err != nil {
+			return nil, &SetupError{Kind: InterfaceNotFound, Err: err}
+		}
+	}
+
+	ec, err = newEBPFConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -55,33 +263,68 @@ func NewNetworkDataSource(networkInterface string, cidrs, ports map[string]struc
 		}
 	}()
 
-	if err := initCIDRMap(ec.cidrMap, cidrs); err != nil {
+	if err = initCIDRMap(ec.cidrMap, cidrs); err != nil {
 		return nil, fmt.Errorf("initializing CIDR map: %w", err)
 	}
-	if err := initPortMap(ec.portMap, ports); err != nil {
+	if err = initPortMap(ec.portMap, ports); err != nil {
 		return nil, fmt.Errorf("initializing port map: %w", err)
 	}
-	if err := initStatsMap(ec.statsMap); err != nil {
+	if err = initForwardMap(ec.forwardMap, opts.forward); err != nil {
+		return nil, fmt.Errorf("initializing forward map: %w", err)
+	}
+	if err = initCaptureMap(ec.captureMap, opts.capture()); err != nil {
+		return nil, fmt.Errorf("initializing capture map: %w", err)
+	}
+	if err = initSNIMap(ec.sniConfigMap, opts.maxSNILength, opts.noSNIPrefix); err != nil {
+		return nil, fmt.Errorf("initializing SNI map: %w", err)
+	}
+	if err = initStatsMap(ec, opts.slots); err != nil {
 		return nil, fmt.Errorf("initializing stats map: %w", err)
 	}
+	return ec, nil
+}
 
-	attachment, err := attachProgramToNetworkInterface(ec.prog, networkInterface)
+func attachEBPF(ec *ebpfConfig, networkInterface string, opts setupOptions) (*ebpfAttachment, error) {
+	attachment, err := attachProgramToNetworkInterface(ec.prog, networkInterface, opts.span)
 	if err != nil {
 		return nil, err
 	}
-
-	s := &NetworkDataSource{
-		cidrs:      cidrs,
-		ports:      ports,
-		ebpfConfig: ec,
-		attachment: attachment,
+	if opts.rttCgroup != "" {
+		if err := attachment.attachSockOps(ec, opts.rttCgroup); err != nil {
+			attachment.Close()
+			return nil, err
+		}
 	}
-
-	return s, nil
+	return attachment, nil
 }
 
 // Close cleans up the network data source.
 func (s *NetworkDataSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, d := range s.draining {
+		d.release()
+	}
+	s.draining = nil
+	if s.canary != nil {
+		s.canary.release()
+		s.canary = nil
+	}
+	if s.secondary != nil {
+		s.secondary.release()
+		s.secondary = nil
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+		s.recorder = nil
+	}
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	if c, ok := s.source.(io.Closer); ok {
+		c.Close()
+	}
 	if s.attachment != nil {
 		s.attachment.Close()
 		s.attachment = nil
@@ -93,16 +336,47 @@ func (s *NetworkDataSource) Close() error {
 	return nil
 }
 
+// OpenConnections counts the connections in the eBPF map by state. It
+// is called at scrape time, the connections of a replay are not
+// counted.
+func (s *NetworkDataSource) OpenConnections() (map[string]int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	counts := make(map[string]int)
+	if s.ebpfConfig == nil {
+		return counts, nil
+	}
+	connections, err := readEntries(BPF_CONNECTION_MAP_NAME, s.ebpfConfig.connectionMap)
+	if err != nil {
+		return counts, err
+	}
+	for _, e := range connections {
+		_, data, err := decodeConnection(e)
+		if err != nil {
+			return counts, err
+		}
+		counts[data.state.String()]++
+	}
+	return counts, nil
+}
+
 // TrackExecutionTime periodically reads the histogram snapshots from
-// the eBPF map and sends them over the channel.
+// the eBPF map and sends them over the channel, followed by the RTT
+// histograms if the RTT is sampled.
 func (s *NetworkDataSource) TrackExecutionTime(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time, snapshots chan<- promextra.Snapshot) {
 	defer wg.Done()
-	defer close(snapshots)
 	done := ctx.Done()
 	for {
 		select {
-		case <-ticks:
+		case now := <-ticks:
 			snapshots <- s.readHistogramSnapshot()
+			rtts, err := s.readRTTSnapshots(now)
+			if err != nil {
+				klog.Errorf("Failed to read the RTT histograms: %v", err)
+			}
+			for _, snapshot := range rtts {
+				snapshots <- snapshot
+			}
 		case <-done:
 			return
 		}
@@ -110,9 +384,11 @@ func (s *NetworkDataSource) TrackExecutionTime(ctx context.Context, wg *sync.Wai
 }
 
 func (s *NetworkDataSource) readHistogramSnapshot() promextra.Snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	snapshot, err := readSnapshotFromMap(s.ebpfConfig.histogramMap)
 	if err != nil {
-		klog.Fatalf("failed to read histogram snapshot from eBPF map: %v", err)
+		fatal.Exit(fatal.Runtime, "Failed to read the histogram snapshot from the eBPF map", err)
 	}
 	return snapshot
 }
@@ -131,236 +407,430 @@ func AsSet(list string) map[string]struct{} {
 // and updates the prometheus inc counters as per data received from the map.
 // It also tracks information from stats map and retrieves value of succecced and failed seconds.
 // Those values are updated as prometheus counters.
-func (s *NetworkDataSource) TrackConnections(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time, incs chan<- *metrics.Inc) {
+// If failures is not nil, a failure event is sent whenever an SNI starts failing. The events
+// are dropped if the channel is not ready, so they never delay the accounting.
+func (s *NetworkDataSource) TrackConnections(ctx context.Context, wg *sync.WaitGroup, ticks clock.TickSource, incs chan<- *metrics.Inc, failures chan<- *events.Failure) {
 	defer wg.Done()
-	state := newState()
-	var key C.struct_tuple_key_t
-	var val C.struct_tuple_data_t
+	defer ticks.Stop()
+	// The accounting of a window sees the time of its snapshot.
+	windowClock := clock.NewFake(time.Time{})
+	state := s.newTrackingState(windowClock)
 	var currentTickerClock uint64
-
-	// keep track of failed second between ticks for each SNI in order to
-	// carry over failed seconds during inactive seconds.
-	previousFailedSecond := map[ConnKey]bool{}
+	ttlAnomalies := make(map[string]uint64)
+	interceptions := make(map[string]interceptionCounts)
+	interfaces := make(map[uint32]interfaceCounts)
+	tlsParameterCounts := make(map[tlsParameters]uint64)
+	tlsAlertCounts := make(map[tlsAlert]uint64)
+	mptcpSubflowCounts := make(map[mptcpToken]mptcpSubflowCounts)
+	partialMatchCounts := make(map[partialMatchKey]uint64)
+	alpnCounts := make(map[alpn]uint64)
+	throughput := newThroughputTracker()
+	udpFlows := newUDPFlowTracker()
+	var lateWrites, sniTruncations uint64
 
 	done := ctx.Done()
 	for {
 		select {
-		case <-ticks:
-			// Set of encountered SNIs, in either of the 2 maps
-			sniSet := map[ConnKey]struct{}{}
-			// oldConnections are the connections that were initiated C.STATS_SECONDS_COUNT seconds ago
-			oldConnections := make(map[C.struct_tuple_key_t]*tupleData)
-			connections := s.ebpfConfig.connectionMap.Iterate()
-			for connections.Next(unsafe.Pointer(&key), unsafe.Pointer(&val)) {
-				data := tupleDataFromC(val)
-
-				// Entry will be only added if the connection is old.
-				if isConnectionOld(data.tickerClockFirstPacket, currentTickerClock) {
-					oldConnections[key] = data
-				}
+		case req := <-s.reloads:
+			req.done <- s.swapSource(req, currentTickerClock)
+		case req := <-s.canaries:
+			req.done <- s.swapCanary(req.canary, currentTickerClock)
+		case req := <-s.probes:
+			req.done <- s.runProbe(req)
+		case now := <-ticks.C():
+			snapshot, err := s.readSnapshot(currentTickerClock, now)
+			if err == io.EOF {
+				klog.Infof("Replayed all map snapshots")
+				return
 			}
-
-			if err := connections.Err(); err != nil {
-				klog.Errorf("reading connections from map: %v", err)
+			if err != nil {
+				klog.Errorf("reading map snapshot: %v", err)
 				continue
 			}
-
-			for k, t := range oldConnections {
-				if t.sni == "" {
-					klog.Errorf("Empty SNI\nDATA: %+v\n%+v", k, t)
-				}
-				// Delete old connections.
-				// We do not want to check error while deleting
-				_ = s.ebpfConfig.connectionMap.Delete(unsafe.Pointer(&k))
+			if s.recorder != nil {
+				s.recorder.record(snapshot)
 			}
+			windowClock.Set(snapshot.Time)
 
-			statsKey := (currentTickerClock + 1) % 20
-			statsValuesAtKey, err := getOldestStatsAndCleanup(s, statsKey)
+			windowIncs, windowFailures, oldKeys, quarantined, err := s.accountSafely(state, snapshot)
 			if err != nil {
-				klog.Errorf("getting stats from map: %v", err)
+				klog.Errorf("accounting map snapshot: %v", err)
 				continue
 			}
-
-			// Get the union of SNIs from both BPF maps. Some SNIs
-			// might be in connectionMap only, in statsMap only, or
-			// in both.
-			for k, v := range oldConnections {
-				sourceIP := net.IP{}
-				binary.LittleEndian.PutUint32(sourceIP, uint32(k.source_ip))
-				destIP := net.IP{}
-				binary.LittleEndian.PutUint32(destIP, uint32(k.dest_ip))
-				sniSet[ConnKey{sourceIP: sourceIP.String(), destIP: destIP.String(), sni: v.sni}] = struct{}{}
+			if quarantined {
+				state = s.resetState(state)
 			}
-			for k := range statsValuesAtKey {
-				sniSet[k] = struct{}{}
+			windowIncs, windowFailures = s.withholdProbes(windowIncs, windowFailures)
+			if s.journal != nil {
+				s.journal.flush(snapshot.Time, snapshot.TickerClock)
 			}
+			// Delete old connections.
+			s.source.deleteConnections(oldKeys)
+			s.drain(oldKeys)
 
-			staleConnections := make(map[ConnKey][]*tupleData)
-			for sni := range sniSet {
-				staleConnections[sni] = []*tupleData{}
+			if s.canary != nil {
+				s.accountCanary(windowIncs, currentTickerClock, now)
 			}
-
-			for k, v := range oldConnections {
-				sourceIP := net.IP{}
-				binary.LittleEndian.PutUint32(sourceIP, uint32(k.source_ip))
-				destIP := net.IP{}
-				binary.LittleEndian.PutUint32(destIP, uint32(k.dest_ip))
-				ck := ConnKey{sourceIP: sourceIP.String(), destIP: destIP.String(), sni: v.sni}
-				staleConnections[ck] = append(staleConnections[ck], v)
+			if s.secondary != nil {
+				s.accountSecondary(state, currentTickerClock, now)
 			}
-
-			for sni := range sniSet {
-				var succeeded_connections, failed_connections uint64
-				if completedConnections, ok := statsValuesAtKey[sni]; ok {
-					succeeded_connections = completedConnections[0]
-					failed_connections = completedConnections[1]
+			for _, inc := range windowIncs {
+				incs <- inc
+			}
+			if failures != nil {
+				for _, f := range windowFailures {
+					select {
+					case failures <- f:
+					default:
+						metrics.IncSinkItems("failure_events", "dropped")
+						klog.Warningf("Dropped failure event of SNI %q", f.SNI)
+					}
 				}
+			}
+
+			state.deleteExpiredSNIs(snapshot.Time)
 
-				if _, ok := previousFailedSecond[sni]; !ok {
-					previousFailedSecond[sni] = false
+			if s.ebpfConfig != nil {
+				if err := s.syncHandshakeOnly(state.config.Get()); err != nil {
+					klog.Errorf("updating capture map: %v", err)
+				}
+				if err := s.readTTLAnomalies(ttlAnomalies); err != nil {
+					klog.Errorf("reading TTL anomalies from map: %v", err)
+				}
+				if err := s.readLateWrites(&lateWrites); err != nil {
+					klog.Errorf("reading late writes from map: %v", err)
+				}
+				if err := s.readSNITruncations(&sniTruncations); err != nil {
+					klog.Errorf("reading SNI truncations from map: %v", err)
+				}
+				if err := s.readInterceptions(interceptions); err != nil {
+					klog.Errorf("reading interceptions from map: %v", err)
+				}
+				if err := s.readInterfaceCounts(interfaces); err != nil {
+					klog.Errorf("reading interface counters from map: %v", err)
+				}
+				if err := s.readTLSParameters(tlsParameterCounts); err != nil {
+					klog.Errorf("reading TLS parameters from map: %v", err)
+				}
+				if err := s.readTLSAlerts(tlsAlertCounts); err != nil {
+					klog.Errorf("reading TLS alerts from map: %v", err)
+				}
+				if err := s.readMPTCPSubflows(mptcpSubflowCounts); err != nil {
+					klog.Errorf("reading MPTCP subflows from map: %v", err)
+				}
+				if err := s.readPartialMatches(partialMatchCounts); err != nil {
+					klog.Errorf("reading partial matches from map: %v", err)
+				}
+				if err := s.readALPN(alpnCounts); err != nil {
+					klog.Errorf("reading ALPN from map: %v", err)
+				}
+				if err := s.readThroughput(throughput, state.config.Get(), state.openKeys, snapshot.Time); err != nil {
+					klog.Errorf("reading payload bytes from map: %v", err)
+				}
+				if err := s.readUDPFlows(udpFlows, currentTickerClock, snapshot.Time); err != nil {
+					klog.Errorf("reading UDP flows from map: %v", err)
 				}
-				inc, failedSecond := state.accountForConnections(sni, previousFailedSecond[sni], staleConnections[sni], succeeded_connections, failed_connections)
-				previousFailedSecond[sni] = failedSecond
-				incs <- inc
 			}
 
-			state.deleteExpiredSNIs(time.Now())
-
 			// Update the counter to new value.
-			currentTickerClock++
-			if err := s.ebpfConfig.tickerClockMap.Put(uint32(0), currentTickerClock); err != nil {
+			currentTickerClock = snapshot.TickerClock + 1
+			if err := s.source.setTickerClock(currentTickerClock); err != nil {
 				klog.Errorf("updating tickerClockMap: %v", err)
 				continue
 			}
+			if s.canary != nil {
+				if err := s.canary.source.setTickerClock(currentTickerClock); err != nil {
+					klog.Errorf("updating tickerClockMap of the canary: %v", err)
+				}
+			}
+			if s.secondary != nil {
+				if err := s.secondary.source.setTickerClock(currentTickerClock); err != nil {
+					klog.Errorf("updating tickerClockMap of the secondary filter: %v", err)
+				}
+			}
 		case <-done:
 			return
 		}
 	}
 }
 
+// newTrackingState returns the state of TrackConnections.
+func (s *NetworkDataSource) newTrackingState(clk clock.Clock) *State {
+	state := newState(s.config, clk)
+	state.setResolution(s.Resolution())
+	state.journal = s.journal
+	state.backends = s.backends
+	state.normalizer = s.normalizer
+	state.noSNIPrefix = s.noSNIPrefix
+	return state
+}
+
+// connKeyFromC creates the connection key of a connection in the
+// connections map.
+func connKeyFromC(key C.struct_tuple_key_t, sni string) ConnKey {
+	sourceIP := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(sourceIP, uint32(key.source_ip))
+	destIP := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(destIP, uint32(key.dest_ip))
+	return ConnKey{sourceIP: sourceIP.String(), destIP: destIP.String(), sni: sni}
+}
+
 func (s *State) deleteExpiredSNIs(now time.Time) {
 	for name, lastUpdate := range s.snis {
 		// Expire metrics if the last update is older than the metric expiration
 		if lastUpdate.Add(metrics.Expiration).Before(now) {
 			delete(s.snis, name)
-			metrics.DeleteMetrics(name)
+			if !s.quiet {
+				metrics.DeleteMetrics(name)
+			}
 		}
 	}
+	s.deleteExpiredCarryOvers(now)
+	s.identities.deleteExpired(now)
+	s.deleteExpiredBackends(now)
 }
 
-func newState() *State {
-	return &State{
-		snis: make(map[string]time.Time),
-	}
-}
-
-// getOldestStatsAndCleanup reads the stats map at the given index and cleans up the inner stats map at that index.
-// Returned variable out is a map of sni to:
-// - succeeded_connections := innerValue[0]
-// - failed_connections := innerValue[1]
-func getOldestStatsAndCleanup(s *NetworkDataSource, statsKey uint64) (out map[ConnKey][2]uint64, err error) {
-	var innerMap *ebpf.Map
-
-	if err := s.ebpfConfig.statsMap.Lookup(unsafe.Pointer(&statsKey), &innerMap); err != nil {
-		return nil, err
+func newState(store *config.Store, clk clock.Clock) *State {
+	if store == nil {
+		store = config.NewStore(nil)
 	}
-	var innerKey string
-	var innerValue [2]uint64
-	var innerKeysToBeDeleted []string
-	out = make(map[ConnKey][2]uint64)
-	innerEntries := innerMap.Iterate()
-	for innerEntries.Next(&innerKey, &innerValue) {
-		key := ConnKey{
-			sourceIP: net.IP(innerKey[0:4]).String(),
-			destIP: net.IP(innerKey[4:8]).String(),
-			sni: strings.SplitN(innerKey[8:], "\000", 2)[0],
-		}
-		klog.InfoS("getOldestStatsAndCleanup", "source", key.sourceIP, "dest", key.destIP, "sni", key.sni)
-		out[key] = innerValue
-		innerKeysToBeDeleted = append(innerKeysToBeDeleted, innerKey)
+	if clk == nil {
+		clk = clock.Real
 	}
-
-	for _, v := range innerKeysToBeDeleted {
-		// We do not want to check error while deleting
-		_ = innerMap.Delete(v)
+	s := &State{
+		snis:          make(map[string]time.Time),
+		config:        store,
+		clock:         clk,
+		carryOver:     make(map[carryOverKey]*carriedFailure),
+		identities:    make(identityCache),
+		classifiers:   registeredClassifiers(),
+		backendSeries: make(map[backendKey]time.Time),
 	}
-
-	if err := innerEntries.Err(); err != nil {
-		return nil, err
-	}
-
-	return out, nil
+	s.setResolution(DefaultResolution)
+	return s
 }
 
-// isConnectionOld checks whether the connection is older than 20 seconds.
-func isConnectionOld(tickerClockFirstPacket, current_ticker_clock uint64) bool {
-	return current_ticker_clock > C.STATS_SECONDS_COUNT+uint64(tickerClockFirstPacket)
+// AccountingDelay is the approximate time between a connection and
+// its accounting at the default resolution. The connections are only
+// accounted once they are older than C.STATS_SECONDS_COUNT seconds, so
+// late packets are still taken into account.
+const AccountingDelay = (C.STATS_SECONDS_COUNT + 1) * time.Second
+
+// isConnectionOld checks whether the connection is older than the
+// slots of the stats map.
+func isConnectionOld(tickerClockFirstPacket, current_ticker_clock, slots uint64) bool {
+	return current_ticker_clock > slots+uint64(tickerClockFirstPacket)
 }
 
 func (s *State) accountForConnections(
 	connKey ConnKey,
 	previousFailedSecond bool,
 	staleConnMapInfo []*tupleData,
-	succeeded_connections, failed_connections uint64,
+	stats sniStats,
 ) (i *metrics.Inc, failedSecond bool) {
 	if connKey.sourceIP == "" {
 		klog.Error("source IP is empty")
 	}
+	now := s.clock.Now()
 	if _, ok := s.snis[connKey.sni]; !ok {
-		s.snis[connKey.sni] = time.Now()
+		s.snis[connKey.sni] = now
 	}
-	inc := &metrics.Inc{SNI: connKey.sni, SourceIP: connKey.sourceIP, DestIP: connKey.destIP}
+	inc := &metrics.Inc{SNI: connKey.sni, SourceIP: connKey.sourceIP, DestIP: connKey.destIP, Time: now.Add(-accountingDelay(s.window))}
 
 	klog.V(2).Infof("sni: %s, connections: %d", connKey.sni, len(staleConnMapInfo))
+	// The seconds counters count the seconds of the window.
+	seconds := s.window.Seconds()
 	var activeSecond, activeFailedSecond bool
+	// failedConnections are the connections failing the second, see
+	// config.Rule.MinFailedConnections, the others the failed
+	// connections by cause, see config.Rule.AttributeFailures.
+	var failedConnections, serverFailures, clientFailures, networkFailures uint64
+	handshakesOnly := stats.handshakesOnly
 
 	for _, v := range staleConnMapInfo {
 		state := v.state
 		// TODO handle all the states
 		// note: TCP FIN state is ambiguous, rejection depends on who sent the RST packet
 		if state == SYN_RECEIVED || state == SYNACK_RECEIVED {
-			activeFailedSecond = true
+			failedConnections++
+			networkFailures++
 		}
 
-		if state == SNI_RECEIVED {
+		// A closed connection stays in the map if its stats slot was
+		// sealed.
+		if state == SNI_RECEIVED || state == FIN_RECEIVED {
 			inc.SuccessfulConnections++
 		}
 
+		// TCP works, but the TLS endpoint never answered.
+		if v.sni != "" && !v.serverHelloSeen && !v.httpHost && !v.sctp && !v.noSNI {
+			inc.HandshakesAbandoned++
+		}
+		v.latency.addTo(inc)
+		if v.handshakeOnly() {
+			handshakesOnly++
+		}
+		if v.handshakeFailed() {
+			inc.HandshakesFailed++
+		}
+		if v.establishedReset() {
+			inc.EstablishedResets++
+		}
+		if v.certificateRequested {
+			inc.CertificateRequests++
+			if v.handshakeFailed() {
+				inc.CertificateRequestFailures++
+			}
+		}
+
 		if state == RST_SENT_BY_SERVER {
-			activeFailedSecond = true
+			failedConnections++
+			serverFailures++
 			inc.RejectedConnections++
+			inc.AddRSTOrigin(rstOriginName(C.RST_ORIGIN_SERVER), 1)
 		}
 
 		if state == RST_SENT_BY_CLIENT {
+			clientFailures++
 			inc.RejectedConnectionsByClient++
+			inc.AddRSTOrigin(rstOriginName(C.RST_ORIGIN_CLIENT), 1)
+		}
+
+		// Neither of the peers rejected the connection, but the
+		// path to the server is broken.
+		if state == RST_SENT_BY_MIDDLEBOX {
+			failedConnections++
+			networkFailures++
+			inc.RejectedConnectionsByMiddlebox++
+			inc.AddRSTOrigin(rstOriginName(C.RST_ORIGIN_MIDDLEBOX), 1)
+		}
+
+		// The SYN did not reach the server, the network rejected it
+		// instead of letting it time out.
+		if state == ICMP_UNREACHABLE {
+			failedConnections++
+			networkFailures++
+			inc.AddICMPCode(icmpCodeName(v.icmpCode), 1)
+		}
+
+		if s.classify(v, inc) {
+			failedConnections++
 		}
 	}
 
-	inc.SuccessfulConnections += float64(succeeded_connections)
-	inc.RejectedConnections += float64(failed_connections)
+	accountTransitions(inc, stats.transitions, staleConnMapInfo)
 
-	if len(staleConnMapInfo) > 0 || succeeded_connections > 0 || failed_connections > 0 {
+	congestion := stats.congestion
+	for _, v := range staleConnMapInfo {
+		congestion.add(v.congestion)
+	}
+	inc.ECNRequested = float64(congestion.ecnRequested)
+	inc.ECNAccepted = float64(congestion.ecnAccepted)
+	inc.CongestionExperiencedPackets = float64(congestion.cePackets)
+	inc.ECEPackets = float64(congestion.ecePackets)
+	inc.CWRPackets = float64(congestion.cwrPackets)
+
+	inc.SuccessfulConnections += float64(stats.succeededConnections)
+	inc.RejectedConnections += float64(stats.failedConnections)
+	inc.RejectedConnectionsByMiddlebox += float64(stats.middleboxResets)
+	for origin, n := range stats.resets {
+		if n > 0 {
+			inc.AddRSTOrigin(rstOriginName(origin), float64(n))
+		}
+	}
+	for code, n := range stats.icmpUnreachable {
+		if n > 0 {
+			inc.AddICMPCode(icmpCodeName(uint8(code)), float64(n))
+		}
+	}
+	inc.HandshakesAbandoned += float64(stats.handshakesAbandoned)
+	inc.HandshakesFailed += float64(stats.handshakesFailed)
+	inc.EstablishedResets += float64(stats.establishedResets)
+	inc.CertificateRequests += float64(stats.certificateRequests)
+	inc.CertificateRequestFailures += float64(stats.certificateRequestFailures)
+	for _, l := range stats.latencies {
+		l.addTo(inc)
+	}
+
+	if len(staleConnMapInfo) > 0 || !stats.empty() {
 		activeSecond = true
 	}
-	if failed_connections > 0 {
+
+	cfg := s.config.Get()
+	if cfg.DetectsHandshakeOnly(connKey.sni) {
+		inc.DetectHandshakeOnly = true
+		inc.HandshakeOnlyConnections = float64(handshakesOnly)
+	}
+	policy := cfg.SecondsPolicyFor(connKey.sni)
+	if policy == config.SecondsActiveOnly {
+		previousFailedSecond = false
+	}
+	// No traffic is expected outside of the schedule, so an inactive
+	// second is neither failed nor missing data. The failure is kept
+	// to be carried over once the schedule resumes.
+	if !activeSecond && !cfg.ExpectsTraffic(connKey.sni, inc.Time) {
+		inc.ExpectedIdleSeconds += seconds
+		return inc, previousFailedSecond
+	}
+	failedConnections += uint64(stats.failedConnections) + uint64(stats.middleboxResets) + stats.networkRejections()
+	serverFailures += uint64(stats.failedConnections)
+	networkFailures += uint64(stats.middleboxResets) + stats.networkRejections()
+	minFailures := cfg.MinFailedConnectionsFor(connKey.sni)
+	if failedConnections > 0 && failedConnections >= minFailures {
 		activeFailedSecond = true
 	}
+	// The failures of the client do not fail the second, they are
+	// only accounted by cause.
+	if cfg.AttributesFailures(connKey.sni) {
+		inc.AttributeFailures = true
+		for _, c := range []struct {
+			failures uint64
+			seconds  *float64
+		}{
+			{serverFailures, &inc.ServerFailedSeconds},
+			{clientFailures, &inc.ClientFailedSeconds},
+			{networkFailures, &inc.NetworkFailedSeconds},
+		} {
+			if c.failures > 0 && c.failures >= minFailures {
+				*c.seconds = seconds
+			}
+		}
+	}
 
 	// the second failed if we carry the failure from before, or if there is a new failure
 	if (previousFailedSecond && !activeSecond) || activeFailedSecond {
 		failedSecond = true
 	}
+	if !activeSecond && policy == config.SecondsWallClockStrict {
+		failedSecond = true
+	}
+	if config.IsWallClock(policy) {
+		inc.WallClockSeconds += seconds
+		if !activeSecond && !failedSecond {
+			inc.UnknownSeconds += seconds
+		}
+	}
 
 	if activeFailedSecond {
-		inc.ActiveFailedSeconds++
+		inc.ActiveFailedSeconds += seconds
 	}
 
 	if activeSecond {
-		inc.ActiveSeconds++
+		inc.ActiveSeconds += seconds
 	}
 
 	if failedSecond {
-		inc.FailedSeconds++
+		inc.FailedSeconds += seconds
+	}
+
+	// Planned maintenance should not burn the error budget, so the
+	// failures are recorded separately. The carry-over is kept as
+	// is, a failure lasting past the window is still a failure.
+	if cfg.InMaintenance(connKey.sni, inc.Time) {
+		inc.SilencedSeconds = inc.FailedSeconds
+		inc.FailedSeconds = 0
+		inc.ActiveFailedSeconds = 0
+		inc.ServerFailedSeconds, inc.ClientFailedSeconds, inc.NetworkFailedSeconds = 0, 0, 0
 	}
 
 	return inc, failedSecond
@@ -5,9 +5,15 @@
 package packet
 
 import (
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"m/clock"
+	"m/config"
+	"m/metrics"
 )
 
 func TestFlag(t *testing.T) {
@@ -20,8 +26,498 @@ func TestFlag(t *testing.T) {
 		"[F] [F.] [S] [S.] [R] [R.] [P] [P.] [.] [.] [U] [.U] [E] [.E] [W] [.W]")
 }
 
+func TestMaintenanceSilencesFailures(t *testing.T) {
+	now := time.Now()
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{
+		SNI:                "*.example.com",
+		MaintenanceWindows: []config.Window{{Start: now.Add(-time.Minute), End: now.Add(time.Minute)}},
+	}}})
+	state := newState(store, nil)
+	failed := []*tupleData{{state: RST_SENT_BY_SERVER}}
+
+	inc, failedSecond := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, failed, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [3]float64{inc.FailedSeconds, inc.ActiveFailedSeconds, inc.SilencedSeconds}, [3]float64{0, 0, 1})
+
+	inc, failedSecond = state.accountForConnections(ConnKey{sni: "example.org"}, false, failed, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [3]float64{inc.FailedSeconds, inc.ActiveFailedSeconds, inc.SilencedSeconds}, [3]float64{1, 1, 0})
+}
+
+// TestMaintenanceWindowBoundary checks that the maintenance windows
+// apply to the accounted second, which lags behind the snapshot.
+func TestMaintenanceWindowBoundary(t *testing.T) {
+	start := time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{
+		SNI:                "api.example.com",
+		MaintenanceWindows: []config.Window{{Start: start, End: end}},
+	}}})
+	clk := clock.NewFake(start)
+	state := newState(store, clk)
+	failed := []*tupleData{{state: RST_SENT_BY_SERVER}}
+	delay := accountingDelay(0)
+
+	for _, tc := range []struct {
+		desc         string
+		now          time.Time
+		wantSilenced bool
+	}{
+		{"snapshot within, second before the window", start.Add(delay / 2), false},
+		{"second at the start of the window", start.Add(delay), true},
+		{"snapshot after, second within the window", end.Add(delay / 2), true},
+		{"second after the window", end.Add(delay + time.Second), false},
+	} {
+		clk.Set(tc.now)
+		inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, failed, sniStats{})
+		if silenced := inc.SilencedSeconds > 0; silenced != tc.wantSilenced {
+			t.Errorf("%s: got silenced %v, want %v", tc.desc, silenced, tc.wantSilenced)
+		}
+	}
+}
+
+func TestScheduleExpectedIdle(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{
+		{SNI: "backup.example.com", Schedule: []config.ScheduleWindow{{Days: []string{"Tue"}, Start: "00:00", End: "24:00"}}},
+		{SNI: "*.example.com", Schedule: []config.ScheduleWindow{{Days: []string{"Mon"}, Start: "00:00", End: "24:00"}}},
+	}})
+	// 2022-05-02 is a Monday.
+	state := newState(store, clock.NewFake(time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC)))
+
+	// Outside of the schedule, the failure is kept but not counted.
+	inc, failedSecond := state.accountForConnections(ConnKey{sni: "backup.example.com"}, true, nil, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [2]float64{inc.FailedSeconds, inc.ExpectedIdleSeconds}, [2]float64{0, 1})
+
+	// Within the schedule, the failure is carried over.
+	inc, failedSecond = state.accountForConnections(ConnKey{sni: "api.example.com"}, true, nil, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [2]float64{inc.FailedSeconds, inc.ExpectedIdleSeconds}, [2]float64{1, 0})
+}
+
+func TestScheduleBoundary(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{
+		{SNI: "backup.example.com", Schedule: []config.ScheduleWindow{{Days: []string{"Mon"}, Start: "00:00", End: "24:00"}}},
+	}})
+	// 2022-05-03 is a Tuesday, the schedule ended at midnight. The
+	// accounted second lags behind the snapshot.
+	midnight := time.Date(2022, 5, 3, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(midnight.Add(accountingDelay(0) / 2))
+	state := newState(store, clk)
+
+	inc, _ := state.accountForConnections(ConnKey{sni: "backup.example.com"}, true, nil, sniStats{})
+	assert(t, [2]float64{inc.FailedSeconds, inc.ExpectedIdleSeconds}, [2]float64{1, 0})
+
+	clk.Set(midnight.Add(accountingDelay(0) + time.Second))
+	inc, _ = state.accountForConnections(ConnKey{sni: "backup.example.com"}, true, nil, sniStats{})
+	assert(t, [2]float64{inc.FailedSeconds, inc.ExpectedIdleSeconds}, [2]float64{0, 1})
+}
+
+func TestSecondsPolicy(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{
+		{SNI: "active-only.example.com", SecondsPolicy: config.SecondsActiveOnly},
+		{SNI: "carry.example.com", SecondsPolicy: config.SecondsWallClockWithCarry},
+		{SNI: "strict.example.com", SecondsPolicy: config.SecondsWallClockStrict},
+	}})
+	state := newState(store, nil)
+	succeeded := []*tupleData{{state: SNI_RECEIVED}}
+
+	for _, tc := range []struct {
+		sni            string
+		previousFailed bool
+		connections    []*tupleData
+		wantFailed     bool
+		// failed, wall clock and unknown seconds
+		wantSeconds [3]float64
+	}{
+		{"api.example.com", true, nil, true, [3]float64{1, 0, 0}},
+		{"active-only.example.com", true, nil, false, [3]float64{0, 0, 0}},
+		{"carry.example.com", true, nil, true, [3]float64{1, 1, 0}},
+		{"carry.example.com", false, nil, false, [3]float64{0, 1, 1}},
+		{"carry.example.com", true, succeeded, false, [3]float64{0, 1, 0}},
+		{"strict.example.com", false, nil, true, [3]float64{1, 1, 0}},
+		{"strict.example.com", true, succeeded, false, [3]float64{0, 1, 0}},
+	} {
+		inc, failedSecond := state.accountForConnections(ConnKey{sni: tc.sni}, tc.previousFailed, tc.connections, sniStats{})
+		if failedSecond != tc.wantFailed {
+			t.Errorf("%s (previous failed: %v): got failed second %v, want %v", tc.sni, tc.previousFailed, failedSecond, tc.wantFailed)
+		}
+		if got := [3]float64{inc.FailedSeconds, inc.WallClockSeconds, inc.UnknownSeconds}; got != tc.wantSeconds {
+			t.Errorf("%s (previous failed: %v): got seconds %v, want %v", tc.sni, tc.previousFailed, got, tc.wantSeconds)
+		}
+	}
+}
+
+func TestMiddleboxResets(t *testing.T) {
+	state := newState(nil, nil)
+
+	inc, failedSecond := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, []*tupleData{{state: RST_SENT_BY_MIDDLEBOX}}, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [3]float64{inc.RejectedConnections, inc.RejectedConnectionsByMiddlebox, inc.ActiveFailedSeconds}, [3]float64{0, 1, 1})
+
+	inc, failedSecond = state.accountForConnections(ConnKey{sni: "api.example.com"}, false, nil, sniStats{succeededConnections: 1, middleboxResets: 2})
+	assert(t, failedSecond, true)
+	assert(t, [3]float64{inc.SuccessfulConnections, inc.RejectedConnectionsByMiddlebox, inc.ActiveFailedSeconds}, [3]float64{1, 2, 1})
+}
+
+func TestRSTOrigins(t *testing.T) {
+	state := newState(nil, nil)
+
+	stale := []*tupleData{{state: RST_SENT_BY_SERVER}, {state: RST_SENT_BY_CLIENT}, {state: RST_SENT_BY_MIDDLEBOX}, {state: FIN_RECEIVED}}
+	stats := sniStats{failedConnections: 2, middleboxResets: 1}
+	stats.resets = [3]uint64{2, 0, 1}
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, inc.RSTOrigins, map[string]float64{"server": 3, "client": 1, "middlebox": 2})
+}
+
+func TestNetworkRejections(t *testing.T) {
+	state := newState(nil, nil)
+
+	inc, failedSecond := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, []*tupleData{{state: ICMP_UNREACHABLE, icmpCode: 13}}, sniStats{})
+	assert(t, failedSecond, true)
+	assert(t, [2]float64{inc.RejectedConnectionsByNetwork, inc.ActiveFailedSeconds}, [2]float64{1, 1})
+	assert(t, inc.ICMPCodes, map[string]float64{"admin_prohibited": 1})
+
+	stats := sniStats{succeededConnections: 1}
+	stats.icmpUnreachable[1] = 2
+	inc, failedSecond = state.accountForConnections(ConnKey{sni: "api.example.com"}, false, nil, stats)
+	assert(t, failedSecond, true)
+	assert(t, [2]float64{inc.SuccessfulConnections, inc.RejectedConnectionsByNetwork}, [2]float64{1, 2})
+	assert(t, inc.ICMPCodes, map[string]float64{"host_unreachable": 2})
+}
+
+func TestHandshakesAbandoned(t *testing.T) {
+	state := newState(nil, nil)
+	stale := []*tupleData{
+		{state: SNI_RECEIVED, sni: "api.example.com"},
+		{state: SNI_RECEIVED, sni: "api.example.com", serverHelloSeen: true},
+		// The handshake did not start yet.
+		{state: SYNACK_RECEIVED},
+	}
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, sniStats{succeededConnections: 3, handshakesAbandoned: 2})
+	assert(t, inc.HandshakesAbandoned, float64(3))
+}
+
+func TestSCTPAssociations(t *testing.T) {
+	state := newState(nil, nil)
+	stale := []*tupleData{
+		// Established, without a TLS handshake.
+		{state: SNI_RECEIVED, sni: "__sctp__:3868", sctp: true},
+		// The INIT timed out.
+		{state: SYN_RECEIVED, sni: "__sctp__:3868", sctp: true},
+	}
+	inc, failedSecond := state.accountForConnections(ConnKey{sni: "__sctp__:3868"}, false, stale, sniStats{failedConnections: 1})
+	assert(t, failedSecond, true)
+	assert(t, [3]float64{inc.SuccessfulConnections, inc.RejectedConnections, inc.HandshakesAbandoned}, [3]float64{1, 1, 0})
+}
+
+func TestLatencies(t *testing.T) {
+	state := newState(nil, nil)
+	stale := []*tupleData{
+		{state: SNI_RECEIVED, latency: latencySample{connect: time.Millisecond, handshake: 3 * time.Millisecond, handshakeDuration: 5 * time.Millisecond}},
+		// Not measured.
+		{state: SNI_RECEIVED},
+	}
+	stats := sniStats{succeededConnections: 2, latencies: []latencySample{{connect: 2 * time.Millisecond}, {connect: 4 * time.Millisecond, handshakeDuration: 6 * time.Millisecond}}}
+	// The latencies survive the stats map.
+	_, stats, err := decodeStats(statsEntry(t, ConnKey{sourceIP: "10.0.0.1", destIP: "10.0.0.2", sni: "api.example.com"}, stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, inc.ConnectLatencies, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond})
+	assert(t, inc.HandshakeLatencies, []time.Duration{3 * time.Millisecond})
+	assert(t, inc.HandshakeDurations, []time.Duration{5 * time.Millisecond, 6 * time.Millisecond})
+}
+
+func TestCounterDelta(t *testing.T) {
+	assert(t, counterDelta(0, 5), uint64(5))
+	assert(t, counterDelta(5, 7), uint64(2))
+	// The counter was reset in the meantime.
+	assert(t, counterDelta(7, 3), uint64(3))
+}
+
+func TestInterceptionDeltas(t *testing.T) {
+	last := map[string]interceptionCounts{
+		"api.example.com":     {SplitHandshakes: 2},
+		"evicted.example.com": {ClientHellosAfterRST: 4},
+	}
+	deltas := interceptionDeltas(last, map[string]interceptionCounts{
+		"api.example.com":   {SplitHandshakes: 3, ClientHellosAfterRST: 1},
+		"other.example.com": {ClientHellosAfterRST: 2},
+	})
+	assert(t, deltas, map[string]interceptionCounts{
+		"api.example.com":   {SplitHandshakes: 1, ClientHellosAfterRST: 1},
+		"other.example.com": {ClientHellosAfterRST: 2},
+	})
+	assert(t, last, map[string]interceptionCounts{
+		"api.example.com":   {SplitHandshakes: 3, ClientHellosAfterRST: 1},
+		"other.example.com": {ClientHellosAfterRST: 2},
+	})
+
+	// Unchanged counters have no delta.
+	deltas = interceptionDeltas(last, map[string]interceptionCounts{"api.example.com": {SplitHandshakes: 3, ClientHellosAfterRST: 1}})
+	assert(t, deltas, map[string]interceptionCounts{})
+}
+
+func TestInterfaceDeltas(t *testing.T) {
+	last := map[uint32]interfaceCounts{
+		1: {Packets: 10, Matched: 2, Bytes: 1000},
+		2: {Packets: 5, Bytes: 500},
+	}
+	deltas := interfaceDeltas(last, map[uint32]interfaceCounts{
+		1: {Packets: 15, Matched: 3, Bytes: 1600},
+		2: {Packets: 5, Bytes: 500},
+		3: {Packets: 1, Matched: 1, Bytes: 60},
+	})
+	// The idle interface 2 has a zero delta, so its series exist.
+	assert(t, deltas, map[uint32]interfaceCounts{
+		1: {Packets: 5, Matched: 1, Bytes: 600},
+		2: {},
+		3: {Packets: 1, Matched: 1, Bytes: 60},
+	})
+	assert(t, last[1], interfaceCounts{Packets: 15, Matched: 3, Bytes: 1600})
+
+	// The counters of a reloaded program start from zero again.
+	deltas = interfaceDeltas(last, map[uint32]interfaceCounts{1: {Packets: 4, Bytes: 400}})
+	assert(t, deltas, map[uint32]interfaceCounts{1: {Packets: 4, Bytes: 400}})
+	assert(t, len(last), 1)
+}
+
+func TestTLSParameterDeltas(t *testing.T) {
+	tls12 := tlsParameters{sni: "api.example.com", version: 0x0303, cipherSuite: 0xc02f}
+	tls13 := tlsParameters{sni: "api.example.com", version: 0x0304, cipherSuite: 0x1301}
+	// A resumed session is accounted for the SNI of its ClientHello, apart
+	// from the full handshakes.
+	resumed := tlsParameters{sni: "api.example.com", version: 0x0304, cipherSuite: 0x1301, resumed: true, earlyData: true}
+	evicted := tlsParameters{sni: "evicted.example.com", version: 0x0303, cipherSuite: 0xc02f}
+	last := map[tlsParameters]uint64{tls12: 2, evicted: 4}
+	deltas := tlsParameterDeltas(last, map[tlsParameters]uint64{tls12: 2, tls13: 3, resumed: 1})
+	assert(t, deltas, map[tlsParameters]uint64{tls13: 3, resumed: 1})
+	assert(t, last, map[tlsParameters]uint64{tls12: 2, tls13: 3, resumed: 1})
+
+	assert(t, tlsVersionName(0x0304), "TLS 1.3")
+	assert(t, tlsVersionName(0x7f1c), "0x7F1C")
+}
+
+func TestTLSAlertDeltas(t *testing.T) {
+	rejected := tlsAlert{sni: "api.example.com", description: 40, fromServer: true}
+	untrusted := tlsAlert{sni: "api.example.com", description: 48}
+	evicted := tlsAlert{sni: "evicted.example.com", description: 112, fromServer: true}
+	last := map[tlsAlert]uint64{rejected: 1, evicted: 2}
+	deltas := tlsAlertDeltas(last, map[tlsAlert]uint64{rejected: 3, untrusted: 1})
+	assert(t, deltas, map[tlsAlert]uint64{rejected: 2, untrusted: 1})
+	assert(t, last, map[tlsAlert]uint64{rejected: 3, untrusted: 1})
+
+	assert(t, tlsAlertName(45), "certificate_expired")
+	assert(t, tlsAlertName(112), "unrecognized_name")
+	assert(t, tlsAlertName(200), "200")
+}
+
+func TestMPTCPSubflowDeltas(t *testing.T) {
+	joined := mptcpTokenOf([8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	assert(t, joined, mptcpToken{0x66, 0x84, 0x0d, 0xda})
+	failed := mptcpToken{1}
+	evicted := mptcpToken{2}
+	last := map[mptcpToken]mptcpSubflowCounts{joined: {Joined: 1}, evicted: {Failed: 3}}
+	deltas := mptcpSubflowDeltas(last, map[mptcpToken]mptcpSubflowCounts{joined: {Joined: 3, Failed: 1}, failed: {Failed: 2}})
+	assert(t, deltas, map[mptcpToken]mptcpSubflowCounts{joined: {Joined: 2, Failed: 1}, failed: {Failed: 2}})
+	assert(t, last, map[mptcpToken]mptcpSubflowCounts{joined: {Joined: 3, Failed: 1}, failed: {Failed: 2}})
+}
+
+func TestPartialMatchDeltas(t *testing.T) {
+	cidr := partialMatchKey{Match: partialMatchCIDR}
+	port := partialMatchKey{IP: [4]byte{192, 168, 0, 7}, Port: [2]byte{0x20, 0xfb}, Match: partialMatchPort}
+	evicted := partialMatchKey{IP: [4]byte{192, 168, 0, 8}, Port: [2]byte{0x01, 0xbb}, Match: partialMatchPort}
+	last := map[partialMatchKey]uint64{cidr: 4, evicted: 1}
+	deltas := partialMatchDeltas(last, map[partialMatchKey]uint64{cidr: 6, port: 1})
+	assert(t, deltas, map[partialMatchKey]uint64{cidr: 2, port: 1})
+	assert(t, last, map[partialMatchKey]uint64{cidr: 6, port: 1})
+
+	ip, p := partialMatchServer(cidr)
+	assert(t, []string{ip, p}, []string{"", ""})
+	ip, p = partialMatchServer(port)
+	assert(t, []string{ip, p}, []string{"192.168.0.7", "8443"})
+}
+
+func TestALPNDeltas(t *testing.T) {
+	protocols := make(map[string]uint8)
+	for protocol, name := range alpnProtocolNames {
+		protocols[name] = protocol
+	}
+	offered := alpn{sni: "api.example.com", protocol: protocols["h2"]}
+	selected := alpn{sni: "api.example.com", selected: true, protocol: protocols["http/1.1"]}
+	evicted := alpn{sni: "evicted.example.com", protocol: protocols["none"]}
+	last := map[alpn]uint64{offered: 5, evicted: 1}
+	deltas := alpnDeltas(last, map[alpn]uint64{offered: 7, selected: 2})
+	assert(t, deltas, map[alpn]uint64{offered: 2, selected: 2})
+	assert(t, last, map[alpn]uint64{offered: 7, selected: 2})
+	assert(t, len(protocols), len(metrics.ALPNProtocols))
+}
+
 func assert(t *testing.T, got interface{}, expected interface{}) {
 	if !reflect.DeepEqual(got, expected) {
 		t.Errorf("Got %+v\nwant %+v", got, expected)
 	}
 }
+
+func TestCongestionSignals(t *testing.T) {
+	state := newState(nil, nil)
+
+	stale := []*tupleData{
+		{state: FIN_RECEIVED, congestion: congestionSignals{ecnRequested: 1, ecnAccepted: 1, cePackets: 2, ecePackets: 3, cwrPackets: 1}},
+		{state: SNI_RECEIVED, congestion: congestionSignals{ecnRequested: 1}},
+	}
+	stats := sniStats{succeededConnections: 1, congestion: congestionSignals{ecnRequested: 1, cePackets: 1}}
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t,
+		[5]float64{inc.ECNRequested, inc.ECNAccepted, inc.CongestionExperiencedPackets, inc.ECEPackets, inc.CWRPackets},
+		[5]float64{3, 1, 3, 3, 1})
+}
+
+func TestHandshakeOnly(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{SNI: "h2.example.com", DetectHandshakeOnly: true}}})
+	state := newState(store, nil)
+	stale := []*tupleData{
+		// The Finished of TLS 1.3 is the only ApplicationData record.
+		{state: SNI_RECEIVED, serverHelloSeen: true, tls13: true, clientAppDataRecords: 1},
+		{state: SNI_RECEIVED, serverHelloSeen: true, tls13: true, clientAppDataRecords: 2},
+		{state: SNI_RECEIVED, serverHelloSeen: true, clientAppDataRecords: 1},
+		// The handshake did not succeed.
+		{state: SNI_RECEIVED},
+	}
+	stats := sniStats{succeededConnections: 2, handshakesOnly: 1}
+
+	inc, _ := state.accountForConnections(ConnKey{sni: "h2.example.com"}, false, stale, stats)
+	assert(t, [2]interface{}{inc.DetectHandshakeOnly, inc.HandshakeOnlyConnections}, [2]interface{}{true, float64(2)})
+
+	// Not counted without the rule.
+	inc, _ = state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, [2]interface{}{inc.DetectHandshakeOnly, inc.HandshakeOnlyConnections}, [2]interface{}{false, float64(0)})
+}
+
+func TestMinFailedConnections(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{SNI: "debounced.example.com", MinFailedConnections: 3}}})
+	state := newState(store, nil)
+	stray := []*tupleData{
+		{state: SNI_RECEIVED},
+		{state: RST_SENT_BY_SERVER},
+	}
+	// A single stray reset only fails the SNIs without the rule.
+	for sni, failed := range map[string]bool{"debounced.example.com": false, "api.example.com": true} {
+		inc, failedSecond := state.accountForConnections(ConnKey{sni: sni}, false, stray, sniStats{})
+		assert(t, [2]interface{}{failedSecond, inc.RejectedConnections}, [2]interface{}{failed, float64(1)})
+	}
+	// The failures of the closed and the open connections add up.
+	_, failedSecond := state.accountForConnections(ConnKey{sni: "debounced.example.com"}, false, stray, sniStats{failedConnections: 1, middleboxResets: 1})
+	assert(t, failedSecond, true)
+}
+
+func TestAttributeFailures(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{{SNI: "attributed.example.com", AttributeFailures: true}}})
+	state := newState(store, nil)
+	stale := []*tupleData{
+		{state: SNI_RECEIVED},
+		{state: RST_SENT_BY_CLIENT},
+		{state: SYN_RECEIVED},
+	}
+	seconds := func(inc *metrics.Inc) [5]float64 {
+		return [5]float64{inc.FailedSeconds, inc.ServerFailedSeconds, inc.ClientFailedSeconds, inc.NetworkFailedSeconds, inc.ActiveSeconds}
+	}
+	inc, _ := state.accountForConnections(ConnKey{sni: "attributed.example.com"}, false, stale, sniStats{})
+	assert(t, inc.AttributeFailures, true)
+	assert(t, seconds(inc), [5]float64{1, 0, 1, 1, 1})
+	// The closed connections rejected by the server.
+	inc, _ = state.accountForConnections(ConnKey{sni: "attributed.example.com"}, false, stale[:2], sniStats{failedConnections: 1})
+	assert(t, seconds(inc), [5]float64{1, 1, 1, 0, 1})
+	// A failure of the client alone does not fail the second.
+	inc, _ = state.accountForConnections(ConnKey{sni: "attributed.example.com"}, false, stale[:2], sniStats{})
+	assert(t, seconds(inc), [5]float64{0, 0, 1, 0, 1})
+
+	// Not accounted without the rule.
+	inc, _ = state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, sniStats{})
+	assert(t, inc.AttributeFailures, false)
+	assert(t, seconds(inc), [5]float64{1, 0, 0, 0, 1})
+}
+
+func TestHandshakePhases(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{}), nil)
+	stale := []*tupleData{
+		// The client rejected the certificate.
+		{state: FIN_RECEIVED, serverHelloSeen: true},
+		{state: RST_SENT_BY_SERVER, serverHelloSeen: true, handshakeFinished: true},
+		// Resets by the client are not failures.
+		{state: RST_SENT_BY_CLIENT, serverHelloSeen: true, handshakeFinished: true},
+		// The handshake is still in progress.
+		{state: SNI_RECEIVED, serverHelloSeen: true},
+	}
+	stats := sniStats{failedConnections: 1, handshakesFailed: 2, establishedResets: 1}
+
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, [2]float64{inc.HandshakesFailed, inc.EstablishedResets}, [2]float64{3, 2})
+}
+
+func TestCertificateRequests(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{}), nil)
+	stale := []*tupleData{
+		// The client had no certificate to send.
+		{state: FIN_RECEIVED, serverHelloSeen: true, certificateRequested: true},
+		{state: SNI_RECEIVED, serverHelloSeen: true, handshakeFinished: true, certificateRequested: true},
+		// Without mutual TLS.
+		{state: FIN_RECEIVED, serverHelloSeen: true},
+	}
+	stats := sniStats{succeededConnections: 2, certificateRequests: 2, certificateRequestFailures: 1}
+
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, [2]float64{inc.CertificateRequests, inc.CertificateRequestFailures}, [2]float64{4, 2})
+	assert(t, inc.HandshakesFailed, 2.0)
+}
+
+func TestStateTransitions(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{}), nil)
+	index := func(name string) int {
+		for i, n := range transitionNames {
+			if n == name {
+				return i
+			}
+		}
+		t.Fatalf("unknown transition %q", name)
+		return 0
+	}
+	bits := func(names ...string) uint32 {
+		var b uint32
+		for _, name := range names {
+			b |= 1 << index(name)
+		}
+		return b
+	}
+	stale := []*tupleData{
+		// Never answered.
+		{state: SYN_RECEIVED, transitions: bits("syn")},
+		// Still open.
+		{state: SNI_RECEIVED, transitions: bits("syn", "synack", "sni")},
+		// Closed while the stats slot was sealed.
+		{state: FIN_RECEIVED, transitions: bits("syn", "synack", "sni", "fin")},
+	}
+	stats := sniStats{failedConnections: 1}
+	stats.transitions[index("syn")] = 1
+	stats.transitions[index("rst_server")] = 1
+
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, stats)
+	assert(t, inc.Transitions, map[string]float64{"syn": 4, "synack": 2, "sni": 2, "fin": 1, "rst_server": 1, "expired": 2})
+}
+
+func TestLateWrite(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{}), nil)
+	// Closed while the stats slot was sealed.
+	stale := []*tupleData{{state: FIN_RECEIVED, sni: "api.example.com"}}
+	inc, _ := state.accountForConnections(ConnKey{sni: "api.example.com"}, false, stale, sniStats{})
+	assert(t, [2]float64{inc.SuccessfulConnections, inc.ActiveSeconds}, [2]float64{1, 1})
+}
+
+func TestEBPFInfoWithoutProgram(t *testing.T) {
+	// A replayed data source has no eBPF program.
+	if _, err := (&NetworkDataSource{}).EBPFInfo(true); !errors.Is(err, ErrNoEBPF) {
+		t.Errorf("EBPFInfo() = %v, want %v", err, ErrNoEBPF)
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"m/metrics"
+)
+
+// #include "c/types.h"
+import "C"
+
+// partialMatchKey mirrors struct partial_match_t. The IP and the port
+// of the server are zero unless the partial matches are observed.
+type partialMatchKey struct {
+	IP    [4]byte
+	Port  [2]byte
+	Match uint8
+	_     uint8
+}
+
+// The filter dimensions matched by a partial match.
+const (
+	partialMatchCIDR uint8 = C.PARTIAL_MATCH_CIDR
+	partialMatchPort uint8 = C.PARTIAL_MATCH_PORT
+)
+
+// partialMatchNames name the filter dimension matched by a partial
+// match.
+var partialMatchNames = map[uint8]string{
+	partialMatchCIDR: "cidr",
+	partialMatchPort: "port",
+}
+
+// SetObservePartialMatches makes the eBPF program count the SYNs
+// matching only the configured CIDRs or only the configured ports per
+// server instead of in a counter per matched dimension, so the servers
+// missing in the configuration can be found. The connections are not
+// tracked either way.
+func (s *NetworkDataSource) SetObservePartialMatches(enabled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return nil
+	}
+	capture := s.setupOptions().capture()
+	capture.observePartialMatches = enabled
+	if err := initCaptureMap(s.ebpfConfig.captureMap, capture); err != nil {
+		return fmt.Errorf("initializing capture map: %w", err)
+	}
+	s.observePartialMatches = enabled
+	return nil
+}
+
+// readPartialMatches exports the SYNs matching only one of the
+// configured CIDRs and ports since the last read. The kernel counters
+// are cumulative, last holds their previous values.
+func (s *NetworkDataSource) readPartialMatches(last map[partialMatchKey]uint64) error {
+	var key partialMatchKey
+	var count uint64
+	current := make(map[partialMatchKey]uint64)
+	entries := s.ebpfConfig.partialMatchesMap.Iterate()
+	for entries.Next(&key, &count) {
+		current[key] = count
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for key, delta := range partialMatchDeltas(last, current) {
+		match, ok := partialMatchNames[key.Match]
+		if !ok {
+			continue
+		}
+		ip, port := partialMatchServer(key)
+		metrics.AddPartialMatches(match, ip, port, float64(delta))
+	}
+	return nil
+}
+
+// partialMatchServer returns the IP and the port of the server of a
+// partial match, empty if the partial matches are not observed.
+func partialMatchServer(key partialMatchKey) (string, string) {
+	if key.IP == [4]byte{} && key.Port == [2]byte{} {
+		return "", ""
+	}
+	return net.IP(key.IP[:]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(key.Port[:])))
+}
+
+// partialMatchDeltas returns the increase of the counters and replaces
+// the last counters with the current ones. Evicted entries start from
+// zero again.
+func partialMatchDeltas(last, current map[partialMatchKey]uint64) map[partialMatchKey]uint64 {
+	deltas := make(map[partialMatchKey]uint64)
+	for key, count := range current {
+		if delta := counterDelta(last[key], count); delta > 0 {
+			deltas[key] = delta
+		}
+	}
+	for key := range last {
+		if _, ok := current[key]; !ok {
+			delete(last, key)
+		}
+	}
+	for key, count := range current {
+		last[key] = count
+	}
+	return deltas
+}
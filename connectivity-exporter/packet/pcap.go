@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	"m/config"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// pcapFlowTimeout is the time after which a connection without a
+// ClientHello is reported, like the eBPF program accounts a handshake
+// which never completed.
+const pcapFlowTimeout = 20 * time.Second
+
+// PcapConnection is a connection seen by the pcap backend.
+type PcapConnection struct {
+	SourceIP, DestIP, SNI string
+	Time                  time.Time
+}
+
+type flowKey struct {
+	sourceIP, destIP     [net.IPv4len]byte
+	sourcePort, destPort uint16
+}
+
+// PcapBackend parses the TCP handshakes and the ClientHellos of the
+// captured connections in userspace, from a packet socket on the same
+// interface as the eBPF program. It is independent of the parsing of
+// the eBPF program, so both can be compared to validate changes of the
+// program. Only ClientHellos in the first segment are parsed.
+type PcapBackend struct {
+	networkInterface string
+	cidrs            []*net.IPNet
+	// ports are the protocols of the ports, see parsePort.
+	ports        map[uint16]byte
+	config       *config.Store
+	maxSNILength int
+	// noSNIPrefix is the prefix of the pseudo SNI of the connections
+	// without an SNI, see SetNoSNIPrefix.
+	noSNIPrefix string
+
+	// flows are the connections whose SYN was seen, by client side.
+	flows map[flowKey]time.Time
+}
+
+// NewPcapBackend creates a pcap backend capturing the connections of
+// the CIDRs and ports like the eBPF program. The SNIs are truncated to
+// the maximum length of the program and the connections without an SNI
+// are accounted for the same fallback SNI.
+func NewPcapBackend(networkInterface string, cidrs, ports map[string]struct{}, maxSNILength int, store *config.Store) (*PcapBackend, error) {
+	b := &PcapBackend{
+		networkInterface: networkInterface,
+		ports:            make(map[uint16]byte, len(ports)),
+		config:           store,
+		maxSNILength:     maxSNILength,
+		flows:            make(map[flowKey]time.Time),
+	}
+	for c := range cidrs {
+		ip, size, err := parseIPSizeCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		b.cidrs = append(b.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(size, 8*net.IPv4len)})
+	}
+	for p := range ports {
+		port, protocol, err := parsePort(p)
+		if err != nil {
+			return nil, err
+		}
+		// The flows of UDP and the associations of SCTP are only
+		// tracked by the eBPF program.
+		if protocol == C.PORT_PROTOCOL_UDP || protocol == C.PORT_PROTOCOL_SCTP {
+			continue
+		}
+		b.ports[port] = protocol
+	}
+	if b.maxSNILength <= 0 || b.maxSNILength > MaxSNILength {
+		b.maxSNILength = MaxSNILength
+	}
+	if b.config == nil {
+		b.config = config.NewStore(nil)
+	}
+	return b, nil
+}
+
+// SetNoSNIPrefix accounts the connections without an SNI for the pseudo
+// SNI of their port like NetworkDataSource.SetNoSNIPrefix. It has to be
+// called before Run.
+func (b *PcapBackend) SetNoSNIPrefix(prefix string) {
+	b.noSNIPrefix = prefix
+}
+
+// Run opens the packet socket and passes the connections to the
+// function until the context is done.
+func (b *PcapBackend) Run(ctx context.Context, wg *sync.WaitGroup, connections func(*PcapConnection)) error {
+	iface, err := net.InterfaceByName(b.networkInterface)
+	if err != nil {
+		return &SetupError{Kind: InterfaceNotFound, Err: err}
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return fmt.Errorf("opening packet socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("binding packet socket to %s: %w", b.networkInterface, err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer unix.Close(fd)
+		buf := make([]byte, 0xffff)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for ctx.Err() == nil {
+			if _, err := unix.Poll(fds, int(capturePollTimeout/time.Millisecond)); err != nil && !errors.Is(err, unix.EINTR) {
+				klog.Errorf("Failed to capture packets for the pcap backend: %v", err)
+				return
+			}
+			now := time.Now()
+			if fds[0].Revents&unix.POLLIN != 0 {
+				if n, _, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT); err == nil {
+					if c := b.handlePacket(buf[:n], now); c != nil {
+						connections(c)
+					}
+				}
+			}
+			for _, c := range b.expire(now) {
+				connections(c)
+			}
+		}
+	}()
+	return nil
+}
+
+// handlePacket tracks the connection of an Ethernet frame and returns
+// it once its SNI is known or it ends without one.
+func (b *PcapBackend) handlePacket(data []byte, now time.Time) *PcapConnection {
+	var (
+		eth     layers.Ethernet
+		vlan    layers.Dot1Q
+		ip      layers.IPv4
+		tcp     layers.TCP
+		payload gopacket.Payload
+	)
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &vlan, &ip, &tcp, &payload)
+	parser.IgnoreUnsupported = true
+	decoded := make([]gopacket.LayerType, 0, 5)
+	// The error of a truncated or unsupported layer is ignored, the
+	// decoded layers are checked instead.
+	_ = parser.DecodeLayers(data, &decoded)
+	hasTCP := false
+	for _, l := range decoded {
+		hasTCP = hasTCP || l == layers.LayerTypeTCP
+	}
+	if !hasTCP || ip.SrcIP.To4() == nil || ip.DstIP.To4() == nil {
+		return nil
+	}
+
+	key := flowKey{sourcePort: uint16(tcp.SrcPort), destPort: uint16(tcp.DstPort)}
+	copy(key.sourceIP[:], ip.SrcIP.To4())
+	copy(key.destIP[:], ip.DstIP.To4())
+	if tcp.SYN && !tcp.ACK {
+		if b.captures(ip.SrcIP, ip.DstIP, key.sourcePort, key.destPort) {
+			if _, ok := b.flows[key]; !ok {
+				b.flows[key] = now
+			}
+		}
+		return nil
+	}
+	if _, ok := b.flows[key]; ok {
+		parse := parseClientHelloSNI
+		if b.ports[key.destPort] == C.PORT_PROTOCOL_HTTP {
+			parse = parseHTTPHost
+		}
+		if sni, ok := parse(tcp.Payload); ok {
+			delete(b.flows, key)
+			return b.connection(key, sni, now)
+		}
+		if tcp.RST || tcp.FIN {
+			delete(b.flows, key)
+			return b.connection(key, "", now)
+		}
+		return nil
+	}
+	// A reset or FIN of the server ends the connection as well.
+	reverse := flowKey{sourceIP: key.destIP, destIP: key.sourceIP, sourcePort: key.destPort, destPort: key.sourcePort}
+	if _, ok := b.flows[reverse]; ok && (tcp.RST || tcp.FIN) {
+		delete(b.flows, reverse)
+		return b.connection(reverse, "", now)
+	}
+	return nil
+}
+
+// captures mirrors the filter of the eBPF program: either address in
+// the CIDRs and either port in the ports.
+func (b *PcapBackend) captures(sourceIP, destIP net.IP, sourcePort, destPort uint16) bool {
+	inCIDRs := false
+	for _, n := range b.cidrs {
+		inCIDRs = inCIDRs || n.Contains(sourceIP) || n.Contains(destIP)
+	}
+	_, sourcePortFound := b.ports[sourcePort]
+	_, destPortFound := b.ports[destPort]
+	return inCIDRs && (sourcePortFound || destPortFound)
+}
+
+// expire returns the connections without a ClientHello after the flow
+// timeout.
+func (b *PcapBackend) expire(now time.Time) []*PcapConnection {
+	var expired []*PcapConnection
+	for key, started := range b.flows {
+		if now.Sub(started) > pcapFlowTimeout {
+			delete(b.flows, key)
+			expired = append(expired, b.connection(key, "", now))
+		}
+	}
+	return expired
+}
+
+func (b *PcapBackend) connection(key flowKey, sni string, now time.Time) *PcapConnection {
+	sourceIP, destIP := net.IP(key.sourceIP[:]), net.IP(key.destIP[:])
+	if sni == "" && b.noSNIPrefix != "" {
+		sni = noSNI(b.noSNIPrefix, key.destPort)
+	} else if sni == "" {
+		sni = fallbackSNI(b.config.Get(), destIP)
+	} else {
+		sni = b.truncate(sni)
+	}
+	return &PcapConnection{SourceIP: sourceIP.String(), DestIP: destIP.String(), SNI: sni, Time: now}
+}
+
+// truncate truncates the SNI like the eBPF program.
+func (b *PcapBackend) truncate(sni string) string {
+	buf := []byte(sni)
+	if len(buf) > b.maxSNILength {
+		buf = buf[:b.maxSNILength]
+		buf[len(buf)-1] = C.SNI_TRUNCATED_MARKER
+	}
+	return sniFromC(buf)
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tlsClientHello returns the first flight of a TLS client.
+func tlsClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	buf := make([]byte, 0xffff)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("reading ClientHello: %v", err)
+	}
+	return buf[:n]
+}
+
+func frame(t *testing.T, srcIP, dstIP string, srcPort, dstPort int, flags string, payload []byte) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP(dstIP)}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		SYN:     strings.Contains(flags, "S"),
+		ACK:     strings.Contains(flags, "A"),
+		RST:     strings.Contains(flags, "R"),
+		FIN:     strings.Contains(flags, "F"),
+		PSH:     strings.Contains(flags, "P"),
+		Window:  65535,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("serializing frame: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPcapBackend(t *testing.T) {
+	backend, err := NewPcapBackend("lo", AsSet("192.168.0.0/24"), AsSet("443,80/http"), 12, nil)
+	if err != nil {
+		t.Fatalf("NewPcapBackend() = %v", err)
+	}
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	handle := func(f []byte) *PcapConnection { return backend.handlePacket(f, now) }
+
+	// A ClientHello after the handshake.
+	assert(t, handle(frame(t, "10.0.0.1", "192.168.0.1", 40000, 443, "S", nil)), (*PcapConnection)(nil))
+	assert(t, handle(frame(t, "192.168.0.1", "10.0.0.1", 443, 40000, "SA", nil)), (*PcapConnection)(nil))
+	assert(t, handle(frame(t, "10.0.0.1", "192.168.0.1", 40000, 443, "PA", tlsClientHello(t, "example.com"))),
+		&PcapConnection{SourceIP: "10.0.0.1", DestIP: "192.168.0.1", SNI: "example.com", Time: now})
+	// An SNI longer than the maximum length is truncated.
+	handle(frame(t, "10.0.0.1", "192.168.0.1", 40001, 443, "S", nil))
+	assert(t, handle(frame(t, "10.0.0.1", "192.168.0.1", 40001, 443, "PA", tlsClientHello(t, "api.example.com"))).SNI,
+		"api.example"+TruncatedSNISuffix)
+	// The Host header of a plaintext HTTP request.
+	handle(frame(t, "10.0.0.1", "192.168.0.1", 40002, 80, "S", nil))
+	assert(t, handle(frame(t, "10.0.0.1", "192.168.0.1", 40002, 80, "PA", []byte("GET / HTTP/1.1\r\nHost: Example.com:80\r\n\r\n"))),
+		&PcapConnection{SourceIP: "10.0.0.1", DestIP: "192.168.0.1", SNI: "example.com", Time: now})
+	// A connection reset by the server before the ClientHello.
+	handle(frame(t, "10.0.0.2", "192.168.0.1", 40000, 443, "S", nil))
+	assert(t, handle(frame(t, "192.168.0.1", "10.0.0.2", 443, 40000, "R", nil)),
+		&PcapConnection{SourceIP: "10.0.0.2", DestIP: "192.168.0.1", SNI: UnknownSNI, Time: now})
+	// Connections outside the filter are ignored.
+	handle(frame(t, "10.0.0.1", "172.16.0.1", 40000, 443, "S", nil))
+	handle(frame(t, "10.0.0.1", "192.168.0.1", 40000, 8443, "S", nil))
+	assert(t, len(backend.flows), 0)
+	// A connection without a ClientHello expires.
+	handle(frame(t, "10.0.0.3", "192.168.0.1", 40000, 443, "S", nil))
+	assert(t, len(backend.expire(now.Add(pcapFlowTimeout))), 0)
+	expired := backend.expire(now.Add(pcapFlowTimeout + time.Second))
+	assert(t, len(expired), 1)
+	assert(t, expired[0].SourceIP, "10.0.0.3")
+}
+
+func FuzzParseClientHelloSNI(f *testing.F) {
+	f.Add([]byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		parseClientHelloSNI(payload)
+	})
+}
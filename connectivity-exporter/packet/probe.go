@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"k8s.io/klog/v2"
+
+	"m/events"
+	"m/metrics"
+)
+
+// probeRequest asks TrackConnections to run the frames of a probe
+// through the current program between two windows.
+type probeRequest struct {
+	sourceIP string
+	frames   [][]byte
+	// incs receives the increments of the first window accounting
+	// connections of the source IP.
+	incs chan []*metrics.Inc
+	done chan error
+}
+
+// Probe runs the frames through the current eBPF program, as if they
+// were captured on its network interface, and returns the increments
+// of the first window accounting connections from the source IP. The
+// frames are Ethernet frames of connections between the source IP as
+// the client and servers captured by the filter.
+//
+// The increments of the source IP, also the later ones of its carried
+// over failures, are withheld from the metrics, the observers and the
+// failure events, so the source IP must not be used by any real client.
+func (s *NetworkDataSource) Probe(ctx context.Context, sourceIP string, frames [][]byte) ([]*metrics.Inc, error) {
+	s.mutex.RLock()
+	capturing := s.ebpfConfig != nil
+	s.mutex.RUnlock()
+	if !capturing {
+		return nil, errors.New("probes are only supported when capturing packets")
+	}
+	req := &probeRequest{sourceIP: sourceIP, frames: frames, incs: make(chan []*metrics.Inc, 1), done: make(chan error, 1)}
+	select {
+	case s.probes <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := <-req.done; err != nil {
+		return nil, err
+	}
+	// The connections are accounted after the accounting delay.
+	timeout := time.NewTimer(s.AccountingDelay() + 2*s.Resolution())
+	defer timeout.Stop()
+	select {
+	case incs := <-req.incs:
+		return incs, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("the connections from %s were not accounted", sourceIP)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runProbe runs the frames of the probe through the current program.
+// It is called by TrackConnections between two windows. The entries
+// of the maps keyed by the IPs of the probe, which are not accounted
+// per connection, are restored afterwards.
+func (s *NetworkDataSource) runProbe(req *probeRequest) error {
+	s.mutex.RLock()
+	ec := s.ebpfConfig
+	s.mutex.RUnlock()
+	ips, err := probeIPs(req.frames)
+	if err != nil {
+		return err
+	}
+	var restores []func()
+	for _, m := range []*ebpf.Map{ec.destTTLMap, ec.ttlAnomalyMap} {
+		for _, ip := range ips {
+			restores = append(restores, keepEntry(m, ip))
+		}
+	}
+	restores = append(restores, keepInterfaces(ec.interfacePacketsMap))
+	defer func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}()
+
+	if s.probeSources == nil {
+		s.probeSources = make(map[string]struct{})
+	}
+	s.probeSources[req.sourceIP] = struct{}{}
+	s.probe = req
+	for _, frame := range req.frames {
+		// The first 14 bytes are not passed to the program.
+		if _, _, err := ec.prog.Test(append(make([]byte, 14), frame...)); err != nil {
+			s.probe = nil
+			return fmt.Errorf("running the probe: %w", err)
+		}
+	}
+	return nil
+}
+
+// withholdProbes removes the increments and failure events of the
+// probe source IPs. The increments of a window with connections from
+// the source IP of the running probe are handed over to it.
+func (s *NetworkDataSource) withholdProbes(incs []*metrics.Inc, failures []*events.Failure) ([]*metrics.Inc, []*events.Failure) {
+	if len(s.probeSources) == 0 {
+		return incs, failures
+	}
+	var kept, probed []*metrics.Inc
+	var connections float64
+	for _, inc := range incs {
+		if _, ok := s.probeSources[inc.SourceIP]; !ok {
+			kept = append(kept, inc)
+			continue
+		}
+		if s.probe != nil && inc.SourceIP == s.probe.sourceIP {
+			probed = append(probed, inc)
+			connections += inc.SuccessfulConnections + inc.RejectedConnections
+		}
+	}
+	if connections > 0 {
+		s.probe.incs <- probed
+		s.probe = nil
+	}
+	var keptFailures []*events.Failure
+	for _, f := range failures {
+		if _, ok := s.probeSources[f.SourceIP]; !ok {
+			keptFailures = append(keptFailures, f)
+		}
+	}
+	return kept, keptFailures
+}
+
+// probeIPs returns the IPv4 addresses of the frames.
+func probeIPs(frames [][]byte) ([][4]byte, error) {
+	seen := make(map[[4]byte]bool)
+	var ips [][4]byte
+	for _, frame := range frames {
+		p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+		ip, ok := p.NetworkLayer().(*layers.IPv4)
+		if !ok {
+			return nil, errors.New("the probe frames must be IPv4 packets")
+		}
+		for _, addr := range []gopacket.Endpoint{ip.NetworkFlow().Src(), ip.NetworkFlow().Dst()} {
+			var key [4]byte
+			copy(key[:], addr.Raw())
+			if !seen[key] {
+				seen[key] = true
+				ips = append(ips, key)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// keepEntry returns the function restoring the entry of the key, or
+// deleting it if there is none yet.
+func keepEntry(m *ebpf.Map, key [4]byte) func() {
+	var value []byte
+	if err := m.Lookup(&key, &value); err != nil {
+		return func() {
+			if err := m.Delete(&key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				klog.Warningf("Failed to delete the probe entry of map %s: %v", m, err)
+			}
+		}
+	}
+	return func() {
+		if err := m.Put(&key, value); err != nil {
+			klog.Warningf("Failed to restore the entry of map %s: %v", m, err)
+		}
+	}
+}
+
+// keepInterfaces returns the function deleting the counters of the
+// network interfaces seen first since, i.e. of the probe.
+func keepInterfaces(m *ebpf.Map) func() {
+	before := interfaceIndexes(m)
+	return func() {
+		for ifindex := range interfaceIndexes(m) {
+			if _, ok := before[ifindex]; ok {
+				continue
+			}
+			ifindex := ifindex
+			if err := m.Delete(&ifindex); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				klog.Warningf("Failed to delete the probe entry of map %s: %v", m, err)
+			}
+		}
+	}
+}
+
+// interfaceIndexes returns the keys of the interface packets map.
+func interfaceIndexes(m *ebpf.Map) map[uint32]struct{} {
+	indexes := make(map[uint32]struct{})
+	var ifindex uint32
+	var perCPU []interfaceCounts
+	entries := m.Iterate()
+	for entries.Next(&ifindex, &perCPU) {
+		indexes[ifindex] = struct{}{}
+	}
+	return indexes
+}
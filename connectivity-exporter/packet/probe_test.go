@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+
+	"m/events"
+	"m/metrics"
+)
+
+func TestWithholdProbes(t *testing.T) {
+	const probeIP = "198.18.0.1"
+	regular := &metrics.Inc{SNI: "db.example.com", SourceIP: "10.0.0.1", SuccessfulConnections: 1}
+	regularFailure := &events.Failure{SNI: "db.example.com", SourceIP: "10.0.0.1"}
+	dataSource := &NetworkDataSource{}
+
+	// Nothing is withheld without probes.
+	incs, failures := dataSource.withholdProbes([]*metrics.Inc{regular}, []*events.Failure{regularFailure})
+	assert(t, incs, []*metrics.Inc{regular})
+	assert(t, failures, []*events.Failure{regularFailure})
+
+	req := &probeRequest{sourceIP: probeIP, incs: make(chan []*metrics.Inc, 1)}
+	dataSource.probeSources = map[string]struct{}{probeIP: {}}
+	dataSource.probe = req
+
+	// A window without connections of the probe, e.g. with the carried
+	// over failures of a previous one, is withheld, but not handed over.
+	idle := &metrics.Inc{SNI: "selftest", SourceIP: probeIP, FailedSeconds: 1}
+	probeFailure := &events.Failure{SNI: "selftest", SourceIP: probeIP}
+	incs, failures = dataSource.withholdProbes([]*metrics.Inc{regular, idle}, []*events.Failure{regularFailure, probeFailure})
+	assert(t, incs, []*metrics.Inc{regular})
+	assert(t, failures, []*events.Failure{regularFailure})
+	assert(t, len(req.incs), 0)
+
+	succeeded := &metrics.Inc{SNI: "selftest", SourceIP: probeIP, SuccessfulConnections: 1}
+	rejected := &metrics.Inc{SNI: UnknownSNI, SourceIP: probeIP, RejectedConnections: 1}
+	incs, _ = dataSource.withholdProbes([]*metrics.Inc{succeeded, regular, rejected}, nil)
+	assert(t, incs, []*metrics.Inc{regular})
+	assert(t, <-req.incs, []*metrics.Inc{succeeded, rejected})
+
+	// The later increments of the source IP are still withheld.
+	incs, _ = dataSource.withholdProbes([]*metrics.Inc{idle, regular}, nil)
+	assert(t, incs, []*metrics.Inc{regular})
+	if dataSource.probe != nil {
+		t.Errorf("Got probe %+v still running", dataSource.probe)
+	}
+}
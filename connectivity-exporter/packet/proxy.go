@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import "fmt"
+
+// SetProxySourceIP makes the eBPF program account the connections
+// starting with a PROXY protocol header of a load balancer for the
+// original client of the header instead of the load balancer. The
+// headers are skipped before the ClientHello is parsed either way.
+func (s *NetworkDataSource) SetProxySourceIP(enabled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return nil
+	}
+	capture := s.setupOptions().capture()
+	capture.proxySourceIP = enabled
+	if err := initCaptureMap(s.ebpfConfig.captureMap, capture); err != nil {
+		return fmt.Errorf("initializing capture map: %w", err)
+	}
+	s.proxySourceIP = enabled
+	return nil
+}
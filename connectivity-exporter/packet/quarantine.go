@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"k8s.io/klog/v2"
+
+	"m/events"
+	"m/metrics"
+)
+
+const (
+	// maxExactCount is the largest count added to the float64
+	// counters without losing precision. A larger count is usually a
+	// decremented zero wrapping around.
+	maxExactCount = 1 << 53
+	// maxConnectionsPerSecond is the largest number of connections
+	// of a connection key accounted in one second. The eBPF program
+	// cannot track more, the connections map is much smaller.
+	maxConnectionsPerSecond = 1 << 20
+)
+
+// Reasons of quarantined stats.
+const (
+	quarantineOverflow     = "overflow"
+	quarantineImplausible  = "implausible"
+	quarantineInconsistent = "inconsistent"
+	// quarantineMalformed entries cannot be decoded at all.
+	quarantineMalformed = "malformed"
+)
+
+type count struct {
+	name  string
+	value uint64
+}
+
+// quarantineReason checks whether the stats of a second are plausible
+// and returns why they are not, or an empty string. Stats left behind
+// in a re-adopted map, e.g. by a program with another layout, or a
+// counter decremented below zero, would otherwise add impossible spikes
+// to the counters, which never go away.
+func quarantineReason(s sniStats) (reason, detail string) {
+	// Every connection is counted with exactly one outcome, the
+	// properties are counted for the same connections.
+	properties := []count{
+		{"handshakes_abandoned", s.handshakesAbandoned},
+		{"handshakes_only", s.handshakesOnly},
+		{"handshakes_failed", s.handshakesFailed},
+		{"established_resets", s.establishedResets},
+		{"certificate_requests", s.certificateRequests},
+		{"ecn_requested", s.congestion.ecnRequested},
+		{"ecn_accepted", s.congestion.ecnAccepted},
+	}
+	counts := append([]count{
+		{"succeeded_connections", s.succeededConnections},
+		{"failed_connections", s.failedConnections},
+		{"middlebox_resets", s.middleboxResets},
+		{"network_rejections", s.networkRejections()},
+		{"ce_packets", s.congestion.cePackets},
+		{"ece_packets", s.congestion.ecePackets},
+		{"cwr_packets", s.congestion.cwrPackets},
+	}, properties...)
+	for _, c := range counts {
+		if c.value >= maxExactCount {
+			return quarantineOverflow, fmt.Sprintf("%s is %d", c.name, c.value)
+		}
+	}
+
+	// The outcomes are below maxExactCount, so their sum cannot
+	// overflow.
+	connections := s.succeededConnections + s.failedConnections + s.middleboxResets + s.networkRejections()
+	if connections > maxConnectionsPerSecond {
+		return quarantineImplausible, fmt.Sprintf("%d connections in one second", connections)
+	}
+
+	for _, c := range properties {
+		if c.value > connections {
+			return quarantineInconsistent, fmt.Sprintf("%s is %d, but only %d connections were counted", c.name, c.value, connections)
+		}
+	}
+	if s.congestion.ecnAccepted > s.congestion.ecnRequested {
+		return quarantineInconsistent, fmt.Sprintf("ecn_accepted is %d, but ecn_requested only %d", s.congestion.ecnAccepted, s.congestion.ecnRequested)
+	}
+	if s.certificateRequestFailures > s.certificateRequests {
+		return quarantineInconsistent, fmt.Sprintf("certificate_request_failures is %d, but certificate_requests only %d", s.certificateRequestFailures, s.certificateRequests)
+	}
+	return "", ""
+}
+
+// maxQuarantinedSnapshots is the number of map snapshots dumped by a
+// process. The windows panicking beyond it are only counted, so a bug
+// panicking in every window does not fill the disk.
+const maxQuarantinedSnapshots = 10
+
+// quarantinedSnapshot is a quarantined map snapshot with the value of
+// the panic. The panic is ignored by the replay.
+type quarantinedSnapshot struct {
+	*mapSnapshot
+	Panic string `json:"panic"`
+}
+
+// SetQuarantineDir sets the directory the map snapshots of the windows
+// whose accounting panicked are dumped to, the temporary directory if
+// it is empty.
+func (s *NetworkDataSource) SetQuarantineDir(dir string) {
+	s.quarantineDir = dir
+}
+
+// accountSafely accounts the snapshot like State.accountSnapshot, but
+// recovers from a panic of the accounting, e.g. over a malformed map
+// entry. The snapshot is then dumped to the quarantine directory,
+// nothing of the window is accounted and the keys of all its
+// connections are returned, so they are deleted and do not panic again
+// in the next window. The state may be inconsistent after a panic, the
+// caller replaces it with resetState if quarantined is true.
+func (s *NetworkDataSource) accountSafely(state *State, snapshot *mapSnapshot) (incs []*metrics.Inc, failures []*events.Failure, oldKeys [][]byte, quarantined bool, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		klog.Errorf("Accounting the window at ticker clock %d panicked: %v\n%s", snapshot.TickerClock, r, debug.Stack())
+		metrics.IncQuarantinedWindows()
+		if filename, err := s.quarantine(snapshot, r); err != nil {
+			klog.Errorf("Failed to quarantine the map snapshot: %v", err)
+		} else if filename != "" {
+			klog.Errorf("Quarantined the map snapshot to %s, it can be replayed with -replay-map-snapshots", filename)
+		}
+		if state.journal != nil {
+			state.journal.window = nil
+		}
+		oldKeys = make([][]byte, len(snapshot.Connections))
+		for i, e := range snapshot.Connections {
+			oldKeys[i] = e.Key
+		}
+		incs, failures, quarantined, err = nil, nil, true, nil
+	}()
+	incs, failures, oldKeys, err = state.accountSnapshot(snapshot)
+	return incs, failures, oldKeys, false, err
+}
+
+// quarantine dumps the snapshot as a line of recorded map snapshots and
+// returns the name of the file, or an empty string after
+// maxQuarantinedSnapshots.
+func (s *NetworkDataSource) quarantine(snapshot *mapSnapshot, r interface{}) (string, error) {
+	if s.quarantined >= maxQuarantinedSnapshots {
+		return "", nil
+	}
+	s.quarantined++
+	dir := s.quarantineDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("quarantined-snapshot-%d-%s.json", snapshot.TickerClock, snapshot.Time.UTC().Format("20060102T150405Z")))
+	b, err := json.Marshal(quarantinedSnapshot{mapSnapshot: snapshot, Panic: fmt.Sprint(r)})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filename, append(b, '\n'), 0o644); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// resetState returns a new state for TrackConnections after a panic.
+// The SNIs with metrics are kept, so their metrics still expire.
+func (s *NetworkDataSource) resetState(state *State) *State {
+	fresh := s.newTrackingState(state.clock)
+	fresh.snis = state.snis
+	return fresh
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"m/config"
+)
+
+func TestQuarantine(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		stats sniStats
+		want  string
+	}{
+		{"plausible", sniStats{succeededConnections: 3, failedConnections: 1, handshakesFailed: 1}, ""},
+		{"wrapped around", sniStats{succeededConnections: ^uint64(0)}, quarantineOverflow},
+		{"spike", sniStats{succeededConnections: maxConnectionsPerSecond + 1}, quarantineImplausible},
+		{"more properties than connections", sniStats{succeededConnections: 1, handshakesAbandoned: 2}, quarantineInconsistent},
+		{"accepted without request", sniStats{succeededConnections: 1, congestion: congestionSignals{ecnAccepted: 1}}, quarantineInconsistent},
+		{"certificate request failures without requests", sniStats{failedConnections: 2, certificateRequests: 1, certificateRequestFailures: 2}, quarantineInconsistent},
+	} {
+		if got, _ := quarantineReason(tc.stats); got != tc.want {
+			t.Errorf("%s: got reason %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQuarantinedStatsAreNotAccounted(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{}), nil)
+	good := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	bad := ConnKey{sourceIP: "10.0.0.2", destIP: "192.168.0.1", sni: "api.example.com"}
+	plausible := statsEntry(t, good, sniStats{succeededConnections: 2})
+	snapshot := &mapSnapshot{TickerClock: 22, Stats: []rawEntry{
+		plausible,
+		statsEntry(t, bad, sniStats{failedConnections: ^uint64(0)}),
+		// A key of an older layout without the destination.
+		{Key: []byte{10, 0, 0, 3, 'a', 'p', 'i'}, Value: plausible.Value},
+	}}
+
+	incs, _, _, err := state.accountSnapshot(snapshot)
+	if err != nil {
+		t.Fatalf("accountSnapshot() = %v", err)
+	}
+	if len(incs) != 1 || incs[0].SourceIP != good.sourceIP || incs[0].SuccessfulConnections != 2 {
+		t.Errorf("Only the plausible stats should be accounted: %+v", incs)
+	}
+}
+
+func TestAccountingPanicIsQuarantined(t *testing.T) {
+	tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	connection, err := encodeConnection(tp, &tupleData{state: SYN_RECEIVED, sni: "api.example.com", sourceIP: tp.srcIP.To4(), destIP: tp.dstIP.To4()})
+	if err != nil {
+		t.Fatalf("encodeConnection: %v", err)
+	}
+	dir := t.TempDir()
+	s := &NetworkDataSource{quarantineDir: dir}
+	state := newState(nil, nil)
+	state.snis["api.example.com"] = time.Now()
+	state.classifiers = []Classifier{{Name: "panicking", Classify: func(*ClassifiedConnection) Classification {
+		panic("malformed connection")
+	}}}
+
+	snapshot := &mapSnapshot{TickerClock: 21, Connections: []rawEntry{connection}}
+	incs, _, oldKeys, quarantined, err := s.accountSafely(state, snapshot)
+	if err != nil || !quarantined {
+		t.Fatalf("accountSafely() = %v, %v, want a quarantined window", quarantined, err)
+	}
+	assert(t, len(incs), 0)
+	// The connection is deleted, so it does not panic again.
+	assert(t, oldKeys, [][]byte{connection.Key})
+
+	// The snapshot can be replayed.
+	files, err := filepath.Glob(filepath.Join(dir, "quarantined-snapshot-21-*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got quarantined snapshots %v, %v, want one", files, err)
+	}
+	source, err := NewReplayDataSource(files[0], nil)
+	if err != nil {
+		t.Fatalf("NewReplayDataSource: %v", err)
+	}
+	defer source.Close()
+	replayed, err := source.readSnapshot(0, time.Now())
+	if err != nil {
+		t.Fatalf("readSnapshot: %v", err)
+	}
+	assert(t, replayed.Connections, snapshot.Connections)
+
+	fresh := s.resetState(state)
+	assert(t, fresh.snis, state.snis)
+	assert(t, len(fresh.classifiers), 0)
+}
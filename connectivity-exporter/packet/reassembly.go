@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+const (
+	// maxPendingHellos bounds the ClientHellos being reassembled.
+	maxPendingHellos = 1024
+	// pendingHelloTimeout is the time after which an incomplete
+	// ClientHello is dropped.
+	pendingHelloTimeout = 10 * time.Second
+	// maxClientHelloRecord is the largest TLS record of a ClientHello.
+	maxClientHelloRecord = 5 + 1<<14
+)
+
+// pendingHello is a ClientHello split over several segments.
+type pendingHello struct {
+	data []byte
+	// length is the length of its TLS record, nextSeq the sequence
+	// number of the next segment.
+	length  int
+	nextSeq uint32
+	started time.Time
+}
+
+// helloReassembler reassembles the ClientHellos split over several
+// segments from the segments the eBPF program could not parse an SNI
+// from. Only the segments in order are reassembled, a lost segment
+// drops the ClientHello.
+type helloReassembler struct {
+	pending map[flowKey]*pendingHello
+}
+
+func newHelloReassembler() *helloReassembler {
+	return &helloReassembler{pending: make(map[flowKey]*pendingHello)}
+}
+
+// add adds a segment of the client. It returns the SNI once the
+// ClientHello of the connection is complete.
+func (r *helloReassembler) add(key flowKey, seq uint32, payload []byte, now time.Time) (string, bool) {
+	if len(payload) == 0 {
+		return "", false
+	}
+	p, ok := r.pending[key]
+	if !ok {
+		// A segment starting a ClientHello: the TLS record header
+		// and the handshake type.
+		if len(payload) < 6 || payload[0] != 0x16 || payload[5] != 0x01 {
+			return "", false
+		}
+		length := 5 + int(binary.BigEndian.Uint16(payload[3:5]))
+		if length > maxClientHelloRecord {
+			metrics.IncClientHelloReassemblies("dropped")
+			return "", false
+		}
+		if len(r.pending) >= maxPendingHellos {
+			metrics.IncClientHelloReassemblies("dropped")
+			return "", false
+		}
+		p = &pendingHello{data: make([]byte, 0, length), length: length, nextSeq: seq, started: now}
+		r.pending[key] = p
+	}
+	switch {
+	case seq == p.nextSeq:
+	case int32(seq-p.nextSeq) < 0:
+		// A retransmission of a segment already added.
+		return "", false
+	default:
+		delete(r.pending, key)
+		metrics.IncClientHelloReassemblies("out_of_order")
+		return "", false
+	}
+	p.data = append(p.data, payload...)
+	p.nextSeq += uint32(len(payload))
+	if len(p.data) < p.length {
+		return "", false
+	}
+	delete(r.pending, key)
+	sni, ok := parseClientHelloSNI(p.data[:p.length])
+	if !ok {
+		metrics.IncClientHelloReassemblies("no_sni")
+		return "", false
+	}
+	metrics.IncClientHelloReassemblies("reassembled")
+	return sni, true
+}
+
+// expire drops the ClientHellos which were not completed in time.
+func (r *helloReassembler) expire(now time.Time) {
+	for key, p := range r.pending {
+		if now.Sub(p.started) > pendingHelloTimeout {
+			delete(r.pending, key)
+			metrics.IncClientHelloReassemblies("expired")
+		}
+	}
+}
+
+// ReassembleClientHellos makes the eBPF program pass the segments
+// whose SNI it cannot parse on to userspace and reassembles the
+// ClientHellos split over several segments from them. The SNIs are
+// handed back to the eBPF program, which applies them to their
+// connections with the next packet.
+func (s *NetworkDataSource) ReassembleClientHellos(ctx context.Context, wg *sync.WaitGroup) error {
+	// The segments are passed on completely.
+	if err := s.enableForward(forwardConfig{enabled: true, snapLength: 0xffff}); err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r := newHelloReassembler()
+		var (
+			eth     layers.Ethernet
+			vlan    layers.Dot1Q
+			ip      layers.IPv4
+			tcp     layers.TCP
+			payload gopacket.Payload
+		)
+		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &vlan, &ip, &tcp, &payload)
+		parser.IgnoreUnsupported = true
+		decoded := make([]gopacket.LayerType, 0, 5)
+		lastExpiry := time.Now()
+		buf := make([]byte, 0xffff)
+		for ctx.Err() == nil {
+			err := s.capturePackets(buf, func(data []byte, now time.Time) error {
+				// The error of a truncated or unsupported layer is
+				// ignored, the decoded layers are checked instead.
+				_ = parser.DecodeLayers(data, &decoded)
+				hasTCP := false
+				for _, l := range decoded {
+					hasTCP = hasTCP || l == layers.LayerTypeTCP
+				}
+				if !hasTCP || ip.SrcIP.To4() == nil || ip.DstIP.To4() == nil {
+					return nil
+				}
+				key := flowKey{sourcePort: uint16(tcp.SrcPort), destPort: uint16(tcp.DstPort)}
+				copy(key.sourceIP[:], ip.SrcIP.To4())
+				copy(key.destIP[:], ip.DstIP.To4())
+				sni, ok := r.add(key, tcp.Seq, tcp.Payload, now)
+				if !ok {
+					return nil
+				}
+				if err := s.putReassembledSNI(key, sni); err != nil {
+					klog.Errorf("Failed to hand over the reassembled SNI %q: %v", sni, err)
+				}
+				return nil
+			})
+			if err != nil {
+				klog.Errorf("Failed to reassemble ClientHellos: %v", err)
+				return
+			}
+			if now := time.Now(); now.Sub(lastExpiry) > time.Second {
+				r.expire(now)
+				lastExpiry = now
+			}
+		}
+	}()
+	return nil
+}
+
+// putReassembledSNI hands the SNI of the connection over to the eBPF
+// program, truncated like the SNIs it parses itself. The caller holds
+// the attachment.
+func (s *NetworkDataSource) putReassembledSNI(key flowKey, sni string) error {
+	if s.ebpfConfig == nil {
+		return errors.New("data source is closed")
+	}
+	maxLength := int(s.maxSNILength)
+	if maxLength == 0 {
+		maxLength = MaxSNILength
+	}
+	b := []byte(sni)
+	if len(b) > maxLength {
+		b = b[:maxLength]
+		b[len(b)-1] = C.SNI_TRUNCATED_MARKER
+	}
+	var value [C.TLS_MAX_SERVER_NAME_LEN]byte
+	copy(value[:], b)
+	tp := tuple{
+		srcIP:   append(make([]byte, 12), key.sourceIP[:]...),
+		dstIP:   append(make([]byte, 12), key.destIP[:]...),
+		srcPort: key.sourcePort,
+		dstPort: key.destPort,
+	}
+	k := tp.toBytes()
+	return s.ebpfConfig.reassembledSNIsMap.Put(unsafe.Pointer(&k[0]), unsafe.Pointer(&value[0]))
+}
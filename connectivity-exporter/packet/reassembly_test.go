@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHelloReassembler(t *testing.T) {
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	key := flowKey{sourceIP: [4]byte{10, 0, 0, 1}, destIP: [4]byte{192, 168, 0, 1}, sourcePort: 40000, destPort: 443}
+	for _, e := range loadClientHelloCorpus(t) {
+		if e.SNI == "" {
+			continue
+		}
+		t.Run(e.Stack, func(t *testing.T) {
+			r := newHelloReassembler()
+			// Split into three segments, the second one retransmitted.
+			first, second := len(e.payload)/3, 2*len(e.payload)/3
+			const seq = 1000
+			for _, segment := range []struct {
+				start, end int
+			}{{0, first}, {first, second}, {first, second}} {
+				if _, ok := r.add(key, seq+uint32(segment.start), e.payload[segment.start:segment.end], now); ok {
+					t.Fatalf("SNI before the last segment")
+				}
+			}
+			sni, ok := r.add(key, seq+uint32(second), e.payload[second:], now)
+			if !ok || sni != e.SNI {
+				t.Errorf("got SNI %q, %t, want %q", sni, ok, e.SNI)
+			}
+			assert(t, len(r.pending), 0)
+		})
+	}
+
+	t.Run("lost segment", func(t *testing.T) {
+		payload := loadClientHelloCorpus(t)[0].payload
+		r := newHelloReassembler()
+		r.add(key, 0, payload[:10], now)
+		if _, ok := r.add(key, 20, payload[20:], now); ok {
+			t.Errorf("SNI after a lost segment")
+		}
+		assert(t, len(r.pending), 0)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		payload := loadClientHelloCorpus(t)[0].payload
+		r := newHelloReassembler()
+		r.add(key, 0, payload[:10], now)
+		r.expire(now.Add(pendingHelloTimeout))
+		assert(t, len(r.pending), 1)
+		r.expire(now.Add(pendingHelloTimeout + time.Second))
+		assert(t, len(r.pending), 0)
+	})
+}
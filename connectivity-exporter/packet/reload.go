@@ -0,0 +1,318 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// drainPeriod returns the number of windows a previous program is
+// read after a reload at the resolution. Afterwards, all its
+// connections are accounted.
+func drainPeriod(resolution time.Duration) int {
+	return int(statsSlots(resolution)) + 1
+}
+
+// reloadRequest asks TrackConnections to swap the source of the
+// snapshots between two windows.
+type reloadRequest struct {
+	source snapshotSource
+	// swap attaches the new program, replaces the resources of the
+	// data source and returns the function releasing the previous
+	// ones once they are drained. On error, the previous program
+	// keeps running.
+	swap func() (release func(), err error)
+	done chan error
+}
+
+// drainingSource is the source of a previous program. The program is
+// detached, but its maps still hold the connections of the last
+// windows.
+type drainingSource struct {
+	source    snapshotSource
+	remaining int
+	release   func()
+}
+
+// Reload loads the eBPF program again with the given network
+// interface, CIDRs and ports, and swaps it in between two windows of
+// TrackConnections. The new program is only attached then, right after
+// the previous one is detached. The accounting state is kept and the
+// connections captured by the previous program are still accounted,
+// so the windows remain continuous. On error, the running program is
+// kept.
+func (s *NetworkDataSource) Reload(ctx context.Context, networkInterface string, cidrs, ports map[string]struct{}) error {
+	s.mutex.RLock()
+	capturing, opts := s.ebpfConfig != nil, s.setupOptions()
+	s.mutex.RUnlock()
+	if !capturing {
+		return errors.New("reloading is only supported when capturing packets")
+	}
+	ec, err := newEBPFProgram(networkInterface, cidrs, ports, opts)
+	if err != nil {
+		return err
+	}
+	req := &reloadRequest{
+		source: &ebpfSource{config: ec},
+		swap: func() (func(), error) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			previousConfig, previousAttachment, previousInterface := s.ebpfConfig, s.attachment, s.networkInterface
+			var attachment *ebpfAttachment
+			err := detachAndAttach(previousAttachment.Close,
+				func() (err error) {
+					attachment, err = attachEBPFProgram(ec, networkInterface, opts)
+					return err
+				},
+				func() (err error) {
+					s.attachment, err = attachEBPFProgram(previousConfig, previousInterface, opts)
+					if err != nil {
+						s.attachment = &ebpfAttachment{}
+					}
+					return err
+				})
+			if err != nil {
+				ec.Close()
+				return nil, err
+			}
+			s.networkInterface, s.cidrs, s.ports = networkInterface, cidrs, ports
+			s.ebpfConfig, s.attachment = ec, attachment
+			return previousConfig.Close, nil
+		},
+		done: make(chan error, 1),
+	}
+	select {
+	case s.reloads <- req:
+	case <-ctx.Done():
+		ec.Close()
+		return ctx.Err()
+	}
+	if err := <-req.done; err != nil {
+		return err
+	}
+	klog.Infof("Reloaded the eBPF program on %s", networkInterface)
+	return nil
+}
+
+// detachAndAttach detaches the previous program right before the next
+// one is attached, so no connection is captured by both programs and
+// accounted twice. If the next program fails to attach, the previous
+// one is attached again.
+func detachAndAttach(detach func(), attach, reattach func() error) error {
+	detach()
+	if err := attach(); err != nil {
+		if reattachErr := reattach(); reattachErr != nil {
+			klog.Errorf("Failed to attach the previous program again, no connections are captured: %v", reattachErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Filter returns the network interface, the CIDRs and the ports the
+// current program captures the connections of.
+func (s *NetworkDataSource) Filter() (networkInterface string, cidrs, ports []string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.networkInterface, setToSortedList(s.cidrs), setToSortedList(s.ports)
+}
+
+// ReloadPlan are the changes a reload with another filter would apply.
+type ReloadPlan struct {
+	// Interface is set if the program is attached to another network
+	// interface.
+	Interface *InterfaceChange `json:"interface,omitempty"`
+	// Maps are the changes of the entries of the config maps.
+	Maps []MapChange `json:"maps"`
+}
+
+// InterfaceChange is the move of the program to another interface.
+type InterfaceChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MapChange are the keys added to and removed from a map.
+type MapChange struct {
+	Map     string   `json:"map"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// PlanReload validates the filter without reloading and returns the
+// changes Reload would apply. The keys are normalized like the entries
+// of the maps, e.g. a single IP is the CIDR with prefix length 32.
+func (s *NetworkDataSource) PlanReload(networkInterface string, cidrs, ports map[string]struct{}) (*ReloadPlan, error) {
+	if _, err := net.InterfaceByName(networkInterface); err != nil {
+		return nil, fmt.Errorf("invalid network interface %q: %w", networkInterface, err)
+	}
+	newCIDRs, err := cidrKeys(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	newPorts, err := portKeys(ports)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	currentInterface, currentCIDRs, currentPorts := s.networkInterface, s.cidrs, s.ports
+	s.mutex.RUnlock()
+	// The current filter was validated when it was loaded.
+	oldCIDRs, _ := cidrKeys(currentCIDRs)
+	oldPorts, _ := portKeys(currentPorts)
+
+	plan := &ReloadPlan{Maps: []MapChange{
+		diffKeys(BPF_CIDR_MAP_NAME, oldCIDRs, newCIDRs),
+		diffKeys(BPF_PORT_MAP_NAME, oldPorts, newPorts),
+	}}
+	if networkInterface != currentInterface {
+		plan.Interface = &InterfaceChange{From: currentInterface, To: networkInterface}
+	}
+	return plan, nil
+}
+
+func cidrKeys(cidrs map[string]struct{}) (map[string]struct{}, error) {
+	keys := make(map[string]struct{}, len(cidrs))
+	for h := range cidrs {
+		ip, size, err := parseIPSizeCIDR(h)
+		if err != nil {
+			return nil, err
+		}
+		keys[fmt.Sprintf("%s/%d", ip, size)] = struct{}{}
+	}
+	return keys, nil
+}
+
+func portKeys(ports map[string]struct{}) (map[string]struct{}, error) {
+	keys := make(map[string]struct{}, len(ports))
+	for p := range ports {
+		port, protocol, err := parsePort(p)
+		if err != nil {
+			return nil, err
+		}
+		key := strconv.FormatUint(uint64(port), 10)
+		switch protocol {
+		case C.PORT_PROTOCOL_HTTP:
+			key += PortSuffixHTTP
+		case C.PORT_PROTOCOL_UDP:
+			key += PortSuffixUDP
+		case C.PORT_PROTOCOL_SCTP:
+			key += PortSuffixSCTP
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, nil
+}
+
+func diffKeys(name string, old, new map[string]struct{}) MapChange {
+	c := MapChange{Map: name}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			c.Added = append(c.Added, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			c.Removed = append(c.Removed, k)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+	return c
+}
+
+func setToSortedList(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for item := range set {
+		out = append(out, item)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// swapSource swaps in the source of the request and starts draining
+// the current source. It is called by TrackConnections between two
+// windows.
+func (s *NetworkDataSource) swapSource(req *reloadRequest, tickerClock uint64) error {
+	// The ticker clock continues, so the age of the connections of
+	// both programs is comparable.
+	if err := req.source.setTickerClock(tickerClock); err != nil {
+		return err
+	}
+	release, err := req.swap()
+	if err != nil {
+		return err
+	}
+	s.draining = append(s.draining, &drainingSource{source: s.source, remaining: drainPeriod(s.resolution), release: release})
+	s.source = req.source
+	return nil
+}
+
+// readSnapshot reads the snapshot of the current source merged with
+// the completed connections and the stats of the draining sources.
+func (s *NetworkDataSource) readSnapshot(tickerClock uint64, now time.Time) (*mapSnapshot, error) {
+	snapshot, err := s.source.read(tickerClock, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range s.draining {
+		previous, err := d.source.read(tickerClock, now)
+		if err != nil {
+			klog.Errorf("reading map snapshot of a previous program: %v", err)
+			continue
+		}
+		snapshot.Connections = append(snapshot.Connections, completedConnections(previous.Connections)...)
+		snapshot.Stats = append(snapshot.Stats, previous.Stats...)
+	}
+	return snapshot, nil
+}
+
+// drain deletes the accounted connections from the draining sources
+// and releases the drained ones.
+func (s *NetworkDataSource) drain(accountedKeys [][]byte) {
+	draining := s.draining[:0]
+	for _, d := range s.draining {
+		d.source.deleteConnections(accountedKeys)
+		d.remaining--
+		if d.remaining > 0 {
+			draining = append(draining, d)
+			continue
+		}
+		d.release()
+	}
+	s.draining = draining
+}
+
+// completedConnections filters out the connections of a detached
+// program with an incomplete handshake. Their packets after the
+// reload are only seen by the new program, so their outcome is
+// unknown and they must not be accounted as failed.
+func completedConnections(entries []rawEntry) []rawEntry {
+	var out []rawEntry
+	for _, e := range entries {
+		_, data, err := decodeConnection(e)
+		if err != nil {
+			// Let the accounting report the error.
+			out = append(out, e)
+			continue
+		}
+		if data.state == SYN_RECEIVED || data.state == SYNACK_RECEIVED {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
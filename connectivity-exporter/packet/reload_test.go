@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"m/clock"
+	"m/metrics"
+)
+
+func TestReloadDrainsPreviousSource(t *testing.T) {
+	const sni = "api.example.com"
+	connection := func(srcIP string, state connState, tickerClock uint64) rawEntry {
+		tp := &tuple{srcIP: net.ParseIP(srcIP), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+		e, err := encodeConnection(tp, &tupleData{state: state, sni: sni, tickerClockFirstPacket: tickerClock})
+		if err != nil {
+			t.Fatalf("encodeConnection: %v", err)
+		}
+		return e
+	}
+	stats := func(srcIP string, s sniStats) []rawEntry {
+		return []rawEntry{statsEntry(t, ConnKey{sourceIP: srcIP, destIP: "192.168.0.1", sni: sni}, s)}
+	}
+
+	previous := &scriptedSource{
+		connections: []rawEntry{
+			connection("10.0.0.1", SNI_RECEIVED, 5),
+			// The handshake is completed after the reload, which
+			// only the new program sees.
+			connection("10.0.0.2", SYN_RECEIVED, 5),
+		},
+		stats: map[uint64][]rawEntry{15: stats("10.0.0.3", sniStats{failedConnections: 1})},
+	}
+	next := &scriptedSource{stats: map[uint64][]rawEntry{30: stats("10.0.0.4", sniStats{succeededConnections: 1})}}
+	dataSource := &NetworkDataSource{source: previous, reloads: make(chan *reloadRequest)}
+
+	clk := clock.NewFake(time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC))
+	incs := make(chan *metrics.Inc, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, clk, incs, nil)
+
+	for i := 0; i < 10; i++ {
+		clk.Tick(time.Second)
+	}
+	released := 0
+	req := &reloadRequest{
+		source: next,
+		swap:   func() (func(), error) { return func() { released++ }, nil },
+		done:   make(chan error, 1),
+	}
+	dataSource.reloads <- req
+	if err := <-req.done; err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	for i := 0; i < drainPeriod(DefaultResolution)+10; i++ {
+		clk.Tick(time.Second)
+	}
+	cancel()
+	wg.Wait()
+	close(incs)
+	assert(t, released, 1)
+	assert(t, len(dataSource.draining), 0)
+
+	type counts struct{ active, successful, rejected float64 }
+	got := map[string]counts{}
+	for inc := range incs {
+		c := got[inc.SourceIP]
+		c.active += inc.ActiveSeconds
+		c.successful += inc.SuccessfulConnections
+		c.rejected += inc.RejectedConnections
+		got[inc.SourceIP] = c
+	}
+	assert(t, got, map[string]counts{
+		"10.0.0.1": {active: 1, successful: 1},
+		"10.0.0.3": {active: 1, rejected: 1},
+		"10.0.0.4": {active: 1, successful: 1},
+	})
+}
+
+// capturingSource is a program on a fake network, it only captures the
+// connections while it is attached.
+type capturingSource struct {
+	mutex    sync.Mutex
+	attached bool
+	stats    []rawEntry
+}
+
+func (s *capturingSource) setAttached(attached bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attached = attached
+}
+
+func (s *capturingSource) capture(e rawEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.attached {
+		s.stats = append(s.stats, e)
+	}
+}
+
+func (s *capturingSource) read(tickerClock uint64, now time.Time) (*mapSnapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	s.stats = nil
+	return &mapSnapshot{Time: now, TickerClock: tickerClock, Stats: stats}, nil
+}
+
+func (s *capturingSource) deleteConnections([][]byte) {}
+
+func (s *capturingSource) setTickerClock(uint64) error { return nil }
+
+func TestReloadCapturesConnectionsOnce(t *testing.T) {
+	previous := &capturingSource{attached: true}
+	next := &capturingSource{}
+	connect := func(srcIP string) {
+		e := statsEntry(t, ConnKey{sourceIP: srcIP, destIP: "192.168.0.1", sni: "api.example.com"}, sniStats{succeededConnections: 1})
+		previous.capture(e)
+		next.capture(e)
+	}
+	dataSource := &NetworkDataSource{source: previous, reloads: make(chan *reloadRequest)}
+
+	clk := clock.NewFake(time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC))
+	incs := make(chan *metrics.Inc, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, clk, incs, nil)
+
+	clk.Tick(time.Second)
+	// The new program is loaded, but not attached before the swap.
+	req := &reloadRequest{
+		source: next,
+		swap: func() (func(), error) {
+			err := detachAndAttach(
+				func() { previous.setAttached(false) },
+				func() error { next.setAttached(true); return nil },
+				func() error { previous.setAttached(true); return nil })
+			return func() {}, err
+		},
+		done: make(chan error, 1),
+	}
+	connect("10.0.0.1")
+	dataSource.reloads <- req
+	if err := <-req.done; err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	connect("10.0.0.2")
+	for i := 0; i < drainPeriod(DefaultResolution)+10; i++ {
+		clk.Tick(time.Second)
+	}
+	cancel()
+	wg.Wait()
+	close(incs)
+
+	got := map[string]float64{}
+	for inc := range incs {
+		got[inc.SourceIP] += inc.SuccessfulConnections
+	}
+	assert(t, got, map[string]float64{"10.0.0.1": 1, "10.0.0.2": 1})
+}
+
+func TestDetachAndAttach(t *testing.T) {
+	var calls []string
+	record := func(call string, err error) func() error {
+		return func() error {
+			calls = append(calls, call)
+			return err
+		}
+	}
+	detach := func() { calls = append(calls, "detach") }
+
+	if err := detachAndAttach(detach, record("attach", nil), record("reattach", nil)); err != nil {
+		t.Fatalf("detachAndAttach() = %v", err)
+	}
+	assert(t, calls, []string{"detach", "attach"})
+
+	// The previous program keeps running if the new one fails to attach.
+	calls = nil
+	if err := detachAndAttach(detach, record("attach", errors.New("no such device")), record("reattach", nil)); err == nil {
+		t.Fatal("detachAndAttach() should fail")
+	}
+	assert(t, calls, []string{"detach", "attach", "reattach"})
+}
+
+func TestPlanReload(t *testing.T) {
+	dataSource := &NetworkDataSource{networkInterface: "lo", cidrs: AsSet("10.0.0.0/8,192.168.0.1"), ports: AsSet("443")}
+	plan, err := dataSource.PlanReload("lo", AsSet("10.1.2.3/8,172.16.0.0/12"), AsSet("443,0443,8443,080/http,051820/udp,3868/sctp"))
+	if err != nil {
+		t.Fatalf("PlanReload() = %v", err)
+	}
+	assert(t, plan, &ReloadPlan{Maps: []MapChange{
+		{Map: BPF_CIDR_MAP_NAME, Added: []string{"172.16.0.0/12"}, Removed: []string{"192.168.0.1/32"}},
+		{Map: BPF_PORT_MAP_NAME, Added: []string{"3868/sctp", "51820/udp", "80/http", "8443"}},
+	}})
+
+	for _, tc := range []struct{ networkInterface, cidrs, ports string }{
+		{"no-such-interface0", "10.0.0.0/8", "443"},
+		{"lo", "10.0.0.0/33", "443"},
+		{"lo", "10.0.0.0/8", "65536"},
+		{"lo", "10.0.0.0/8", "80/quic"},
+	} {
+		if _, err := dataSource.PlanReload(tc.networkInterface, AsSet(tc.cidrs), AsSet(tc.ports)); err == nil {
+			t.Errorf("PlanReload(%q, %q, %q) should fail", tc.networkInterface, tc.cidrs, tc.ports)
+		}
+	}
+}
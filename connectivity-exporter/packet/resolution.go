@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"fmt"
+	"time"
+
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// The resolutions of the accounting, the width of its windows. The
+// seconds counters add the width of a window per window, so they keep
+// counting seconds at any resolution.
+const (
+	DefaultResolution = time.Second
+	MinResolution     = 100 * time.Millisecond
+	MaxResolution     = 10 * time.Second
+)
+
+// statsPeriod is the time the slots of the stats map hold the data of
+// at any resolution, so late packets are taken into account like at
+// the default resolution.
+const statsPeriod = C.STATS_SECONDS_COUNT * time.Second
+
+// ValidateResolution checks that the resolution is within the limits
+// and that the windows align with the seconds, either as fractions or
+// as multiples of a second.
+func ValidateResolution(resolution time.Duration) error {
+	if resolution < MinResolution || resolution > MaxResolution {
+		return fmt.Errorf("invalid resolution %v, expected %v to %v", resolution, MinResolution, MaxResolution)
+	}
+	if time.Second%resolution != 0 && resolution%time.Second != 0 {
+		return fmt.Errorf("invalid resolution %v, expected a fraction or a multiple of a second", resolution)
+	}
+	return nil
+}
+
+// orDefault returns the default resolution for the zero resolution.
+func orDefault(resolution time.Duration) time.Duration {
+	if resolution == 0 {
+		return DefaultResolution
+	}
+	return resolution
+}
+
+// statsSlots returns the number of slots of the stats map at the
+// resolution.
+func statsSlots(resolution time.Duration) uint64 {
+	resolution = orDefault(resolution)
+	slots := uint64((statsPeriod + resolution - 1) / resolution)
+	if slots < 2 {
+		slots = 2
+	}
+	if slots > C.STATS_MAX_SLOTS {
+		slots = C.STATS_MAX_SLOTS
+	}
+	return slots
+}
+
+// accountingDelay returns the approximate time between a connection
+// and its accounting at the resolution.
+func accountingDelay(resolution time.Duration) time.Duration {
+	resolution = orDefault(resolution)
+	return time.Duration(statsSlots(resolution)+1) * resolution
+}
+
+// SetResolution sets the width of the accounting windows, which has to
+// match the interval of the ticks passed to TrackConnections. The
+// slots of the stats map are scaled, so they hold about the same time
+// of data at any resolution. It has to be called before tracking the
+// connections and is kept across reloads. When replaying, it has to
+// match the resolution of the recording.
+func (s *NetworkDataSource) SetResolution(resolution time.Duration) error {
+	if err := ValidateResolution(resolution); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig != nil {
+		if err := initStatsMap(s.ebpfConfig, statsSlots(resolution)); err != nil {
+			return fmt.Errorf("initializing stats map: %w", err)
+		}
+	}
+	s.resolution = resolution
+	metrics.SetResolution(resolution, int(statsSlots(resolution)))
+	return nil
+}
+
+// Resolution returns the width of the accounting windows.
+func (s *NetworkDataSource) Resolution() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return orDefault(s.resolution)
+}
+
+// AccountingDelay returns the approximate time between a connection
+// and its accounting at the resolution of the data source.
+func (s *NetworkDataSource) AccountingDelay() time.Duration {
+	return accountingDelay(s.Resolution())
+}
+
+// setResolution sets the width of the windows of the accounting.
+func (s *State) setResolution(resolution time.Duration) {
+	s.window = orDefault(resolution)
+	s.slots = statsSlots(resolution)
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"m/clock"
+	"m/metrics"
+)
+
+func TestStatsSlots(t *testing.T) {
+	for _, tc := range []struct {
+		resolution time.Duration
+		valid      bool
+		slots      uint64
+	}{
+		{100 * time.Millisecond, true, 200},
+		{250 * time.Millisecond, true, 80},
+		{time.Second, true, 20},
+		{3 * time.Second, true, 7},
+		{10 * time.Second, true, 2},
+		{50 * time.Millisecond, false, 0},
+		{300 * time.Millisecond, false, 0},
+		{1500 * time.Millisecond, false, 0},
+		{time.Minute, false, 0},
+	} {
+		err := ValidateResolution(tc.resolution)
+		if (err == nil) != tc.valid {
+			t.Errorf("ValidateResolution(%v) = %v, want valid %v", tc.resolution, err, tc.valid)
+		}
+		if tc.valid {
+			assert(t, statsSlots(tc.resolution), tc.slots)
+		}
+	}
+	assert(t, accountingDelay(0), AccountingDelay)
+}
+
+func TestTrackConnectionsResolution(t *testing.T) {
+	const (
+		sni        = "api.example.com"
+		resolution = 100 * time.Millisecond
+	)
+	tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	connection, err := encodeConnection(tp, &tupleData{state: SYN_RECEIVED, sni: sni})
+	if err != nil {
+		t.Fatalf("encodeConnection: %v", err)
+	}
+	dataSource := &NetworkDataSource{source: &scriptedSource{
+		connections: []rawEntry{connection},
+		stats: map[uint64][]rawEntry{
+			3: {statsEntry(t, ConnKey{sourceIP: "10.0.0.2", destIP: "192.168.0.1", sni: sni}, sniStats{failedConnections: 1})},
+		},
+	}}
+	if err := dataSource.SetResolution(resolution); err != nil {
+		t.Fatalf("SetResolution() = %v", err)
+	}
+
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	incs := make(chan *metrics.Inc, 10000)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, clk, incs, nil)
+	for i := 0; i < 210; i++ {
+		clk.Tick(resolution)
+	}
+	cancel()
+	wg.Wait()
+	close(incs)
+
+	// The stats are accounted in their window, the connection once it
+	// is older than the 200 slots of the stats map.
+	var activeFailed []time.Duration
+	var activeFailedSeconds float64
+	for inc := range incs {
+		if inc.ActiveFailedSeconds > 0 {
+			activeFailed = append(activeFailed, inc.Time.Add(dataSource.AccountingDelay()).Sub(start))
+			activeFailedSeconds += inc.ActiveFailedSeconds
+		}
+	}
+	assert(t, activeFailed, []time.Duration{400 * time.Millisecond, 20200 * time.Millisecond})
+	assert(t, activeFailedSeconds, 0.2)
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"m/metrics"
+	"m/promextra"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// SampleRTT attaches the sock_ops program sampling the smoothed RTT of
+// the connections opened by the sockets in the cgroup, which stays
+// attached across reloads. The histograms per SNI are sent along with
+// the execution time by TrackExecutionTime.
+func (s *NetworkDataSource) SampleRTT(cgroupPath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return errors.New("sampling the RTT is only supported when capturing packets")
+	}
+	if err := s.attachment.attachSockOps(s.ebpfConfig, cgroupPath); err != nil {
+		return err
+	}
+	s.rttCgroup = cgroupPath
+	s.rtt = newRTTTracker()
+	return nil
+}
+
+// rttSeries is the total of the histogram of an SNI at its last change.
+type rttSeries struct {
+	total   uint64
+	updated time.Time
+}
+
+// rttTracker merges the histograms of the SNIs normalized to the same
+// name and expires the SNIs without samples.
+type rttTracker struct {
+	series map[string]rttSeries
+}
+
+func newRTTTracker() *rttTracker {
+	return &rttTracker{series: make(map[string]rttSeries)}
+}
+
+// update returns the snapshots of the normalized SNIs and the SNIs
+// whose histograms did not change within the expiration of the
+// metrics. Their series are deleted, so their entries in the kernel
+// have to be deleted as well.
+func (t *rttTracker) update(raw map[string]promextra.Snapshot, normalizer SNINormalizer, now time.Time) ([]promextra.Snapshot, map[string]bool) {
+	merged := make(map[string]promextra.Snapshot)
+	for sni, snapshot := range raw {
+		sni = normalizeSNI(normalizer, sni)
+		m, ok := merged[sni]
+		if !ok {
+			m = promextra.NewSnapshot(len(snapshot.Buckets))
+			m.Name, m.LabelValues = metrics.RTTSnapshot, []string{sni}
+		}
+		m.Total += snapshot.Total
+		for i, n := range snapshot.Buckets {
+			m.Buckets[i] += n
+		}
+		merged[sni] = m
+	}
+	expired := make(map[string]bool)
+	var snapshots []promextra.Snapshot
+	for sni, snapshot := range merged {
+		series, ok := t.series[sni]
+		if !ok || series.total != snapshot.Total {
+			t.series[sni] = rttSeries{total: snapshot.Total, updated: now}
+		} else if series.updated.Add(metrics.Expiration).Before(now) {
+			expired[sni] = true
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	for sni := range t.series {
+		if _, ok := merged[sni]; !ok || expired[sni] {
+			// Evicted in the kernel or expired.
+			metrics.DeleteRTT(sni)
+			delete(t.series, sni)
+		}
+	}
+	return snapshots, expired
+}
+
+// readRTTSnapshots reads the histograms of the RTT per SNI, if it is
+// sampled, and deletes the expired SNIs from the kernel.
+func (s *NetworkDataSource) readRTTSnapshots(now time.Time) ([]promextra.Snapshot, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.rtt == nil || s.ebpfConfig.rttMap == nil {
+		return nil, nil
+	}
+	var key [C.TLS_MAX_SERVER_NAME_LEN]byte
+	var values []C.struct_execution_histogram
+	raw := make(map[string]promextra.Snapshot)
+	keys := make(map[string][C.TLS_MAX_SERVER_NAME_LEN]byte)
+	entries := s.ebpfConfig.rttMap.Iterate()
+	for entries.Next(&key, &values) {
+		sni := sniFromC(key[:])
+		raw[sni] = snapshotFromHistograms(values)
+		keys[sni] = key
+	}
+	if err := entries.Err(); err != nil {
+		return nil, fmt.Errorf("reading the RTT histograms: %w", err)
+	}
+	// Only TrackExecutionTime updates the tracker.
+	snapshots, expired := s.rtt.update(raw, s.normalizer, now)
+	for sni, key := range keys {
+		if expired[normalizeSNI(s.normalizer, sni)] {
+			key := key
+			if err := s.ebpfConfig.rttMap.Delete(&key); err != nil {
+				return snapshots, fmt.Errorf("deleting the RTT histogram of %s: %w", sni, err)
+			}
+		}
+	}
+	return snapshots, nil
+}
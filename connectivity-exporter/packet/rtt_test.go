@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+	"time"
+
+	"m/metrics"
+	"m/normalization"
+	"m/promextra"
+)
+
+func TestRTTTracker(t *testing.T) {
+	normalizer, err := normalization.New([]normalization.Rule{{Suffix: "ingress.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	histogram := func(total uint64, bucket int) promextra.Snapshot {
+		snapshot := promextra.NewSnapshot(4)
+		snapshot.Total = total
+		snapshot.Buckets[bucket] = 1
+		return snapshot
+	}
+	tracker := newRTTTracker()
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// The histograms of the normalized SNIs are merged.
+	snapshots, expired := tracker.update(map[string]promextra.Snapshot{
+		"a.ingress.example.com": histogram(1000, 0),
+		"b.ingress.example.com": histogram(3000, 2),
+	}, normalizer, start)
+	assert(t, len(expired), 0)
+	assert(t, snapshots, []promextra.Snapshot{{
+		Total:       4000,
+		Buckets:     []uint64{1, 0, 1, 0},
+		Name:        metrics.RTTSnapshot,
+		LabelValues: []string{"*.ingress.example.com"},
+	}})
+
+	// Without samples for longer than the expiration, the SNI expires.
+	raw := map[string]promextra.Snapshot{"a.ingress.example.com": histogram(4000, 0)}
+	tracker.update(raw, normalizer, start.Add(time.Second))
+	snapshots, expired = tracker.update(raw, normalizer, start.Add(time.Second+metrics.Expiration+time.Second))
+	assert(t, len(snapshots), 0)
+	assert(t, expired, map[string]bool{"*.ingress.example.com": true})
+	assert(t, len(tracker.series), 0)
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"errors"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/clock"
+	"m/metrics"
+)
+
+// secondary is the program attached a second time to the interface of
+// the data source, with a filter of its own. Like a canary, it has its
+// own maps and socket and sees the same packets, but it is kept for the
+// lifetime of the data source and its increments are exported to the
+// metrics of its own namespace instead of being compared.
+type secondary struct {
+	source  snapshotSource
+	state   *State
+	clock   *clock.Fake
+	release func()
+	metrics *metrics.Secondary
+	// discoverer samples the increments of the SNIs not monitored by
+	// the primary filter, nil if it does not.
+	discoverer Discoverer
+}
+
+// Discoverer records the destinations seen by the secondary filter
+// which the primary filter does not monitor.
+type Discoverer interface {
+	// Observe records an increment of an SNI the primary filter has
+	// not seen.
+	Observe(inc *metrics.Inc)
+	// Forget removes the destinations of an SNI the primary filter
+	// monitors.
+	Forget(sni string)
+}
+
+// AttachSecondary attaches the program a second time to the interface
+// of the data source, with the CIDRs and ports of a secondary filter,
+// e.g. a broad filter discovering the endpoints next to the strict
+// filter of the SLOs. Its connections are accounted with the current
+// configuration and exported to the metrics m only, so they add
+// neither series nor failures to the metrics, failure events and
+// observers of the primary filter. It has to be called before
+// TrackConnections. The secondary filter is kept across reloads, on the
+// interface it was attached to.
+func (s *NetworkDataSource) AttachSecondary(cidrs, ports map[string]struct{}, m *metrics.Secondary) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return errors.New("secondary attachments are only supported when capturing packets")
+	}
+	if s.secondary != nil {
+		return errors.New("the secondary filter is already attached")
+	}
+	opts := s.setupOptions()
+	// Neither the packets of unparsed ClientHellos nor the RTT samples
+	// are needed twice.
+	opts.forward = forwardConfig{}
+	opts.rttCgroup = ""
+	ec, attachment, err := newEBPFSetup(s.networkInterface, cidrs, ports, opts)
+	if err != nil {
+		return err
+	}
+	windowClock := clock.NewFake(time.Time{})
+	state := newState(s.config, windowClock)
+	state.setResolution(s.resolution)
+	state.quiet = true
+	state.normalizer = s.normalizer
+	state.noSNIPrefix = s.noSNIPrefix
+	s.secondary = &secondary{
+		source:  &ebpfSource{config: ec},
+		state:   state,
+		clock:   windowClock,
+		metrics: m,
+		release: func() {
+			attachment.Close()
+			ec.Close()
+		},
+	}
+	klog.Infof("Attached the secondary filter to %s", s.networkInterface)
+	return nil
+}
+
+// DiscoverUnmonitored passes the increments of the secondary filter to
+// the discoverer, split by whether the primary filter has seen their
+// SNI within the expiration of the metrics. It has to be called after
+// AttachSecondary.
+func (s *NetworkDataSource) DiscoverUnmonitored(d Discoverer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.secondary == nil {
+		return errors.New("discovering the unmonitored destinations needs the secondary filter")
+	}
+	s.secondary.discoverer = d
+	return nil
+}
+
+// accountSecondary accounts the window of the secondary attachment and
+// exports it to its metrics. The SNIs of the primary state are the
+// monitored ones.
+func (s *NetworkDataSource) accountSecondary(primary *State, tickerClock uint64, now time.Time) {
+	c := s.secondary
+	snapshot, err := c.source.read(tickerClock, now)
+	if err != nil {
+		klog.Errorf("reading secondary map snapshot: %v", err)
+		return
+	}
+	c.clock.Set(snapshot.Time)
+	incs, _, oldKeys, err := c.state.accountSnapshot(snapshot)
+	if err != nil {
+		klog.Errorf("accounting secondary map snapshot: %v", err)
+		return
+	}
+	c.source.deleteConnections(oldKeys)
+	c.metrics.Add(incs)
+	if c.discoverer != nil {
+		for _, inc := range incs {
+			if _, ok := primary.snis[inc.SNI]; ok {
+				c.discoverer.Forget(inc.SNI)
+			} else {
+				c.discoverer.Observe(inc)
+			}
+		}
+	}
+	// The state is quiet, so the series of the expired SNIs are deleted
+	// here.
+	for sni, lastUpdate := range c.state.snis {
+		if lastUpdate.Add(metrics.Expiration).Before(snapshot.Time) {
+			c.metrics.Delete(sni)
+		}
+	}
+	c.state.deleteExpiredSNIs(snapshot.Time)
+}
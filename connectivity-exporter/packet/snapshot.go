@@ -0,0 +1,439 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"k8s.io/klog/v2"
+
+	"m/config"
+	"m/events"
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// mapSnapshot is the raw content of the eBPF maps read by
+// TrackConnections in one tick: all the connections of the
+// connections map and the oldest stats. It is the only input of the
+// accounting, so recorded snapshots can be replayed to reproduce the
+// accounting.
+type mapSnapshot struct {
+	Time        time.Time  `json:"time"`
+	TickerClock uint64     `json:"tickerClock"`
+	Connections []rawEntry `json:"connections"`
+	Stats       []rawEntry `json:"stats"`
+}
+
+// rawEntry is the key and the value of a map entry as stored in the
+// kernel.
+type rawEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// snapshotSource provides the map snapshots to TrackConnections.
+type snapshotSource interface {
+	// read returns the snapshot at the ticker clock and the time of
+	// the tick. The oldest stats are removed from the source.
+	read(tickerClock uint64, now time.Time) (*mapSnapshot, error)
+	// deleteConnections removes the accounted connections.
+	deleteConnections(keys [][]byte)
+	// setTickerClock advances the ticker clock of the source.
+	setTickerClock(tickerClock uint64) error
+}
+
+// ebpfSource reads the snapshots from the eBPF maps.
+type ebpfSource struct {
+	config *ebpfConfig
+}
+
+func (e *ebpfSource) read(tickerClock uint64, now time.Time) (*mapSnapshot, error) {
+	snapshot := &mapSnapshot{Time: now, TickerClock: tickerClock}
+	connections, err := readEntries(BPF_CONNECTION_MAP_NAME, e.config.connectionMap)
+	if err != nil {
+		return nil, fmt.Errorf("reading connections from map: %w", err)
+	}
+	snapshot.Connections = connections
+
+	// Seal the oldest slot, so no write reaches its inner map after it
+	// is swapped. Writes of in-flight packets are counted as late
+	// writes instead.
+	statsKey := (tickerClock + 1) % e.config.slots
+	if err := e.config.generationsMap.Put(uint32(statsKey), uint64(C.STATS_SLOT_SEALED)); err != nil {
+		return nil, fmt.Errorf("sealing stats slot: %w", err)
+	}
+	stats, err := swapStats(e.config, uint32(statsKey))
+	if err != nil {
+		return nil, fmt.Errorf("getting stats from map: %w", err)
+	}
+	snapshot.Stats = stats
+	return snapshot, nil
+}
+
+func (e *ebpfSource) deleteConnections(keys [][]byte) {
+	for _, k := range keys {
+		// We do not want to check error while deleting
+		_ = e.config.connectionMap.Delete(k)
+	}
+}
+
+// setTickerClock opens the slot of the stats map for the ticker clock
+// before advancing the clock.
+func (e *ebpfSource) setTickerClock(tickerClock uint64) error {
+	if err := e.config.generationsMap.Put(uint32(tickerClock%e.config.slots), tickerClock); err != nil {
+		return fmt.Errorf("opening stats slot: %w", err)
+	}
+	return e.config.tickerClockMap.Put(uint32(0), tickerClock)
+}
+
+// swapStats replaces the inner map of the stats map at the given
+// index with the spare map, and returns the entries of the replaced
+// map. The kernel does not free the entries one by one while packets
+// are processed, and the replaced map is read once no new packet can
+// reach it. The
+// next spare map is allocated afterwards, outside of the critical
+// part of the tick.
+func swapStats(config *ebpfConfig, statsKey uint32) ([]rawEntry, error) {
+	// The allocation of the spare map failed in the last tick.
+	if config.spareStatsMap == nil {
+		spare, err := newInnerStatsMap()
+		if err != nil {
+			return nil, fmt.Errorf("allocating inner stats map: %w", err)
+		}
+		config.spareStatsMap = spare
+	}
+	var innerMap *ebpf.Map
+	if err := config.statsMap.Lookup(statsKey, &innerMap); err != nil {
+		return nil, err
+	}
+	defer innerMap.Close()
+	if err := config.statsMap.Put(statsKey, config.spareStatsMap); err != nil {
+		return nil, fmt.Errorf("swapping inner stats map: %w", err)
+	}
+	config.spareStatsMap.Close()
+	config.spareStatsMap = nil
+
+	var out []rawEntry
+	var key, value []byte
+	innerEntries := innerMap.Iterate()
+	for innerEntries.Next(&key, &value) {
+		out = append(out, rawEntry{Key: copyBytes(key), Value: copyBytes(value)})
+	}
+	if err := innerEntries.Err(); err != nil {
+		return nil, err
+	}
+
+	// A failure is retried in the next tick, the entries are read
+	// already.
+	if spare, err := newInnerStatsMap(); err != nil {
+		klog.Errorf("Failed to allocate the spare inner stats map: %v", err)
+	} else {
+		config.spareStatsMap = spare
+	}
+	return out, nil
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// accountSnapshot accounts for the old connections and the stats of
+// the snapshot. It returns the keys of the accounted connections,
+// which have to be deleted from the connections map.
+func (s *State) accountSnapshot(snapshot *mapSnapshot) ([]*metrics.Inc, []*events.Failure, [][]byte, error) {
+	cfg := s.config.Get()
+	// Set of encountered SNIs, in either of the 2 maps
+	sniSet := map[ConnKey]struct{}{}
+	staleConnections := make(map[ConnKey][]*tupleData)
+	attributions := newSNIAttributions()
+	keys := make([]C.struct_tuple_key_t, len(snapshot.Connections))
+	connections := make([]*tupleData, len(snapshot.Connections))
+	s.openKeys = nil
+	if cfg.HasMinThroughput() {
+		s.openKeys = make(map[ConnKey]struct{})
+	}
+	for i, e := range snapshot.Connections {
+		key, data, err := decodeConnection(e)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if s.openKeys != nil && data.sni != "" && data.state == SNI_RECEIVED {
+			s.openKeys[connKeyFromC(key, normalizeSNI(s.normalizer, data.sni))] = struct{}{}
+		}
+		// All the connections with an SNI refresh the cache, not only
+		// the old ones, so the connections following them are
+		// attributed even if they are accounted first.
+		s.learnSNI(cfg, key, data.sni)
+		keys[i], connections[i] = key, data
+	}
+	var oldKeys [][]byte
+	var staleKeys []C.struct_tuple_key_t
+	var staleData []*tupleData
+	for i, e := range snapshot.Connections {
+		key, data := keys[i], connections[i]
+		// Entry will be only added if the connection is old.
+		if !isConnectionOld(data.tickerClockFirstPacket, snapshot.TickerClock, s.slots) {
+			continue
+		}
+		// An old subflow of an MPTCP connection is dropped, the MPTCP
+		// connection is accounted with its first subflow.
+		if data.mptcpSubflow {
+			oldKeys = append(oldKeys, e.Key)
+			continue
+		}
+		if data.sni == "" && s.noSNIPrefix != "" {
+			s.accountNoSNI(key, data)
+		} else if data.sni == "" {
+			s.countUnknownSNI(key, data)
+			data.sni = s.connectionSNI(cfg, key, attributions)
+		}
+		data.sni = normalizeSNI(s.normalizer, data.sni)
+		oldKeys = append(oldKeys, e.Key)
+		staleKeys, staleData = append(staleKeys, key), append(staleData, data)
+
+		// Get the union of SNIs from both BPF maps. Some SNIs
+		// might be in connectionMap only, in statsMap only, or
+		// in both.
+		ck := connKeyFromC(key, data.sni)
+		// The connections through a load balancer are accounted for
+		// the original client of their PROXY protocol header, like
+		// their stats.
+		if data.proxied {
+			ck.sourceIP = data.sourceIP.String()
+		}
+		sniSet[ck] = struct{}{}
+		staleConnections[ck] = append(staleConnections[ck], data)
+	}
+
+	s.attributeBackends(staleKeys, staleData)
+
+	stats := make(map[ConnKey]sniStats, len(snapshot.Stats))
+	for _, e := range snapshot.Stats {
+		ck, value, err := decodeStats(e)
+		if err != nil {
+			if !s.quiet {
+				metrics.IncQuarantinedStats(quarantineMalformed)
+			}
+			klog.Warningf("Quarantined a stats entry: %v, raw key %x, raw value %x", err, e.Key, e.Value)
+			continue
+		}
+		if reason, detail := quarantineReason(value); reason != "" {
+			if !s.quiet {
+				metrics.IncQuarantinedStats(reason)
+			}
+			klog.Warningf("Quarantined the stats of %s from %s to %s: %s, raw value %x", ck.sni, ck.sourceIP, ck.destIP, detail, e.Value)
+			continue
+		}
+		if ck.sni == "" {
+			ck.sni = s.statsSNI(cfg, ck, value, attributions)
+		}
+		ck.sni = normalizeSNI(s.normalizer, ck.sni)
+		// While a previous program is drained, the stats of a key
+		// can be in both programs.
+		merged := stats[ck]
+		merged.add(value)
+		stats[ck] = merged
+		sniSet[ck] = struct{}{}
+	}
+
+	addSNIGroups(cfg, sniSet, staleConnections, stats)
+	incs, failures := s.accountWindow(sniSet, staleConnections, stats)
+	attributions.addTo(incs)
+	return aggregateIncs(incs), failures, oldKeys, nil
+}
+
+func decodeConnection(e rawEntry) (C.struct_tuple_key_t, *tupleData, error) {
+	var key C.struct_tuple_key_t
+	var value C.struct_tuple_data_t
+	if len(e.Key) != C.sizeof_struct_tuple_key_t || len(e.Value) != C.sizeof_struct_tuple_data_t {
+		return key, nil, fmt.Errorf("unexpected size of connection entry: key %d, value %d bytes", len(e.Key), len(e.Value))
+	}
+	copy((*[C.sizeof_struct_tuple_key_t]byte)(unsafe.Pointer(&key))[:], e.Key)
+	copy((*[C.sizeof_struct_tuple_data_t]byte)(unsafe.Pointer(&value))[:], e.Value)
+	return key, tupleDataFromC(value), nil
+}
+
+func decodeStats(e rawEntry) (ConnKey, sniStats, error) {
+	var value C.struct_sni_stats_t
+	if len(e.Value) != C.sizeof_struct_sni_stats_t {
+		return ConnKey{}, sniStats{}, fmt.Errorf("unexpected size of stats value: got %d, want %d bytes", len(e.Value), C.sizeof_struct_sni_stats_t)
+	}
+	key, err := statsKeyFromBytes(e.Key)
+	if err != nil {
+		return ConnKey{}, sniStats{}, err
+	}
+	copy((*[C.sizeof_struct_sni_stats_t]byte)(unsafe.Pointer(&value))[:], e.Value)
+	return key, sniStatsFromC(value), nil
+}
+
+// encodeConnection is the inverse of decodeConnection.
+func encodeConnection(t *tuple, td *tupleData) (rawEntry, error) {
+	key := t.toBytes()
+	value, err := tupleDataToC(td)
+	if err != nil {
+		return rawEntry{}, err
+	}
+	return rawEntry{
+		Key:   key[:],
+		Value: copyBytes((*[C.sizeof_struct_tuple_data_t]byte)(unsafe.Pointer(&value))[:]),
+	}, nil
+}
+
+// encodeStats is the inverse of decodeStats.
+func encodeStats(key ConnKey, stats sniStats) (rawEntry, error) {
+	k, err := statsKeyToBytes(key)
+	if err != nil {
+		return rawEntry{}, err
+	}
+	value := C.struct_sni_stats_t{
+		succeeded_connections:        C.__u64(stats.succeededConnections),
+		failed_connections:           C.__u64(stats.failedConnections),
+		middlebox_resets:             C.__u64(stats.middleboxResets),
+		handshakes_abandoned:         C.__u64(stats.handshakesAbandoned),
+		handshakes_only:              C.__u64(stats.handshakesOnly),
+		handshakes_failed:            C.__u64(stats.handshakesFailed),
+		established_resets:           C.__u64(stats.establishedResets),
+		certificate_requests:         C.__u64(stats.certificateRequests),
+		certificate_request_failures: C.__u64(stats.certificateRequestFailures),
+		ecn_requested:                C.__u64(stats.congestion.ecnRequested),
+		ecn_accepted:                 C.__u64(stats.congestion.ecnAccepted),
+		ce_packets:                   C.__u64(stats.congestion.cePackets),
+		ece_packets:                  C.__u64(stats.congestion.ecePackets),
+		cwr_packets:                  C.__u64(stats.congestion.cwrPackets),
+	}
+	for i, n := range stats.icmpUnreachable {
+		value.icmp_unreachable[i] = C.__u64(n)
+	}
+	for i, n := range stats.transitions {
+		value.transitions[i] = C.__u64(n)
+	}
+	for i, n := range stats.resets {
+		value.resets[i] = C.__u64(n)
+	}
+	for i, l := range stats.latencies {
+		if i < C.LATENCY_SAMPLE_COUNT {
+			value.connect_latency_us[i] = C.__u32(l.connect / time.Microsecond)
+			value.handshake_latency_us[i] = C.__u32(l.handshake / time.Microsecond)
+			value.handshake_duration_us[i] = C.__u32(l.handshakeDuration / time.Microsecond)
+		}
+	}
+	value.latency_samples = C.__u32(len(stats.latencies))
+	return rawEntry{
+		Key:   k,
+		Value: copyBytes((*[C.sizeof_struct_sni_stats_t]byte)(unsafe.Pointer(&value))[:]),
+	}, nil
+}
+
+// snapshotRecorder appends the snapshots as JSON lines to a file until
+// the maximum size is reached.
+type snapshotRecorder struct {
+	file    *os.File
+	encoder *json.Encoder
+	written *countingWriter
+	maxSize int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newSnapshotRecorder(filename string, maxSize int64) (*snapshotRecorder, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot file: %w", err)
+	}
+	written := &countingWriter{w: file}
+	return &snapshotRecorder{file: file, encoder: json.NewEncoder(written), written: written, maxSize: maxSize}, nil
+}
+
+func (r *snapshotRecorder) record(snapshot *mapSnapshot) {
+	if r.file == nil {
+		return
+	}
+	if err := r.encoder.Encode(snapshot); err != nil {
+		klog.Errorf("Failed to record map snapshot: %v", err)
+	}
+	if r.written.n >= r.maxSize {
+		klog.Warningf("Stopped recording map snapshots after %d bytes", r.written.n)
+		r.Close()
+	}
+}
+
+func (r *snapshotRecorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// replaySource provides recorded snapshots. They keep their recorded
+// time, so the accounting sees the time of the recording.
+type replaySource struct {
+	file    *os.File
+	decoder *json.Decoder
+}
+
+func (r *replaySource) read(_ uint64, now time.Time) (*mapSnapshot, error) {
+	snapshot := &mapSnapshot{}
+	if err := r.decoder.Decode(snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Time.IsZero() {
+		snapshot.Time = now
+	}
+	return snapshot, nil
+}
+
+func (r *replaySource) deleteConnections([][]byte) {}
+
+func (r *replaySource) setTickerClock(uint64) error { return nil }
+
+func (r *replaySource) Close() error {
+	return r.file.Close()
+}
+
+// NewReplayDataSource creates a data source replaying the map
+// snapshots recorded in the file instead of loading the eBPF program.
+// Only TrackConnections is supported.
+func NewReplayDataSource(filename string, store *config.Store) (*NetworkDataSource, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot file: %w", err)
+	}
+	return &NetworkDataSource{
+		config:  store,
+		source:  &replaySource{file: file, decoder: json.NewDecoder(file)},
+		reloads: make(chan *reloadRequest),
+	}, nil
+}
+
+// RecordSnapshots appends the map snapshots read by TrackConnections
+// to the file, until maxSize bytes are written.
+func (s *NetworkDataSource) RecordSnapshots(filename string, maxSize int64) error {
+	recorder, err := newSnapshotRecorder(filename, maxSize)
+	if err != nil {
+		return err
+	}
+	s.recorder = recorder
+	return nil
+}
@@ -0,0 +1,391 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"m/clock"
+	"m/config"
+	"m/metrics"
+	"m/normalization"
+)
+
+func TestReplay(t *testing.T) {
+	const sni = "api.example.com"
+	clientA := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	clientB := &tuple{srcIP: net.ParseIP("10.0.0.2"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	connection := func(tp *tuple, state connState) rawEntry {
+		e, err := encodeConnection(tp, &tupleData{state: state, sni: sni, sourceIP: tp.srcIP.To4(), destIP: tp.dstIP.To4()})
+		if err != nil {
+			t.Fatalf("encodeConnection: %v", err)
+		}
+		return e
+	}
+	clientC := ConnKey{sourceIP: "10.0.0.3", destIP: "192.168.0.1", sni: sni}
+
+	snapshots := []mapSnapshot{
+		// The connections are not old yet.
+		{TickerClock: 20, Connections: []rawEntry{connection(clientA, SNI_RECEIVED), connection(clientB, RST_SENT_BY_SERVER)}},
+		{TickerClock: 21, Connections: []rawEntry{connection(clientA, SNI_RECEIVED), connection(clientB, RST_SENT_BY_SERVER)}},
+		{TickerClock: 22, Stats: []rawEntry{statsEntry(t, clientC, sniStats{succeededConnections: 2})}},
+	}
+	filename := filepath.Join(t.TempDir(), "snapshots.jsonl")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, s := range snapshots {
+		if err := encoder.Encode(s); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	file.Close()
+
+	dataSource, err := NewReplayDataSource(filename, nil)
+	if err != nil {
+		t.Fatalf("NewReplayDataSource: %v", err)
+	}
+	defer dataSource.Close()
+
+	ticks := clock.NewFake(time.Now())
+	incs := make(chan *metrics.Inc, 100)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(context.Background(), wg, ticks, incs, nil)
+	for i := 0; i <= len(snapshots); i++ {
+		ticks.Tick(time.Second)
+	}
+	wg.Wait()
+	close(incs)
+
+	type counts struct{ active, failed, successful, rejected float64 }
+	got := map[string]counts{}
+	for inc := range incs {
+		c := got[inc.SourceIP]
+		c.active += inc.ActiveSeconds
+		c.failed += inc.FailedSeconds
+		c.successful += inc.SuccessfulConnections
+		c.rejected += inc.RejectedConnections
+		got[inc.SourceIP] = c
+	}
+	assert(t, got, map[string]counts{
+		"10.0.0.1": {active: 1, successful: 1},
+		// The failure is not carried over, client C succeeded in
+		// the next window.
+		"10.0.0.2": {active: 1, failed: 1, rejected: 1},
+		"10.0.0.3": {active: 1, successful: 2},
+	})
+}
+
+// scriptedSource provides the stats of a window by ticker clock and
+// the connections until they are deleted.
+type scriptedSource struct {
+	stats       map[uint64][]rawEntry
+	connections []rawEntry
+}
+
+func (s *scriptedSource) read(tickerClock uint64, now time.Time) (*mapSnapshot, error) {
+	return &mapSnapshot{Time: now, TickerClock: tickerClock, Connections: s.connections, Stats: s.stats[tickerClock]}, nil
+}
+
+func (s *scriptedSource) deleteConnections(keys [][]byte) {
+	var remaining []rawEntry
+	for _, c := range s.connections {
+		deleted := false
+		for _, k := range keys {
+			deleted = deleted || string(c.Key) == string(k)
+		}
+		if !deleted {
+			remaining = append(remaining, c)
+		}
+	}
+	s.connections = remaining
+}
+
+func (s *scriptedSource) setTickerClock(uint64) error { return nil }
+
+func TestTrackConnectionsCarryOverExpiry(t *testing.T) {
+	clientA := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	dataSource := &NetworkDataSource{
+		config: config.NewStore(&config.Config{CarryOverRetention: config.Duration(time.Minute)}),
+		source: &scriptedSource{stats: map[uint64][]rawEntry{
+			0: {statsEntry(t, clientA, sniStats{failedConnections: 1})},
+		}},
+	}
+
+	incs := make(chan *metrics.Inc, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, clk, incs, nil)
+	// Each tick is only received once the previous one is accounted.
+	for i := 0; i < 90; i++ {
+		clk.Tick(time.Second)
+	}
+	cancel()
+	wg.Wait()
+	close(incs)
+
+	var failed []time.Duration
+	for inc := range incs {
+		if inc.FailedSeconds > 0 {
+			failed = append(failed, inc.Time.Add(AccountingDelay).Sub(start))
+		}
+	}
+	// The failure is carried over for the retention after the last
+	// activity, then the carry-over state expires.
+	assert(t, len(failed), 62)
+	assert(t, failed[len(failed)-1], 62*time.Second)
+}
+
+func TestUnknownSNI(t *testing.T) {
+	connection := func(dst string, state connState) rawEntry {
+		tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP(dst), srcPort: 40000, dstPort: 443}
+		e, err := encodeConnection(tp, &tupleData{state: state, sourceIP: tp.srcIP.To4(), destIP: tp.dstIP.To4()})
+		if err != nil {
+			t.Fatalf("encodeConnection: %v", err)
+		}
+		return e
+	}
+	state := newState(nil, nil)
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{
+		TickerClock: 21,
+		Connections: []rawEntry{connection("192.168.0.1", SYN_RECEIVED), connection("192.168.0.2", RST_SENT_BY_CLIENT)},
+	})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	failed := map[string]float64{}
+	for _, inc := range incs {
+		assert(t, inc.SNI, UnknownSNI)
+		failed[inc.DestIP] += inc.FailedSeconds
+	}
+	assert(t, failed, map[string]float64{"192.168.0.1": 1, "192.168.0.2": 0})
+
+	// The failure is carried over per destination.
+	assert(t, len(state.carryOver), 2)
+	assert(t, state.unknownSNIs, uint64(2))
+
+	// The connections to a CIDR group are accounted for its name.
+	state = newState(config.NewStore(&config.Config{CIDRGroups: []config.CIDRGroup{{Name: "database", CIDRs: []string{"192.168.0.0/31"}}}}), nil)
+	incs, _, _, err = state.accountSnapshot(&mapSnapshot{
+		TickerClock: 21,
+		Connections: []rawEntry{connection("192.168.0.1", SYN_RECEIVED), connection("192.168.0.2", RST_SENT_BY_CLIENT)},
+	})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	snis := map[string]string{}
+	for _, inc := range incs {
+		snis[inc.DestIP] = inc.SNI
+	}
+	assert(t, snis, map[string]string{"192.168.0.1": "database", "192.168.0.2": UnknownSNI})
+}
+
+func TestProxiedSourceIP(t *testing.T) {
+	// A connection from the load balancer 10.0.0.1 whose PROXY protocol
+	// header named the original client 203.0.113.7.
+	tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	e, err := encodeConnection(tp, &tupleData{
+		state:    SYN_RECEIVED,
+		sourceIP: net.ParseIP("203.0.113.7").To4(),
+		destIP:   tp.dstIP.To4(),
+		sni:      "api.example.com",
+		proxied:  true,
+	})
+	if err != nil {
+		t.Fatalf("encodeConnection: %v", err)
+	}
+	state := newState(nil, nil)
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{TickerClock: 21, Connections: []rawEntry{e}})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	assert(t, len(incs), 1)
+	assert(t, incs[0].SourceIP, "203.0.113.7")
+	assert(t, incs[0].FailedSeconds, float64(1))
+}
+
+func TestMPTCPSubflowNotAccounted(t *testing.T) {
+	// A subflow joining an MPTCP connection is accounted with its
+	// connection, not on its own.
+	tp := &tuple{srcIP: net.ParseIP("10.0.0.2"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40001, dstPort: 443}
+	e, err := encodeConnection(tp, &tupleData{
+		state:        SYN_RECEIVED,
+		sourceIP:     tp.srcIP.To4(),
+		destIP:       tp.dstIP.To4(),
+		sni:          "api.example.com",
+		mptcpSubflow: true,
+	})
+	if err != nil {
+		t.Fatalf("encodeConnection: %v", err)
+	}
+	state := newState(nil, nil)
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{TickerClock: 21, Connections: []rawEntry{e}})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	assert(t, len(incs), 0)
+}
+
+func TestNoSNIPrefix(t *testing.T) {
+	entry := func(srcPort uint16, state connState) rawEntry {
+		tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: srcPort, dstPort: 5432}
+		e, err := encodeConnection(tp, &tupleData{state: state, sourceIP: tp.srcIP.To4(), destIP: tp.dstIP.To4()})
+		if err != nil {
+			t.Fatalf("encodeConnection: %v", err)
+		}
+		return e
+	}
+	state := newState(nil, nil)
+	state.noSNIPrefix = "__no_sni__:"
+	// The server answered the first connection, which never sent a
+	// ClientHello, but not the second one.
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{TickerClock: 21, Connections: []rawEntry{entry(40000, SYNACK_RECEIVED), entry(40001, SYN_RECEIVED)}})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	assert(t, len(incs), 1)
+	assert(t, incs[0].SNI, "__no_sni__:5432")
+	assert(t, incs[0].SuccessfulConnections, float64(1))
+	assert(t, incs[0].HandshakesAbandoned, float64(0))
+	assert(t, incs[0].FailedSeconds, float64(1))
+	assert(t, incs[0].FallbackSNIConnections, float64(0))
+	assert(t, noSNI("__no_sni__:", 25), "__no_sni__:25")
+}
+
+func statsEntry(t *testing.T, key ConnKey, stats sniStats) rawEntry {
+	e, err := encodeStats(key, stats)
+	if err != nil {
+		t.Fatalf("encodeStats: %v", err)
+	}
+	return e
+}
+
+func FuzzDecodeStats(f *testing.F) {
+	key := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "api.example.com"}
+	for _, stats := range []sniStats{{}, {succeededConnections: 2, latencies: []latencySample{{connect: time.Millisecond}}}} {
+		e, err := encodeStats(key, stats)
+		if err != nil {
+			f.Fatalf("encodeStats: %v", err)
+		}
+		f.Add(e.Key, e.Value)
+		f.Add(e.Key[:8], e.Value)
+		f.Add(append(e.Key, 0), e.Value[1:])
+	}
+	f.Fuzz(func(t *testing.T, k, v []byte) {
+		ck, stats, err := decodeStats(rawEntry{Key: k, Value: v})
+		if err != nil {
+			return
+		}
+		if !utf8.ValidString(ck.sni) {
+			t.Fatalf("decodeStats() returned an invalid SNI %q", ck.sni)
+		}
+		// Replacing invalid characters can make the SNI too long for
+		// the key.
+		e, err := encodeStats(ck, stats)
+		if err != nil {
+			return
+		}
+		again, _, err := decodeStats(e)
+		if err != nil {
+			t.Fatalf("decodeStats() of an encoded key = %v", err)
+		}
+		assert(t, again, ck)
+	})
+}
+
+func TestSNINormalization(t *testing.T) {
+	normalizer, err := normalization.New([]normalization.Rule{{Suffix: "ingress.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newState(nil, nil)
+	state.normalizer = normalizer
+	key := func(sni string) ConnKey {
+		return ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: sni}
+	}
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{
+		TickerClock: 21,
+		Stats: []rawEntry{
+			statsEntry(t, key("a.ingress.example.com"), sniStats{succeededConnections: 2}),
+			statsEntry(t, key("b.ingress.example.com"), sniStats{failedConnections: 1}),
+			statsEntry(t, key("api.example.com"), sniStats{succeededConnections: 1}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	type counts struct{ failed, successful, rejected float64 }
+	got := map[string]counts{}
+	for _, inc := range incs {
+		got[inc.SNI] = counts{inc.FailedSeconds, inc.SuccessfulConnections, inc.RejectedConnections}
+	}
+	// The stats of the normalized SNIs are merged before they are
+	// accounted, so the window fails once.
+	assert(t, got, map[string]counts{
+		"*.ingress.example.com": {failed: 1, successful: 2, rejected: 1},
+		"api.example.com":       {successful: 1},
+	})
+}
+
+func TestSNIGroups(t *testing.T) {
+	state := newState(config.NewStore(&config.Config{SNIGroups: []config.SNIGroup{{Name: "vip-1", SNIs: []string{"*.apps.example.com"}}}}), nil)
+	key := func(sni string) ConnKey {
+		return ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: sni}
+	}
+	incs, _, _, err := state.accountSnapshot(&mapSnapshot{
+		TickerClock: 21,
+		Stats: []rawEntry{
+			statsEntry(t, key("shop.apps.example.com"), sniStats{succeededConnections: 2}),
+			statsEntry(t, key("blog.apps.example.com"), sniStats{failedConnections: 1}),
+			statsEntry(t, key("api.example.com"), sniStats{succeededConnections: 1}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("accountSnapshot: %v", err)
+	}
+	type counts struct{ failed, successful, rejected float64 }
+	got := map[string]counts{}
+	for _, inc := range incs {
+		got[inc.SNI] = counts{inc.FailedSeconds, inc.SuccessfulConnections, inc.RejectedConnections}
+	}
+	// The members are accounted individually and together for the
+	// group, which fails with one of them.
+	assert(t, got, map[string]counts{
+		"shop.apps.example.com": {successful: 2},
+		"blog.apps.example.com": {failed: 1, rejected: 1},
+		"vip-1":                 {failed: 1, successful: 2, rejected: 1},
+		"api.example.com":       {successful: 1},
+	})
+}
+
+func TestAggregateIncs(t *testing.T) {
+	incs := aggregateIncs([]*metrics.Inc{
+		{SNI: "a.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", ActiveSeconds: 1, SuccessfulConnections: 2, ConnectLatencies: []time.Duration{time.Millisecond}},
+		{SNI: "b.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", ActiveSeconds: 1, SuccessfulConnections: 1},
+		{SNI: "a.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", ActiveSeconds: 1, FailedSeconds: 1, RejectedConnections: 1, ConnectLatencies: []time.Duration{2 * time.Millisecond}},
+	})
+	assert(t, len(incs), 2)
+	// The seconds of the same window are not added.
+	assert(t, *incs[0], metrics.Inc{
+		SNI: "a.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1",
+		ActiveSeconds: 1, FailedSeconds: 1, SuccessfulConnections: 2, RejectedConnections: 1,
+		ConnectLatencies: []time.Duration{time.Millisecond, 2 * time.Millisecond},
+	})
+	assert(t, incs[1].SNI, "b.example.com")
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// TruncatedSNISuffix marks the SNIs truncated by the eBPF program. It
+// replaces the last character of the truncated SNI, so a truncated SNI
+// does not collide with an SNI of the truncated length.
+const TruncatedSNISuffix = "~truncated"
+
+// MaxSNILength is the size of the SNI buffers of the eBPF program, the
+// largest configurable maximum length of an SNI.
+const MaxSNILength = C.TLS_MAX_SERVER_NAME_LEN
+
+// sniFromC converts an SNI buffer of the eBPF program, which is only
+// zero terminated if it is shorter than the buffer.
+func sniFromC(b []byte) string {
+	// Cut the SNI at the first zero byte. This removes any zero bytes we
+	// get from the null-terminated C string and also ensures we don't have
+	// zero bytes in the middle of the SNI.
+	b = bytes.SplitN(b, []byte{0}, 2)[0]
+	// The SNI becomes a label value, which has to be valid UTF-8.
+	if n := len(b); n > 0 && b[n-1] == C.SNI_TRUNCATED_MARKER {
+		return strings.ToValidUTF8(string(b[:n-1]), "\ufffd") + TruncatedSNISuffix
+	}
+	return strings.ToValidUTF8(string(b), "\ufffd")
+}
+
+// sniToC is the inverse of sniFromC.
+func sniToC(sni string) []byte {
+	if strings.HasSuffix(sni, TruncatedSNISuffix) {
+		return append([]byte(strings.TrimSuffix(sni, TruncatedSNISuffix)), C.SNI_TRUNCATED_MARKER)
+	}
+	return []byte(sni)
+}
+
+// SetMaxSNILength sets the maximum length of the SNIs parsed by the
+// eBPF program, including the truncation marker. Longer SNIs are
+// truncated and marked with TruncatedSNISuffix. The length is kept
+// across reloads.
+func (s *NetworkDataSource) SetMaxSNILength(n int) error {
+	if n < 2 || n > MaxSNILength {
+		return fmt.Errorf("invalid maximum SNI length %d, expected 2 to %d", n, MaxSNILength)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return nil
+	}
+	if err := initSNIMap(s.ebpfConfig.sniConfigMap, uint32(n), s.noSNIPrefix); err != nil {
+		return fmt.Errorf("initializing SNI map: %w", err)
+	}
+	s.maxSNILength = uint32(n)
+	return nil
+}
+
+// SetNoSNIPrefix accounts the connections without an SNI, e.g. health
+// checks or connections of other protocols than TLS, for a pseudo SNI
+// of the port of their server: the prefix followed by the port, e.g.
+// "__no_sni__:5432". A connection answered by the server is
+// established, it does not fail for lacking a ClientHello. The empty
+// prefix accounts them for the fallback SNI. The prefix is kept across
+// reloads.
+func (s *NetworkDataSource) SetNoSNIPrefix(prefix string) error {
+	if len(prefix) > C.NO_SNI_PREFIX_MAX_LEN || strings.IndexByte(prefix, 0) >= 0 || !utf8.ValidString(prefix) {
+		return fmt.Errorf("invalid prefix %q of the connections without an SNI, expected up to %d bytes of UTF-8", prefix, C.NO_SNI_PREFIX_MAX_LEN)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig != nil {
+		if err := initSNIMap(s.ebpfConfig.sniConfigMap, s.maxSNILength, prefix); err != nil {
+			return fmt.Errorf("initializing SNI map: %w", err)
+		}
+	}
+	s.noSNIPrefix = prefix
+	return nil
+}
+
+// noSNI returns the pseudo SNI of the connections without an SNI to
+// the port, like the eBPF program.
+func noSNI(prefix string, port uint16) string {
+	return prefix + strconv.Itoa(int(port))
+}
+
+func initSNIMap(m *ebpf.Map, maxLength uint32, noSNIPrefix string) error {
+	var zero uint32
+	value := C.struct_sni_config_t{
+		max_len:           C.__u32(maxLength),
+		no_sni_prefix_len: C.__u32(len(noSNIPrefix)),
+	}
+	for i := 0; i < len(noSNIPrefix); i++ {
+		value.no_sni_prefix[i] = C.char(noSNIPrefix[i])
+	}
+	return m.Put(unsafe.Pointer(&zero), unsafe.Pointer(&value))
+}
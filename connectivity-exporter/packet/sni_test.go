@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTruncatedSNI(t *testing.T) {
+	truncated := append([]byte("a-very-long-name.exampl"), 0x1)
+	assert(t, sniFromC(append(truncated, 0, 'x')), "a-very-long-name.exampl"+TruncatedSNISuffix)
+	assert(t, sniFromC([]byte("api.example.com\000\000")), "api.example.com")
+	assert(t, sniToC("a-very-long-name.exampl"+TruncatedSNISuffix), truncated)
+
+	// The truncated SNIs survive the round trip through the maps.
+	key := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "a-very-long-name.exampl" + TruncatedSNISuffix}
+	decoded, _, err := decodeStats(statsEntry(t, key, sniStats{}))
+	if err != nil {
+		t.Fatalf("decodeStats() = %v", err)
+	}
+	assert(t, decoded, key)
+
+	tp := &tuple{srcIP: net.ParseIP("10.0.0.1"), dstIP: net.ParseIP("192.168.0.1"), srcPort: 40000, dstPort: 443}
+	e, err := encodeConnection(tp, &tupleData{sni: key.sni})
+	if err != nil {
+		t.Fatalf("encodeConnection() = %v", err)
+	}
+	_, data, err := decodeConnection(e)
+	if err != nil {
+		t.Fatalf("decodeConnection() = %v", err)
+	}
+	assert(t, data.sni, key.sni)
+}
@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"m/config"
+)
+
+// addSNIGroups adds the connections and the stats of the members of
+// the SNI groups to the keys of the groups, with the source and
+// destination of the members. The groups are then accounted like
+// SNIs, so a second of a group fails if one of its members failed and
+// the rules of the configuration match the name of the group.
+func addSNIGroups(cfg *config.Config, connKeys map[ConnKey]struct{}, staleConnections map[ConnKey][]*tupleData, stats map[ConnKey]sniStats) {
+	if len(cfg.SNIGroups) == 0 {
+		return
+	}
+	// The keys of the members are collected first, the map is
+	// extended with the keys of the groups.
+	members := make([]ConnKey, 0, len(connKeys))
+	for connKey := range connKeys {
+		members = append(members, connKey)
+	}
+	for _, member := range members {
+		for _, name := range cfg.SNIGroupNames(member.sni) {
+			group := member
+			group.sni = name
+			connKeys[group] = struct{}{}
+			if connections := staleConnections[member]; len(connections) > 0 {
+				staleConnections[group] = append(staleConnections[group], connections...)
+			}
+			if memberStats, ok := stats[member]; ok {
+				merged := stats[group]
+				merged.add(memberStats)
+				stats[group] = merged
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// statsKeyFromBytes decodes a key of an inner stats map. A key of
+// another size than struct stats_key_t, e.g. from a snapshot file or a
+// map of another program, is rejected instead of being sliced at fixed
+// offsets.
+func statsKeyFromBytes(b []byte) (ConnKey, error) {
+	var key C.struct_stats_key_t
+	if len(b) != C.sizeof_struct_stats_key_t {
+		return ConnKey{}, fmt.Errorf("unexpected size of stats key: got %d, want %d bytes", len(b), C.sizeof_struct_stats_key_t)
+	}
+	copy((*[C.sizeof_struct_stats_key_t]byte)(unsafe.Pointer(&key))[:], b)
+	return statsKeyFromC(key), nil
+}
+
+func statsKeyFromC(key C.struct_stats_key_t) ConnKey {
+	sourceIP := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(sourceIP, uint32(key.source_ip))
+	destIP := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(destIP, uint32(key.dest_ip))
+	sni := make([]byte, len(key.sni))
+	for i, c := range key.sni {
+		sni[i] = byte(c)
+	}
+	return ConnKey{sourceIP: sourceIP.String(), destIP: destIP.String(), sni: sniFromC(sni)}
+}
+
+// statsKeyToBytes is the inverse of statsKeyFromBytes.
+func statsKeyToBytes(ck ConnKey) ([]byte, error) {
+	sourceIP, destIP := net.ParseIP(ck.sourceIP).To4(), net.ParseIP(ck.destIP).To4()
+	if sourceIP == nil || destIP == nil {
+		return nil, fmt.Errorf("no IPv4 addresses: %q, %q", ck.sourceIP, ck.destIP)
+	}
+	sni := sniToC(ck.sni)
+	if len(sni) > C.TLS_MAX_SERVER_NAME_LEN {
+		return nil, fmt.Errorf("SNI field is too long: got %d, allowed %d", len(sni), C.TLS_MAX_SERVER_NAME_LEN)
+	}
+	key := C.struct_stats_key_t{
+		source_ip: C.__u32(binary.LittleEndian.Uint32(sourceIP)),
+		dest_ip:   C.__u32(binary.LittleEndian.Uint32(destIP)),
+	}
+	for i, c := range sni {
+		key.sni[i] = C.char(c)
+	}
+	return copyBytes((*[C.sizeof_struct_stats_key_t]byte)(unsafe.Pointer(&key))[:]), nil
+}
@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"fmt"
+	"time"
+
+	"m/config"
+	"m/metrics"
+)
+
+// throughputTracker accounts the degraded seconds of the connection
+// keys whose SNI has a minimum throughput.
+type throughputTracker struct {
+	// last are the cumulative payload bytes of the keys at the last
+	// read.
+	last map[ConnKey]uint64
+	// degraded are the keys with degraded seconds and the time of their
+	// last update.
+	degraded map[ConnKey]time.Time
+}
+
+func newThroughputTracker() *throughputTracker {
+	return &throughputTracker{
+		last:     make(map[ConnKey]uint64),
+		degraded: make(map[ConnKey]time.Time),
+	}
+}
+
+// degradedKeys returns the connection keys whose payload bytes within
+// the window were below the minimum throughput of their SNI. The keys
+// with an open connection, but without payload bytes, are stalled and
+// degraded as well.
+func degradedKeys(cfg *config.Config, deltas map[ConnKey]uint64, open map[ConnKey]struct{}, window time.Duration) []ConnKey {
+	var keys []ConnKey
+	check := func(k ConnKey, bytes uint64) {
+		minimum := cfg.MinThroughputFor(k.sni)
+		if minimum > 0 && float64(bytes) < float64(minimum)*window.Seconds() {
+			keys = append(keys, k)
+		}
+	}
+	for k, bytes := range deltas {
+		check(k, bytes)
+	}
+	for k := range open {
+		if _, ok := deltas[k]; !ok {
+			check(k, 0)
+		}
+	}
+	return keys
+}
+
+// byteDeltas returns the increase of the counters and replaces the last
+// counters with the current ones. Evicted entries start from zero
+// again.
+func byteDeltas(last, current map[ConnKey]uint64) map[ConnKey]uint64 {
+	deltas := make(map[ConnKey]uint64)
+	for k, count := range current {
+		if delta := counterDelta(last[k], count); delta > 0 {
+			deltas[k] = delta
+		}
+	}
+	for k := range last {
+		if _, ok := current[k]; !ok {
+			delete(last, k)
+		}
+	}
+	for k, count := range current {
+		last[k] = count
+	}
+	return deltas
+}
+
+// readThroughput exports the degraded seconds of the window from the
+// payload bytes counted since the last read and the keys with an open
+// connection. The counting in the kernel is only enabled while a rule
+// has a minimum throughput.
+func (s *NetworkDataSource) readThroughput(t *throughputTracker, cfg *config.Config, open map[ConnKey]struct{}, now time.Time) error {
+	if err := setDataBytesCounting(s.ebpfConfig, cfg.HasMinThroughput()); err != nil {
+		return fmt.Errorf("configuring the counting of the payload bytes: %w", err)
+	}
+	current := make(map[ConnKey]uint64)
+	if s.ebpfConfig.countDataBytes {
+		var key []byte
+		var count uint64
+		entries := s.ebpfConfig.dataBytesMap.Iterate()
+		for entries.Next(&key, &count) {
+			k, err := statsKeyFromBytes(key)
+			if err != nil {
+				return err
+			}
+			k.sni = normalizeSNI(s.normalizer, k.sni)
+			current[k] += count
+		}
+		if err := entries.Err(); err != nil {
+			return err
+		}
+	}
+	s.mutex.RLock()
+	window := orDefault(s.resolution)
+	s.mutex.RUnlock()
+	for _, k := range degradedKeys(cfg, byteDeltas(t.last, current), open, window) {
+		metrics.AddDegradedSeconds(k.sni, k.sourceIP, k.destIP, window.Seconds())
+		t.degraded[k] = now
+	}
+	for k, lastUpdate := range t.degraded {
+		if lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteDegradedSeconds(k.sni, k.sourceIP, k.destIP)
+			delete(t.degraded, k)
+		}
+	}
+	return nil
+}
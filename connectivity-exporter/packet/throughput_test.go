@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"m/config"
+)
+
+func TestDegradedKeys(t *testing.T) {
+	cfg := &config.Config{Rules: []config.Rule{{SNI: "backup.example.com", MinThroughput: 1000}}}
+	fast := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.1", sni: "backup.example.com"}
+	slow := ConnKey{sourceIP: "10.0.0.2", destIP: "192.168.0.1", sni: "backup.example.com"}
+	stalled := ConnKey{sourceIP: "10.0.0.3", destIP: "192.168.0.1", sni: "backup.example.com"}
+	other := ConnKey{sourceIP: "10.0.0.1", destIP: "192.168.0.2", sni: "api.example.com"}
+
+	last := map[ConnKey]uint64{fast: 5000, slow: 100, other: 10}
+	deltas := byteDeltas(last, map[ConnKey]uint64{fast: 7000, slow: 600, other: 20})
+	assert(t, deltas, map[ConnKey]uint64{fast: 2000, slow: 500, other: 10})
+
+	open := map[ConnKey]struct{}{fast: {}, stalled: {}, other: {}}
+	// 2000 bytes are enough within 2 seconds.
+	got := degradedKeys(cfg, deltas, open, 2*time.Second)
+	sort.Slice(got, func(i, j int) bool { return got[i].sourceIP < got[j].sourceIP })
+	assert(t, got, []ConnKey{slow, stalled})
+	// But not within 3 seconds.
+	assert(t, len(degradedKeys(cfg, deltas, open, 3*time.Second)), 3)
+}
@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// tlsParametersKey mirrors struct tls_parameters_t.
+type tlsParametersKey struct {
+	SNI         [C.TLS_MAX_SERVER_NAME_LEN]byte
+	Version     uint16
+	CipherSuite uint16
+	Resumed     uint8
+	EarlyData   uint8
+}
+
+// tlsParameters are the TLS version and cipher suite negotiated for an
+// SNI, and whether the handshake resumed a TLS 1.3 session and offered
+// 0-RTT early data.
+type tlsParameters struct {
+	sni                  string
+	version, cipherSuite uint16
+	resumed, earlyData   bool
+}
+
+// tlsVersionNames are the names of the TLS versions, the version
+// label.
+var tlsVersionNames = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// readTLSParameters exports the handshakes per SNI, negotiated TLS
+// version, cipher suite and resumption since the last read. The kernel counters
+// are cumulative, last holds their previous values.
+func (s *NetworkDataSource) readTLSParameters(last map[tlsParameters]uint64) error {
+	var key tlsParametersKey
+	var count uint64
+	current := make(map[tlsParameters]uint64)
+	entries := s.ebpfConfig.tlsParametersMap.Iterate()
+	for entries.Next(&key, &count) {
+		p := tlsParameters{
+			sni:         sniFromC(key.SNI[:]),
+			version:     key.Version,
+			cipherSuite: key.CipherSuite,
+			resumed:     key.Resumed != 0,
+			earlyData:   key.EarlyData != 0,
+		}
+		current[p] = count
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for p, delta := range tlsParameterDeltas(last, current) {
+		sni := normalizeSNI(s.normalizer, p.sni)
+		metrics.AddTLSHandshakes(sni, tlsVersionName(p.version), tls.CipherSuiteName(p.cipherSuite), p.resumed, float64(delta))
+		if p.earlyData {
+			metrics.AddTLSEarlyData(sni, p.resumed, float64(delta))
+		}
+	}
+	return nil
+}
+
+// tlsParameterDeltas returns the increase of the counters and replaces
+// the last counters with the current ones. Evicted entries start from
+// zero again.
+func tlsParameterDeltas(last, current map[tlsParameters]uint64) map[tlsParameters]uint64 {
+	deltas := make(map[tlsParameters]uint64)
+	for p, count := range current {
+		if delta := counterDelta(last[p], count); delta > 0 {
+			deltas[p] = delta
+		}
+	}
+	for p := range last {
+		if _, ok := current[p]; !ok {
+			delete(last, p)
+		}
+	}
+	for p, count := range current {
+		last[p] = count
+	}
+	return deltas
+}
+
+// tlsAlertKey mirrors struct tls_alert_t.
+type tlsAlertKey struct {
+	SNI         [C.TLS_MAX_SERVER_NAME_LEN]byte
+	Description uint8
+	FromServer  uint8
+}
+
+// tlsAlert is a fatal alert sent during the handshake of an SNI.
+type tlsAlert struct {
+	sni         string
+	description uint8
+	fromServer  bool
+}
+
+// tlsAlertNames are the names of the alert descriptions of RFC 5246
+// and RFC 8446, the alert label.
+var tlsAlertNames = map[uint8]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	21:  "decryption_failed",
+	22:  "record_overflow",
+	30:  "decompression_failure",
+	40:  "handshake_failure",
+	41:  "no_certificate",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func tlsAlertName(description uint8) string {
+	if name, ok := tlsAlertNames[description]; ok {
+		return name
+	}
+	return strconv.Itoa(int(description))
+}
+
+// readTLSAlerts exports the fatal alerts of the handshakes per SNI,
+// alert and sender since the last read. The kernel counters are
+// cumulative, last holds their previous values.
+func (s *NetworkDataSource) readTLSAlerts(last map[tlsAlert]uint64) error {
+	var key tlsAlertKey
+	var count uint64
+	current := make(map[tlsAlert]uint64)
+	entries := s.ebpfConfig.tlsAlertsMap.Iterate()
+	for entries.Next(&key, &count) {
+		a := tlsAlert{sni: sniFromC(key.SNI[:]), description: key.Description, fromServer: key.FromServer != 0}
+		current[a] = count
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for a, delta := range tlsAlertDeltas(last, current) {
+		sender := "client"
+		if a.fromServer {
+			sender = "server"
+		}
+		metrics.AddTLSAlerts(normalizeSNI(s.normalizer, a.sni), tlsAlertName(a.description), sender, float64(delta))
+	}
+	return nil
+}
+
+// tlsAlertDeltas returns the increase of the counters and replaces the
+// last counters with the current ones. Evicted entries start from zero
+// again.
+func tlsAlertDeltas(last, current map[tlsAlert]uint64) map[tlsAlert]uint64 {
+	deltas := make(map[tlsAlert]uint64)
+	for a, count := range current {
+		if delta := counterDelta(last[a], count); delta > 0 {
+			deltas[a] = delta
+		}
+	}
+	for a := range last {
+		if _, ok := current[a]; !ok {
+			delete(last, a)
+		}
+	}
+	for a, count := range current {
+		last[a] = count
+	}
+	return deltas
+}
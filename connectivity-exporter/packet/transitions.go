@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// transitionNames are the names of the state transitions counted by
+// the eBPF program, indexed like the counters of sni_stats_t.
+var transitionNames = [C.TRANSITION_COUNT]string{
+	C.TRANSITION_SYN:        "syn",
+	C.TRANSITION_SYNACK:     "synack",
+	C.TRANSITION_SNI:        "sni",
+	C.TRANSITION_RST_CLIENT: "rst_client",
+	C.TRANSITION_RST_SERVER: "rst_server",
+	C.TRANSITION_FIN:        "fin",
+}
+
+// transitionExpired is the transition of the connections deleted from
+// the connections map because they are old, without being closed.
+const transitionExpired = "expired"
+
+// accountTransitions adds the state transitions of the closed
+// connections and the old connections to the increment. The old
+// connections which are not closed expire.
+func accountTransitions(inc *metrics.Inc, closed [C.TRANSITION_COUNT]uint64, old []*tupleData) {
+	counts := closed
+	var expired uint64
+	for _, td := range old {
+		for i := range counts {
+			if td.transitions&(1<<i) != 0 {
+				counts[i]++
+			}
+		}
+		if !td.closed() {
+			expired++
+		}
+	}
+	for i, n := range counts {
+		if n > 0 {
+			inc.AddTransitions(transitionNames[i], float64(n))
+		}
+	}
+	if expired > 0 {
+		inc.AddTransitions(transitionExpired, float64(expired))
+	}
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+
+	"github.com/cilium/ebpf"
+
+	"m/metrics"
+)
+
+// readTTLAnomalies exports the typical TTL of the destinations and
+// the number of packets with an unexpected TTL since the last read.
+// The kernel counters are cumulative, last holds their previous
+// values per destination IP.
+func (s *NetworkDataSource) readTTLAnomalies(last map[string]uint64) error {
+	var ip [net.IPv4len]byte
+	var typical struct {
+		TTL, Deviations uint8
+	}
+	ttls := make(map[string]uint8)
+	entries := s.ebpfConfig.destTTLMap.Iterate()
+	for entries.Next(&ip, &typical) {
+		ttls[net.IP(ip[:]).String()] = typical.TTL
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	metrics.SetDestinationTTLs(ttls)
+
+	var count uint64
+	current := make(map[string]uint64)
+	entries = s.ebpfConfig.ttlAnomalyMap.Iterate()
+	for entries.Next(&ip, &count) {
+		current[net.IP(ip[:]).String()] = count
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+
+	for destIP, count := range current {
+		if delta := counterDelta(last[destIP], count); delta > 0 {
+			metrics.AddTTLAnomalies(destIP, float64(delta))
+		}
+	}
+	// Evicted destinations start from zero again.
+	for destIP := range last {
+		if _, ok := current[destIP]; !ok {
+			delete(last, destIP)
+		}
+	}
+	for destIP, count := range current {
+		last[destIP] = count
+	}
+	return nil
+}
+
+// readLateWrites counts the writes to sealed slots of the stats map
+// since the last read. The kernel counter is cumulative, last holds
+// its previous value.
+func (s *NetworkDataSource) readLateWrites(last *uint64) error {
+	delta, err := readCounter(s.ebpfConfig.lateWritesMap, last)
+	if delta > 0 {
+		metrics.AddLateStatsWrites(float64(delta))
+	}
+	return err
+}
+
+// readSNITruncations counts the SNIs truncated since the last read.
+func (s *NetworkDataSource) readSNITruncations(last *uint64) error {
+	delta, err := readCounter(s.ebpfConfig.truncationsMap, last)
+	if delta > 0 {
+		metrics.AddSNITruncations(float64(delta))
+	}
+	return err
+}
+
+// readCounter returns the increase of a cumulative kernel counter in
+// an array map with a single entry since its last value.
+func readCounter(m *ebpf.Map, last *uint64) (uint64, error) {
+	var count uint64
+	if err := m.Lookup(uint32(0), &count); err != nil {
+		return 0, err
+	}
+	delta := counterDelta(*last, count)
+	*last = count
+	return delta, nil
+}
+
+// counterDelta returns the increase of a cumulative kernel counter.
+// A counter lower than before was reset, e.g. because its map entry
+// was evicted and created again, so the whole value is the increase.
+func counterDelta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
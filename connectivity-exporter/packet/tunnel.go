@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import "fmt"
+
+// tunnelPorts are the UDP destination ports of the VXLAN, Geneve and
+// GTP-U tunnels whose inner packets the eBPF program tracks instead of
+// the outer ones, 0 if it does not.
+type tunnelPorts struct {
+	vxlan, geneve, gtpu uint16
+}
+
+// SetTunnelPorts makes the eBPF program track the inner packets of the
+// VXLAN, Geneve and GTP-U tunnels to the UDP ports, e.g. 4789 for VXLAN,
+// 6081 for Geneve and 2152 for GTP-U, when it is attached to the
+// underlay interface of an overlay network or to the N3 interface of a
+// mobile network. The CIDRs and ports are matched against the inner
+// packets. A port of 0 disables the decapsulation.
+func (s *NetworkDataSource) SetTunnelPorts(vxlan, geneve, gtpu int) error {
+	names := map[int]string{}
+	for _, t := range []struct {
+		name string
+		port int
+	}{{"VXLAN", vxlan}, {"Geneve", geneve}, {"GTP-U", gtpu}} {
+		if t.port < 0 || t.port > 65535 {
+			return fmt.Errorf("invalid tunnel port %d", t.port)
+		}
+		if t.port == 0 {
+			continue
+		}
+		if name, ok := names[t.port]; ok {
+			return fmt.Errorf("the %s and the %s tunnel use the same port %d", name, t.name, t.port)
+		}
+		names[t.port] = t.name
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ebpfConfig == nil {
+		return nil
+	}
+	capture := s.setupOptions().capture()
+	capture.tunnels = tunnelPorts{vxlan: uint16(vxlan), geneve: uint16(geneve), gtpu: uint16(gtpu)}
+	if err := initCaptureMap(s.ebpfConfig.captureMap, capture); err != nil {
+		return fmt.Errorf("initializing capture map: %w", err)
+	}
+	s.tunnels = capture.tunnels
+	return nil
+}
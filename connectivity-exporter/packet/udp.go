@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+const (
+	// DefaultUDPResponseTimeout is the time after which a UDP flow
+	// without a datagram from the server is unanswered.
+	DefaultUDPResponseTimeout = 5 * time.Second
+	// udpFlowIdleTimeout is the time after which a flow without
+	// datagrams is deleted, so the next datagram of its client starts a
+	// new flow.
+	udpFlowIdleTimeout = time.Minute
+)
+
+// The outcomes of the UDP flows.
+const (
+	udpFlowAnswered   = "answered"
+	udpFlowUnanswered = "unanswered"
+)
+
+// udpFlow mirrors struct udp_flow_t.
+type udpFlow struct {
+	FirstTick, LastTick          uint64
+	ClientPackets, ServerPackets uint32
+}
+
+// udpFlowKey identifies a UDP flow by its tuple from the client.
+type udpFlowKey = C.struct_tuple_key_t
+
+// udpDestination is the server of a UDP flow.
+type udpDestination struct {
+	ip   string
+	port uint16
+}
+
+// udpFlowTracker accounts the UDP flows once, when they are answered or
+// time out, and deletes them when they time out or go idle.
+type udpFlowTracker struct {
+	// answered are the flows accounted as answered.
+	answered map[udpFlowKey]struct{}
+	// destinations are the destinations with metrics and the time of
+	// their last update.
+	destinations map[udpDestination]time.Time
+}
+
+func newUDPFlowTracker() *udpFlowTracker {
+	return &udpFlowTracker{
+		answered:     make(map[udpFlowKey]struct{}),
+		destinations: make(map[udpDestination]time.Time),
+	}
+}
+
+// account returns the outcome of the flow at the tick, empty if it is
+// not accounted at the tick, and whether the flow is deleted.
+func (t *udpFlowTracker) account(key udpFlowKey, flow udpFlow, tick, timeoutTicks, idleTicks uint64) (string, bool) {
+	var outcome string
+	if flow.ServerPackets > 0 {
+		if _, ok := t.answered[key]; !ok {
+			t.answered[key] = struct{}{}
+			outcome = udpFlowAnswered
+		}
+	} else if tick > flow.FirstTick+timeoutTicks {
+		// A datagram of the client after the timeout starts a new
+		// flow, e.g. a retry.
+		return udpFlowUnanswered, true
+	}
+	if tick > flow.LastTick+idleTicks {
+		delete(t.answered, key)
+		return outcome, true
+	}
+	return outcome, false
+}
+
+// readUDPFlows accounts the UDP flows answered or timed out since the
+// last read. The tick is the current ticker clock of the program.
+func (s *NetworkDataSource) readUDPFlows(t *udpFlowTracker, tick uint64, now time.Time) error {
+	s.mutex.RLock()
+	resolution := orDefault(s.resolution)
+	timeout := s.udpResponseTimeout
+	s.mutex.RUnlock()
+	if timeout == 0 {
+		timeout = DefaultUDPResponseTimeout
+	}
+	timeoutTicks := uint64((timeout + resolution - 1) / resolution)
+	idleTicks := uint64((udpFlowIdleTimeout + resolution - 1) / resolution)
+
+	var key udpFlowKey
+	var flow udpFlow
+	var deleted []udpFlowKey
+	seen := make(map[udpFlowKey]struct{})
+	entries := s.ebpfConfig.udpFlowsMap.Iterate()
+	for entries.Next(unsafe.Pointer(&key), &flow) {
+		seen[key] = struct{}{}
+		outcome, remove := t.account(key, flow, tick, timeoutTicks, idleTicks)
+		if remove {
+			deleted = append(deleted, key)
+		}
+		if outcome == "" {
+			continue
+		}
+		d := udpDestination{ip: connKeyFromC(key, "").destIP, port: ntohs(uint16(key.dest_port))}
+		metrics.AddUDPFlows(outcome, d.ip, strconv.Itoa(int(d.port)), 1)
+		t.destinations[d] = now
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for _, k := range deleted {
+		k := k
+		if err := s.ebpfConfig.udpFlowsMap.Delete(unsafe.Pointer(&k)); err != nil {
+			return fmt.Errorf("deleting UDP flow: %w", err)
+		}
+	}
+	// The flows evicted from the LRU map are forgotten.
+	for k := range t.answered {
+		if _, ok := seen[k]; !ok {
+			delete(t.answered, k)
+		}
+	}
+	for d, lastUpdate := range t.destinations {
+		if lastUpdate.Add(metrics.Expiration).Before(now) {
+			metrics.DeleteUDPFlows(d.ip, strconv.Itoa(int(d.port)))
+			delete(t.destinations, d)
+		}
+	}
+	return nil
+}
+
+// SetUDPResponseTimeout sets the time after which a UDP flow without a
+// datagram from the server is accounted as unanswered.
+func (s *NetworkDataSource) SetUDPResponseTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid UDP response timeout %s, expected a positive duration", timeout)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.udpResponseTimeout = timeout
+	return nil
+}
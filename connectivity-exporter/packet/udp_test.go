@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"testing"
+)
+
+func TestUDPFlowTracker(t *testing.T) {
+	tracker := newUDPFlowTracker()
+	var answered, unanswered udpFlowKey
+	unanswered.source_port = 1
+	const timeout, idle = 5, 60
+
+	type result struct {
+		outcome string
+		remove  bool
+	}
+	account := func(key udpFlowKey, flow udpFlow, tick uint64) result {
+		outcome, remove := tracker.account(key, flow, tick, timeout, idle)
+		return result{outcome, remove}
+	}
+	// Answered once, accounted once.
+	assert(t, account(answered, udpFlow{FirstTick: 10, LastTick: 11, ClientPackets: 1, ServerPackets: 1}, 11), result{udpFlowAnswered, false})
+	assert(t, account(answered, udpFlow{FirstTick: 10, LastTick: 30, ClientPackets: 5, ServerPackets: 5}, 30), result{"", false})
+	// Idle flows are deleted and forgotten.
+	assert(t, account(answered, udpFlow{FirstTick: 10, LastTick: 30, ClientPackets: 5, ServerPackets: 5}, 91), result{"", true})
+	assert(t, len(tracker.answered), 0)
+
+	// Not yet timed out.
+	assert(t, account(unanswered, udpFlow{FirstTick: 10, LastTick: 12, ClientPackets: 3}, 15), result{"", false})
+	assert(t, account(unanswered, udpFlow{FirstTick: 10, LastTick: 12, ClientPackets: 3}, 16), result{udpFlowUnanswered, true})
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"net"
+	"strconv"
+
+	"k8s.io/klog/v2"
+
+	"m/config"
+	"m/metrics"
+)
+
+// #include "./c/types.h"
+import "C"
+
+// UnknownSNI is the SNI the connections are accounted for whose SNI
+// could not be extracted, e.g. because the handshake never started,
+// unless their destination is in a CIDR group.
+const UnknownSNI = "unknown"
+
+// fallbackSNI returns the SNI a connection without an SNI is
+// accounted for: the name of the CIDR group of its destination, or
+// the unknown SNI.
+func fallbackSNI(cfg *config.Config, destIP net.IP) string {
+	if name := cfg.CIDRGroupName(destIP); name != "" {
+		return name
+	}
+	return UnknownSNI
+}
+
+// accountNoSNI accounts an old connection without an SNI for the
+// pseudo SNI of the port of its server. The protocol of the port need
+// not start with a ClientHello, so a connection answered by the server
+// is established rather than a failed handshake.
+func (s *State) accountNoSNI(key C.struct_tuple_key_t, data *tupleData) {
+	data.sni = noSNI(s.noSNIPrefix, ntohs(uint16(key.dest_port)))
+	data.noSNI = true
+	if data.state == SYNACK_RECEIVED {
+		data.state = SNI_RECEIVED
+	}
+}
+
+// unknownSNILogInterval is the number of connections without an SNI
+// per debug log message.
+const unknownSNILogInterval = 100
+
+// countUnknownSNI counts a connection without an SNI per destination
+// and logs a sample of them.
+func (s *State) countUnknownSNI(key C.struct_tuple_key_t, data *tupleData) {
+	destPort := strconv.Itoa(int(ntohs(uint16(key.dest_port))))
+	if !s.quiet {
+		metrics.IncUnknownSNIConnections(data.destIP.String(), destPort, data.state.String())
+	}
+	if s.unknownSNIs%unknownSNILogInterval == 0 && klog.V(2).Enabled() {
+		klog.Infof("Connection without SNI from %s to %s: %s (%d so far)",
+			data.sourceIP, net.JoinHostPort(data.destIP.String(), destPort), data.state, s.unknownSNIs+1)
+	}
+	s.unknownSNIs++
+}
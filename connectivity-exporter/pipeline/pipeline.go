@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package pipeline runs the long-running goroutines of the exporter in
+// stages, from the data source to the accounting to the sinks, and
+// stops them in that order. A goroutine only stops after all the
+// goroutines of the previous stages returned, so it keeps receiving
+// until nothing can be sent to it anymore: no sender blocks on a
+// receiver which returned, and no stage sends on a channel closed by a
+// stage which stopped before.
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Goroutine is a long-running function of a stage. It returns once the
+// context is done and calls wg.Done, like the long-running functions
+// of the exporter.
+type Goroutine func(ctx context.Context, wg *sync.WaitGroup)
+
+// Pipeline is a sequence of stages.
+type Pipeline struct {
+	stages [][]Goroutine
+}
+
+// Add appends a stage, whose goroutines are stopped once the goroutines
+// of all the previous stages returned.
+func (p *Pipeline) Add(goroutines ...Goroutine) {
+	p.stages = append(p.stages, goroutines)
+}
+
+// Run starts the goroutines of all stages and blocks until the context
+// is done and all of them returned, stage by stage.
+func (p *Pipeline) Run(ctx context.Context) {
+	cancels := make([]context.CancelFunc, len(p.stages))
+	wgs := make([]*sync.WaitGroup, len(p.stages))
+	for i, stage := range p.stages {
+		// Only the first stage follows the context, the later ones
+		// are cancelled in order.
+		parent := context.Background()
+		if i == 0 {
+			parent = ctx
+		}
+		var stageCtx context.Context
+		stageCtx, cancels[i] = context.WithCancel(parent)
+		wgs[i] = &sync.WaitGroup{}
+		wgs[i].Add(len(stage))
+		for _, g := range stage {
+			go g(stageCtx, wgs[i])
+		}
+	}
+	<-ctx.Done()
+	for i := range p.stages {
+		cancels[i]()
+		wgs[i].Wait()
+	}
+}
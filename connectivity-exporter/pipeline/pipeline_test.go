@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelineStopsInOrder(t *testing.T) {
+	values := make(chan int)
+	var mutex sync.Mutex
+	var stopped []string
+	stop := func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = append(stopped, name)
+	}
+	sent, received := 0, 0
+
+	p := &Pipeline{}
+	// The source sends without watching the context while sending,
+	// like a data source in the middle of a tick.
+	p.Add(func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		defer stop("source")
+		for ctx.Err() == nil {
+			values <- sent
+			sent++
+		}
+	})
+	p.Add(func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		defer stop("accounting")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-values:
+				received++
+			}
+		}
+	})
+	p.Add(func(ctx context.Context, wg *sync.WaitGroup) {
+		defer wg.Done()
+		<-ctx.Done()
+		stop("sink")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The pipeline did not stop")
+	}
+	if sent != received {
+		t.Errorf("Sent %d values, received %d", sent, received)
+	}
+	if len(stopped) != 3 || stopped[0] != "source" || stopped[1] != "accounting" || stopped[2] != "sink" {
+		t.Errorf("Wrong order of the stages: %v", stopped)
+	}
+}
@@ -0,0 +1,238 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package podmonitor registers the exporter with the Prometheus
+// operator. The PodMonitor is derived from the listen configuration of
+// the running exporter and the labels of its pod, so the scrape
+// configuration cannot drift from the deployment.
+package podmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/kube"
+	"m/server"
+)
+
+const fieldManager = "connectivity-exporter"
+
+// podLabelsIgnored are the labels set by the controllers of the pod,
+// which differ between the revisions of the pod.
+var podLabelsIgnored = map[string]bool{
+	"controller-revision-hash": true,
+	"pod-template-generation":  true,
+	"pod-template-hash":        true,
+}
+
+// Options configure the PodMonitor.
+type Options struct {
+	// Name is the name of the PodMonitor.
+	Name string
+	// PodName is the name of the pod of the exporter, usually passed
+	// via the downward API.
+	PodName string
+	// Labels are the labels of the PodMonitor, e.g. to be selected by
+	// the Prometheus instance.
+	Labels map[string]string
+	// Interval is the scrape interval, empty for the default of the
+	// Prometheus instance.
+	Interval string
+}
+
+// podMonitor is the subset of the PodMonitor resource of the Prometheus
+// operator set by the exporter.
+type podMonitor struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   metadata       `json:"metadata"`
+	Spec       podMonitorSpec `json:"spec"`
+}
+
+type metadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type podMonitorSpec struct {
+	Selector            labelSelector `json:"selector"`
+	PodMetricsEndpoints []endpoint    `json:"podMetricsEndpoints"`
+}
+
+type labelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels"`
+}
+
+type endpoint struct {
+	Port        string       `json:"port,omitempty"`
+	TargetPort  *int         `json:"targetPort,omitempty"`
+	Path        string       `json:"path"`
+	Scheme      string       `json:"scheme"`
+	Interval    string       `json:"interval,omitempty"`
+	Relabelings []relabeling `json:"relabelings,omitempty"`
+}
+
+type relabeling struct {
+	SourceLabels []string `json:"sourceLabels"`
+	TargetLabel  string   `json:"targetLabel"`
+}
+
+// pod is the subset of a pod read by the exporter.
+type pod struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+}
+
+// build returns the PodMonitor scraping the metrics listener of the pod.
+func build(opts Options, namespace string, p *pod, metrics *server.Listener) (*podMonitor, error) {
+	_, portString, err := net.SplitHostPort(metrics.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the metrics address: %w", err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the metrics port %q: %w", portString, err)
+	}
+	if metrics.ClientCAFile != "" || metrics.TokenFile != "" || metrics.KubernetesAuth {
+		klog.Warningf("The PodMonitor %s does not configure the client certificate or the token of the metrics listener", opts.Name)
+	}
+
+	e := endpoint{Path: "/metrics", Scheme: "http", Interval: opts.Interval}
+	if metrics.TLSCertFile != "" {
+		e.Scheme = "https"
+	}
+	// A named port is preferred, the target port is deprecated.
+	for _, c := range p.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.ContainerPort == port && cp.Name != "" {
+				e.Port = cp.Name
+			}
+		}
+	}
+	if e.Port == "" {
+		e.TargetPort = &port
+	}
+	e.Relabelings = []relabeling{{SourceLabels: []string{"__meta_kubernetes_pod_node_name"}, TargetLabel: "node"}}
+
+	selector := make(map[string]string)
+	for k, v := range p.Metadata.Labels {
+		if !podLabelsIgnored[k] {
+			selector[k] = v
+		}
+	}
+	if len(selector) == 0 {
+		return nil, errors.New("the pod has no labels to select it")
+	}
+
+	return &podMonitor{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "PodMonitor",
+		Metadata:   metadata{Name: opts.Name, Namespace: namespace, Labels: opts.Labels},
+		Spec: podMonitorSpec{
+			Selector:            labelSelector{MatchLabels: selector},
+			PodMetricsEndpoints: []endpoint{e},
+		},
+	}, nil
+}
+
+func getPod(ctx context.Context, c *kube.Client, namespace, name string) (*pod, error) {
+	p := &pod{}
+	if err := c.Do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), "", nil, p); err != nil {
+		return nil, fmt.Errorf("reading the pod: %w", err)
+	}
+	return p, nil
+}
+
+// apply creates or updates the PodMonitor with a server-side apply, so
+// the fields set by others are kept.
+func apply(ctx context.Context, c *kube.Client, pm *podMonitor) error {
+	body, err := json.Marshal(pm)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/apis/monitoring.coreos.com/v1/namespaces/%s/podmonitors/%s?fieldManager=%s&force=true",
+		pm.Metadata.Namespace, pm.Metadata.Name, fieldManager)
+	if err := c.Do(ctx, http.MethodPatch, path, "application/apply-patch+yaml", body, nil); err != nil {
+		return fmt.Errorf("applying the PodMonitor: %w", err)
+	}
+	return nil
+}
+
+// register applies the PodMonitor of the pod.
+func register(ctx context.Context, c *kube.Client, namespace string, opts Options, metrics *server.Listener) error {
+	p, err := getPod(ctx, c, namespace, opts.PodName)
+	if err != nil {
+		return err
+	}
+	pm, err := build(opts, namespace, p, metrics)
+	if err != nil {
+		return err
+	}
+	return apply(ctx, c, pm)
+}
+
+// Run applies the PodMonitor on start and on every tick, so changes of
+// the PodMonitor by others are reverted. Failures are logged and
+// retried on the next tick.
+func Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time, opts Options, metrics *server.Listener) {
+	defer wg.Done()
+	if opts.PodName == "" {
+		klog.Errorf("Failed to register the PodMonitor: the pod name is unknown")
+		return
+	}
+	c, namespace, err := kube.NewInClusterClient()
+	if err != nil {
+		klog.Errorf("Failed to register the PodMonitor: %v", err)
+		return
+	}
+	done := ctx.Done()
+	for {
+		if err := register(ctx, c, namespace, opts, metrics); err != nil {
+			klog.Errorf("Failed to register the PodMonitor: %v", err)
+		} else {
+			klog.V(2).Infof("Registered the PodMonitor %s/%s", namespace, opts.Name)
+		}
+		select {
+		case <-ticks:
+		case <-done:
+			return
+		}
+	}
+}
+
+// ParseLabels parses labels like "release=prometheus,team=network".
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,85 @@
+package podmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"m/kube"
+	"m/server"
+)
+
+func TestRegister(t *testing.T) {
+	var applied podMonitor
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/monitoring/pods/exporter-x7k2p":
+			io.WriteString(w, `{"metadata": {"labels": {"app": "connectivity-exporter", "controller-revision-hash": "5d8f"}},
+				"spec": {"containers": [{"ports": [{"name": "metrics", "containerPort": 19101}]}]}}`)
+		case r.Method == http.MethodPatch && r.URL.Path == "/apis/monitoring.coreos.com/v1/namespaces/monitoring/podmonitors/exporter":
+			if r.URL.Query().Get("fieldManager") != fieldManager || r.Header.Get("Content-Type") != "application/apply-patch+yaml" {
+				http.Error(w, "not a server-side apply", http.StatusBadRequest)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&applied); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	c := kube.NewClient(api.URL, "token", api.Client())
+	opts := Options{Name: "exporter", PodName: "exporter-x7k2p", Labels: map[string]string{"release": "prometheus"}, Interval: "10s"}
+	metrics := &server.Listener{Name: "metrics", Addr: ":19101", TLSCertFile: "tls.crt", TLSKeyFile: "tls.key"}
+
+	if err := register(context.Background(), c, "monitoring", opts, metrics); err != nil {
+		t.Fatalf("register() = %v", err)
+	}
+	want := podMonitor{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "PodMonitor",
+		Metadata:   metadata{Name: "exporter", Namespace: "monitoring", Labels: map[string]string{"release": "prometheus"}},
+		Spec: podMonitorSpec{
+			Selector: labelSelector{MatchLabels: map[string]string{"app": "connectivity-exporter"}},
+			PodMetricsEndpoints: []endpoint{{
+				Port:        "metrics",
+				Path:        "/metrics",
+				Scheme:      "https",
+				Interval:    "10s",
+				Relabelings: []relabeling{{SourceLabels: []string{"__meta_kubernetes_pod_node_name"}, TargetLabel: "node"}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("Applied %+v\nwant %+v", applied, want)
+	}
+
+	// Without a named container port, the port number is used.
+	metrics.Addr = "127.0.0.1:9100"
+	applied = podMonitor{}
+	if err := register(context.Background(), c, "monitoring", opts, metrics); err != nil {
+		t.Fatalf("register() = %v", err)
+	}
+	if e := applied.Spec.PodMetricsEndpoints[0]; e.Port != "" || e.TargetPort == nil || *e.TargetPort != 9100 {
+		t.Errorf("Wrong endpoint %+v", e)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("release=prometheus,team=")
+	if err != nil || !reflect.DeepEqual(labels, map[string]string{"release": "prometheus", "team": ""}) {
+		t.Errorf("ParseLabels() = %v, %v", labels, err)
+	}
+	if _, err := ParseLabels("release"); err == nil {
+		t.Errorf("ParseLabels() of a label without a value should fail")
+	}
+}
@@ -7,6 +7,7 @@ package promextra
 import (
 	"fmt"
 	"math"
+	"strings"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,6 +19,11 @@ type Snapshot struct {
 	Total uint64
 	// This field does contain the +Inf bucket.
 	Buckets []uint64
+	// Name identifies the histogram the snapshot is of, empty for the
+	// execution time.
+	Name string
+	// LabelValues select the histogram of a PrecomputedHistogramVec.
+	LabelValues []string
 }
 
 type PrecomputedHistogram struct {
@@ -151,6 +157,79 @@ func (s *PrecomputedHistogram) ApplySnapshot(snapshot Snapshot) error {
 	return nil
 }
 
+// PrecomputedHistogramVec is a PrecomputedHistogram per combination of
+// label values, each one updated with its own snapshots.
+type PrecomputedHistogramVec struct {
+	desc *prometheus.Desc
+	// This field does not contain the +Inf bucket.
+	buckets []float64
+
+	mutex     sync.Mutex
+	snapshots map[string]Snapshot
+}
+
+var _ prometheus.Collector = (*PrecomputedHistogramVec)(nil)
+
+func NewPrecomputedHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *PrecomputedHistogramVec {
+	h := NewPrecomputedHistogram(opts)
+	return &PrecomputedHistogramVec{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help,
+			labelNames,
+			opts.ConstLabels,
+		),
+		buckets:   h.buckets,
+		snapshots: make(map[string]Snapshot),
+	}
+}
+
+// Describe is a part of an implementation of the prometheus.Collector
+// interface.
+func (v *PrecomputedHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+// Collect is a part of an implementation of the prometheus.Collector
+// interface. Every histogram is written like a PrecomputedHistogram
+// with its label values.
+func (v *PrecomputedHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, snapshot := range v.snapshots {
+		ch <- &PrecomputedHistogram{
+			desc:            v.desc,
+			buckets:         v.buckets,
+			labels:          prometheus.MakeLabelPairs(v.desc, snapshot.LabelValues),
+			currentSnapshot: snapshot,
+		}
+	}
+}
+
+// ApplySnapshot replaces the histogram of the label values of the
+// snapshot.
+func (v *PrecomputedHistogramVec) ApplySnapshot(snapshot Snapshot) error {
+	// The +Inf bucket is not in the bounds.
+	if len(snapshot.Buckets) != len(v.buckets)+1 {
+		return fmt.Errorf("snapshot bucket count is not equal to current bucket count, %d vs %d", len(snapshot.Buckets), len(v.buckets)+1)
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.snapshots[labelKey(snapshot.LabelValues)] = snapshot
+	return nil
+}
+
+// Delete removes the histogram of the label values.
+func (v *PrecomputedHistogramVec) Delete(labelValues ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.snapshots, labelKey(labelValues))
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
 func (s *PrecomputedHistogram) checkSnapshot(snapshot Snapshot) error {
 	if len(snapshot.Buckets) != len(s.currentSnapshot.Buckets) {
 		return fmt.Errorf("snapshot bucket count is not equal to current bucket count, %d vs %d", len(snapshot.Buckets), len(s.currentSnapshot.Buckets))
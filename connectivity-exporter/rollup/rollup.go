@@ -0,0 +1,288 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package rollup keeps the accounted seconds per SNI in calendar
+// periods, so the availability of past days, weeks and months can be
+// reported without a long Prometheus retention.
+package rollup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+// Period is a calendar period in UTC.
+type Period string
+
+const (
+	Day Period = "day"
+	// Week starts on Monday.
+	Week  Period = "week"
+	Month Period = "month"
+)
+
+// Periods are all the periods the seconds are rolled up in.
+var Periods = []Period{Day, Week, Month}
+
+// retention is the number of past periods kept.
+var retention = map[Period]int{
+	Day:   62,
+	Week:  15,
+	Month: 13,
+}
+
+// Start returns the start of the period containing the time t.
+func (p Period) Start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case Week:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// add returns the start of the period n periods after the period
+// starting at start.
+func (p Period) add(start time.Time, n int) time.Time {
+	switch p {
+	case Week:
+		return start.AddDate(0, 0, 7*n)
+	case Month:
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(0, 0, n)
+	}
+}
+
+func (p Period) valid() bool {
+	_, ok := retention[p]
+	return ok
+}
+
+// Rollup are the seconds of an SNI accounted in a period.
+type Rollup struct {
+	SNI                 string    `json:"sni"`
+	Period              Period    `json:"period"`
+	Start               time.Time `json:"start"`
+	ActiveSeconds       float64   `json:"activeSeconds"`
+	ActiveFailedSeconds float64   `json:"activeFailedSeconds"`
+	FailedSeconds       float64   `json:"failedSeconds"`
+	SilencedSeconds     float64   `json:"silencedSeconds"`
+	// Availability is the share of the active seconds which did not
+	// fail, unset without active seconds.
+	Availability *float64 `json:"availability,omitempty"`
+}
+
+func (r *Rollup) add(inc *metrics.Inc) {
+	r.ActiveSeconds += inc.ActiveSeconds
+	r.ActiveFailedSeconds += inc.ActiveFailedSeconds
+	r.FailedSeconds += inc.FailedSeconds
+	r.SilencedSeconds += inc.SilencedSeconds
+}
+
+func (r Rollup) withAvailability() Rollup {
+	r.Availability = nil
+	if r.ActiveSeconds > 0 {
+		availability := 1 - r.ActiveFailedSeconds/r.ActiveSeconds
+		r.Availability = &availability
+	}
+	return r
+}
+
+type key struct {
+	sni    string
+	period Period
+	start  int64
+}
+
+// Tracker keeps the rollups of the SNIs and persists them to a file.
+type Tracker struct {
+	filename string
+
+	mutex   sync.Mutex
+	rollups map[key]*Rollup
+}
+
+// NewTracker creates a tracker persisting the rollups to the file. The
+// rollups already in the file are loaded. An empty filename keeps the
+// rollups in memory only.
+func NewTracker(filename string) (*Tracker, error) {
+	t := &Tracker{filename: filename, rollups: make(map[key]*Rollup)}
+	if filename == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading rollups: %w", err)
+	}
+	var rollups []*Rollup
+	if err := json.Unmarshal(data, &rollups); err != nil {
+		return nil, fmt.Errorf("parsing rollups %s: %w", filename, err)
+	}
+	for _, r := range rollups {
+		if !r.Period.valid() {
+			return nil, fmt.Errorf("parsing rollups %s: invalid period %q", filename, r.Period)
+		}
+		r.Availability = nil
+		t.rollups[key{r.SNI, r.Period, r.Start.Unix()}] = r
+	}
+	return t, nil
+}
+
+// Observe adds the seconds of the increment to the current periods.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, p := range Periods {
+		start := p.Start(inc.Time)
+		k := key{inc.SNI, p, start.Unix()}
+		r, ok := t.rollups[k]
+		if !ok {
+			r = &Rollup{SNI: inc.SNI, Period: p, Start: start}
+			t.rollups[k] = r
+		}
+		r.add(inc)
+	}
+}
+
+// Current returns the rollups of the periods containing the time now.
+func (t *Tracker) Current(now time.Time) []metrics.Rollup {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var out []metrics.Rollup
+	for _, r := range t.rollups {
+		if !r.Start.Equal(r.Period.Start(now)) {
+			continue
+		}
+		out = append(out, metrics.Rollup{
+			SNI:                 r.SNI,
+			Period:              string(r.Period),
+			ActiveSeconds:       r.ActiveSeconds,
+			ActiveFailedSeconds: r.ActiveFailedSeconds,
+		})
+	}
+	return out
+}
+
+// Query returns the rollups of the period of the SNIs matching the
+// pattern, sorted by SNI and start.
+func (t *Tracker) Query(sniPattern string, period Period) ([]Rollup, error) {
+	if _, err := path.Match(sniPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid SNI pattern %q: %w", sniPattern, err)
+	}
+	if !period.valid() {
+		return nil, fmt.Errorf("invalid period %q", period)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	out := []Rollup{}
+	for _, r := range t.rollups {
+		if r.Period != period {
+			continue
+		}
+		if ok, _ := path.Match(sniPattern, r.SNI); !ok {
+			continue
+		}
+		out = append(out, r.withAvailability())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SNI != out[j].SNI {
+			return out[i].SNI < out[j].SNI
+		}
+		return out[i].Start.Before(out[j].Start)
+	})
+	return out, nil
+}
+
+// Run removes the rollups older than their retention and saves the
+// rollups on every tick and before returning.
+func (t *Tracker) Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time) {
+	defer wg.Done()
+	done := ctx.Done()
+	for {
+		select {
+		case now := <-ticks:
+			t.expire(now)
+			if err := t.save(); err != nil {
+				klog.Errorf("Failed to save the rollups: %v", err)
+			}
+		case <-done:
+			if err := t.save(); err != nil {
+				klog.Errorf("Failed to save the rollups: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (t *Tracker) expire(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for k, r := range t.rollups {
+		if r.Period.add(r.Start, retention[r.Period]).Before(r.Period.Start(now)) {
+			delete(t.rollups, k)
+		}
+	}
+}
+
+// save writes the rollups to a temporary file which replaces the file,
+// so a crash does not leave a partial file behind.
+func (t *Tracker) save() error {
+	if t.filename == "" {
+		return nil
+	}
+	t.mutex.Lock()
+	rollups := make([]*Rollup, 0, len(t.rollups))
+	for _, r := range t.rollups {
+		copied := *r
+		rollups = append(rollups, &copied)
+	}
+	t.mutex.Unlock()
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if a.SNI != b.SNI {
+			return a.SNI < b.SNI
+		}
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		return a.Start.Before(b.Start)
+	})
+	data, err := json.Marshal(rollups)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.filename), filepath.Base(t.filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.filename)
+}
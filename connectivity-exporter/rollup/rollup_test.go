@@ -0,0 +1,75 @@
+package rollup
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"m/metrics"
+)
+
+func TestPeriodStart(t *testing.T) {
+	// A Sunday.
+	now := time.Date(2022, 5, 15, 10, 30, 0, 0, time.UTC)
+	for p, want := range map[Period]time.Time{
+		Day:   time.Date(2022, 5, 15, 0, 0, 0, 0, time.UTC),
+		Week:  time.Date(2022, 5, 9, 0, 0, 0, 0, time.UTC),
+		Month: time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if got := p.Start(now); !got.Equal(want) {
+			t.Errorf("%s.Start(%s) = %s, want %s", p, now, got, want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rollups.json")
+	tracker, err := NewTracker(filename)
+	if err != nil {
+		t.Fatalf("NewTracker() = %v", err)
+	}
+	may := time.Date(2022, 5, 31, 23, 59, 0, 0, time.UTC)
+	june := time.Date(2022, 6, 1, 0, 1, 0, 0, time.UTC)
+	tracker.Observe(&metrics.Inc{SNI: "a.example.com", ActiveSeconds: 4, ActiveFailedSeconds: 1, Time: may})
+	tracker.Observe(&metrics.Inc{SNI: "a.example.com", ActiveSeconds: 2, Time: june})
+	tracker.Observe(&metrics.Inc{SNI: "b.example.com", ActiveSeconds: 1, Time: june})
+
+	// Save and load the rollups.
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go tracker.Run(ctx, wg, nil)
+	cancel()
+	wg.Wait()
+	tracker, err = NewTracker(filename)
+	if err != nil {
+		t.Fatalf("NewTracker() = %v", err)
+	}
+
+	rollups, err := tracker.Query("a.*", Month)
+	if err != nil {
+		t.Fatalf("Query() = %v", err)
+	}
+	if len(rollups) != 2 {
+		t.Fatalf("Query() returned %d rollups, want 2: %+v", len(rollups), rollups)
+	}
+	if !rollups[0].Start.Equal(Month.Start(may)) || *rollups[0].Availability != 0.75 {
+		t.Errorf("Wrong rollup of May: %+v", rollups[0])
+	}
+	if !rollups[1].Start.Equal(Month.Start(june)) || *rollups[1].Availability != 1 {
+		t.Errorf("Wrong rollup of June: %+v", rollups[1])
+	}
+	if current := tracker.Current(june); len(current) != 6 {
+		t.Errorf("Current() returned %d rollups, want 6: %+v", len(current), current)
+	}
+
+	tracker.expire(Day.add(Day.Start(may), retention[Day]+1))
+	if rollups, _ := tracker.Query("*", Day); len(rollups) != 2 {
+		t.Errorf("The rollup of May 31 should be expired: %+v", rollups)
+	}
+	if _, err := tracker.Query("*", "year"); err == nil {
+		t.Errorf("Query() of an invalid period should fail")
+	}
+}
@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package selftest proves that the connection tracking works end to end
+// on the running kernel: known traffic is sent through the attached
+// eBPF program and the resulting increments are verified.
+package selftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/clock"
+	"m/config"
+	"m/metrics"
+	"m/packet"
+)
+
+const (
+	vethName = "cxselftest0"
+	vethPeer = "cxselftest1"
+	sni      = "selftest.connectivity-exporter.invalid"
+	cidr     = "198.18.0.0/24"
+)
+
+var (
+	// The addresses are from the benchmarking range (RFC 2544), the
+	// generated traffic must not be mistaken for real traffic.
+	client         = net.IPv4(198, 18, 0, 1)
+	server         = net.IPv4(198, 18, 0, 2)
+	refusingServer = net.IPv4(198, 18, 0, 3)
+)
+
+// Run creates a veth pair, loads and attaches the eBPF program, and
+// sends one successful TLS handshake and one refused connection
+// through it. It returns an error unless both connections are
+// accounted as expected.
+func Run() error {
+	// Remove the leftover of an interrupted run.
+	_ = deleteLink(vethName)
+	if err := createVeth(vethName, vethPeer); err != nil {
+		return err
+	}
+	defer func() {
+		if err := deleteLink(vethName); err != nil {
+			klog.Warningf("Failed to clean up: %v", err)
+		}
+	}()
+
+	dataSource, err := packet.NewNetworkDataSource(vethName, packet.AsSet(cidr), packet.AsSet("443"), config.NewStore(&config.Config{}))
+	if err != nil {
+		return fmt.Errorf("creating an eBPF setup: %w", err)
+	}
+	defer dataSource.Close()
+
+	traffic, err := connections(server, refusingServer, 443)
+	if err != nil {
+		return err
+	}
+	if err := inject(vethName, traffic); err != nil {
+		return err
+	}
+	// The peer receives the frames asynchronously.
+	time.Sleep(100 * time.Millisecond)
+
+	return verify(account(dataSource), server, refusingServer)
+}
+
+// Prober runs frames through a running eBPF program, see
+// packet.NetworkDataSource.Probe.
+type Prober interface {
+	Filter() (networkInterface string, cidrs, ports []string)
+	Probe(ctx context.Context, sourceIP string, frames [][]byte) ([]*metrics.Inc, error)
+}
+
+// Probe runs one successful TLS handshake and one refused connection
+// to a server captured by the filter through the running eBPF program,
+// e.g. after a reload. It returns an error unless both connections are
+// accounted as expected. The connections only show up in the returned
+// increments of the prober, not in the metrics.
+func Probe(ctx context.Context, prober Prober) error {
+	_, cidrs, ports := prober.Filter()
+	target, err := probeServer(cidrs)
+	if err != nil {
+		return err
+	}
+	port, err := probePort(ports)
+	if err != nil {
+		return err
+	}
+	traffic, err := connections(target, target, port)
+	if err != nil {
+		return err
+	}
+	incs, err := prober.Probe(ctx, client.String(), traffic)
+	if err != nil {
+		return err
+	}
+	return verify(incs, target, target)
+}
+
+// probeServer returns an IPv4 address of the first IPv4 CIDR. Unless
+// the CIDR is a single address, the first address is skipped, which
+// is usually the network address.
+func probeServer(cidrs []string) (net.IP, error) {
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			// A single address without a prefix length.
+			ipNet = &net.IPNet{IP: net.ParseIP(c), Mask: net.CIDRMask(32, 32)}
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil {
+			continue
+		}
+		server := make(net.IP, net.IPv4len)
+		copy(server, ip)
+		if ones, _ := ipNet.Mask.Size(); ones < 32 {
+			server[3]++
+		}
+		return server, nil
+	}
+	return nil, errors.New("the filter has no IPv4 CIDR to probe")
+}
+
+// probePort returns the first port of TLS over TCP.
+func probePort(ports []string) (uint16, error) {
+	for _, p := range ports {
+		if strings.Contains(p, "/") {
+			continue
+		}
+		var port uint16
+		if _, err := fmt.Sscan(p, &port); err == nil {
+			return port, nil
+		}
+	}
+	return 0, errors.New("the filter has no TLS port to probe")
+}
+
+// connections returns the frames of a successful TLS handshake to the
+// server and of a connection the refusing server refuses.
+func connections(server, refusingServer net.IP, port uint16) ([][]byte, error) {
+	var traffic [][]byte
+	for _, c := range []struct {
+		server     net.IP
+		clientPort uint16
+		segments   []segment
+	}{
+		{server, 40001, handshake(sni)},
+		{refusingServer, 40002, refused()},
+	} {
+		f, err := frames(client, c.server, c.clientPort, port, c.segments)
+		if err != nil {
+			return nil, err
+		}
+		traffic = append(traffic, f...)
+	}
+	return traffic, nil
+}
+
+// account runs the accounting with virtual time until the stats of the
+// generated traffic are accounted and returns the increments.
+func account(dataSource *packet.NetworkDataSource) []*metrics.Inc {
+	ticks := clock.NewFake(time.Now())
+	incs := make(chan *metrics.Inc)
+	ctx, stop := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go dataSource.TrackConnections(ctx, wg, ticks, incs, nil)
+	var accounted []*metrics.Inc
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for inc := range incs {
+			accounted = append(accounted, inc)
+		}
+	}()
+
+	for i := time.Duration(0); i <= packet.AccountingDelay; i += time.Second {
+		ticks.Tick(time.Second)
+	}
+	stop()
+	wg.Wait()
+	// All the increments are sent.
+	close(incs)
+	<-collected
+	return accounted
+}
+
+// verify checks the increments of both generated connections. The
+// increments of the refused connection carry no SNI of their own.
+func verify(incs []*metrics.Inc, server, refusingServer net.IP) error {
+	var successful, rejected float64
+	for _, inc := range incs {
+		if inc.SourceIP != client.String() {
+			continue
+		}
+		if inc.SNI == sni && inc.DestIP == server.String() {
+			successful += inc.SuccessfulConnections
+		}
+		if inc.DestIP == refusingServer.String() {
+			rejected += inc.RejectedConnections
+		}
+	}
+	if successful != 1 {
+		return fmt.Errorf("%v successful connections of %s to %s, want 1", successful, sni, server)
+	}
+	if rejected != 1 {
+		return fmt.Errorf("%v rejected connections to %s, want 1", rejected, refusingServer)
+	}
+	return nil
+}
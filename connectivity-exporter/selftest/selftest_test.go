@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package selftest
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"m/metrics"
+)
+
+// TestClientHello follows the offsets the eBPF program parses the SNI
+// with, see parse_sni in packet/c/cap.c.
+func TestClientHello(t *testing.T) {
+	hello := clientHello(sni)
+	if hello[0] != 0x16 || hello[5] != 0x01 {
+		t.Fatalf("not a handshake record with a ClientHello: % x", hello[:6])
+	}
+	sessionIDLengthOff := 43
+	cipherSuitesLengthOff := sessionIDLengthOff + 1 + int(hello[sessionIDLengthOff])
+	compressionMethodsLengthOff := cipherSuitesLengthOff + 2 + int(binary.BigEndian.Uint16(hello[cipherSuitesLengthOff:]))
+	extensionsOff := compressionMethodsLengthOff + 1 + int(hello[compressionMethodsLengthOff]) + 2
+	if extensionType := binary.BigEndian.Uint16(hello[extensionsOff:]); extensionType != 0 {
+		t.Fatalf("first extension is %d, want server_name", extensionType)
+	}
+	serverNameLength := int(binary.BigEndian.Uint16(hello[extensionsOff+7:]))
+	if got := string(hello[extensionsOff+9 : extensionsOff+9+serverNameLength]); got != sni {
+		t.Errorf("got SNI %q, want %q", got, sni)
+	}
+	if recordLength := int(binary.BigEndian.Uint16(hello[3:])); recordLength != len(hello)-5 {
+		t.Errorf("record length is %d, want %d", recordLength, len(hello)-5)
+	}
+}
+
+// fakeProber accounts the frames of the probe like the eBPF program
+// would unless it is broken.
+type fakeProber struct {
+	cidrs, ports []string
+	broken       bool
+	frames       [][]byte
+}
+
+func (p *fakeProber) Filter() (string, []string, []string) {
+	return "eth0", p.cidrs, p.ports
+}
+
+func (p *fakeProber) Probe(ctx context.Context, sourceIP string, frames [][]byte) ([]*metrics.Inc, error) {
+	p.frames = frames
+	if p.broken {
+		return []*metrics.Inc{{SNI: sni, SourceIP: sourceIP, DestIP: "10.0.0.1", RejectedConnections: 1}}, nil
+	}
+	return []*metrics.Inc{
+		{SNI: sni, SourceIP: sourceIP, DestIP: "10.0.0.1", SuccessfulConnections: 1, RejectedConnections: 1},
+		// Another window with the carried over failure.
+		{SNI: sni, SourceIP: sourceIP, DestIP: "10.0.0.1", FailedSeconds: 1},
+	}, nil
+}
+
+func TestProbe(t *testing.T) {
+	prober := &fakeProber{cidrs: []string{"fd00::/8", "10.0.0.0/8"}, ports: []string{"80/http", "8443"}}
+	if err := Probe(context.Background(), prober); err != nil {
+		t.Fatalf("Probing: %v", err)
+	}
+	// The SYN of the handshake goes to the first host address of the
+	// IPv4 CIDR and the TLS port.
+	syn := gopacket.NewPacket(prober.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	ip, tcp := syn.Layer(layers.LayerTypeIPv4).(*layers.IPv4), syn.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip.SrcIP.String() != "198.18.0.1" || ip.DstIP.String() != "10.0.0.1" || tcp.DstPort != 8443 {
+		t.Errorf("Got SYN from %s to %s:%d, want from 198.18.0.1 to 10.0.0.1:8443", ip.SrcIP, ip.DstIP, tcp.DstPort)
+	}
+
+	prober.broken = true
+	if err := Probe(context.Background(), prober); err == nil {
+		t.Errorf("Got no error without the successful connection")
+	}
+	if err := Probe(context.Background(), &fakeProber{cidrs: []string{"10.0.0.0/8"}, ports: []string{"53/udp"}}); err == nil {
+		t.Errorf("Got no error without a TLS port")
+	}
+}
+
+func TestProbeServer(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"10.0.0.0/8":     "10.0.0.1",
+		"192.168.0.1":    "192.168.0.1",
+		"192.168.0.7/32": "192.168.0.7",
+	} {
+		got, err := probeServer([]string{cidr})
+		if err != nil {
+			t.Fatalf("Getting the server of %s: %v", cidr, err)
+		}
+		if got.String() != want {
+			t.Errorf("Got server %s of %s, want %s", got, cidr, want)
+		}
+	}
+	if _, err := probeServer([]string{"fd00::/8"}); err == nil {
+		t.Errorf("Got no error without an IPv4 CIDR")
+	}
+}
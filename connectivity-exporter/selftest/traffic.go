@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package selftest
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// segment is a TCP segment of the generated traffic.
+type segment struct {
+	serverToClient          bool
+	SYN, ACK, PSH, FIN, RST bool
+	payload                 []byte
+}
+
+var (
+	clientMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	serverMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// handshake returns the segments of a connection with a TLS
+// handshake which the client closes.
+func handshake(sni string) []segment {
+	return []segment{
+		{SYN: true},
+		{serverToClient: true, SYN: true, ACK: true},
+		{ACK: true, PSH: true, payload: clientHello(sni)},
+		{ACK: true, FIN: true},
+	}
+}
+
+// refused returns the segments of a connection the server refuses.
+func refused() []segment {
+	return []segment{
+		{SYN: true},
+		{serverToClient: true, RST: true, ACK: true},
+	}
+}
+
+// frames serializes the segments of a connection between the client
+// and the server.
+func frames(client, server net.IP, clientPort, serverPort uint16, segments []segment) ([][]byte, error) {
+	var out [][]byte
+	for _, s := range segments {
+		eth := &layers.Ethernet{SrcMAC: clientMAC, DstMAC: serverMAC, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(clientPort), DstPort: layers.TCPPort(serverPort),
+			SYN: s.SYN, ACK: s.ACK, PSH: s.PSH, FIN: s.FIN, RST: s.RST,
+			Window: 0xffff,
+		}
+		if s.serverToClient {
+			eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+			ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			return nil, err
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(s.payload)); err != nil {
+			return nil, fmt.Errorf("serializing segment: %w", err)
+		}
+		out = append(out, buf.Bytes())
+	}
+	return out, nil
+}
+
+// clientHello returns a minimal TLS ClientHello record with the
+// server_name extension.
+func clientHello(sni string) []byte {
+	serverName := []byte{0} // host_name
+	serverName = appendUint16(serverName, uint16(len(sni)))
+	serverName = append(serverName, sni...)
+	serverNameList := appendUint16(nil, uint16(len(serverName)))
+	serverNameList = append(serverNameList, serverName...)
+
+	extensions := appendUint16(nil, 0) // server_name
+	extensions = appendUint16(extensions, uint16(len(serverNameList)))
+	extensions = append(extensions, serverNameList...)
+
+	body := []byte{0x03, 0x03}               // TLS 1.2
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID length
+	body = append(body, 0x00, 0x02, 0x13, 0x01)
+	body = append(body, 0x01, 0x00) // null compression
+	body = appendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := []byte{0x01, 0, byte(len(body) >> 8), byte(len(body))} // ClientHello
+	handshake = append(handshake, body...)
+
+	record := []byte{0x16, 0x03, 0x01} // handshake, TLS 1.0
+	record = appendUint16(record, uint16(len(handshake)))
+	return append(record, handshake...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// inject sends the frames out of the network interface, so they pass
+// the filters attached to both ends of the veth pair.
+func inject(ifaceName string, frames [][]byte) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	addr := &unix.SockaddrLinklayer{Ifindex: iface.Index, Halen: 6}
+	for _, frame := range frames {
+		copy(addr.Addr[:], frame[0:6])
+		if err := unix.Sendto(fd, frame, 0, addr); err != nil {
+			return fmt.Errorf("sending frame on %s: %w", ifaceName, err)
+		}
+	}
+	return nil
+}
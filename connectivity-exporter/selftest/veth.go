@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package selftest
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethInfoPeer is VETH_INFO_PEER of linux/veth.h.
+const vethInfoPeer = 1
+
+// createVeth creates a veth pair with both ends up.
+func createVeth(name, peer string) error {
+	peerInfo := append(ifInfomsg(0), attr(unix.IFLA_IFNAME, cString(peer))...)
+	linkInfo := append(attr(unix.IFLA_INFO_KIND, []byte("veth")), attr(unix.IFLA_INFO_DATA, attr(vethInfoPeer, peerInfo))...)
+	msg := append(ifInfomsg(0), attr(unix.IFLA_IFNAME, cString(name))...)
+	msg = append(msg, attr(unix.IFLA_LINKINFO, linkInfo)...)
+	if err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg); err != nil {
+		return fmt.Errorf("creating veth pair %s/%s: %w", name, peer, err)
+	}
+	return nil
+}
+
+// deleteLink deletes the network interface. Deleting one end of a veth
+// pair deletes both.
+func deleteLink(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlinkRequest(unix.RTM_DELLINK, 0, ifInfomsg(iface.Index)); err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	return nil
+}
+
+// ifInfomsg returns the ifinfomsg of the interface with the index, 0
+// for a new interface. The interface is brought up, if the request
+// changes its flags.
+func ifInfomsg(index int) []byte {
+	msg := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	return append([]byte(nil), (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]...)
+}
+
+// attr encodes a netlink attribute, padded to the netlink alignment.
+func attr(typ uint16, data []byte) []byte {
+	header := unix.RtAttr{Len: uint16(unix.SizeofRtAttr + len(data)), Type: typ}
+	out := append([]byte(nil), (*[unix.SizeofRtAttr]byte)(unsafe.Pointer(&header))[:]...)
+	out = append(out, data...)
+	for len(out)%unix.NLMSG_ALIGNTO != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// netlinkRequest sends a route netlink request and waits for its
+// acknowledgement.
+func netlinkRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(body)),
+		Type:  typ,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	msg := append((*[unix.SizeofNlMsghdr]byte)(unsafe.Pointer(&header))[:], body...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != header.Seq || reply.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			if errno := *(*int32)(unsafe.Pointer(&reply.Data[0])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package server runs the HTTP listeners of the exporter. The metrics,
+// the admin API and the debug handlers can be bound to their own
+// addresses with their own TLS and authentication settings.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"m/fatal"
+)
+
+// Listener is the configuration of one HTTP listener.
+type Listener struct {
+	// Name is the name of the listener in the logs and the prefix of
+	// its flags.
+	Name string
+	// Addr is the bind and listen address. An empty address serves
+	// the handlers on the default listener.
+	Addr string
+	// TLSCertFile and TLSKeyFile enable TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile requires the clients to present a certificate
+	// signed by one of the CAs in the file.
+	ClientCAFile string
+	// TokenFile requires the clients to send the token in the file as
+	// bearer token.
+	TokenFile string
+	// KubernetesAuth requires the clients to send a bearer token which
+	// the Authorizer allows to access the request.
+	KubernetesAuth bool
+	// Authorizer authorizes the requests with KubernetesAuth.
+	Authorizer Authorizer
+}
+
+// Authorizer decides whether the client with the bearer token may send
+// the request.
+type Authorizer interface {
+	// Authorize returns false if the token is not authenticated or its
+	// client may not send the request, and an error if no decision
+	// could be made.
+	Authorize(ctx context.Context, token string, r *http.Request) (bool, error)
+}
+
+// RegisterFlags adds the flags of the listener to the flag set, all
+// prefixed with the name of the listener.
+func (l *Listener) RegisterFlags(fs *flag.FlagSet, addrUsage string) {
+	fs.StringVar(&l.Addr, l.Name+"-addr", l.Addr, addrUsage)
+	fs.StringVar(&l.TLSCertFile, l.Name+"-tls-cert-file", "", "Path to the TLS certificate of the "+l.Name+" listener")
+	fs.StringVar(&l.TLSKeyFile, l.Name+"-tls-key-file", "", "Path to the TLS key of the "+l.Name+" listener")
+	fs.StringVar(&l.ClientCAFile, l.Name+"-client-ca-file", "", "Path to the CAs the client certificates of the "+l.Name+" listener are verified with")
+	fs.StringVar(&l.TokenFile, l.Name+"-token-file", "", "Path to the bearer token the clients of the "+l.Name+" listener have to send")
+	fs.BoolVar(&l.KubernetesAuth, l.Name+"-kubernetes-auth", false, "Authorize the clients of the "+l.Name+" listener with a TokenReview and a SubjectAccessReview of their bearer token, requires running in a cluster")
+}
+
+// configured reports whether any TLS or authentication setting is set.
+func (l *Listener) configured() bool {
+	return l.TLSCertFile != "" || l.TLSKeyFile != "" || l.ClientCAFile != "" || l.TokenFile != "" || l.KubernetesAuth
+}
+
+// Server is an HTTP server with its listener configuration.
+type Server struct {
+	listener *Listener
+	server   *http.Server
+	tls      bool
+}
+
+// New creates the server of the listener. The handler is wrapped in the
+// bearer token check, if the listener has a token file, or in the
+// authorization with KubernetesAuth.
+func New(l *Listener, handler http.Handler) (*Server, error) {
+	if (l.TLSCertFile == "") != (l.TLSKeyFile == "") {
+		return nil, fmt.Errorf("%s listener: both the TLS certificate and key are required", l.Name)
+	}
+	if l.ClientCAFile != "" && l.TLSCertFile == "" {
+		return nil, fmt.Errorf("%s listener: verifying client certificates requires TLS", l.Name)
+	}
+	s := &Server{
+		listener: l,
+		server:   &http.Server{Addr: l.Addr, Handler: handler},
+		tls:      l.TLSCertFile != "",
+	}
+	if l.TokenFile != "" {
+		token, err := os.ReadFile(l.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s listener: reading token: %w", l.Name, err)
+		}
+		token = bytes.TrimSpace(token)
+		if len(token) == 0 {
+			return nil, fmt.Errorf("%s listener: token file %s is empty", l.Name, l.TokenFile)
+		}
+		s.server.Handler = requireToken(token, handler)
+	}
+	if l.KubernetesAuth {
+		if l.TokenFile != "" {
+			return nil, fmt.Errorf("%s listener: a token file and Kubernetes authorization are exclusive", l.Name)
+		}
+		if l.Authorizer == nil {
+			return nil, fmt.Errorf("%s listener: Kubernetes authorization requires an authorizer", l.Name)
+		}
+		s.server.Handler = requireAuthorization(l.Name, l.Authorizer, handler)
+	}
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s listener: reading client CAs: %w", l.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s listener: no certificate found in %s", l.Name, l.ClientCAFile)
+		}
+		s.server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return s, nil
+}
+
+// ListenAndServe serves until the context is done.
+func (s *Server) ListenAndServe(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer klog.Infof("Stopped the %s listener.", s.listener.Name)
+
+	go func() {
+		<-ctx.Done()
+		// ignoring the error, we are shutting down anyway
+		_ = s.server.Shutdown(context.TODO())
+	}()
+
+	klog.Infof("Starting the %s listener on %s", s.listener.Name, s.server.Addr)
+	var err error
+	if s.tls {
+		err = s.server.ListenAndServeTLS(s.listener.TLSCertFile, s.listener.TLSKeyFile)
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal.Exit(fatal.Runtime, fmt.Sprintf("The %s listener failed", s.listener.Name), err)
+	}
+}
+
+// requireToken rejects the requests without the bearer token.
+func requireToken(token []byte, next http.Handler) http.Handler {
+	want := append([]byte("Bearer "), token...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthorization rejects the requests without a bearer token and
+// the requests the authorizer does not allow.
+func requireAuthorization(name string, authorizer Authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		allowed, err := authorizer.Authorize(r.Context(), token, r)
+		if err != nil {
+			klog.Errorf("Failed to authorize a request to the %s listener: %v", name, err)
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Surface is a set of handlers of the exporter served by a listener.
+type Surface struct {
+	Listener *Listener
+	// Prefix is the path prefix of the handlers, used when the surface
+	// is served by the default listener.
+	Prefix  string
+	Handler http.Handler
+}
+
+// Group returns the servers of the surfaces. The first surface is the
+// default, the surfaces without an address are served by its listener
+// and inherit its TLS and authentication settings. Two listeners
+// cannot share an address.
+func Group(surfaces ...Surface) ([]*Server, error) {
+	if len(surfaces) == 0 {
+		return nil, nil
+	}
+	def := surfaces[0]
+	if def.Listener.Addr == "" {
+		return nil, fmt.Errorf("%s listener: an address is required", def.Listener.Name)
+	}
+	shared := http.NewServeMux()
+	shared.Handle(def.Prefix, def.Handler)
+	listeners := map[string]string{def.Listener.Addr: def.Listener.Name}
+	var own []Surface
+	for _, s := range surfaces[1:] {
+		if s.Listener.Addr == "" {
+			if s.Listener.configured() {
+				return nil, fmt.Errorf("%s listener: TLS and authentication settings require an own address", s.Listener.Name)
+			}
+			shared.Handle(s.Prefix, s.Handler)
+			continue
+		}
+		if other, ok := listeners[s.Listener.Addr]; ok {
+			return nil, fmt.Errorf("%s listener: address %s is already used by the %s listener", s.Listener.Name, s.Listener.Addr, other)
+		}
+		listeners[s.Listener.Addr] = s.Listener.Name
+		own = append(own, s)
+	}
+
+	server, err := New(def.Listener, shared)
+	if err != nil {
+		return nil, err
+	}
+	servers := []*Server{server}
+	for _, s := range own {
+		server, err := New(s.Listener, s.Handler)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
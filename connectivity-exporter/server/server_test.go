@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name        string
+		admin       Listener
+		wantServers int
+		wantErr     bool
+	}{
+		{name: "shared", admin: Listener{Name: "admin"}, wantServers: 1},
+		{name: "own address", admin: Listener{Name: "admin", Addr: "localhost:19101"}, wantServers: 2},
+		{name: "same address", admin: Listener{Name: "admin", Addr: ":19100"}, wantErr: true},
+		{name: "settings without address", admin: Listener{Name: "admin", TokenFile: "token"}, wantErr: true},
+		{name: "key without certificate", admin: Listener{Name: "admin", Addr: "localhost:19101", TLSKeyFile: "key"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, err := Group(
+				Surface{Listener: &Listener{Name: "metrics", Addr: ":19100"}, Prefix: "/metrics", Handler: ok},
+				Surface{Listener: &tt.admin, Prefix: "/admin/", Handler: ok},
+			)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Group() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(servers) != tt.wantServers {
+				t.Errorf("Group() returned %d servers, want %d", len(servers), tt.wantServers)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(&Listener{Name: "admin", Addr: "localhost:0", TokenFile: tokenFile}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	for authorization, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("Authorization %q: got status %d, want %d", authorization, w.Code, want)
+		}
+	}
+}
+
+type allowMetrics struct{}
+
+func (allowMetrics) Authorize(ctx context.Context, token string, r *http.Request) (bool, error) {
+	return token == "prometheus" && r.URL.Path == "/metrics", nil
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	if _, err := New(&Listener{Name: "metrics", Addr: "localhost:0", KubernetesAuth: true}, http.NotFoundHandler()); err == nil {
+		t.Errorf("New() without an authorizer should fail")
+	}
+	s, err := New(&Listener{Name: "metrics", Addr: "localhost:0", KubernetesAuth: true, Authorizer: allowMetrics{}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	for _, tc := range []struct {
+		authorization, path string
+		want                int
+	}{
+		{"", "/metrics", http.StatusUnauthorized},
+		{"Basic cHJvbWV0aGV1cw==", "/metrics", http.StatusUnauthorized},
+		{"Bearer prometheus", "/metrics", http.StatusOK},
+		{"Bearer prometheus", "/admin/config", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("Authorization %q of %s: got status %d, want %d", tc.authorization, tc.path, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sflow exports sampled packet headers and the flow records of
+// the exporter as sFlow version 5 datagrams to a collector, for the
+// tooling of network teams. The packet samples are sent by the
+// sub-agent 0 and the flow records by the sub-agent 1, so each has its
+// own sequence numbers.
+package sflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+const (
+	packetsSubAgent = 0
+	flowsSubAgent   = 1
+
+	// maxDatagramLength keeps the datagrams within the MTU of an
+	// Ethernet.
+	maxDatagramLength = 1400
+	// flushInterval is the maximum time a sample waits for further
+	// samples of its datagram.
+	flushInterval = time.Second
+	// pollTimeout is the maximum time the sampling socket is polled
+	// before the context is checked again.
+	pollTimeout = 100 * time.Millisecond
+)
+
+// The ancillary data of a classic BPF filter holding a random number,
+// see linux/filter.h.
+const (
+	skfAdOff    = 0xfffff000
+	skfAdRandom = 56
+)
+
+// subAgent are the samples of a sub-agent and their sequence numbers.
+type subAgent struct {
+	id        uint32
+	datagrams uint32
+	samples   uint32
+	// pool is the number of packets or connections the samples were
+	// taken from.
+	pool    uint32
+	pending [][]byte
+	length  int
+}
+
+// Agent sends the samples to the collector.
+type Agent struct {
+	conn         net.Conn
+	address      net.IP
+	ifIndex      uint32
+	samplingRate uint32
+	headerBytes  int
+	start        time.Time
+
+	mutex          sync.Mutex
+	packets, flows *subAgent
+	// drops is the number of frames the sampling socket dropped.
+	drops uint32
+}
+
+// NewAgent creates an agent sending to the collector, host:port. It
+// samples one in samplingRate frames of the network interface, all
+// interfaces if it is empty, and sends their first headerBytes. A
+// sampling rate of 0 only sends the flow records. The agent address is
+// the local address of the datagrams.
+func NewAgent(collector, networkInterface string, samplingRate, headerBytes int) (*Agent, error) {
+	if samplingRate < 0 {
+		return nil, fmt.Errorf("invalid sampling rate %d", samplingRate)
+	}
+	if headerBytes < 14 || headerBytes > 256 {
+		return nil, fmt.Errorf("invalid header length %d, expected 14 to 256 bytes", headerBytes)
+	}
+	a := &Agent{
+		samplingRate: uint32(samplingRate),
+		headerBytes:  headerBytes,
+		start:        time.Now(),
+		packets:      &subAgent{id: packetsSubAgent},
+		flows:        &subAgent{id: flowsSubAgent},
+	}
+	if networkInterface != "" {
+		iface, err := net.InterfaceByName(networkInterface)
+		if err != nil {
+			return nil, err
+		}
+		a.ifIndex = uint32(iface.Index)
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the sFlow collector: %w", err)
+	}
+	a.conn = conn
+	a.address = conn.LocalAddr().(*net.UDPAddr).IP
+	return a, nil
+}
+
+// Observe adds the flow records of the connections of an increment.
+// Each kind of connection is one sample of a TLS connect operation
+// with the SNI as attribute, weighted with the number of connections
+// as sampling rate.
+func (a *Agent) Observe(inc *metrics.Inc) {
+	attributes := "sni=" + url.QueryEscape(inc.SNI)
+	source, dest := net.ParseIP(inc.SourceIP), net.ParseIP(inc.DestIP)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, op := range []struct {
+		connections float64
+		kind        string
+		status      uint32
+	}{
+		{inc.SuccessfulConnections, "successful", statusSuccess},
+		{inc.RejectedConnections, "rejected", statusUnavailable},
+		{inc.RejectedConnectionsByClient, "rejected_by_client", statusOther},
+		{inc.RejectedConnectionsByMiddlebox, "rejected_by_middlebox", statusOther},
+		{inc.RejectedConnectionsByNetwork, "rejected_by_network", statusOther},
+	} {
+		n := uint32(op.connections)
+		if n == 0 {
+			continue
+		}
+		a.flows.samples++
+		a.flows.pool += n
+		sample := flowSample{
+			sequenceNumber: a.flows.samples,
+			sourceID:       a.ifIndex,
+			samplingRate:   n,
+			samplePool:     a.flows.pool,
+		}
+		a.add(a.flows, sample.encode(
+			appOperation("tls", "connect", attributes, op.kind, op.status),
+			socketIPv4(source, dest),
+		))
+	}
+}
+
+// samplePacket adds the sample of a frame of the given length, whose
+// header was captured.
+func (a *Agent) samplePacket(header []byte, frameLength int, outgoing bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.packets.samples++
+	a.packets.pool += a.samplingRate
+	sample := flowSample{
+		sequenceNumber: a.packets.samples,
+		sourceID:       a.ifIndex,
+		samplingRate:   a.samplingRate,
+		samplePool:     a.packets.pool,
+		drops:          a.drops,
+	}
+	if outgoing {
+		sample.output = a.ifIndex
+	} else {
+		sample.input = a.ifIndex
+	}
+	a.add(a.packets, sample.encode(rawPacketHeader(frameLength, header)))
+}
+
+// add adds a sample to the next datagram of the sub-agent, and sends
+// the datagram first if the sample does not fit. The caller holds the
+// mutex.
+func (a *Agent) add(s *subAgent, sample []byte) {
+	if s.length+len(sample) > maxDatagramLength-datagramHeaderLength {
+		a.send(s)
+	}
+	s.pending = append(s.pending, sample)
+	s.length += len(sample)
+}
+
+// send sends the pending samples of the sub-agent. The caller holds
+// the mutex.
+func (a *Agent) send(s *subAgent) {
+	if len(s.pending) == 0 {
+		return
+	}
+	s.datagrams++
+	d := datagram{
+		agent:          a.address,
+		subAgentID:     s.id,
+		sequenceNumber: s.datagrams,
+		uptime:         uint32(time.Since(a.start) / time.Millisecond),
+	}
+	if _, err := a.conn.Write(d.encode(s.pending)); err != nil {
+		klog.V(2).Infof("Failed to send sFlow datagram: %v", err)
+		metrics.IncSFlowDatagrams("failed")
+	} else {
+		metrics.IncSFlowDatagrams("sent")
+	}
+	s.pending, s.length = nil, 0
+}
+
+// flush sends the pending samples of both sub-agents.
+func (a *Agent) flush() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.send(a.packets)
+	a.send(a.flows)
+}
+
+// Run samples the frames and sends the samples at least every flush
+// interval until the context is done. The pending samples are sent
+// before it returns.
+func (a *Agent) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer a.conn.Close()
+	capturing := &sync.WaitGroup{}
+	if a.samplingRate > 0 {
+		fd, err := openSamplingSocket(a.ifIndex, a.samplingRate, a.headerBytes)
+		if err != nil {
+			klog.Errorf("Failed to sample packets for sFlow: %v", err)
+		} else {
+			capturing.Add(1)
+			go a.capture(ctx, capturing, fd)
+		}
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-ctx.Done():
+			capturing.Wait()
+			a.flush()
+			return
+		}
+	}
+}
+
+func (a *Agent) capture(ctx context.Context, wg *sync.WaitGroup, fd int) {
+	defer wg.Done()
+	defer unix.Close(fd)
+	buf := make([]byte, a.headerBytes)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for ctx.Err() == nil {
+		if _, err := unix.Poll(fds, int(pollTimeout/time.Millisecond)); err != nil && !errors.Is(err, unix.EINTR) {
+			klog.Errorf("Failed to sample packets for sFlow: %v", err)
+			return
+		}
+		if fds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+		// With MSG_TRUNC, the length of the whole frame is returned.
+		n, from, err := unix.Recvfrom(fd, buf, unix.MSG_TRUNC|unix.MSG_DONTWAIT)
+		if err != nil {
+			continue
+		}
+		if stats, err := unix.GetsockoptTpacketStats(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS); err == nil {
+			a.mutex.Lock()
+			a.drops += stats.Drops
+			a.mutex.Unlock()
+		}
+		header := buf
+		if n < len(buf) {
+			header = buf[:n]
+		}
+		ll, _ := from.(*unix.SockaddrLinklayer)
+		a.samplePacket(header, n, ll != nil && ll.Pkttype == unix.PACKET_OUTGOING)
+	}
+}
+
+// openSamplingSocket opens a packet socket receiving the headers of
+// one in samplingRate frames of the interface, or of all interfaces
+// for the index 0. The frames are sampled by a classic BPF filter, so
+// the other frames are not copied to userspace.
+func openSamplingSocket(ifIndex, samplingRate uint32, headerBytes int) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, fmt.Errorf("opening packet socket: %w", err)
+	}
+	filter := samplingFilter(samplingRate, headerBytes)
+	prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	// The filter is attached before binding, so no frame is received
+	// unsampled.
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("attaching sampling filter: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: int(ifIndex)}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("binding packet socket: %w", err)
+	}
+	return fd, nil
+}
+
+// samplingFilter accepts the first headerBytes of a frame if a random
+// number is below the share of the sampling rate.
+func samplingFilter(samplingRate uint32, headerBytes int) []unix.SockFilter {
+	accept := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: uint32(headerBytes)}
+	if samplingRate <= 1 {
+		return []unix.SockFilter{accept}
+	}
+	threshold := uint32(math.MaxUint32 / uint64(samplingRate))
+	return []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdOff + skfAdRandom},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: threshold, Jt: 1},
+		accept,
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+	}
+}
+
+// htons converts a short from host to network byte order on little
+// endian hosts.
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
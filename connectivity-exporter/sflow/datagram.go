@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sflow
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// The formats of the sFlow version 5 structures, see
+// https://sflow.org/sflow_version_5.txt and
+// https://sflow.org/sflow_application.txt. All of them are of the
+// enterprise 0.
+const (
+	version = 5
+
+	addressIPv4 = 1
+
+	formatFlowSample = 1
+
+	formatRawPacketHeader = 1
+	formatSocketIPv4      = 2100
+	formatAppOperation    = 2202
+
+	headerProtocolEthernet = 1
+	protocolTCP            = 6
+)
+
+// The status of an application operation.
+const (
+	statusSuccess     = 0
+	statusOther       = 1
+	statusUnavailable = 9
+)
+
+// encoder writes the XDR encoding of the structures.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// opaque writes variable-length data, padded to 4 bytes.
+func (e *encoder) opaque(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// string writes a string of at most max bytes.
+func (e *encoder) string(s string, max int) {
+	if len(s) > max {
+		s = s[:max]
+	}
+	e.opaque([]byte(s))
+}
+
+func (e *encoder) ipv4(ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+	e.buf = append(e.buf, ip4...)
+}
+
+// record writes a flow record or a sample: its format, its length and
+// the data.
+func (e *encoder) record(format uint32, data []byte) {
+	e.uint32(format)
+	e.opaque(data)
+}
+
+// datagram is the header of an sFlow datagram.
+type datagram struct {
+	agent          net.IP
+	subAgentID     uint32
+	sequenceNumber uint32
+	// uptime is the time since the start of the agent in
+	// milliseconds.
+	uptime uint32
+}
+
+// datagramHeaderLength is the length of the encoded datagram header,
+// including the number of samples.
+const datagramHeaderLength = 7 * 4
+
+func (d datagram) encode(samples [][]byte) []byte {
+	e := &encoder{}
+	e.uint32(version)
+	e.uint32(addressIPv4)
+	e.ipv4(d.agent)
+	e.uint32(d.subAgentID)
+	e.uint32(d.sequenceNumber)
+	e.uint32(d.uptime)
+	e.uint32(uint32(len(samples)))
+	for _, s := range samples {
+		e.buf = append(e.buf, s...)
+	}
+	return e.buf
+}
+
+// flowSample is a sample of a flow: of a packet or of the connections
+// of an operation.
+type flowSample struct {
+	sequenceNumber uint32
+	// sourceID is the class of the data source in the most
+	// significant byte and its index, e.g. the ifIndex.
+	sourceID     uint32
+	samplingRate uint32
+	samplePool   uint32
+	drops        uint32
+	input        uint32
+	output       uint32
+}
+
+// encode returns the sample including its format and length.
+func (s flowSample) encode(records ...[]byte) []byte {
+	data := &encoder{}
+	data.uint32(s.sequenceNumber)
+	data.uint32(s.sourceID)
+	data.uint32(s.samplingRate)
+	data.uint32(s.samplePool)
+	data.uint32(s.drops)
+	data.uint32(s.input)
+	data.uint32(s.output)
+	data.uint32(uint32(len(records)))
+	for _, r := range records {
+		data.buf = append(data.buf, r...)
+	}
+	e := &encoder{}
+	e.record(formatFlowSample, data.buf)
+	return e.buf
+}
+
+// rawPacketHeader returns the record of the header of a sampled
+// Ethernet frame.
+func rawPacketHeader(frameLength int, header []byte) []byte {
+	data := &encoder{}
+	data.uint32(headerProtocolEthernet)
+	data.uint32(uint32(frameLength))
+	// Nothing was stripped from the frame.
+	data.uint32(0)
+	data.opaque(header)
+	e := &encoder{}
+	e.record(formatRawPacketHeader, data.buf)
+	return e.buf
+}
+
+// appOperation returns the record of an application operation.
+func appOperation(application, operation, attributes, statusDescription string, status uint32) []byte {
+	data := &encoder{}
+	data.string(application, 32)
+	data.string(operation, 32)
+	data.string(attributes, 255)
+	data.string(statusDescription, 64)
+	// The sizes of the request and the response, and the duration are
+	// not known.
+	data.uint64(0)
+	data.uint64(0)
+	data.uint32(0)
+	data.uint32(status)
+	e := &encoder{}
+	e.record(formatAppOperation, data.buf)
+	return e.buf
+}
+
+// socketIPv4 returns the record of the socket of an operation. The
+// ports are not known.
+func socketIPv4(local, remote net.IP) []byte {
+	data := &encoder{}
+	data.uint32(protocolTCP)
+	data.ipv4(local)
+	data.ipv4(remote)
+	data.uint32(0)
+	data.uint32(0)
+	e := &encoder{}
+	e.record(formatSocketIPv4, data.buf)
+	return e.buf
+}
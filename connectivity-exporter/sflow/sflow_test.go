@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sflow
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"m/metrics"
+)
+
+func assert(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// newTestAgent returns an agent sending to a collector listening on the
+// loopback interface.
+func newTestAgent(t *testing.T, samplingRate int) (*Agent, net.PacketConn) {
+	t.Helper()
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { collector.Close() })
+	a, err := NewAgent(collector.LocalAddr().String(), "", samplingRate, 128)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	t.Cleanup(func() { a.conn.Close() })
+	return a, collector
+}
+
+func receive(t *testing.T, collector net.PacketConn) []byte {
+	t.Helper()
+	buf := make([]byte, 65536)
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestPacketSamples(t *testing.T) {
+	a, collector := newTestAgent(t, 100)
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("192.168.0.1")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+	frame := buf.Bytes()
+
+	a.samplePacket(frame, 1514, false)
+	a.samplePacket(frame, 1514, true)
+	a.flush()
+
+	var d layers.SFlowDatagram
+	if err := d.DecodeFromBytes(receive(t, collector), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatalf("DecodeFromBytes: %v", err)
+	}
+	assert(t, d.DatagramVersion, uint32(5))
+	assert(t, d.AgentAddress.Equal(a.address), true)
+	assert(t, d.SubAgentID, uint32(packetsSubAgent))
+	assert(t, d.SequenceNumber, uint32(1))
+	assert(t, len(d.FlowSamples), 2)
+	for i, s := range d.FlowSamples {
+		assert(t, s.SequenceNumber, uint32(i+1))
+		assert(t, s.SamplingRate, uint32(100))
+		assert(t, s.SamplePool, uint32(100*(i+1)))
+		assert(t, len(s.Records), 1)
+		r, ok := s.Records[0].(layers.SFlowRawPacketFlowRecord)
+		if !ok {
+			t.Fatalf("record %T, want a raw packet header", s.Records[0])
+		}
+		assert(t, r.FrameLength, uint32(1514))
+		assert(t, r.Header.Data(), frame)
+		tcp, ok := r.Header.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			t.Fatalf("header without TCP layer")
+		}
+		assert(t, tcp.DstPort, layers.TCPPort(443))
+	}
+}
+
+// reader reads the XDR encoding of the flow records, which are not
+// decoded by gopacket.
+type reader struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (r *reader) uint32() uint32 {
+	r.t.Helper()
+	if len(r.buf) < 4 {
+		r.t.Fatalf("truncated datagram")
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *reader) opaque() []byte {
+	r.t.Helper()
+	n := int(r.uint32())
+	padded := (n + 3) &^ 3
+	if len(r.buf) < padded {
+		r.t.Fatalf("truncated datagram")
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[padded:]
+	return b
+}
+
+func TestFlowRecords(t *testing.T) {
+	a, collector := newTestAgent(t, 0)
+	a.Observe(&metrics.Inc{
+		SNI:                   "api.example.com",
+		SourceIP:              "10.0.0.1",
+		DestIP:                "192.168.0.1",
+		SuccessfulConnections: 3,
+		RejectedConnections:   1,
+	})
+	a.flush()
+
+	r := &reader{t: t, buf: receive(t, collector)}
+	assert(t, r.uint32(), uint32(version))
+	assert(t, r.uint32(), uint32(addressIPv4))
+	r.buf = r.buf[4:]
+	assert(t, r.uint32(), uint32(flowsSubAgent))
+	assert(t, r.uint32(), uint32(1))
+	r.uint32()
+	assert(t, r.uint32(), uint32(2))
+	for i, want := range []struct {
+		samplingRate uint32
+		status       string
+		statusCode   uint32
+	}{
+		{3, "successful", statusSuccess},
+		{1, "rejected", statusUnavailable},
+	} {
+		assert(t, r.uint32(), uint32(formatFlowSample))
+		s := &reader{t: t, buf: r.opaque()}
+		assert(t, s.uint32(), uint32(i+1))
+		s.uint32()
+		assert(t, s.uint32(), want.samplingRate)
+		s.buf = s.buf[4*4:]
+		assert(t, s.uint32(), uint32(2))
+
+		assert(t, s.uint32(), uint32(formatAppOperation))
+		op := &reader{t: t, buf: s.opaque()}
+		assert(t, string(op.opaque()), "tls")
+		assert(t, string(op.opaque()), "connect")
+		assert(t, string(op.opaque()), "sni=api.example.com")
+		assert(t, string(op.opaque()), want.status)
+		op.buf = op.buf[5*4:]
+		assert(t, op.uint32(), want.statusCode)
+
+		assert(t, s.uint32(), uint32(formatSocketIPv4))
+		socket := &reader{t: t, buf: s.opaque()}
+		assert(t, socket.uint32(), uint32(protocolTCP))
+		assert(t, net.IP(socket.buf[:4]).String(), "10.0.0.1")
+		assert(t, net.IP(socket.buf[4:8]).String(), "192.168.0.1")
+		assert(t, len(s.buf), 0)
+	}
+	assert(t, len(r.buf), 0)
+}
+
+func TestDatagramLength(t *testing.T) {
+	a, collector := newTestAgent(t, 1)
+	frame := make([]byte, 128)
+	for i := 0; i < 20; i++ {
+		a.samplePacket(frame, 1514, false)
+	}
+	a.flush()
+
+	// The samples are split into datagrams within the maximum length.
+	samples := 0
+	for samples < 20 {
+		var d layers.SFlowDatagram
+		data := receive(t, collector)
+		if len(data) > maxDatagramLength {
+			t.Errorf("datagram of %d bytes, want at most %d", len(data), maxDatagramLength)
+		}
+		if err := d.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("DecodeFromBytes: %v", err)
+		}
+		samples += len(d.FlowSamples)
+	}
+	assert(t, samples, 20)
+	assert(t, a.packets.datagrams > 1, true)
+}
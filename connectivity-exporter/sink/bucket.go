@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sink
+
+import "time"
+
+// TokenBucket limits the rate of the deliveries of a sink. It holds up
+// to burst tokens and refills rate tokens per second.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket. A rate of 0 or less does not
+// limit the deliveries, a burst below 1 allows one.
+func NewTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// Take takes a token and returns the time to wait before using it. The
+// token is taken even if it is not available yet, so the callers are
+// served in order.
+func (b *TokenBucket) Take(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
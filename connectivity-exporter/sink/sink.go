@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sink decouples the push sinks of the exporter from the
+// accounting. Every sink gets a bounded queue drained by a goroutine of
+// its own, at a limited rate and with a backoff after failed
+// deliveries. A slow or failing sink drops the items it cannot take
+// instead of blocking the accounting loop, which has to finish within
+// the tick.
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+// The results of the items of a sink, see metrics.IncSinkItems.
+const (
+	resultDelivered = "delivered"
+	resultFailed    = "failed"
+	resultDropped   = "dropped"
+)
+
+// Options configure the queue of a sink.
+type Options struct {
+	// QueueSize is the number of items queued, further items are
+	// dropped.
+	QueueSize int
+	// Rate is the number of items delivered per second, 0 for no
+	// limit, Burst the number of items delivered at once after a
+	// pause.
+	Rate  float64
+	Burst int
+	// MaxAttempts is the number of times the delivery of an item is
+	// attempted before it is counted as failed.
+	MaxAttempts int
+	// MinBackoff is the time waited after a failed delivery, doubled
+	// after every further one up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// DefaultOptions are the options of a sink without a rate limit.
+var DefaultOptions = Options{
+	QueueSize:   10000,
+	MaxAttempts: 3,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+}
+
+// Queue is the queue of a sink.
+type Queue struct {
+	name    string
+	opts    Options
+	deliver func(item interface{}) error
+	items   chan interface{}
+	bucket  *TokenBucket
+	// backoff is the time waited before the next attempt, 0 after a
+	// successful delivery.
+	backoff time.Duration
+	// now and sleep are replaced in tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) bool
+}
+
+// NewQueue returns the queue of the sink with the name, which is the
+// value of the sink label of its metrics. Run delivers the items with
+// deliver.
+func NewQueue(name string, opts Options, deliver func(item interface{}) error) *Queue {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	q := &Queue{
+		name:    name,
+		opts:    opts,
+		deliver: deliver,
+		items:   make(chan interface{}, opts.QueueSize),
+		now:     time.Now,
+		sleep:   sleep,
+	}
+	q.bucket = NewTokenBucket(opts.Rate, opts.Burst, q.now())
+	metrics.SetSinkQueueLength(name, 0)
+	return q
+}
+
+// Offer queues the item without blocking. If the queue is full, the
+// item is dropped and false is returned.
+func (q *Queue) Offer(item interface{}) bool {
+	select {
+	case q.items <- item:
+		metrics.SetSinkQueueLength(q.name, len(q.items))
+		return true
+	default:
+		metrics.IncSinkItems(q.name, resultDropped)
+		klog.V(2).Infof("Dropped an item of the full queue of sink %s", q.name)
+		return false
+	}
+}
+
+// Run delivers the queued items until the context is done. The items
+// still queued then are delivered once each, without the rate limit
+// and the backoff, before it returns.
+func (q *Queue) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	done := ctx.Done()
+	for {
+		select {
+		case item := <-q.items:
+			metrics.SetSinkQueueLength(q.name, len(q.items))
+			if !q.sleep(ctx, q.bucket.Take(q.now())) {
+				q.attempt(item)
+				q.drain()
+				return
+			}
+			q.deliverWithRetries(ctx, item)
+		case <-done:
+			q.drain()
+			return
+		}
+	}
+}
+
+// deliverWithRetries attempts the delivery of the item up to
+// MaxAttempts times, waiting for the backoff before each attempt.
+func (q *Queue) deliverWithRetries(ctx context.Context, item interface{}) {
+	for i := 0; i < q.opts.MaxAttempts; i++ {
+		if !q.sleep(ctx, q.backoff) {
+			q.attempt(item)
+			return
+		}
+		err := q.deliver(item)
+		if err == nil {
+			q.backoff = 0
+			metrics.IncSinkItems(q.name, resultDelivered)
+			return
+		}
+		klog.V(2).Infof("Failed to deliver an item to sink %s: %v", q.name, err)
+		q.backoff *= 2
+		if q.backoff < q.opts.MinBackoff {
+			q.backoff = q.opts.MinBackoff
+		}
+		if q.backoff > q.opts.MaxBackoff {
+			q.backoff = q.opts.MaxBackoff
+		}
+	}
+	klog.Errorf("Failed to deliver an item to sink %s after %d attempts", q.name, q.opts.MaxAttempts)
+	metrics.IncSinkItems(q.name, resultFailed)
+}
+
+// attempt delivers the item once.
+func (q *Queue) attempt(item interface{}) {
+	if err := q.deliver(item); err != nil {
+		klog.Errorf("Failed to deliver an item to sink %s: %v", q.name, err)
+		metrics.IncSinkItems(q.name, resultFailed)
+		return
+	}
+	metrics.IncSinkItems(q.name, resultDelivered)
+}
+
+func (q *Queue) drain() {
+	for {
+		select {
+		case item := <-q.items:
+			q.attempt(item)
+		default:
+			metrics.SetSinkQueueLength(q.name, 0)
+			return
+		}
+	}
+}
+
+// sleep waits for the duration and returns false if the context was
+// done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
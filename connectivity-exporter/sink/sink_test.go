@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	b := NewTokenBucket(10, 2, now)
+	var waits []time.Duration
+	for i := 0; i < 4; i++ {
+		waits = append(waits, b.Take(now))
+	}
+	want := []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}
+	if !reflect.DeepEqual(waits, want) {
+		t.Errorf("got waits %v, want %v", waits, want)
+	}
+	// The debt is paid off after 200ms, the bucket is full after 400ms.
+	if wait := b.Take(now.Add(time.Second)); wait != 0 {
+		t.Errorf("got wait %v after a pause, want 0", wait)
+	}
+
+	unlimited := NewTokenBucket(0, 0, now)
+	for i := 0; i < 100; i++ {
+		if wait := unlimited.Take(now); wait != 0 {
+			t.Fatalf("got wait %v without a rate, want 0", wait)
+		}
+	}
+}
+
+// fakeTime records the waits of a queue instead of sleeping.
+type fakeTime struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (f *fakeTime) sleep(ctx context.Context, d time.Duration) bool {
+	if d > 0 {
+		f.waits = append(f.waits, d)
+		f.now = f.now.Add(d)
+	}
+	return ctx.Err() == nil
+}
+
+func TestQueueOverflow(t *testing.T) {
+	var delivered []interface{}
+	q := NewQueue("test", Options{QueueSize: 2}, func(item interface{}) error {
+		delivered = append(delivered, item)
+		return nil
+	})
+	// The sink is blocked, nothing is delivered.
+	got := []bool{q.Offer(1), q.Offer(2), q.Offer(3)}
+	if want := []bool{true, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got offers %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	q.Run(ctx, wg)
+	if want := []interface{}{1, 2}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("got delivered %v, want %v", delivered, want)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	var attempts []interface{}
+	opts := Options{QueueSize: 10, Rate: 10, Burst: 1, MaxAttempts: 3, MinBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	q := NewQueue("test", opts, func(item interface{}) error {
+		attempts = append(attempts, item)
+		if item == "failing" {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	ft := &fakeTime{now: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)}
+	q.now, q.sleep = func() time.Time { return ft.now }, ft.sleep
+	q.bucket = NewTokenBucket(opts.Rate, opts.Burst, ft.now)
+
+	ctx := context.Background()
+	q.deliverWithRetries(ctx, "failing")
+	q.deliverWithRetries(ctx, "recovered")
+	q.deliverWithRetries(ctx, "next")
+
+	if want := []interface{}{"failing", "failing", "failing", "recovered", "next"}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("got attempts %v, want %v", attempts, want)
+	}
+	// The backoff doubles up to the maximum and is reset by a
+	// successful delivery.
+	if want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}; !reflect.DeepEqual(ft.waits, want) {
+		t.Errorf("got waits %v, want %v", ft.waits, want)
+	}
+}
@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package slo computes the error budgets of the SNIs with an SLO from
+// the accounted seconds.
+package slo
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"m/config"
+	"m/metrics"
+)
+
+// bucketCount is the number of buckets a window is split into. The
+// failed seconds leave the rolling window one bucket at a time.
+const bucketCount = 720
+
+// Tracker keeps the failed seconds of the SNIs with an SLO within
+// the window of their SLO.
+type Tracker struct {
+	config *config.Store
+
+	mutex sync.Mutex
+	snis  map[string]*budget
+}
+
+// NewTracker creates a tracker for the SLOs of the configuration.
+func NewTracker(store *config.Store) *Tracker {
+	return &Tracker{
+		config: store,
+		snis:   make(map[string]*budget),
+	}
+}
+
+type bucket struct {
+	index  int64
+	failed float64
+}
+
+type budget struct {
+	window time.Duration
+	width  time.Duration
+	// buckets is a ring of the failed seconds, a bucket is reused
+	// once its index leaves the window.
+	buckets [bucketCount]bucket
+	// failed is the sum of the buckets.
+	failed    float64
+	lastSeen  time.Time
+	exhausted time.Time
+}
+
+func newBudget(window time.Duration) *budget {
+	return &budget{window: window, width: window / bucketCount}
+}
+
+func (b *budget) index(t time.Time) int64 {
+	return t.UnixNano() / int64(b.width)
+}
+
+func (b *budget) add(t time.Time, failed float64) {
+	i := b.index(t)
+	slot := &b.buckets[i%bucketCount]
+	if slot.index != i {
+		if slot.index > i {
+			// The bucket of the time has already left the window.
+			return
+		}
+		b.failed -= slot.failed
+		*slot = bucket{index: i}
+	}
+	slot.failed += failed
+	b.failed += failed
+}
+
+// expire removes the buckets which left the window at the time now.
+func (b *budget) expire(now time.Time) {
+	oldest := b.index(now) - bucketCount
+	for i := range b.buckets {
+		if b.buckets[i].index <= oldest && b.buckets[i].failed != 0 {
+			b.failed -= b.buckets[i].failed
+			b.buckets[i] = bucket{}
+		}
+	}
+}
+
+// Observe records the failed seconds of the increment if its SNI has
+// an SLO.
+func (t *Tracker) Observe(inc *metrics.Inc) {
+	rule := t.config.Get().RuleFor(inc.SNI)
+	if rule == nil || rule.SLO == nil {
+		return
+	}
+	window := rule.SLO.WindowOrDefault()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b, ok := t.snis[inc.SNI]
+	if !ok || b.window != window {
+		b = newBudget(window)
+		t.snis[inc.SNI] = b
+	}
+	if inc.Time.After(b.lastSeen) {
+		b.lastSeen = inc.Time
+	}
+	if inc.FailedSeconds == 0 {
+		return
+	}
+	b.add(inc.Time, inc.FailedSeconds)
+	if b.exhausted.IsZero() && b.failed >= rule.SLO.BudgetSeconds() {
+		b.expire(inc.Time)
+		if b.failed >= rule.SLO.BudgetSeconds() {
+			b.exhausted = inc.Time
+		}
+	}
+}
+
+// Budgets returns the error budgets at the time now, sorted by SNI.
+// The SNIs without an SLO or without traffic within their window are
+// dropped.
+func (t *Tracker) Budgets(now time.Time) []metrics.ErrorBudget {
+	cfg := t.config.Get()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var out []metrics.ErrorBudget
+	for sni, b := range t.snis {
+		rule := cfg.RuleFor(sni)
+		if rule == nil || rule.SLO == nil || rule.SLO.WindowOrDefault() != b.window || now.Sub(b.lastSeen) > b.window {
+			delete(t.snis, sni)
+			continue
+		}
+		b.expire(now)
+		budget := rule.SLO.BudgetSeconds()
+		remaining := budget - b.failed
+		if remaining > 0 {
+			b.exhausted = time.Time{}
+		}
+		out = append(out, metrics.ErrorBudget{
+			SNI:       sni,
+			Budget:    budget,
+			Remaining: remaining,
+			Exhausted: b.exhausted,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SNI < out[j].SNI })
+	return out
+}
@@ -0,0 +1,66 @@
+package slo
+
+import (
+	"testing"
+	"time"
+
+	"m/config"
+	"m/metrics"
+)
+
+func TestBudgets(t *testing.T) {
+	store := config.NewStore(&config.Config{Rules: []config.Rule{
+		// A budget of 36 seconds in an hour.
+		{SNI: "*.example.com", SLO: &config.SLO{Target: 0.99, Window: config.Duration(time.Hour)}},
+	}})
+	tracker := NewTracker(store)
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tracker.Observe(&metrics.Inc{SNI: "other.com", FailedSeconds: 1, Time: start})
+	tracker.Observe(&metrics.Inc{SNI: "a.example.com", ActiveSeconds: 1, Time: start})
+	for i := 0; i < 20; i++ {
+		tracker.Observe(&metrics.Inc{SNI: "b.example.com", FailedSeconds: 1, Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	assertBudgets(t, tracker.Budgets(start.Add(time.Minute)), []metrics.ErrorBudget{
+		{SNI: "a.example.com", Budget: 36, Remaining: 36},
+		{SNI: "b.example.com", Budget: 36, Remaining: 16},
+	})
+
+	exhausted := start.Add(30 * time.Minute)
+	for i := 0; i < 20; i++ {
+		tracker.Observe(&metrics.Inc{SNI: "b.example.com", FailedSeconds: 1, Time: exhausted.Add(time.Duration(i-15) * time.Second)})
+	}
+	assertBudgets(t, tracker.Budgets(exhausted.Add(time.Minute)), []metrics.ErrorBudget{
+		{SNI: "a.example.com", Budget: 36, Remaining: 36},
+		{SNI: "b.example.com", Budget: 36, Remaining: -4, Exhausted: exhausted},
+	})
+
+	// The first failures leave the window, a.example.com had no
+	// traffic within the window.
+	assertBudgets(t, tracker.Budgets(start.Add(time.Hour+time.Minute)), []metrics.ErrorBudget{
+		{SNI: "b.example.com", Budget: 36, Remaining: 16},
+	})
+
+	// The SLO is removed from the configuration.
+	if err := store.Set(&config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	assertBudgets(t, tracker.Budgets(start.Add(time.Hour+time.Minute)), nil)
+}
+
+func assertBudgets(t *testing.T, got, want []metrics.ErrorBudget) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d budgets %+v, want %+v", len(got), got, want)
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.SNI != w.SNI || !almostEqual(g.Budget, w.Budget) || !almostEqual(g.Remaining, w.Remaining) || !g.Exhausted.Equal(w.Exhausted) {
+			t.Errorf("budget %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
@@ -0,0 +1,436 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package testwindow records what the exporter observed for an SNI
+// during a time window, so synthetic tests can verify the effect of
+// network changes.
+package testwindow
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"m/metrics"
+)
+
+const (
+	// MaxWindows is the maximum number of registered windows.
+	MaxWindows = 100
+	// Retention is how long a window is kept after it is complete.
+	Retention = time.Hour
+	// MaxLatencySamples bounds the memory per window, flow and kind of
+	// latency. Once reached, the oldest samples are dropped, the count
+	// of the summary still covers all of them.
+	MaxLatencySamples = 1024
+)
+
+// ErrTooManyWindows is returned if MaxWindows windows are registered.
+var ErrTooManyWindows = errors.New("too many test windows")
+
+// Spec declares a test window.
+type Spec struct {
+	// SNI is a pattern as accepted by path.Match.
+	SNI   string    `json:"sni"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// CallbackURL receives the report with a POST request once the
+	// window is complete. Its host must be one of the callback hosts
+	// of the registry.
+	CallbackURL string `json:"callbackURL,omitempty"`
+}
+
+// Counts are the accounted seconds and connections.
+type Counts struct {
+	ActiveSeconds                  float64 `json:"activeSeconds"`
+	FailedSeconds                  float64 `json:"failedSeconds"`
+	ActiveFailedSeconds            float64 `json:"activeFailedSeconds"`
+	SilencedSeconds                float64 `json:"silencedSeconds"`
+	ExpectedIdleSeconds            float64 `json:"expectedIdleSeconds"`
+	SuccessfulConnections          float64 `json:"successfulConnections"`
+	RejectedConnections            float64 `json:"rejectedConnections"`
+	RejectedConnectionsByClient    float64 `json:"rejectedConnectionsByClient"`
+	RejectedConnectionsByMiddlebox float64 `json:"rejectedConnectionsByMiddlebox"`
+	RejectedConnectionsByNetwork   float64 `json:"rejectedConnectionsByNetwork"`
+}
+
+func (c *Counts) add(inc *metrics.Inc) {
+	c.ActiveSeconds += inc.ActiveSeconds
+	c.FailedSeconds += inc.FailedSeconds
+	c.ActiveFailedSeconds += inc.ActiveFailedSeconds
+	c.SilencedSeconds += inc.SilencedSeconds
+	c.ExpectedIdleSeconds += inc.ExpectedIdleSeconds
+	c.SuccessfulConnections += inc.SuccessfulConnections
+	c.RejectedConnections += inc.RejectedConnections
+	c.RejectedConnectionsByClient += inc.RejectedConnectionsByClient
+	c.RejectedConnectionsByMiddlebox += inc.RejectedConnectionsByMiddlebox
+	c.RejectedConnectionsByNetwork += inc.RejectedConnectionsByNetwork
+}
+
+// Latency summarizes the measured latencies of a kind, in seconds.
+// The quantiles are of the last MaxLatencySamples latencies.
+type Latency struct {
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// Latencies are the latencies of the accounted connections, nil for
+// the kinds without measurements. The latencies are only measured by
+// the program built with LATENCY=1.
+type Latencies struct {
+	Connect   *Latency `json:"connect,omitempty"`
+	Handshake *Latency `json:"handshake,omitempty"`
+	// HandshakeDuration is the time from the SYN to the ServerHello.
+	HandshakeDuration *Latency `json:"handshakeDuration,omitempty"`
+}
+
+// samples are the latencies of the accounted connections of a window
+// or a flow, per kind.
+type samples struct {
+	connect, handshake, handshakeDuration latencySamples
+}
+
+func (s *samples) add(inc *metrics.Inc) {
+	s.connect.add(inc.ConnectLatencies)
+	s.handshake.add(inc.HandshakeLatencies)
+	s.handshakeDuration.add(inc.HandshakeDurations)
+}
+
+func (s *samples) latencies() Latencies {
+	return Latencies{
+		Connect:           s.connect.summarize(),
+		Handshake:         s.handshake.summarize(),
+		HandshakeDuration: s.handshakeDuration.summarize(),
+	}
+}
+
+type latencySamples struct {
+	count  uint64
+	recent []time.Duration
+}
+
+func (l *latencySamples) add(latencies []time.Duration) {
+	l.count += uint64(len(latencies))
+	l.recent = append(l.recent, latencies...)
+	if len(l.recent) > MaxLatencySamples {
+		l.recent = append(l.recent[:0], l.recent[len(l.recent)-MaxLatencySamples:]...)
+	}
+}
+
+func (l *latencySamples) summarize() *Latency {
+	if l.count == 0 {
+		return nil
+	}
+	sorted := make([]float64, len(l.recent))
+	for i, d := range l.recent {
+		sorted[i] = d.Seconds()
+	}
+	sort.Float64s(sorted)
+	quantile := func(q float64) float64 {
+		// The nearest rank, so a quantile is always a measured
+		// latency.
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return sorted[rank]
+	}
+	return &Latency{
+		Count: l.count,
+		Min:   sorted[0],
+		P50:   quantile(0.5),
+		P90:   quantile(0.9),
+		P99:   quantile(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// Flow are the counts and latencies of the connections between a
+// client and a destination.
+type Flow struct {
+	SNI      string `json:"sni"`
+	SourceIP string `json:"sourceIP"`
+	DestIP   string `json:"destIP"`
+	Counts
+	Latencies Latencies `json:"latencies"`
+}
+
+// Report is what was observed during a window.
+type Report struct {
+	ID string `json:"id"`
+	Spec
+	// Complete is set once all the seconds of the window have been
+	// accounted.
+	Complete       bool      `json:"complete"`
+	Total          Counts    `json:"total"`
+	TotalLatencies Latencies `json:"totalLatencies"`
+	Flows          []Flow    `json:"flows"`
+}
+
+type window struct {
+	id           string
+	spec         Spec
+	total        Counts
+	totalSamples samples
+	flows        map[[3]string]*flow
+	callbackSent bool
+}
+
+type flow struct {
+	Flow
+	samples samples
+}
+
+// Registry keeps track of the test windows.
+type Registry struct {
+	// delay is the time it takes until a second is accounted.
+	delay  time.Duration
+	client *http.Client
+	// callbackHosts are the hosts the reports may be sent to.
+	callbackHosts map[string]struct{}
+
+	mutex   sync.Mutex
+	windows map[string]*window
+}
+
+// NewRegistry creates a registry of test windows. A window is
+// complete once the delay has passed after its end. The callbacks of
+// the windows are restricted to the callback hosts, so the admin API
+// cannot be used to send requests to arbitrary services; without
+// callback hosts, windows with a callback are rejected.
+func NewRegistry(delay time.Duration, callbackHosts map[string]struct{}) *Registry {
+	hosts := make(map[string]struct{}, len(callbackHosts))
+	for host := range callbackHosts {
+		if host != "" {
+			hosts[strings.ToLower(host)] = struct{}{}
+		}
+	}
+	return &Registry{
+		delay: delay,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// A redirect could lead to any host.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		callbackHosts: hosts,
+		windows:       make(map[string]*window),
+	}
+}
+
+func (r *Registry) validateCallback(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid callback URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback URL %q is not http or https", callbackURL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("callback URL %q has user info", callbackURL)
+	}
+	if _, ok := r.callbackHosts[strings.ToLower(u.Hostname())]; !ok {
+		return fmt.Errorf("callback host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// Add registers a new window and returns its ID.
+func (r *Registry) Add(spec Spec) (string, error) {
+	if _, err := path.Match(spec.SNI, ""); err != nil {
+		return "", fmt.Errorf("invalid SNI pattern %q: %w", spec.SNI, err)
+	}
+	if !spec.End.After(spec.Start) {
+		return "", fmt.Errorf("test window ends before it starts: %s - %s", spec.Start, spec.End)
+	}
+	if spec.CallbackURL != "" {
+		if err := r.validateCallback(spec.CallbackURL); err != nil {
+			return "", err
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating ID: %w", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.windows) >= MaxWindows {
+		return "", ErrTooManyWindows
+	}
+	w := &window{id: hex.EncodeToString(id), spec: spec, flows: make(map[[3]string]*flow)}
+	r.windows[w.id] = w
+	return w.id, nil
+}
+
+// Delete removes a window. It returns false if there is no such
+// window.
+func (r *Registry) Delete(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.windows[id]
+	delete(r.windows, id)
+	return ok
+}
+
+// Report returns the observations of a window at the time now.
+func (r *Registry) Report(id string, now time.Time) (*Report, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	w, ok := r.windows[id]
+	if !ok {
+		return nil, false
+	}
+	return r.report(w, now), true
+}
+
+func (r *Registry) report(w *window, now time.Time) *Report {
+	report := &Report{
+		ID:             w.id,
+		Spec:           w.spec,
+		Complete:       r.complete(w, now),
+		Total:          w.total,
+		TotalLatencies: w.totalSamples.latencies(),
+		Flows:          make([]Flow, 0, len(w.flows)),
+	}
+	for _, f := range w.flows {
+		report.Flows = append(report.Flows, f.Flow)
+		report.Flows[len(report.Flows)-1].Latencies = f.samples.latencies()
+	}
+	sort.Slice(report.Flows, func(i, j int) bool {
+		a, b := report.Flows[i], report.Flows[j]
+		if a.SNI != b.SNI {
+			return a.SNI < b.SNI
+		}
+		if a.SourceIP != b.SourceIP {
+			return a.SourceIP < b.SourceIP
+		}
+		return a.DestIP < b.DestIP
+	})
+	return report
+}
+
+func (r *Registry) complete(w *window, now time.Time) bool {
+	return !now.Before(w.spec.End.Add(r.delay))
+}
+
+// Observe records the increment in the windows it belongs to.
+func (r *Registry) Observe(inc *metrics.Inc) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, w := range r.windows {
+		if inc.Time.Before(w.spec.Start) || !inc.Time.Before(w.spec.End) {
+			continue
+		}
+		// The patterns are validated, so the error can be ignored.
+		if ok, _ := path.Match(w.spec.SNI, inc.SNI); !ok {
+			continue
+		}
+		w.total.add(inc)
+		w.totalSamples.add(inc)
+		key := [3]string{inc.SNI, inc.SourceIP, inc.DestIP}
+		f, ok := w.flows[key]
+		if !ok {
+			f = &flow{Flow: Flow{SNI: inc.SNI, SourceIP: inc.SourceIP, DestIP: inc.DestIP}}
+			w.flows[key] = f
+		}
+		f.add(inc)
+		f.samples.add(inc)
+	}
+}
+
+// Run sends the reports of the completed windows to their callbacks
+// and removes the windows after the retention.
+func (r *Registry) Run(ctx context.Context, wg *sync.WaitGroup, ticks <-chan time.Time) {
+	defer wg.Done()
+	done := ctx.Done()
+	for {
+		select {
+		case now := <-ticks:
+			for _, report := range r.expire(now) {
+				r.sendCallback(ctx, report)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Count returns the number of registered windows which are still
+// pending and which are complete.
+func (r *Registry) Count(now time.Time) (pending, complete int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, w := range r.windows {
+		if r.complete(w, now) {
+			complete++
+		} else {
+			pending++
+		}
+	}
+	return pending, complete
+}
+
+// expire removes the expired windows and returns the reports that
+// are due to be sent to a callback.
+func (r *Registry) expire(now time.Time) []*Report {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var due []*Report
+	for id, w := range r.windows {
+		if !r.complete(w, now) {
+			continue
+		}
+		if w.spec.CallbackURL != "" && !w.callbackSent {
+			w.callbackSent = true
+			due = append(due, r.report(w, now))
+		}
+		if w.spec.End.Add(r.delay + Retention).Before(now) {
+			delete(r.windows, id)
+		}
+	}
+	return due
+}
+
+func (r *Registry) sendCallback(ctx context.Context, report *Report) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		klog.Errorf("Failed to encode the report of test window %s: %v", report.ID, err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, report.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		klog.Errorf("Failed to create the callback of test window %s: %v", report.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		klog.Errorf("Failed to send the report of test window %s: %v", report.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		klog.Errorf("Callback of test window %s returned %s", report.ID, resp.Status)
+	}
+}
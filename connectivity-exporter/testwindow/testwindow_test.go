@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package testwindow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"m/metrics"
+)
+
+func TestObserve(t *testing.T) {
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	registry := NewRegistry(20*time.Second, nil)
+	id, err := registry.Add(Spec{SNI: "*.example.com", Start: start, End: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for _, inc := range []*metrics.Inc{
+		{SNI: "api.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Time: start, ActiveSeconds: 1, SuccessfulConnections: 2, ConnectLatencies: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}},
+		{SNI: "api.example.com", SourceIP: "10.0.0.2", DestIP: "192.168.0.1", Time: start.Add(time.Second), ActiveSeconds: 1, FailedSeconds: 1, ActiveFailedSeconds: 1, RejectedConnections: 1},
+		{SNI: "api.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Time: start.Add(2 * time.Second), ActiveSeconds: 1, SuccessfulConnections: 1, ConnectLatencies: []time.Duration{20 * time.Millisecond}, HandshakeLatencies: []time.Duration{50 * time.Millisecond}},
+		// Outside of the window.
+		{SNI: "api.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Time: start.Add(-time.Second), ActiveSeconds: 1, ConnectLatencies: []time.Duration{time.Second}},
+		{SNI: "api.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Time: start.Add(time.Minute), ActiveSeconds: 1},
+		{SNI: "example.org", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Time: start, ActiveSeconds: 1},
+	} {
+		registry.Observe(inc)
+	}
+
+	report, ok := registry.Report(id, start.Add(time.Minute))
+	if !ok {
+		t.Fatalf("Report: window %s not found", id)
+	}
+	if report.Complete {
+		t.Errorf("window should not be complete before the delay")
+	}
+	wantTotal := Counts{ActiveSeconds: 3, FailedSeconds: 1, ActiveFailedSeconds: 1, SuccessfulConnections: 3, RejectedConnections: 1}
+	if report.Total != wantTotal {
+		t.Errorf("wrong total: got %+v, want %+v", report.Total, wantTotal)
+	}
+	wantLatencies := Latencies{
+		Connect:   &Latency{Count: 3, Min: 0.01, P50: 0.02, P90: 0.03, P99: 0.03, Max: 0.03},
+		Handshake: &Latency{Count: 1, Min: 0.05, P50: 0.05, P90: 0.05, P99: 0.05, Max: 0.05},
+	}
+	if !reflect.DeepEqual(report.TotalLatencies, wantLatencies) {
+		t.Errorf("wrong total latencies: got %+v, want %+v", report.TotalLatencies, wantLatencies)
+	}
+	wantFlows := []Flow{
+		{SNI: "api.example.com", SourceIP: "10.0.0.1", DestIP: "192.168.0.1", Counts: Counts{ActiveSeconds: 2, SuccessfulConnections: 3}, Latencies: wantLatencies},
+		{SNI: "api.example.com", SourceIP: "10.0.0.2", DestIP: "192.168.0.1", Counts: Counts{ActiveSeconds: 1, FailedSeconds: 1, ActiveFailedSeconds: 1, RejectedConnections: 1}},
+	}
+	if !reflect.DeepEqual(report.Flows, wantFlows) {
+		t.Errorf("wrong flows: got %+v, want %+v", report.Flows, wantFlows)
+	}
+
+	if report, _ := registry.Report(id, start.Add(time.Minute+20*time.Second)); !report.Complete {
+		t.Errorf("window should be complete after the delay")
+	}
+}
+
+func TestAddInvalid(t *testing.T) {
+	registry := NewRegistry(0, map[string]struct{}{"ci.example.com": {}})
+	now := time.Now()
+	for _, spec := range []Spec{
+		{SNI: "[", Start: now, End: now.Add(time.Minute)},
+		{SNI: "api.example.com", Start: now, End: now},
+		{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "http://169.254.169.254/latest/meta-data/"},
+		{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "file:///etc/passwd"},
+		{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "gopher://ci.example.com/"},
+		{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "http://user@ci.example.com/hook"},
+		{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "http://ci.example.com.attacker.test/hook"},
+	} {
+		if _, err := registry.Add(spec); err == nil {
+			t.Errorf("Add(%+v) should fail", spec)
+		}
+	}
+	for _, callbackURL := range []string{"http://ci.example.com/hook", "https://CI.example.com:8443/hook"} {
+		if _, err := registry.Add(Spec{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: callbackURL}); err != nil {
+			t.Errorf("Add with the callback %q: %v", callbackURL, err)
+		}
+	}
+	if _, err := NewRegistry(0, nil).Add(Spec{SNI: "api.example.com", Start: now, End: now.Add(time.Minute), CallbackURL: "http://ci.example.com/hook"}); err == nil {
+		t.Errorf("Add with a callback should fail without callback hosts")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	reports := make(chan Report, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Report{}
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decoding callback: %v", err)
+		}
+		reports <- report
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	registry := NewRegistry(20*time.Second, map[string]struct{}{"127.0.0.1": {}})
+	id, err := registry.Add(Spec{SNI: "api.example.com", Start: start, End: start.Add(time.Minute), CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if due := registry.expire(start.Add(time.Minute)); len(due) != 0 {
+		t.Fatalf("incomplete window should not be due: %v", due)
+	}
+	due := registry.expire(start.Add(time.Minute + 20*time.Second))
+	if len(due) != 1 || due[0].ID != id || !due[0].Complete {
+		t.Fatalf("complete window should be due: %v", due)
+	}
+	registry.sendCallback(context.Background(), due[0])
+	if got := <-reports; got.ID != id {
+		t.Fatalf("wrong report sent: %+v", got)
+	}
+	if due := registry.expire(start.Add(time.Minute + 21*time.Second)); len(due) != 0 {
+		t.Fatalf("callback should only be sent once: %v", due)
+	}
+
+	registry.expire(start.Add(time.Minute + 20*time.Second + Retention + time.Second))
+	if _, ok := registry.Report(id, start); ok {
+		t.Fatalf("window should be removed after the retention")
+	}
+}
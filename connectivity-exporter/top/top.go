@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package top is a terminal dashboard of a running exporter for the
+// nodes without access to Grafana. It scrapes the metrics of the
+// exporter periodically and shows the availability, the failure
+// streaks, the connect latency and the connection rates per SNI.
+package top
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	metricPrefix = "connectivity_exporter_"
+
+	// The ANSI escape sequences of the dashboard.
+	clearScreen = "\033[H\033[2J"
+	bold        = "\033[1m"
+	red         = "\033[31m"
+	yellow      = "\033[33m"
+	green       = "\033[32m"
+	reset       = "\033[0m"
+)
+
+// counters are the cumulative counters of an SNI, summed up over the
+// clients and destinations.
+type counters struct {
+	activeSeconds, activeFailedSeconds, failedSeconds float64
+	successful, failed                                float64
+	// connectP50 and connectP99 are the quantiles of the connect
+	// latency, NaN without latency quantiles.
+	connectP50, connectP99 float64
+}
+
+// parse sums up the counters of the SNIs of the metrics in the
+// Prometheus text format.
+func parse(r io.Reader) (map[string]*counters, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+	snis := make(map[string]*counters)
+	get := func(m *dto.Metric) (*counters, map[string]string) {
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		c, ok := snis[labels["sni"]]
+		if !ok {
+			c = &counters{connectP50: math.NaN(), connectP99: math.NaN()}
+			snis[labels["sni"]] = c
+		}
+		return c, labels
+	}
+	for _, m := range families[metricPrefix+"seconds_total"].GetMetric() {
+		c, labels := get(m)
+		switch labels["kind"] {
+		case "active":
+			c.activeSeconds += m.GetCounter().GetValue()
+		case "active_failed":
+			c.activeFailedSeconds += m.GetCounter().GetValue()
+		case "failed":
+			c.failedSeconds += m.GetCounter().GetValue()
+		}
+	}
+	for _, m := range families[metricPrefix+"connections_total"].GetMetric() {
+		c, labels := get(m)
+		switch labels["kind"] {
+		case "successful":
+			c.successful += m.GetCounter().GetValue()
+		// The resets of the client do not fail the connection.
+		case "rejected", "rejected_by_middlebox", "rejected_by_network":
+			c.failed += m.GetCounter().GetValue()
+		}
+	}
+	for _, m := range families[metricPrefix+"latency_seconds"].GetMetric() {
+		c, labels := get(m)
+		if labels["kind"] != "connect" {
+			continue
+		}
+		for _, q := range m.GetSummary().GetQuantile() {
+			switch q.GetQuantile() {
+			case 0.5:
+				c.connectP50 = q.GetValue()
+			case 0.99:
+				c.connectP99 = q.GetValue()
+			}
+		}
+	}
+	return snis, nil
+}
+
+// row is the line of an SNI on the dashboard.
+type row struct {
+	sni string
+	// availability is the share of the active seconds since the
+	// previous refresh which did not fail, total since the start of
+	// the exporter. They are NaN without active seconds.
+	availability, total float64
+	// streak is the time the SNI has been failing for, 0 if it is not
+	// failing.
+	streak time.Duration
+	// connections and failures are the connections per second.
+	connections, failures  float64
+	connectP50, connectP99 float64
+}
+
+// Dashboard computes the rows of the SNIs from the difference of two
+// scrapes.
+type Dashboard struct {
+	url    string
+	client *http.Client
+
+	previous     map[string]*counters
+	previousTime time.Time
+	// failingSince are the times the failing SNIs started failing.
+	failingSince map[string]time.Time
+}
+
+// NewDashboard creates a dashboard of the metrics served at the URL.
+func NewDashboard(url string) *Dashboard {
+	return &Dashboard{
+		url:          url,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		failingSince: make(map[string]time.Time),
+	}
+}
+
+func (d *Dashboard) scrape(ctx context.Context) (map[string]*counters, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", d.url, resp.Status)
+	}
+	return parse(resp.Body)
+}
+
+// update computes the rows of the counters scraped at now, ordered by
+// their availability, the failing SNIs first.
+func (d *Dashboard) update(current map[string]*counters, now time.Time) []row {
+	elapsed := now.Sub(d.previousTime).Seconds()
+	rows := make([]row, 0, len(current))
+	for sni, c := range current {
+		r := row{sni: sni, availability: math.NaN(), total: ratio(c.activeSeconds-c.activeFailedSeconds, c.activeSeconds), connectP50: c.connectP50, connectP99: c.connectP99}
+		if p, ok := d.previous[sni]; ok && elapsed > 0 {
+			r.availability = ratio(c.activeSeconds-p.activeSeconds-(c.activeFailedSeconds-p.activeFailedSeconds), c.activeSeconds-p.activeSeconds)
+			r.connections = (c.successful + c.failed - p.successful - p.failed) / elapsed
+			r.failures = (c.failed - p.failed) / elapsed
+			// The failed seconds include the failures carried over
+			// to inactive seconds.
+			if c.failedSeconds > p.failedSeconds {
+				if _, ok := d.failingSince[sni]; !ok {
+					d.failingSince[sni] = d.previousTime
+				}
+			} else if c.activeSeconds > p.activeSeconds {
+				delete(d.failingSince, sni)
+			}
+		}
+		if since, ok := d.failingSince[sni]; ok {
+			r.streak = now.Sub(since)
+		}
+		rows = append(rows, r)
+	}
+	for sni := range d.failingSince {
+		if _, ok := current[sni]; !ok {
+			delete(d.failingSince, sni)
+		}
+	}
+	d.previous, d.previousTime = current, now
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].streak != rows[j].streak {
+			return rows[i].streak > rows[j].streak
+		}
+		if a, b := orOne(rows[i].availability), orOne(rows[j].availability); a != b {
+			return a < b
+		}
+		return rows[i].sni < rows[j].sni
+	})
+	return rows
+}
+
+func ratio(a, b float64) float64 {
+	if b <= 0 {
+		return math.NaN()
+	}
+	return a / b
+}
+
+func orOne(v float64) float64 {
+	if math.IsNaN(v) {
+		return 1
+	}
+	return v
+}
+
+// render writes the dashboard, with colors if color is set.
+func render(w io.Writer, rows []row, url string, now time.Time, color bool) {
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + reset
+	}
+	var b strings.Builder
+	if color {
+		b.WriteString(clearScreen)
+	}
+	fmt.Fprintf(&b, "%s  %s  %d SNIs\n\n", paint(bold, "connectivity-exporter top"), url, len(rows))
+	fmt.Fprintf(&b, "%s\n", paint(bold, fmt.Sprintf("%-40s %8s %8s %10s %8s %8s %9s %9s", "SNI", "AVAIL", "TOTAL", "FAILING", "CONN/S", "FAIL/S", "P50", "P99")))
+	for _, r := range rows {
+		code := green
+		switch {
+		case r.streak > 0 || orOne(r.availability) < 0.99:
+			code = red
+		case orOne(r.availability) < 0.999 || orOne(r.total) < 0.999:
+			code = yellow
+		}
+		streak := "-"
+		if r.streak > 0 {
+			streak = r.streak.Truncate(time.Second).String()
+		}
+		line := fmt.Sprintf("%-40s %8s %8s %10s %8.1f %8.1f %9s %9s", truncate(r.sni, 40), percent(r.availability), percent(r.total), streak, r.connections, r.failures, milliseconds(r.connectP50), milliseconds(r.connectP99))
+		fmt.Fprintf(&b, "%s\n", paint(code, line))
+	}
+	fmt.Fprintf(&b, "\nUpdated %s. The connections are accounted about 20s after they started.\n", now.Format("15:04:05"))
+	io.WriteString(w, b.String())
+}
+
+func percent(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", 100*v)
+}
+
+func milliseconds(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", 1000*v)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
+
+// Run refreshes the dashboard on w every interval until the context
+// is done. A failed scrape is shown and retried at the next refresh.
+func Run(ctx context.Context, url string, interval time.Duration, w io.Writer, color bool) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid refresh interval %s, expected a positive duration", interval)
+	}
+	d := NewDashboard(url)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		current, err := d.scrape(ctx)
+		now := time.Now()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(w, "Failed to scrape %s at %s: %v\n", url, now.Format("15:04:05"), err)
+		} else {
+			render(w, d.update(current, now), url, now, color)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package top
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func metricsText(active, activeFailed, failed, successful, rejected float64) string {
+	return fmt.Sprintf(`# TYPE connectivity_exporter_seconds_total counter
+connectivity_exporter_seconds_total{dest_ip="192.168.0.1",kind="active",sni="api.example.com",source_ip="10.0.0.1"} %[1]v
+connectivity_exporter_seconds_total{dest_ip="192.168.0.1",kind="active",sni="api.example.com",source_ip="10.0.0.2"} %[1]v
+connectivity_exporter_seconds_total{dest_ip="192.168.0.1",kind="active_failed",sni="api.example.com",source_ip="10.0.0.1"} %[2]v
+connectivity_exporter_seconds_total{dest_ip="192.168.0.1",kind="failed",sni="api.example.com",source_ip="10.0.0.1"} %[3]v
+connectivity_exporter_seconds_total{dest_ip="192.168.0.2",kind="active",sni="db.example.com",source_ip="10.0.0.1"} 100
+# TYPE connectivity_exporter_connections_total counter
+connectivity_exporter_connections_total{dest_ip="192.168.0.1",kind="successful",sni="api.example.com",source_ip="10.0.0.1"} %[4]v
+connectivity_exporter_connections_total{dest_ip="192.168.0.1",kind="rejected",sni="api.example.com",source_ip="10.0.0.1"} %[5]v
+connectivity_exporter_connections_total{dest_ip="192.168.0.1",kind="rejected_by_client",sni="api.example.com",source_ip="10.0.0.1"} 7
+# TYPE connectivity_exporter_latency_seconds summary
+connectivity_exporter_latency_seconds{kind="connect",sni="api.example.com",quantile="0.5"} 0.002
+connectivity_exporter_latency_seconds{kind="connect",sni="api.example.com",quantile="0.99"} 0.02
+connectivity_exporter_latency_seconds_sum{kind="connect",sni="api.example.com"} 1
+connectivity_exporter_latency_seconds_count{kind="connect",sni="api.example.com"} 100
+`, active, activeFailed, failed, successful, rejected)
+}
+
+func TestParse(t *testing.T) {
+	snis, err := parse(strings.NewReader(metricsText(10, 1, 2, 30, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := *snis["api.example.com"]
+	if want := (counters{activeSeconds: 20, activeFailedSeconds: 1, failedSeconds: 2, successful: 30, failed: 3, connectP50: 0.002, connectP99: 0.02}); api != want {
+		t.Errorf("got %+v, want %+v", api, want)
+	}
+	if db := snis["db.example.com"]; db.activeSeconds != 100 || !math.IsNaN(db.connectP50) {
+		t.Errorf("got %+v", db)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d := NewDashboard("")
+	start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	scrape := func(text string, now time.Time) []row {
+		current, err := parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.update(current, now)
+	}
+	rows := scrape(metricsText(10, 0, 0, 30, 0), start)
+	if !math.IsNaN(rows[0].availability) {
+		t.Errorf("Expected no availability of the first scrape, got %v", rows[0].availability)
+	}
+	// 2 of the 20 active seconds failed.
+	rows = scrape(metricsText(20, 2, 2, 40, 2), start.Add(10*time.Second))
+	api := rows[0]
+	if api.sni != "api.example.com" || api.availability != 0.9 || api.streak != 10*time.Second || api.connections != 1.2 || api.failures != 0.2 {
+		t.Errorf("got %+v", api)
+	}
+	// The failure is carried over while the SNI is inactive.
+	rows = scrape(metricsText(20, 2, 4, 40, 2), start.Add(20*time.Second))
+	if rows[0].streak != 20*time.Second {
+		t.Errorf("got streak %s, want 20s", rows[0].streak)
+	}
+	// The streak ends with an active second without failures.
+	rows = scrape(metricsText(21, 2, 4, 41, 2), start.Add(30*time.Second))
+	if rows[0].sni != "api.example.com" || rows[0].streak != 0 {
+		t.Errorf("got %+v", rows[0])
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, metricsText(10, 1, 1, 30, 3))
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var out strings.Builder
+	if err := Run(ctx, server.URL, time.Hour, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "\033") {
+		t.Error("Expected no escape sequences without colors")
+	}
+	for _, want := range []string{"2 SNIs", "api.example.com", "95.00%", "2.0ms", "20.0ms"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Missing %q in\n%s", want, out.String())
+		}
+	}
+	if err := Run(context.Background(), server.URL, 0, &out, false); err == nil {
+		t.Error("Expected an error for an invalid interval")
+	}
+}
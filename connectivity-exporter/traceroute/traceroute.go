@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package traceroute discovers the path to a destination by sending
+// UDP probes with increasing TTLs and receiving the ICMP errors of
+// the routers on the path.
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// basePort is the destination port of the first probe, the
+	// port of each probe is basePort + TTL.
+	basePort = 33434
+
+	icmpDestinationUnreachable = 3
+	icmpTimeExceeded           = 11
+)
+
+// Hop is a router on the path to the destination.
+type Hop struct {
+	TTL int `json:"ttl"`
+	// IP is empty if the hop did not reply in time.
+	IP  string        `json:"ip,omitempty"`
+	RTT time.Duration `json:"rtt,omitempty"`
+}
+
+// Tracer runs rate-limited traceroutes to IPv4 destinations.
+type Tracer struct {
+	// MaxHops is the highest TTL probed.
+	MaxHops int
+	// Timeout is how long to wait for the reply to a probe.
+	Timeout time.Duration
+	// Interval is the minimum time between two traceroutes to the
+	// same destination.
+	Interval time.Duration
+
+	mutex   sync.Mutex
+	last    map[string]time.Time
+	running chan struct{}
+}
+
+// NewTracer creates a tracer running at most maxConcurrent
+// traceroutes at the same time and at most one per destination and
+// interval.
+func NewTracer(interval time.Duration, maxConcurrent int) *Tracer {
+	return &Tracer{
+		MaxHops:  30,
+		Timeout:  time.Second,
+		Interval: interval,
+		last:     make(map[string]time.Time),
+		running:  make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Allow checks whether a traceroute to the destination may start at
+// the time now. If so, the start is recorded and Done has to be
+// called once the traceroute finished.
+func (t *Tracer) Allow(destIP string, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if last, ok := t.last[destIP]; ok && now.Sub(last) < t.Interval {
+		return false
+	}
+	select {
+	case t.running <- struct{}{}:
+	default:
+		return false
+	}
+	t.last[destIP] = now
+	for ip, last := range t.last {
+		if now.Sub(last) >= t.Interval {
+			delete(t.last, ip)
+		}
+	}
+	return true
+}
+
+// Done releases the slot taken by Allow.
+func (t *Tracer) Done() {
+	<-t.running
+}
+
+// Trace probes the path to the destination until it is reached, the
+// maximum number of hops is exceeded or the context is cancelled.
+// Running it requires the CAP_NET_RAW capability.
+func (t *Tracer) Trace(ctx context.Context, destIP string) ([]Hop, error) {
+	dest := net.ParseIP(destIP).To4()
+	if dest == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %q", destIP)
+	}
+
+	udp, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating UDP socket: %w", err)
+	}
+	defer unix.Close(udp)
+	if err := unix.Bind(udp, &unix.SockaddrInet4{}); err != nil {
+		return nil, fmt.Errorf("binding UDP socket: %w", err)
+	}
+	local, err := unix.Getsockname(udp)
+	if err != nil {
+		return nil, fmt.Errorf("getting UDP socket address: %w", err)
+	}
+	sourcePort := local.(*unix.SockaddrInet4).Port
+
+	icmp, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("creating ICMP socket: %w", err)
+	}
+	defer unix.Close(icmp)
+	// Wake up regularly to check the probe deadline and the context.
+	tv := unix.NsecToTimeval((100 * time.Millisecond).Nanoseconds())
+	if err := unix.SetsockoptTimeval(icmp, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("setting ICMP socket timeout: %w", err)
+	}
+
+	var hops []Hop
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= t.MaxHops; ttl++ {
+		if err := unix.SetsockoptInt(udp, unix.IPPROTO_IP, unix.IP_TTL, ttl); err != nil {
+			return hops, fmt.Errorf("setting TTL: %w", err)
+		}
+		to := &unix.SockaddrInet4{Port: basePort + ttl}
+		copy(to.Addr[:], dest)
+		sent := time.Now()
+		if err := unix.Sendto(udp, nil, 0, to); err != nil {
+			return hops, fmt.Errorf("sending probe: %w", err)
+		}
+
+		hop := Hop{TTL: ttl}
+		reached := false
+		for deadline := sent.Add(t.Timeout); time.Now().Before(deadline); {
+			if err := ctx.Err(); err != nil {
+				return hops, err
+			}
+			n, _, err := unix.Recvfrom(icmp, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				return hops, fmt.Errorf("receiving ICMP: %w", err)
+			}
+			reply, ok := parseReply(buf[:n])
+			if !ok || !reply.probeDest.Equal(dest) || reply.probeSourcePort != sourcePort || reply.probeDestPort != to.Port {
+				continue
+			}
+			hop.IP = reply.from.String()
+			hop.RTT = time.Since(sent)
+			reached = reply.final
+			break
+		}
+		hops = append(hops, hop)
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// reply is an ICMP error caused by a probe.
+type reply struct {
+	from net.IP
+	// final is true if the probe reached the destination or was
+	// rejected on the way, so no further hops can be discovered.
+	final                          bool
+	probeDest                      net.IP
+	probeSourcePort, probeDestPort int
+}
+
+// parseReply parses an IPv4 packet received on a raw ICMP socket. It
+// only accepts the ICMP errors quoting a UDP packet.
+func parseReply(packet []byte) (reply, bool) {
+	ip, ok := ipv4Payload(packet)
+	if !ok || len(ip) < 8 {
+		return reply{}, false
+	}
+	icmpType := ip[0]
+	if icmpType != icmpTimeExceeded && icmpType != icmpDestinationUnreachable {
+		return reply{}, false
+	}
+	// The ICMP error quotes the IP header and the first 8 bytes of
+	// the probe.
+	quoted := ip[8:]
+	probe, ok := ipv4Payload(quoted)
+	if !ok || quoted[9] != unix.IPPROTO_UDP || len(probe) < 4 {
+		return reply{}, false
+	}
+	return reply{
+		from:            net.IP(packet[12:16]),
+		final:           icmpType == icmpDestinationUnreachable,
+		probeDest:       net.IP(quoted[16:20]),
+		probeSourcePort: int(binary.BigEndian.Uint16(probe[0:2])),
+		probeDestPort:   int(binary.BigEndian.Uint16(probe[2:4])),
+	}, true
+}
+
+// ipv4Payload returns the payload of an IPv4 packet.
+func ipv4Payload(packet []byte) ([]byte, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, false
+	}
+	headerLength := int(packet[0]&0x0f) * 4
+	if headerLength < 20 || len(packet) < headerLength {
+		return nil, false
+	}
+	return packet[headerLength:], true
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company and Gardener contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package traceroute
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// icmpError builds an IPv4 packet from the router carrying an ICMP
+// error that quotes a UDP probe to the destination.
+func icmpError(router, dest net.IP, icmpType byte, protocol byte, sourcePort, destPort uint16) []byte {
+	ipHeader := func(protocol byte, source, dest net.IP) []byte {
+		h := make([]byte, 20)
+		h[0] = 0x45
+		h[9] = protocol
+		copy(h[12:16], source.To4())
+		copy(h[16:20], dest.To4())
+		return h
+	}
+	probe := make([]byte, 8)
+	binary.BigEndian.PutUint16(probe[0:2], sourcePort)
+	binary.BigEndian.PutUint16(probe[2:4], destPort)
+
+	icmp := make([]byte, 8)
+	icmp[0] = icmpType
+	packet := ipHeader(1, router, net.IPv4(10, 0, 0, 1))
+	packet = append(packet, icmp...)
+	packet = append(packet, ipHeader(protocol, net.IPv4(10, 0, 0, 1), dest)...)
+	return append(packet, probe...)
+}
+
+func TestParseReply(t *testing.T) {
+	router := net.IPv4(192, 168, 0, 1)
+	dest := net.IPv4(10, 1, 2, 3)
+
+	r, ok := parseReply(icmpError(router, dest, icmpTimeExceeded, 17, 40000, basePort+1))
+	if !ok {
+		t.Fatalf("time exceeded should be parsed")
+	}
+	if !r.from.Equal(router) || !r.probeDest.Equal(dest) || r.final || r.probeSourcePort != 40000 || r.probeDestPort != basePort+1 {
+		t.Fatalf("wrong reply: %+v", r)
+	}
+
+	r, ok = parseReply(icmpError(dest, dest, icmpDestinationUnreachable, 17, 40000, basePort+5))
+	if !ok || !r.final {
+		t.Fatalf("destination unreachable should be final: %+v", r)
+	}
+
+	for desc, packet := range map[string][]byte{
+		"echo reply": icmpError(router, dest, 0, 17, 40000, basePort+1),
+		"quotes TCP": icmpError(router, dest, icmpTimeExceeded, 6, 40000, basePort+1),
+		"truncated":  icmpError(router, dest, icmpTimeExceeded, 17, 40000, basePort+1)[:40],
+		"empty":      nil,
+	} {
+		if _, ok := parseReply(packet); ok {
+			t.Errorf("%s: should not be parsed", desc)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tracer := NewTracer(time.Minute, 1)
+	now := time.Now()
+
+	if !tracer.Allow("10.0.0.1", now) {
+		t.Fatalf("first traceroute should be allowed")
+	}
+	if tracer.Allow("10.0.0.2", now) {
+		t.Fatalf("traceroute should not be allowed while another one is running")
+	}
+	tracer.Done()
+	if tracer.Allow("10.0.0.1", now.Add(30*time.Second)) {
+		t.Fatalf("traceroute to the same destination should be rate limited")
+	}
+	if !tracer.Allow("10.0.0.2", now.Add(30*time.Second)) {
+		t.Fatalf("traceroute to another destination should be allowed")
+	}
+	tracer.Done()
+	if !tracer.Allow("10.0.0.1", now.Add(time.Minute)) {
+		t.Fatalf("traceroute should be allowed after the interval")
+	}
+}